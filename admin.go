@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// This file guards the /admin endpoints. They can reload the configuration,
+// overwrite every note with a backup, or make handlers fail, so on any
+// server reachable by people other than you they need protecting. With
+// ADMIN_API_KEYS set, each request to them needs one of the keys, sent as
+// Authorization: Bearer <key>; the seed, backup and restore commands send
+// the first one. Without it they're closed, answering 403, except in dev
+// mode (DEV_MODE), where they're open for local development. Failing closed
+// means a server deployed without thinking about it doesn't let anyone
+// restore a backup or mint tokens.
+//
+// Browsers can't be made to send a bearer token when following a link, so
+// for the admin UI (see adminui.go) the key can also be given as the
+// password of HTTP Basic authentication, with any user name. Requests for
+// HTML are challenged with Basic, which makes the browser ask for it once
+// and then send it with every request to the admin pages and APIs,
+// fetch() and EventSource included.
+//
+// A browser sends the Basic credentials with every request to the server,
+// including ones another site's page makes it send: a form that POSTs a
+// backup to /admin/restore, say, which would overwrite every user. So
+// admin requests that change something (anything but GET and HEAD), and
+// WebSocket upgrades, which another site could use to read the log tail,
+// are refused if they come from another site. Browsers say where a request
+// comes from with Sec-Fetch-Site, or Origin in older ones; the CLI and curl
+// send neither, and aren't affected.
+//
+// The check is attached to the admin routes alone, in routes(), rather than
+// added to the standard middleware stack, which would have to work out from
+// each request's path whether it applies.
+
+// adminOpenWithoutKeys reports whether the admin endpoints are open when
+// ADMIN_API_KEYS isn't set: only in dev mode. It's a variable so that
+// tests can open them without a key (see openAdmin in admin_test.go).
+var adminOpenWithoutKeys = func(cfg Config) bool {
+	return cfg.DevMode
+}
+
+// adminAuthMiddleware turns away requests without one of ADMIN_API_KEYS,
+// or every request if it isn't set, outside dev mode.
+func (s *Server) adminAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		keys := cfg.AdminAPIKeys
+		if len(keys) == 0 && !adminOpenWithoutKeys(cfg) {
+			writeProblem(w, http.StatusForbidden, "admin endpoints are disabled: set ADMIN_API_KEYS, or DEV_MODE for local development")
+			return
+		}
+		unsafe := r.Method != http.MethodGet && r.Method != http.MethodHead
+		if (unsafe || headerContains(r.Header, "Upgrade", "websocket")) && crossSite(r) {
+			writeProblem(w, http.StatusForbidden, "admin endpoints refuse requests from other sites")
+			return
+		}
+		if len(keys) > 0 && !authorized(r, keys) && !basicAuthorized(r, keys) {
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="go-hello-devops admin", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="go-hello-devops admin"`)
+			}
+			writeProblem(w, http.StatusUnauthorized, "admin endpoints need an API key, sent as Authorization: Bearer <key>")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// basicAuthorized reports whether a request carries one of keys as its
+// Basic authentication password, comparing in constant time like
+// authorized.
+func basicAuthorized(r *http.Request, keys []string) bool {
+	_, given, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// crossSite reports whether a browser sent r on behalf of another site's
+// page. Requests that say nothing about where they come from, as non-browser
+// clients' don't, aren't.
+func crossSite(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		// "none" is the user's own doing: typing the URL, or a bookmark.
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// setAdminKey adds the first of cfg's admin API keys, if it has any, to a
+// request to an admin endpoint.
+func setAdminKey(req *http.Request, cfg Config) {
+	if len(cfg.AdminAPIKeys) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminAPIKeys[0])
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestAdminAuth checks that with ADMIN_API_KEYS set, admin endpoints need a
+// key and the others don't.
+func TestAdminAuth(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	c.Get("/admin/upstreams").Status(http.StatusOK)
+
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1", "k2"}
+	s.cfgMu.Unlock()
+
+	c.Get("/admin/upstreams").
+		Status(http.StatusUnauthorized).
+		HasHeader("WWW-Authenticate", `Bearer realm="go-hello-devops admin"`)
+	c.Header.Set("Authorization", "Bearer nope")
+	c.Post("/admin/reload", nil).Status(http.StatusUnauthorized)
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+
+	c.Header.Set("Authorization", "Bearer k2")
+	routes := testsupport.Decode[RouteListResponse](c.Get("/admin/routes").Status(http.StatusOK)).Routes
+	for _, route := range routes {
+		admin := slices.Contains(route.Middleware, "adminauth")
+		if want := route.Path == "/admin" || strings.HasPrefix(route.Path, "/admin/"); admin != want {
+			t.Errorf("%s: expected adminauth %v, got middleware %v", route.Path, want, route.Middleware)
+		}
+	}
+}
+
+// openAdmin opens the admin endpoints without ADMIN_API_KEYS for the rest
+// of the test, as dev mode does, so that its requests needn't send a key.
+func openAdmin(t testing.TB) {
+	t.Helper()
+	open := adminOpenWithoutKeys
+	adminOpenWithoutKeys = func(Config) bool { return true }
+	t.Cleanup(func() { adminOpenWithoutKeys = open })
+}
+
+// TestAdminClosedWithoutKeys checks that without ADMIN_API_KEYS the admin
+// endpoints, token minting included, are closed outside dev mode.
+func TestAdminClosedWithoutKeys(t *testing.T) {
+	s, c := newTestServer(t)
+
+	c.Post("/admin/tokens", map[string]any{"subject": "alice"}).
+		Status(http.StatusForbidden).
+		JSON(`{"detail": "admin endpoints are disabled: set ADMIN_API_KEYS, or DEV_MODE for local development", "...": "..."}`)
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+
+	s.cfgMu.Lock()
+	s.cfg.DevMode = true
+	s.cfgMu.Unlock()
+	c.Get("/admin/upstreams").Status(http.StatusOK)
+}
+
+// TestAdminBasicAuth checks a browser asking for HTML is challenged with
+// Basic authentication, and the key is accepted as its password.
+func TestAdminBasicAuth(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+
+	c.Header.Set("Accept", "text/html")
+	c.Get("/admin").
+		Status(http.StatusUnauthorized).
+		HasHeader("WWW-Authenticate", `Basic realm="go-hello-devops admin", charset="UTF-8"`)
+	c.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":nope")))
+	c.Get("/admin").Status(http.StatusUnauthorized)
+	c.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("anyone:k1")))
+	c.Get("/admin").Status(http.StatusOK)
+}
+
+// TestAdminCrossSite checks a browser can't be made to change anything
+// through the admin endpoints from another site, with the Basic
+// credentials it sends by itself, while the admin UI and the CLI can.
+func TestAdminCrossSite(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+	c.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("anyone:k1")))
+
+	seed := func(header, value string) *testsupport.Response {
+		req := httptest.NewRequest(http.MethodPost, "/admin/seed", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return c.DoRequest(req)
+	}
+	seed("Sec-Fetch-Site", "cross-site").Status(http.StatusForbidden)
+	seed("Sec-Fetch-Site", "same-site").Status(http.StatusForbidden)
+	seed("Origin", "https://evil.example").Status(http.StatusForbidden)
+	seed("Origin", "null").Status(http.StatusForbidden)
+	seed("Sec-Fetch-Site", "same-origin").Status(http.StatusOK)
+	seed("Origin", "http://example.com").Status(http.StatusOK)
+	seed("", "").Status(http.StatusOK)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	c.DoRequest(req).Status(http.StatusOK)
+	req = httptest.NewRequest(http.MethodGet, "/admin/logs/tail", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	c.DoRequest(req).Status(http.StatusForbidden)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This file implements GET /admin/events, a Server-Sent Events feed of the
+// things an operator wants to hear about as they happen:
+//   - "reload": the configuration was reloaded, with what changed, or a
+//     reload failed (see reload.go)
+//   - "breaker": an upstream's circuit breaker opened or closed (see
+//     balancer.go)
+//   - "health": the readiness status changed (see readiness.go)
+//   - "drain": shutdown began, and the instance is draining connections
+//     (see shutdown.go)
+//   - "maintenance": maintenance mode was switched on or off (see
+//     maintenance.go)
+//   - "flag": a feature flag was switched from the admin UI (see flags.go)
+//
+// The dashboard lists them as they arrive. They're the same events the log
+// has, picked out and structured so a page can show them without parsing
+// log lines. Chat notifications (notify.go) cover some of the same ground
+// for people who aren't watching.
+//
+// Each event has an ID, sent as the SSE "id:" field. When the connection
+// drops, EventSource reconnects by itself and sends the last ID it saw as
+// Last-Event-ID, and the feed replays the events since then from the last
+// maxRecentAdminEvents, so a browser that blinked misses nothing. A new
+// connection gets none of the old ones.
+//
+// With ADMIN_API_KEYS set, the feed needs a key like every admin endpoint.
+// EventSource can't send one, so the dashboard only shows the feed on a
+// server without keys, as in local development; with keys, read it with
+// curl:
+//
+//	curl -N -H 'Authorization: Bearer <key>' http://localhost:8000/admin/events
+
+// Admin event types.
+const (
+	adminEventReload  = "reload"
+	adminEventBreaker = "breaker"
+	adminEventHealth  = "health"
+	adminEventDrain   = "drain"
+
+	adminEventMaintenance = "maintenance"
+	adminEventFlag        = "flag"
+)
+
+// maxRecentAdminEvents is how many events are kept for reconnecting
+// clients.
+const maxRecentAdminEvents = 100
+
+// adminEventsKeepAlive is how often an idle feed sends a comment, so
+// proxies and load balancers don't time out the connection.
+const adminEventsKeepAlive = 30 * time.Second
+
+// AdminEvent is one event in the admin feed. Data depends on the type.
+type AdminEvent struct {
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Data    any       `json:"data,omitempty"`
+}
+
+// AdminEvents keeps the recent admin events and hands new ones to the
+// feeds.
+type AdminEvents struct {
+	mu     sync.Mutex
+	lastID uint64
+	recent []AdminEvent
+	subs   map[chan AdminEvent]struct{}
+}
+
+// newAdminEvents creates an empty event feed.
+func newAdminEvents() *AdminEvents {
+	return &AdminEvents{subs: make(map[chan AdminEvent]struct{})}
+}
+
+// adminEvent publishes an event of eventType, happening now.
+func (s *Server) adminEvent(eventType, message string, data any) {
+	s.adminEvents.Publish(AdminEvent{Type: eventType, Time: s.clock.Now(), Message: message, Data: data})
+}
+
+// Publish gives event the next ID, keeps it, and hands it to every feed. A
+// feed too slow to take it misses it, rather than holding up the caller.
+func (e *AdminEvents) Publish(event AdminEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastID++
+	event.ID = e.lastID
+	e.recent = append(e.recent, event)
+	if len(e.recent) > maxRecentAdminEvents {
+		e.recent = e.recent[1:]
+	}
+	for ch := range e.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the recent events after the one with ID after (none
+// if after is 0), and a channel that receives new ones until cancel is
+// called.
+func (e *AdminEvents) Subscribe(after uint64) (missed []AdminEvent, events <-chan AdminEvent, cancel func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if after > 0 {
+		for _, event := range e.recent {
+			if event.ID > after {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan AdminEvent, maxRecentAdminEvents)
+	e.subs[ch] = struct{}{}
+	return missed, ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subs, ch)
+	}
+}
+
+// BreakerEvent is the data of a "breaker" event.
+type BreakerEvent struct {
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+}
+
+// HealthEvent is the data of a "health" event: the readiness status went
+// from From to To, with the Failing checks.
+type HealthEvent struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Failing []string `json:"failing,omitempty"`
+}
+
+// circuitChanged publishes an upstream's circuit opening or closing.
+func (s *Server) circuitChanged(upstream, state string) {
+	s.adminEvent(adminEventBreaker, fmt.Sprintf("circuit for upstream %s is %s", upstream, state), BreakerEvent{Upstream: upstream, State: state})
+}
+
+// handleAdminEvents streams admin events until the client disconnects.
+func (s *Server) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	after, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	missed, events, cancel := s.adminEvents.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// A comment, so the client knows it's connected before the first event.
+	fmt.Fprint(w, ": connected\n\n")
+	for _, event := range missed {
+		writeAdminEvent(w, event)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := s.clock.NewTicker(adminEventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case event := <-events:
+			writeAdminEvent(w, event)
+		case <-keepAlive.C():
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeAdminEvent writes event in SSE format.
+func writeAdminEvent(w http.ResponseWriter, event AdminEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAdminEvent reads the next event from an admin feed, skipping
+// comments.
+func readAdminEvent(t *testing.T, body *bufio.Reader) (id, eventType string, event AdminEvent) {
+	t.Helper()
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Feed ended: %v", err)
+		}
+		switch line = strings.TrimSuffix(line, "\n"); {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && eventType != "":
+			return id, eventType, event
+		}
+	}
+}
+
+// TestAdminEvents connects to the feed and checks reloads, breakers and
+// health changes arrive, and a reconnecting client gets what it missed.
+func TestAdminEvents(t *testing.T) {
+	openAdmin(t)
+	s, _ := newTestServer(t)
+	// Closed last, after the feeds' connections (cleanups run in reverse).
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	connect := func(lastID string) *bufio.Reader {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/admin/events", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		body := bufio.NewReader(resp.Body)
+		if line, _ := body.ReadString('\n'); line != ": connected\n" {
+			t.Fatalf("Expected the connected comment, got %q", line)
+		}
+		return body
+	}
+	body := connect("")
+
+	resp, err := http.Post(ts.URL+"/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id, eventType, event := readAdminEvent(t, body)
+	if eventType != adminEventReload || !strings.HasPrefix(event.Message, "config reloaded") || id != "1" {
+		t.Errorf("Expected reload event 1, got %s %s %+v", id, eventType, event)
+	}
+
+	u := newTestUpstream(t, "http://a:80", s.balancing(Config{ProxyBreakerFailures: 1, ProxyBreakerCooldown: time.Minute}))
+	u.Pick()
+	u.Done(mustURL(t, "http://a:80"), true)
+	if _, eventType, event := readAdminEvent(t, body); eventType != adminEventBreaker || event.Message != "circuit for upstream test is open" {
+		t.Errorf("Expected the circuit to open, got %s %+v", eventType, event)
+	}
+
+	s.readinessChanged("ready", "degraded", []CheckResult{{Name: "redis", Error: "refused"}})
+	_, eventType, event = readAdminEvent(t, body)
+	if data, _ := json.Marshal(event.Data); eventType != adminEventHealth || string(data) != `{"failing":["redis: refused"],"from":"ready","to":"degraded"}` {
+		t.Errorf("Expected the health change, got %s %+v", eventType, event)
+	}
+
+	// A client that saw event 1 gets 2 and 3 when it reconnects.
+	body = connect("1")
+	if id, eventType, _ := readAdminEvent(t, body); id != "2" || eventType != adminEventBreaker {
+		t.Errorf("Expected the breaker event replayed, got %s %s", id, eventType)
+	}
+	if id, _, _ := readAdminEvent(t, body); id != "3" {
+		t.Errorf("Expected event 3 replayed, got %s", id)
+	}
+}
+
+// TestAdminEventsRecent checks only the latest maxRecentAdminEvents are
+// kept for reconnecting clients.
+func TestAdminEventsRecent(t *testing.T) {
+	events := newAdminEvents()
+	for range maxRecentAdminEvents + 10 {
+		events.Publish(AdminEvent{Type: adminEventReload})
+	}
+	missed, _, cancel := events.Subscribe(1)
+	cancel()
+	if len(missed) != maxRecentAdminEvents || missed[0].ID != 11 {
+		t.Errorf("Expected events 11 onwards, got %d from %d", len(missed), missed[0].ID)
+	}
+}
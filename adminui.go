@@ -0,0 +1,37 @@
+package main
+
+import "net/http"
+
+// This file serves the admin UI at /admin: a page for the things an
+// operator changes or checks by hand, namely maintenance mode, feature
+// flags, the health checks, the rate limit and the configuration. The page
+// is a shell, and static/admin.js fills it in from the admin JSON API
+// (GET /admin/config, /admin/healthchecks, /admin/ratelimit and
+// /admin/maintenance) and makes its changes through it (PUT
+// /admin/maintenance and /admin/flags/{name}), so everything it does can be
+// done, and scripted, with curl as well.
+//
+// The page is an admin route like the rest, so with ADMIN_API_KEYS set the
+// browser asks for a key: leave the user name empty and give the key as the
+// password (see admin.go).
+
+// AdminPage is the data for the admin template.
+type AdminPage struct {
+	Version  string
+	Instance string
+}
+
+// handleAdminUI renders the admin page.
+func (s *Server) handleAdminUI(w http.ResponseWriter, r *http.Request) {
+	s.renderPage(w, "admin.html", http.StatusOK, AdminPage{Version: version, Instance: instanceName()})
+}
+
+// handleAdminConfig lists every setting of the running configuration, with
+// secrets redacted, as the "config" command prints them, and where each
+// value came from: its default, the .env file, the environment, a
+// command-line flag, or the admin API. When an instance behaves unlike its
+// neighbours, comparing this between them shows which setting differs and
+// why, without access to the pod's environment.
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.config().Settings())
+}
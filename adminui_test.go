@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestAdminUI checks the admin page renders and loads its script.
+func TestAdminUI(t *testing.T) {
+	openAdmin(t)
+	_, c := newTestServer(t)
+	page := c.Get("/admin").Status(http.StatusOK).Body.String()
+	if !strings.Contains(page, `<script src="/static/admin.js">`) {
+		t.Errorf("Expected the admin script, got %s", page)
+	}
+	c.Get("/static/admin.js").Status(http.StatusOK)
+}
+
+// TestAdminConfig checks the configuration is listed with secrets
+// redacted, and where each setting came from.
+func TestAdminConfig(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+	c.Header.Set("Authorization", "Bearer k1")
+
+	settings := testsupport.Decode[[]configSetting](c.Get("/admin/config").Status(http.StatusOK))
+	found := 0
+	for _, setting := range settings {
+		switch setting.Name {
+		case "admin_api_keys":
+			found++
+			if setting.Value != redacted || !setting.Reloadable || setting.Source != sourceDefault {
+				t.Errorf("Expected the keys redacted, reloadable and from their default, got %+v", setting)
+			}
+		case "rate_limit":
+			found++
+			if setting.Value != float64(0) {
+				t.Errorf("Expected no rate limit, got %+v", setting)
+			}
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected admin_api_keys and rate_limit, got %+v", settings)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// This file implements session affinity ("sticky sessions") for proxy
+// routes with "sticky": true in GATEWAY_ROUTES_FILE. Each client is pinned
+// to one endpoint with a cookie, so an upstream that keeps state in memory
+// (a login session, a shopping cart, a websocket's room) sees all of one
+// user's requests.
+//
+// The first response to a client sets the cookie to the ID of the endpoint
+// that answered. Later requests go to that endpoint while it's available;
+// if it's gone, ejected or failed over by a retry, another is chosen and
+// the cookie updated. The ID is a hash of the endpoint's address, so
+// internal IPs aren't shown to clients.
+//
+// Affinity works against load balancing: busy users make busy endpoints,
+// and scaling up only helps new users. It's better for upstreams to keep
+// state somewhere shared, but stickiness is a common first step.
+//
+// proxy_affinity_total in /metrics counts how requests were placed: "hit"
+// (the client's endpoint), "new" (the client had none) or "moved".
+
+// affinityCookie holds a client's endpoint ID. It's scoped to the route's
+// prefix, so each sticky route has its own.
+const affinityCookie = "gw_affinity"
+
+// proxyAffinityContextKey carries the endpoint ID a request came with.
+const proxyAffinityContextKey contextKey = "proxy-affinity"
+
+// endpointID identifies an endpoint without revealing its address.
+func endpointID(endpoint *url.URL) string {
+	sum := sha256.Sum256([]byte(endpoint.Host))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pinClient records how a sticky route's request was placed, and points
+// the client's cookie at the endpoint that answered if it didn't already.
+// resp.Request is the request sent to that endpoint.
+func (route *ProxyRoute) pinClient(resp *http.Response) {
+	had, _ := resp.Request.Context().Value(proxyAffinityContextKey).(string)
+	id := endpointID(resp.Request.URL)
+
+	result := "hit"
+	switch {
+	case had == "":
+		result = "new"
+	case had != id:
+		result = "moved"
+	}
+	route.metrics.ObserveAffinity(affinityLabels{Upstream: route.Upstream.Name, Result: result})
+	if result == "hit" {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     affinityCookie,
+		Value:    id,
+		Path:     route.Prefix,
+		HttpOnly: true,
+		Secure:   resp.Request.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// removeCookie takes a cookie out of a request's Cookie headers, so the
+// upstream doesn't see the gateway's own cookie.
+func removeCookie(h http.Header, name string) {
+	var kept []string
+	for _, line := range h.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if n, _, _ := strings.Cut(part, "="); part != "" && n != name {
+				kept = append(kept, part)
+			}
+		}
+	}
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestStickyRoute checks a client stays on the endpoint that first served
+// it, and moves when that endpoint goes away.
+func TestStickyRoute(t *testing.T) {
+	var cookies []string
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookies = append(cookies, r.Header.Get("Cookie"))
+			io.WriteString(w, name)
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+
+	cfg := defaultConfig(t)
+	cfg.GatewayRoutesFile = writeGatewayFile(t, t.TempDir(), `{"routes": [
+		{"path": "/app", "upstream": "`+a.URL+`|`+b.URL+`", "sticky": true}
+	]}`)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	h := s.proxyRouter(s.routes())
+
+	get := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+		req.Header.Set("Cookie", "theme=dark")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get(nil)
+	set := first.Result().Cookies()
+	if len(set) != 1 || set[0].Name != affinityCookie || set[0].Path != "/app" || !set[0].HttpOnly {
+		t.Fatalf("Expected an affinity cookie, got %v", set)
+	}
+	pinned := first.Body.String()
+	for range 5 {
+		rec := get(set[0])
+		if rec.Body.String() != pinned {
+			t.Fatalf("Expected every request on %s, got one on %s", pinned, rec.Body)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Error("Expected no new cookie while the endpoint is the same")
+		}
+	}
+	for _, c := range cookies {
+		if c != "theme=dark" {
+			t.Errorf("Expected only the client's own cookie upstream, got %q", c)
+		}
+	}
+
+	// Take the pinned endpoint away: the client moves, with a new cookie.
+	route, _ := s.proxy.Load().match("/app")
+	for _, e := range route.Upstream.Endpoints() {
+		if endpointID(e) == set[0].Value {
+			route.Upstream.endpoints = []*url.URL{other(route.Upstream.Endpoints(), e)}
+			break
+		}
+	}
+	moved := get(set[0])
+	if moved.Body.String() == pinned || len(moved.Result().Cookies()) != 1 {
+		t.Errorf("Expected the client to move with a new cookie, got %q %v", moved.Body, moved.Result().Cookies())
+	}
+
+	var metrics strings.Builder
+	s.metrics.WriteTo(&metrics)
+	for _, want := range []string{`result="hit"} 5`, `result="new"} 1`, `result="moved"} 1`} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", want, metrics.String())
+		}
+	}
+}
+
+// other returns the endpoint in a pair that isn't e.
+func other(pair []*url.URL, e *url.URL) *url.URL {
+	if pair[0] == e {
+		return pair[1]
+	}
+	return pair[0]
+}
+
+// TestRemoveCookie checks only the named cookie is removed.
+func TestRemoveCookie(t *testing.T) {
+	h := http.Header{"Cookie": {"a=1; gw_affinity=x", "b=2"}}
+	removeCookie(h, affinityCookie)
+	if got := h.Get("Cookie"); got != "a=1; b=2" {
+		t.Errorf("Expected a=1; b=2, got %q", got)
+	}
+
+	h = http.Header{"Cookie": {"gw_affinity=x"}}
+	removeCookie(h, affinityCookie)
+	if _, ok := h["Cookie"]; ok {
+		t.Errorf("Expected no Cookie header, got %v", h)
+	}
+}
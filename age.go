@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// This file implements enough of age (https://age-encryption.org/v1) to
+// encrypt to and decrypt with X25519 keys, the kind age-keygen makes:
+//
+//	AGE-SECRET-KEY-1...  identity (private)
+//	age1...              recipient (public)
+//
+// An age file is a text header followed by the binary payload:
+//
+//	age-encryption.org/v1
+//	-> X25519 <ephemeral public key>
+//	<the file key, encrypted to the recipient>
+//	--- <MAC of the header>
+//	<16-byte nonce><the payload, in 64 KiB ChaCha20-Poly1305 chunks>
+//
+// A random file key encrypts the payload. For each recipient, the header
+// has a stanza with the file key encrypted by a key that the sender derives
+// from a throwaway key pair and the recipient's public key, and that the
+// recipient can derive from the throwaway public key and their private key
+// (X25519 Diffie-Hellman). The MAC, keyed by the file key, stops stanzas
+// being added or changed. Passphrase and SSH key recipients aren't
+// supported; their stanzas are skipped like any other unknown kind.
+
+// ageIntro is the first line of every age file.
+const ageIntro = "age-encryption.org/v1"
+
+// ageChunkSize is how much plaintext each payload chunk holds.
+const ageChunkSize = 64 * 1024
+
+// The Bech32 prefixes of age keys.
+const (
+	ageIdentityPrefix  = "AGE-SECRET-KEY-"
+	ageRecipientPrefix = "age"
+)
+
+// The markers around an ASCII-armored age file, which is how sops stores
+// them.
+const (
+	ageArmorBegin = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd   = "-----END AGE ENCRYPTED FILE-----"
+)
+
+// errNoAgeIdentity is returned when none of the identities can decrypt a
+// file.
+var errNoAgeIdentity = errors.New("no identity matches any of the file's recipients")
+
+// b64 is the encoding of keys and stanza bodies in the header.
+var b64 = base64.RawStdEncoding
+
+// newAgeIdentity generates an identity and returns it with its recipient,
+// like age-keygen.
+func newAgeIdentity() (identity, recipient string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	identity = strings.ToUpper(bech32Encode(strings.ToLower(ageIdentityPrefix), key.Bytes()))
+	return identity, bech32Encode(ageRecipientPrefix, key.PublicKey().Bytes()), nil
+}
+
+// parseAgeIdentities reads identities from text in the format of
+// age-keygen's output: one per line, with blank lines and # comments.
+func parseAgeIdentities(text string) ([]*ecdh.PrivateKey, error) {
+	var keys []*ecdh.PrivateKey
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, data, err := bech32Decode(line)
+		if err != nil || hrp != strings.ToLower(ageIdentityPrefix) {
+			return nil, fmt.Errorf("%.20s...: not an age identity", line)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no age identities found")
+	}
+	return keys, nil
+}
+
+// parseAgeRecipient reads an age1... recipient.
+func parseAgeRecipient(s string) (*ecdh.PublicKey, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil || hrp != ageRecipientPrefix {
+		return nil, fmt.Errorf("%q is not an age recipient", s)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// ageEncrypt encrypts plaintext to the recipients, in the binary format.
+func ageEncrypt(plaintext []byte, recipients []*ecdh.PublicKey) ([]byte, error) {
+	fileKey := make([]byte, 16)
+	rand.Read(fileKey)
+
+	var header bytes.Buffer
+	header.WriteString(ageIntro + "\n")
+	for _, recipient := range recipients {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		share := ephemeral.PublicKey().Bytes()
+		wrapKey := hkdfSHA256(shared, append(share[:len(share):len(share)], recipient.Bytes()...), "age-encryption.org/v1/X25519", chachaKeySize)
+		aead, _ := newChaCha20Poly1305(wrapKey)
+		body := aead.Seal(nil, make([]byte, chachaNonceSize), fileKey, nil)
+		fmt.Fprintf(&header, "-> X25519 %s\n%s\n", b64.EncodeToString(share), b64.EncodeToString(body))
+	}
+	header.WriteString("---")
+	mac := hmac.New(sha256.New, hkdfSHA256(fileKey, nil, "header", sha256.Size))
+	mac.Write(header.Bytes())
+	fmt.Fprintf(&header, " %s\n", b64.EncodeToString(mac.Sum(nil)))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	aead, _ := newChaCha20Poly1305(hkdfSHA256(fileKey, nonce, "payload", chachaKeySize))
+	out := append(header.Bytes(), nonce...)
+	for i := 0; ; i++ {
+		chunk := plaintext[:min(len(plaintext), ageChunkSize)]
+		plaintext = plaintext[len(chunk):]
+		last := len(plaintext) == 0
+		out = aead.Seal(out, ageChunkNonce(i, last), chunk, nil)
+		if last {
+			return out, nil
+		}
+	}
+}
+
+// ageDecrypt decrypts an age file, binary or armored, with whichever of
+// the identities it was encrypted to.
+func ageDecrypt(data []byte, identities []*ecdh.PrivateKey) ([]byte, error) {
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte(ageArmorBegin)) {
+		var err error
+		if data, err = ageDearmor(string(trimmed)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The header is lines of text up to the MAC line.
+	rest, ok := bytes.CutPrefix(data, []byte(ageIntro+"\n"))
+	if !ok {
+		return nil, errors.New("not an age file")
+	}
+	var fileKey []byte
+	for fileKey == nil {
+		line, next, ok := bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			return nil, errors.New("the age header is truncated")
+		}
+		if bytes.HasPrefix(line, []byte("---")) {
+			return nil, errNoAgeIdentity
+		}
+		args := strings.Fields(string(line))
+		if len(args) < 2 || args[0] != "->" {
+			return nil, errors.New("the age header is malformed")
+		}
+
+		// A stanza's body is base64 in lines of 64 characters; the last
+		// line is shorter, even if that means empty.
+		var body []byte
+		rest = next
+		for {
+			line, next, ok := bytes.Cut(rest, []byte("\n"))
+			if !ok {
+				return nil, errors.New("the age header is truncated")
+			}
+			chunk, err := b64.DecodeString(string(line))
+			if err != nil {
+				return nil, fmt.Errorf("the age header is malformed: %w", err)
+			}
+			body, rest = append(body, chunk...), next
+			if len(line) < 64 {
+				break
+			}
+		}
+
+		if args[1] == "X25519" && len(args) == 3 {
+			fileKey = ageUnwrapX25519(args[2], body, identities)
+		}
+	}
+
+	// Skip the rest of the stanzas, then check the MAC, which covers the
+	// header up to and including "---".
+	for !bytes.HasPrefix(rest, []byte("--- ")) {
+		_, next, ok := bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			return nil, errors.New("the age header is truncated")
+		}
+		rest = next
+	}
+	headerLen := len(data) - len(rest) + len("---")
+	macLine, payload, ok := bytes.Cut(rest[len("--- "):], []byte("\n"))
+	if !ok {
+		return nil, errors.New("the age header is truncated")
+	}
+	got, err := b64.DecodeString(string(macLine))
+	if err != nil {
+		return nil, fmt.Errorf("the age header is malformed: %w", err)
+	}
+	mac := hmac.New(sha256.New, hkdfSHA256(fileKey, nil, "header", sha256.Size))
+	mac.Write(data[:headerLen])
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, errors.New("the age header has been tampered with")
+	}
+
+	if len(payload) < 16 {
+		return nil, errors.New("the age payload is truncated")
+	}
+	nonce, payload := payload[:16], payload[16:]
+	aead, _ := newChaCha20Poly1305(hkdfSHA256(fileKey, nonce, "payload", chachaKeySize))
+	var plaintext []byte
+	for i := 0; ; i++ {
+		chunk := payload[:min(len(payload), ageChunkSize+poly1305TagSize)]
+		payload = payload[len(chunk):]
+		last := len(payload) == 0
+		if plaintext, err = aead.Open(plaintext, ageChunkNonce(i, last), chunk, nil); err != nil {
+			return nil, fmt.Errorf("decrypting the age payload: %w", err)
+		}
+		if last {
+			return plaintext, nil
+		}
+	}
+}
+
+// ageUnwrapX25519 tries to decrypt an X25519 stanza's file key with each
+// identity, returning nil if none can.
+func ageUnwrapX25519(share string, body []byte, identities []*ecdh.PrivateKey) []byte {
+	shareBytes, err := b64.DecodeString(share)
+	if err != nil {
+		return nil
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(shareBytes)
+	if err != nil {
+		return nil
+	}
+	for _, identity := range identities {
+		shared, err := identity.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+		salt := append(shareBytes[:len(shareBytes):len(shareBytes)], identity.PublicKey().Bytes()...)
+		aead, _ := newChaCha20Poly1305(hkdfSHA256(shared, salt, "age-encryption.org/v1/X25519", chachaKeySize))
+		if fileKey, err := aead.Open(nil, make([]byte, chachaNonceSize), body, nil); err == nil {
+			return fileKey
+		}
+	}
+	return nil
+}
+
+// ageChunkNonce is the nonce of payload chunk i: an 11-byte big-endian
+// counter, then 1 for the last chunk, so chunks can't be reordered or
+// dropped.
+func ageChunkNonce(i int, last bool) []byte {
+	nonce := make([]byte, chachaNonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// ageArmor returns an age file in its ASCII-armored form: padded base64 in
+// lines of 64 characters between markers.
+func ageArmor(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	b.WriteString(ageArmorBegin + "\n")
+	for len(encoded) > 0 {
+		n := min(len(encoded), 64)
+		b.WriteString(encoded[:n] + "\n")
+		encoded = encoded[n:]
+	}
+	b.WriteString(ageArmorEnd + "\n")
+	return b.String()
+}
+
+// ageDearmor reverses ageArmor.
+func ageDearmor(armored string) ([]byte, error) {
+	body, ok := strings.CutPrefix(armored, ageArmorBegin)
+	if body, ok = strings.CutSuffix(body, ageArmorEnd); !ok {
+		return nil, errors.New("the armored age file is truncated")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, fmt.Errorf("the armored age file is malformed: %w", err)
+	}
+	return data, nil
+}
+
+// hkdfSHA256 derives n bytes from secret with HKDF (RFC 5869): extract a
+// pseudorandom key keyed by salt, then expand it with info.
+func hkdfSHA256(secret, salt []byte, info string, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, prev []byte
+	for counter := byte(1); len(out) < n; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write([]byte(info))
+		expand.Write([]byte{counter})
+		prev = expand.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:n]
+}
+
+// bech32Charset maps 5-bit values to the characters of Bech32 (BIP 173),
+// the encoding of age keys: a human-readable prefix, "1", the data and a
+// six-character checksum.
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Polymod is the checksum function from BIP 173.
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range generator {
+			if top>>i&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+// bech32HRPExpand prepares the prefix for the checksum.
+func bech32HRPExpand(hrp string) []byte {
+	var out []byte
+	for _, c := range []byte(hrp) {
+		out = append(out, c>>5)
+	}
+	out = append(out, 0)
+	for _, c := range []byte(hrp) {
+		out = append(out, c&31)
+	}
+	return out
+}
+
+// bech32Encode encodes data with the lowercase prefix hrp.
+func bech32Encode(hrp string, data []byte) string {
+	values, _ := convertBits(data, 8, 5, true)
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := range 6 {
+		values = append(values, byte(polymod>>(5*(5-i))&31))
+	}
+	var b strings.Builder
+	b.WriteString(hrp + "1")
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	return b.String()
+}
+
+// bech32Decode decodes s, which may be all upper or all lower case, and
+// returns its lowercase prefix and data.
+func bech32Decode(s string) (hrp string, data []byte, err error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("bech32: mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("bech32: malformed")
+	}
+	hrp = s[:sep]
+	var values []byte
+	for _, c := range []byte(s[sep+1:]) {
+		v := strings.IndexByte(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("bech32: invalid character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("bech32: bad checksum")
+	}
+	data, ok := convertBits(values[:len(values)-6], 5, 8, false)
+	if !ok {
+		return "", nil, errors.New("bech32: malformed")
+	}
+	return hrp, data, nil
+}
+
+// convertBits regroups data from groups of from bits to groups of to bits,
+// padding the last group with zeros if pad is set. Without pad, leftover
+// bits must be zero padding, or it reports false.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, bool) {
+	var acc uint32
+	var bits uint
+	var out []byte
+	for _, v := range data {
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&(1<<to-1)))
+		}
+	}
+	if pad && bits > 0 {
+		out = append(out, byte(acc<<(to-bits)&(1<<to-1)))
+	} else if !pad && (bits >= from || acc<<(to-bits)&(1<<to-1) != 0) {
+		return nil, false
+	}
+	return out, true
+}
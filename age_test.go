@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testAgeKey returns a new identity and its recipient.
+func testAgeKey(t *testing.T) (identity string, key *ecdh.PrivateKey, recipient *ecdh.PublicKey) {
+	t.Helper()
+	identity, recipientString, err := newAgeIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseAgeIdentities("# a comment\n\n" + identity + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient, err = parseAgeRecipient(recipientString); err != nil {
+		t.Fatal(err)
+	}
+	return identity, keys[0], recipient
+}
+
+// TestAgeKeys decodes a key from age's own test data and checks its
+// recipient, and that a corrupted key is rejected.
+func TestAgeKeys(t *testing.T) {
+	keys, err := parseAgeIdentities("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys[0].Bytes(), bytes.Repeat([]byte{0x42}, 32)) {
+		t.Errorf("Expected the key 0x42..., got %x", keys[0].Bytes())
+	}
+	if got := bech32Encode(ageRecipientPrefix, keys[0].PublicKey().Bytes()); got != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Errorf("Unexpected recipient %s", got)
+	}
+
+	for _, bad := range []string{"AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEY", "age-secret-key-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX", ""} {
+		if _, err := parseAgeIdentities(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestHKDF checks test case 1 from RFC 5869.
+func TestHKDF(t *testing.T) {
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	got := hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), salt, string(info), 42)
+	if want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"; hex.EncodeToString(got) != want {
+		t.Errorf("Expected %s, got %x", want, got)
+	}
+}
+
+// TestAgeRoundTrip encrypts payloads around the chunk size to two
+// recipients and decrypts them with either.
+func TestAgeRoundTrip(t *testing.T) {
+	_, alice, aliceRecipient := testAgeKey(t)
+	_, bob, bobRecipient := testAgeKey(t)
+	_, eve, _ := testAgeKey(t)
+
+	for _, size := range []int{0, 10, ageChunkSize, ageChunkSize + 1, 2*ageChunkSize + 100} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		encrypted, err := ageEncrypt(plaintext, []*ecdh.PublicKey{aliceRecipient, bobRecipient})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(encrypted), "age-encryption.org/v1\n-> X25519 ") {
+			t.Fatalf("Unexpected header %.60q", encrypted)
+		}
+		for _, identity := range []*ecdh.PrivateKey{alice, bob} {
+			got, err := ageDecrypt(encrypted, []*ecdh.PrivateKey{eve, identity})
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Errorf("%d bytes: expected the plaintext back, got %d bytes, %v", size, len(got), err)
+			}
+		}
+		if got, err := ageDecrypt([]byte(ageArmor(encrypted)), []*ecdh.PrivateKey{bob}); err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: expected the armored file to decrypt, got %v", size, err)
+		}
+	}
+
+	encrypted, _ := ageEncrypt([]byte("secret"), []*ecdh.PublicKey{aliceRecipient})
+	if _, err := ageDecrypt(encrypted, []*ecdh.PrivateKey{eve}); !errors.Is(err, errNoAgeIdentity) {
+		t.Errorf("Expected another identity not to decrypt it, got %v", err)
+	}
+
+	// Dropping the last chunk's final flag, changing the payload or the
+	// header are all detected.
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := ageDecrypt(tampered, []*ecdh.PrivateKey{alice}); err == nil {
+		t.Error("Expected a changed payload to be rejected")
+	}
+	tampered = bytes.Replace(encrypted, []byte("\n---"), []byte("\n-> grease\n\n---"), 1)
+	if _, err := ageDecrypt(tampered, []*ecdh.PrivateKey{alice}); err == nil || !strings.Contains(err.Error(), "tampered") {
+		t.Errorf("Expected an added stanza to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// This file implements Argon2id (RFC 9106), the password hash users.go
+// stores. A password hash has to be slow, so that someone holding a copy
+// of the users can't try billions of guesses a second, and Argon2 is also
+// memory-hard: each hash fills memory (19 MiB by default) with blocks that
+// depend on earlier ones, so guessing on GPUs or custom chips, which have
+// lots of arithmetic but little memory per core, gains far less. The "id"
+// variant reads memory in a password-independent order for the first half
+// of the first pass, which resists side channels, then in a
+// password-dependent order, which resists trading memory for time.
+//
+// Like ChaCha20-Poly1305 (see chacha20poly1305.go), Argon2 isn't in the
+// standard library, so it's written out here, along with the BLAKE2b hash
+// it's built on (RFC 7693). It runs on one goroutine, and is written for
+// clarity; golang.org/x/crypto/argon2 is the one to use outside a
+// demonstration.
+//
+// Hashes are stored in the PHC string format that other implementations
+// read and write, with the parameters and salt alongside the hash, so
+// they can be changed without invalidating stored passwords:
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+
+// argon2Version is the version of Argon2 implemented: 1.3, or 0x13.
+const argon2Version = 0x13
+
+// argon2Block is a block of memory: 1 KiB, as 128 64-bit words.
+type argon2Block [128]uint64
+
+// argon2Params are an Argon2id hash's costs.
+type argon2Params struct {
+	// Memory is in KiB, Time is the number of passes over it and Threads
+	// is the number of lanes it's split into (computed one after another
+	// here, but part of the result all the same).
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// errPasswordHash is returned for a stored hash that can't be read.
+var errPasswordHash = errors.New("not an Argon2id hash")
+
+// argon2id derives keyLen bytes from a password and salt. The secret and
+// associated data of RFC 9106 are included for its test vectors.
+func argon2id(password, salt, secret, data []byte, p argon2Params, keyLen uint32) []byte {
+	lanes := uint32(p.Threads)
+
+	// H0 hashes every input and parameter, so changing any of them
+	// changes every block.
+	var h0 []byte
+	for _, v := range []uint32{lanes, keyLen, p.Memory, p.Time, argon2Version, 2} {
+		h0 = binary.LittleEndian.AppendUint32(h0, v)
+	}
+	for _, b := range [][]byte{password, salt, secret, data} {
+		h0 = binary.LittleEndian.AppendUint32(h0, uint32(len(b)))
+		h0 = append(h0, b...)
+	}
+	h0 = blake2b(64, h0)
+
+	// Memory is split into lanes, and each lane into four segments; every
+	// lane fills a segment (a "slice" across the lanes) before moving on.
+	memory := max(p.Memory, 8*lanes) / (4 * lanes) * (4 * lanes)
+	laneLen := memory / lanes
+	segmentLen := laneLen / 4
+	B := make([]argon2Block, memory)
+
+	// The first two blocks of each lane come from H0.
+	for lane := range lanes {
+		for i := range uint32(2) {
+			in := binary.LittleEndian.AppendUint32(append([]byte{}, h0...), i)
+			in = binary.LittleEndian.AppendUint32(in, lane)
+			blockFromBytes(&B[lane*laneLen+i], argon2Hash(1024, in))
+		}
+	}
+
+	for pass := range p.Time {
+		for slice := range uint32(4) {
+			for lane := range lanes {
+				argon2Segment(B, pass, slice, lane, lanes, laneLen, segmentLen, memory, p.Time)
+			}
+		}
+	}
+
+	// The last blocks of the lanes are XORed and hashed into the result.
+	final := B[laneLen-1]
+	for lane := uint32(1); lane < lanes; lane++ {
+		for i, w := range B[lane*laneLen+laneLen-1] {
+			final[i] ^= w
+		}
+	}
+	out := make([]byte, 0, 1024)
+	for _, w := range final {
+		out = binary.LittleEndian.AppendUint64(out, w)
+	}
+	return argon2Hash(keyLen, out)
+}
+
+// argon2Segment fills one lane's segment of a slice in a pass.
+func argon2Segment(B []argon2Block, pass, slice, lane, lanes, laneLen, segmentLen, memory, passes uint32) {
+	// Argon2id picks which earlier block to mix in from a counter-driven
+	// stream in the first half of the first pass, and from the previous
+	// block's contents after that.
+	independent := pass == 0 && slice < 2
+	var address, input, zero argon2Block
+	if independent {
+		input[0], input[1], input[2], input[3], input[4], input[5] = uint64(pass), uint64(lane), uint64(slice), uint64(memory), uint64(passes), 2
+	}
+	nextAddresses := func() {
+		input[6]++
+		argon2Compress(&address, &zero, &input, false)
+		argon2Compress(&address, &zero, &address, false)
+	}
+
+	start := uint32(0)
+	if pass == 0 && slice == 0 {
+		start = 2
+		if independent {
+			nextAddresses()
+		}
+	}
+	for index := start; index < segmentLen; index++ {
+		cur := lane*laneLen + slice*segmentLen + index
+		prev := cur - 1
+		if cur%laneLen == 0 {
+			prev = cur + laneLen - 1
+		}
+
+		var random uint64
+		if independent {
+			if index%128 == 0 {
+				nextAddresses()
+			}
+			random = address[index%128]
+		} else {
+			random = B[prev][0]
+		}
+
+		refLane := uint32(random>>32) % lanes
+		if pass == 0 && slice == 0 {
+			refLane = lane
+		}
+		ref := refLane*laneLen + argon2RefIndex(pass, slice, index, laneLen, segmentLen, uint32(random), refLane == lane)
+		argon2Compress(&B[cur], &B[prev], &B[ref], pass > 0)
+	}
+}
+
+// argon2RefIndex maps a pseudo-random number to a block of the reference
+// lane that's already been filled, favouring recent ones.
+func argon2RefIndex(pass, slice, index, laneLen, segmentLen, j1 uint32, sameLane bool) uint32 {
+	// The area is every block finished so far, not counting the one being
+	// filled, the one just before it, or the current slice of other lanes,
+	// which may still be in progress. After the first pass, it's every
+	// block but the current segment.
+	var area uint32
+	switch {
+	case pass == 0 && sameLane:
+		area = slice*segmentLen + index - 1
+	case pass == 0:
+		area = slice * segmentLen
+	case sameLane:
+		area = laneLen - segmentLen + index - 1
+	default:
+		area = laneLen - segmentLen
+	}
+	if !sameLane && index == 0 {
+		area--
+	}
+
+	x := uint64(j1) * uint64(j1) >> 32
+	relative := uint64(area) - 1 - uint64(area)*x>>32
+	startAt := uint32(0)
+	if pass > 0 && slice < 3 {
+		startAt = (slice + 1) * segmentLen
+	}
+	return uint32((uint64(startAt) + relative) % uint64(laneLen))
+}
+
+// argon2Compress sets dst to the compression of x and y, XORed into dst's
+// old contents if xor is set, as it is after the first pass.
+func argon2Compress(dst, x, y *argon2Block, xor bool) {
+	var r, q argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	q = r
+	if xor {
+		for i := range q {
+			q[i] ^= dst[i]
+		}
+	}
+
+	// The block is an 8×8 matrix of 16-byte registers; BLAKE2b's round
+	// function mixes each row, then each column.
+	for i := 0; i < 128; i += 16 {
+		argon2Round(&r, i, i+1, i+2, i+3, i+4, i+5, i+6, i+7, i+8, i+9, i+10, i+11, i+12, i+13, i+14, i+15)
+	}
+	for i := 0; i < 16; i += 2 {
+		argon2Round(&r, i, i+1, i+16, i+17, i+32, i+33, i+48, i+49, i+64, i+65, i+80, i+81, i+96, i+97, i+112, i+113)
+	}
+	for i := range dst {
+		dst[i] = q[i] ^ r[i]
+	}
+}
+
+// argon2Round is BLAKE2b's round without a message, on 16 words of b.
+func argon2Round(b *argon2Block, v ...int) {
+	g := func(a, bb, c, d int) {
+		mul := func(x, y uint64) uint64 { return 2 * uint64(uint32(x)) * uint64(uint32(y)) }
+		b[v[a]] += b[v[bb]] + mul(b[v[a]], b[v[bb]])
+		b[v[d]] = bits.RotateLeft64(b[v[d]]^b[v[a]], -32)
+		b[v[c]] += b[v[d]] + mul(b[v[c]], b[v[d]])
+		b[v[bb]] = bits.RotateLeft64(b[v[bb]]^b[v[c]], -24)
+		b[v[a]] += b[v[bb]] + mul(b[v[a]], b[v[bb]])
+		b[v[d]] = bits.RotateLeft64(b[v[d]]^b[v[a]], -16)
+		b[v[c]] += b[v[d]] + mul(b[v[c]], b[v[d]])
+		b[v[bb]] = bits.RotateLeft64(b[v[bb]]^b[v[c]], -63)
+	}
+	g(0, 4, 8, 12)
+	g(1, 5, 9, 13)
+	g(2, 6, 10, 14)
+	g(3, 7, 11, 15)
+	g(0, 5, 10, 15)
+	g(1, 6, 11, 12)
+	g(2, 7, 8, 13)
+	g(3, 4, 9, 14)
+}
+
+// blockFromBytes reads a block from 1024 bytes.
+func blockFromBytes(b *argon2Block, data []byte) {
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+}
+
+// argon2Hash is Argon2's variable-length hash, H', which stretches BLAKE2b
+// to any length by chaining it: each 64-byte hash contributes its first
+// 32 bytes, and the last contributes all of it.
+func argon2Hash(n uint32, in []byte) []byte {
+	in = append(binary.LittleEndian.AppendUint32(nil, n), in...)
+	if n <= 64 {
+		return blake2b(int(n), in)
+	}
+	r := (n+31)/32 - 2
+	v := blake2b(64, in)
+	out := append(make([]byte, 0, n), v[:32]...)
+	for i := uint32(1); i < r; i++ {
+		v = blake2b(64, v)
+		out = append(out, v[:32]...)
+	}
+	return append(out, blake2b(int(n-32*r), v)...)
+}
+
+// blake2bIV is BLAKE2b's initialization vector, the same as SHA-512's.
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+// blake2bSigma is the order the message words are used in, each round.
+var blake2bSigma = [10][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+// blake2b returns the size-byte BLAKE2b hash of data, without a key.
+func blake2b(size int, data []byte) []byte {
+	h := blake2bIV
+	h[0] ^= 0x01010000 ^ uint64(size)
+
+	// Every 128-byte block is compressed with the count of bytes so far,
+	// and the last one, padded with zeros, is flagged as the last.
+	var counter uint64
+	for {
+		var block [128]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		counter += uint64(n)
+		last := len(data) == 0
+		blake2bCompress(&h, &block, counter, last)
+		if last {
+			break
+		}
+	}
+
+	out := make([]byte, 0, 64)
+	for _, w := range h {
+		out = binary.LittleEndian.AppendUint64(out, w)
+	}
+	return out[:size]
+}
+
+// blake2bCompress mixes a 128-byte block into the state h.
+func blake2bCompress(h *[8]uint64, block *[128]byte, counter uint64, last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= counter
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+	for round := range 12 {
+		s := &blake2bSigma[round%10]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+// hashPassword returns the PHC string of a new Argon2id hash of password,
+// with a random salt.
+func hashPassword(password string, p argon2Params) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	hash := argon2id([]byte(password), salt, nil, nil, p, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2Version, p.Memory, p.Time, p.Threads, b64.EncodeToString(salt), b64.EncodeToString(hash))
+}
+
+// checkPassword reports whether password matches a PHC string from
+// hashPassword, hashing it with the parameters and salt stored there.
+func checkPassword(encoded, password string) (bool, error) {
+	p, salt, hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	got := argon2id([]byte(password), salt, nil, nil, p, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(got, hash) == 1, nil
+}
+
+// parsePasswordHash reads the parameters, salt and hash of a PHC string.
+func parsePasswordHash(encoded string) (p argon2Params, salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2Version) {
+		return p, nil, nil, errPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil || p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, errPasswordHash
+	}
+	salt, err1 := b64.DecodeString(parts[4])
+	hash, err2 := b64.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(salt) < 8 || len(hash) < 4 {
+		return p, nil, nil, errPasswordHash
+	}
+	return p, salt, hash, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// TestBLAKE2b checks the BLAKE2b-512 test vector from RFC 7693, appendix A,
+// and hashes of the empty string and of more than one block.
+func TestBLAKE2b(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"", "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{"The quick brown fox jumps over the lazy dog", "a8add4bdddfd93e4877d2746e62817b116364a1fa7bc148d95090bc7333b3673f82401cf7aa2e4cb1ecd90296e3f14cb5413f8ed77be73045b13914cdcd6a918"},
+	} {
+		if got := hex.EncodeToString(blake2b(64, []byte(tc.in))); got != tc.want {
+			t.Errorf("BLAKE2b(%q): expected %s, got %s", tc.in, tc.want, got)
+		}
+	}
+}
+
+// TestArgon2id checks the Argon2id test vector from RFC 9106, section 5.3.
+func TestArgon2id(t *testing.T) {
+	repeat := func(b byte, n int) []byte { return []byte(strings.Repeat(string(b), n)) }
+	got := argon2id(repeat(1, 32), repeat(2, 16), repeat(3, 8), repeat(4, 12), argon2Params{Memory: 32, Time: 3, Threads: 4}, 32)
+	want := "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("Expected %s, got %x", want, got)
+	}
+}
+
+// TestHashPassword checks a hash matches its password and no other, that
+// the same password gets a different salt each time, and that malformed
+// hashes are rejected.
+func TestHashPassword(t *testing.T) {
+	p := argon2Params{Memory: 64, Time: 1, Threads: 2}
+	hash := hashPassword("correct horse", p)
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=2$") {
+		t.Errorf("Unexpected hash %s", hash)
+	}
+	if hash == hashPassword("correct horse", p) {
+		t.Error("Expected a new salt for every hash")
+	}
+	if ok, err := checkPassword(hash, "correct horse"); !ok || err != nil {
+		t.Errorf("Expected the password to match, got %v %v", ok, err)
+	}
+	if ok, _ := checkPassword(hash, "battery staple"); ok {
+		t.Error("Expected another password not to match")
+	}
+	for _, bad := range []string{"", "hunter2", "$2b$10$abcdefghijklmnopqrstuv", strings.Replace(hash, "v=19", "v=16", 1), strings.Replace(hash, "t=1", "t=0", 1)} {
+		if _, err := checkPassword(bad, "hunter2"); err != errPasswordHash {
+			t.Errorf("%q: expected errPasswordHash, got %v", bad, err)
+		}
+	}
+}
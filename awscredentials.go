@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file finds AWS credentials the way the AWS SDKs and CLI do, so the
+// server can call AWS APIs (see awssecrets.go) with whatever identity it
+// was deployed with, and nobody has to put an access key in its
+// configuration. The "default credential chain" tries, in order:
+//
+//  1. AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (and AWS_SESSION_TOKEN)
+//  2. a web identity: the token in AWS_WEB_IDENTITY_TOKEN_FILE, exchanged
+//     with STS for the role AWS_ROLE_ARN. This is how EKS pods get an IAM
+//     role ("IRSA")
+//  3. the shared credentials file, ~/.aws/credentials or
+//     AWS_SHARED_CREDENTIALS_FILE, for the AWS_PROFILE profile ("default")
+//  4. the container credentials endpoint, which ECS tasks and EKS Pod
+//     Identity provide through AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+//     AWS_CONTAINER_CREDENTIALS_FULL_URI
+//  5. the EC2 instance metadata service (IMDSv2), for the instance's role,
+//     unless AWS_EC2_METADATA_DISABLED=true
+//
+// and uses the first that has credentials. AWS_REGION (or
+// AWS_DEFAULT_REGION) says which region to call, and AWS_ENDPOINT_URL
+// points every AWS API at another address, such as LocalStack.
+
+// The addresses of the container credentials endpoint and the instance
+// metadata service, which are the same everywhere.
+const (
+	awsContainerCredentialsHost = "http://169.254.170.2"
+	awsInstanceMetadataURL      = "http://169.254.169.254"
+)
+
+// awsCredentials are the keys requests to AWS are signed with. Source says
+// which link of the chain they came from.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Source          string
+}
+
+// errNoAWSCredentials is returned when no link of the chain has
+// credentials.
+var errNoAWSCredentials = errors.New("no AWS credentials found (set AWS_ACCESS_KEY_ID, AWS_PROFILE or AWS_WEB_IDENTITY_TOKEN_FILE, or run with an IAM role)")
+
+// awsCredentialChain finds credentials. getenv reads the environment, and
+// the URLs are fields so tests can point them at fake servers.
+type awsCredentialChain struct {
+	getenv         func(string) string
+	client         *http.Client
+	containerHost  string
+	metadataURL    string
+	stsURL         string // by default, STS in AWS_REGION
+	credentialsDir string // by default, ~/.aws
+}
+
+// newAWSCredentialChain returns the default chain, reading the process's
+// environment.
+func newAWSCredentialChain(client *http.Client) *awsCredentialChain {
+	return &awsCredentialChain{
+		getenv:        os.Getenv,
+		client:        client,
+		containerHost: awsContainerCredentialsHost,
+		metadataURL:   awsInstanceMetadataURL,
+	}
+}
+
+// Credentials returns the credentials of the first link that has them. A
+// link that's configured but fails is an error, rather than falling
+// through to the next and running with an identity nobody intended.
+func (c *awsCredentialChain) Credentials(ctx context.Context) (awsCredentials, error) {
+	if id, secret := c.getenv("AWS_ACCESS_KEY_ID"), c.getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: c.getenv("AWS_SESSION_TOKEN"), Source: "environment"}, nil
+	}
+	if tokenFile, role := c.getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), c.getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		return c.webIdentity(ctx, tokenFile, role)
+	}
+	if creds, ok, err := c.sharedFile(); ok || err != nil {
+		return creds, err
+	}
+	if uri := c.getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return c.container(ctx, c.containerHost+uri)
+	}
+	if uri := c.getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		return c.container(ctx, uri)
+	}
+	if c.getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		if creds, err := c.instanceMetadata(ctx); err == nil {
+			return creds, nil
+		}
+	}
+	return awsCredentials{}, errNoAWSCredentials
+}
+
+// webIdentity exchanges the token in tokenFile for credentials for role.
+// AssumeRoleWithWebIdentity is one of the few AWS calls that isn't signed:
+// the token is the proof.
+func (c *awsCredentialChain) webIdentity(ctx context.Context, tokenFile, role string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("reading the web identity token: %w", err)
+	}
+	session := c.getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "go-hello-devops-" + instanceName()
+	}
+	q := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	endpoint := c.stsURL
+	if endpoint == "" {
+		endpoint = awsEndpoint(c.getenv, "sts", awsRegion(c.getenv))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(q.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming %s: %w", role, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("assuming %s: STS answered %s", role, resp.Status)
+	}
+
+	// STS's query API answers in XML.
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming %s: %w", role, err)
+	}
+	creds := result.Credentials
+	return awsCredentials{AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.SessionToken, Source: "web identity " + role}, nil
+}
+
+// sharedFile reads the profile's credentials from the shared credentials
+// file, an INI file of [profile] sections. ok is false if there's no file,
+// or no such profile in it.
+func (c *awsCredentialChain) sharedFile() (creds awsCredentials, ok bool, err error) {
+	path := c.getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		dir := c.credentialsDir
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return awsCredentials{}, false, nil
+			}
+			dir = filepath.Join(home, ".aws")
+		}
+		path = filepath.Join(dir, "credentials")
+	}
+	profile := c.getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return awsCredentials{}, false, nil
+	} else if err != nil {
+		return awsCredentials{}, false, err
+	}
+	defer f.Close()
+
+	section := ""
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+		case section == profile:
+			if key, value, found := strings.Cut(line, "="); found {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, false, err
+	}
+	if values["aws_access_key_id"] == "" {
+		return awsCredentials{}, false, nil
+	}
+	return awsCredentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+		Source:          "profile " + profile,
+	}, true, nil
+}
+
+// awsRoleCredentials is how the container endpoint and instance metadata
+// service return credentials.
+type awsRoleCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// container fetches credentials from the container credentials endpoint.
+func (c *awsCredentialChain) container(ctx context.Context, endpoint string) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := c.getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := c.getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("reading the container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	var creds awsRoleCredentials
+	if err := c.getJSON(req, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching container credentials: %w", err)
+	}
+	return awsCredentials{AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.Token, Source: "container"}, nil
+}
+
+// instanceMetadata fetches the EC2 instance role's credentials with
+// IMDSv2: a PUT gets a session token, which the GETs then send. Off EC2
+// nothing answers, so it gives up quickly.
+func (c *awsCredentialChain) instanceMetadata(ctx context.Context) (awsCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.metadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("instance metadata token: %s", resp.Status)
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.metadataURL+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	roles, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if err != nil || resp.StatusCode != http.StatusOK || role == "" {
+		return awsCredentials{}, errors.New("the instance has no role")
+	}
+
+	if req, err = get(role); err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsRoleCredentials
+	if err := c.getJSON(req, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching instance credentials: %w", err)
+	}
+	return awsCredentials{AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.Token, Source: "instance role " + role}, nil
+}
+
+// getJSON sends req and decodes the JSON response into v.
+func (c *awsCredentialChain) getJSON(req *http.Request, v any) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// awsRegion returns the region to call, from AWS_REGION or
+// AWS_DEFAULT_REGION.
+func awsRegion(getenv func(string) string) string {
+	if region := getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return getenv("AWS_DEFAULT_REGION")
+}
+
+// awsEndpoint returns the URL of service's API in region, or
+// AWS_ENDPOINT_URL if it's set.
+func awsEndpoint(getenv func(string) string, service, region string) string {
+	if endpoint := getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return "https://" + service + "." + region + ".amazonaws.com"
+}
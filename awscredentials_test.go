@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testChain returns a credential chain reading env, with nothing listening
+// at the metadata addresses and no home directory credentials.
+func testChain(t *testing.T, env map[string]string) *awsCredentialChain {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(dead.Close)
+	return &awsCredentialChain{
+		getenv:         func(key string) string { return env[key] },
+		client:         dead.Client(),
+		containerHost:  dead.URL,
+		metadataURL:    dead.URL,
+		credentialsDir: t.TempDir(),
+	}
+}
+
+// TestAWSCredentialsEnvAndProfile checks the environment comes first, then
+// the shared credentials file's profile.
+func TestAWSCredentialsEnvAndProfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(file, []byte("[default]\naws_access_key_id = AKDEFAULT\naws_secret_access_key = d\n\n# staging\n[staging]\naws_access_key_id=AKSTAGING\naws_secret_access_key=s\naws_session_token=tok\n"), 0o600)
+
+	for _, tc := range []struct {
+		env  map[string]string
+		want awsCredentials
+	}{
+		{map[string]string{"AWS_ACCESS_KEY_ID": "AKENV", "AWS_SECRET_ACCESS_KEY": "e", "AWS_SHARED_CREDENTIALS_FILE": file}, awsCredentials{"AKENV", "e", "", "environment"}},
+		{map[string]string{"AWS_SHARED_CREDENTIALS_FILE": file}, awsCredentials{"AKDEFAULT", "d", "", "profile default"}},
+		{map[string]string{"AWS_SHARED_CREDENTIALS_FILE": file, "AWS_PROFILE": "staging"}, awsCredentials{"AKSTAGING", "s", "tok", "profile staging"}},
+	} {
+		got, err := testChain(t, tc.env).Credentials(context.Background())
+		if err != nil || got != tc.want {
+			t.Errorf("%v: expected %+v, got %+v %v", tc.env, tc.want, got, err)
+		}
+	}
+
+	_, err := testChain(t, map[string]string{"AWS_SHARED_CREDENTIALS_FILE": file, "AWS_PROFILE": "prod", "AWS_EC2_METADATA_DISABLED": "true"}).Credentials(context.Background())
+	if !errors.Is(err, errNoAWSCredentials) {
+		t.Errorf("Expected no credentials for a missing profile, got %v", err)
+	}
+}
+
+// TestAWSCredentialsWebIdentity exchanges a web identity token with STS.
+func TestAWSCredentialsWebIdentity(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "pod-jwt" || r.Form.Get("RoleArn") != "arn:aws:iam::123:role/web" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials><AccessKeyId>ASIAWEB</AccessKeyId><SecretAccessKey>w</SecretAccessKey><SessionToken>session</SessionToken></Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	token := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(token, []byte("pod-jwt\n"), 0o600)
+
+	chain := testChain(t, map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": token, "AWS_ROLE_ARN": "arn:aws:iam::123:role/web"})
+	chain.stsURL = sts.URL
+	got, err := chain.Credentials(context.Background())
+	if want := (awsCredentials{"ASIAWEB", "w", "session", "web identity arn:aws:iam::123:role/web"}); err != nil || got != want {
+		t.Errorf("Expected %+v, got %+v %v", want, got, err)
+	}
+}
+
+// TestAWSCredentialsMetadata checks the container endpoint and the
+// instance metadata service, with its session token.
+func TestAWSCredentialsMetadata(t *testing.T) {
+	creds := `{"AccessKeyId": "ASIAROLE", "SecretAccessKey": "r", "Token": "t"}`
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/credentials/abc" && r.Header.Get("Authorization") == "":
+			w.Write([]byte(creds))
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("imds-token"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("web-role\n"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/web-role":
+			w.Write([]byte(creds))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer meta.Close()
+
+	chain := testChain(t, map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/abc"})
+	chain.containerHost = meta.URL
+	if got, err := chain.Credentials(context.Background()); err != nil || got.Source != "container" || got.SessionToken != "t" {
+		t.Errorf("Expected the container's credentials, got %+v %v", got, err)
+	}
+
+	chain = testChain(t, nil)
+	chain.metadataURL = meta.URL
+	if got, err := chain.Credentials(context.Background()); err != nil || got.Source != "instance role web-role" || got.AccessKeyID != "ASIAROLE" {
+		t.Errorf("Expected the instance role's credentials, got %+v %v", got, err)
+	}
+}
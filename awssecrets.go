@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// This file lets a setting name a secret kept in AWS instead of holding
+// it, so a deployment on AWS doesn't have to copy secrets into environment
+// variables, where anyone who can read the task definition or Deployment
+// can see them:
+//
+//	LLM_API_KEY=aws-sm://prod/go-hello-devops/llm
+//	SMTP_PASSWORD=aws-sm://prod/go-hello-devops#smtp_password
+//	REDIS_URL=aws-ssm:///prod/go-hello-devops/redis-url
+//
+// aws-sm:// is a secret in Secrets Manager, by name or ARN. If the secret
+// is a JSON object, as the console stores key/value secrets, "#key" picks
+// one value from it. aws-ssm:// is a parameter in SSM Parameter Store,
+// decrypted if it's a SecureString; parameter names in a hierarchy start
+// with "/", hence the third slash.
+//
+// References are resolved when the configuration is loaded, at startup and
+// at every reload, so a rotated secret is picked up by a reload. Requests
+// are signed with the credentials of the default chain (see
+// awscredentials.go). Only string and list settings can be references, and
+// GET /admin/config reports them with the source "aws-sm" or "aws-ssm".
+// Resolving fails loudly: a setting left as "aws-sm://..." would otherwise
+// be used as, say, a password.
+
+// The schemes of references to AWS secrets.
+const (
+	awsSecretsManagerScheme = "aws-sm"
+	awsParameterStoreScheme = "aws-ssm"
+)
+
+// awsResolveTimeout bounds how long resolving the references can take.
+const awsResolveTimeout = 30 * time.Second
+
+// awsSecrets reads secrets from Secrets Manager and Parameter Store.
+type awsSecrets struct {
+	creds  awsCredentials
+	region string
+	getenv func(string) string
+	client *http.Client
+	now    func() time.Time
+}
+
+// newAWSSecrets finds credentials and returns a client for the region.
+func newAWSSecrets(ctx context.Context, getenv func(string) string, chain *awsCredentialChain) (*awsSecrets, error) {
+	creds, err := chain.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Resolving AWS secret references", "credentials", creds.Source, "region", awsRegion(getenv))
+	return &awsSecrets{creds: creds, region: awsRegion(getenv), getenv: getenv, client: chain.client, now: time.Now}, nil
+}
+
+// isAWSReference reports whether a setting's value is a reference, and
+// which kind.
+func isAWSReference(value string) (scheme string, ok bool) {
+	for _, scheme := range []string{awsSecretsManagerScheme, awsParameterStoreScheme} {
+		if strings.HasPrefix(value, scheme+"://") {
+			return scheme, true
+		}
+	}
+	return "", false
+}
+
+// resolveAWSReferences replaces every reference in cfg's string and list
+// settings with the secret it names, creating the client with connect the
+// first time one is found. It returns a description of every reference
+// that can't be resolved.
+func resolveAWSReferences(ctx context.Context, cfg *Config, connect func(context.Context) (*awsSecrets, error)) []string {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	var aws *awsSecrets
+	var problems []string
+	resolve := func(env, ref string) (string, bool) {
+		if aws == nil {
+			var err error
+			if aws, err = connect(ctx); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: can't resolve %s: %v", env, ref, err))
+				return "", false
+			}
+		}
+		value, err := aws.Resolve(ctx, ref)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", env, err))
+			return "", false
+		}
+		return value, true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		switch f := v.Field(i); {
+		case f.Kind() == reflect.String:
+			scheme, ok := isAWSReference(f.String())
+			if !ok {
+				continue
+			}
+			if value, ok := resolve(env, f.String()); ok {
+				f.SetString(value)
+				cfg.setSource(field.Tag.Get("json"), scheme)
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			// Each item of a list can be a reference, and a secret can hold
+			// several comma-separated items itself.
+			items := f.Interface().([]string)
+			found, failed := "", false
+			for j, item := range items {
+				scheme, ok := isAWSReference(item)
+				if !ok {
+					continue
+				}
+				found = scheme
+				if items[j], ok = resolve(env, item); !ok {
+					failed = true
+				}
+			}
+			if found != "" && !failed {
+				setField(f, strings.Join(items, ","))
+				cfg.setSource(field.Tag.Get("json"), found)
+			}
+		}
+	}
+	return problems
+}
+
+// resolveAWSReferencesFromEnv resolves cfg's references with the default
+// credential chain, if it has any.
+func resolveAWSReferencesFromEnv(cfg *Config) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), awsResolveTimeout)
+	defer cancel()
+	return resolveAWSReferences(ctx, cfg, func(ctx context.Context) (*awsSecrets, error) {
+		return newAWSSecrets(ctx, os.Getenv, newAWSCredentialChain(&http.Client{Timeout: 10 * time.Second}))
+	})
+}
+
+// Resolve returns the secret ref names.
+func (a *awsSecrets) Resolve(ctx context.Context, ref string) (string, error) {
+	scheme, name, _ := strings.Cut(ref, "://")
+	switch scheme {
+	case awsSecretsManagerScheme:
+		id, key, hasKey := strings.Cut(name, "#")
+		var resp struct {
+			SecretString string
+		}
+		if err := a.call(ctx, "secretsmanager", "secretsmanager.GetSecretValue", map[string]any{"SecretId": id}, &resp); err != nil {
+			return "", fmt.Errorf("reading %s: %w", ref, err)
+		}
+		if !hasKey {
+			return resp.SecretString, nil
+		}
+		var values map[string]any
+		if err := json.Unmarshal([]byte(resp.SecretString), &values); err != nil {
+			return "", fmt.Errorf("reading %s: the secret isn't a JSON object", ref)
+		}
+		value, ok := values[key].(string)
+		if !ok {
+			return "", fmt.Errorf("reading %s: the secret has no string %q", ref, key)
+		}
+		return value, nil
+	case awsParameterStoreScheme:
+		var resp struct {
+			Parameter struct {
+				Value string
+			}
+		}
+		if err := a.call(ctx, "ssm", "AmazonSSM.GetParameter", map[string]any{"Name": name, "WithDecryption": true}, &resp); err != nil {
+			return "", fmt.Errorf("reading %s: %w", ref, err)
+		}
+		return resp.Parameter.Value, nil
+	}
+	return "", fmt.Errorf("%s is not an AWS secret reference", ref)
+}
+
+// call calls an AWS API that speaks the JSON protocol: a signed POST with
+// the operation in X-Amz-Target and its input as the body. A secret named
+// by ARN is read from the ARN's region.
+func (a *awsSecrets) call(ctx context.Context, service, target string, input map[string]any, output any) error {
+	region := a.region
+	for _, v := range input {
+		if arn, ok := v.(string); ok && strings.HasPrefix(arn, "arn:") {
+			if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[3] != "" {
+				region = parts[3]
+			}
+		}
+	}
+	if region == "" {
+		return fmt.Errorf("AWS_REGION isn't set")
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, awsEndpoint(a.getenv, service, region)+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	a.sign(req, body, service, region, a.now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Errors have a type, like ResourceNotFoundException, and a
+		// message whose capitalization varies between services.
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+			Msg     string `json:"Message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&awsErr)
+		typ := awsErr.Type[strings.LastIndex(awsErr.Type, "#")+1:]
+		return fmt.Errorf("%s answered %s: %s: %s", service, resp.Status, typ, cmp.Or(awsErr.Message, awsErr.Msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+// sign adds a Signature Version 4 Authorization header for service, like
+// S3BlobStore.signRequest does for S3, except that the body is hashed.
+func (a *awsSecrets) sign(req *http.Request, body []byte, service, region string, t time.Time) {
+	t = t.UTC()
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	if a.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Target", "X-Amz-Security-Token"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = v
+		}
+	}
+	u := *req.URL
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	signedHeaders, canonical := canonicalRequest(req.Method, &u, headers, payloadHash)
+	signature := sigV4Signature(a.creds.SecretAccessKey, t, region, service, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, a.creds.AccessKeyID, sigV4Scope(t, region, service), signedHeaders, signature))
+}
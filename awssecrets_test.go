@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeAWS starts a Secrets Manager and Parameter Store for tests, and
+// returns a client for it.
+func newFakeAWS(t *testing.T) *awsSecrets {
+	secrets := map[string]string{
+		"prod/llm":  "sk-aws",
+		"prod/app":  `{"smtp_password": "mail", "port": 25}`,
+		"prod/keys": "k1, k2",
+	}
+	params := map[string]string{"/prod/redis-url": "redis://cache:6379"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		service := map[string]string{"secretsmanager.GetSecretValue": "secretsmanager", "AmazonSSM.GetParameter": "ssm"}[r.Header.Get("X-Amz-Target")]
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKTEST/20240501/eu-west-1/"+service+"/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") ||
+			r.Header.Get("X-Amz-Security-Token") != "session" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var input struct {
+			SecretID       string `json:"SecretId"`
+			Name           string
+			WithDecryption bool
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if service == "ssm" {
+			if value, ok := params[input.Name]; ok && input.WithDecryption {
+				json.NewEncoder(w).Encode(map[string]any{"Parameter": map[string]any{"Name": input.Name, "Value": value}})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ParameterNotFound"}`))
+			return
+		}
+		if value, ok := secrets[input.SecretID]; ok {
+			json.NewEncoder(w).Encode(map[string]any{"Name": input.SecretID, "SecretString": value})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "com.amazonaws.secretsmanager#ResourceNotFoundException", "Message": "Secrets Manager can't find the specified secret."}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	env := map[string]string{"AWS_ENDPOINT_URL": srv.URL, "AWS_REGION": "eu-west-1"}
+	return &awsSecrets{
+		creds:  awsCredentials{AccessKeyID: "AKTEST", SecretAccessKey: "secret", SessionToken: "session"},
+		region: "eu-west-1",
+		getenv: func(key string) string { return env[key] },
+		client: srv.Client(),
+		now:    func() time.Time { return time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC) },
+	}
+}
+
+// TestResolveAWSReferences resolves references in string and list
+// settings, and leaves the rest alone without connecting.
+func TestResolveAWSReferences(t *testing.T) {
+	aws := newFakeAWS(t)
+	connects := 0
+	connect := func(context.Context) (*awsSecrets, error) {
+		connects++
+		return aws, nil
+	}
+
+	cfg := defaultConfig(t)
+	if problems := resolveAWSReferences(context.Background(), &cfg, connect); len(problems) > 0 || connects != 0 {
+		t.Fatalf("Expected nothing to resolve, got %v after %d connects", problems, connects)
+	}
+
+	cfg.LLMAPIKey = "aws-sm://prod/llm"
+	cfg.SMTPPassword = "aws-sm://prod/app#smtp_password"
+	cfg.RedisURL = "aws-ssm:///prod/redis-url"
+	cfg.AdminAPIKeys = []string{"local", "aws-sm://prod/keys"}
+	cfg.BannerText = "not a reference"
+	if problems := resolveAWSReferences(context.Background(), &cfg, connect); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if connects != 1 || cfg.LLMAPIKey != "sk-aws" || cfg.SMTPPassword != "mail" || cfg.RedisURL != "redis://cache:6379" ||
+		!slices.Equal(cfg.AdminAPIKeys, []string{"local", "k1", "k2"}) || cfg.BannerText != "not a reference" {
+		t.Errorf("Expected every reference resolved with one client, got %d connects and %+v", connects, cfg)
+	}
+	for _, setting := range cfg.Settings() {
+		if want := map[string]string{"llm_api_key": "aws-sm", "redis_url": "aws-ssm", "admin_api_keys": "aws-sm"}[setting.Name]; want != "" && setting.Source != want {
+			t.Errorf("%s: expected source %s, got %s", setting.Name, want, setting.Source)
+		}
+	}
+}
+
+// TestResolveAWSReferencesErrors checks every unresolvable reference is
+// reported.
+func TestResolveAWSReferencesErrors(t *testing.T) {
+	aws := newFakeAWS(t)
+	cfg := defaultConfig(t)
+	cfg.LLMAPIKey = "aws-sm://prod/missing"
+	cfg.SMTPPassword = "aws-sm://prod/app#port"
+	cfg.RedisURL = "aws-ssm://nope"
+	problems := resolveAWSReferences(context.Background(), &cfg, func(context.Context) (*awsSecrets, error) { return aws, nil })
+	want := []string{
+		"LLM_API_KEY: reading aws-sm://prod/missing: secretsmanager answered 400 Bad Request: ResourceNotFoundException: Secrets Manager can't find the specified secret.",
+		"REDIS_URL: reading aws-ssm://nope: ssm answered 400 Bad Request: ParameterNotFound: ",
+		`SMTP_PASSWORD: reading aws-sm://prod/app#port: the secret has no string "port"`,
+	}
+	slices.Sort(problems)
+	if !slices.Equal(problems, want) {
+		t.Errorf("Expected %q, got %q", want, problems)
+	}
+}
+
+// TestAWSReferenceRegionFromARN checks a secret named by ARN is read from
+// the ARN's region.
+func TestAWSReferenceRegionFromARN(t *testing.T) {
+	aws := newFakeAWS(t)
+	aws.region = ""
+	_, err := aws.Resolve(context.Background(), "aws-sm://arn:aws:secretsmanager:us-east-2:123:secret:prod/llm")
+	// The fake only accepts eu-west-1, so a 403 means the ARN's region was
+	// used; without one it wouldn't have been called at all.
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected the call to be signed for us-east-2, got %v", err)
+	}
+	if _, err := aws.Resolve(context.Background(), "aws-sm://prod/llm"); err == nil || !strings.Contains(err.Error(), "AWS_REGION isn't set") {
+		t.Errorf("Expected a missing region to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// This file implements backup and restore of the data store. Stateful
+// applications are where operations gets interesting: a backup you've never
+// restored is only a hope, so both directions are exposed and easy to try.
+//
+// A backup is a gzip-compressed tar archive (the same .tar.gz format you'd
+// use for any files) containing two entries:
+//
+//	manifest.json   format version, creation time, record counts and the
+//	                SHA-256 checksum of store.json
+//	store.json      the data itself
+//
+// On restore the checksum is recomputed and compared, so a truncated
+// download or an edited file is rejected before it can replace good data.
+
+// backupFormatVersion is bumped whenever the layout of store.json changes,
+// so an old server never misreads a newer backup.
+const backupFormatVersion = 1
+
+// maxBackupSize limits restore uploads, and what they decompress to.
+// Reading an unbounded request body into memory is an easy way to let one
+// request crash the server, and so is a few kilobytes of gzip that expand
+// to gigabytes of zeros (a "decompression bomb").
+const maxBackupSize = 64 << 20 // 64 MiB
+
+// BackupManifest describes a backup archive.
+type BackupManifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	SHA256        string    `json:"sha256"`
+	Tenants       int       `json:"tenants"`
+	Notes         int       `json:"notes"`
+}
+
+// newManifest describes a snapshot and its serialized form, made at now.
+func newManifest(snap StoreSnapshot, data []byte, now time.Time) BackupManifest {
+	sum := sha256.Sum256(data)
+	m := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     now.UTC(),
+		SHA256:        hex.EncodeToString(sum[:]),
+		Tenants:       len(snap.Tenants),
+	}
+	for _, t := range snap.Tenants {
+		m.Notes += len(t.Notes)
+	}
+	return m
+}
+
+// writeBackup writes a snapshot, made at now, as a .tar.gz archive.
+func writeBackup(w io.Writer, snap StoreSnapshot, now time.Time) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifest, err := json.MarshalIndent(newManifest(snap, data, now), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Writers stack: tar writes into gzip, which writes into w.
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", manifest},
+		{"store.json", data},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0o600, Size: int64(len(f.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+
+	// Close flushes buffered data; forgetting it produces a corrupt archive.
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readBackup reads and verifies a .tar.gz archive made by writeBackup.
+func readBackup(r io.Reader) (StoreSnapshot, BackupManifest, error) {
+	var snap StoreSnapshot
+	var manifest BackupManifest
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return snap, manifest, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+
+	// Only the two files we need are kept, and the whole archive may only
+	// decompress to maxBackupSize.
+	tooLarge := fmt.Errorf("archive is larger than %d bytes when decompressed", maxBackupSize)
+	limited := &io.LimitedReader{R: gz, N: maxBackupSize}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(limited)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if limited.N <= 0 {
+				return snap, manifest, tooLarge
+			}
+			return snap, manifest, fmt.Errorf("reading archive: %w", err)
+		}
+		if hdr.Name != "manifest.json" && hdr.Name != "store.json" {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			if limited.N <= 0 {
+				return snap, manifest, tooLarge
+			}
+			return snap, manifest, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = data
+	}
+
+	rawManifest, ok := files["manifest.json"]
+	if !ok {
+		return snap, manifest, errors.New("archive has no manifest.json")
+	}
+	data, ok := files["store.json"]
+	if !ok {
+		return snap, manifest, errors.New("archive has no store.json")
+	}
+
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return snap, manifest, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return snap, manifest, fmt.Errorf("unsupported backup format version %d (this server reads version %d)",
+			manifest.FormatVersion, backupFormatVersion)
+	}
+
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != manifest.SHA256 {
+		return snap, manifest, fmt.Errorf("checksum mismatch: manifest says %s, data is %s", manifest.SHA256, got)
+	}
+
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, manifest, fmt.Errorf("invalid store data: %w", err)
+	}
+	return snap, manifest, nil
+}
+
+// handleBackup downloads a backup of the whole store.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	// Build the archive in memory first so that an error can still be
+	// reported with a proper status code.
+	var buf bytes.Buffer
+	now := s.clock.Now()
+	if err := writeBackup(&buf, s.store.Snapshot(), now); err != nil {
+		writeProblem(w, http.StatusInternalServerError, fmt.Sprintf("creating backup: %v", err))
+		return
+	}
+
+	// Content-Disposition: attachment makes browsers download the file
+	// instead of trying to display it.
+	name := "backup-" + now.UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handleRestore replaces the store's contents with an uploaded backup.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxBackupSize)
+
+	snap, manifest, err := readBackup(body)
+	if err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("restore rejected: %v", err))
+		return
+	}
+
+	s.store.Restore(snap)
+	writeJSON(w, http.StatusOK, manifest)
+}
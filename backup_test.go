@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBackupRoundTrip backs up one server and restores into another.
+func TestBackupRoundTrip(t *testing.T) {
+	openAdmin(t)
+	src := newServer(Config{})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	src.useClock(newFakeClock(now))
+	src.store.CreateNote("acme", "Hello", "World")
+	src.store.CreateNote("globex", "Second", "")
+	src.store.IncrementCounter("acme")
+
+	rec := httptest.NewRecorder()
+	src.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment") {
+		t.Errorf("Expected an attachment, got Content-Disposition %q", cd)
+	}
+	if _, manifest, err := readBackup(bytes.NewReader(rec.Body.Bytes())); err != nil || !manifest.CreatedAt.Equal(now) {
+		t.Errorf("Expected the manifest to be dated by the server's clock, got %v (%v)", manifest.CreatedAt, err)
+	}
+
+	dst := newServer(Config{})
+	dst.store.CreateNote("acme", "Will be replaced", "")
+
+	rec2 := httptest.NewRecorder()
+	dst.routes().ServeHTTP(rec2, httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(rec.Body.Bytes())))
+	if rec2.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec2.Code, rec2.Body.String())
+	}
+
+	notes := dst.store.ListNotes("acme")
+	if len(notes) != 1 || notes[0].Title != "Hello" {
+		t.Errorf("Expected the restored acme note, got %+v", notes)
+	}
+	if got := len(dst.store.ListNotes("globex")); got != 1 {
+		t.Errorf("Expected 1 globex note, got %d", got)
+	}
+	if got := dst.store.Counter("acme"); got != 1 {
+		t.Errorf("Expected acme counter 1, got %d", got)
+	}
+}
+
+// TestRestoreRejectsBadArchives checks the integrity checks. A rejected
+// restore must leave the existing data untouched.
+func TestRestoreRejectsBadArchives(t *testing.T) {
+	openAdmin(t)
+	var good bytes.Buffer
+	if err := writeBackup(&good, newStore().Snapshot(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"not gzip", []byte("hello")},
+		{"truncated", good.Bytes()[:good.Len()/2]},
+		{"tampered data", tamperedBackup(t)},
+		{"decompression bomb", bombBackup(t)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(Config{})
+			srv.store.CreateNote("acme", "Keep me", "")
+
+			rec := httptest.NewRecorder()
+			srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(tt.body)))
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("Expected status 422, got %d", rec.Code)
+			}
+			if got := len(srv.store.ListNotes("acme")); got != 1 {
+				t.Errorf("Expected existing data to survive, got %d notes", got)
+			}
+		})
+	}
+}
+
+// tamperedBackup builds an archive whose store.json doesn't match the
+// checksum in its manifest.
+func tamperedBackup(t testing.TB) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range map[string]string{
+		"manifest.json": `{"format_version": 1, "sha256": "0000"}`,
+		"store.json":    `{"tenants": {}}`,
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// bombBackup builds a small archive that decompresses to more than
+// maxBackupSize.
+func bombBackup(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "padding", Mode: 0o600, Size: maxBackupSize + 1})
+	tw.Write(make([]byte, maxBackupSize+1))
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// FuzzReadBackup reads arbitrary archives.
+//
+//	go test -fuzz FuzzReadBackup -fuzztime 30s
+func FuzzReadBackup(f *testing.F) {
+	var good bytes.Buffer
+	if err := writeBackup(&good, newStore().Snapshot(), time.Now()); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(good.Bytes())
+	f.Add(tamperedBackup(f))
+	f.Add([]byte("hello"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readBackup(bytes.NewReader(data))
+	})
+}
+
+// TestBackupAndRestoreCommands runs both commands against a test server
+// whose admin endpoints need the key from ADMIN_API_KEYS.
+func TestBackupAndRestoreCommands(t *testing.T) {
+	t.Setenv("ADMIN_API_KEYS", "backup-key")
+	srv := newServer(Config{AdminAPIKeys: []string{"backup-key"}})
+	srv.store.CreateNote("acme", "Hello", "")
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"backup", "-url", ts.URL + "/admin/backup", "-o", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("backup: expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "1 notes") {
+		t.Errorf("Expected backup output to count the note, got %q", stdout.String())
+	}
+
+	srv.store.Restore(StoreSnapshot{})
+
+	stdout.Reset()
+	if code := runCLI([]string{"restore", "-url", ts.URL + "/admin/restore", "-i", file}, &stdout, &stderr); code != 0 {
+		t.Fatalf("restore: expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if got := len(srv.store.ListNotes("acme")); got != 1 {
+		t.Errorf("Expected the note to be restored, got %d notes", got)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// This file decides which of an upstream's endpoints gets each proxied
+// request, and stops sending requests to endpoints, or whole upstreams,
+// that are failing. A load balancer in front of the upstream would do this
+// too; doing it in the client instead saves a hop, and is how service
+// meshes like Istio and Linkerd balance traffic.
+//
+// PROXY_LB_STRATEGY chooses between two strategies:
+//   - round_robin takes the endpoints in turn. Simple and fair when every
+//     request costs about the same.
+//   - least_connections picks the endpoint with the fewest requests in
+//     flight, so slow requests on one endpoint don't pile up behind each
+//     other while the others sit idle.
+//
+// Passive health checking ("outlier detection" in Envoy) watches the real
+// traffic instead of sending probes: an endpoint whose last
+// PROXY_EJECT_AFTER requests all failed is ejected, skipped for
+// PROXY_EJECT_DURATION, then tried again. If every endpoint is ejected,
+// they're all used anyway: some chance of success beats none.
+//
+// A circuit breaker protects the upstream as a whole. After
+// PROXY_BREAKER_FAILURES failures in a row the circuit opens and requests
+// fail straight away with 503, instead of queueing up for a service that's
+// down (and making its recovery harder). After PROXY_BREAKER_COOLDOWN it's
+// half-open: one trial request is let through, and closes the circuit if
+// it succeeds or opens it again if it fails.
+//
+// A failure is a request that got no response, or 502, 503 or 504. Other
+// errors, like 404 or 500, are the upstream answering, so don't count.
+
+// Load balancing strategies.
+const (
+	strategyRoundRobin       = "round_robin"
+	strategyLeastConnections = "least_connections"
+)
+
+// errCircuitOpen is returned by Upstream.Pick while the circuit is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// balancing is how an upstream's endpoints are chosen and failures
+// handled. The zero value is round robin with no ejection or breaker.
+type balancing struct {
+	strategy        string
+	ejectAfter      int // 0 never ejects
+	ejectFor        time.Duration
+	breakerFailures int // 0 never opens the circuit
+	breakerCooldown time.Duration
+
+	// onCircuit, if set, is told when the circuit opens or closes. It's
+	// called with the upstream locked, so mustn't call back into it.
+	onCircuit func(upstream, state string)
+
+	// clock, if set, times ejections and the circuit's cooldown instead
+	// of time.Now. It's a function so that it follows the server's clock
+	// when a test swaps it (see clock.go).
+	clock func() time.Time
+}
+
+// now returns the time ejections and the circuit are measured against.
+func (b balancing) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock()
+}
+
+// balancingFromConfig returns the balancing settings in cfg.
+func balancingFromConfig(cfg Config) balancing {
+	return balancing{
+		strategy:        cfg.ProxyLBStrategy,
+		ejectAfter:      cfg.ProxyEjectAfter,
+		ejectFor:        cfg.ProxyEjectDuration,
+		breakerFailures: cfg.ProxyBreakerFailures,
+		breakerCooldown: cfg.ProxyBreakerCooldown,
+	}
+}
+
+// endpointState is what's known about one endpoint's recent requests.
+type endpointState struct {
+	active       int // requests in flight
+	failures     int // in a row
+	ejectedUntil time.Time
+}
+
+// circuit is an upstream's circuit breaker.
+type circuit struct {
+	failures  int // in a row, across all endpoints
+	openUntil time.Time
+	trial     bool // a half-open trial request is in flight
+}
+
+// state returns "closed", "open" or "half-open".
+func (c *circuit) state(b balancing, now time.Time) string {
+	switch {
+	case b.breakerFailures == 0 || c.failures < b.breakerFailures:
+		return "closed"
+	case now.Before(c.openUntil):
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// setBalancing sets how the upstream's endpoints are chosen.
+func (u *Upstream) setBalancing(b balancing) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.balancing = b
+}
+
+// state returns the state of an endpoint, creating it if needed. u.mu must
+// be held.
+func (u *Upstream) state(endpoint *url.URL) *endpointState {
+	if u.states == nil {
+		u.states = make(map[string]*endpointState)
+	}
+	st, ok := u.states[endpoint.Host]
+	if !ok {
+		st = &endpointState{}
+		u.states[endpoint.Host] = st
+	}
+	return st
+}
+
+// Pick chooses an endpoint for a request. Every successful Pick must be
+// followed by a call to Done when the request is over.
+func (u *Upstream) Pick() (*url.URL, error) {
+	return u.PickPreferring("")
+}
+
+// PickPreferring is Pick, except that the endpoint with the given ID (see
+// endpointID) is chosen if it's available, for session affinity.
+func (u *Upstream) PickPreferring(id string) (*url.URL, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.balancing.now()
+
+	if len(u.endpoints) == 0 {
+		return nil, fmt.Errorf("upstream %s: %w", u.Name, errNoEndpoints)
+	}
+	switch u.circuit.state(u.balancing, now) {
+	case "open":
+		return nil, fmt.Errorf("upstream %s: %w", u.Name, errCircuitOpen)
+	case "half-open":
+		if u.circuit.trial {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, errCircuitOpen)
+		}
+		u.circuit.trial = true
+	}
+
+	candidates := slices.DeleteFunc(slices.Clone(u.endpoints), func(e *url.URL) bool {
+		return now.Before(u.state(e).ejectedUntil)
+	})
+	if len(candidates) == 0 {
+		candidates = u.endpoints
+	}
+
+	// Round robin starts where the last pick left off; least connections
+	// starts there too, so ties are shared out rather than always going to
+	// the first endpoint.
+	start := int(u.next % uint64(len(candidates)))
+	u.next++
+	chosen := candidates[start]
+	if i := slices.IndexFunc(candidates, func(e *url.URL) bool { return id != "" && endpointID(e) == id }); i >= 0 {
+		chosen = candidates[i]
+	} else if u.balancing.strategy == strategyLeastConnections {
+		for i := range candidates {
+			e := candidates[(start+i)%len(candidates)]
+			if u.state(e).active < u.state(chosen).active {
+				chosen = e
+			}
+		}
+	}
+	u.state(chosen).active++
+	return chosen, nil
+}
+
+// Done records how a request to an endpoint from Pick went.
+func (u *Upstream) Done(endpoint *url.URL, failed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b := u.balancing
+	now := b.now()
+
+	st := u.state(endpoint)
+	st.active = max(st.active-1, 0)
+	u.circuit.trial = false
+	if !failed {
+		if u.circuit.state(b, now) != "closed" {
+			slog.Info("Upstream circuit closed", "upstream", u.Name)
+			if b.onCircuit != nil {
+				b.onCircuit(u.Name, "closed")
+			}
+		}
+		st.failures, u.circuit.failures = 0, 0
+		return
+	}
+
+	st.failures++
+	if b.ejectAfter > 0 && st.failures >= b.ejectAfter && !now.Before(st.ejectedUntil) {
+		st.ejectedUntil = now.Add(b.ejectFor)
+		slog.Warn("Upstream endpoint ejected", "upstream", u.Name, "endpoint", endpoint.Host, "failures", st.failures, "for", b.ejectFor)
+	}
+	u.circuit.failures++
+	if b.breakerFailures > 0 && u.circuit.failures >= b.breakerFailures {
+		u.circuit.openUntil = now.Add(b.breakerCooldown)
+		slog.Warn("Upstream circuit opened", "upstream", u.Name, "failures", u.circuit.failures, "for", b.breakerCooldown)
+		if b.onCircuit != nil {
+			b.onCircuit(u.Name, "open")
+		}
+	}
+}
+
+// doneBody calls done when a response body is closed, so a request counts
+// as in flight until its response has been passed on in full.
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+// Close closes the body and calls done, once.
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mustURL parses a URL.
+func mustURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// newTestUpstream returns a fixed upstream with the given endpoints and
+// balancing.
+func newTestUpstream(t *testing.T, target string, b balancing) *Upstream {
+	t.Helper()
+	u, err := parseUpstream("test", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.setBalancing(b)
+	return u
+}
+
+// TestPickLeastConnections checks requests go to the least busy endpoint.
+func TestPickLeastConnections(t *testing.T) {
+	u := newTestUpstream(t, "http://a:80|http://b:80|http://c:80", balancing{strategy: strategyLeastConnections})
+
+	// Three requests in flight spread over the three endpoints.
+	picked := map[string]int{}
+	for range 3 {
+		e, err := u.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[e.Host]++
+	}
+	if len(picked) != 3 {
+		t.Fatalf("Expected one request on each endpoint, got %v", picked)
+	}
+
+	// Once b's request is done, it's the least busy.
+	u.Done(mustURL(t, "http://b:80"), false)
+	if e, _ := u.Pick(); e.Host != "b:80" {
+		t.Errorf("Expected b:80, got %s", e.Host)
+	}
+}
+
+// TestEjection checks an endpoint failing in a row is skipped for a while,
+// and that if all are ejected they're used anyway.
+func TestEjection(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	u := newTestUpstream(t, "http://a:80|http://b:80", balancing{ejectAfter: 2, ejectFor: time.Minute, clock: clock.Now})
+	a := mustURL(t, "http://a:80")
+	for range 2 {
+		u.Pick()
+		u.Done(a, true)
+	}
+	if st := u.Status(); len(st.Ejected) != 1 || st.Ejected[0] != "http://a:80" {
+		t.Fatalf("Expected a to be ejected, got %+v", st)
+	}
+	for range 4 {
+		e, _ := u.Pick()
+		if e.Host != "b:80" {
+			t.Errorf("Expected only b while a is ejected, got %s", e.Host)
+		}
+		u.Done(e, false)
+	}
+
+	// With b ejected too, both are used rather than none.
+	b := mustURL(t, "http://b:80")
+	for range 2 {
+		u.Pick()
+		u.Done(b, true)
+	}
+	if _, err := u.Pick(); err != nil {
+		t.Errorf("Expected a pick with every endpoint ejected, got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if st := u.Status(); len(st.Ejected) != 0 {
+		t.Errorf("Expected the ejections to have expired, got %v", st.Ejected)
+	}
+}
+
+// TestCircuitBreaker checks the circuit opens after failures in a row,
+// lets one trial through once cooled down, and closes if it succeeds.
+func TestCircuitBreaker(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	u := newTestUpstream(t, "http://a:80", balancing{breakerFailures: 3, breakerCooldown: time.Minute, clock: clock.Now})
+	a := mustURL(t, "http://a:80")
+	for range 3 {
+		if _, err := u.Pick(); err != nil {
+			t.Fatal(err)
+		}
+		u.Done(a, true)
+	}
+	if _, err := u.Pick(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected the circuit to be open, got %v", err)
+	}
+	if st := u.Status(); st.Circuit != "open" {
+		t.Errorf("Expected status open, got %q", st.Circuit)
+	}
+
+	// Half-open: one trial, which fails and opens the circuit again.
+	clock.Advance(time.Minute)
+	if _, err := u.Pick(); err != nil {
+		t.Fatalf("Expected a trial request, got %v", err)
+	}
+	if _, err := u.Pick(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected only one trial at a time, got %v", err)
+	}
+	u.Done(a, true)
+	if _, err := u.Pick(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected a failed trial to reopen the circuit, got %v", err)
+	}
+
+	// A successful trial closes it.
+	clock.Advance(time.Minute)
+	u.Pick()
+	u.Done(a, false)
+	if st := u.Status(); st.Circuit != "closed" {
+		t.Errorf("Expected status closed, got %q", st.Circuit)
+	}
+}
+
+// TestProxyCircuitOpen checks a proxied request fails fast once the
+// upstream's circuit is open, and the request in flight counts until its
+// body is closed.
+func TestProxyCircuitOpen(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	cfg := defaultConfig(t)
+	cfg.ProxyRoutes = []string{"/svc=" + down.URL}
+	cfg.ProxyRetries, cfg.ProxyBreakerFailures = 0, 2
+	s := newServer(cfg)
+	h := s.proxyRouter(s.routes())
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/svc/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected the upstream's 503, got %d", rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/svc/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After from the open circuit, got %d %v", rec.Code, rec.Header())
+	}
+
+	route, _ := s.proxy.Load().match("/svc")
+	for host, st := range route.Upstream.states {
+		if st.active != 0 {
+			t.Errorf("Expected no requests in flight on %s, got %d", host, st.active)
+		}
+	}
+}
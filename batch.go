@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// This file implements batch operations on notes:
+//
+//	POST /api/v1/notes:batch
+//	{"atomic": false, "operations": [
+//	  {"op": "create", "title": "First"},
+//	  {"op": "delete", "id": "8f3a..."}
+//	]}
+//
+// Sending many changes in one request saves round trips, but raises the
+// question of what happens when some of them fail. There are two common
+// answers, and the "atomic" flag picks one:
+//
+//   - atomic: false (partial success). Each operation stands alone. The good
+//     ones are applied, the bad ones aren't, and the client must look at
+//     each result to find out which is which.
+//   - atomic: true (all or nothing). Like a database transaction: if any
+//     operation fails, none is applied. Operations that would have worked
+//     report 424 Failed Dependency.
+//
+// Either way the response carries one result per operation, each with its
+// own HTTP-style status code. The overall status is 207 Multi-Status (a
+// status borrowed from WebDAV meaning "look inside for the real answers"),
+// or 422 when an atomic batch was rolled back.
+
+// BatchRequest is the body of POST /api/v1/notes:batch.
+type BatchRequest struct {
+	Atomic     bool      `json:"atomic"`
+	Operations []BatchOp `json:"operations"`
+}
+
+// BatchOp is one operation in a batch.
+type BatchOp struct {
+	Op    string `json:"op"`
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// BatchResult reports the outcome of one operation.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Note   *Note  `json:"note,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse lists the results in the same order as the operations.
+type BatchResponse struct {
+	Atomic    bool          `json:"atomic"`
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// handleBatchNotes applies a batch of note operations.
+func (s *Server) handleBatchNotes(w http.ResponseWriter, r *http.Request) {
+	// The schema (schemas/notes-batch.json) limits the batch to between 1
+	// and 100 operations, so a single request can't hold the store's lock
+	// for long.
+	var req BatchRequest
+	if !decodeValid(w, r, "notes-batch", &req) {
+		return
+	}
+
+	resp := BatchResponse{Atomic: req.Atomic, Results: make([]BatchResult, len(req.Operations))}
+	tenant := tenantFromContext(r.Context())
+
+	s.store.Batch(tenant, func(tx *NoteTx) bool {
+		failed := false
+		for i, op := range req.Operations {
+			resp.Results[i] = applyBatchOp(tx, i, op)
+			if resp.Results[i].Status >= 400 {
+				failed = true
+			}
+		}
+
+		// An atomic batch with a failure is rolled back: report the
+		// operations that did work as not applied.
+		if req.Atomic && failed {
+			for i := range resp.Results {
+				if resp.Results[i].Status < 400 {
+					resp.Results[i] = BatchResult{Index: i, Status: http.StatusFailedDependency,
+						Error: "not applied: another operation in the atomic batch failed"}
+				}
+			}
+			return false
+		}
+
+		resp.Committed = true
+		return true
+	})
+
+	status := http.StatusMultiStatus
+	if !resp.Committed {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, resp)
+}
+
+// applyBatchOp performs one operation within the transaction.
+func applyBatchOp(tx *NoteTx, i int, op BatchOp) BatchResult {
+	switch op.Op {
+	case "create":
+		title := strings.TrimSpace(op.Title)
+		if title == "" {
+			return BatchResult{Index: i, Status: http.StatusUnprocessableEntity, Error: "title is required"}
+		}
+		note := tx.Create(title, op.Body)
+		return BatchResult{Index: i, Status: http.StatusCreated, Note: &note}
+
+	case "delete":
+		if !tx.Delete(op.ID) {
+			return BatchResult{Index: i, Status: http.StatusNotFound, Error: "note not found"}
+		}
+		return BatchResult{Index: i, Status: http.StatusNoContent}
+	}
+
+	return BatchResult{Index: i, Status: http.StatusBadRequest, Error: fmt.Sprintf("unknown op %q (use create or delete)", op.Op)}
+}
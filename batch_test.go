@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// postBatch sends a batch request and decodes the response.
+func postBatch(t *testing.T, srv *Server, body string) (int, BatchResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/notes:batch", strings.NewReader(body)))
+
+	var resp BatchResponse
+	if rec.Code == http.StatusMultiStatus || rec.Code == http.StatusUnprocessableEntity {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse JSON response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, resp
+}
+
+// statuses returns the per-operation status codes.
+func statuses(resp BatchResponse) []int {
+	var out []int
+	for _, r := range resp.Results {
+		out = append(out, r.Status)
+	}
+	return out
+}
+
+// TestBatchPartialSuccess checks that a non-atomic batch applies the
+// operations that succeed and reports the ones that don't.
+func TestBatchPartialSuccess(t *testing.T) {
+	srv := newServer(Config{})
+	existing := srv.store.CreateNote(defaultTenant, "Existing", "")
+
+	code, resp := postBatch(t, srv, `{"operations": [
+		{"op": "create", "title": "New"},
+		{"op": "create", "title": "  "},
+		{"op": "delete", "id": "`+existing.ID+`"},
+		{"op": "delete", "id": "missing"},
+		{"op": "rename"}
+	]}`)
+
+	if code != http.StatusMultiStatus || !resp.Committed {
+		t.Fatalf("Expected a committed 207, got %d %+v", code, resp)
+	}
+	want := []int{201, 422, 204, 404, 400}
+	if got := statuses(resp); !slices.Equal(got, want) {
+		t.Errorf("Expected statuses %v, got %v", want, got)
+	}
+
+	notes := srv.store.ListNotes(defaultTenant)
+	if len(notes) != 1 || notes[0].Title != "New" {
+		t.Errorf("Expected only the new note to remain, got %+v", notes)
+	}
+}
+
+// TestBatchAtomicRollback checks that one failure in an atomic batch undoes
+// the whole batch.
+func TestBatchAtomicRollback(t *testing.T) {
+	srv := newServer(Config{})
+	existing := srv.store.CreateNote(defaultTenant, "Existing", "")
+
+	code, resp := postBatch(t, srv, `{"atomic": true, "operations": [
+		{"op": "create", "title": "New"},
+		{"op": "delete", "id": "`+existing.ID+`"},
+		{"op": "delete", "id": "`+existing.ID+`"}
+	]}`)
+
+	if code != http.StatusUnprocessableEntity || resp.Committed {
+		t.Fatalf("Expected a rolled-back 422, got %d %+v", code, resp)
+	}
+	want := []int{424, 424, 404}
+	if got := statuses(resp); !slices.Equal(got, want) {
+		t.Errorf("Expected statuses %v, got %v", want, got)
+	}
+
+	notes := srv.store.ListNotes(defaultTenant)
+	if len(notes) != 1 || notes[0].ID != existing.ID {
+		t.Errorf("Expected the store to be unchanged, got %+v", notes)
+	}
+}
+
+// TestBatchAtomicCommit checks a fully successful atomic batch is applied.
+func TestBatchAtomicCommit(t *testing.T) {
+	srv := newServer(Config{})
+
+	code, resp := postBatch(t, srv, `{"atomic": true, "operations": [
+		{"op": "create", "title": "One"},
+		{"op": "create", "title": "Two"}
+	]}`)
+	if code != http.StatusMultiStatus || !resp.Committed {
+		t.Fatalf("Expected a committed 207, got %d %+v", code, resp)
+	}
+	if got := len(srv.store.ListNotes(defaultTenant)); got != 2 {
+		t.Errorf("Expected 2 notes, got %d", got)
+	}
+}
+
+// TestBatchLimits checks empty and oversized batches are refused.
+func TestBatchLimits(t *testing.T) {
+	srv := newServer(Config{})
+
+	if code, _ := postBatch(t, srv, `{"operations": []}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an empty batch, got %d", code)
+	}
+
+	ops := strings.Repeat(`{"op": "create", "title": "x"},`, 101)
+	if code, _ := postBatch(t, srv, `{"operations": [`+strings.TrimSuffix(ops, ",")+`]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an oversized batch, got %d", code)
+	}
+	if got := len(srv.store.ListNotes(defaultTenant)); got != 0 {
+		t.Errorf("Expected no notes created, got %d", got)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// This file is a benchmark suite for the code on the hot path (middleware,
+// JSON rendering and the store), and the bench command that checks it for
+// regressions:
+//
+//	server bench -update            # record a baseline
+//	server bench                    # compare against it, fail if slower
+//
+// Benchmarks normally live in _test.go files and run with go test -bench.
+// These are in the binary instead, run with testing.Benchmark, so the
+// check doesn't need the Go toolchain, and go test -bench BenchmarkSuite
+// runs the same code.
+//
+// A benchmark regresses if it takes more than -max-slowdown percent longer
+// per operation than the baseline, or makes more than -max-alloc-increase
+// percent more allocations. Timings vary from run to run, so each
+// benchmark runs -count times and the fastest run counts; allocations
+// hardly vary, so their threshold can be much tighter.
+//
+// Timings only mean something compared with the same machine, so the
+// baseline should be recorded where it's checked: in CI, on the CI runner,
+// from the main branch.
+
+// benchmark is one entry of the suite.
+type benchmark struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+// BenchResult is one benchmark's result.
+type BenchResult struct {
+	Name        string  `json:"name"`
+	NsPerOp     float64 `json:"ns_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+}
+
+// BenchBaseline is the file the bench command compares against.
+type BenchBaseline struct {
+	GoVersion string        `json:"go_version"`
+	Platform  string        `json:"platform"`
+	Recorded  time.Time     `json:"recorded"`
+	Results   []BenchResult `json:"results"`
+}
+
+// discardWriter is a ResponseWriter that throws the response away, so the
+// benchmarks measure the server rather than httptest.ResponseRecorder.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// benchServe returns a benchmark of a request to h.
+func benchServe(h http.Handler, method, target string) func(b *testing.B) {
+	return func(b *testing.B) {
+		req := httptest.NewRequest(method, target, nil)
+		w := &discardWriter{header: http.Header{}}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			clear(w.header)
+			h.ServeHTTP(w, req)
+		}
+	}
+}
+
+// benchNotes returns n notes like the ones users create.
+func benchNotes(n int) []Note {
+	notes := make([]Note, n)
+	for i := range notes {
+		notes[i] = Note{ID: newID(), Title: fmt.Sprintf("Note %d", i), Body: "Some text to make the note a realistic size.", CreatedAt: time.Now()}
+	}
+	return notes
+}
+
+// benchmarks returns the suite.
+func benchmarks() []benchmark {
+	newBenchServer := func() (*Server, http.Handler) {
+		s := newServer(Config{})
+		for i := range 50 {
+			s.store.CreateNote(defaultTenant, fmt.Sprintf("Note %d", i), "Some text to make the note a realistic size.")
+		}
+		return s, s.routes()
+	}
+
+	return []benchmark{
+		// The same endpoint with and without the middleware shows what
+		// the chain costs.
+		{"middleware/none", benchServe(http.HandlerFunc(handleHealth), http.MethodGet, "/health")},
+		{"middleware/chain", func(b *testing.B) {
+			_, h := newBenchServer()
+			benchServe(h, http.MethodGet, "/health")(b)
+		}},
+		{"handler/root", func(b *testing.B) {
+			_, h := newBenchServer()
+			benchServe(h, http.MethodGet, "/")(b)
+		}},
+		{"handler/list-notes", func(b *testing.B) {
+			_, h := newBenchServer()
+			benchServe(h, http.MethodGet, "/api/v1/notes")(b)
+		}},
+
+		{"render/json-small", func(b *testing.B) {
+			w := &discardWriter{header: http.Header{}}
+			v := HealthResponse{Status: "healthy", Timestamp: time.Now(), Version: version}
+			for i := 0; i < b.N; i++ {
+				writeJSON(w, http.StatusOK, v)
+			}
+		}},
+		{"render/json-notes", func(b *testing.B) {
+			w := &discardWriter{header: http.Header{}}
+			notes := benchNotes(50)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writeJSON(w, http.StatusOK, notes)
+			}
+		}},
+
+		{"store/create-note", func(b *testing.B) {
+			s := newStore()
+			for i := 0; i < b.N; i++ {
+				s.CreateNote(defaultTenant, "Title", "Body")
+			}
+		}},
+		{"store/list-notes", func(b *testing.B) {
+			s := newStore()
+			for range 50 {
+				s.CreateNote(defaultTenant, "Title", "Body")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.ListNotes(defaultTenant)
+			}
+		}},
+		{"store/increment-counter", func(b *testing.B) {
+			s := newStore()
+			for i := 0; i < b.N; i++ {
+				s.IncrementCounter(defaultTenant)
+			}
+		}},
+		// With a DATA_FILE, a save writes the whole store. Creating notes
+		// would grow the file as b.N grows, so this changes the counter of
+		// a store holding 50 notes, flushing each time since increments
+		// are otherwise saved in batches.
+		{"store/increment-counter-persisted", func(b *testing.B) {
+			s, err := openStore(filepath.Join(b.TempDir(), "data.json"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for range 50 {
+				s.CreateNote(defaultTenant, "Title", "Body")
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.IncrementCounter(defaultTenant)
+				s.Flush()
+			}
+		}},
+	}
+}
+
+// runBenchmarks runs the benchmarks whose names match filter, count times
+// each, and returns the fastest run of each.
+func runBenchmarks(filter *regexp.Regexp, count int, progress io.Writer) []BenchResult {
+	var results []BenchResult
+	for _, bm := range benchmarks() {
+		if !filter.MatchString(bm.name) {
+			continue
+		}
+		var best BenchResult
+		for i := range count {
+			r := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				bm.fn(b)
+			})
+			if r.N == 0 {
+				// The benchmark failed; testing.Benchmark doesn't say why.
+				best = BenchResult{Name: bm.name}
+				break
+			}
+			res := BenchResult{Name: bm.name, NsPerOp: float64(r.T.Nanoseconds()) / float64(r.N), BytesPerOp: r.AllocedBytesPerOp(), AllocsPerOp: r.AllocsPerOp()}
+			if i == 0 || res.NsPerOp < best.NsPerOp {
+				best = res
+			}
+		}
+		fmt.Fprintf(progress, "%-30s %12.0f ns/op %8d B/op %6d allocs/op\n", best.Name, best.NsPerOp, best.BytesPerOp, best.AllocsPerOp)
+		results = append(results, best)
+	}
+	return results
+}
+
+// benchThresholds are how much worse than the baseline a result may be, in
+// percent.
+type benchThresholds struct {
+	slowdown      float64
+	allocIncrease float64
+}
+
+// BenchComparison is a result next to its baseline.
+type BenchComparison struct {
+	BenchResult
+	Baseline  *BenchResult // nil for a benchmark new since the baseline
+	Regressed bool
+}
+
+// compareBench compares results with a baseline.
+func compareBench(results []BenchResult, baseline []BenchResult, th benchThresholds) []BenchComparison {
+	base := make(map[string]BenchResult, len(baseline))
+	for _, r := range baseline {
+		base[r.Name] = r
+	}
+	comparisons := make([]BenchComparison, 0, len(results))
+	for _, r := range results {
+		c := BenchComparison{BenchResult: r}
+		if b, ok := base[r.Name]; ok {
+			c.Baseline = &b
+			c.Regressed = r.NsPerOp == 0 ||
+				r.NsPerOp > b.NsPerOp*(1+th.slowdown/100) ||
+				float64(r.AllocsPerOp) > float64(b.AllocsPerOp)*(1+th.allocIncrease/100)
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// change formats how a value differs from its baseline.
+func change(now, base float64) string {
+	if base == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (now-base)/base*100)
+}
+
+// runBenchCommand runs the benchmark suite and compares it with a baseline.
+func runBenchCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("bench", stderr)
+	baselinePath := fs.String("baseline", "bench-baseline.json", "baseline file to compare against or update")
+	update := fs.Bool("update", false, "record the results as the new baseline instead of comparing")
+	run := fs.String("run", "", "only run benchmarks whose names match this regular expression")
+	count := fs.Int("count", 3, "runs of each benchmark; the fastest counts")
+	benchtime := fs.Duration("benchtime", 500*time.Millisecond, "how long to run each benchmark for")
+	var th benchThresholds
+	fs.Float64Var(&th.slowdown, "max-slowdown", 20, "percent slower than the baseline before failing")
+	fs.Float64Var(&th.allocIncrease, "max-alloc-increase", 10, "percent more allocations than the baseline before failing")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil || *count < 1 {
+		fmt.Fprintln(stderr, "-run must be a regular expression and -count at least 1")
+		return errUsage
+	}
+
+	var baseline BenchBaseline
+	if !*update {
+		raw, err := os.ReadFile(*baselinePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no baseline at %s; record one with 'bench -update'", *baselinePath)
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &baseline); err != nil {
+			return fmt.Errorf("reading %s: %w", *baselinePath, err)
+		}
+	}
+
+	// testing.Benchmark takes its run time from the testing package's
+	// flags, which only exist once testing.Init has registered them.
+	testing.Init()
+	if err := flag.Set("test.benchtime", benchtime.String()); err != nil {
+		return err
+	}
+	// The handlers log every request, which would bury the results.
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	results := runBenchmarks(filter, *count, stderr)
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if *update {
+		raw, _ := json.MarshalIndent(BenchBaseline{GoVersion: runtime.Version(), Platform: platform, Recorded: time.Now().UTC(), Results: results}, "", "  ")
+		if err := os.WriteFile(*baselinePath, append(raw, '\n'), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Recorded %d benchmarks in %s\n", len(results), *baselinePath)
+		return nil
+	}
+
+	if baseline.GoVersion != runtime.Version() || baseline.Platform != platform {
+		fmt.Fprintf(stderr, "Warning: the baseline was recorded with %s on %s, this is %s on %s\n", baseline.GoVersion, baseline.Platform, runtime.Version(), platform)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BENCHMARK\tNS/OP\tCHANGE\tALLOCS/OP\tCHANGE\tRESULT")
+	regressed := 0
+	for _, c := range compareBench(results, baseline.Results, th) {
+		result, timeChange, allocChange := "ok", "-", "-"
+		switch {
+		case c.Baseline == nil:
+			result = "new"
+		case c.Regressed:
+			result = "REGRESSED"
+			regressed++
+		}
+		if c.Baseline != nil {
+			timeChange = change(c.NsPerOp, c.Baseline.NsPerOp)
+			allocChange = change(float64(c.AllocsPerOp), float64(c.Baseline.AllocsPerOp))
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%s\t%d\t%s\t%s\n", c.Name, c.NsPerOp, timeChange, c.AllocsPerOp, allocChange, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if regressed > 0 {
+		return fmt.Errorf("%d benchmark(s) regressed beyond -max-slowdown %.0f%% / -max-alloc-increase %.0f%%", regressed, th.slowdown, th.allocIncrease)
+	}
+	return nil
+}
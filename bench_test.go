@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkSuite runs the bench command's suite under go test -bench.
+func BenchmarkSuite(b *testing.B) {
+	for _, bm := range benchmarks() {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			bm.fn(b)
+		})
+	}
+}
+
+// TestCompareBench checks results are flagged past either threshold, and
+// new benchmarks aren't.
+func TestCompareBench(t *testing.T) {
+	baseline := []BenchResult{
+		{Name: "same", NsPerOp: 100, AllocsPerOp: 10},
+		{Name: "slower", NsPerOp: 100, AllocsPerOp: 10},
+		{Name: "allocs", NsPerOp: 100, AllocsPerOp: 10},
+		{Name: "within", NsPerOp: 100, AllocsPerOp: 10},
+	}
+	results := []BenchResult{
+		{Name: "same", NsPerOp: 100, AllocsPerOp: 10},
+		{Name: "slower", NsPerOp: 130, AllocsPerOp: 10},
+		{Name: "allocs", NsPerOp: 90, AllocsPerOp: 12},
+		{Name: "within", NsPerOp: 119, AllocsPerOp: 11},
+		{Name: "new", NsPerOp: 1000, AllocsPerOp: 100},
+	}
+	want := map[string]bool{"same": false, "slower": true, "allocs": true, "within": false, "new": false}
+	for _, c := range compareBench(results, baseline, benchThresholds{slowdown: 20, allocIncrease: 10}) {
+		if c.Regressed != want[c.Name] {
+			t.Errorf("%s: expected regressed=%v, got %v", c.Name, want[c.Name], c.Regressed)
+		}
+		if (c.Baseline == nil) != (c.Name == "new") {
+			t.Errorf("%s: unexpected baseline %v", c.Name, c.Baseline)
+		}
+	}
+}
+
+// TestBenchCommand records a baseline, passes against it, and fails once
+// the baseline is made faster than the code can be.
+func TestBenchCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	args := []string{"-baseline", path, "-run", "^store/increment-counter$", "-benchtime", "10ms", "-count", "1"}
+	var stdout, stderr strings.Builder
+
+	if err := runBenchCommand(append(args, "-update"), &stdout, &stderr); err != nil {
+		t.Fatalf("Recording the baseline failed: %v\n%s", err, stderr.String())
+	}
+	if err := runBenchCommand(append(args, "-max-slowdown", "1000"), &stdout, &stderr); err != nil {
+		t.Fatalf("Expected no regression, got %v\n%s", err, stdout.String())
+	}
+
+	raw, _ := os.ReadFile(path)
+	var baseline BenchBaseline
+	if err := json.Unmarshal(raw, &baseline); err != nil || len(baseline.Results) != 1 {
+		t.Fatalf("Unexpected baseline %s", raw)
+	}
+	baseline.Results[0].NsPerOp /= 1000
+	raw, _ = json.Marshal(baseline)
+	os.WriteFile(path, raw, 0o644)
+
+	stdout.Reset()
+	if err := runBenchCommand(args, &stdout, &stderr); err == nil || !strings.Contains(stdout.String(), "REGRESSED") {
+		t.Errorf("Expected a regression, got %v\n%s", err, stdout.String())
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file stores the contents of uploaded files ("blobs", short for binary
+// large objects). Handlers talk to the BlobStore interface, so the same code
+// can keep files on local disk during development and in S3-compatible
+// object storage (AWS S3, MinIO, Cloudflare R2...) in production, chosen by
+// BLOB_BACKEND.
+//
+// Local disk is fine for a single instance, but once you run several
+// replicas each one would only see its own uploads. Object storage is shared
+// by all of them, which is why it's the usual choice in Kubernetes.
+
+// BlobStore saves and retrieves blobs by key. Keys look like file paths
+// ("tenant/id").
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any existing blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Open returns the blob's contents. It returns an error wrapping
+	// errBlobNotFound if there is no such blob.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes a blob. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// SignedURL returns a URL that lets anyone holding it download the blob
+	// directly from the storage service until it expires, with the browser
+	// told to save it as filename. Backends that can't do this return
+	// errors.ErrUnsupported.
+	SignedURL(key, filename string, expires time.Duration) (string, error)
+}
+
+// errBlobNotFound is returned (wrapped) by Open for a missing blob.
+var errBlobNotFound = errors.New("blob not found")
+
+// newBlobStore creates the blob store selected by the configuration.
+func newBlobStore(cfg Config) BlobStore {
+	if cfg.BlobBackend == "s3" {
+		return newS3BlobStore(cfg)
+	}
+	return &LocalBlobStore{dir: cfg.UploadDir}
+}
+
+// LocalBlobStore keeps blobs as files under a directory.
+type LocalBlobStore struct {
+	dir string
+}
+
+// path turns a key into a file path. Keys are generated by the server, never
+// taken from a client, so they can't escape the directory.
+func (l *LocalBlobStore) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key))
+}
+
+// Put writes the blob to a temporary file and renames it into place, so a
+// reader never sees a half-written blob.
+func (l *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "blob-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Open opens the blob's file.
+func (l *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errBlobNotFound, key)
+	}
+	return f, err
+}
+
+// Delete removes the blob's file.
+func (l *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SignedURL is not supported: local files can only be served by this server.
+func (l *LocalBlobStore) SignedURL(key, filename string, expires time.Duration) (string, error) {
+	return "", errors.ErrUnsupported
+}
+
+// S3BlobStore keeps blobs in an S3-compatible bucket. It speaks the S3 REST
+// API directly with net/http instead of using the AWS SDK, to show there's
+// no magic involved: every request is an ordinary HTTP request carrying an
+// AWS Signature Version 4, computed below.
+//
+// Objects are addressed path-style (https://endpoint/bucket/key), which
+// MinIO and other S3-compatible services expect and AWS still accepts.
+type S3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+
+	// now is time.Now, replaceable so tests can sign at a fixed time.
+	now func() time.Time
+}
+
+// newS3BlobStore creates an S3 blob store. The configuration has already
+// been validated, so the endpoint parses.
+func newS3BlobStore(cfg Config) *S3BlobStore {
+	endpoint, _ := url.Parse(cfg.S3Endpoint)
+	return &S3BlobStore{
+		endpoint:  endpoint,
+		region:    cfg.S3Region,
+		bucket:    cfg.S3Bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}
+}
+
+// objectURL returns the URL of the object stored under key.
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	return &u
+}
+
+// do signs and sends a request for an object.
+func (s *S3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.signRequest(req, s.now())
+	return s.client.Do(req)
+}
+
+// Put uploads the blob with a single PUT request.
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, key)
+}
+
+// Open downloads the blob. The caller must close the returned body.
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the blob. S3 answers 204 even when the object didn't exist.
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, key)
+}
+
+// s3Error turns an unsuccessful S3 response into an error. S3 explains
+// errors in a small XML document, which is included as-is.
+func s3Error(resp *http.Response, key string) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errBlobNotFound, key)
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s: %s", resp.Request.Method, key, resp.Status, strings.TrimSpace(string(detail)))
+}
+
+// SignedURL returns a presigned GET URL. The signature travels in the query
+// string instead of a header, so a browser can follow it with no credentials
+// of its own. S3 honors response-content-disposition on such URLs, which is
+// how the download keeps its original file name.
+func (s *S3BlobStore) SignedURL(key, filename string, expires time.Duration) (string, error) {
+	u := s.objectURL(key)
+	q := u.Query()
+	q.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	u.RawQuery = q.Encode()
+
+	return presignURL(u, s.region, s.accessKey, s.secretKey, expires, s.now()), nil
+}
+
+// AWS Signature Version 4, the scheme S3 uses to authenticate requests. The
+// client proves it knows the secret key without sending it: it builds a
+// canonical text form of the request, and signs that with a key derived from
+// the secret, the date, the region and the service. The server repeats the
+// computation and compares. Any change to the signed parts of the request
+// (or a clock more than 15 minutes off) makes the signatures differ.
+//
+// Reference: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	s3Service       = "s3"
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// signRequest adds an Authorization header. The body isn't hashed
+// ("UNSIGNED-PAYLOAD"), so it can be streamed without reading it twice;
+// HTTPS already protects it in transit.
+func (s *S3BlobStore) signRequest(req *http.Request, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Content-Sha256"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = v
+		}
+	}
+
+	scope := sigV4Scope(t, s.region, s3Service)
+	signedHeaders, canonical := canonicalRequest(req.Method, req.URL, headers, unsignedPayload)
+	signature := sigV4Signature(s.secretKey, t, s.region, s3Service, canonical)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// presignURL returns u with a query-string signature valid for expires.
+func presignURL(u *url.URL, region, accessKey, secretKey string, expires time.Duration, t time.Time) string {
+	t = t.UTC()
+	signed := *u
+	q := signed.Query()
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", accessKey+"/"+sigV4Scope(t, region, s3Service))
+	q.Set("X-Amz-Date", t.Format(amzDateFormat))
+	q.Set("X-Amz-Expires", fmt.Sprint(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	signed.RawQuery = canonicalQuery(q)
+
+	_, canonical := canonicalRequest(http.MethodGet, &signed, map[string]string{"host": signed.Host}, unsignedPayload)
+	q.Set("X-Amz-Signature", sigV4Signature(secretKey, t, region, s3Service, canonical))
+	signed.RawQuery = canonicalQuery(q)
+	return signed.String()
+}
+
+// sigV4Scope limits a signature to one day, region and service.
+func sigV4Scope(t time.Time, region, service string) string {
+	return t.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// canonicalRequest builds the text that gets signed and returns it along
+// with the list of signed header names. headers must have lowercase keys.
+func canonicalRequest(method string, u *url.URL, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		canonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	return signedHeaders, canonical
+}
+
+// canonicalQuery encodes query parameters sorted by name, the way SigV4
+// requires. url.Values.Encode is close but encodes spaces as "+".
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters
+// (A-Z a-z 0-9 - _ . ~), and also leaves "/" alone unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4Signature signs a canonical request to service. Other AWS services
+// sign the same way as S3 (see awssecrets.go), with their own name in the
+// scope.
+func sigV4Signature(secretKey string, t time.Time, region, service, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(amzDateFormat),
+		sigV4Scope(t, region, service),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	// The signing key is derived in steps, so a leaked derived key is only
+	// good for one day, region and service.
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// hmacSHA256 computes an HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file puts a CAPTCHA in front of the guestbook and the contact form,
+// the two things anyone can post to without an account, and so the two
+// things spam bots find. Cloudflare Turnstile and hCaptcha are supported;
+// both work the same way:
+//
+//  1. The page loads the provider's script, which shows a widget for
+//     CAPTCHA_SITE_KEY. Turnstile's is usually just a checkbox, or nothing
+//     at all, since it mostly judges the browser rather than quizzing the
+//     visitor.
+//  2. Once satisfied, the widget adds a one-time token to the form, as
+//     cf-turnstile-response or h-captcha-response.
+//  3. The server sends the token and CAPTCHA_SECRET to the provider's
+//     siteverify API, which says whether it's genuine, and only then
+//     accepts the submission.
+//
+// Step 3 is the one that matters: the widget alone stops nothing, since a
+// bot can post the form without ever loading the page. API clients send
+// the token as "captcha_token" in the JSON body.
+//
+// With no CAPTCHA_SECRET, which is the default, there's no widget and no
+// check. If the provider can't be reached, submissions are refused rather
+// than let through: a CAPTCHA that fails open is one a bot can switch off.
+// With MOCK_EXTERNAL=true, siteverify is faked (see mock.go) and accepts
+// any token but "fail".
+
+// captchaProvider is what differs between the providers.
+type captchaProvider struct {
+	// Script is the widget's JavaScript, Class the class of the element it
+	// turns into a widget, and Field the form field it puts the token in.
+	Script, Class, Field string
+
+	verifyURL string
+}
+
+// captchaProviders are the supported CAPTCHA_PROVIDERs.
+var captchaProviders = map[string]captchaProvider{
+	"turnstile": {
+		Script:    "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		Class:     "cf-turnstile",
+		Field:     "cf-turnstile-response",
+		verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+	"hcaptcha": {
+		Script:    "https://js.hcaptcha.com/1/api.js",
+		Class:     "h-captcha",
+		Field:     "h-captcha-response",
+		verifyURL: "https://api.hcaptcha.com/siteverify",
+	},
+}
+
+// captchaVerifyTimeout bounds a call to siteverify.
+const captchaVerifyTimeout = 5 * time.Second
+
+// CaptchaWidget is what a page needs to show the widget. It's the zero
+// value when CAPTCHAs are off.
+type CaptchaWidget struct {
+	captchaProvider
+	SiteKey string
+}
+
+// captchaField is the FieldError pointer for a missing or rejected token.
+const captchaField = "/captcha_token"
+
+// Why a CAPTCHA wasn't accepted.
+var (
+	errCaptchaFailed      = errors.New("the CAPTCHA wasn't solved; please try again")
+	errCaptchaUnavailable = errors.New("the CAPTCHA couldn't be checked; please try again later")
+)
+
+// captchaVerifyURL returns the siteverify URL for cfg.
+func captchaVerifyURL(cfg Config) string {
+	if cfg.CaptchaVerifyURL != "" {
+		return cfg.CaptchaVerifyURL
+	}
+	return captchaProviders[cfg.CaptchaProvider].verifyURL
+}
+
+// captchaWidget returns the widget for the forms, if CAPTCHAs are on.
+func (s *Server) captchaWidget() CaptchaWidget {
+	cfg := s.config()
+	if cfg.CaptchaSecret == "" {
+		return CaptchaWidget{}
+	}
+	return CaptchaWidget{captchaProvider: captchaProviders[cfg.CaptchaProvider], SiteKey: cfg.CaptchaSiteKey}
+}
+
+// formCaptchaToken returns the token the widget added to a form.
+func (s *Server) formCaptchaToken(r *http.Request) string {
+	return r.PostForm.Get(captchaProviders[s.config().CaptchaProvider].Field)
+}
+
+// verifyCaptcha checks the token sent with r. It returns nil when CAPTCHAs
+// are off, errCaptchaFailed if the token isn't genuine, and
+// errCaptchaUnavailable if the provider couldn't say.
+func (s *Server) verifyCaptcha(r *http.Request, token string) error {
+	cfg := s.config()
+	if cfg.CaptchaSecret == "" {
+		return nil
+	}
+	if token == "" {
+		return errCaptchaFailed
+	}
+
+	form := url.Values{"secret": {cfg.CaptchaSecret}, "response": {token}, "sitekey": {cfg.CaptchaSiteKey}}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		form.Set("remoteip", host)
+	}
+	ok, err := s.siteverify(r.Context(), captchaVerifyURL(cfg), form)
+	switch {
+	case err != nil:
+		slog.WarnContext(r.Context(), "Couldn't verify a CAPTCHA", "provider", cfg.CaptchaProvider, "error", err)
+		return errCaptchaUnavailable
+	case !ok:
+		return errCaptchaFailed
+	}
+	return nil
+}
+
+// siteverify asks the provider whether a token is genuine.
+func (s *Server) siteverify(ctx context.Context, verifyURL string, form url.Values) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, captchaVerifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.outbound.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify answered %s", resp.Status)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	// A bad secret is the server's problem, not the visitor's.
+	for _, code := range result.ErrorCodes {
+		if code == "invalid-input-secret" || code == "missing-input-secret" {
+			return false, errors.New("the provider rejected CAPTCHA_SECRET")
+		}
+	}
+	return result.Success, nil
+}
+
+// captchaProblem returns the status and field error to answer with when a
+// CAPTCHA isn't accepted: 422 if it failed, 502 if it couldn't be checked.
+func captchaProblem(err error) (int, FieldError) {
+	status := http.StatusUnprocessableEntity
+	if errors.Is(err, errCaptchaUnavailable) {
+		status = http.StatusBadGateway
+	}
+	return status, FieldError{Pointer: captchaField, Detail: err.Error()}
+}
+
+// writeCaptchaProblem answers a JSON request whose CAPTCHA wasn't accepted.
+func writeCaptchaProblem(w http.ResponseWriter, schema string, err error) {
+	status, fieldErr := captchaProblem(err)
+	if status == http.StatusBadGateway {
+		writeProblem(w, status, err.Error())
+		return
+	}
+	writeValidationProblem(w, schema, []FieldError{fieldErr})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// fakeSiteverify is a CAPTCHA provider's siteverify API that accepts the
+// token "good", and records the forms it's sent.
+type fakeSiteverify struct {
+	*httptest.Server
+	mu    sync.Mutex
+	forms []url.Values
+}
+
+func newFakeSiteverify(t *testing.T) *fakeSiteverify {
+	f := &fakeSiteverify{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		f.forms = append(f.forms, r.PostForm)
+		f.mu.Unlock()
+		switch {
+		case r.PostForm.Get("secret") != "shh":
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+		case r.PostForm.Get("response") == "good":
+			w.Write([]byte(`{"success": true}`))
+		default:
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// useCaptcha turns on CAPTCHAs for s, checked by verifyURL.
+func useCaptcha(s *Server, provider, verifyURL string) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	s.cfg.CaptchaProvider, s.cfg.CaptchaSiteKey, s.cfg.CaptchaSecret, s.cfg.CaptchaVerifyURL = provider, "site-key", "shh", verifyURL
+}
+
+// TestCaptchaAPI signs the guestbook through the API with no token, a bad
+// one and a good one, and checks what's sent to the provider.
+func TestCaptchaAPI(t *testing.T) {
+	s, c := newTestServer(t)
+	verify := newFakeSiteverify(t)
+	useCaptcha(s, "turnstile", verify.URL)
+
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi"}).
+		Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/captcha_token", "detail": "the CAPTCHA wasn't solved; please try again"}], "...": "..."}`)
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "bad"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "good"}).Status(http.StatusCreated)
+	c.Post("/api/v1/contact", map[string]any{"name": "Ada", "email": "ada@example.com", "message": "Hi", "captcha_token": "bad"}).
+		Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/captcha_token", "...": "..."}], "...": "..."}`)
+
+	// Invalid fields are reported without asking the provider.
+	c.Post("/api/v1/guestbook", map[string]any{"name": "", "message": "Hi", "captcha_token": "good"}).Status(http.StatusUnprocessableEntity)
+
+	verify.mu.Lock()
+	forms := verify.forms
+	verify.mu.Unlock()
+	if len(forms) != 3 {
+		t.Fatalf("Expected 3 calls to siteverify, got %d", len(forms))
+	}
+	if got := forms[1]; got.Get("secret") != "shh" || got.Get("response") != "good" || got.Get("remoteip") != "192.0.2.1" || got.Get("sitekey") != "site-key" {
+		t.Errorf("Unexpected siteverify form %v", got)
+	}
+
+	// A wrong secret or an unreachable provider is the server's problem.
+	s.cfg.CaptchaSecret = "wrong"
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "good"}).
+		Status(http.StatusBadGateway).
+		JSON(`{"detail": "the CAPTCHA couldn't be checked; please try again later", "...": "..."}`)
+	s.cfg.CaptchaSecret, s.cfg.CaptchaVerifyURL = "shh", "http://127.0.0.1:1/siteverify"
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "good"}).Status(http.StatusBadGateway)
+}
+
+// TestCaptchaForms checks the forms show the provider's widget and the
+// form field it fills in is checked.
+func TestCaptchaForms(t *testing.T) {
+	s, c := newTestServer(t)
+	verify := newFakeSiteverify(t)
+	useCaptcha(s, "hcaptcha", verify.URL)
+	useMailer(s, &fakeMailer{})
+
+	for _, page := range []string{"/guestbook", "/contact"} {
+		body := c.Get(page).Status(http.StatusOK).Body.String()
+		if !strings.Contains(body, `<script src="https://js.hcaptcha.com/1/api.js" async defer>`) || !strings.Contains(body, `<div class="h-captcha" data-sitekey="site-key">`) {
+			t.Errorf("%s: expected the hCaptcha widget, got:\n%s", page, body)
+		}
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"name": {"Ada"}, "message": {"Hi"}, "h-captcha-response": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/guestbook", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post("bad"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "the CAPTCHA wasn&#39;t solved") {
+		t.Errorf("Expected the form again with an error, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+	if rec := post("good"); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expected a redirect, got %d", rec.Code)
+	}
+
+	// Without a secret there's no widget.
+	s.cfg.CaptchaSecret = ""
+	if body := c.Get("/guestbook").Body.String(); strings.Contains(body, "h-captcha") {
+		t.Errorf("Expected no widget without a secret, got:\n%s", body)
+	}
+}
+
+// TestCaptchaMock checks MOCK_EXTERNAL fakes the provider, so CAPTCHAs
+// can be tried out offline.
+func TestCaptchaMock(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.MockExternal, cfg.CaptchaSiteKey, cfg.CaptchaSecret = true, "site-key", "shh"
+	c := testsupport.New(t, newServer(cfg).handler())
+
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "fail"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/api/v1/guestbook", map[string]any{"name": "Ada", "message": "Hi", "captcha_token": "anything"}).Status(http.StatusCreated)
+}
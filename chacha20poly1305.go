@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// This file implements ChaCha20-Poly1305 (RFC 8439), the authenticated
+// cipher age encrypts with (see age.go). It isn't in the standard library's
+// public API, and this repository sticks to the standard library, so here
+// it is: ChaCha20 is a stream cipher built from additions, rotations and
+// XORs of 32-bit words, and Poly1305 is a one-time MAC computed modulo the
+// prime 2^130-5. It's written for clarity rather than speed (Poly1305 uses
+// math/big) and is only used for config values, which are small. Anything
+// performance- or side-channel-sensitive should use
+// golang.org/x/crypto/chacha20poly1305 instead.
+
+// chachaKeySize, chachaNonceSize and poly1305TagSize are in bytes.
+const (
+	chachaKeySize   = 32
+	chachaNonceSize = 12
+	poly1305TagSize = 16
+)
+
+// errOpen is returned when a ciphertext or its tag has been tampered with,
+// or the key is wrong: the two can't be told apart, by design.
+var errOpen = errors.New("message authentication failed")
+
+// chacha20Poly1305 is a cipher.AEAD, like the ones crypto/cipher returns for
+// AES-GCM.
+type chacha20Poly1305 struct {
+	key [chachaKeySize]byte
+}
+
+// newChaCha20Poly1305 returns the AEAD for a 32-byte key.
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chachaKeySize {
+		return nil, errors.New("chacha20poly1305: the key must be 32 bytes")
+	}
+	var c chacha20Poly1305
+	copy(c.key[:], key)
+	return &c, nil
+}
+
+func (c *chacha20Poly1305) NonceSize() int { return chachaNonceSize }
+
+func (c *chacha20Poly1305) Overhead() int { return poly1305TagSize }
+
+// Seal encrypts and authenticates plaintext, authenticates additionalData,
+// and appends the ciphertext and its tag to dst.
+func (c *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	// Block 0 of the key stream is the one-time Poly1305 key; the message
+	// is encrypted from block 1.
+	ciphertext := make([]byte, len(plaintext))
+	chacha20XOR(ciphertext, plaintext, &c.key, nonce, 1)
+	tag := c.tag(nonce, ciphertext, additionalData)
+	return append(append(dst, ciphertext...), tag[:]...)
+}
+
+// Open checks the tag, then decrypts and appends the plaintext to dst.
+func (c *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != chachaNonceSize {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	if len(ciphertext) < poly1305TagSize {
+		return nil, errOpen
+	}
+	ciphertext, got := ciphertext[:len(ciphertext)-poly1305TagSize], ciphertext[len(ciphertext)-poly1305TagSize:]
+	want := c.tag(nonce, ciphertext, additionalData)
+	if subtle.ConstantTimeCompare(got, want[:]) != 1 {
+		return nil, errOpen
+	}
+	plaintext := make([]byte, len(ciphertext))
+	chacha20XOR(plaintext, ciphertext, &c.key, nonce, 1)
+	return append(dst, plaintext...), nil
+}
+
+// tag computes the Poly1305 tag of the additional data and ciphertext, each
+// padded to 16 bytes, followed by their lengths.
+func (c *chacha20Poly1305) tag(nonce, ciphertext, additionalData []byte) [poly1305TagSize]byte {
+	var polyKey [64]byte
+	chacha20XOR(polyKey[:], polyKey[:], &c.key, nonce, 0)
+
+	pad := func(b []byte) []byte { return make([]byte, (16-len(b)%16)%16) }
+	var msg []byte
+	msg = append(msg, additionalData...)
+	msg = append(msg, pad(additionalData)...)
+	msg = append(msg, ciphertext...)
+	msg = append(msg, pad(ciphertext)...)
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(additionalData)))
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(ciphertext)))
+	return poly1305(polyKey[:32], msg)
+}
+
+// chacha20XOR XORs src with the ChaCha20 key stream starting at block
+// counter, writing to dst.
+func chacha20XOR(dst, src []byte, key *[chachaKeySize]byte, nonce []byte, counter uint32) {
+	// The state is four constant words ("expand 32-byte k"), the key, the
+	// block counter and the nonce.
+	var state [16]uint32
+	state[0], state[1], state[2], state[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := range 8 {
+		state[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	for i := range 3 {
+		state[13+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+
+	var block [64]byte
+	for len(src) > 0 {
+		state[12] = counter
+		chacha20Block(&block, &state)
+		n := copy(dst, src[:min(len(src), 64)])
+		subtle.XORBytes(dst[:n], src[:n], block[:n])
+		dst, src = dst[n:], src[n:]
+		counter++
+	}
+}
+
+// chacha20Block computes one 64-byte block of the key stream: 20 rounds
+// mixing the state, which is then added to the original.
+func chacha20Block(out *[64]byte, state *[16]uint32) {
+	x := *state
+	quarterRound := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for range 10 {
+		// A column round, then a diagonal round.
+		quarterRound(0, 4, 8, 12)
+		quarterRound(1, 5, 9, 13)
+		quarterRound(2, 6, 10, 14)
+		quarterRound(3, 7, 11, 15)
+		quarterRound(0, 5, 10, 15)
+		quarterRound(1, 6, 11, 12)
+		quarterRound(2, 7, 8, 13)
+		quarterRound(3, 4, 9, 14)
+	}
+	for i := range 16 {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+state[i])
+	}
+}
+
+// poly1305Prime is 2^130 - 5.
+var poly1305Prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+
+// poly1305 computes the tag of msg with a 32-byte one-time key: the message
+// is read as 16-byte little-endian numbers, each with a 1 appended, that
+// are the coefficients of a polynomial evaluated at r modulo 2^130-5. The
+// other half of the key, s, is added to the result.
+func poly1305(key, msg []byte) [poly1305TagSize]byte {
+	r := littleEndianInt(key[:16])
+	r.And(r, littleEndianInt([]byte{0xff, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f}))
+	s := littleEndianInt(key[16:32])
+
+	acc := new(big.Int)
+	for len(msg) > 0 {
+		n := min(len(msg), 16)
+		block := append(msg[:n:n], 1)
+		acc.Add(acc, littleEndianInt(block))
+		acc.Mul(acc, r)
+		acc.Mod(acc, poly1305Prime)
+		msg = msg[n:]
+	}
+	acc.Add(acc, s)
+
+	// The tag is the low 128 bits, little-endian.
+	var tag [poly1305TagSize]byte
+	be := acc.FillBytes(make([]byte, 32))
+	for i := range tag {
+		tag[i] = be[len(be)-1-i]
+	}
+	return tag
+}
+
+// littleEndianInt reads b as a little-endian number.
+func littleEndianInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
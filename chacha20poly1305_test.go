@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestChaCha20Poly1305 checks the AEAD test vector from RFC 8439, section
+// 2.8.2, and that tampering is caught.
+func TestChaCha20Poly1305(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key := unhex("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := unhex("070000004041424344454647")
+	aad := unhex("50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	want := unhex("d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691")
+
+	aead, err := newChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, aad)
+	if !bytes.Equal(sealed, want) {
+		t.Fatalf("Expected\n%x\ngot\n%x", want, sealed)
+	}
+	opened, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Expected the plaintext back, got %q %v", opened, err)
+	}
+
+	sealed[3] ^= 1
+	if _, err := aead.Open(nil, nonce, sealed, aad); err != errOpen {
+		t.Errorf("Expected a changed ciphertext to be rejected, got %v", err)
+	}
+	sealed[3] ^= 1
+	if _, err := aead.Open(nil, nonce, sealed, aad[1:]); err != errOpen {
+		t.Errorf("Expected changed additional data to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// This file builds the middleware chains. Every middleware has a name, and
+// the order they run in is declared once, in middlewareOrder. Each group
+// of routes (the server's own routes, and proxied requests) picks the
+// middleware it needs from that list, and chain puts them in the declared
+// order. The groups can't end up with the same middleware in different
+// orders, which is an easy mistake when every chain is written out by
+// hand: logging before the request ID is set, say, so log lines have no ID.
+//
+// MIDDLEWARE_ORDER can change the order, for trying things out, but not
+// the part that matters for correctness: recover has to come first, so it
+// catches panics anywhere in the chain, then requestid, logging and auth,
+// so that even a request rejected for its missing API key is logged with
+// its ID.
+
+// middlewareOrder is the default order the middleware runs in, outermost
+// first.
+var middlewareOrder = []string{
+	"recover",
+	"requestid",
+	"trace",
+	"tenant",
+	"metrics",
+	"logging",
+	"ratelimit",
+	"shed",
+	"limit",
+	"auth",
+	"signature",
+	"idempotency",
+	"inspect",
+	"servertiming",
+	"livereload",
+	"protobuf",
+	"envelope",
+}
+
+// fixedMiddlewareOrder lists the middleware whose relative order
+// MIDDLEWARE_ORDER can't change.
+var fixedMiddlewareOrder = []string{"recover", "requestid", "logging", "auth"}
+
+// Middleware groups, and the middleware each one uses. Proxied responses
+// come from another service, so the inspector, live reload and envelope,
+// which look at or rewrite the response, are left out. The health probes
+// get as little as possible (see probes.go).
+const (
+	routeGroup = "routes"
+	proxyGroup = "proxy"
+	probeGroup = "probes"
+)
+
+var middlewareGroups = map[string][]string{
+	routeGroup: {"recover", "requestid", "trace", "tenant", "metrics", "logging", "ratelimit", "shed", "limit", "signature", "idempotency", "inspect", "servertiming", "livereload", "protobuf", "envelope"},
+	proxyGroup: {"recover", "requestid", "trace", "tenant", "metrics", "logging", "ratelimit", "shed", "limit", "auth", "signature", "servertiming"},
+	probeGroup: {"recover", "requestid", "metrics"},
+}
+
+// checkMiddlewareOrder reports what's wrong with a MIDDLEWARE_ORDER: it
+// must name every middleware once, with those in fixedMiddlewareOrder in
+// that order.
+func checkMiddlewareOrder(order []string) error {
+	seen := make(map[string]bool)
+	for _, name := range order {
+		switch {
+		case !slices.Contains(middlewareOrder, name):
+			return fmt.Errorf("unknown middleware %q (use %s)", name, strings.Join(middlewareOrder, ", "))
+		case seen[name]:
+			return fmt.Errorf("%s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	for _, name := range middlewareOrder {
+		if !seen[name] {
+			return fmt.Errorf("%s is missing", name)
+		}
+	}
+	for i := 1; i < len(fixedMiddlewareOrder); i++ {
+		before, after := fixedMiddlewareOrder[i-1], fixedMiddlewareOrder[i]
+		if slices.Index(order, before) > slices.Index(order, after) {
+			return fmt.Errorf("%s must come before %s", before, after)
+		}
+	}
+	return nil
+}
+
+// availableMiddleware returns the middleware the configuration turns on, by
+// name.
+func (s *Server) availableMiddleware() map[string]func(http.HandlerFunc) http.HandlerFunc {
+	cfg := s.config()
+	available := map[string]func(http.HandlerFunc) http.HandlerFunc{
+		"recover":     s.recoverMiddleware,
+		"requestid":   requestIDMiddleware,
+		"trace":       traceMiddleware,
+		"tenant":      s.tenantMiddleware,
+		"metrics":     s.metricsMiddleware,
+		"logging":     loggingMiddleware,
+		"ratelimit":   s.rateLimitMiddleware,
+		"shed":        s.shedMiddleware,
+		"idempotency": s.idempotencyMiddleware,
+		"limit":       s.limitMiddleware,
+		"auth":        s.authMiddleware,
+		"signature":   s.signatureMiddleware,
+		"inspect":     s.inspectMiddleware,
+		"protobuf":    protobufMiddleware,
+	}
+	// With SERVER_TIMING, responses say where the time went.
+	if cfg.ServerTiming {
+		available["servertiming"] = serverTimingMiddleware
+	}
+	// In dev mode, HTML pages get the live reload script injected.
+	if cfg.DevMode {
+		available["livereload"] = liveReloadMiddleware
+	}
+	// With RESPONSE_ENVELOPE, JSON responses are wrapped in an envelope.
+	if cfg.ResponseEnvelope {
+		available["envelope"] = envelopeMiddleware
+	}
+	return available
+}
+
+// chain returns a group's middleware, outermost first, in the configured
+// order.
+func (s *Server) chain(group string) []middleware {
+	order := s.config().MiddlewareOrder
+	if len(order) == 0 {
+		order = middlewareOrder
+	}
+	available := s.availableMiddleware()
+	var chain []middleware
+	for _, name := range order {
+		if wrap, ok := available[name]; ok && slices.Contains(middlewareGroups[group], name) {
+			chain = append(chain, middleware{name, wrap})
+		}
+	}
+	return chain
+}
+
+// recoverMiddleware turns a panicking handler into a 500 response. Without
+// it, Go's server recovers from the panic itself, but by dropping the
+// connection, so the client gets no response at all. The panic and its
+// stack trace are logged. If the handler had already started its response,
+// it's too late to send a 500; the connection is dropped as before.
+func (s *Server) recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// http.ErrAbortHandler is how a handler asks for the connection
+			// to be dropped on purpose.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "Handler panicked", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+			s.notify(eventPanic, fmt.Sprintf("%s %s panicked: %v", r.Method, r.URL.Path, v))
+			if pw.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next(pw, r)
+	}
+}
+
+// panicWriter records whether the response has started.
+type panicWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (pw *panicWriter) WriteHeader(status int) {
+	pw.started = true
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *panicWriter) Write(b []byte) (int, error) {
+	pw.started = true
+	return pw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying ResponseWriter, for flushing.
+func (pw *panicWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chainNames returns the names in a middleware chain.
+func chainNames(chain []middleware) string {
+	var names []string
+	for _, m := range chain {
+		names = append(names, m.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// TestChain checks each group gets its middleware in the declared order,
+// without those the configuration turns off.
+func TestChain(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.ServerTiming = false
+	s := newServer(cfg)
+	if got, want := chainNames(s.chain(routeGroup)), "recover,requestid,trace,tenant,metrics,logging,ratelimit,shed,limit,signature,idempotency,inspect,protobuf"; got != want {
+		t.Errorf("Expected routes to use %s, got %s", want, got)
+	}
+	if got, want := chainNames(s.chain(proxyGroup)), "recover,requestid,trace,tenant,metrics,logging,ratelimit,shed,limit,auth,signature"; got != want {
+		t.Errorf("Expected proxy to use %s, got %s", want, got)
+	}
+
+	cfg.ServerTiming, cfg.ResponseEnvelope = true, true
+	cfg.MiddlewareOrder = []string{"recover", "requestid", "tenant", "trace", "logging", "auth", "limit", "shed", "metrics", "envelope", "servertiming", "inspect", "livereload"}
+	s = newServer(cfg)
+	if got, want := chainNames(s.chain(routeGroup)), "recover,requestid,tenant,trace,logging,limit,shed,metrics,envelope,servertiming,inspect"; got != want {
+		t.Errorf("Expected MIDDLEWARE_ORDER followed, got %s", got)
+	}
+}
+
+// TestCheckMiddlewareOrder checks MIDDLEWARE_ORDER must list every
+// middleware once and keep the fixed ones in order.
+func TestCheckMiddlewareOrder(t *testing.T) {
+	if err := checkMiddlewareOrder(middlewareOrder); err != nil {
+		t.Errorf("Expected the default order to be valid, got %v", err)
+	}
+
+	swap := func(a, b string) []string {
+		order := strings.Join(middlewareOrder, ",")
+		order = strings.NewReplacer(a, b, b, a).Replace(order)
+		return strings.Split(order, ",")
+	}
+	for _, tt := range []struct {
+		order []string
+		want  string
+	}{
+		{append(middlewareOrder[:len(middlewareOrder):len(middlewareOrder)], "cors"), `unknown middleware "cors"`},
+		{append(middlewareOrder[:len(middlewareOrder):len(middlewareOrder)], "trace"), "trace is listed twice"},
+		{middlewareOrder[1:], "recover is missing"},
+		{swap("requestid", "recover"), "recover must come before requestid"},
+		{swap("auth", "logging"), "logging must come before auth"},
+	} {
+		if err := checkMiddlewareOrder(tt.order); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected %q, got %v", tt.order, tt.want, err)
+		}
+	}
+
+	cfg := defaultConfig(t)
+	cfg.MiddlewareOrder = []string{"logging"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "MIDDLEWARE_ORDER: recover is missing") {
+		t.Errorf("Expected the config rejected, got %v", err)
+	}
+}
+
+// TestRecoverMiddleware checks a panic becomes a 500, unless the response
+// has started, when the connection has to be dropped instead.
+func TestRecoverMiddleware(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.recoverMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("started") {
+			w.Write([]byte("partial"))
+		}
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "internal server error") {
+		t.Errorf("Expected a 500 problem, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("Expected http.ErrAbortHandler, got %v", v)
+		}
+	}()
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?started", nil))
+	t.Error("Expected the handler to abort")
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// This file turns the binary into a small command-line tool. Operational
+// tasks (checking health from inside a container, listing routes, validating
+// configuration) ship in the same binary as the server, so there's no second
+// toolchain to install in the image.
+//
+// We use the standard library's flag package: each subcommand gets its own
+// flag.FlagSet. Libraries like cobra add niceties such as shell completion,
+// but this is all a handful of commands needs.
+
+// command describes one subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string, stdout, stderr io.Writer) error
+}
+
+// commands returns every available subcommand in the order they are listed
+// in the help output. It's a function rather than a variable because the help
+// command refers back to the list.
+func commands() []command {
+	return []command{
+		{"serve", "Start the HTTP server (the default)", runServeCommand},
+		{"worker", "Run background jobs from the Redis queue, without serving HTTP", runWorkerCommand},
+		{"version", "Print version information", runVersionCommand},
+		{"healthcheck", "Check a running server's /health endpoint", runHealthcheckCommand},
+		{"routes", "List the registered HTTP routes", runRoutesCommand},
+		{"migrate", "Manage data file migrations (up, down, status, create)", runMigrateCommand},
+		{"reencrypt", "Re-encrypt the data file's sensitive fields with the first DATA_ENCRYPTION_KEYS key", runReencryptCommand},
+		{"seed", "Load demo data into a running server", runSeedCommand},
+		{"backup", "Download a backup from a running server", runBackupCommand},
+		{"restore", "Restore a running server from a backup", runRestoreCommand},
+		{"config", "Validate, print or encrypt the configuration (config validate|print|keygen|encrypt)", runConfigCommand},
+		{"sign", "Print signature headers for a request to a signed route", runSignCommand},
+		{"bench", "Run the benchmark suite and compare against a baseline", runBenchCommand},
+		{"help", "Show this help", runHelpCommand},
+	}
+}
+
+// errUsage signals that the command line was wrong. The message has already
+// been printed, so runCLI only needs to pick the right exit code.
+var errUsage = errors.New("usage error")
+
+// runCLI dispatches to a subcommand and returns the process exit code:
+// 0 for success, 1 for failure and 2 for incorrect usage (the same
+// conventions most Unix tools follow).
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name != name {
+			continue
+		}
+
+		err := cmd.run(args, stdout, stderr)
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		default:
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n\n", name)
+	printUsage(stderr)
+	return 2
+}
+
+// printUsage lists the available commands.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: server <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'server <command> -h' for help with a command.")
+}
+
+// newFlagSet creates a FlagSet that reports errors instead of exiting, so
+// commands can be tested and runCLI stays in charge of exit codes.
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseFlags parses a command's flags, translating parse errors to errUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "Unexpected arguments: %v\n", fs.Args())
+		return errUsage
+	}
+	return nil
+}
+
+// runServeCommand starts the web server. Flags override environment variables.
+func runServeCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("serve", stderr)
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on (env PORT)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	// The flags are named after the settings' JSON names.
+	fs.Visit(func(f *flag.Flag) { cfg.setSource(f.Name, sourceFlag) })
+
+	// Check again in case a flag introduced an invalid value.
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	return serve(cfg)
+}
+
+// runVersionCommand prints the application and Go versions.
+func runVersionCommand(args []string, stdout, stderr io.Writer) error {
+	if err := parseFlags(newFlagSet("version", stderr), args); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "go-hello-devops %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// runHealthcheckCommand calls /health on a running server and fails unless it
+// answers 200 OK. Container images built FROM alpine don't include curl, so
+// Docker HEALTHCHECKs can run "server healthcheck" instead.
+func runHealthcheckCommand(args []string, stdout, stderr io.Writer) error {
+	// Only the port is needed here, so other configuration problems are
+	// ignored: they're the server's business, not the health checker's.
+	cfg, _ := loadConfig()
+
+	fs := newFlagSet("healthcheck", stderr)
+	url := fs.String("url", fmt.Sprintf("http://localhost:%d/health", cfg.Port), "health endpoint to check")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for a response")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(*url)
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check failed: %s returned %s", *url, resp.Status)
+	}
+
+	fmt.Fprintf(stdout, "OK: %s returned %s\n", *url, resp.Status)
+	return nil
+}
+
+// runRoutesCommand prints every route the server registers, either as a
+// table for people or as JSON for scripts.
+func runRoutesCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("routes", stderr)
+	asJSON := fs.Bool("json", false, "print the routes as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Listing routes doesn't depend on the configuration being valid.
+	cfg, _ := loadConfig()
+	srv := newServer(cfg)
+	srv.routes()
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(RouteListResponse{Routes: srv.registry})
+	}
+
+	// tabwriter lines up columns, like the output of "kubectl get".
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHODS\tPATH\tHANDLER\tMIDDLEWARE")
+	for _, r := range srv.registry {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			strings.Join(r.Methods, ","), r.Path, r.Handler, strings.Join(r.Middleware, " -> "))
+	}
+	return tw.Flush()
+}
+
+// runMigrateCommand manages the data file's schema migrations (see
+// migrate.go). With no subcommand it runs "up", so deployment scripts can
+// call it unconditionally, even when DATA_FILE isn't set.
+func runMigrateCommand(args []string, stdout, stderr io.Writer) error {
+	sub := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+
+	switch sub {
+	case "up", "down", "status":
+		return runMigrateData(sub, args, stdout, stderr)
+	case "create":
+		return runMigrateCreate(args, stdout, stderr)
+	}
+
+	fmt.Fprintln(stderr, "Usage: server migrate <up|down [N]|status|create NAME> [flags]")
+	return errUsage
+}
+
+// runMigrateData runs the migrate subcommands that work on the data file.
+func runMigrateData(sub string, args []string, stdout, stderr io.Writer) error {
+	cfg, _ := loadConfig()
+
+	// "down" takes an optional count before its flags.
+	count := "1"
+	if sub == "down" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		count, args = args[0], args[1:]
+	}
+
+	fs := newFlagSet("migrate "+sub, stderr)
+	file := fs.String("file", cfg.DataFile, "data file to migrate (default: $DATA_FILE)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		fmt.Fprintln(stdout, "Nothing to migrate: DATA_FILE is not set, so the store lives in memory.")
+		return nil
+	}
+	m := newMigrator(*file)
+
+	switch sub {
+	case "up":
+		applied, err := m.Up()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintf(stdout, "%s is up to date (schema version %d).\n", *file, latestSchemaVersion())
+		}
+		for _, mig := range applied {
+			fmt.Fprintf(stdout, "Applied %04d_%s\n", mig.Version, mig.Name)
+		}
+		return nil
+
+	case "down":
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			fmt.Fprintf(stderr, "migrate down: N must be a positive number, got %q\n", count)
+			return errUsage
+		}
+		reverted, err := m.Down(n)
+		if err != nil {
+			return err
+		}
+		for _, mig := range reverted {
+			fmt.Fprintf(stdout, "Reverted %04d_%s\n", mig.Version, mig.Name)
+		}
+		return nil
+	}
+
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: schema version %d of %d\n\n", *file, version, latestSchemaVersion())
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+	for _, mig := range migrations {
+		status := "pending"
+		if mig.Version <= version {
+			status = "applied"
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", mig.Version, mig.Name, status)
+	}
+	return tw.Flush()
+}
+
+// runMigrateCreate writes an empty migration for the developer to fill in.
+func runMigrateCreate(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(stderr, "Usage: server migrate create NAME [-dir DIR]")
+		return errUsage
+	}
+	name, args := args[0], args[1:]
+
+	fs := newFlagSet("migrate create", stderr)
+	dir := fs.String("dir", "migrations", "directory holding the migration files")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	paths, err := createMigration(*dir, name)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fmt.Fprintf(stdout, "Created %s\n", p)
+	}
+	fmt.Fprintln(stdout, "Migrations are embedded in the binary: rebuild after editing them.")
+	return nil
+}
+
+// runSeedCommand asks a running server to load its demo data. The data
+// lives in the server's memory, so seeding has to happen inside that process;
+// like healthcheck, this command is a small HTTP client for it.
+func runSeedCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, _ := loadConfig()
+
+	fs := newFlagSet("seed", stderr)
+	url := fs.String("url", fmt.Sprintf("http://localhost:%d/admin/seed", cfg.Port), "seed endpoint of the running server")
+	tenant := fs.String("tenant", "", "tenant to seed (default: the default tenant)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, *url, nil)
+	if err != nil {
+		return err
+	}
+	if *tenant != "" {
+		req.Header.Set(tenantHeader, *tenant)
+	}
+	setAdminKey(req, cfg)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("seeding failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("seeding failed: %s returned %s", *url, resp.Status)
+	}
+
+	var result SeedResponse
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = decodeResponse(body, &result)
+	}
+	if err != nil {
+		return fmt.Errorf("reading seed response: %w", err)
+	}
+
+	fmt.Fprintf(stdout, "Seeded tenant %q: notes %d created, %d updated, %d unchanged; guestbook %d created, %d updated, %d unchanged\n",
+		result.Tenant, result.Notes.Created, result.Notes.Updated, result.Notes.Unchanged,
+		result.Guestbook.Created, result.Guestbook.Updated, result.Guestbook.Unchanged)
+	return nil
+}
+
+// runBackupCommand downloads a backup archive from a running server and
+// checks it can be read back before declaring success.
+func runBackupCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, _ := loadConfig()
+
+	fs := newFlagSet("backup", stderr)
+	url := fs.String("url", fmt.Sprintf("http://localhost:%d/admin/backup", cfg.Port), "backup endpoint of the running server")
+	out := fs.String("o", "backup.tar.gz", "file to write the backup to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, *url, nil)
+	if err != nil {
+		return err
+	}
+	setAdminKey(req, cfg)
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup failed: %s returned %s", *url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBackupSize))
+	if err != nil {
+		return fmt.Errorf("downloading backup: %w", err)
+	}
+
+	// Verify before writing, so a bad download never replaces a good file.
+	_, manifest, err := readBackup(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("downloaded backup is invalid: %w", err)
+	}
+	if err := os.WriteFile(*out, data, 0o600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Wrote %s: %d tenants, %d notes, sha256 %s\n", *out, manifest.Tenants, manifest.Notes, manifest.SHA256)
+	return nil
+}
+
+// runRestoreCommand uploads a backup archive to a running server.
+func runRestoreCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, _ := loadConfig()
+
+	fs := newFlagSet("restore", stderr)
+	url := fs.String("url", fmt.Sprintf("http://localhost:%d/admin/restore", cfg.Port), "restore endpoint of the running server")
+	in := fs.String("i", "backup.tar.gz", "backup file to restore")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest(http.MethodPost, *url, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	setAdminKey(req, cfg)
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("restore failed: %s returned %s: %s", *url, resp.Status, bytes.TrimSpace(body))
+	}
+
+	var manifest BackupManifest
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = decodeResponse(body, &manifest)
+	}
+	if err != nil {
+		return fmt.Errorf("reading restore response: %w", err)
+	}
+
+	fmt.Fprintf(stdout, "Restored %s: %d tenants, %d notes\n", *in, manifest.Tenants, manifest.Notes)
+	return nil
+}
+
+// runConfigCommand groups configuration subcommands under "config".
+func runConfigCommand(args []string, stdout, stderr io.Writer) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return runConfigValidate(args[1:], stdout, stderr)
+		case "print":
+			return runConfigPrint(args[1:], stdout, stderr)
+		case "keygen":
+			return runConfigKeygen(args[1:], stdout, stderr)
+		case "encrypt":
+			return runConfigEncrypt(args[1:], stdout, stderr)
+		}
+	}
+
+	fmt.Fprintln(stderr, "Usage: server config <validate|print|keygen|encrypt> [flags]")
+	return errUsage
+}
+
+// runConfigValidate loads the configuration and reports whether it is valid,
+// so misconfiguration is caught before deploying rather than at startup.
+func runConfigValidate(args []string, stdout, stderr io.Writer) error {
+	if err := parseFlags(newFlagSet("config validate", stderr), args); err != nil {
+		return err
+	}
+
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, "Configuration is valid.")
+	return nil
+}
+
+// runConfigPrint prints the effective configuration, after defaults have been
+// applied, with secret values redacted.
+func runConfigPrint(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("config print", stderr)
+	format := fs.String("format", "yaml", "output format: yaml or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Print whatever could be loaded even if some settings are invalid:
+	// seeing the effective values is often how you find the mistake.
+	cfg, loadErr := loadConfig()
+
+	var err error
+	switch *format {
+	case "yaml":
+		err = writeConfigYAML(stdout, cfg)
+	case "json":
+		err = writeConfigJSON(stdout, cfg)
+	default:
+		fmt.Fprintf(stderr, "Unknown format %q (want yaml or json)\n", *format)
+		return errUsage
+	}
+	if err != nil {
+		return err
+	}
+	return loadErr
+}
+
+// runConfigKeygen prints a new age identity for encrypting .env values, in
+// the format of age-keygen, which SOPS_AGE_KEY_FILE can point at.
+func runConfigKeygen(args []string, stdout, stderr io.Writer) error {
+	if err := parseFlags(newFlagSet("config keygen", stderr), args); err != nil {
+		return err
+	}
+
+	identity, recipient, err := newAgeIdentity()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "# created: %s\n# public key: %s\n%s\n", time.Now().UTC().Format(time.RFC3339), recipient, identity)
+	return nil
+}
+
+// runConfigEncrypt encrypts a value for the .env file (see
+// encryptedenv.go). The value is read from standard input unless -value is
+// given, so it stays out of the shell's history.
+func runConfigEncrypt(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("config encrypt", stderr)
+	to := fs.String("r", "", "comma-separated age recipients (default: those of SOPS_AGE_KEY or SOPS_AGE_KEY_FILE)")
+	value := fs.String("value", "", "the value to encrypt (default: read from standard input)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var recipients []*ecdh.PublicKey
+	for _, r := range strings.Split(*to, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		recipient, err := parseAgeRecipient(r)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		identities, err := ageIdentitiesFromEnv(os.Getenv)
+		if err != nil {
+			return fmt.Errorf("no recipients given with -r: %w", err)
+		}
+		for _, identity := range identities {
+			recipients = append(recipients, identity.PublicKey())
+		}
+	}
+
+	plaintext := *value
+	if plaintext == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		plaintext = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	}
+	encrypted, err := ageEncrypt([]byte(plaintext), recipients)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, ageValuePrefix+base64.StdEncoding.EncodeToString(encrypted))
+	return nil
+}
+
+// runSignCommand prints the headers that sign a request for SIGNED_ROUTES
+// (see signature.go), to add to curl with -H:
+//
+//	go run . sign -method POST -path /api/v1/notes -body '{"title": "Hi"}'
+func runSignCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("sign", stderr)
+	key := fs.String("key", "", "the signing key (default: the first of SIGNING_KEYS)")
+	method := fs.String("method", http.MethodGet, "the request's method")
+	path := fs.String("path", "", "the request's path and query, as it will be sent")
+	body := fs.String("body", "", "the request's body, exactly as it will be sent")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(*path, "/") {
+		fmt.Fprintln(stderr, "-path is required, and starts with /")
+		return errUsage
+	}
+	if *key == "" {
+		// Whatever else is wrong with the configuration, the keys may be
+		// fine.
+		if cfg, _ := loadConfig(); len(cfg.SigningKeys) > 0 {
+			*key = cfg.SigningKeys[0]
+		} else {
+			return errors.New("no key: pass -key or set SIGNING_KEYS")
+		}
+	}
+
+	req, err := http.NewRequest(*method, *path, strings.NewReader(*body))
+	if err != nil {
+		return err
+	}
+	if err := signRequest(req, *key, time.Now()); err != nil {
+		return err
+	}
+	for _, name := range []string{signatureTimestampHeader, signatureHeader} {
+		fmt.Fprintf(stdout, "%s: %s\n", name, req.Header.Get(name))
+	}
+	return nil
+}
+
+// runHelpCommand prints the list of commands.
+func runHelpCommand(args []string, stdout, stderr io.Writer) error {
+	printUsage(stdout)
+	return nil
+}
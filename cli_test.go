@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRunCLIUnknownCommand verifies that a typo gets a usage message and the
+// conventional exit code 2 rather than silently starting the server.
+func TestRunCLIUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	if code := runCLI([]string{"sevre"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "Unknown command") {
+		t.Errorf("Expected an unknown command message, got %q", stderr.String())
+	}
+}
+
+// TestVersionCommand checks the version command prints the version.
+func TestVersionCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	if code := runCLI([]string{"version"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), version) {
+		t.Errorf("Expected output to contain version %s, got %q", version, stdout.String())
+	}
+}
+
+// TestHealthcheckCommand runs the healthcheck command against a real HTTP
+// server. httptest.NewServer starts one on a random free port.
+func TestHealthcheckCommand(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(handleHealth))
+	defer ts.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"healthcheck", "-url", ts.URL}, &stdout, &stderr); code != 0 {
+		t.Errorf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	if code := runCLI([]string{"healthcheck", "-url", failing.URL}, &stdout, &stderr); code != 1 {
+		t.Errorf("Expected exit code 1 for an unhealthy server, got %d", code)
+	}
+}
+
+// TestRoutesCommand checks that the routes command lists registered routes.
+func TestRoutesCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	if code := runCLI([]string{"routes"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{"/health", "/api/v1/notes/{id}", "(*Server).handleGetNote"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("Expected routes output to contain %q", want)
+		}
+	}
+}
+
+// TestConfigPrintCommand checks that config print emits valid JSON.
+func TestConfigPrintCommand(t *testing.T) {
+	t.Setenv("PORT", "9000")
+
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"config", "print", "-format", "json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	var printed map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &printed); err != nil {
+		t.Fatalf("Expected JSON output, got %q: %v", stdout.String(), err)
+	}
+	if printed["port"] != float64(9000) {
+		t.Errorf("Expected port 9000, got %v", printed["port"])
+	}
+}
+
+// TestConfigKeygenAndEncrypt encrypts a value to a key from config keygen
+// and decrypts it the way loading the .env file does.
+func TestConfigKeygenAndEncrypt(t *testing.T) {
+	var keyOut, stderr bytes.Buffer
+	if code := runCLI([]string{"config", "keygen"}, &keyOut, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(keyOut.String()), "\n")
+	recipient, _ := strings.CutPrefix(lines[1], "# public key: ")
+
+	var encrypted bytes.Buffer
+	if code := runCLI([]string{"config", "encrypt", "-r", recipient, "-value", "hunter2"}, &encrypted, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	vars := []dotenvVar{{"SMTP_PASSWORD", strings.TrimSpace(encrypted.String())}}
+	got, err := decryptDotenv(vars, func(key string) string { return map[string]string{"SOPS_AGE_KEY": keyOut.String()}[key] })
+	if err != nil || got[0].value != "hunter2" {
+		t.Errorf("Expected the value to decrypt, got %v %v", got, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+// This file defines Clock, the server's source of the current time and of
+// tickers and timers. Code that calls time.Now directly can only be tested
+// by waiting for real time to pass, and what it does depends on when the
+// test happens to run. Going through a Clock lets tests swap in a fake one
+// (fakeClock, in clock_test.go) that stands still until the test moves it
+// on: a note is created at exactly 12:00, and the purge job runs exactly
+// when the test advances the clock past its interval.
+//
+// The Server and the Store have a clock; newServer gives both realClock.
+// Timestamps that end up in responses or data, the background jobs'
+// tickers, the proxy's ejection and circuit breaker timing, and the pauses
+// between startup dependency checks go through it. A few things still use
+// time.Now and time.Since:
+//   - durations that are only measured for logs and metrics, like a
+//     request's latency: they're about real elapsed time, and tests don't
+//     depend on them.
+//   - handleHealth's timestamp. It's a plain function, so that it can be
+//     served without a Server, and the time only shows the process
+//     answered.
+//   - when an upstream's addresses were last looked up, which is about
+//     real DNS lookups.
+
+// Clock tells the time and makes tickers and timers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is a time.Ticker. Its channel is returned by a method, since an
+// interface can't have fields.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Timer is a time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time   { return r.t.C }
+func (r realTicker) Stop()                 { r.t.Stop() }
+func (r realTicker) Reset(d time.Duration) { r.t.Reset(d) }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// fakeClock is a Clock that only moves when Advance is called. Its tickers
+// and timers fire during Advance, at the times they would have fired, and
+// like real ones they drop ticks nobody has received yet.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// newFakeClock returns a fake clock showing now.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// useClock makes s and its store use clock.
+func (s *Server) useClock(clock Clock) {
+	s.clock = clock
+	s.store.clock = clock
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{c.add(d, 0)}
+}
+
+// Advance moves the clock on by d, firing whatever is due on the way.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for _, w := range c.waiters {
+			if !w.at.IsZero() && !w.at.After(end) && (next == nil || w.at.Before(next.at)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.at
+		next.fire()
+	}
+	c.now = end
+}
+
+// Waiters counts the tickers and timers that are running.
+func (c *fakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, w := range c.waiters {
+		if !w.at.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// add starts a waiter due in d, repeating every period if it's not 0.
+func (c *fakeClock) add(d, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{clock: c, ch: make(chan time.Time, 1), period: period}
+	c.waiters = append(c.waiters, w)
+	w.start(d)
+	return w
+}
+
+// fakeWaiter is the state shared by fake tickers and timers. at is when it
+// next fires, or zero once stopped. The clock's lock protects it.
+type fakeWaiter struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+// start schedules the waiter d from now, firing at once if that's not in
+// the future. The caller holds the clock's lock.
+func (w *fakeWaiter) start(d time.Duration) {
+	w.at = w.clock.now.Add(d)
+	if d <= 0 {
+		w.fire()
+	}
+}
+
+// fire sends the time, unless the last one hasn't been received yet, and
+// schedules the next tick. The caller holds the clock's lock.
+func (w *fakeWaiter) fire() {
+	select {
+	case w.ch <- w.clock.now:
+	default:
+	}
+	if w.period > 0 {
+		w.at = w.at.Add(w.period)
+	} else {
+		w.at = time.Time{}
+	}
+}
+
+// stop stops the waiter and reports whether it was running.
+func (w *fakeWaiter) stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	running := !w.at.IsZero()
+	w.at = time.Time{}
+	return running
+}
+
+// reset restarts the waiter, due in d, and reports whether it was running.
+func (w *fakeWaiter) reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	running := !w.at.IsZero()
+	if w.period > 0 {
+		w.period = d
+	}
+	w.start(d)
+	return running
+}
+
+type fakeTicker struct{ w *fakeWaiter }
+
+func (t fakeTicker) C() <-chan time.Time   { return t.w.ch }
+func (t fakeTicker) Stop()                 { t.w.stop() }
+func (t fakeTicker) Reset(d time.Duration) { t.w.reset(d) }
+
+type fakeTimer struct{ w *fakeWaiter }
+
+func (t fakeTimer) C() <-chan time.Time        { return t.w.ch }
+func (t fakeTimer) Stop() bool                 { return t.w.stop() }
+func (t fakeTimer) Reset(d time.Duration) bool { return t.w.reset(d) }
+
+// eventually fails the test unless cond becomes true within a few seconds.
+// Background jobs react to a fake clock's ticks in their own goroutine, so
+// tests have to wait for the result.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestFakeClock checks tickers and timers fire when the clock passes their
+// time, and not after they're stopped.
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	ticker := clock.NewTicker(time.Minute)
+	timer := clock.NewTimer(90 * time.Second)
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("Expected no tick before a minute")
+	case <-timer.C():
+		t.Fatal("Expected the timer not to fire yet")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if got := <-ticker.C(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected a tick at 12:01, got %v", got)
+	}
+
+	clock.Advance(time.Hour)
+	if got := <-timer.C(); !got.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("Expected the timer at 12:01:30, got %v", got)
+	}
+	if got := <-ticker.C(); !got.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("Expected the ticks after that dropped, got %v", got)
+	}
+	if timer.Stop() {
+		t.Error("Expected the fired timer to be stopped already")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("Expected no tick after Stop")
+	default:
+	}
+	if clock.Waiters() != 0 || !clock.Now().Equal(start.Add(2*time.Hour+time.Minute)) {
+		t.Errorf("Expected nothing running at 14:01, got %d at %v", clock.Waiters(), clock.Now())
+	}
+}
+
+// TestClockTimestamps checks records are stamped with the server's clock.
+func TestClockTimestamps(t *testing.T) {
+	s, c := newTestServer(t)
+	at := time.Date(2024, 2, 29, 9, 30, 0, 0, time.UTC)
+	s.useClock(newFakeClock(at))
+
+	note := testsupport.Decode[Note](c.Post("/api/v1/notes", map[string]string{"title": "Leap day"}).Status(http.StatusCreated))
+	if !note.CreatedAt.Equal(at) {
+		t.Errorf("Expected the note created at %v, got %v", at, note.CreatedAt)
+	}
+	message := testsupport.Decode[MessageResponse](c.Get("/api/v1/message").Status(http.StatusOK))
+	if message.Time != "2024-02-29T09:30:00Z" {
+		t.Errorf("Expected the message time from the clock, got %q", message.Time)
+	}
+	utc := testsupport.Decode[TimeResponse](c.Get("/api/v1/time/UTC").Status(http.StatusOK))
+	if utc.Unix != at.Unix() {
+		t.Errorf("Expected the time from the clock, got %+v", utc)
+	}
+}
+
+// TestPurgeSchedule runs the purge job on a fake clock: a deleted note is
+// purged at the first run after the retention period, not before.
+func TestPurgeSchedule(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.DeletedNoteRetention = 24 * time.Hour
+	s := newServer(cfg)
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+
+	note := s.store.CreateNote(defaultTenant, "Old", "")
+	s.store.DeleteNote(defaultTenant, note.ID, nil)
+	kept := s.store.CreateNote(defaultTenant, "Kept", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.purgeDeletedNotes(ctx, time.Hour)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+
+	clock.Advance(23 * time.Hour)
+	if len(s.store.ListNotesWithDeleted(defaultTenant)) != 2 {
+		t.Fatal("Expected the note kept for the retention period")
+	}
+	clock.Advance(2 * time.Hour)
+	eventually(t, func() bool { return len(s.store.ListNotesWithDeleted(defaultTenant)) == 1 })
+	if _, ok := s.store.GetNote(defaultTenant, kept.ID); !ok {
+		t.Error("Expected the other note kept")
+	}
+
+	cancel()
+	eventually(t, func() bool { return clock.Waiters() == 0 })
+}
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the application's settings. Following the twelve-factor app
+// guidelines, everything that differs between environments (development,
+// staging, production) comes from environment variables rather than code.
+//
+// Each field describes itself with struct tags, in the style of the popular
+// envconfig library:
+//
+//	env:"PORT"         the environment variable to read
+//	default:"8000"     the value used when the variable isn't set
+//	required:"true"    the variable must be set (and not empty)
+//	min:"1" max:"10"   allowed range for numbers and durations
+//	json:"port"        the name used when printing the configuration
+//	secret:"true"      the value is redacted when printing
+//	reload:"true"      the setting can change at runtime (see reload.go)
+//
+// Adding a setting is a matter of adding a field: loading, validation and
+// "config print" all work from the tags.
+type Config struct {
+	// Port is the TCP port the HTTP server listens on.
+	Port int `env:"PORT" default:"8000" min:"1" max:"65535" json:"port"`
+
+	// TenantDomain is the base domain for subdomain-based tenant selection.
+	TenantDomain string `env:"TENANT_DOMAIN" json:"tenant_domain"`
+
+	// Tenants are the tenants served besides the default one (see
+	// tenant.go). Requests for any other get a 404.
+	Tenants []string `env:"TENANTS" json:"tenants" reload:"true"`
+
+	// ReadTimeout, WriteTimeout and IdleTimeout protect the server from slow
+	// or idle clients holding connections open forever.
+	ReadTimeout  time.Duration `env:"READ_TIMEOUT" default:"15s" min:"1s" max:"10m" json:"read_timeout"`
+	WriteTimeout time.Duration `env:"WRITE_TIMEOUT" default:"15s" min:"1s" max:"10m" json:"write_timeout"`
+	IdleTimeout  time.Duration `env:"IDLE_TIMEOUT" default:"60s" min:"1s" max:"1h" json:"idle_timeout"`
+
+	// DevMode reads templates and static files from disk and reloads them
+	// when they change, instead of using the copies embedded in the binary.
+	DevMode bool `env:"DEV_MODE" default:"false" json:"dev_mode"`
+
+	// LogLevel is the minimum level of log messages to print: debug, info,
+	// warn or error.
+	LogLevel string `env:"LOG_LEVEL" default:"info" json:"log_level" reload:"true"`
+
+	// BannerText is an optional announcement shown on the landing page.
+	BannerText string `env:"BANNER_TEXT" json:"banner_text" reload:"true"`
+
+	// ResponseEnvelope wraps every JSON response in {data, error, meta}
+	// (see envelope.go). It isn't reloadable: clients shouldn't see the
+	// shape of responses change under them.
+	ResponseEnvelope bool `env:"RESPONSE_ENVELOPE" default:"false" json:"response_envelope"`
+
+	// DataFile is where the store is saved. When empty, data lives only in
+	// memory and is lost on restart.
+	DataFile string `env:"DATA_FILE" json:"data_file"`
+
+	// MigrateOnStart applies pending migrations to DataFile before the
+	// server starts, instead of requiring a separate "migrate up" step.
+	MigrateOnStart bool `env:"MIGRATE_ON_START" default:"false" json:"migrate_on_start"`
+
+	// DeletedNoteRetention is how long deleted notes can still be restored
+	// before the purge job removes them for good, checked every
+	// PurgeInterval.
+	DeletedNoteRetention time.Duration `env:"DELETED_NOTE_RETENTION" default:"720h" min:"1m" json:"deleted_note_retention" reload:"true"`
+	PurgeInterval        time.Duration `env:"PURGE_INTERVAL" default:"1h" min:"1s" max:"24h" json:"purge_interval"`
+
+	// CounterSaveInterval is how often counter changes are saved to
+	// DataFile. They're batched rather than saved on every page view
+	// (see Store.Flush).
+	CounterSaveInterval time.Duration `env:"COUNTER_SAVE_INTERVAL" default:"5s" min:"100ms" max:"5m" json:"counter_save_interval"`
+
+	// BlobBackend selects where uploaded files are stored: "local" (under
+	// UploadDir) or "s3" (an S3-compatible bucket, configured below).
+	BlobBackend string `env:"BLOB_BACKEND" default:"local" json:"blob_backend"`
+
+	// UploadDir is where the local backend stores uploaded files, one
+	// directory per tenant.
+	UploadDir string `env:"UPLOAD_DIR" default:"uploads" json:"upload_dir"`
+
+	// S3 settings for BLOB_BACKEND=s3. S3Endpoint is the service's base
+	// URL, for example https://s3.eu-west-1.amazonaws.com or
+	// http://minio:9000.
+	S3Endpoint  string `env:"S3_ENDPOINT" json:"s3_endpoint"`
+	S3Region    string `env:"S3_REGION" default:"us-east-1" json:"s3_region"`
+	S3Bucket    string `env:"S3_BUCKET" json:"s3_bucket"`
+	S3AccessKey string `env:"S3_ACCESS_KEY" json:"s3_access_key"`
+	S3SecretKey string `env:"S3_SECRET_KEY" json:"s3_secret_key" secret:"true"`
+
+	// SignedURLExpiry is how long a signed S3 download URL stays valid.
+	SignedURLExpiry time.Duration `env:"SIGNED_URL_EXPIRY" default:"15m" min:"1s" max:"168h" json:"signed_url_expiry" reload:"true"`
+
+	// UploadMaxBytes is the largest file POST /api/v1/files accepts.
+	UploadMaxBytes int64 `env:"UPLOAD_MAX_BYTES" default:"10485760" min:"1" json:"upload_max_bytes" reload:"true"`
+
+	// UploadAllowedTypes lists the media types uploads may have, as
+	// detected from the file's contents, comma-separated.
+	UploadAllowedTypes []string `env:"UPLOAD_ALLOWED_TYPES" default:"image/png,image/jpeg,image/gif,image/webp,text/plain,application/pdf" json:"upload_allowed_types" reload:"true"`
+
+	// QuoteSource selects where GET /api/v1/quote gets its quotes:
+	// "embedded" (a small list built into the binary), "http" (the JSON API
+	// at QuoteAPIURL) or "llm" (a language model, see LLMURL). When the
+	// source fails, the embedded list is used instead.
+	QuoteSource string `env:"QUOTE_SOURCE" default:"embedded" json:"quote_source"`
+
+	// QuoteCacheTTL is how long a quote is reused before fetching a new
+	// one; 0 fetches one for every request. QuoteTimeout limits each fetch.
+	QuoteCacheTTL time.Duration `env:"QUOTE_CACHE_TTL" default:"1h" min:"0s" max:"24h" json:"quote_cache_ttl"`
+	QuoteTimeout  time.Duration `env:"QUOTE_TIMEOUT" default:"5s" min:"100ms" max:"1m" json:"quote_timeout"`
+
+	// QuoteAPIURL is the API used by QUOTE_SOURCE=http. It must answer
+	// with a JSON object holding "quote" (or "text") and "author".
+	QuoteAPIURL string `env:"QUOTE_API_URL" default:"https://dummyjson.com/quotes/random" json:"quote_api_url"`
+
+	// LLM settings for QUOTE_SOURCE=llm. LLMURL is an OpenAI-compatible
+	// chat completions endpoint, which most model servers provide; the
+	// default is a local Ollama. LLMAPIKey is sent as a bearer token if set.
+	LLMURL    string `env:"LLM_URL" default:"http://localhost:11434/v1/chat/completions" json:"llm_url"`
+	LLMModel  string `env:"LLM_MODEL" default:"llama3.2" json:"llm_model"`
+	LLMAPIKey string `env:"LLM_API_KEY" json:"llm_api_key" secret:"true"`
+
+	// Weather API endpoints for GET /api/v1/weather. The defaults are
+	// Open-Meteo's, which need no API key.
+	WeatherGeocodingURL string `env:"WEATHER_GEOCODING_URL" default:"https://geocoding-api.open-meteo.com/v1/search" json:"weather_geocoding_url"`
+	WeatherForecastURL  string `env:"WEATHER_FORECAST_URL" default:"https://api.open-meteo.com/v1/forecast" json:"weather_forecast_url"`
+
+	// WeatherCacheTTL is how long a city's weather is served from the
+	// cache. When the weather API is down, expired results are still served
+	// (marked stale) for up to WeatherMaxStale longer.
+	WeatherCacheTTL time.Duration `env:"WEATHER_CACHE_TTL" default:"10m" min:"1s" max:"24h" json:"weather_cache_ttl"`
+	WeatherMaxStale time.Duration `env:"WEATHER_MAX_STALE" default:"6h" min:"0s" max:"168h" json:"weather_max_stale"`
+
+	// MockExternal answers calls to the quote, LLM and weather APIs with
+	// made-up, deterministic responses instead of calling them (see
+	// mock.go), for offline demos and tests.
+	MockExternal bool `env:"MOCK_EXTERNAL" default:"false" json:"mock_external"`
+
+	// PodInfoDir is where a Kubernetes downwardAPI volume with the pod's
+	// labels and annotations is mounted, if there is one (see instance.go).
+	PodInfoDir string `env:"PODINFO_DIR" default:"/etc/podinfo" json:"podinfo_dir"`
+
+	// ShutdownDelay is how long the server keeps serving, with /readyz
+	// failing, after SIGTERM; ShutdownTimeout then bounds how long it waits
+	// for requests in progress to finish (see shutdown.go).
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY" default:"5s" min:"0s" max:"5m" json:"shutdown_delay"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" default:"20s" min:"1s" max:"10m" json:"shutdown_timeout"`
+
+	// Readiness checks (see readiness.go): each check gets
+	// ReadinessCheckTimeout, results are reused for ReadinessCacheTTL, and
+	// the disks holding the data file and uploads need ReadinessMinDiskFree
+	// bytes available.
+	ReadinessCheckTimeout time.Duration `env:"READINESS_CHECK_TIMEOUT" default:"800ms" min:"10ms" max:"30s" json:"readiness_check_timeout"`
+	ReadinessCacheTTL     time.Duration `env:"READINESS_CACHE_TTL" default:"2s" min:"0s" max:"1m" json:"readiness_cache_ttl"`
+	ReadinessMinDiskFree  int64         `env:"READINESS_MIN_DISK_FREE" default:"104857600" min:"0" json:"readiness_min_disk_free"`
+
+	// WaitFor lists dependencies (host:port or http(s) URLs) to wait for
+	// before the server starts listening, for at most WaitTimeout (see
+	// waitfor.go).
+	WaitFor     []string      `env:"WAIT_FOR" json:"wait_for"`
+	WaitTimeout time.Duration `env:"WAIT_TIMEOUT" default:"60s" min:"1s" max:"30m" json:"wait_timeout"`
+
+	// Consul service registration (see consul.go), off unless ConsulAddr,
+	// the agent's URL, is set. ConsulServiceAddress is the address Consul
+	// gives out for this instance, by default its first non-loopback IP.
+	ConsulAddr           string        `env:"CONSUL_ADDR" json:"consul_addr"`
+	ConsulToken          string        `env:"CONSUL_TOKEN" json:"consul_token" secret:"true"`
+	ConsulServiceName    string        `env:"CONSUL_SERVICE_NAME" default:"go-hello-devops" json:"consul_service_name"`
+	ConsulServiceTags    []string      `env:"CONSUL_SERVICE_TAGS" json:"consul_service_tags"`
+	ConsulServiceAddress string        `env:"CONSUL_SERVICE_ADDRESS" json:"consul_service_address"`
+	ConsulCheckInterval  time.Duration `env:"CONSUL_CHECK_INTERVAL" default:"10s" min:"1s" max:"10m" json:"consul_check_interval"`
+
+	// Upstreams names the services the server can forward requests to, as
+	// a list of name=target; they're looked up again every
+	// UpstreamRefreshInterval (see resolver.go).
+	Upstreams               []string      `env:"UPSTREAMS" json:"upstreams"`
+	UpstreamRefreshInterval time.Duration `env:"UPSTREAM_REFRESH_INTERVAL" default:"30s" min:"1s" max:"1h" json:"upstream_refresh_interval"`
+
+	// ProxyRoutes forwards requests under a path prefix to an upstream, as a
+	// list of prefix=upstream (see proxy.go). GatewayRoutesFile is a JSON
+	// file of routes with more options, and GatewayAPIKeys are the keys
+	// accepted by routes that require one. ProxyTimeout bounds the wait for
+	// an upstream's response headers, and ProxyRetries how many other
+	// endpoints a failed idempotent request is tried on.
+	ProxyRoutes       []string      `env:"PROXY_ROUTES" json:"proxy_routes" reload:"true"`
+	GatewayRoutesFile string        `env:"GATEWAY_ROUTES_FILE" json:"gateway_routes_file" reload:"true"`
+	GatewayAPIKeys    []string      `env:"GATEWAY_API_KEYS" json:"gateway_api_keys" secret:"true" reload:"true"`
+	ProxyTimeout      time.Duration `env:"PROXY_TIMEOUT" default:"30s" min:"1s" max:"5m" json:"proxy_timeout"`
+	ProxyRetries      int           `env:"PROXY_RETRIES" default:"2" min:"0" max:"5" json:"proxy_retries"`
+
+	// ProxyLBStrategy chooses an upstream endpoint for each request:
+	// round_robin or least_connections. Endpoints failing ProxyEjectAfter
+	// requests in a row are skipped for ProxyEjectDuration, and an
+	// upstream failing ProxyBreakerFailures in a row is not sent requests
+	// for ProxyBreakerCooldown; 0 turns either off (see balancer.go).
+	ProxyLBStrategy      string        `env:"PROXY_LB_STRATEGY" default:"round_robin" json:"proxy_lb_strategy"`
+	ProxyEjectAfter      int           `env:"PROXY_EJECT_AFTER" default:"3" min:"0" json:"proxy_eject_after"`
+	ProxyEjectDuration   time.Duration `env:"PROXY_EJECT_DURATION" default:"30s" min:"1s" max:"1h" json:"proxy_eject_duration"`
+	ProxyBreakerFailures int           `env:"PROXY_BREAKER_FAILURES" default:"5" min:"0" json:"proxy_breaker_failures"`
+	ProxyBreakerCooldown time.Duration `env:"PROXY_BREAKER_COOLDOWN" default:"30s" min:"1s" max:"1h" json:"proxy_breaker_cooldown"`
+
+	// ServerTiming adds a Server-Timing header to responses, showing where
+	// the server spent its time (see servertiming.go).
+	ServerTiming bool `env:"SERVER_TIMING" default:"true" json:"server_timing"`
+
+	// MiddlewareOrder overrides the order the middleware runs in, outermost
+	// first (see chain.go). Empty means the default order.
+	MiddlewareOrder []string `env:"MIDDLEWARE_ORDER" json:"middleware_order"`
+
+	// AdminAPIKeys, when set, are the keys the /admin endpoints require, as
+	// Authorization: Bearer <key> (see admin.go). When empty, they're
+	// closed, unless DevMode is on.
+	AdminAPIKeys []string `env:"ADMIN_API_KEYS" json:"admin_api_keys" secret:"true" reload:"true"`
+
+	// SigningKeys, when set, are the shared keys requests to SignedRoutes
+	// (path prefixes) must be signed with, and SignatureMaxAge is how far a
+	// signature's timestamp can be from the server's clock (see
+	// signature.go).
+	SigningKeys     []string      `env:"SIGNING_KEYS" json:"signing_keys" secret:"true" reload:"true"`
+	SignedRoutes    []string      `env:"SIGNED_ROUTES" json:"signed_routes" reload:"true"`
+	SignatureMaxAge time.Duration `env:"SIGNATURE_MAX_AGE" default:"5m" min:"1s" max:"1h" json:"signature_max_age" reload:"true"`
+
+	// JWTSecret is what the keys that sign JWTs are derived from, a new
+	// key every JWTKeyRotation, each still accepted for JWTKeyGrace after
+	// it's replaced. Tokens are issued by JWTIssuer and last JWTTTL (see
+	// jwt.go), with a refresh token that lasts JWTRefreshTTL (see
+	// refresh.go). Without a secret, a random one is made at startup.
+	JWTSecret      string        `env:"JWT_SECRET" json:"jwt_secret" secret:"true"`
+	JWTIssuer      string        `env:"JWT_ISSUER" default:"go-hello-devops" json:"jwt_issuer"`
+	JWTTTL         time.Duration `env:"JWT_TTL" default:"15m" min:"1m" max:"24h" json:"jwt_ttl" reload:"true"`
+	JWTKeyRotation time.Duration `env:"JWT_KEY_ROTATION" default:"24h" min:"1m" max:"2160h" json:"jwt_key_rotation"`
+	JWTKeyGrace    time.Duration `env:"JWT_KEY_GRACE" default:"24h" min:"0s" max:"2160h" json:"jwt_key_grace"`
+	JWTRefreshTTL  time.Duration `env:"JWT_REFRESH_TTL" default:"720h" min:"1h" max:"8760h" json:"jwt_refresh_ttl" reload:"true"`
+
+	// PasswordHashMemory (in KiB) and PasswordHashIterations are the costs
+	// of the Argon2id hashes of new passwords (see argon2.go). The defaults
+	// are OWASP's minimum; raising them slows down logins and guessing
+	// alike. Stored hashes keep the costs they were made with.
+	PasswordHashMemory     int `env:"PASSWORD_HASH_MEMORY" default:"19456" min:"8" max:"1048576" json:"password_hash_memory" reload:"true"`
+	PasswordHashIterations int `env:"PASSWORD_HASH_ITERATIONS" default:"2" min:"1" max:"10" json:"password_hash_iterations" reload:"true"`
+
+	// PasswordHashMaxMemory (in KiB) is how much memory the password
+	// hashes running at once may take; further logins and registrations
+	// wait (see hashlimit.go). The default fits six hashes at the default
+	// cost.
+	PasswordHashMaxMemory int `env:"PASSWORD_HASH_MAX_MEMORY" default:"131072" min:"8" max:"16777216" json:"password_hash_max_memory" reload:"true"`
+
+	// DataEncryptionKeys encrypt the sensitive fields of DataFile, such as
+	// users' email addresses, with AES-256-GCM (see fieldcrypt.go): the
+	// first encrypts, the others only decrypt, for changing keys.
+	DataEncryptionKeys []string `env:"DATA_ENCRYPTION_KEYS" json:"data_encryption_keys" secret:"true"`
+
+	// LoginMaxFailures failed logins in a row lock an account for
+	// LoginLockout, and LoginMaxFailuresPerIP lock a client's address, for
+	// twice as long each time (see lockout.go). 0 turns either off.
+	LoginMaxFailures      int           `env:"LOGIN_MAX_FAILURES" default:"5" min:"0" json:"login_max_failures" reload:"true"`
+	LoginMaxFailuresPerIP int           `env:"LOGIN_MAX_FAILURES_PER_IP" default:"20" min:"0" json:"login_max_failures_per_ip" reload:"true"`
+	LoginLockout          time.Duration `env:"LOGIN_LOCKOUT" default:"15m" min:"1s" max:"24h" json:"login_lockout" reload:"true"`
+
+	// AccountEraseInterval is how often accounts whose users asked to be
+	// deleted are erased (see privacy.go).
+	AccountEraseInterval time.Duration `env:"ACCOUNT_ERASE_INTERVAL" default:"1m" min:"1s" max:"24h" json:"account_erase_interval"`
+
+	// HandlerTimeout is how long a handler has to answer before the client
+	// gets a 503, and RouteTimeouts overrides it for some routes, as a list
+	// of pattern=duration (see timeout.go). 0 means no deadline.
+	HandlerTimeout time.Duration `env:"HANDLER_TIMEOUT" default:"10s" min:"0s" max:"10m" json:"handler_timeout" reload:"true"`
+	RouteTimeouts  []string      `env:"ROUTE_TIMEOUTS" json:"route_timeouts" reload:"true"`
+
+	// MaxInFlight caps the requests handled at once, and RouteMaxInFlight
+	// caps some routes, as a list of pattern=n (see limit.go). 0 means no
+	// limit.
+	MaxInFlight      int      `env:"MAX_IN_FLIGHT" default:"0" min:"0" json:"max_in_flight" reload:"true"`
+	RouteMaxInFlight []string `env:"ROUTE_MAX_IN_FLIGHT" json:"route_max_in_flight" reload:"true"`
+
+	// MaxQueued requests over those limits wait up to QueueTimeout for a
+	// slot, before being turned away. 0 means none wait.
+	MaxQueued    int           `env:"MAX_QUEUED" default:"0" min:"0" json:"max_queued" reload:"true"`
+	QueueTimeout time.Duration `env:"QUEUE_TIMEOUT" default:"1s" min:"0s" max:"1m" json:"queue_timeout" reload:"true"`
+
+	// RateLimit is how many requests each client can make every
+	// RateLimitWindow (see ratelimit.go). 0 means no limit.
+	RateLimit       int           `env:"RATE_LIMIT" default:"0" min:"0" json:"rate_limit" reload:"true"`
+	RateLimitWindow time.Duration `env:"RATE_LIMIT_WINDOW" default:"1m" min:"1s" max:"24h" json:"rate_limit_window" reload:"true"`
+
+	// RedisURL, when set, is the Redis server the instances share their
+	// rate limit counters through (see redis.go and ratelimit.go), and
+	// RedisTimeout is how long a command can take.
+	RedisURL     string        `env:"REDIS_URL" json:"redis_url" secret:"true"`
+	RedisTimeout time.Duration `env:"REDIS_TIMEOUT" default:"100ms" min:"1ms" max:"10s" json:"redis_timeout"`
+
+	// IdempotencyTTL is how long the response to a request with an
+	// Idempotency-Key is kept for retries (see idempotency.go).
+	IdempotencyTTL time.Duration `env:"IDEMPOTENCY_TTL" default:"24h" min:"1m" max:"168h" json:"idempotency_ttl" reload:"true"`
+
+	// RuntimeMetricsInterval is how often the Go runtime's metrics are
+	// collected for /metrics (see runtimemetrics.go). 0 turns it off.
+	RuntimeMetricsInterval time.Duration `env:"RUNTIME_METRICS_INTERVAL" default:"15s" min:"0s" max:"10m" json:"runtime_metrics_interval"`
+
+	// HeartbeatURL, when set, is pinged with HeartbeatMethod every
+	// HeartbeatInterval while the server is healthy, for a dead man's
+	// switch monitor (see heartbeat.go).
+	HeartbeatURL      string        `env:"HEARTBEAT_URL" json:"heartbeat_url" secret:"true"`
+	HeartbeatMethod   string        `env:"HEARTBEAT_METHOD" default:"GET" json:"heartbeat_method"`
+	HeartbeatInterval time.Duration `env:"HEARTBEAT_INTERVAL" default:"1m" min:"1s" max:"24h" json:"heartbeat_interval"`
+
+	// StatusInterval is how often a status summary is published, to the
+	// log, StatusWebhookURL and chat (see status.go). 0 turns it off.
+	StatusInterval   time.Duration `env:"STATUS_INTERVAL" default:"0s" min:"0s" max:"168h" json:"status_interval"`
+	StatusWebhookURL string        `env:"STATUS_WEBHOOK_URL" json:"status_webhook_url" secret:"true" reload:"true"`
+
+	// SMTPHost, when set, is the mail server email is sent through, on
+	// SMTPPort, protected as SMTPTLS says: "starttls", "tls" or "none" (see
+	// email.go). SMTPUsername and SMTPPassword log in to it, if it needs
+	// them.
+	SMTPHost     string `env:"SMTP_HOST" json:"smtp_host"`
+	SMTPPort     int    `env:"SMTP_PORT" default:"587" min:"1" max:"65535" json:"smtp_port"`
+	SMTPTLS      string `env:"SMTP_TLS" default:"starttls" json:"smtp_tls"`
+	SMTPUsername string `env:"SMTP_USERNAME" json:"smtp_username"`
+	SMTPPassword string `env:"SMTP_PASSWORD" json:"smtp_password" secret:"true"`
+
+	// EmailFrom is who email is sent from, and ContactEmail is where the
+	// contact form's messages go; the form is off without it (see
+	// contact.go). Each client can send ContactRateLimit messages every
+	// ContactRateLimitWindow.
+	EmailFrom              string        `env:"EMAIL_FROM" default:"Hello DevOps <noreply@localhost>" json:"email_from"`
+	ContactEmail           string        `env:"CONTACT_EMAIL" json:"contact_email" reload:"true"`
+	ContactRateLimit       int           `env:"CONTACT_RATE_LIMIT" default:"5" min:"1" json:"contact_rate_limit" reload:"true"`
+	ContactRateLimitWindow time.Duration `env:"CONTACT_RATE_LIMIT_WINDOW" default:"1h" min:"1s" max:"24h" json:"contact_rate_limit_window" reload:"true"`
+
+	// CaptchaSecret turns on CAPTCHAs for the guestbook and the contact
+	// form, using CaptchaProvider's widget for CaptchaSiteKey (see
+	// captcha.go). CaptchaVerifyURL replaces the provider's siteverify URL.
+	CaptchaProvider  string `env:"CAPTCHA_PROVIDER" default:"turnstile" json:"captcha_provider" reload:"true"`
+	CaptchaSiteKey   string `env:"CAPTCHA_SITE_KEY" json:"captcha_site_key" reload:"true"`
+	CaptchaSecret    string `env:"CAPTCHA_SECRET" json:"captcha_secret" secret:"true" reload:"true"`
+	CaptchaVerifyURL string `env:"CAPTCHA_VERIFY_URL" json:"captcha_verify_url" reload:"true"`
+
+	// NotifySlackURL and NotifyDiscordURL, when set, are chat webhooks
+	// the NotifyEvents are posted to, gathered up for NotifyBatchInterval
+	// (see notify.go).
+	NotifySlackURL      string        `env:"NOTIFY_SLACK_URL" json:"notify_slack_url" secret:"true"`
+	NotifyDiscordURL    string        `env:"NOTIFY_DISCORD_URL" json:"notify_discord_url" secret:"true"`
+	NotifyEvents        []string      `env:"NOTIFY_EVENTS" default:"startup,shutdown,panic,health" json:"notify_events"`
+	NotifyBatchInterval time.Duration `env:"NOTIFY_BATCH_INTERVAL" default:"10s" min:"0s" max:"1h" json:"notify_batch_interval"`
+
+	// ProjectionInterval is how often the event-sourced counter's read
+	// model catches up with its events (see projection.go).
+	ProjectionInterval time.Duration `env:"PROJECTION_INTERVAL" default:"1s" min:"10ms" max:"1m" json:"projection_interval"`
+
+	// Vault, off unless VaultAddr is set, supplies secret settings at
+	// startup (see vault.go). VaultAuth is approle, with VaultRoleID and
+	// VaultSecretID, or kubernetes, as VaultRole. VaultAuthMount is where
+	// the auth method is mounted, by default at its own name.
+	VaultAddr       string `env:"VAULT_ADDR" json:"vault_addr"`
+	VaultAuth       string `env:"VAULT_AUTH" default:"approle" json:"vault_auth"`
+	VaultAuthMount  string `env:"VAULT_AUTH_MOUNT" json:"vault_auth_mount"`
+	VaultRoleID     string `env:"VAULT_ROLE_ID" json:"vault_role_id"`
+	VaultSecretID   string `env:"VAULT_SECRET_ID" json:"vault_secret_id" secret:"true"`
+	VaultRole       string `env:"VAULT_ROLE" json:"vault_role"`
+	VaultSecretPath string `env:"VAULT_SECRET_PATH" default:"secret/data/go-hello-devops" json:"vault_secret_path"`
+
+	// LoadShedding turns away a share of requests, up to ShedMaxFraction,
+	// while the 90th percentile request latency is over ShedLatency or the
+	// Go scheduler's 99th percentile is over ShedSchedLatency (see shed.go).
+	LoadShedding     bool          `env:"LOAD_SHEDDING" default:"false" json:"load_shedding" reload:"true"`
+	ShedLatency      time.Duration `env:"SHED_LATENCY" default:"500ms" min:"1ms" max:"1m" json:"shed_latency" reload:"true"`
+	ShedSchedLatency time.Duration `env:"SHED_SCHED_LATENCY" default:"20ms" min:"1ms" max:"10s" json:"shed_sched_latency" reload:"true"`
+	ShedMaxFraction  float64       `env:"SHED_MAX_FRACTION" default:"0.5" min:"0" max:"1" json:"shed_max_fraction" reload:"true"`
+
+	// FeatureFlags lists the names of enabled features, comma-separated.
+	FeatureFlags []string `env:"FEATURE_FLAGS" json:"feature_flags" reload:"true"`
+
+	// sources says where each setting's value came from, by its JSON name
+	// (see configSources). It has no tags, so loading and printing skip it.
+	sources map[string]string
+}
+
+// Where a setting's value came from, as reported by GET /admin/config.
+const (
+	sourceDefault = "default" // neither the environment nor .env set it
+	sourceFile    = "file"    // the .env file (see dotenv.go)
+	sourceEnv     = "env"     // the real environment
+	sourceFlag    = "flag"    // a command-line flag
+	sourceAdmin   = "admin"   // changed at runtime through the admin API
+)
+
+// redacted replaces the value of secret settings in printed configuration.
+const redacted = "[REDACTED]"
+
+// ConfigError lists every problem found in the configuration. Reporting all
+// of them at once saves the frustrating fix-one-restart-find-the-next cycle.
+type ConfigError struct {
+	Problems []string
+}
+
+// Error formats the problems as a bulleted list.
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// loadConfig reads the configuration from environment variables and
+// validates it. When there are problems it returns a *ConfigError along with
+// a Config in which every valid setting is filled in (and invalid ones keep
+// their defaults), so callers that only need part of it can still proceed.
+func loadConfig() (Config, error) {
+	var cfg Config
+	problems := loadEnv(&cfg, os.LookupEnv)
+	cfg.sources = configSources(cfg, os.LookupEnv, fromDotenv)
+	// Settings can name secrets in AWS instead (see awssecrets.go).
+	problems = append(problems, resolveAWSReferencesFromEnv(&cfg)...)
+	problems = append(problems, cfg.problems()...)
+
+	if len(problems) > 0 {
+		return cfg, &ConfigError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration makes sense. loadConfig already
+// calls it, but settings can also be changed afterwards (for example by
+// command-line flags), so it's available on its own too.
+func (c Config) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// problems returns every validation problem. Range checks come from the
+// min/max tags; checks involving several fields at once would go here too.
+func (c Config) problems() []string {
+	problems := checkRanges(c)
+
+	for _, tenant := range c.Tenants {
+		if !tenantIDPattern.MatchString(tenant) {
+			problems = append(problems, fmt.Sprintf("TENANTS: %q is not a valid tenant ID (lowercase letters, digits and hyphens)", tenant))
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL: %q is not a valid level (use debug, info, warn or error)", c.LogLevel))
+	}
+
+	switch c.BlobBackend {
+	case "", "local":
+	case "s3":
+		// These are only required with the S3 backend, which a struct tag
+		// can't express, so they're checked here.
+		for name, value := range map[string]string{
+			"S3_ENDPOINT": c.S3Endpoint, "S3_BUCKET": c.S3Bucket,
+			"S3_ACCESS_KEY": c.S3AccessKey, "S3_SECRET_KEY": c.S3SecretKey,
+		} {
+			if value == "" {
+				problems = append(problems, fmt.Sprintf("%s: required when BLOB_BACKEND=s3", name))
+			}
+		}
+		if u, err := url.Parse(c.S3Endpoint); c.S3Endpoint != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			problems = append(problems, fmt.Sprintf("S3_ENDPOINT: %q is not a valid URL", c.S3Endpoint))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("BLOB_BACKEND: %q is not a valid backend (use local or s3)", c.BlobBackend))
+	}
+
+	for name, value := range map[string]string{
+		"WEATHER_GEOCODING_URL": c.WeatherGeocodingURL, "WEATHER_FORECAST_URL": c.WeatherForecastURL,
+		"CAPTCHA_VERIFY_URL": c.CaptchaVerifyURL,
+	} {
+		if value != "" && !validHTTPURL(value) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a valid URL", name, value))
+		}
+	}
+
+	if _, ok := captchaProviders[c.CaptchaProvider]; !ok {
+		problems = append(problems, fmt.Sprintf("CAPTCHA_PROVIDER: %q is not a valid provider (use turnstile or hcaptcha)", c.CaptchaProvider))
+	}
+	if c.CaptchaSecret != "" && c.CaptchaSiteKey == "" {
+		problems = append(problems, "CAPTCHA_SITE_KEY: required with CAPTCHA_SECRET, for the widget")
+	}
+
+	if len(c.MiddlewareOrder) > 0 {
+		if err := checkMiddlewareOrder(c.MiddlewareOrder); err != nil {
+			problems = append(problems, fmt.Sprintf("MIDDLEWARE_ORDER: %v", err))
+		}
+	}
+
+	if c.JWTSecret != "" && len(c.JWTSecret) < 32 {
+		problems = append(problems, "JWT_SECRET: must be at least 32 characters")
+	}
+	if c.JWTKeyGrace < c.JWTTTL {
+		problems = append(problems, fmt.Sprintf("JWT_KEY_GRACE: must be at least JWT_TTL (%s), or tokens signed just before a rotation stop working before they expire", c.JWTTTL))
+	}
+	if c.JWTKeyRotation > 0 && c.JWTKeyGrace > 30*c.JWTKeyRotation {
+		problems = append(problems, "JWT_KEY_GRACE: at most 30 JWT_KEY_ROTATION periods, or the key set gets too long")
+	}
+
+	for i, key := range c.DataEncryptionKeys {
+		if _, err := parseFieldKey(key); err != nil {
+			problems = append(problems, fmt.Sprintf("DATA_ENCRYPTION_KEYS: key %d %s", i+1, err))
+		}
+	}
+
+	if len(c.SignedRoutes) > 0 && len(c.SigningKeys) == 0 {
+		problems = append(problems, "SIGNING_KEYS: required when SIGNED_ROUTES is set")
+	}
+	for _, route := range c.SignedRoutes {
+		if !strings.HasPrefix(route, "/") {
+			problems = append(problems, fmt.Sprintf("SIGNED_ROUTES: %q is not a path", route))
+		}
+	}
+
+	if _, err := parseRouteTimeouts(c.RouteTimeouts); err != nil {
+		problems = append(problems, fmt.Sprintf("ROUTE_TIMEOUTS: %v", err))
+	}
+	if _, err := parseRouteLimits(c.RouteMaxInFlight); err != nil {
+		problems = append(problems, fmt.Sprintf("ROUTE_MAX_IN_FLIGHT: %v", err))
+	}
+
+	switch c.QuoteSource {
+	case "", "embedded":
+	case "http":
+		if !validHTTPURL(c.QuoteAPIURL) {
+			problems = append(problems, fmt.Sprintf("QUOTE_API_URL: %q is not a valid URL", c.QuoteAPIURL))
+		}
+	case "llm":
+		if !validHTTPURL(c.LLMURL) {
+			problems = append(problems, fmt.Sprintf("LLM_URL: %q is not a valid URL", c.LLMURL))
+		}
+		if c.LLMModel == "" {
+			problems = append(problems, "LLM_MODEL: required when QUOTE_SOURCE=llm")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("QUOTE_SOURCE: %q is not a valid source (use embedded, http or llm)", c.QuoteSource))
+	}
+
+	if c.ConsulAddr != "" {
+		if !validHTTPURL(c.ConsulAddr) {
+			problems = append(problems, fmt.Sprintf("CONSUL_ADDR: %q is not a valid URL", c.ConsulAddr))
+		}
+		if c.ConsulServiceName == "" {
+			problems = append(problems, "CONSUL_SERVICE_NAME: required when CONSUL_ADDR is set")
+		}
+	}
+
+	if c.VaultAddr != "" {
+		if !validHTTPURL(c.VaultAddr) {
+			problems = append(problems, fmt.Sprintf("VAULT_ADDR: %q is not a valid URL", c.VaultAddr))
+		}
+		switch c.VaultAuth {
+		case vaultAuthAppRole:
+			if c.VaultRoleID == "" || c.VaultSecretID == "" {
+				problems = append(problems, "VAULT_ROLE_ID and VAULT_SECRET_ID: required when VAULT_AUTH=approle")
+			}
+		case vaultAuthKubernetes:
+			if c.VaultRole == "" {
+				problems = append(problems, "VAULT_ROLE: required when VAULT_AUTH=kubernetes")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("VAULT_AUTH: must be approle or kubernetes, not %q", c.VaultAuth))
+		}
+	}
+
+	if c.HeartbeatURL != "" {
+		if !validHTTPURL(c.HeartbeatURL) {
+			problems = append(problems, "HEARTBEAT_URL: not a valid URL")
+		}
+		if c.HeartbeatMethod != "GET" && c.HeartbeatMethod != "POST" {
+			problems = append(problems, fmt.Sprintf("HEARTBEAT_METHOD: must be GET or POST, not %q", c.HeartbeatMethod))
+		}
+	}
+
+	if c.NotifySlackURL != "" && !validHTTPURL(c.NotifySlackURL) {
+		problems = append(problems, "NOTIFY_SLACK_URL: not a valid URL")
+	}
+	if c.NotifyDiscordURL != "" && !validHTTPURL(c.NotifyDiscordURL) {
+		problems = append(problems, "NOTIFY_DISCORD_URL: not a valid URL")
+	}
+	if c.StatusWebhookURL != "" && !validHTTPURL(c.StatusWebhookURL) {
+		problems = append(problems, "STATUS_WEBHOOK_URL: not a valid URL")
+	}
+	for _, event := range c.NotifyEvents {
+		if !slices.Contains(notifyEvents, event) {
+			problems = append(problems, fmt.Sprintf("NOTIFY_EVENTS: unknown event %q (use %s)", event, strings.Join(notifyEvents, ", ")))
+		}
+	}
+
+	if c.SMTPTLS != "starttls" && c.SMTPTLS != "tls" && c.SMTPTLS != "none" {
+		problems = append(problems, fmt.Sprintf("SMTP_TLS: must be starttls, tls or none, not %q", c.SMTPTLS))
+	}
+	if _, err := mail.ParseAddress(c.EmailFrom); err != nil {
+		problems = append(problems, fmt.Sprintf("EMAIL_FROM: %q is not an email address", c.EmailFrom))
+	}
+	if c.ContactEmail != "" {
+		if _, err := mail.ParseAddress(c.ContactEmail); err != nil {
+			problems = append(problems, fmt.Sprintf("CONTACT_EMAIL: %q is not an email address", c.ContactEmail))
+		}
+	}
+
+	if c.RedisURL != "" {
+		if _, err := parseRedisURL(c.RedisURL, c.RedisTimeout); err != nil {
+			problems = append(problems, "REDIS_URL: "+err.Error())
+		}
+	}
+
+	if c.ProxyLBStrategy != strategyRoundRobin && c.ProxyLBStrategy != strategyLeastConnections {
+		problems = append(problems, fmt.Sprintf("PROXY_LB_STRATEGY must be %s or %s, got %q", strategyRoundRobin, strategyLeastConnections, c.ProxyLBStrategy))
+	}
+
+	if ups, err := parseUpstreams(c.Upstreams); err != nil {
+		problems = append(problems, fmt.Sprintf("UPSTREAMS: %v", err))
+	} else if _, _, err := loadProxyRoutes(c, ups, nil); err != nil {
+		problems = append(problems, fmt.Sprintf("proxy routes: %v", err))
+	}
+
+	for _, target := range c.WaitFor {
+		if !validWaitTarget(target) {
+			problems = append(problems, fmt.Sprintf("WAIT_FOR: %q is not host:port or an http(s) URL", target))
+		}
+	}
+	return problems
+}
+
+// slogLevel converts LogLevel into a slog.Level. Validate has already
+// rejected unknown levels, so a parse failure here just means "info".
+func (c Config) slogLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// loadEnv fills the fields of the struct pointed to by dst from environment
+// variables, using lookup to read them (os.LookupEnv in production, a map in
+// tests). It returns a description of every variable that is missing or
+// can't be parsed.
+func loadEnv(dst any, lookup func(string) (string, bool)) []string {
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+
+	var problems []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		// Apply the default first, so an invalid value still leaves the
+		// field with something sensible in it.
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setField(v.Field(i), def); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: bad default %q: %v", name, def, err))
+			}
+		}
+
+		raw, ok := lookup(name)
+		if !ok || raw == "" {
+			if field.Tag.Get("required") == "true" {
+				problems = append(problems, fmt.Sprintf("%s: required but not set", name))
+			}
+			continue
+		}
+
+		if err := setField(v.Field(i), raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %q %v", name, raw, err))
+		}
+	}
+	return problems
+}
+
+// setField parses raw according to the field's type and stores it.
+func setField(field reflect.Value, raw string) error {
+	// time.Duration is an int64 underneath, so it must be checked before
+	// the generic integer case.
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("is not a valid duration (examples: 500ms, 15s, 2m)")
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("is not a valid integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("is not a valid number")
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("is not a valid boolean (use true or false)")
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("has unsupported type %s", field.Type())
+		}
+		// Lists are comma-separated: "a, b,c" becomes [a b c].
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("has unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// checkRanges enforces the min and max tags on numeric and duration fields.
+func checkRanges(cfg any) []string {
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+
+	var problems []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			name = field.Name
+		}
+
+		for _, bound := range []string{"min", "max"} {
+			limit, ok := field.Tag.Lookup(bound)
+			if !ok {
+				continue
+			}
+
+			// Parse the limit into a value of the same type as the field,
+			// then compare the two as numbers.
+			lv := reflect.New(field.Type).Elem()
+			if err := setField(lv, limit); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: bad %s tag %q", name, bound, limit))
+				continue
+			}
+
+			fv := v.Field(i)
+			var tooLow, tooHigh bool
+			switch fv.Kind() {
+			case reflect.Int, reflect.Int64:
+				tooLow, tooHigh = fv.Int() < lv.Int(), fv.Int() > lv.Int()
+			case reflect.Float64:
+				tooLow, tooHigh = fv.Float() < lv.Float(), fv.Float() > lv.Float()
+			}
+
+			if bound == "min" && tooLow {
+				problems = append(problems, fmt.Sprintf("%s: must be at least %s, got %v", name, limit, fv.Interface()))
+			}
+			if bound == "max" && tooHigh {
+				problems = append(problems, fmt.Sprintf("%s: must be at most %s, got %v", name, limit, fv.Interface()))
+			}
+		}
+	}
+	return problems
+}
+
+// configSources works out where each setting of cfg came from, using
+// lookup to read the environment like loadEnv does, and fromFile to tell
+// which variables were set by the .env file.
+func configSources(cfg any, lookup func(string) (string, bool), fromFile func(string) bool) map[string]string {
+	t := reflect.TypeOf(cfg)
+	sources := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		env, name := field.Tag.Get("env"), field.Tag.Get("json")
+		if env == "" || name == "" || name == "-" {
+			continue
+		}
+		switch raw, ok := lookup(env); {
+		case !ok || raw == "":
+			sources[name] = sourceDefault
+		case fromFile(env):
+			sources[name] = sourceFile
+		default:
+			sources[name] = sourceEnv
+		}
+	}
+	return sources
+}
+
+// setSource records that the setting name now comes from source. The map
+// is copied rather than changed in place, because copies of the
+// configuration share it.
+func (c *Config) setSource(name, source string) {
+	sources := maps.Clone(c.sources)
+	if sources == nil {
+		sources = make(map[string]string)
+	}
+	sources[name] = source
+	c.sources = sources
+}
+
+// configSetting is one named value from the configuration.
+type configSetting struct {
+	Name       string `json:"name"`
+	Value      any    `json:"value"`
+	Reloadable bool   `json:"reloadable"`
+	Source     string `json:"source,omitempty"`
+}
+
+// Settings lists every setting in declaration order with secrets redacted,
+// and where each came from. It uses reflection (inspecting the struct's
+// fields at runtime) so that new fields show up automatically without
+// anyone updating a printing function.
+func (c Config) Settings() []configSetting {
+	settings := settingsOf(c)
+	for i := range settings {
+		settings[i].Source = cmp.Or(c.sources[settings[i].Name], sourceDefault)
+	}
+	return settings
+}
+
+// settingsOf does the work for Settings. It accepts any struct so the
+// redaction logic can be tested independently of which fields Config has.
+func settingsOf(cfg any) []configSetting {
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+
+	settings := make([]configSetting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := field.Tag.Get("json")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		var value any = v.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value = redacted
+		}
+		// Durations would otherwise print as a raw count of nanoseconds.
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		settings = append(settings, configSetting{
+			Name:       name,
+			Value:      value,
+			Reloadable: field.Tag.Get("reload") == "true",
+		})
+	}
+	return settings
+}
+
+// writeConfigJSON prints the effective configuration as a JSON object.
+func writeConfigJSON(w io.Writer, c Config) error {
+	values := make(map[string]any)
+	for _, s := range c.Settings() {
+		values[s.Name] = s.Value
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
+
+// writeConfigYAML prints the effective configuration as YAML. Our settings
+// are flat key/value pairs, so we don't need a YAML library: every JSON
+// scalar (a quoted string, a number, true/false) is also valid YAML.
+func writeConfigYAML(w io.Writer, c Config) error {
+	for _, s := range c.Settings() {
+		value, err := json.Marshal(s.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", s.Name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
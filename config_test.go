@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadConfigDefaults checks the defaults used when nothing is set.
+// t.Setenv sets a variable for the duration of the test and restores it after.
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("READ_TIMEOUT", "")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Expected defaults to be valid, got %v", err)
+	}
+	if cfg.Port != 8000 {
+		t.Errorf("Expected default port 8000, got %d", cfg.Port)
+	}
+	if cfg.ReadTimeout != 15*time.Second {
+		t.Errorf("Expected default read timeout 15s, got %v", cfg.ReadTimeout)
+	}
+}
+
+// TestLoadConfigReportsEveryProblem sets several bad values at once and checks
+// that all of them are reported together.
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	t.Setenv("PORT", "eighty")
+	t.Setenv("READ_TIMEOUT", "fast")
+	t.Setenv("IDLE_TIMEOUT", "2h")
+
+	_, err := loadConfig()
+
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Expected a *ConfigError, got %v", err)
+	}
+	if len(cfgErr.Problems) != 3 {
+		t.Errorf("Expected 3 problems, got %d: %v", len(cfgErr.Problems), cfgErr.Problems)
+	}
+	for _, name := range []string{"PORT", "READ_TIMEOUT", "IDLE_TIMEOUT"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected the error to mention %s, got:\n%v", name, err)
+		}
+	}
+}
+
+// TestLoadEnvTypes uses a throwaway struct to cover every supported field
+// type along with the required tag, independent of Config's fields.
+func TestLoadEnvTypes(t *testing.T) {
+	var cfg struct {
+		Name    string        `env:"NAME" required:"true"`
+		Count   int           `env:"COUNT" default:"3"`
+		Ratio   float64       `env:"RATIO"`
+		Enabled bool          `env:"ENABLED"`
+		Wait    time.Duration `env:"WAIT"`
+		Hosts   []string      `env:"HOSTS"`
+		Missing string        `env:"MISSING" required:"true"`
+	}
+
+	env := map[string]string{
+		"NAME":    "demo",
+		"RATIO":   "0.5",
+		"ENABLED": "true",
+		"WAIT":    "250ms",
+		"HOSTS":   "a, b,,c",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	problems := loadEnv(&cfg, lookup)
+	if len(problems) != 1 || !strings.Contains(problems[0], "MISSING") {
+		t.Errorf("Expected only MISSING to be reported, got %v", problems)
+	}
+
+	if cfg.Name != "demo" || cfg.Count != 3 || cfg.Ratio != 0.5 || !cfg.Enabled || cfg.Wait != 250*time.Millisecond {
+		t.Errorf("Unexpected values: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Hosts, []string{"a", "b", "c"}) {
+		t.Errorf("Expected hosts [a b c], got %q", cfg.Hosts)
+	}
+}
+
+// defaultConfig returns the configuration an empty environment produces,
+// regardless of what's set in the environment running the tests.
+func defaultConfig(t testing.TB) Config {
+	t.Helper()
+	var cfg Config
+	if problems := loadEnv(&cfg, func(string) (string, bool) { return "", false }); len(problems) > 0 {
+		t.Fatalf("Expected the defaults to load, got %v", problems)
+	}
+	return cfg
+}
+
+// TestConfigValidate checks that out-of-range values are rejected.
+func TestConfigValidate(t *testing.T) {
+	valid := defaultConfig(t)
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected config to be valid, got %v", err)
+	}
+
+	for _, port := range []int{0, -1, 70000} {
+		cfg := valid
+		cfg.Port = port
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected port %d to be rejected", port)
+		}
+	}
+
+	for _, source := range []string{"magic", "llm"} {
+		cfg := valid
+		cfg.QuoteSource, cfg.LLMModel = source, ""
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected QUOTE_SOURCE=%s without a model to be rejected", source)
+		}
+	}
+
+	cfg := valid
+	cfg.WaitFor = []string{"db:5432", "ftp://files"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "ftp://files") {
+		t.Errorf("Expected the bad WAIT_FOR entry to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.Tenants = []string{"acme", "Not Valid"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `TENANTS: "Not Valid"`) {
+		t.Errorf("Expected the bad tenant ID to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.HeartbeatURL, cfg.HeartbeatMethod = "https://hc-ping.com/abc", "PUT"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "HEARTBEAT_METHOD") {
+		t.Errorf("Expected HEARTBEAT_METHOD=PUT to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.VaultAddr, cfg.VaultAuth, cfg.VaultRole = "http://vault:8200", "kubernetes", ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "VAULT_ROLE: required") {
+		t.Errorf("Expected Kubernetes auth without a role to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.JWTSecret, cfg.JWTTTL, cfg.JWTKeyGrace = "short", time.Hour, 30*time.Minute
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "JWT_SECRET: must be at least 32") || !strings.Contains(err.Error(), "JWT_KEY_GRACE: must be at least JWT_TTL") {
+		t.Errorf("Expected a short secret and grace period to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.SignedRoutes = []string{"/api/v1/notes", "api"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "SIGNING_KEYS: required") || !strings.Contains(err.Error(), `SIGNED_ROUTES: "api" is not a path`) {
+		t.Errorf("Expected SIGNED_ROUTES without keys to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.CaptchaProvider, cfg.CaptchaSecret = "recaptcha", "shh"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `CAPTCHA_PROVIDER: "recaptcha" is not a valid provider`) || !strings.Contains(err.Error(), "CAPTCHA_SITE_KEY: required") {
+		t.Errorf("Expected an unknown provider and a missing site key to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.DataEncryptionKeys = []string{"c2hvcnQ="}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "DATA_ENCRYPTION_KEYS: key 1 must be 32 bytes in base64") {
+		t.Errorf("Expected a short encryption key to be rejected, got %v", err)
+	}
+
+	cfg = valid
+	cfg.NotifyEvents = []string{"startup", "deploy"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `NOTIFY_EVENTS: unknown event "deploy"`) {
+		t.Errorf("Expected NOTIFY_EVENTS=deploy to be rejected, got %v", err)
+	}
+}
+
+// TestSettingsRedactsSecrets uses a struct with a secret field to check
+// that secret values never appear in printed configuration.
+func TestSettingsRedactsSecrets(t *testing.T) {
+	cfg := struct {
+		Name     string `json:"name"`
+		Password string `json:"password" secret:"true"`
+		Unset    string `json:"unset" secret:"true"`
+	}{Name: "demo", Password: "hunter2"}
+
+	got := settingsOf(cfg)
+	want := []configSetting{
+		{Name: "name", Value: "demo"},
+		{Name: "password", Value: redacted},
+		{Name: "unset", Value: ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+// TestConfigSources checks each setting is attributed to its default, the
+// .env file or the environment.
+func TestConfigSources(t *testing.T) {
+	env := map[string]string{"PORT": "9000", "LOG_LEVEL": "debug", "BANNER_TEXT": ""}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	fromFile := func(key string) bool { return key == "LOG_LEVEL" }
+
+	var cfg Config
+	loadEnv(&cfg, lookup)
+	cfg.sources = configSources(cfg, lookup, fromFile)
+	cfg.setSource("feature_flags", sourceAdmin)
+
+	want := map[string]string{"port": sourceEnv, "log_level": sourceFile, "banner_text": sourceDefault, "idle_timeout": sourceDefault, "feature_flags": sourceAdmin}
+	for _, setting := range cfg.Settings() {
+		if source, ok := want[setting.Name]; ok && setting.Source != source {
+			t.Errorf("%s: expected source %s, got %s", setting.Name, source, setting.Source)
+		}
+	}
+}
+
+// TestWriteConfigYAML checks the YAML rendering of the configuration.
+func TestWriteConfigYAML(t *testing.T) {
+	cfg := Config{Port: 8000, TenantDomain: "example.com", ReadTimeout: 15 * time.Second}
+
+	var buf bytes.Buffer
+	if err := writeConfigYAML(&buf, cfg); err != nil {
+		t.Fatalf("writeConfigYAML failed: %v", err)
+	}
+
+	for _, want := range []string{"port: 8000\n", "tenant_domain: \"example.com\"\n", "read_timeout: \"15s\"\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected YAML to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
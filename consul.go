@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// This file registers the server with Consul, a service registry, when
+// CONSUL_ADDR is set. A service registry is a phone book for services:
+// each instance adds itself when it starts and removes itself when it
+// stops, so other services can look up where to find it (via Consul's DNS
+// interface or HTTP API) instead of having addresses configured by hand.
+//
+// Registration includes a health check: Consul calls /readyz every
+// CONSUL_CHECK_INTERVAL and only hands out instances that pass. An
+// instance that dies without deregistering is removed once its check has
+// been failing for a minute.
+//
+// Try it with the Consul service in docker-compose.yml:
+//
+//	docker compose --profile consul up
+//
+// with CONSUL_ADDR=http://consul:8500 in the app's environment, then open
+// the Consul UI at http://localhost:8500 or ask its DNS interface:
+//
+//	dig @localhost -p 8600 go-hello-devops.service.consul
+//
+// Kubernetes has discovery built in (Services and their DNS names), so
+// there this is mostly useful for learning how it works underneath.
+
+// consulDeregisterAfter is how long Consul keeps an instance whose check
+// is failing before removing it.
+const consulDeregisterAfter = "1m"
+
+// Consul registers one instance of the server with a Consul agent.
+type Consul struct {
+	addr   string // the agent's base URL
+	token  string
+	client *http.Client
+
+	registration consulRegistration
+}
+
+// consulRegistration is the body of Consul's service registration API.
+type consulRegistration struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   consulCheck       `json:"Check"`
+}
+
+// consulCheck is the health check part of a consulRegistration.
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// newConsul returns a Consul registration for the configuration, or nil if
+// CONSUL_ADDR isn't set.
+func newConsul(cfg Config, client *http.Client) *Consul {
+	if cfg.ConsulAddr == "" {
+		return nil
+	}
+	address := cfg.ConsulServiceAddress
+	if address == "" {
+		address = advertiseAddress()
+	}
+	hostPort := net.JoinHostPort(address, strconv.Itoa(cfg.Port))
+
+	return &Consul{
+		addr:   cfg.ConsulAddr,
+		token:  cfg.ConsulToken,
+		client: client,
+		registration: consulRegistration{
+			// The ID must be unique per instance, while the name is shared
+			// by every instance of the service.
+			ID:      cfg.ConsulServiceName + "-" + instanceName(),
+			Name:    cfg.ConsulServiceName,
+			Tags:    cfg.ConsulServiceTags,
+			Address: address,
+			Port:    cfg.Port,
+			Meta:    map[string]string{"version": version},
+			Check: consulCheck{
+				HTTP:                           "http://" + hostPort + "/readyz",
+				Interval:                       cfg.ConsulCheckInterval.String(),
+				Timeout:                        "2s",
+				DeregisterCriticalServiceAfter: consulDeregisterAfter,
+			},
+		},
+	}
+}
+
+// advertiseAddress returns the first non-loopback IPv4 address of this
+// machine, which is the one other containers on the same network reach it
+// by, or the host name if there's none.
+func advertiseAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return instanceName()
+}
+
+// Register adds the instance to Consul, replacing any earlier registration
+// with the same ID.
+func (c *Consul) Register(ctx context.Context) error {
+	body, err := json.Marshal(c.registration)
+	if err != nil {
+		return err
+	}
+	if err := c.put(ctx, "/v1/agent/service/register", body); err != nil {
+		return fmt.Errorf("registering with Consul: %w", err)
+	}
+	slog.Info("Registered with Consul", "id", c.registration.ID, "check", c.registration.Check.HTTP)
+	return nil
+}
+
+// Deregister removes the instance from Consul.
+func (c *Consul) Deregister(ctx context.Context) error {
+	if err := c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(c.registration.ID), nil); err != nil {
+		return fmt.Errorf("deregistering from Consul: %w", err)
+	}
+	slog.Info("Deregistered from Consul", "id", c.registration.ID)
+	return nil
+}
+
+// put calls the Consul agent API.
+func (c *Consul) put(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul answered %s", resp.Status)
+	}
+	return nil
+}
+
+// registerWithConsul registers the server once startup is done. A failure
+// is logged rather than fatal: the server works without Consul, it just
+// can't be discovered through it.
+func (s *Server) registerWithConsul() {
+	if s.consul == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.consul.Register(ctx); err != nil {
+		slog.Error("Consul registration failed", "error", err)
+	}
+}
+
+// deregisterFromConsul removes the server from Consul as shutdown begins,
+// so it stops being handed out before it stops serving.
+func (s *Server) deregisterFromConsul() {
+	if s.consul == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.consul.Deregister(ctx); err != nil {
+		slog.Error("Consul deregistration failed", "error", err)
+	}
+}
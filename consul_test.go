@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeConsul records the requests made to a fake Consul agent.
+type fakeConsul struct {
+	mu       sync.Mutex
+	requests []string // "METHOD path"
+	token    string
+	body     []byte
+	status   int
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *httptest.Server) {
+	fake := &fakeConsul{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+		fake.token = r.Header.Get("X-Consul-Token")
+		if r.URL.Path == "/v1/agent/service/register" {
+			fake.body, _ = io.ReadAll(r.Body)
+		}
+		w.WriteHeader(fake.status)
+	}))
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+// TestNewConsulDisabled checks registration is off by default.
+func TestNewConsulDisabled(t *testing.T) {
+	if c := newConsul(defaultConfig(t), http.DefaultClient); c != nil {
+		t.Errorf("Expected no Consul registration without CONSUL_ADDR, got %+v", c)
+	}
+}
+
+// TestConsulRegister checks the registration sent to the agent.
+func TestConsulRegister(t *testing.T) {
+	fake, srv := newFakeConsul(t)
+	cfg := defaultConfig(t)
+	cfg.ConsulAddr, cfg.ConsulToken = srv.URL, "s3cret"
+	cfg.ConsulServiceTags = []string{"web", "v1"}
+	cfg.ConsulServiceAddress = "10.0.0.7"
+
+	c := newConsul(cfg, srv.Client())
+	if err := c.Register(context.Background()); err != nil {
+		t.Fatalf("Expected registration to succeed, got %v", err)
+	}
+
+	var reg consulRegistration
+	if err := json.Unmarshal(fake.body, &reg); err != nil {
+		t.Fatalf("Failed to parse the registration: %v", err)
+	}
+	if reg.Name != "go-hello-devops" || reg.ID != "go-hello-devops-"+instanceName() || reg.Address != "10.0.0.7" || reg.Port != 8000 {
+		t.Errorf("Unexpected registration %+v", reg)
+	}
+	if len(reg.Tags) != 2 || reg.Check.HTTP != "http://10.0.0.7:8000/readyz" || reg.Check.Interval != "10s" {
+		t.Errorf("Unexpected tags or check %+v", reg)
+	}
+	if fake.token != "s3cret" {
+		t.Errorf("Expected the token to be sent, got %q", fake.token)
+	}
+
+	fake.status = http.StatusForbidden
+	if err := c.Register(context.Background()); err == nil {
+		t.Error("Expected an error when Consul refuses")
+	}
+}
+
+// TestTerminateDeregisters checks shutdown removes the instance from Consul.
+func TestTerminateDeregisters(t *testing.T) {
+	fake, srv := newFakeConsul(t)
+	cfg := defaultConfig(t)
+	cfg.ConsulAddr = srv.URL
+
+	s := newServer(cfg)
+	s.consul.client = srv.Client()
+	if err := s.terminate(&http.Server{}, nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "PUT /v1/agent/service/deregister/go-hello-devops-" + instanceName()
+	if len(fake.requests) != 1 || fake.requests[0] != want {
+		t.Errorf("Expected %q, got %v", want, fake.requests)
+	}
+}
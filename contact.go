@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"time"
+)
+
+// This file implements the contact form: visitors leave their name, email
+// address and a message, and it's emailed to CONTACT_EMAIL (see email.go
+// for how). Replying to the email answers the visitor, since their address
+// is its Reply-To. The form is at /contact, and the same thing is available
+// as JSON with POST /api/v1/contact.
+//
+// Every message becomes an email in someone's inbox, which makes the form a
+// target for spam and a way to flood that inbox. So on top of RATE_LIMIT,
+// which isn't on by default, each client address can only send
+// CONTACT_RATE_LIMIT messages every CONTACT_RATE_LIMIT_WINDOW, 5 an hour
+// unless configured. It's counted by address alone, as RATE_LIMIT is, so
+// naming a different tenant with each message doesn't get around it.
+//
+// Without CONTACT_EMAIL, or with no way of sending email, the form says so
+// and submissions get a 503.
+
+// ContactRequest is the JSON body accepted by POST /api/v1/contact.
+type ContactRequest struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Message string `json:"message"`
+
+	// CaptchaToken is needed when CAPTCHAs are on (see captcha.go).
+	CaptchaToken string `json:"captcha_token,omitempty"`
+}
+
+// ContactResponse is returned once a message has been sent.
+type ContactResponse struct {
+	Status string `json:"status"`
+}
+
+// ContactPage is the data for templates/contact.html.
+type ContactPage struct {
+	// Disabled is set when messages can't be sent, and Sent after one has
+	// been.
+	Disabled, Sent bool
+
+	// After a failed submission the form is shown again with what the
+	// visitor typed and what was wrong with it, or Failed if the email
+	// couldn't be sent.
+	Name, Email, Message string
+	Errors               []FieldError
+	Failed               bool
+
+	// Captcha is the CAPTCHA widget, if there is one (see captcha.go).
+	Captcha CaptchaWidget
+}
+
+// contactEmail is the data for templates/email/contact.txt.
+type contactEmail struct {
+	ContactRequest
+	Tenant   string
+	Instance string
+	SentAt   time.Time
+}
+
+// errContactDisabled means there's nowhere to send contact messages.
+var errContactDisabled = errors.New("the contact form is not set up")
+
+// cleanContact cleans a submission and checks it against the contact
+// schema. The schema can only roughly check the email address, so it's
+// then parsed properly; only a bare address is accepted.
+func cleanContact(name, email, message string) (ContactRequest, []FieldError) {
+	req := ContactRequest{Name: cleanText(name, false), Email: cleanText(email, false), Message: cleanText(message, true)}
+	errs := requestSchemas["contact"].Validate(map[string]any{"name": req.Name, "email": req.Email, "message": req.Message})
+	if len(errs) == 0 {
+		if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			errs = append(errs, FieldError{Pointer: "/email", Detail: "must be an email address"})
+		}
+	}
+	return req, errs
+}
+
+// contactEnabled reports whether contact messages can be sent.
+func (s *Server) contactEnabled() bool {
+	return s.mailer != nil && s.config().ContactEmail != ""
+}
+
+// sendContact emails a cleaned contact message to CONTACT_EMAIL.
+func (s *Server) sendContact(ctx context.Context, req ContactRequest) error {
+	if !s.contactEnabled() {
+		return errContactDisabled
+	}
+	tenant := tenantFromContext(ctx)
+	subject, body, err := renderEmail("contact.txt", contactEmail{
+		ContactRequest: req,
+		Tenant:         tenant,
+		Instance:       instanceName(),
+		SentAt:         s.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	// The configuration has been validated, so parsing can't fail.
+	to, _ := mail.ParseAddress(s.config().ContactEmail)
+
+	// A visitor giving up on the page shouldn't stop the email halfway.
+	ctx = context.WithoutCancel(ctx)
+	err = s.mailer.Send(ctx, Email{
+		To:      []*mail.Address{to},
+		ReplyTo: &mail.Address{Name: req.Name, Address: req.Email},
+		Subject: subject,
+		Body:    body,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Contact message not sent", "error", err)
+		return err
+	}
+	slog.InfoContext(ctx, "Contact message sent", "tenant", tenant)
+	return nil
+}
+
+// contactRateLimitMiddleware limits how many messages each client can
+// send, with CONTACT_RATE_LIMIT.
+func (s *Server) contactRateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		if s.limitRequest(w, r, s.contactLimiter, "contact", cfg.ContactRateLimit, cfg.ContactRateLimitWindow) {
+			next(w, r)
+		}
+	}
+}
+
+// handleContact sends a message from a JSON body.
+func (s *Server) handleContact(w http.ResponseWriter, r *http.Request) {
+	var req ContactRequest
+	if !decodeValid(w, r, "contact", &req) {
+		return
+	}
+	token := req.CaptchaToken
+	req, errs := cleanContact(req.Name, req.Email, req.Message)
+	if len(errs) > 0 {
+		writeValidationProblem(w, "contact", errs)
+		return
+	}
+	if err := s.verifyCaptcha(r, token); err != nil {
+		writeCaptchaProblem(w, "contact", err)
+		return
+	}
+
+	switch err := s.sendContact(r.Context(), req); {
+	case errors.Is(err, errContactDisabled):
+		writeProblem(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		writeProblem(w, http.StatusBadGateway, "the message couldn't be sent; try again later")
+	default:
+		writeJSON(w, http.StatusAccepted, ContactResponse{Status: "sent"})
+	}
+}
+
+// handleContactPage renders the contact form.
+func (s *Server) handleContactPage(w http.ResponseWriter, r *http.Request) {
+	s.renderPage(w, "contact.html", http.StatusOK, ContactPage{
+		Disabled: !s.contactEnabled(),
+		Sent:     r.URL.Query().Get("sent") == "1",
+		Captcha:  s.captchaWidget(),
+	})
+}
+
+// handleContactForm handles the HTML form, redirecting to a thank you with
+// Post/Redirect/Get like the guestbook.
+func (s *Server) handleContactForm(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxValidatedBody)
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid form submission")
+		return
+	}
+
+	req, errs := cleanContact(r.PostForm.Get("name"), r.PostForm.Get("email"), r.PostForm.Get("message"))
+	page := ContactPage{Name: req.Name, Email: req.Email, Message: req.Message, Errors: errs, Captcha: s.captchaWidget()}
+	if len(errs) > 0 {
+		s.renderPage(w, "contact.html", http.StatusUnprocessableEntity, page)
+		return
+	}
+	if err := s.verifyCaptcha(r, s.formCaptchaToken(r)); err != nil {
+		status, fieldErr := captchaProblem(err)
+		page.Errors = []FieldError{fieldErr}
+		s.renderPage(w, "contact.html", status, page)
+		return
+	}
+
+	switch err := s.sendContact(r.Context(), req); {
+	case errors.Is(err, errContactDisabled):
+		page.Disabled = true
+		s.renderPage(w, "contact.html", http.StatusServiceUnavailable, page)
+	case err != nil:
+		page.Failed = true
+		s.renderPage(w, "contact.html", http.StatusBadGateway, page)
+	default:
+		http.Redirect(w, r, "/contact?sent=1", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMailer records the email it's asked to send, failing with err if
+// it's set.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []Email
+	err  error
+}
+
+func (m *fakeMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+// Sent returns the email sent so far.
+func (m *fakeMailer) Sent() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Email(nil), m.sent...)
+}
+
+// useMailer makes s send contact messages to ops@example.com with mailer.
+func useMailer(s *Server, mailer Mailer) {
+	s.mailer = mailer
+	s.cfgMu.Lock()
+	s.cfg.ContactEmail = "Ops <ops@example.com>"
+	s.cfgMu.Unlock()
+}
+
+// TestContactAPI sends a message as JSON.
+func TestContactAPI(t *testing.T) {
+	s, c := newTestServer(t)
+	mailer := &fakeMailer{}
+	useMailer(s, mailer)
+
+	c.Post("/api/v1/contact", map[string]string{"name": "Ada", "email": "ada@example.com", "message": "Hi\r\nthere"}).
+		Status(http.StatusAccepted).
+		JSON(`{"status": "sent"}`)
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected one email, got %d", len(sent))
+	}
+	email := sent[0]
+	if email.To[0].Address != "ops@example.com" || email.ReplyTo.String() != `"Ada" <ada@example.com>` {
+		t.Errorf("Expected an email to ops, replying to Ada, got %+v", email)
+	}
+	if email.Subject != "Contact form: message from Ada" || !strings.Contains(email.Body, "\nHi\nthere\n") {
+		t.Errorf("Expected the message in the email, got %q: %q", email.Subject, email.Body)
+	}
+}
+
+// TestContactValidation checks bad submissions are rejected, naming the
+// field, and nothing is sent.
+func TestContactValidation(t *testing.T) {
+	s, c := newTestServer(t)
+	mailer := &fakeMailer{}
+	useMailer(s, mailer)
+
+	for _, body := range []map[string]string{
+		{"name": "Ada", "email": "ada@example.com"},
+		{"name": "Ada", "email": "not an address", "message": "Hi"},
+		{"name": "Ada", "email": "Ada <ada@example.com>", "message": "Hi"},
+		{"name": "\x00", "email": "ada@example.com", "message": "Hi"},
+	} {
+		c.Post("/api/v1/contact", body).Status(http.StatusUnprocessableEntity)
+	}
+	if sent := mailer.Sent(); len(sent) != 0 {
+		t.Errorf("Expected nothing sent, got %+v", sent)
+	}
+}
+
+// TestContactUnavailable checks submissions get a 503 without a mailer or
+// CONTACT_EMAIL, and a 502 when sending fails.
+func TestContactUnavailable(t *testing.T) {
+	s, c := newTestServer(t)
+	body := map[string]string{"name": "Ada", "email": "ada@example.com", "message": "Hi"}
+	c.Post("/api/v1/contact", body).Status(http.StatusServiceUnavailable)
+	if page := c.Get("/contact").Status(http.StatusOK).Body.String(); !strings.Contains(page, "isn't set up") {
+		t.Errorf("Expected the page to say the form is off, got:\n%s", page)
+	}
+
+	useMailer(s, &fakeMailer{err: errors.New("connection refused")})
+	c.Post("/api/v1/contact", body).Status(http.StatusBadGateway)
+}
+
+// TestContactForm submits the HTML form: invalid input is shown again with
+// the errors, and a message is sent and redirects to a thank you.
+func TestContactForm(t *testing.T) {
+	s, _ := newTestServer(t)
+	mailer := &fakeMailer{}
+	useMailer(s, mailer)
+	h := s.handler()
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/contact", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(url.Values{"name": {"<b>Ada</b>"}, "email": {"nope"}, "message": {"Hi"}})
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d", rec.Code)
+	}
+	if page := rec.Body.String(); !strings.Contains(page, "/email") || !strings.Contains(page, "&lt;b&gt;Ada&lt;/b&gt;") {
+		t.Errorf("Expected the error and the escaped name, got:\n%s", page)
+	}
+
+	rec = post(url.Values{"name": {"Ada"}, "email": {"ada@example.com"}, "message": {"Hi"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/contact?sent=1" {
+		t.Fatalf("Expected a redirect to the thank you, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if len(mailer.Sent()) != 1 {
+		t.Errorf("Expected one email, got %d", len(mailer.Sent()))
+	}
+}
+
+// TestContactRateLimit checks each client can only send
+// CONTACT_RATE_LIMIT messages, whether or not RATE_LIMIT is set, and
+// however many tenants it names.
+func TestContactRateLimit(t *testing.T) {
+	s, c := newTestServer(t)
+	useMailer(s, &fakeMailer{})
+	s.cfgMu.Lock()
+	s.cfg.ContactRateLimit = 2
+	s.cfgMu.Unlock()
+
+	body := map[string]string{"name": "Ada", "email": "ada@example.com", "message": "Hi"}
+	for range 2 {
+		c.Post("/api/v1/contact", body).Status(http.StatusAccepted)
+	}
+	resp := c.Post("/api/v1/contact", body).Status(http.StatusTooManyRequests)
+	if resp.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected to retry in an hour, got %q", resp.Header().Get("Retry-After"))
+	}
+	c.Header.Set(tenantHeader, "acme")
+	c.Post("/api/v1/contact", body).Status(http.StatusTooManyRequests)
+	c.Header.Del(tenantHeader)
+	c.Get("/contact").Status(http.StatusOK)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+)
+
+// This file implements the visitor counter: GET /api/v1/counter reads it,
+// POST increments it, and every view of the landing page counts as a visit.
+//
+// A counter is the smallest piece of shared, changing state there is, which
+// makes it a good way to see two things:
+//   - concurrency safety: many requests increment it at once, and the
+//     store's mutex makes sure none of the increments is lost.
+//   - where state lives: each response says which instance served it. Run
+//     more than one replica (docker compose up --scale app=3) and each keeps
+//     its own count, because the store lives in each process's memory. A
+//     shared database is what fixes that.
+
+// CounterResponse is returned by the counter endpoints.
+type CounterResponse struct {
+	Tenant string `json:"tenant"`
+	Count  int64  `json:"count"`
+
+	// Instance is the host name of the process that answered; in a
+	// container that's the container ID.
+	Instance string `json:"instance"`
+}
+
+// instanceName returns this process's host name, looked up once.
+var instanceName = sync.OnceValue(func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+})
+
+// handleGetCounter returns the tenant's current count.
+func (s *Server) handleGetCounter(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	writeJSON(w, http.StatusOK, CounterResponse{Tenant: tenant, Count: s.store.Counter(tenant), Instance: instanceName()})
+}
+
+// handleIncrementCounter adds one to the tenant's count and returns the new
+// value. The increment and the read happen under one lock, so two
+// concurrent requests can never both see the same number.
+func (s *Server) handleIncrementCounter(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	writeJSON(w, http.StatusOK, CounterResponse{Tenant: tenant, Count: s.store.IncrementCounter(tenant), Instance: instanceName()})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestCounterEndpoints increments the counter concurrently through the API
+// and checks no increment was lost.
+func TestCounterEndpoints(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/counter", nil))
+		}()
+	}
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/counter", nil))
+
+	var got CounterResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if got.Count != 20 || got.Instance == "" {
+		t.Errorf("Expected count 20 and an instance name, got %+v", got)
+	}
+}
+
+// TestLandingPageCountsVisits checks views of the landing page are
+// counted, for static/landing.js to show.
+func TestLandingPageCountsVisits(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	for i := 0; i < 3; i++ {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/counter", nil))
+
+	if !strings.Contains(rec.Body.String(), `"count":3`) {
+		t.Errorf("Expected three visits to be counted, got %s", rec.Body.String())
+	}
+}
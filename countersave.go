@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// This file implements the background job that saves the visit counters.
+//
+// Counting a visit only changes the store in memory (see Store.Flush), so
+// that GET / doesn't rewrite and fsync the whole data file on every
+// request. This job writes what's changed every COUNTER_SAVE_INTERVAL, and
+// the server writes it one last time when it shuts down.
+
+// saveCounters flushes the store every interval until ctx is cancelled.
+func (s *Server) saveCounters(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.store.Flush()
+	}
+}
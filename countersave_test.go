@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// savedCounter returns the tenant's counter in the data file at path.
+func savedCounter(t *testing.T, path, tenant string) int64 {
+	t.Helper()
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Counter(tenant)
+}
+
+// TestSaveCounters checks visits are saved by the job, not on every
+// increment, and at shutdown.
+func TestSaveCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	s := newServer(Config{})
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.store = store
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.saveCounters(ctx, 5*time.Second)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+
+	s.store.IncrementCounter(defaultTenant)
+	s.store.IncrementCounter(defaultTenant)
+	if got := savedCounter(t, path, defaultTenant); got != 0 {
+		t.Fatalf("Expected the increments not saved yet, got %d", got)
+	}
+	clock.Advance(5 * time.Second)
+	eventually(t, func() bool { return savedCounter(t, path, defaultTenant) == 2 })
+
+	s.store.IncrementCounter(defaultTenant)
+	if err := s.terminate(&http.Server{}, nil, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedCounter(t, path, defaultTenant); got != 3 {
+		t.Errorf("Expected the last increment saved at shutdown, got %d", got)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This file lets you add metrics of your own to /metrics, for the things
+// your business cares about rather than the HTTP plumbing: notes created,
+// sign-ups by plan, the size of uploaded files. Declare the metric once, at
+// package level, and update it from your handler in one line:
+//
+//	var notesCreated = NewCounter("notes_created_total", "Notes created.")
+//	var uploadSize = NewHistogram("upload_size_bytes", "Sizes of uploaded files.",
+//		[]float64{1e3, 1e4, 1e5, 1e6, 1e7})
+//	var queueDepth = NewGauge("jobs_queued", "Jobs waiting to run.", "queue")
+//
+//	notesCreated.Inc()
+//	uploadSize.Observe(float64(header.Size))
+//	queueDepth.Set(12, "emails")
+//
+// The three kinds are Prometheus's:
+//   - a Counter only goes up (Inc, Add); Prometheus's rate() turns it into
+//     a rate per second. By convention its name ends in _total.
+//   - a Gauge goes up and down (Set, Add): a level, like a queue's length
+//   - a Histogram counts observations into buckets (Observe), so you can
+//     graph percentiles with histogram_quantile(). Without buckets it gets
+//     DefaultBuckets, which suit durations in seconds.
+//
+// Metrics can have labels, named when the metric is made, and then given
+// values, in the same order, with each update. Every combination of label
+// values is a separate series in Prometheus, so keep values to a small,
+// fixed set: a plan or a status, never a user ID or a URL.
+//
+// Like RegisterRoute, the constructors panic on a mistake (an invalid or
+// duplicate name), and so do updates with the wrong number of label
+// values: they're bugs to fix, not errors to handle. The metrics belong to
+// the process, so a metric is shared by every Server in it, tests included.
+
+// DefaultBuckets are the histogram buckets used when none are given:
+// durations from 5ms to 10s, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// customMetrics holds the metrics made with NewCounter, NewGauge and
+// NewHistogram, in the order they were made.
+var customMetrics struct {
+	mu      sync.Mutex
+	metrics []*customMetric
+}
+
+// customMetric is a metric and its series, by label values.
+type customMetric struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64 // for histograms, sorted
+
+	mu     sync.Mutex
+	series map[string]*customSeries
+}
+
+// customSeries is one combination of label values.
+type customSeries struct {
+	values []string
+	value  float64  // a counter's or gauge's
+	counts []uint64 // a histogram's, per bucket (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+// Counter is a metric that only goes up.
+type Counter struct{ m *customMetric }
+
+// Gauge is a metric that goes up and down.
+type Gauge struct{ m *customMetric }
+
+// Histogram counts observations into buckets.
+type Histogram struct{ m *customMetric }
+
+// NewCounter makes a counter. Its updates give values for labels.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{registerMetric(name, help, "counter", labels, nil)}
+}
+
+// NewGauge makes a gauge. Its updates give values for labels.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{registerMetric(name, help, "gauge", labels, nil)}
+}
+
+// NewHistogram makes a histogram with the given bucket upper bounds, or
+// DefaultBuckets if that's nil. Its updates give values for labels.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{registerMetric(name, help, "histogram", labels, slices.Sorted(slices.Values(buckets)))}
+}
+
+// registerMetric adds a metric to customMetrics.
+func registerMetric(name, help, kind string, labels []string, buckets []float64) *customMetric {
+	if !metricNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("metric %q: invalid name", name))
+	}
+	for _, label := range labels {
+		if !labelNamePattern.MatchString(label) || label == "le" {
+			panic(fmt.Sprintf("metric %q: invalid label name %q", name, label))
+		}
+	}
+
+	customMetrics.mu.Lock()
+	defer customMetrics.mu.Unlock()
+	if slices.ContainsFunc(customMetrics.metrics, func(m *customMetric) bool { return m.name == name }) {
+		panic(fmt.Sprintf("metric %q: made twice", name))
+	}
+	m := &customMetric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*customSeries),
+	}
+	customMetrics.metrics = append(customMetrics.metrics, m)
+	return m
+}
+
+// update calls f with the series for values, under the metric's lock.
+func (m *customMetric) update(values []string, f func(*customSeries)) {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %q: got %d label values for %d labels", m.name, len(values), len(m.labels)))
+	}
+	key := strings.Join(values, "\x00")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &customSeries{values: slices.Clone(values), counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	f(s)
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n, which mustn't be negative, to the counter.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	if n < 0 {
+		panic(fmt.Sprintf("metric %q: a counter can't go down", c.m.name))
+	}
+	c.m.update(labelValues, func(s *customSeries) { s.value += n })
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.update(labelValues, func(s *customSeries) { s.value = v })
+}
+
+// Add adds n, which may be negative, to the gauge.
+func (g *Gauge) Add(n float64, labelValues ...string) {
+	g.m.update(labelValues, func(s *customSeries) { s.value += n })
+}
+
+// Observe counts v in the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.update(labelValues, func(s *customSeries) {
+		if i, _ := slices.BinarySearch(h.m.buckets, v); i < len(s.counts) {
+			s.counts[i]++
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// writeCustomMetrics writes the custom metrics in Prometheus's text
+// format, series sorted by label values.
+func writeCustomMetrics(w io.Writer) (int64, error) {
+	customMetrics.mu.Lock()
+	all := slices.Clone(customMetrics.metrics)
+	customMetrics.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range all {
+		m.mu.Lock()
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, key := range slices.Sorted(maps.Keys(m.series)) {
+			s := m.series[key]
+			if m.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %g\n", m.name, formatCustomLabels(m.labels, s.values, ""), s.value)
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range m.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, formatCustomLabels(m.labels, s.values, strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, formatCustomLabels(m.labels, s.values, "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %g\n", m.name, formatCustomLabels(m.labels, s.values, ""), s.sum)
+			fmt.Fprintf(&b, "%s_count%s %d\n", m.name, formatCustomLabels(m.labels, s.values, ""), s.count)
+		}
+		m.mu.Unlock()
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// formatCustomLabels renders a series' labels, with le for a histogram
+// bucket if it's set, or nothing if there are none.
+func formatCustomLabels(names, values []string, le string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+"="+strconv.Quote(values[i]))
+	}
+	if le != "" {
+		parts = append(parts, "le="+strconv.Quote(le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
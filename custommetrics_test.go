@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// useCustomMetrics starts the test with no custom metrics, and puts back
+// the real ones after it.
+func useCustomMetrics(t *testing.T) {
+	metrics := customMetrics.metrics
+	t.Cleanup(func() { customMetrics.metrics = metrics })
+	customMetrics.metrics = nil
+}
+
+// TestCustomMetrics updates a metric of each kind and checks /metrics shows
+// them in Prometheus's format.
+func TestCustomMetrics(t *testing.T) {
+	useCustomMetrics(t)
+	signups := NewCounter("test_signups_total", "Sign-ups, by plan.", "plan")
+	queued := NewGauge("test_jobs_queued", "Jobs waiting to run.")
+	sizes := NewHistogram("test_upload_size_bytes", "Upload sizes.", []float64{1000, 100})
+
+	signups.Inc("pro")
+	signups.Add(2, "free")
+	signups.Inc("pro")
+	queued.Set(5)
+	queued.Add(-2)
+	for _, v := range []float64{50, 100, 500, 5000} {
+		sizes.Observe(v)
+	}
+
+	_, c := newTestServer(t)
+	metrics := c.Get("/metrics").Status(http.StatusOK).Body.String()
+	want := `# HELP test_signups_total Sign-ups, by plan.
+# TYPE test_signups_total counter
+test_signups_total{plan="free"} 2
+test_signups_total{plan="pro"} 2
+# HELP test_jobs_queued Jobs waiting to run.
+# TYPE test_jobs_queued gauge
+test_jobs_queued 3
+# HELP test_upload_size_bytes Upload sizes.
+# TYPE test_upload_size_bytes histogram
+test_upload_size_bytes_bucket{le="100"} 2
+test_upload_size_bytes_bucket{le="1000"} 3
+test_upload_size_bytes_bucket{le="+Inf"} 4
+test_upload_size_bytes_sum 5650
+test_upload_size_bytes_count 4
+`
+	if !strings.Contains(metrics, want) {
+		t.Errorf("Expected the custom metrics:\n%s\ngot:\n%s", want, metrics)
+	}
+}
+
+// TestCustomMetricMistakes checks mistakes panic.
+func TestCustomMetricMistakes(t *testing.T) {
+	useCustomMetrics(t)
+	counter := NewCounter("test_mistakes_total", "Mistakes.", "kind")
+	mistakes := map[string]func(){
+		"invalid name":         func() { NewGauge("test-gauge", "") },
+		"invalid label":        func() { NewGauge("test_gauge", "", "le") },
+		"made twice":           func() { NewCounter("test_mistakes_total", "") },
+		"missing label value":  func() { counter.Inc() },
+		"too many label value": func() { counter.Inc("a", "b") },
+		"counter going down":   func() { counter.Add(-1, "a") },
+	}
+	for name, mistake := range mistakes {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			mistake()
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// This file implements /dashboard, a live status page. The page itself is
+// a template with a small script (static/dashboard.js); the numbers arrive
+// over Server-Sent Events from /dashboard/events, which sends a fresh
+// summary of the metrics every dashboardInterval. See livereload.go for
+// more on SSE.
+//
+// A real setup would graph the Prometheus metrics in Grafana, but a page
+// the server renders itself is handy for demos: open it, send some traffic,
+// and watch the numbers move.
+
+// dashboardInterval is how often the dashboard is updated.
+const dashboardInterval = 2 * time.Second
+
+// DashboardPage is the data for the dashboard template.
+type DashboardPage struct {
+	Version  string
+	Instance string
+}
+
+// DashboardUpdate is the data sent in each "metrics" event.
+type DashboardUpdate struct {
+	Time time.Time `json:"time"`
+
+	// RequestRate is the requests per second since the previous update.
+	RequestRate float64 `json:"request_rate"`
+
+	MetricsSnapshot
+	Dependencies []DependencyHealth `json:"dependencies"`
+}
+
+// DependencyHealth is the state of something the server relies on.
+type DependencyHealth struct {
+	Name   string `json:"name"`
+	Up     bool   `json:"up"`
+	Detail string `json:"detail"`
+}
+
+// dependencies reports on the data file and on every service the server
+// has called. Nothing is probed: the state of each service is that of the
+// most recent real request to it, so the dashboard adds no load of its own.
+func (s *Server) dependencies(snap MetricsSnapshot, now time.Time) []DependencyHealth {
+	deps := []DependencyHealth{{Name: "data file", Up: true, Detail: "in memory only (DATA_FILE is not set)"}}
+	if path := s.config().DataFile; path != "" {
+		deps[0].Detail = "saving to " + path
+		if err := s.store.SaveError(); err != nil {
+			deps[0].Up, deps[0].Detail = false, err.Error()
+		}
+	}
+
+	for _, out := range snap.Outbound {
+		deps = append(deps, DependencyHealth{
+			Name: out.Host,
+			Up:   !outboundFailed(out.LastStatus),
+			Detail: fmt.Sprintf("last request %s, %s ago; %d of %d failed",
+				out.LastStatus, now.Sub(out.LastAt).Round(time.Second), out.Errors, out.Requests),
+		})
+	}
+	return deps
+}
+
+// handleDashboard renders the dashboard page.
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	s.renderPage(w, "dashboard.html", http.StatusOK, DashboardPage{Version: version, Instance: instanceName()})
+}
+
+// handleDashboardEvents streams dashboard updates until the browser
+// disconnects. The request rate is worked out per connection, from the
+// change in the request count between two updates.
+func (s *Server) handleDashboardEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := s.clock.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+
+	var prev DashboardUpdate
+	for {
+		now := s.clock.Now()
+		update := DashboardUpdate{Time: now, MetricsSnapshot: s.metrics.Snapshot()}
+		if !prev.Time.IsZero() {
+			update.RequestRate = float64(update.Requests-prev.Requests) / now.Sub(prev.Time).Seconds()
+		}
+		update.Dependencies = s.dependencies(update.MetricsSnapshot, now)
+		prev = update
+
+		data, err := json.Marshal(update)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: metrics\ndata: %s\n\n", data)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-ticker.C():
+		}
+	}
+}
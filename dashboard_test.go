@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDashboardPage checks the page renders.
+func TestDashboardPage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServer(Config{}).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/static/dashboard.js") {
+		t.Errorf("Expected the dashboard page, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestDashboardEvents connects to the event stream and checks the first
+// update, which is sent straight away.
+func TestDashboardEvents(t *testing.T) {
+	srv := newServer(Config{})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, path := range []string{"/health", "/api/v1/qr"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/dashboard/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); line != "event: metrics\n" {
+		t.Fatalf("Expected a metrics event, got %q", line)
+	}
+	line, _ := body.ReadString('\n')
+
+	var update DashboardUpdate
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &update); err != nil {
+		t.Fatalf("Failed to parse event data %q: %v", line, err)
+	}
+	if update.Requests != 2 || update.ClientErrors != 1 || update.Latency.Samples != 2 {
+		t.Errorf("Expected 2 requests, 1 of them a 400, got %+v", update.MetricsSnapshot)
+	}
+	if len(update.Dependencies) != 1 || !update.Dependencies[0].Up {
+		t.Errorf("Expected only the in-memory data file, got %+v", update.Dependencies)
+	}
+}
+
+// TestDependencies checks failures show up as down.
+func TestDependencies(t *testing.T) {
+	srv := newServer(Config{DataFile: "data.json"})
+	srv.store.saveErr = errors.New("disk full")
+
+	now := time.Now()
+	deps := srv.dependencies(MetricsSnapshot{Outbound: []OutboundSummary{
+		{Host: "api.example.com", Requests: 3, Errors: 1, LastStatus: "error", LastAt: now},
+		{Host: "ok.example.com", Requests: 1, LastStatus: "200", LastAt: now},
+	}}, now)
+
+	want := []bool{false, false, true}
+	if len(deps) != len(want) {
+		t.Fatalf("Expected %d dependencies, got %+v", len(want), deps)
+	}
+	for i, up := range want {
+		if deps[i].Up != up {
+			t.Errorf("Expected %s up=%v, got %+v", deps[i].Name, up, deps[i])
+		}
+	}
+}
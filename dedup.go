@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+)
+
+// This file collapses identical GET requests that arrive while one is
+// already being handled. When a cached result expires, or a popular page
+// is linked somewhere, many clients can ask for the same thing at once
+// (a thundering herd), and each request would make its own call to the
+// weather API or the LLM: slow, and with paid APIs, expensive.
+//
+// The dedup middleware, on the routes that call such services, lets the
+// first request (the leader) run the handler, and makes identical
+// requests that come in meanwhile wait for its response and get a copy.
+// This is what golang.org/x/sync/singleflight does for function calls.
+// Requests are identical if they have the same tenant, URL and Accept
+// header. Once the leader's response is sent, the next request runs the
+// handler again; caching results for longer is the handlers' job.
+//
+// The followers count in http_requests_deduplicated_total, by route.
+// Their own deadline and cancellation still apply while they wait, but the
+// handler runs for the leader's, so a leader that gives up doesn't make
+// everyone else fail with it.
+
+// flight is a response being made for every request with the same key.
+type flight struct {
+	done chan struct{}
+	resp *bufferedResponse // nil if the handler panicked
+}
+
+// flightGroup tracks the flights in progress, by key.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// join returns the flight for key, starting one if there's none, and
+// whether the caller is its leader.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// land ends the flight for key, handing resp to its followers.
+func (g *flightGroup) land(key string, f *flight, resp *bufferedResponse) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.resp = resp
+	close(f.done)
+}
+
+// bufferedResponse holds a response so it can be sent to several clients.
+type bufferedResponse struct {
+	http.ResponseWriter // the leader's, for Unwrap
+	header              http.Header
+	status              int
+	body                bytes.Buffer
+}
+
+// Unwrap lets handlers find the leader's middleware writers, like the
+// envelope's.
+func (b *bufferedResponse) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// writeTo sends the response to w, keeping any headers the middleware has
+// already set on it, like the request ID.
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(max(b.status, http.StatusOK))
+	w.Write(b.body.Bytes())
+}
+
+// dedupMiddleware makes identical concurrent GET requests share one run
+// of the handler.
+func (s *Server) dedupMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+		key := tenantFromContext(r.Context()) + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept")
+		f, leader := s.flights.join(key)
+		if !leader {
+			s.metrics.ObserveDeduplicated(r.Pattern)
+			select {
+			case <-f.done:
+			case <-r.Context().Done():
+				return
+			}
+			if f.resp == nil {
+				next(w, r)
+				return
+			}
+			f.resp.writeTo(w)
+			return
+		}
+
+		resp := &bufferedResponse{ResponseWriter: w, header: make(http.Header)}
+		var landed *bufferedResponse
+		defer func() { s.flights.land(key, f, landed) }()
+		next(resp, r.WithContext(context.WithoutCancel(r.Context())))
+		landed = resp
+		resp.writeTo(w)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDedup checks identical requests made while one is being handled
+// share its response, and are counted in the metrics.
+func TestDedup(t *testing.T) {
+	s, c := newTestServer(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := s.dedupMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("X-Upstream", "weather")
+		writeJSON(w, http.StatusOK, map[string]string{"city": r.URL.Query().Get("city")})
+	})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Pattern = "GET /api/v1/weather"
+		h(rec, req)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 4)
+	wg.Add(1)
+	go func() { defer wg.Done(); recs[0] = get("/api/v1/weather?city=Paris") }()
+	eventually(t, func() bool { return calls.Load() == 1 })
+	for i := 1; i < len(recs); i++ {
+		wg.Add(1)
+		go func() { defer wg.Done(); recs[i] = get("/api/v1/weather?city=Paris") }()
+	}
+	eventually(t, func() bool {
+		s.metrics.mu.Lock()
+		defer s.metrics.mu.Unlock()
+		return s.metrics.deduplicated["GET /api/v1/weather"] == 3
+	})
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", n)
+	}
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Paris") || rec.Header().Get("X-Upstream") != "weather" {
+			t.Errorf("Request %d: expected the shared response, got %d %v %s", i, rec.Code, rec.Header(), rec.Body)
+		}
+	}
+
+	// Once it's answered, and for other URLs, the handler runs again.
+	get("/api/v1/weather?city=Paris")
+	get("/api/v1/weather?city=Lyon")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Expected 3 runs, got %d", n)
+	}
+	if metrics := c.Get("/metrics").Body.String(); !strings.Contains(metrics, `http_requests_deduplicated_total{route="GET /api/v1/weather"} 3`) {
+		t.Errorf("Expected 3 deduplicated requests in the metrics, got:\n%s", metrics)
+	}
+}
+
+// TestDedupPanic checks the followers of a leader that panics run the
+// handler themselves.
+func TestDedupPanic(t *testing.T) {
+	s, _ := newTestServer(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := s.dedupMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	go func() {
+		defer func() { recover() }()
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/quote", nil))
+	}()
+	eventually(t, func() bool { return calls.Load() == 1 })
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/api/v1/quote", nil))
+		done <- rec.Code
+	}()
+	eventually(t, func() bool {
+		s.metrics.mu.Lock()
+		defer s.metrics.mu.Unlock()
+		return s.metrics.deduplicated[""] == 1
+	})
+	close(release)
+	if code := <-done; code != http.StatusNoContent {
+		t.Errorf("Expected the follower to run the handler, got %d", code)
+	}
+}
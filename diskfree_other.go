@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented on this system; the server runs in a Linux
+// container.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// This file loads environment variables from a .env file at startup. Docker
+// Compose reads .env for us, but when you run "go run ." directly nothing
+// does, so the app would start without the settings you wrote down. Loading
+// the file in Go means local development works the same everywhere, without
+// "export $(cat .env)" shell tricks that break on quotes and spaces.
+//
+// The format follows the common dotenv conventions:
+//
+//	# comments and blank lines are ignored
+//	export NAME=value        "export " is optional, so the file can be sourced
+//	NAME=value # comment     unquoted values end at " #"
+//	NAME='literal $value'    single quotes: taken exactly as written
+//	NAME="line1\nline2"      double quotes: \n \r \t \" \\ escapes, may span lines
+//
+// Variables that are already set in the real environment always win, so a
+// value passed by the shell, Compose or Kubernetes overrides the file.
+
+// dotenvPathVar names the environment variable that points at a different
+// .env file. When it's set, the file must exist.
+const dotenvPathVar = "DOTENV_PATH"
+
+// dotenvKeys remembers which variables were set from the .env file (as
+// opposed to the real environment), so a configuration reload knows which
+// ones it's allowed to change. The process environment is global, so this
+// bookkeeping is too.
+var (
+	dotenvMu   sync.Mutex
+	dotenvKeys = make(map[string]bool)
+)
+
+// loadDotenv loads .env from the working directory, or from DOTENV_PATH if
+// set. A missing default .env file is not an error: most deployments
+// configure the app through real environment variables instead.
+func loadDotenv() error {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+
+	vars, err := readDotenv()
+	if err != nil {
+		return err
+	}
+	return applyDotenv(vars)
+}
+
+// reloadDotenv reads the .env file again after it has been edited. Values
+// that came from the file are updated, and ones removed from the file are
+// unset. Variables from the real environment still win: a process's
+// environment can't be changed from outside, so only the file can change.
+func reloadDotenv() error {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+
+	vars, err := readDotenv()
+	if err != nil {
+		return err
+	}
+
+	inFile := make(map[string]bool)
+	for _, v := range vars {
+		inFile[v.key] = true
+	}
+	for key := range dotenvKeys {
+		if !inFile[key] {
+			os.Unsetenv(key)
+			delete(dotenvKeys, key)
+		}
+	}
+	return applyDotenv(vars)
+}
+
+// fromDotenv reports whether the variable key was set from the .env file.
+func fromDotenv(key string) bool {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+	return dotenvKeys[key]
+}
+
+// applyDotenv sets variables from the file, skipping any that were set by
+// the real environment. The caller must hold dotenvMu.
+func applyDotenv(vars []dotenvVar) error {
+	for _, v := range vars {
+		if _, exists := os.LookupEnv(v.key); exists && !dotenvKeys[v.key] {
+			continue
+		}
+		if err := os.Setenv(v.key, v.value); err != nil {
+			return fmt.Errorf("setting %s: %w", v.key, err)
+		}
+		dotenvKeys[v.key] = true
+	}
+	return nil
+}
+
+// readDotenv reads, parses and decrypts the .env file, returning nothing if
+// the default file doesn't exist. The caller must hold dotenvMu.
+func readDotenv() ([]dotenvVar, error) {
+	path, explicit := os.LookupEnv(dotenvPathVar)
+	if !explicit {
+		path = ".env"
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	vars, err := parseDotenv(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// Encrypted values are decrypted with a key from the real environment,
+	// never from the file itself (see encryptedenv.go).
+	vars, err = decryptDotenv(vars, func(key string) string {
+		if dotenvKeys[key] {
+			return ""
+		}
+		return os.Getenv(key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// dotenvVar is one KEY=value assignment from a .env file.
+type dotenvVar struct {
+	key   string
+	value string
+}
+
+// parseDotenv parses the contents of a .env file. Assignments are returned in
+// file order; if a key appears twice, both are returned and the later one wins
+// when they're applied, just like in a shell script.
+func parseDotenv(src string) ([]dotenvVar, error) {
+	p := &dotenvParser{src: src, line: 1}
+
+	var vars []dotenvVar
+	for {
+		p.skipBlankAndComments()
+		if p.done() {
+			return vars, nil
+		}
+
+		v, err := p.assignment()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+		vars = append(vars, v)
+	}
+}
+
+// dotenvParser walks through the file one character at a time. A line-based
+// approach would be simpler, but double-quoted values are allowed to contain
+// newlines, so we need to track our position ourselves.
+type dotenvParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *dotenvParser) done() bool { return p.pos >= len(p.src) }
+
+func (p *dotenvParser) peek() byte { return p.src[p.pos] }
+
+// next consumes one character, counting lines for error messages.
+func (p *dotenvParser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpaces skips spaces and tabs, but not newlines.
+func (p *dotenvParser) skipSpaces() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipToEOL skips the rest of the current line, including the newline.
+func (p *dotenvParser) skipToEOL() {
+	for !p.done() {
+		if p.next() == '\n' {
+			return
+		}
+	}
+}
+
+// skipBlankAndComments moves past whitespace, empty lines and comment lines.
+func (p *dotenvParser) skipBlankAndComments() {
+	for !p.done() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipToEOL()
+		default:
+			return
+		}
+	}
+}
+
+// assignment parses "[export ]KEY=value" and the end of its line.
+func (p *dotenvParser) assignment() (dotenvVar, error) {
+	if strings.HasPrefix(p.src[p.pos:], "export ") {
+		p.pos += len("export ")
+		p.skipSpaces()
+	}
+
+	start := p.pos
+	for !p.done() && isEnvNameChar(p.peek(), p.pos == start) {
+		p.next()
+	}
+	key := p.src[start:p.pos]
+	if key == "" {
+		return dotenvVar{}, errors.New("expected a variable name")
+	}
+
+	p.skipSpaces()
+	if p.done() || p.peek() != '=' {
+		return dotenvVar{}, fmt.Errorf("expected '=' after %s", key)
+	}
+	p.next()
+	p.skipSpaces()
+
+	var value string
+	var err error
+	switch {
+	case p.done():
+	case p.peek() == '\'':
+		value, err = p.singleQuoted()
+	case p.peek() == '"':
+		value, err = p.doubleQuoted()
+	default:
+		value = p.unquoted()
+	}
+	if err != nil {
+		return dotenvVar{}, fmt.Errorf("%s: %w", key, err)
+	}
+
+	// Only whitespace or a comment may follow a quoted value.
+	p.skipSpaces()
+	if !p.done() && p.peek() != '\n' && p.peek() != '\r' && p.peek() != '#' {
+		return dotenvVar{}, fmt.Errorf("%s: unexpected characters after value", key)
+	}
+	p.skipToEOL()
+
+	return dotenvVar{key: key, value: value}, nil
+}
+
+// unquoted reads a bare value up to the end of the line or an inline comment
+// (a '#' preceded by whitespace), trimming trailing whitespace.
+func (p *dotenvParser) unquoted() string {
+	start := p.pos
+	for !p.done() && p.peek() != '\n' {
+		if p.peek() == '#' && p.pos > start && (p.src[p.pos-1] == ' ' || p.src[p.pos-1] == '\t') {
+			break
+		}
+		p.next()
+	}
+	return strings.TrimRight(p.src[start:p.pos], " \t\r")
+}
+
+// singleQuoted reads a '...' value, which is taken literally.
+func (p *dotenvParser) singleQuoted() (string, error) {
+	p.next() // opening quote
+	start := p.pos
+	for !p.done() {
+		if p.peek() == '\'' {
+			value := p.src[start:p.pos]
+			p.next()
+			return value, nil
+		}
+		p.next()
+	}
+	return "", errors.New("unterminated single-quoted value")
+}
+
+// doubleQuoted reads a "..." value, processing backslash escapes.
+func (p *dotenvParser) doubleQuoted() (string, error) {
+	p.next() // opening quote
+	var b strings.Builder
+	for !p.done() {
+		c := p.next()
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errors.New("unterminated double-quoted value")
+			}
+			switch e := p.next(); e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(e)
+			default:
+				// Unknown escapes are kept as written, like most shells do.
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated double-quoted value")
+}
+
+// isEnvNameChar reports whether c may appear in a variable name: letters,
+// digits and underscores, not starting with a digit.
+func isEnvNameChar(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestParseDotenv covers the quoting and escaping rules.
+func TestParseDotenv(t *testing.T) {
+	src := `# a comment
+PLAIN=hello world
+export EXPORTED=yes
+INLINE=value # trailing comment
+HASH=abc#def
+EMPTY=
+SINGLE='literal \n $HOME'
+DOUBLE="tab\there \"quoted\""
+MULTI="line one
+line two"
+SPACED = padded  
+`
+	got, err := parseDotenv(src)
+	if err != nil {
+		t.Fatalf("parseDotenv failed: %v", err)
+	}
+
+	want := []dotenvVar{
+		{"PLAIN", "hello world"},
+		{"EXPORTED", "yes"},
+		{"INLINE", "value"},
+		{"HASH", "abc#def"},
+		{"EMPTY", ""},
+		{"SINGLE", `literal \n $HOME`},
+		{"DOUBLE", "tab\there \"quoted\""},
+		{"MULTI", "line one\nline two"},
+		{"SPACED", "padded"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+// TestParseDotenvErrors checks that malformed files are reported with a line
+// number rather than silently producing wrong values.
+func TestParseDotenvErrors(t *testing.T) {
+	for _, src := range []string{
+		"NO_EQUALS\n",
+		"1BAD=value\n",
+		"OPEN=\"never closed\n",
+		"OPEN='never closed\n",
+		"TRAILING=\"value\" junk\n",
+	} {
+		if _, err := parseDotenv(src); err == nil {
+			t.Errorf("Expected an error for %q", src)
+		}
+	}
+}
+
+// TestLoadDotenv checks that the file is applied without overriding
+// variables that are already set in the environment.
+func TestLoadDotenv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.env")
+	if err := os.WriteFile(path, []byte("DOTENV_TEST_NEW=from-file\nDOTENV_TEST_SET=from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(dotenvPathVar, path)
+	t.Setenv("DOTENV_TEST_SET", "from-env")
+	// Register DOTENV_TEST_NEW with t.Setenv so it's restored after the test,
+	// then unset it so the file can provide it.
+	t.Setenv("DOTENV_TEST_NEW", "")
+	os.Unsetenv("DOTENV_TEST_NEW")
+
+	if err := loadDotenv(); err != nil {
+		t.Fatalf("loadDotenv failed: %v", err)
+	}
+
+	if got := os.Getenv("DOTENV_TEST_NEW"); got != "from-file" {
+		t.Errorf("Expected DOTENV_TEST_NEW=from-file, got %q", got)
+	}
+	if got := os.Getenv("DOTENV_TEST_SET"); got != "from-env" {
+		t.Errorf("Expected the environment to win, got %q", got)
+	}
+
+	t.Setenv(dotenvPathVar, filepath.Join(t.TempDir(), "missing.env"))
+	if err := loadDotenv(); err == nil {
+		t.Error("Expected an error for a missing DOTENV_PATH file")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// This file sends email, through any mail server that speaks SMTP: a
+// company relay, a provider like SES, Postmark or Mailgun, or MailHog and
+// Mailpit for catching mail in development. It's used by the contact form
+// (contact.go).
+//
+// SMTP_HOST and SMTP_PORT say where the server is, and SMTP_TLS how to
+// protect the connection:
+//   - "starttls", the default, connects in plain text and upgrades to TLS
+//     before anything else is sent, as on port 587. A server that doesn't
+//     offer the upgrade gets no email, rather than the password and the
+//     message in the clear.
+//   - "tls" uses TLS from the start, as on port 465.
+//   - "none" never encrypts, which is only for a server on the same host or
+//     a development catcher.
+//
+// With SMTP_USERNAME set, the server is logged in to with SMTP_PASSWORD.
+// Without SMTP_HOST, DEV_MODE logs each email instead of sending it, so the
+// contact form can be tried on a laptop; outside dev mode, nothing can be
+// sent.
+//
+// Messages are written with text/template, from templates/email. Each
+// template is the message as it's sent: a Subject line, a blank line and
+// the body. text/template doesn't escape anything, which is right for plain
+// text, but anything a visitor typed must stay out of the headers, where a
+// line break would let them add their own. So the subject is MIME-encoded,
+// which turns line breaks into harmless text, and addresses are only ever
+// written by net/mail.
+
+// smtpTimeout limits how long sending one email can take.
+const smtpTimeout = 10 * time.Second
+
+// emailTemplates are the message templates in templates/email, by file
+// name. They're always the embedded ones, even in dev mode.
+var emailTemplates = template.Must(template.ParseFS(embeddedFS, "templates/email/*.txt"))
+
+// Email is a plain text email.
+type Email struct {
+	To      []*mail.Address
+	ReplyTo *mail.Address
+	Subject string
+	Body    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// newMailer returns the mailer configured by cfg: an SMTP server if SMTP_HOST
+// is set, or else the log in dev mode. Otherwise it returns nil.
+func newMailer(cfg Config) Mailer {
+	// The configuration has been validated, so parsing can't fail.
+	from, _ := mail.ParseAddress(cfg.EmailFrom)
+	switch {
+	case cfg.SMTPHost != "":
+		return &smtpMailer{
+			addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+			host:     cfg.SMTPHost,
+			tls:      cfg.SMTPTLS,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+			from:     from,
+		}
+	case cfg.DevMode:
+		return logMailer{from: from}
+	}
+	return nil
+}
+
+// renderEmail fills in the template name with data, returning the subject
+// and the body.
+func renderEmail(name string, data any) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err := emailTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", "", err
+	}
+	head, body, ok := strings.Cut(buf.String(), "\n\n")
+	subject, found := strings.CutPrefix(head, "Subject: ")
+	if !ok || !found || strings.Contains(subject, "\n") {
+		return "", "", fmt.Errorf("email template %s must start with a Subject line and a blank line", name)
+	}
+	return subject, body, nil
+}
+
+// buildMessage writes email from from as an RFC 5322 message, dated now.
+func buildMessage(from *mail.Address, email Email, now time.Time) ([]byte, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	to := make([]string, len(email.To))
+	for i, addr := range email.To {
+		to[i] = addr.String()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	if email.ReplyTo != nil {
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", email.ReplyTo)
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	// Quoted-printable keeps lines short and the message 7-bit, whatever
+	// the body contains. SMTP wants CRLF line endings.
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(email.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// smtpMailer sends email through an SMTP server.
+type smtpMailer struct {
+	addr, host         string
+	tls                string // "starttls", "tls" or "none"
+	username, password string
+	from               *mail.Address
+}
+
+// Send delivers email to the server, which takes it from there.
+func (m *smtpMailer) Send(ctx context.Context, email Email) error {
+	msg, err := buildMessage(m.from, email, time.Now())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// net/smtp knows nothing of contexts, so the deadline goes on the
+	// connection instead.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if m.tls == "tls" {
+		conn = tls.Client(conn, &tls.Config{ServerName: m.host})
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if m.tls == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server doesn't support STARTTLS (set SMTP_TLS=none to send unencrypted)")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	for _, addr := range email.To {
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// logMailer logs email instead of sending it, for dev mode.
+type logMailer struct {
+	from *mail.Address
+}
+
+func (m logMailer) Send(ctx context.Context, email Email) error {
+	to := make([]string, len(email.To))
+	for i, addr := range email.To {
+		to[i] = addr.String()
+	}
+	replyTo := ""
+	if email.ReplyTo != nil {
+		replyTo = email.ReplyTo.String()
+	}
+	slog.InfoContext(ctx, "Email not sent (dev mode, no SMTP_HOST)",
+		"from", m.from.String(), "to", strings.Join(to, ", "), "reply_to", replyTo,
+		"subject", email.Subject, "body", email.Body)
+	return nil
+}
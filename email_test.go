@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"mime"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a mail server that accepts every message, offering AUTH
+// PLAIN but not STARTTLS.
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+// newFakeSMTP starts a fake mail server, stopped when the test ends.
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve talks SMTP on conn.
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch verb {
+		case "EHLO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, msg.String())
+			f.mu.Unlock()
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// Commands returns the commands received so far.
+func (f *fakeSMTP) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// Messages returns the messages received so far.
+func (f *fakeSMTP) Messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+// Config points cfg at the fake server.
+func (f *fakeSMTP) Config(cfg Config) Config {
+	host, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	cfg.SMTPHost = host
+	cfg.SMTPPort, _ = strconv.Atoi(port)
+	return cfg
+}
+
+// TestSMTPMailer sends an email through the fake server, logging in.
+func TestSMTPMailer(t *testing.T) {
+	server := newFakeSMTP(t)
+	cfg := server.Config(defaultConfig(t))
+	cfg.SMTPTLS = "none"
+	cfg.SMTPUsername, cfg.SMTPPassword = "app", "secret"
+	cfg.EmailFrom = "App <app@example.com>"
+
+	email := Email{
+		To:      []*mail.Address{{Address: "ops@example.com"}},
+		ReplyTo: &mail.Address{Name: "Ada", Address: "ada@example.com"},
+		Subject: "Hello",
+		Body:    "Line one\nLine two\n",
+	}
+	if err := newMailer(cfg).Send(context.Background(), email); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := strings.Join(server.Commands(), "\n")
+	for _, want := range []string{"AUTH PLAIN", "MAIL FROM:<app@example.com>", "RCPT TO:<ops@example.com>", "DATA", "QUIT"} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("Expected %q sent, got:\n%s", want, commands)
+		}
+	}
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected one message, got %d", len(messages))
+	}
+	for _, want := range []string{"From: \"App\" <app@example.com>\r\n", "To: <ops@example.com>\r\n", "Reply-To: \"Ada\" <ada@example.com>\r\n", "Subject: Hello\r\n", "\r\n\r\nLine one\r\nLine two\r\n"} {
+		if !strings.Contains(messages[0], want) {
+			t.Errorf("Expected %q in the message, got:\n%s", want, messages[0])
+		}
+	}
+}
+
+// TestSMTPMailerRequiresTLS checks a server without STARTTLS isn't sent
+// anything, unless SMTP_TLS is none.
+func TestSMTPMailerRequiresTLS(t *testing.T) {
+	server := newFakeSMTP(t)
+	cfg := server.Config(defaultConfig(t))
+	cfg.SMTPUsername, cfg.SMTPPassword = "app", "secret"
+
+	email := Email{To: []*mail.Address{{Address: "ops@example.com"}}, Subject: "Hello", Body: "Hi"}
+	err := newMailer(cfg).Send(context.Background(), email)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected a STARTTLS error, got %v", err)
+	}
+	for _, command := range server.Commands() {
+		if strings.HasPrefix(command, "AUTH") || strings.HasPrefix(command, "MAIL") {
+			t.Errorf("Expected nothing sent in the clear, got %q", command)
+		}
+	}
+}
+
+// TestNewMailer checks which mailer each configuration gets.
+func TestNewMailer(t *testing.T) {
+	cfg := defaultConfig(t)
+	if m := newMailer(cfg); m != nil {
+		t.Errorf("Expected no mailer by default, got %T", m)
+	}
+	cfg.DevMode = true
+	if _, ok := newMailer(cfg).(logMailer); !ok {
+		t.Error("Expected dev mode to log email")
+	}
+	cfg.SMTPHost = "smtp.example.com"
+	if _, ok := newMailer(cfg).(*smtpMailer); !ok {
+		t.Error("Expected SMTP_HOST to send email")
+	}
+}
+
+// TestBuildMessage checks headers can't be added through the subject, and
+// the body is encoded.
+func TestBuildMessage(t *testing.T) {
+	from := &mail.Address{Name: "App", Address: "app@example.com"}
+	email := Email{
+		To:      []*mail.Address{{Address: "ops@example.com"}},
+		Subject: "Hi\r\nBcc: victim@example.com",
+		Body:    "Héllo\n",
+	}
+	msg, err := buildMessage(from, email, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := parsed.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("Expected no Bcc header, got %q", bcc)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != email.Subject {
+		t.Errorf("Expected the subject to survive encoding, got %q", subject)
+	}
+	if date := parsed.Header.Get("Date"); date != "Mon, 01 Jan 2024 12:00:00 +0000" {
+		t.Errorf("Expected the date, got %q", date)
+	}
+	if id := parsed.Header.Get("Message-Id"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Expected a Message-ID at the sender's domain, got %q", id)
+	}
+	if !strings.Contains(string(msg), "H=C3=A9llo\r\n") {
+		t.Errorf("Expected a quoted-printable body, got:\n%s", msg)
+	}
+}
+
+// TestRenderEmail checks a template's subject and body are split.
+func TestRenderEmail(t *testing.T) {
+	subject, body, err := renderEmail("contact.txt", contactEmail{
+		ContactRequest: ContactRequest{Name: "Ada", Email: "ada@example.com", Message: "Hello <there>"},
+		Tenant:         defaultTenant,
+		Instance:       "test",
+		SentAt:         time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Contact form: message from Ada" {
+		t.Errorf("Expected the subject filled in, got %q", subject)
+	}
+	if !strings.Contains(body, "Ada <ada@example.com> sent this") || !strings.Contains(body, "\nHello <there>\n") {
+		t.Errorf("Expected the message unescaped in the body, got:\n%s", body)
+	}
+}
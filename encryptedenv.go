@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file decrypts secrets in the .env file as it's loaded, so a .env
+// with real passwords in it can be committed to git: only someone with the
+// key can read them. There are two ways to encrypt it, both with age keys
+// (see age.go):
+//
+// One value at a time, with the key from "server config keygen" or
+// age-keygen. "server config encrypt" prints the encrypted value, which is
+// age's binary format in base64 after "age:":
+//
+//	SMTP_PASSWORD=age:YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSB...
+//
+// Or the whole file, with sops (https://getsops.io), which leaves the names
+// readable and adds its own sops_* variables:
+//
+//	sops encrypt --age age1... --input-type dotenv .env.plain > .env
+//
+// Either way, the identity (private key) comes from SOPS_AGE_KEY (the key
+// itself) or SOPS_AGE_KEY_FILE (a file of them), the variables sops reads,
+// or sops's default ~/.config/sops/age/keys.txt. They must be set in the
+// real environment: a key in the file it decrypts wouldn't protect
+// anything. A file without encrypted values doesn't need a key.
+
+// ageValuePrefix marks a value encrypted by "server config encrypt".
+const ageValuePrefix = "age:"
+
+// sopsPrefix starts the names of the variables sops adds to the file.
+const sopsPrefix = "sops_"
+
+// decryptDotenv returns vars with every encrypted value decrypted, reading
+// the identity with getenv.
+func decryptDotenv(vars []dotenvVar, getenv func(string) string) ([]dotenvVar, error) {
+	sops, encrypted := false, false
+	for _, v := range vars {
+		sops = sops || v.key == sopsPrefix+"mac"
+		encrypted = encrypted || strings.HasPrefix(v.value, ageValuePrefix)
+	}
+	if !sops && !encrypted {
+		return vars, nil
+	}
+
+	identities, err := ageIdentitiesFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	if sops {
+		if vars, err = decryptSops(vars, identities); err != nil {
+			return nil, err
+		}
+	}
+
+	decrypted := make([]dotenvVar, len(vars))
+	for i, v := range vars {
+		if encoded, ok := strings.CutPrefix(v.value, ageValuePrefix); ok {
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("%s: the age value isn't valid base64", v.key)
+			}
+			plaintext, err := ageDecrypt(data, identities)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", v.key, err)
+			}
+			v.value = string(plaintext)
+		}
+		decrypted[i] = v
+	}
+	return decrypted, nil
+}
+
+// ageIdentitiesFromEnv reads the age identities from SOPS_AGE_KEY,
+// SOPS_AGE_KEY_FILE or sops's default key file.
+func ageIdentitiesFromEnv(getenv func(string) string) ([]*ecdh.PrivateKey, error) {
+	if keys := getenv("SOPS_AGE_KEY"); keys != "" {
+		identities, err := parseAgeIdentities(keys)
+		if err != nil {
+			return nil, fmt.Errorf("SOPS_AGE_KEY: %w", err)
+		}
+		return identities, nil
+	}
+
+	path, explicit := getenv("SOPS_AGE_KEY_FILE"), true
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, errors.New("the file has encrypted values, but neither SOPS_AGE_KEY nor SOPS_AGE_KEY_FILE is set")
+		}
+		path, explicit = filepath.Join(dir, "sops", "age", "keys.txt"), false
+	}
+	data, err := os.ReadFile(path)
+	if !explicit && errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New("the file has encrypted values, but neither SOPS_AGE_KEY nor SOPS_AGE_KEY_FILE is set")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the age key: %w", err)
+	}
+	identities, err := parseAgeIdentities(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// decryptSops decrypts a dotenv file encrypted by sops and returns its
+// variables without sops's own.
+//
+// sops encrypts each value with AES-256-GCM under a random data key, with
+// the variable's name as additional data so values can't be swapped
+// around. The data key is stored age-encrypted to each recipient, armored,
+// in sops_age__list_<n>__map_enc. sops_mac is an encrypted SHA-512 of all
+// the values, which stops any being added, removed or reordered.
+func decryptSops(vars []dotenvVar, identities []*ecdh.PrivateKey) ([]dotenvVar, error) {
+	meta := make(map[string]string)
+	for _, v := range vars {
+		if strings.HasPrefix(v.key, sopsPrefix) {
+			meta[strings.TrimPrefix(v.key, sopsPrefix)] = v.value
+		}
+	}
+
+	var dataKey []byte
+	for i := 0; dataKey == nil; i++ {
+		enc, ok := meta[fmt.Sprintf("age__list_%d__map_enc", i)]
+		if !ok {
+			if i == 0 {
+				return nil, errors.New("sops: the file isn't encrypted to an age key")
+			}
+			return nil, fmt.Errorf("sops: %w", errNoAgeIdentity)
+		}
+		// sops writes the armored key's newlines as \n to keep it on one
+		// line.
+		dataKey, _ = ageDecrypt([]byte(strings.ReplaceAll(enc, `\n`, "\n")), identities)
+	}
+
+	macOnlyEncrypted := meta["mac_only_encrypted"] == "true"
+	hash := sha512.New()
+	var decrypted []dotenvVar
+	for _, v := range vars {
+		if strings.HasPrefix(v.key, sopsPrefix) {
+			continue
+		}
+		encrypted := strings.HasPrefix(v.value, "ENC[")
+		if encrypted {
+			var err error
+			if v.value, err = decryptSopsValue(v.value, dataKey, v.key+":"); err != nil {
+				return nil, fmt.Errorf("sops: %s: %w", v.key, err)
+			}
+		}
+		if encrypted || !macOnlyEncrypted {
+			hash.Write([]byte(v.value))
+		}
+		decrypted = append(decrypted, v)
+	}
+
+	mac, err := decryptSopsValue(meta["mac"], dataKey, meta["lastmodified"])
+	if err != nil {
+		return nil, fmt.Errorf("sops: sops_mac: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, errors.New("sops: the values don't match sops_mac; the file has been changed since it was encrypted")
+	}
+	return decrypted, nil
+}
+
+// decryptSopsValue decrypts one of sops's encrypted values:
+//
+//	ENC[AES256_GCM,data:<base64>,iv:<base64>,tag:<base64>,type:str]
+func decryptSopsValue(value string, key []byte, additionalData string) (string, error) {
+	inner, ok := strings.CutPrefix(value, "ENC[AES256_GCM,")
+	if inner, ok = strings.CutSuffix(inner, "]"); !ok || !strings.HasPrefix(value, "ENC[AES256_GCM,") {
+		return "", errors.New("not a sops AES256_GCM value")
+	}
+	parts := make(map[string][]byte)
+	for _, field := range strings.Split(inner, ",") {
+		name, encoded, _ := strings.Cut(field, ":")
+		if name == "type" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("%s isn't valid base64", name)
+		}
+		parts[name] = b
+	}
+	if len(parts["iv"]) == 0 || len(parts["tag"]) != 16 {
+		return "", errors.New("malformed sops value")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	// sops uses 32-byte nonces rather than GCM's usual 12.
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(parts["iv"]))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, parts["iv"], append(parts["data"], parts["tag"]...), []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ageValue encrypts a value the way "server config encrypt" does.
+func ageValue(t *testing.T, value string, recipient *ecdh.PublicKey) string {
+	t.Helper()
+	encrypted, err := ageEncrypt([]byte(value), []*ecdh.PublicKey{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ageValuePrefix + base64.StdEncoding.EncodeToString(encrypted)
+}
+
+// sopsFile encrypts vars to recipient the way "sops encrypt" does for a
+// dotenv file, and returns the file.
+func sopsFile(t *testing.T, vars []dotenvVar, recipient *ecdh.PublicKey) string {
+	t.Helper()
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	encrypt := func(value, additionalData string) string {
+		block, _ := aes.NewCipher(dataKey)
+		gcm, _ := cipher.NewGCMWithNonceSize(block, 32)
+		iv := make([]byte, 32)
+		rand.Read(iv)
+		sealed := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+		data, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+		b64 := base64.StdEncoding.EncodeToString
+		return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]", b64(data), b64(iv), b64(tag))
+	}
+
+	var b strings.Builder
+	hash := sha512.New()
+	for _, v := range vars {
+		hash.Write([]byte(v.value))
+		fmt.Fprintf(&b, "%s=%s\n", v.key, encrypt(v.value, v.key+":"))
+	}
+	wrapped, err := ageEncrypt(dataKey, []*ecdh.PublicKey{recipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := "2024-05-01T09:00:00Z"
+	fmt.Fprintf(&b, "sops_age__list_0__map_enc=%s\n", strings.ReplaceAll(ageArmor(wrapped), "\n", `\n`))
+	fmt.Fprintf(&b, "sops_age__list_0__map_recipient=%s\n", bech32Encode(ageRecipientPrefix, recipient.Bytes()))
+	fmt.Fprintf(&b, "sops_lastmodified=%s\n", lastModified)
+	fmt.Fprintf(&b, "sops_mac=%s\n", encrypt(fmt.Sprintf("%X", hash.Sum(nil)), lastModified))
+	fmt.Fprintf(&b, "sops_unencrypted_suffix=_unencrypted\nsops_version=3.8.1\n")
+	return b.String()
+}
+
+// TestDecryptDotenvAgeValues decrypts "age:" values and leaves the rest.
+func TestDecryptDotenvAgeValues(t *testing.T) {
+	identity, _, recipient := testAgeKey(t)
+	vars := []dotenvVar{{"PORT", "9000"}, {"SMTP_PASSWORD", ageValue(t, "hunter2", recipient)}}
+	env := map[string]string{"SOPS_AGE_KEY": identity}
+	getenv := func(key string) string { return env[key] }
+
+	got, err := decryptDotenv(vars, getenv)
+	if want := []dotenvVar{{"PORT", "9000"}, {"SMTP_PASSWORD", "hunter2"}}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v %v", want, got, err)
+	}
+
+	// Without encrypted values no key is needed; with them, it must be the
+	// right one.
+	delete(env, "SOPS_AGE_KEY")
+	if _, err := decryptDotenv(vars[:1], getenv); err != nil {
+		t.Errorf("Expected a plain file to need no key, got %v", err)
+	}
+	other, _, _ := testAgeKey(t)
+	env["SOPS_AGE_KEY_FILE"] = filepath.Join(t.TempDir(), "keys.txt")
+	os.WriteFile(env["SOPS_AGE_KEY_FILE"], []byte("# public key: age1...\n"+other+"\n"), 0o600)
+	if _, err := decryptDotenv(vars, getenv); !errors.Is(err, errNoAgeIdentity) || !strings.HasPrefix(err.Error(), "SMTP_PASSWORD: ") {
+		t.Errorf("Expected the wrong key to be reported, got %v", err)
+	}
+	os.WriteFile(env["SOPS_AGE_KEY_FILE"], []byte(identity+"\n"), 0o600)
+	if _, err := decryptDotenv(vars, getenv); err != nil {
+		t.Errorf("Expected the key file to be read, got %v", err)
+	}
+}
+
+// TestDecryptDotenvSops decrypts a file encrypted by sops, and checks that
+// changes to it are caught.
+func TestDecryptDotenvSops(t *testing.T) {
+	identity, _, recipient := testAgeKey(t)
+	getenv := func(key string) string { return map[string]string{"SOPS_AGE_KEY": identity}[key] }
+	want := []dotenvVar{{"PORT", "9000"}, {"SMTP_PASSWORD", "hunter2"}, {"LLM_API_KEY", "sk-1"}}
+	file := sopsFile(t, want, recipient)
+
+	vars, err := parseDotenv(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decryptDotenv(vars, getenv)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v %v", want, got, err)
+	}
+
+	// Swapping two values breaks their additional data, and dropping one
+	// breaks the MAC.
+	swapped := append([]dotenvVar(nil), vars...)
+	swapped[1].value, swapped[2].value = swapped[2].value, swapped[1].value
+	if _, err := decryptDotenv(swapped, getenv); err == nil || !strings.Contains(err.Error(), "SMTP_PASSWORD") {
+		t.Errorf("Expected swapped values to be rejected, got %v", err)
+	}
+	if _, err := decryptDotenv(append(vars[:1:1], vars[2:]...), getenv); err == nil || !strings.Contains(err.Error(), "sops_mac") {
+		t.Errorf("Expected a removed value to be rejected, got %v", err)
+	}
+}
+
+// TestReadEncryptedDotenv checks readDotenv decrypts with a key from the
+// real environment only.
+func TestReadEncryptedDotenv(t *testing.T) {
+	identity, _, recipient := testAgeKey(t)
+	path := filepath.Join(t.TempDir(), "test.env")
+	os.WriteFile(path, []byte("DOTENV_TEST_SECRET="+ageValue(t, "hunter2", recipient)+"\n"), 0o600)
+	t.Setenv(dotenvPathVar, path)
+	t.Setenv("SOPS_AGE_KEY", identity)
+
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+	vars, err := readDotenv()
+	if want := []dotenvVar{{"DOTENV_TEST_SECRET", "hunter2"}}; err != nil || !reflect.DeepEqual(vars, want) {
+		t.Errorf("Expected %v, got %v %v", want, vars, err)
+	}
+
+	// As if the key had come from the file.
+	dotenvKeys["SOPS_AGE_KEY"] = true
+	defer delete(dotenvKeys, "SOPS_AGE_KEY")
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join(t.TempDir(), "missing.txt"))
+	if _, err := readDotenv(); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("Expected the key from the file to be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// This file implements the optional response envelope. By default the API
+// returns resources as they are: a note is a note object, an error is an
+// RFC 7807 problem. Many teams instead wrap every response in the same
+// outer object, so clients can always find the payload, the error and the
+// metadata in the same place:
+//
+//	{"data": {...}, "error": null, "meta": {"request_id": "..."}}
+//	{"data": null, "error": {"type": ..., "status": 404, ...}, "meta": {...}}
+//
+// Setting RESPONSE_ENVELOPE=true turns this on for every JSON response.
+// Handlers don't change at all: the envelope middleware marks the response
+// writer, and writeJSON and writeProblem (render.go) wrap what they send
+// when they find the mark.
+
+// Envelope is the outer object of every JSON response in envelope mode.
+// Data and Error are always present, one of them null.
+type Envelope struct {
+	Data  any              `json:"data"`
+	Error *ProblemResponse `json:"error"`
+	Meta  EnvelopeMeta     `json:"meta"`
+}
+
+// EnvelopeMeta is information about the response rather than the resource.
+type EnvelopeMeta struct {
+	RequestID  string      `json:"request_id"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+}
+
+// Pagination describes which part of a collection a list response holds.
+type Pagination struct {
+	// Total is the number of items in the whole collection.
+	Total int `json:"total" proto:"1"`
+
+	// Page (counting from 1) and PerPage are set for collections that are
+	// returned a page at a time.
+	Page    int `json:"page,omitempty" proto:"2"`
+	PerPage int `json:"per_page,omitempty" proto:"3"`
+}
+
+// envelopeWriter marks a response as enveloped and collects its metadata.
+// It passes writes straight through; the wrapping is done by the render
+// helpers.
+type envelopeWriter struct {
+	http.ResponseWriter
+	meta EnvelopeMeta
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter.
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// envelopeMiddleware switches a request's JSON responses to envelope mode.
+// It's only in the middleware chain when RESPONSE_ENVELOPE is set.
+func envelopeMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&envelopeWriter{
+			ResponseWriter: w,
+			meta:           EnvelopeMeta{RequestID: requestIDFromContext(r.Context())},
+		}, r)
+	}
+}
+
+// envelopeOf finds the envelopeWriter behind w, looking through any other
+// middleware's wrappers, or returns nil when envelopes are off.
+func envelopeOf(w http.ResponseWriter) *envelopeWriter {
+	for {
+		switch v := w.(type) {
+		case *envelopeWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// setPagination records a list response's pagination for the envelope's
+// meta. Without envelopes there's nowhere to put it, so it's dropped.
+func setPagination(w http.ResponseWriter, p Pagination) {
+	if ew := envelopeOf(w); ew != nil {
+		ew.meta.Pagination = &p
+	}
+}
+
+// decodeResponse decodes a JSON response from this server into v, taking
+// the payload out of its envelope if the server uses them. CLI commands use
+// it so they work whichever way the server is configured.
+func decodeResponse(data []byte, v any) error {
+	var env struct {
+		Data json.RawMessage `json:"data"`
+		Meta *EnvelopeMeta   `json:"meta"`
+	}
+	if json.Unmarshal(data, &env) == nil && env.Meta != nil && env.Data != nil {
+		data = env.Data
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestEnvelopeMode checks success and error responses are both wrapped,
+// with the request ID and pagination in meta.
+func TestEnvelopeMode(t *testing.T) {
+	srv := newServer(Config{ResponseEnvelope: true})
+	mux := srv.routes()
+	srv.store.CreateNote(defaultTenant, "One", "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/notes", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var env struct {
+		Data  NoteListResponse `json:"data"`
+		Error *ProblemResponse `json:"error"`
+		Meta  EnvelopeMeta     `json:"meta"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if len(env.Data.Notes) != 1 || env.Error != nil {
+		t.Errorf("Expected the notes as data and no error, got %s", rec.Body.String())
+	}
+	if env.Meta.RequestID != "req-1" {
+		t.Errorf("Expected request ID req-1, got %q", env.Meta.RequestID)
+	}
+	if env.Meta.Pagination == nil || env.Meta.Pagination.Total != 1 {
+		t.Errorf("Expected pagination total 1, got %+v", env.Meta.Pagination)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/notes/missing", nil))
+	env.Error = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if rec.Code != http.StatusNotFound || env.Error == nil || env.Error.Status != http.StatusNotFound {
+		t.Errorf("Expected a 404 problem as the error, got %d %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected application/json, got %s", ct)
+	}
+}
+
+// TestEnvelopeOff checks the default responses are unchanged.
+func TestEnvelopeOff(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServer(Config{}).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/notes", nil))
+
+	var raw map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["notes"]; !ok {
+		t.Errorf("Expected a bare notes list, got %s", rec.Body.String())
+	}
+}
+
+// TestDecodeResponse checks CLI decoding works with and without envelopes.
+func TestDecodeResponse(t *testing.T) {
+	for _, body := range []string{
+		`{"tenant": "demo"}`,
+		`{"data": {"tenant": "demo"}, "error": null, "meta": {"request_id": "x"}}`,
+	} {
+		var got SeedResponse
+		if err := decodeResponse([]byte(body), &got); err != nil || got.Tenant != "demo" {
+			t.Errorf("decodeResponse(%s): got %+v, %v", body, got, err)
+		}
+	}
+}
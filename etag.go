@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// This file implements optimistic concurrency control with ETags.
+//
+// The problem it solves is the "lost update": Alice and Bob both load a
+// note, Alice saves her edit, then Bob saves his, silently overwriting
+// Alice's work. Locking the note while someone edits it would fix that, but
+// HTTP clients come and go, so a lock could be held forever.
+//
+// Instead every GET returns an ETag, a fingerprint of the resource's
+// current state. A client that wants to change the resource sends that
+// fingerprint back in an If-Match header, meaning "only if it hasn't
+// changed since I read it". If it has, the server answers 412 Precondition
+// Failed and the client re-reads and tries again. Nobody waits, and nobody
+// overwrites anyone else by accident.
+//
+// Updates and deletes of notes require If-Match: without it the server
+// answers 428 Precondition Required, so clients can't skip the check.
+
+// etagOf returns a strong ETag for a value: a hash of its JSON encoding.
+// Any change to any field gives a different tag. Hashing the content (rather
+// than keeping a version number) means nothing extra has to be stored.
+func etagOf(v any) string {
+	raw, _ := json.Marshal(v)
+	sum := sha256.Sum256(raw)
+	// Half the hash is plenty to tell versions of one resource apart.
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ifMatch reports whether an If-Match header value allows a change to a
+// resource whose current ETag is etag. The header is "*" (any version) or
+// a comma-separated list of tags. If-Match uses the strong comparison, so
+// weak tags (W/"...") never match.
+func ifMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// requireIfMatch checks that a request modifying a resource carries an
+// If-Match header. If not, it writes a 428 and returns false. It returns a
+// function that tests a version of the resource against the header, to be
+// passed to the store, which checks it under its lock so nothing can change
+// in between.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) (func(Note) bool, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		writeProblem(w, http.StatusPreconditionRequired, "send an If-Match header with the note's ETag (from GET) to change it")
+		return nil, false
+	}
+	return func(current Note) bool { return ifMatch(header, etagOf(current)) }, true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIfMatch checks the header forms a client may send.
+func TestIfMatch(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`*`, true},
+		{`"old", "abc"`, true},
+		{`"old"`, false},
+		{`W/"abc"`, false}, // weak tags never match If-Match
+	}
+	for _, tt := range tests {
+		if got := ifMatch(tt.header, etag); got != tt.want {
+			t.Errorf("ifMatch(%s): expected %v, got %v", tt.header, tt.want, got)
+		}
+	}
+}
+
+// TestDeleteNoteIfMatch walks through the lost-update scenario: a client
+// holding a stale ETag is refused, and one without any ETag is told to
+// send one.
+func TestDeleteNoteIfMatch(t *testing.T) {
+	srv := newServer(Config{})
+	mux := srv.routes()
+	note := srv.store.CreateNote(defaultTenant, "Original", "")
+	stale := etagOf(note)
+
+	// Someone else changes the note after we read it.
+	if _, err := srv.store.UpdateNote(defaultTenant, Note{ID: note.ID, Title: "Edited"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(ifMatch string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/notes/"+note.ID, nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := del(""); code != http.StatusPreconditionRequired {
+		t.Errorf("Expected 428 without If-Match, got %d", code)
+	}
+	if code := del(stale); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/notes/"+note.ID, nil))
+	if code := del(rec.Header().Get("ETag")); code != http.StatusNoContent {
+		t.Errorf("Expected 204 with the current ETag, got %d", code)
+	}
+}
+
+// TestPatchNoteStaleETag checks a patch based on an old version is refused.
+func TestPatchNoteStaleETag(t *testing.T) {
+	srv := newServer(Config{})
+	note := srv.store.CreateNote(defaultTenant, "Original", "")
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/notes/"+note.ID, nil)
+	req.Header.Set("Content-Type", mergePatchType)
+	req.Header.Set("If-Match", `"stale"`)
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// This file implements a counter with event sourcing, next to the plain
+// one in counter.go to compare it with. The plain counter stores its
+// current value, and each change overwrites it: what the value used to be,
+// and why it changed, is gone. An event-sourced counter stores what
+// happened instead, as an append-only list of events ("incremented by 5",
+// "reset"), and the current value is worked out by replaying them from the
+// start. Nothing is ever updated or deleted, so the history is the data:
+// GET /api/v1/eventcounter?version=N shows the value as it was after event
+// N, and the events themselves are an audit log for free.
+//
+// The pieces, as in any event-sourced system:
+//   - Commands ask for a change (CounterCommand). decide checks it against
+//     the current state and either turns it into an event or refuses it:
+//     the counter can't go below zero. Commands can be refused; events
+//     can't, because they've already happened.
+//   - Events record the change (CounterEvent). apply folds one into the
+//     state, and never fails, so replaying is always possible.
+//   - Replay rebuilds the state from the events. The store does it when
+//     the data file is loaded, and keeps the result in memory from then on.
+//   - Snapshots save the state every counterSnapshotEvery events, so a
+//     replay starts from the latest snapshot rather than from event 1. The
+//     events before it are still kept; a snapshot is only a shortcut.
+//
+// Concurrent writers are kept apart with optimistic concurrency: a command
+// can say which version it expects the counter to be at, and is refused
+// with 409 Conflict if another write got there first. The client then
+// reloads and decides again, rather than overwriting the other change.
+
+// counterSnapshotEvery is how many events there are between snapshots.
+const counterSnapshotEvery = 100
+
+// Event types.
+const (
+	counterIncremented = "incremented"
+	counterDecremented = "decremented"
+	counterReset       = "reset"
+)
+
+// CounterCommand is the JSON body accepted by POST /api/v1/eventcounter:
+// "increment" or "decrement" by Amount (1 if 0), or "reset" to zero.
+// ExpectedVersion, if set, is the version the counter must be at.
+type CounterCommand struct {
+	Action          string `json:"action"`
+	Amount          int64  `json:"amount,omitempty"`
+	ExpectedVersion *int64 `json:"expected_version,omitempty"`
+}
+
+// CounterEvent is something that happened to a tenant's event-sourced
+// counter. Versions count the events, from 1.
+type CounterEvent struct {
+	Version int64     `json:"version"`
+	Type    string    `json:"type"`
+	Amount  int64     `json:"amount,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// EventCounter is the state of the counter after its first Version events.
+type EventCounter struct {
+	Value   int64 `json:"value"`
+	Version int64 `json:"version"`
+}
+
+// CounterSnapshot is the state of the counter saved at a version.
+type CounterSnapshot struct {
+	EventCounter
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// EventCounterResponse is the JSON body returned by GET and POST
+// /api/v1/eventcounter. Replayed is how many events had to be applied on
+// top of the snapshot to get the state.
+type EventCounterResponse struct {
+	EventCounter
+	SnapshotVersion int64         `json:"snapshot_version"`
+	Replayed        int           `json:"replayed"`
+	Event           *CounterEvent `json:"event,omitempty"`
+}
+
+// CounterEventListResponse is the JSON body returned by GET
+// /api/v1/eventcounter/events.
+type CounterEventListResponse struct {
+	Events []CounterEvent `json:"events"`
+}
+
+// Reasons a command is refused.
+var (
+	errCounterVersion  = errors.New("the counter has changed since the expected version")
+	errCounterNegative = errors.New("the counter can't go below zero")
+)
+
+// decide turns a command into the event it causes, or refuses it.
+func (c EventCounter) decide(cmd CounterCommand, now time.Time) (CounterEvent, error) {
+	if cmd.ExpectedVersion != nil && *cmd.ExpectedVersion != c.Version {
+		return CounterEvent{}, errCounterVersion
+	}
+	amount := cmd.Amount
+	if amount == 0 {
+		amount = 1
+	}
+
+	event := CounterEvent{Version: c.Version + 1, Amount: amount, At: now}
+	switch cmd.Action {
+	case "increment":
+		event.Type = counterIncremented
+	case "decrement":
+		if amount > c.Value {
+			return CounterEvent{}, errCounterNegative
+		}
+		event.Type = counterDecremented
+	case "reset":
+		event.Type, event.Amount = counterReset, 0
+	}
+	return event, nil
+}
+
+// apply returns the state after event.
+func (c EventCounter) apply(event CounterEvent) EventCounter {
+	switch event.Type {
+	case counterIncremented:
+		c.Value += event.Amount
+	case counterDecremented:
+		c.Value -= event.Amount
+	case counterReset:
+		c.Value = 0
+	}
+	c.Version = event.Version
+	return c
+}
+
+// replayCounter rebuilds the state after the first version events (all of
+// them if version is 0), starting from snap if it's not past that. It
+// returns the state and how many events were applied.
+func replayCounter(snap *CounterSnapshot, events []CounterEvent, version int64) (EventCounter, int) {
+	var state EventCounter
+	if snap != nil && (version == 0 || snap.Version <= version) {
+		state = snap.EventCounter
+	}
+	replayed := 0
+	for _, event := range events {
+		if event.Version <= state.Version {
+			continue
+		}
+		if version > 0 && event.Version > version {
+			break
+		}
+		state = state.apply(event)
+		replayed++
+	}
+	return state, replayed
+}
+
+// counterVersion reads a version query parameter, 0 if it's missing.
+func counterVersion(r *http.Request, name string) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// handleGetEventCounter returns the counter, as of ?version= if given.
+func (s *Server) handleGetEventCounter(w http.ResponseWriter, r *http.Request) {
+	version, err := counterVersion(r, "version")
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, ok := s.store.EventCounterAt(tenantFromContext(r.Context()), version)
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "no such version")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleCounterCommand runs the command in the request body.
+func (s *Server) handleCounterCommand(w http.ResponseWriter, r *http.Request) {
+	var cmd CounterCommand
+	if !decodeValid(w, r, "counter-command", &cmd) {
+		return
+	}
+	if cmd.Action == "reset" && cmd.Amount != 0 {
+		writeValidationProblem(w, "counter-command", []FieldError{{Pointer: "/amount", Detail: "reset doesn't take an amount"}})
+		return
+	}
+
+	resp, err := s.store.AppendCounterEvent(tenantFromContext(r.Context()), cmd)
+	if err != nil {
+		writeProblem(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// handleListCounterEvents returns the events, after ?after= if given.
+func (s *Server) handleListCounterEvents(w http.ResponseWriter, r *http.Request) {
+	after, err := counterVersion(r, "after")
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, CounterEventListResponse{Events: s.store.CounterEvents(tenantFromContext(r.Context()), after)})
+}
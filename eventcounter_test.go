@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestCounterDecideAndReplay checks commands become events, refused ones
+// don't, and replaying the events gives the state back.
+func TestCounterDecideAndReplay(t *testing.T) {
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	var state EventCounter
+	var events []CounterEvent
+	for _, cmd := range []CounterCommand{
+		{Action: "increment", Amount: 5},
+		{Action: "decrement", Amount: 2},
+		{Action: "reset"},
+		{Action: "increment"},
+	} {
+		event, err := state.decide(cmd, now)
+		if err != nil {
+			t.Fatalf("%+v: %v", cmd, err)
+		}
+		events = append(events, event)
+		state = state.apply(event)
+	}
+	if state != (EventCounter{Value: 1, Version: 4}) {
+		t.Errorf("Expected 1 at version 4, got %+v", state)
+	}
+
+	if _, err := state.decide(CounterCommand{Action: "decrement", Amount: 2}, now); !errors.Is(err, errCounterNegative) {
+		t.Errorf("Expected going below zero to be refused, got %v", err)
+	}
+	stale := int64(3)
+	if _, err := state.decide(CounterCommand{Action: "increment", ExpectedVersion: &stale}, now); !errors.Is(err, errCounterVersion) {
+		t.Errorf("Expected a stale version to be refused, got %v", err)
+	}
+
+	if got, replayed := replayCounter(nil, events, 0); got != state || replayed != 4 {
+		t.Errorf("Expected a full replay to give %+v, got %+v after %d events", state, got, replayed)
+	}
+	if got, _ := replayCounter(nil, events, 2); got != (EventCounter{Value: 3, Version: 2}) {
+		t.Errorf("Expected 3 at version 2, got %+v", got)
+	}
+	snap := &CounterSnapshot{EventCounter: EventCounter{Value: 3, Version: 2}}
+	if got, replayed := replayCounter(snap, events, 0); got != state || replayed != 2 {
+		t.Errorf("Expected the snapshot to leave 2 events to replay, got %+v after %d", got, replayed)
+	}
+}
+
+// TestEventCounterAPI runs commands through the API and reads the counter,
+// its history and its past values back.
+func TestEventCounterAPI(t *testing.T) {
+	_, c := newTestServer(t)
+
+	resp := testsupport.Decode[EventCounterResponse](c.Post("/api/v1/eventcounter", map[string]any{"action": "increment", "amount": 5}).Status(http.StatusCreated))
+	if resp.EventCounter != (EventCounter{Value: 5, Version: 1}) || resp.Event == nil || resp.Event.Type != counterIncremented {
+		t.Errorf("Expected 5 at version 1 and the event, got %+v", resp)
+	}
+	resp = testsupport.Decode[EventCounterResponse](c.Post("/api/v1/eventcounter", map[string]any{"action": "decrement", "expected_version": 1}).Status(http.StatusCreated))
+	if resp.EventCounter != (EventCounter{Value: 4, Version: 2}) {
+		t.Errorf("Expected 4 at version 2, got %+v", resp)
+	}
+
+	c.Post("/api/v1/eventcounter", map[string]any{"action": "decrement", "expected_version": 1}).Status(http.StatusConflict)
+	c.Post("/api/v1/eventcounter", map[string]any{"action": "decrement", "amount": 10}).Status(http.StatusConflict)
+	c.Post("/api/v1/eventcounter", map[string]any{"action": "double"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/api/v1/eventcounter", map[string]any{"action": "reset", "amount": 3}).Status(http.StatusUnprocessableEntity)
+
+	c.Get("/api/v1/eventcounter").Status(http.StatusOK).JSON(`{"value": 4, "version": 2, "snapshot_version": 0, "replayed": 2}`)
+	c.Get("/api/v1/eventcounter?version=1").Status(http.StatusOK).JSON(`{"value": 5, "version": 1, "snapshot_version": 0, "replayed": 1}`)
+	c.Get("/api/v1/eventcounter?version=3").Status(http.StatusNotFound)
+	c.Get("/api/v1/eventcounter?version=x").Status(http.StatusBadRequest)
+
+	events := testsupport.Decode[CounterEventListResponse](c.Get("/api/v1/eventcounter/events?after=1").Status(http.StatusOK)).Events
+	if len(events) != 1 || events[0].Type != counterDecremented || events[0].Amount != 1 {
+		t.Errorf("Expected the decrement, got %+v", events)
+	}
+}
+
+// TestEventCounterSnapshotsAndReplay checks snapshots are taken every
+// counterSnapshotEvery events, and the counter is replayed from the events
+// when the store is reopened.
+func TestEventCounterSnapshotsAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range counterSnapshotEvery + 3 {
+		if _, err := store.AppendCounterEvent("acme", CounterCommand{Action: "increment"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := reopened.EventCounterAt("acme", 0)
+	if got.Value != counterSnapshotEvery+3 || got.SnapshotVersion != counterSnapshotEvery || got.Replayed != 3 {
+		t.Errorf("Expected %d from a snapshot and 3 events, got %+v", counterSnapshotEvery+3, got)
+	}
+	if past, ok := reopened.EventCounterAt("acme", 10); !ok || past.Value != 10 || past.Replayed != 10 {
+		t.Errorf("Expected 10 replayed from the start, got %+v", past)
+	}
+	if events := reopened.CounterEvents("acme", 0); len(events) != counterSnapshotEvery+3 {
+		t.Errorf("Expected every event kept, got %d", len(events))
+	}
+}
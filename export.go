@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This file streams a tenant's notes as CSV (for spreadsheets) or NDJSON
+// (newline-delimited JSON, one object per line, for scripts and data tools):
+//
+//	GET /api/v1/notes/export?format=csv
+//	GET /api/v1/notes/export?format=ndjson
+//
+// The response is written row by row and flushed as it goes, instead of
+// being built in memory first. Because no Content-Length is set, Go sends
+// it with "Transfer-Encoding: chunked", and the client starts receiving
+// data immediately, however long the export is.
+
+// exportFlushEvery is how many rows are written between flushes. Flushing
+// after every row would send many tiny network packets.
+const exportFlushEvery = 100
+
+// handleExportNotes streams the tenant's notes in the requested format.
+func (s *Server) handleExportNotes(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "ndjson":
+		contentType = "application/x-ndjson"
+	default:
+		writeProblem(w, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+
+	// ListNotes copies the notes out of the store, which is cheap (the
+	// strings themselves are shared). Streaming while holding the store's
+	// lock instead would block every writer for as long as the slowest
+	// client takes to download.
+	tenant := tenantFromContext(r.Context())
+	notes := s.store.ListNotes(tenant)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="notes-`+tenant+`.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	var writeRow func(Note) error
+	var flush func() error
+
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "title", "body", "created_at"})
+		writeRow = func(n Note) error {
+			return cw.Write([]string{n.ID, csvSafe(n.Title), csvSafe(n.Body), n.CreatedAt.Format(time.RFC3339)})
+		}
+		// The csv.Writer has its own buffer, which must be emptied into
+		// the response before the response itself is flushed.
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+	} else {
+		enc := json.NewEncoder(w) // Encode adds the newline after each object
+		writeRow = func(n Note) error { return enc.Encode(n) }
+		flush = rc.Flush
+	}
+
+	for i, note := range notes {
+		// Stop early if the client has gone away.
+		if r.Context().Err() != nil {
+			return
+		}
+		if err := writeRow(note); err != nil {
+			return
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return
+			}
+		}
+	}
+	flush()
+}
+
+// csvSafe defuses "CSV injection". Spreadsheet programs treat a cell that
+// starts with =, +, - or @ as a formula, so a note titled
+// =HYPERLINK("http://evil.example") would become a live link when the
+// export is opened. A leading apostrophe makes the cell plain text.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestExportNotesCSV checks the CSV export, including formula escaping.
+func TestExportNotesCSV(t *testing.T) {
+	srv := newServer(Config{})
+	srv.store.CreateNote(defaultTenant, "=HYPERLINK(\"http://evil.example\")", "body, with comma")
+
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/notes/export?format=csv", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Expected a CSV content type, got %q", ct)
+	}
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected valid CSV: %v", err)
+	}
+	if len(rows) != 2 || rows[0][0] != "id" {
+		t.Fatalf("Expected a header and one row, got %q", rows)
+	}
+	if rows[1][1] != `'=HYPERLINK("http://evil.example")` {
+		t.Errorf("Expected the formula to be escaped, got %q", rows[1][1])
+	}
+	if rows[1][2] != "body, with comma" {
+		t.Errorf("Expected the body intact, got %q", rows[1][2])
+	}
+}
+
+// TestExportNotesNDJSON exports enough notes to cross several flushes and
+// checks every line is a complete note.
+func TestExportNotesNDJSON(t *testing.T) {
+	srv := newServer(Config{Tenants: []string{"acme"}})
+	for i := 0; i < 250; i++ {
+		srv.store.CreateNote("acme", fmt.Sprintf("note %d", i), "")
+	}
+
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/notes/export?format=ndjson", nil)
+	req.Header.Set(tenantHeader, "acme")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Without a Content-Length, the response must have been streamed.
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected a chunked response, got length %d, encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var note Note
+		if err := json.Unmarshal(scanner.Bytes(), &note); err != nil || note.ID == "" {
+			t.Fatalf("Line %d is not a note: %q", lines+1, scanner.Text())
+		}
+		lines++
+	}
+	if lines != 250 {
+		t.Errorf("Expected 250 lines, got %d", lines)
+	}
+}
+
+// TestExportNotesBadFormat checks unknown formats are rejected.
+func TestExportNotesBadFormat(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServer(Config{}).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/notes/export?format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// This file is the extension API: a way to add endpoints and middleware to
+// a fork without editing server.go or main.go. Keeping your additions in
+// files of your own means pulling in upstream changes rarely conflicts with
+// them, and it's easy to see what your fork adds.
+//
+// Go keeps one package per directory, and everything here is package main,
+// so extensions can't live in a subdirectory. The convention instead is a
+// file per extension in the top directory, named ext_<name>.go (with an
+// ext_<name>_test.go beside it), that registers what it adds from an init
+// function. Init functions run before main, so everything is registered by
+// the time routes() builds the router:
+//
+//	// ext_hello.go
+//	package main
+//
+//	func init() {
+//		RegisterRoute("GET /api/v1/hello", (*Server).handleHello)
+//		RegisterMiddleware("poweredby", func(next http.HandlerFunc) http.HandlerFunc {
+//			return func(w http.ResponseWriter, r *http.Request) {
+//				w.Header().Set("X-Powered-By", "my fork")
+//				next(w, r)
+//			}
+//		})
+//		RegisterHealthCheck("redis", SeverityHard, pingRedis)
+//	}
+//
+//	func (s *Server) handleHello(w http.ResponseWriter, r *http.Request) {
+//		notes := s.store.ListNotes(tenantFromContext(r.Context()))
+//		writeJSON(w, http.StatusOK, map[string]int{"notes": len(notes)})
+//	}
+//
+// Handlers are given the Server, as a method expression like
+// (*Server).handleHello, so they can use its store, config and outbound
+// client like the built-in ones. They get the standard middleware stack,
+// are listed by GET /admin/routes, and can have faults injected.
+// Registered middleware runs innermost, after the built-in middleware, so
+// it sees the request ID and tenant, and its responses are measured and
+// logged. Health checks are covered in readiness.go, and job handlers in
+// jobs.go.
+
+// extraRoute is a route added with RegisterRoute.
+type extraRoute struct {
+	pattern string
+	handler func(s *Server, w http.ResponseWriter, r *http.Request)
+	extra   []middleware
+}
+
+// extraRoutes and extraMiddleware hold what's been registered, which
+// routes() and middleware() add to the server's own.
+var extraRoutes struct {
+	mu     sync.Mutex
+	routes []extraRoute
+}
+
+var extraMiddleware struct {
+	mu    sync.Mutex
+	chain []middleware
+}
+
+// RegisterRoute adds an endpoint. The pattern is a ServeMux pattern, such as
+// "GET /api/v1/hello/{name}". Like RegisterHealthCheck, it's meant to be
+// called from init functions and panics on a mistake (an empty or duplicate
+// pattern, a nil handler). A pattern that clashes with a built-in route
+// panics too, when the router is built. Middleware for this route alone can
+// follow the handler, as with Server.handle.
+func RegisterRoute(pattern string, handler func(s *Server, w http.ResponseWriter, r *http.Request), extra ...middleware) {
+	extraRoutes.mu.Lock()
+	defer extraRoutes.mu.Unlock()
+	switch {
+	case pattern == "":
+		panic("RegisterRoute: empty pattern")
+	case handler == nil:
+		panic(fmt.Sprintf("RegisterRoute: nil handler for %q", pattern))
+	}
+	for _, route := range extraRoutes.routes {
+		if route.pattern == pattern {
+			panic(fmt.Sprintf("RegisterRoute: %q registered twice", pattern))
+		}
+	}
+	extraRoutes.routes = append(extraRoutes.routes, extraRoute{pattern, handler, extra})
+}
+
+// RegisterMiddleware adds a middleware to every route's stack, after those
+// registered before it. The name is how GET /admin/routes lists it. It
+// panics on an empty or duplicate name or a nil wrap function.
+func RegisterMiddleware(name string, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	extraMiddleware.mu.Lock()
+	defer extraMiddleware.mu.Unlock()
+	switch {
+	case name == "":
+		panic("RegisterMiddleware: empty name")
+	case wrap == nil:
+		panic(fmt.Sprintf("RegisterMiddleware: nil middleware %q", name))
+	}
+	for _, m := range extraMiddleware.chain {
+		if m.name == name {
+			panic(fmt.Sprintf("RegisterMiddleware: %q registered twice", name))
+		}
+	}
+	extraMiddleware.chain = append(extraMiddleware.chain, middleware{name, wrap})
+}
+
+// registeredMiddleware returns the middleware added with RegisterMiddleware.
+func registeredMiddleware() []middleware {
+	extraMiddleware.mu.Lock()
+	defer extraMiddleware.mu.Unlock()
+	return extraMiddleware.chain
+}
+
+// handleExtensions registers the routes added with RegisterRoute.
+func (s *Server) handleExtensions(mux *http.ServeMux) {
+	extraRoutes.mu.Lock()
+	defer extraRoutes.mu.Unlock()
+	for _, route := range extraRoutes.routes {
+		s.handle(mux, route.pattern, func(w http.ResponseWriter, r *http.Request) {
+			route.handler(s, w, r)
+		}, route.extra...)
+		// The registry would name the closure; name the extension's handler.
+		s.registry[len(s.registry)-1].Handler = handlerName(route.handler)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// useExtensions clears the extension registries for one test.
+func useExtensions(t *testing.T) {
+	routes, chain := extraRoutes.routes, extraMiddleware.chain
+	t.Cleanup(func() { extraRoutes.routes, extraMiddleware.chain = routes, chain })
+	extraRoutes.routes, extraMiddleware.chain = nil, nil
+}
+
+func (s *Server) handleNoteCount(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]int{"notes": len(s.store.ListNotes(tenantFromContext(r.Context())))})
+}
+
+// TestRegisterRoute checks a registered route is served with the Server and
+// the standard middleware, and is listed with its handler's name.
+func TestRegisterRoute(t *testing.T) {
+	openAdmin(t)
+	useExtensions(t)
+	RegisterRoute("GET /api/v1/notes/count", (*Server).handleNoteCount, middleware{"nocache", func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-store")
+			next(w, r)
+		}
+	}})
+	RegisterMiddleware("poweredby", func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Powered-By", "extensions")
+			next(w, r)
+		}
+	})
+
+	s, c := newTestServer(t)
+	s.store.CreateNote(defaultTenant, "One", "")
+	c.Get("/api/v1/notes/count").
+		Status(http.StatusOK).
+		HasHeader("X-Powered-By", "extensions").
+		HasHeader("Cache-Control", "no-store").
+		JSON(`{"notes": 1}`)
+
+	routes := testsupport.Decode[RouteListResponse](c.Get("/admin/routes").Status(http.StatusOK)).Routes
+	i := slices.IndexFunc(routes, func(r Route) bool { return r.Path == "/api/v1/notes/count" })
+	if i < 0 {
+		t.Fatal("Expected the route listed")
+	}
+	if routes[i].Handler != "(*Server).handleNoteCount" {
+		t.Errorf("Expected the extension's handler named, got %q", routes[i].Handler)
+	}
+	if chain := routes[i].Middleware; !slices.Equal(chain[len(chain)-3:], []string{"poweredby", "timeout", "nocache"}) {
+		t.Errorf("Expected the registered and then the route's middleware innermost, got %v", chain)
+	}
+}
+
+// TestRegisterMistakes checks bad registrations panic.
+func TestRegisterMistakes(t *testing.T) {
+	useExtensions(t)
+	RegisterRoute("GET /api/v1/notes/count", (*Server).handleNoteCount)
+	RegisterMiddleware("poweredby", func(next http.HandlerFunc) http.HandlerFunc { return next })
+
+	for name, bad := range map[string]func(){
+		"empty pattern":     func() { RegisterRoute("", (*Server).handleNoteCount) },
+		"nil handler":       func() { RegisterRoute("GET /x", nil) },
+		"duplicate route":   func() { RegisterRoute("GET /api/v1/notes/count", (*Server).handleNoteCount) },
+		"empty name":        func() { RegisterMiddleware("", func(next http.HandlerFunc) http.HandlerFunc { return next }) },
+		"nil middleware":    func() { RegisterMiddleware("x", nil) },
+		"duplicate name":    func() { RegisterMiddleware("poweredby", func(next http.HandlerFunc) http.HandlerFunc { return next }) },
+		"clashes built-ins": func() { RegisterRoute("GET /readyz", (*Server).handleNoteCount); newTestServer(t) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected %s to panic", name)
+				}
+			}()
+			bad()
+		}()
+	}
+}
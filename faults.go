@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file implements fault injection: making chosen handlers fail on
+// purpose. The code that copes with failure, like the proxy's retries, the
+// quote fallback, the recover middleware and the 5xx
+// counts you'd alert on, only runs when something goes wrong, which in a
+// test or on a laptop is almost never. A fault makes it go wrong on demand:
+//   - "error" answers with an error status (500 unless another is given)
+//   - "timeout" hangs, until delay_ms has passed (then answers 504) or the
+//     client gives up
+//   - "panic" panics, as a bug would (the recover middleware answers 500)
+//
+// A fault applies to one route, named by its pattern as registered in
+// routes(), such as "GET /api/v1/quote". It fires for every request until
+// it's removed, or only for the next count of them.
+//
+// Faults are only available in test binaries and in DEV_MODE, where they're
+// managed with GET, POST and DELETE /admin/faults. A production server
+// doesn't even wrap its handlers, so there's nothing to switch on by
+// mistake and no cost.
+
+// Fault makes a route fail.
+type Fault struct {
+	Route   string `json:"route"`
+	Kind    string `json:"kind"`
+	Status  int    `json:"status,omitempty"`
+	DelayMs int    `json:"delay_ms,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// FaultListResponse is the JSON body returned by GET /admin/faults.
+type FaultListResponse struct {
+	Faults []Fault `json:"faults"`
+}
+
+// faultsEnabled reports whether handlers can have faults injected.
+func faultsEnabled(cfg Config) bool {
+	return testing.Testing() || cfg.DevMode
+}
+
+// faultInjector holds the faults in force, by route.
+type faultInjector struct {
+	mu     sync.Mutex
+	routes map[string]bool // the routes that can have faults
+	faults map[string]Fault
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{routes: make(map[string]bool), faults: make(map[string]Fault)}
+}
+
+// Set adds a fault, replacing any other for its route.
+func (f *faultInjector) Set(fault Fault) error {
+	if fault.Kind == "error" && fault.Status == 0 {
+		fault.Status = http.StatusInternalServerError
+	}
+	switch {
+	case fault.Kind != "error" && fault.Kind != "timeout" && fault.Kind != "panic":
+		return fmt.Errorf("kind must be error, timeout or panic, not %q", fault.Kind)
+	case fault.Kind == "error" && (fault.Status < 400 || fault.Status > 599):
+		return fmt.Errorf("status must be an error status, 400 to 599")
+	case fault.DelayMs < 0 || fault.Count < 0:
+		return fmt.Errorf("delay_ms and count can't be negative")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.routes[fault.Route] {
+		return fmt.Errorf("no route %q (see GET /admin/routes)", fault.Route)
+	}
+	f.faults[fault.Route] = fault
+	return nil
+}
+
+// Clear removes every fault.
+func (f *faultInjector) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.faults)
+}
+
+// List returns the faults in force, sorted by route.
+func (f *faultInjector) List() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	faults := []Fault{}
+	for _, route := range slices.Sorted(maps.Keys(f.faults)) {
+		faults = append(faults, f.faults[route])
+	}
+	return faults
+}
+
+// take returns the fault for route, if there is one, counting it as used.
+func (f *faultInjector) take(route string) (Fault, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fault, ok := f.faults[route]
+	if ok && fault.Count > 0 {
+		if fault.Count--; fault.Count == 0 {
+			delete(f.faults, route)
+		} else {
+			f.faults[route] = fault
+		}
+	}
+	return fault, ok
+}
+
+// injectFaults wraps the handler for route so that it fails while the
+// route has a fault.
+func (s *Server) injectFaults(route string, h http.HandlerFunc) http.HandlerFunc {
+	s.faults.mu.Lock()
+	s.faults.routes[route] = true
+	s.faults.mu.Unlock()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fault, ok := s.faults.take(route)
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		switch fault.Kind {
+		case "error":
+			writeProblem(w, fault.Status, "injected fault")
+		case "timeout":
+			var expired <-chan time.Time
+			if fault.DelayMs > 0 {
+				timer := s.clock.NewTimer(time.Duration(fault.DelayMs) * time.Millisecond)
+				defer timer.Stop()
+				expired = timer.C()
+			}
+			select {
+			case <-expired:
+				writeProblem(w, http.StatusGatewayTimeout, "injected timeout")
+			case <-r.Context().Done():
+			case <-s.stopping:
+			}
+		case "panic":
+			panic("injected panic in " + route)
+		}
+	}
+}
+
+// handleListFaults lists the faults in force.
+func (s *Server) handleListFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FaultListResponse{Faults: s.faults.List()})
+}
+
+// handleSetFault adds the fault in the request body.
+func (s *Server) handleSetFault(w http.ResponseWriter, r *http.Request) {
+	var fault Fault
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBody))
+	if err == nil {
+		err = json.Unmarshal(data, &fault)
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "request body must be a JSON fault")
+		return
+	}
+	if err := s.faults.Set(fault); err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, FaultListResponse{Faults: s.faults.List()})
+}
+
+// handleClearFaults removes every fault.
+func (s *Server) handleClearFaults(w http.ResponseWriter, r *http.Request) {
+	s.faults.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFaultError checks an error fault answers with its status for count
+// requests, and the errors are counted in the metrics alerts are based on.
+func TestFaultError(t *testing.T) {
+	s, c := newTestServer(t)
+	if err := s.faults.Set(Fault{Route: "GET /api/v1/counter", Kind: "error", Status: http.StatusServiceUnavailable, Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		c.Get("/api/v1/counter").Status(http.StatusServiceUnavailable)
+	}
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+
+	metrics := c.Get("/metrics").Body.String()
+	if !strings.Contains(metrics, `route="GET /api/v1/counter",status="503"} 2`) {
+		t.Errorf("Expected 2 errors in the metrics, got:\n%s", metrics)
+	}
+}
+
+// TestFaultTimeout checks a timeout fault hangs until its delay has passed
+// on the server's clock.
+func TestFaultTimeout(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+	s.faults.Set(Fault{Route: "GET /api/v1/quote", Kind: "timeout", DelayMs: 30_000})
+
+	done := make(chan int)
+	go func() { done <- c.Get("/api/v1/quote").Code }()
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	select {
+	case code := <-done:
+		t.Fatalf("Expected the request to hang, got %d", code)
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	if code := <-done; code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 after the delay, got %d", code)
+	}
+}
+
+// TestFaultPanic checks a panicking handler gets a 500 from the recover
+// middleware, and the next request is served.
+func TestFaultPanic(t *testing.T) {
+	s, c := newTestServer(t)
+	s.faults.Set(Fault{Route: "GET /api/v1/counter", Kind: "panic", Count: 1})
+
+	c.Get("/api/v1/counter").Status(http.StatusInternalServerError)
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+}
+
+// TestFaultRetried checks the proxy retries a request that an upstream
+// fails with 503.
+func TestFaultRetried(t *testing.T) {
+	backend, _ := newTestServer(t)
+	backend.faults.Set(Fault{Route: "GET /api/v1/counter", Kind: "error", Status: http.StatusServiceUnavailable, Count: 1})
+	ts := httptest.NewServer(backend.routes())
+	defer ts.Close()
+
+	gateway, h := newProxyServer(t, "/api/v1/counter="+ts.URL)
+	route, _ := gateway.proxy.Load().match("/api/v1/counter")
+	u, _ := url.Parse(ts.URL)
+	route.Upstream.endpoints = []*url.URL{u, u}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/counter", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the retry to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	if faults := backend.faults.List(); len(faults) != 0 {
+		t.Errorf("Expected the fault used up, got %+v", faults)
+	}
+}
+
+// TestFaultsAdmin sets, lists and clears faults through the API.
+func TestFaultsAdmin(t *testing.T) {
+	openAdmin(t)
+	_, c := newTestServer(t)
+
+	c.Post("/admin/faults", map[string]any{"route": "GET /nope", "kind": "error"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/admin/faults", map[string]any{"route": "GET /api/v1/quote", "kind": "explode"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/admin/faults", map[string]any{"route": "GET /api/v1/quote", "kind": "error", "status": 200}).Status(http.StatusUnprocessableEntity)
+	c.Post("/admin/faults", "not json").Status(http.StatusBadRequest)
+
+	c.Post("/admin/faults", map[string]any{"route": "GET /api/v1/quote", "kind": "error"}).
+		Status(http.StatusOK).
+		JSON(`{"faults": [{"route": "GET /api/v1/quote", "kind": "error", "status": 500}]}`)
+	c.Get("/api/v1/quote").Status(http.StatusInternalServerError)
+
+	c.Delete("/admin/faults").Status(http.StatusNoContent)
+	c.Get("/admin/faults").Status(http.StatusOK).JSON(`{"faults": []}`)
+	c.Get("/api/v1/quote").Status(http.StatusOK)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file encrypts the sensitive fields of the data file (DATA_FILE, see
+// store.go) with AES-256-GCM, so a copy of the file, or of the disk it's
+// on, doesn't give away personal data. Only users' email addresses are
+// sensitive so far: passwords are stored as hashes (see argon2.go), and
+// nothing else the store holds is tied to a person. sensitiveFields lists
+// them, so a new one is a line there.
+//
+// It's done in the store layer, as the file is written and read, so the
+// rest of the app never sees ciphertext: in memory, and in the API, an
+// email address is just a string. In the file it looks like
+//
+//	"email": "enc:v1:3f9a1c2e:Vx3R8k..."
+//
+// that is, the ID of the key it was encrypted with and, in base64, a random
+// 12-byte nonce followed by the ciphertext and GCM's tag. The field's place
+// in the store (tenant, record and field) is bound in as additional data,
+// so a value copied from one record to another fails to decrypt rather
+// than turning up where it doesn't belong.
+//
+// DATA_ENCRYPTION_KEYS lists the keys, each 32 random bytes in base64
+// ("openssl rand -base64 32" makes one). Like any secret setting it can
+// come from Vault (see vault.go). The first key encrypts; the others are
+// only for decrypting, which is how the key is changed:
+//
+//  1. Put the new key first, keeping the old one after it, and restart.
+//     Everything is re-encrypted with the new key at the next write.
+//  2. Run "server reencrypt", which does it at once, and reports how many
+//     values it re-encrypted.
+//  3. Remove the old key.
+//
+// Turning encryption on works the same way: values written before it are
+// read as plaintext and encrypted at the next write. Backups (see
+// backup.go) hold the data decrypted, so that they can be restored into a
+// server with other keys; keep them somewhere at least as safe.
+
+// encryptedFieldPrefix marks an encrypted value, and its format version.
+const encryptedFieldPrefix = "enc:v1:"
+
+// fieldKey is one of the DATA_ENCRYPTION_KEYS.
+type fieldKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// fieldCipher encrypts and decrypts sensitive fields. A nil *fieldCipher
+// leaves them as they are.
+type fieldCipher struct {
+	keys []fieldKey // the first encrypts
+}
+
+// parseFieldKey decodes one of the DATA_ENCRYPTION_KEYS.
+func parseFieldKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes in base64")
+	}
+	return key, nil
+}
+
+// newFieldCipher returns a cipher for keys, or nil if there are none.
+func newFieldCipher(keys []string) (*fieldCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	c := &fieldCipher{}
+	for i, s := range keys {
+		key, err := parseFieldKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("DATA_ENCRYPTION_KEYS: key %d %w", i+1, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// The ID is a hash of the key, so it says which key to use without
+		// saying anything about it.
+		sum := sha256.Sum256(key)
+		c.keys = append(c.keys, fieldKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return c, nil
+}
+
+// seal encrypts a value with the first key. place is where it's stored.
+// Empty values are left empty: there's nothing in them to hide.
+func (c *fieldCipher) seal(value, place string) (string, error) {
+	if c == nil || value == "" {
+		return value, nil
+	}
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(value), []byte(place))
+	return encryptedFieldPrefix + key.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value stored at place. It also reports whether the
+// value is stale: in plaintext or under a key other than the first, so
+// that the next seal will change it.
+func (c *fieldCipher) open(value, place string) (plaintext string, stale bool, err error) {
+	rest, ok := strings.CutPrefix(value, encryptedFieldPrefix)
+	if !ok {
+		return value, c != nil && value != "", nil
+	}
+	if c == nil {
+		return "", false, fmt.Errorf("%s is encrypted, but DATA_ENCRYPTION_KEYS isn't set", place)
+	}
+	id, encoded, _ := strings.Cut(rest, ":")
+	for i, key := range c.keys {
+		if key.id != id {
+			continue
+		}
+		data, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(data) < key.aead.NonceSize() {
+			return "", false, fmt.Errorf("%s is not a valid encrypted value", place)
+		}
+		n := key.aead.NonceSize()
+		decrypted, err := key.aead.Open(nil, data[:n], data[n:], []byte(place))
+		if err != nil {
+			return "", false, fmt.Errorf("%s could not be decrypted: it has been changed or moved", place)
+		}
+		return string(decrypted), i > 0, nil
+	}
+	return "", false, fmt.Errorf("%s is encrypted with key %s, which isn't in DATA_ENCRYPTION_KEYS", place, id)
+}
+
+// sensitiveField is a field to encrypt, and where it is.
+type sensitiveField struct {
+	value *string
+	place string
+}
+
+// sensitiveFields returns the fields of a tenant's snapshot to encrypt.
+func sensitiveFields(tenant string, ts *TenantSnapshot) []sensitiveField {
+	var fields []sensitiveField
+	for i := range ts.Users {
+		fields = append(fields, sensitiveField{&ts.Users[i].Email, tenant + "/users/" + ts.Users[i].ID + "/email"})
+	}
+	return fields
+}
+
+// sealSnapshot encrypts the sensitive fields of a snapshot in place. The
+// snapshot must be a copy, as snapshot makes, not share the store's data.
+func (c *fieldCipher) sealSnapshot(snap StoreSnapshot) error {
+	if c == nil {
+		return nil
+	}
+	for tenant, ts := range snap.Tenants {
+		for _, f := range sensitiveFields(tenant, &ts) {
+			sealed, err := c.seal(*f.value, f.place)
+			if err != nil {
+				return err
+			}
+			*f.value = sealed
+		}
+	}
+	return nil
+}
+
+// openSnapshot decrypts the sensitive fields of a snapshot in place, and
+// returns how many were stale.
+func (c *fieldCipher) openSnapshot(snap StoreSnapshot) (int, error) {
+	stale := 0
+	for tenant, ts := range snap.Tenants {
+		for _, f := range sensitiveFields(tenant, &ts) {
+			plaintext, old, err := c.open(*f.value, f.place)
+			if err != nil {
+				return 0, err
+			}
+			*f.value = plaintext
+			if old {
+				stale++
+			}
+		}
+	}
+	return stale, nil
+}
+
+// reencryptDataFile encrypts every sensitive field of a data file with the
+// first key, and returns how many needed it.
+func reencryptDataFile(path string, c *fieldCipher) (int, error) {
+	s, err := openEncryptedStore(path, c)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.staleFields == 0 {
+		return 0, nil
+	}
+	return s.staleFields, s.save()
+}
+
+// runReencryptCommand re-encrypts the data file, after the keys change.
+func runReencryptCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	fs := newFlagSet("reencrypt", stderr)
+	file := fs.String("file", cfg.DataFile, "data file to re-encrypt (default: $DATA_FILE)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	cfg, _, err = withVaultSecrets(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+
+	if *file == "" {
+		fmt.Fprintln(stdout, "Nothing to re-encrypt: DATA_FILE is not set, so the store lives in memory.")
+		return nil
+	}
+	c, err := newFieldCipher(cfg.DataEncryptionKeys)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		fmt.Fprintln(stderr, "reencrypt: DATA_ENCRYPTION_KEYS is not set")
+		return errUsage
+	}
+	n, err := reencryptDataFile(*file, c)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Re-encrypted %d values in %s with key %s.\n", n, *file, c.keys[0].id)
+	return nil
+}
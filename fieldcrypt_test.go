@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFieldKey returns a DATA_ENCRYPTION_KEYS key made of one repeated byte.
+func testFieldKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// mustFieldCipher returns a cipher for keys, failing the test if it can't.
+func mustFieldCipher(t *testing.T, keys ...string) *fieldCipher {
+	t.Helper()
+	c, err := newFieldCipher(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestEncryptedStore checks email addresses are encrypted in the data file
+// but not in memory, and come back when it's opened again.
+func TestEncryptedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	c := mustFieldCipher(t, testFieldKey(1))
+
+	store, err := openEncryptedStore(path, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.CreateUser("acme", User{ID: "u1", Username: "alice", Email: "alice@example.com"})
+	if err != nil || user.Email != "alice@example.com" {
+		t.Fatalf("Expected the address in memory, got %+v, %v", user, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("alice@example.com")) || !bytes.Contains(data, []byte(`"email": "`+encryptedFieldPrefix+c.keys[0].id+":")) {
+		t.Errorf("Expected the address to be encrypted in the file, got\n%s", data)
+	}
+
+	reopened, err := openEncryptedStore(path, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.GetUser("acme", "u1"); got.Email != "alice@example.com" {
+		t.Errorf("Expected the address to be decrypted, got %q", got.Email)
+	}
+
+	if _, err := openStore(path); err == nil || !strings.Contains(err.Error(), "DATA_ENCRYPTION_KEYS isn't set") {
+		t.Errorf("Expected opening without keys to fail, got %v", err)
+	}
+	if _, err := openEncryptedStore(path, mustFieldCipher(t, testFieldKey(2))); err == nil || !strings.Contains(err.Error(), "isn't in DATA_ENCRYPTION_KEYS") {
+		t.Errorf("Expected opening with another key to fail, got %v", err)
+	}
+}
+
+// TestReencryptDataFile changes the key, and turns encryption on for a
+// file written without it.
+func TestReencryptDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateUser("acme", User{ID: "u1", Username: "alice", Email: "alice@example.com"})
+	store.CreateUser("acme", User{ID: "u2", Username: "bob", Email: "bob@example.com"})
+
+	old := mustFieldCipher(t, testFieldKey(1))
+	if n, err := reencryptDataFile(path, old); n != 2 || err != nil {
+		t.Fatalf("Expected 2 values encrypted, got %d, %v", n, err)
+	}
+	if n, err := reencryptDataFile(path, old); n != 0 || err != nil {
+		t.Errorf("Expected nothing left to encrypt, got %d, %v", n, err)
+	}
+
+	rotated := mustFieldCipher(t, testFieldKey(2), testFieldKey(1))
+	if n, err := reencryptDataFile(path, rotated); n != 2 || err != nil {
+		t.Fatalf("Expected 2 values re-encrypted, got %d, %v", n, err)
+	}
+	reopened, err := openEncryptedStore(path, mustFieldCipher(t, testFieldKey(2)))
+	if err != nil {
+		t.Fatalf("Expected the old key not to be needed any more, got %v", err)
+	}
+	if got, _ := reopened.GetUser("acme", "u2"); got.Email != "bob@example.com" {
+		t.Errorf("Expected bob's address, got %q", got.Email)
+	}
+}
+
+// TestFieldCipherBindsPlace checks a value moved to another record doesn't
+// decrypt.
+func TestFieldCipherBindsPlace(t *testing.T) {
+	c := mustFieldCipher(t, testFieldKey(1))
+	sealed, err := c.seal("alice@example.com", "acme/users/u1/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, stale, err := c.open(sealed, "acme/users/u1/email"); got != "alice@example.com" || stale || err != nil {
+		t.Errorf("Expected the value back, got %q, %v, %v", got, stale, err)
+	}
+	if _, _, err := c.open(sealed, "acme/users/u2/email"); err == nil {
+		t.Error("Expected a moved value not to decrypt")
+	}
+}
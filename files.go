@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// This file implements file uploads. Uploads are where web servers most
+// often get into trouble, so the handler demonstrates the defensive habits:
+//
+//   - Size limits. Without one, a single request can fill the disk.
+//   - Streaming. The file is copied to disk in small chunks as it arrives,
+//     so a 1 GB upload never needs 1 GB of memory.
+//   - Content sniffing. The client's declared Content-Type is just a claim;
+//     we look at the file's first bytes to decide what it really is, and
+//     only accept types on the allowlist.
+//
+// The file contents live in the blob store (blobstore.go), keyed by tenant
+// and file ID. Their metadata (name, type, size, checksum) lives in the
+// store with the notes.
+
+// FileInfo is the metadata of an uploaded file.
+type FileInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FileListResponse wraps the list of files in an object, like
+// NoteListResponse.
+type FileListResponse struct {
+	Files []FileInfo `json:"files"`
+}
+
+// multipartOverhead is the room allowed on top of UPLOAD_MAX_BYTES for the
+// multipart boundaries and headers that surround the file in the body.
+const multipartOverhead = 1 << 20 // 1 MiB
+
+// sniffLen is how many bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// Errors returned by saveUpload, mapped to status codes by the handler.
+var (
+	errFileTooLarge = errors.New("file is too large")
+	errFileType     = errors.New("file type is not allowed")
+
+	// errStoringUpload means the blob store failed, which isn't the
+	// client's fault.
+	errStoringUpload = errors.New("storing upload")
+)
+
+// handleUploadFile accepts a multipart/form-data upload with the file in a
+// field named "file", as sent by <input type="file" name="file"> or
+// curl -F file=@photo.png.
+func (s *Server) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.UploadMaxBytes+multipartOverhead)
+
+	// r.MultipartReader reads the body part by part as it arrives. The
+	// better-known r.ParseMultipartForm reads the whole body before
+	// returning, which is exactly the buffering we want to avoid.
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "request must be multipart/form-data")
+		return
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeProblem(w, http.StatusBadRequest, `form has no "file" field`)
+			return
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		info, err := s.saveUpload(r.Context(), tenantFromContext(r.Context()), uploadName(part.FileName()), part, cfg)
+		part.Close()
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/files/"+info.ID)
+		writeJSON(w, http.StatusCreated, info)
+		return
+	}
+}
+
+// writeUploadError turns an upload failure into the right problem response.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge), errors.As(err, &maxBytes):
+		writeProblem(w, http.StatusRequestEntityTooLarge, errFileTooLarge.Error())
+	case errors.Is(err, errFileType):
+		writeProblem(w, http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, errStoringUpload):
+		log.Printf("upload failed: %v", err)
+		writeProblem(w, http.StatusBadGateway, "could not store the file, try again later")
+	default:
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("reading upload: %v", err))
+	}
+}
+
+// saveUpload streams one uploaded file to disk and records its metadata.
+func (s *Server) saveUpload(ctx context.Context, tenant, name string, src io.Reader, cfg Config) (FileInfo, error) {
+	// Read just enough of the file to identify it.
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return FileInfo{}, err
+	}
+	head = head[:n]
+
+	// DetectContentType may add parameters ("text/plain; charset=utf-8");
+	// the allowlist is about the media type itself.
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !slices.Contains(cfg.UploadAllowedTypes, contentType) {
+		return FileInfo{}, fmt.Errorf("%w: %s", errFileType, contentType)
+	}
+
+	// Spool the upload to a temporary file first. Until the whole file has
+	// arrived we don't know its size or whether it's within the limit, and
+	// an object store wants the size before the first byte is sent.
+	tmp, err := os.CreateTemp("", "upload-*.tmp")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// The checksum is computed while copying, so the file is read once.
+	hash := sha256.New()
+	dst := io.MultiWriter(tmp, hash)
+
+	// Reading one byte more than the limit tells us whether the file is
+	// over it, without trusting any size the client declared.
+	rest := io.LimitReader(src, cfg.UploadMaxBytes-int64(n)+1)
+	copied, err := io.Copy(dst, io.MultiReader(bytes.NewReader(head), rest))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if copied > cfg.UploadMaxBytes {
+		return FileInfo{}, errFileTooLarge
+	}
+
+	info := FileInfo{
+		ID:          newID(),
+		Name:        name,
+		ContentType: contentType,
+		Size:        copied,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt:   s.clock.Now().UTC(),
+	}
+
+	// Hand the complete file to the blob store (see blobstore.go).
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return FileInfo{}, err
+	}
+	if err := s.blobs.Put(ctx, blobKey(tenant, info.ID), tmp, info.Size, info.ContentType); err != nil {
+		return FileInfo{}, fmt.Errorf("%w: %v", errStoringUpload, err)
+	}
+
+	s.store.AddFile(tenant, info)
+	return info, nil
+}
+
+// uploadName cleans the client's name for an uploaded file. Only the base
+// name is kept: a name like "../../etc/passwd" must never become a path.
+func uploadName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		return "upload"
+	}
+	return name
+}
+
+// handleListFiles returns the metadata of the tenant's files.
+func (s *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	files := s.store.ListFiles(tenantFromContext(r.Context()))
+	setPagination(w, Pagination{Total: len(files)})
+	writeJSON(w, http.StatusOK, FileListResponse{Files: files})
+}
+
+// handleGetFile returns one file's metadata.
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.store.GetFile(tenantFromContext(r.Context()), r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "file not found")
+		return
+	}
+	w.Header().Set("ETag", etagOf(info))
+	writeJSON(w, http.StatusOK, info)
+}
+
+// blobKey is where a tenant's file is kept in the blob store.
+func blobKey(tenant, id string) string {
+	return tenant + "/" + id
+}
+
+// handleDownloadFile sends a file's contents. When the blob store can hand
+// out signed URLs (S3), the client is redirected to download straight from
+// storage, which takes the traffic off this server.
+func (s *Server) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	info, ok := s.store.GetFile(tenant, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "file not found")
+		return
+	}
+	key := blobKey(tenant, info.ID)
+
+	if url, err := s.blobs.SignedURL(key, info.Name, s.config().SignedURLExpiry); err == nil {
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	blob, err := s.blobs.Open(r.Context(), key)
+	if errors.Is(err, errBlobNotFound) {
+		writeProblem(w, http.StatusNotFound, "file contents not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "opening blob failed", "key", key, "error", err)
+		writeProblem(w, http.StatusBadGateway, "could not read the file, try again later")
+		return
+	}
+	defer blob.Close()
+
+	// Uploaded files come from users, so never let a browser treat them as
+	// part of our site: "nosniff" stops it guessing a different type, and
+	// "attachment" makes it download instead of render.
+	w.Header().Set("Content-Type", info.ContentType)
+	// The content's SHA-256 is a ready-made strong ETag. ServeContent uses
+	// it to answer If-None-Match and If-Match for us.
+	w.Header().Set("ETag", `"`+info.SHA256+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+
+	// ServeContent handles Range requests and If-Modified-Since, but needs
+	// to seek. Local files can; a network stream is copied as it comes.
+	if rs, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.Name, info.CreatedAt, rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	io.Copy(w, blob)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pngHeader is the signature every PNG file starts with, enough for content
+// sniffing to recognize one.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+// newUploadServer creates a server that stores uploads in a temporary
+// directory and accepts PNG images up to 1 KiB.
+func newUploadServer(t testing.TB) *Server {
+	t.Helper()
+	return newServer(Config{
+		UploadDir:          t.TempDir(),
+		UploadMaxBytes:     1024,
+		UploadAllowedTypes: []string{"image/png"},
+	})
+}
+
+// uploadRequest builds a multipart/form-data request like the one a browser
+// sends for <input type="file" name="file">.
+func uploadRequest(t testing.TB, field, name string, data []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("description", "fields before the file are skipped")
+	fw, err := mw.CreateFormFile(field, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// TestUploadAndDownloadFile uploads an image and reads it back.
+func TestUploadAndDownloadFile(t *testing.T) {
+	srv := newUploadServer(t)
+	mux := srv.routes()
+	data := append(pngHeader, "rest of the image"...)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, uploadRequest(t, "file", "../../cat.png", data))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var info FileInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if info.Name != "cat.png" || info.ContentType != "image/png" || info.Size != int64(len(data)) || info.SHA256 == "" {
+		t.Errorf("Unexpected metadata: %+v", info)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/api/v1/files/"+info.ID {
+		t.Errorf("Expected Location for the new file, got %q", loc)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+info.ID+"/content", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Error("Expected the downloaded file to match the upload")
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected nosniff, got %q", got)
+	}
+}
+
+// TestUploadFileRejections checks each way an upload can be refused. None of
+// them may leave a file behind.
+func TestUploadFileRejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    func(t *testing.T) *http.Request
+		status int
+	}{
+		{"not multipart", func(t *testing.T) *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/api/v1/files", strings.NewReader(`{}`))
+		}, http.StatusBadRequest},
+		{"no file field", func(t *testing.T) *http.Request {
+			return uploadRequest(t, "attachment", "cat.png", pngHeader)
+		}, http.StatusBadRequest},
+		{"type not allowed", func(t *testing.T) *http.Request {
+			return uploadRequest(t, "file", "notes.txt", []byte("just some text"))
+		}, http.StatusUnsupportedMediaType},
+		{"too large", func(t *testing.T) *http.Request {
+			return uploadRequest(t, "file", "big.png", append(pngHeader, make([]byte, 2048)...))
+		}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newUploadServer(t)
+
+			rec := httptest.NewRecorder()
+			srv.routes().ServeHTTP(rec, tt.req(t))
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+
+			if files := srv.store.ListFiles(defaultTenant); len(files) != 0 {
+				t.Errorf("Expected no files recorded, got %+v", files)
+			}
+			entries, _ := os.ReadDir(filepath.Join(srv.config().UploadDir, defaultTenant))
+			if len(entries) != 0 {
+				t.Errorf("Expected no files on disk, found %d", len(entries))
+			}
+		})
+	}
+}
+
+// TestUploadIsStreamed checks that saveUpload reads its input in chunks as
+// it copies, rather than buffering the whole file first.
+func TestUploadIsStreamed(t *testing.T) {
+	srv := newUploadServer(t)
+	cfg := srv.config()
+	cfg.UploadMaxBytes = 1 << 20
+
+	src := &countingReader{r: io.MultiReader(bytes.NewReader(pngHeader), bytes.NewReader(make([]byte, 200<<10)))}
+	if _, err := srv.saveUpload(context.Background(), defaultTenant, "big.png", src, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if src.largest > 64<<10 {
+		t.Errorf("Expected reads of at most 64 KiB, got one of %d bytes", src.largest)
+	}
+}
+
+// countingReader records the largest single read made from it.
+type countingReader struct {
+	r       io.Reader
+	largest int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > c.largest {
+		c.largest = n
+	}
+	return n, err
+}
+
+// FuzzUploadFile sends arbitrary multipart bodies, with the boundary
+// "fuzz".
+//
+//	go test -fuzz FuzzUploadFile -fuzztime 30s
+func FuzzUploadFile(f *testing.F) {
+	seed := uploadRequest(f, "file", "../../x.png", pngHeader)
+	_, params, _ := mime.ParseMediaType(seed.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(seed.Body)
+	f.Add(strings.ReplaceAll(string(body), params["boundary"], "fuzz"))
+	f.Add("--fuzz\r\nContent-Disposition: form-data; name=\"file\"\r\n\r\n\x00\r\n--fuzz--")
+	f.Add("--fuzz--")
+
+	h := newUploadServer(f).routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, body string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", strings.NewReader(body))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=fuzz")
+		serveFuzz(t, h, req)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// This file lets an operator switch feature flags on and off while the
+// server runs, from the admin UI or with
+//
+//	curl -X PUT http://localhost:8000/admin/flags/new-editor
+//	curl -X DELETE http://localhost:8000/admin/flags/new-editor
+//
+// A flag is switched by changing FeatureFlags in the running configuration,
+// so everything that reads s.config().FeatureFlags sees it at once, just as
+// after a reload. Like a reload, it applies to this instance only. And it
+// doesn't touch the environment: the next reload reads FEATURE_FLAGS again,
+// and a flag switched here is back to how it was set there, with the change
+// listed in the reload's diff. Put a flag that should stay in FEATURE_FLAGS.
+
+// flagNamePattern is what a feature flag can be called: the names are
+// comma-separated in FEATURE_FLAGS, so they mustn't have commas or spaces.
+var flagNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// FlagEvent is the data of a "flag" event.
+type FlagEvent struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleEnableFlag switches on the flag named in the path.
+func (s *Server) handleEnableFlag(w http.ResponseWriter, r *http.Request) {
+	s.switchFlag(w, r, true)
+}
+
+// handleDisableFlag switches off the flag named in the path.
+func (s *Server) handleDisableFlag(w http.ResponseWriter, r *http.Request) {
+	s.switchFlag(w, r, false)
+}
+
+// switchFlag sets whether the flag named in the path is enabled and
+// returns the enabled flags, like GET /api/v1/features.
+func (s *Server) switchFlag(w http.ResponseWriter, r *http.Request, enabled bool) {
+	name := r.PathValue("name")
+	if !flagNamePattern.MatchString(name) {
+		writeProblem(w, http.StatusBadRequest, "a flag name is lowercase letters, digits, '_', '.' and '-', at most 64 characters")
+		return
+	}
+
+	s.cfgMu.Lock()
+	flags := s.cfg.FeatureFlags
+	changed := slices.Contains(flags, name) != enabled
+	if changed {
+		// Copied rather than changed in place: earlier copies of the
+		// configuration share the slice.
+		if enabled {
+			flags = append(slices.Clone(flags), name)
+		} else {
+			flags = slices.DeleteFunc(slices.Clone(flags), func(f string) bool { return f == name })
+		}
+		s.cfg.FeatureFlags = flags
+		s.cfg.setSource("feature_flags", sourceAdmin)
+	}
+	s.cfgMu.Unlock()
+
+	if changed {
+		state := "off"
+		if enabled {
+			state = "on"
+		}
+		s.adminEvent(adminEventFlag, "feature flag "+name+" switched "+state, FlagEvent{Name: name, Enabled: enabled})
+	}
+	if flags == nil {
+		flags = []string{}
+	}
+	writeJSON(w, http.StatusOK, FeatureListResponse{Features: flags})
+}
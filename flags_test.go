@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestSwitchFlags switches flags on and off, and checks the running
+// configuration sees it and an earlier copy doesn't.
+func TestSwitchFlags(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.FeatureFlags = []string{"beta"}
+	s.cfgMu.Unlock()
+	before := s.config()
+
+	c.Put("/admin/flags/new-editor", nil).Status(http.StatusOK).JSON(`{"features": ["beta", "new-editor"]}`)
+	c.Put("/admin/flags/new-editor", nil).JSON(`{"features": ["beta", "new-editor"]}`)
+	c.Get("/api/v1/features").JSON(`{"features": ["beta", "new-editor"]}`)
+	c.Delete("/admin/flags/beta").Status(http.StatusOK).JSON(`{"features": ["new-editor"]}`)
+	c.Delete("/admin/flags/beta").JSON(`{"features": ["new-editor"]}`)
+	if source := s.config().sources["feature_flags"]; source != sourceAdmin {
+		t.Errorf("Expected the flags to come from the admin API, got %q", source)
+	}
+	if len(before.FeatureFlags) != 1 || before.FeatureFlags[0] != "beta" {
+		t.Errorf("Expected the earlier configuration unchanged, got %v", before.FeatureFlags)
+	}
+
+	c.Put("/admin/flags/Not%20OK", nil).Status(http.StatusBadRequest)
+	c.Put("/admin/flags/a,b", nil).Status(http.StatusBadRequest)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file lets some JSON endpoints take HTML form posts too, so a plain
+// <form method="post" action="/api/v1/notes"> works against the API with
+// no JavaScript:
+//
+//	curl -d title=Shopping -d body=Milk http://localhost:8000/api/v1/notes
+//	curl -F title=Shopping -F body=Milk http://localhost:8000/api/v1/notes
+//
+// decodeValidForm looks at the Content-Type: application/x-www-form-urlencoded
+// (what forms send by default, and curl -d) and multipart/form-data (forms
+// with enctype="multipart/form-data", and curl -F) are read as forms, and
+// anything else as JSON, as decodeValid does.
+//
+// A form is turned into the JSON document it stands for and then checked
+// against the same schema, so the rules and error messages are the same
+// whichever way a request comes. Form values are all text, so the schema
+// says what each field really is: "42" becomes a number for an integer
+// field, "true" or "on" (a ticked checkbox) true for a boolean, and a field
+// given several times an array. Field errors point at the form field, like
+// "/title".
+//
+// The endpoints that take forms are the ones that create things: notes and
+// guestbook entries. Browsers let any web page post a form to any site,
+// with no CORS preflight, which is why they're not accepted everywhere.
+
+// The form content types.
+const (
+	formURLEncoded = "application/x-www-form-urlencoded"
+	formMultipart  = "multipart/form-data"
+)
+
+// errFormFile is the field error for a file sent where a value is expected.
+var errFormFile = errors.New("must be a value, not a file")
+
+// isFormRequest reports whether r's body is a form.
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == formURLEncoded || mediaType == formMultipart
+}
+
+// decodeValidForm is decodeValid for endpoints that take forms as well as
+// JSON.
+func decodeValidForm(w http.ResponseWriter, r *http.Request, schema string, dst any) bool {
+	if !isFormRequest(r) {
+		return decodeValid(w, r, schema, dst)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxValidatedBody)
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == formMultipart {
+		// The body is limited, so it all fits in memory and nothing is
+		// written to temporary files.
+		err = r.ParseMultipartForm(maxValidatedBody)
+	} else {
+		err = r.ParseForm()
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeProblem(w, http.StatusRequestEntityTooLarge, "request body must be at most "+strconv.Itoa(maxValidatedBody)+" bytes")
+		return false
+	case err != nil:
+		writeProblem(w, http.StatusBadRequest, "request body must be a valid form")
+		return false
+	}
+
+	var files []string
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+		for name := range r.MultipartForm.File {
+			files = append(files, name)
+		}
+	}
+	doc, errs := formDocument(r.PostForm, requestSchemas[schema])
+	for _, name := range files {
+		errs = append(errs, FieldError{Pointer: "/" + name, Detail: errFormFile.Error()})
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Pointer < errs[j].Pointer })
+		writeValidationProblem(w, schema, errs)
+		return false
+	}
+	return decodeValidDocument(w, schema, doc, dst)
+}
+
+// formDocument turns form values into the JSON document the schema
+// describes. Fields the schema doesn't know are kept as text, for the
+// schema to reject.
+func formDocument(values url.Values, schema *Schema) (map[string]any, []FieldError) {
+	doc := make(map[string]any, len(values))
+	var errs []FieldError
+	for name, vs := range values {
+		prop := schema.Properties[name]
+		if prop != nil && prop.Type == "array" {
+			items := make([]any, len(vs))
+			for i, v := range vs {
+				item, err := formValue(v, prop.Items)
+				if err != nil {
+					errs = append(errs, FieldError{Pointer: "/" + name + "/" + strconv.Itoa(i), Detail: err.Error()})
+				}
+				items[i] = item
+			}
+			doc[name] = items
+			continue
+		}
+		if len(vs) > 1 {
+			errs = append(errs, FieldError{Pointer: "/" + name, Detail: "must be given once"})
+			continue
+		}
+		v, err := formValue(vs[0], prop)
+		if err != nil {
+			errs = append(errs, FieldError{Pointer: "/" + name, Detail: err.Error()})
+		}
+		doc[name] = v
+	}
+	return doc, errs
+}
+
+// formValue converts a form value to the type its schema gives it.
+func formValue(v string, schema *Schema) (any, error) {
+	if schema == nil {
+		return v, nil
+	}
+	switch schema.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return n, nil
+	case "boolean":
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "on", "1":
+			return true, nil
+		case "false", "off", "0", "":
+			return false, nil
+		}
+		return nil, errors.New("must be true or false")
+	}
+	return v, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestFormDocument checks form values take the types the schema gives them.
+func TestFormDocument(t *testing.T) {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{
+		"title":   {Type: "string"},
+		"count":   {Type: "integer"},
+		"enabled": {Type: "boolean"},
+		"tags":    {Type: "array", Items: &Schema{Type: "string"}},
+	}}
+
+	doc, errs := formDocument(url.Values{"title": {"42"}, "count": {"42"}, "enabled": {"on"}, "tags": {"a", "b"}, "extra": {"x"}}, schema)
+	want := map[string]any{"title": "42", "count": 42.0, "enabled": true, "tags": []any{"a", "b"}, "extra": "x"}
+	if len(errs) > 0 || !reflect.DeepEqual(doc, want) {
+		t.Errorf("Expected %v, got %v and %v", want, doc, errs)
+	}
+
+	_, errs = formDocument(url.Values{"title": {"a", "b"}, "count": {"many"}, "enabled": {"maybe"}}, schema)
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 field errors, got %+v", errs)
+	}
+}
+
+// TestCreateNoteFromForm creates notes from both kinds of form, and checks
+// form field errors are reported like JSON ones.
+func TestCreateNoteFromForm(t *testing.T) {
+	_, c := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader("title=Shopping&body=Milk+%26+eggs"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	note := testsupport.Decode[Note](c.DoRequest(req).Status(http.StatusCreated))
+	if note.Title != "Shopping" || note.Body != "Milk & eggs" {
+		t.Errorf("Unexpected note %+v", note)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Multipart")
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/notes", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	c.DoRequest(req).Status(http.StatusCreated).JSON(`{"title": "Multipart", "...": "..."}`)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader("title=+&colour=red"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.DoRequest(req).Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/colour", "...": "..."}, {"pointer": "/title", "...": "..."}], "...": "..."}`)
+
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.WriteField("title", "With a file")
+	fw, _ := mw.CreateFormFile("body", "body.txt")
+	fw.Write([]byte("text"))
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/notes", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	c.DoRequest(req).Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/body", "detail": "must be a value, not a file"}], "...": "..."}`)
+}
+
+// TestSignGuestbookFromForm signs the guestbook through the API with a form.
+func TestSignGuestbookFromForm(t *testing.T) {
+	_, c := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/guestbook", strings.NewReader("name=Ada&message=Hello"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.DoRequest(req).Status(http.StatusCreated).JSON(`{"name": "Ada", "message": "Hello", "...": "..."}`)
+}
+
+// FuzzAPIForms posts arbitrary urlencoded and multipart bodies to the API
+// endpoints that take forms. The answer must be JSON either way: a form
+// post to the API isn't a page.
+//
+//	go test -fuzz FuzzAPIForms -fuzztime 30s
+func FuzzAPIForms(f *testing.F) {
+	const boundary = "fuzzboundary"
+	multipartBody := func(fields ...string) []byte {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.SetBoundary(boundary)
+		for i := 0; i+1 < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		part, _ := mw.CreateFormFile("attachment", "a.txt")
+		part.Write([]byte("file"))
+		mw.Close()
+		return buf.Bytes()
+	}
+	targets := []string{"/api/v1/notes", "/api/v1/guestbook"}
+	f.Add(uint8(0), false, []byte("title=Shopping&body=Milk"))
+	f.Add(uint8(1), false, []byte("name=Ann&message=Hi&name=Bob"))
+	f.Add(uint8(0), false, []byte("title=%zz&body=%00;;&&=="))
+	f.Add(uint8(0), true, multipartBody("title", "Shopping", "body", "Milk"))
+	f.Add(uint8(1), true, multipartBody("name", "\xff\xfe", "message", strings.Repeat("a", 600)))
+	f.Add(uint8(1), true, []byte("--"+boundary+"\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nAnn"))
+
+	h := newServer(Config{}).routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, target uint8, multipartForm bool, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, targets[int(target)%len(targets)], bytes.NewReader(body))
+		if multipartForm {
+			req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		} else {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := serveFuzz(t, h, req)
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("Expected a JSON response, got %d %q", rec.Code, rec.Body.String())
+		}
+	})
+}
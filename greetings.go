@@ -0,0 +1,101 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// This file says hello in dozens of languages:
+//   - GET /api/v1/hello/{lang} greets in a language, by its ISO 639 code
+//     such as fr or ja. A regional tag such as pt-BR falls back to its
+//     language, pt.
+//   - GET /api/v1/hello/random greets in a language picked at random.
+//   - GET /api/v1/greetings lists them all.
+//
+// Like the time zone API (see timezone.go) it's stateless and the instance
+// field shows which replica answered, so it's a friendly thing to point a
+// load test or a load balancer demo at. Plain GET /api/v1/hello is left
+// for the "Add an endpoint" exercise (see learn.go).
+//
+// The greetings are compiled in from greetings/greetings.json; adding a
+// language is a line there.
+
+//go:embed greetings/greetings.json
+var greetingsJSON []byte
+
+// Greeting is hello in one language.
+type Greeting struct {
+	// Lang is the language's ISO 639 code, Language its English name and
+	// Native its own.
+	Lang     string `json:"lang" proto:"1"`
+	Language string `json:"language" proto:"2"`
+	Native   string `json:"native" proto:"3"`
+	Hello    string `json:"hello" proto:"4"`
+}
+
+// HelloResponse is the JSON body returned by GET /api/v1/hello/{lang}.
+type HelloResponse struct {
+	Greeting
+	Instance string `json:"instance" proto:"5"`
+}
+
+// GreetingListResponse is the JSON body returned by GET /api/v1/greetings.
+type GreetingListResponse struct {
+	Greetings []Greeting `json:"greetings" proto:"1"`
+}
+
+// greetings parses the embedded catalog once. It's part of the binary, so
+// a parse error is a bug and panics.
+var greetings = sync.OnceValue(func() []Greeting {
+	var list []Greeting
+	if err := json.Unmarshal(greetingsJSON, &list); err != nil || len(list) == 0 {
+		panic(fmt.Sprintf("greetings/greetings.json: %d greetings, %v", len(list), err))
+	}
+	return list
+})
+
+// findGreeting looks up a language by its code, ignoring case, or by the
+// language of a regional tag.
+func findGreeting(lang string) (Greeting, bool) {
+	lang = strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+	for {
+		for _, g := range greetings() {
+			if g.Lang == lang {
+				return g, true
+			}
+		}
+		i := strings.LastIndexByte(lang, '-')
+		if i < 0 {
+			return Greeting{}, false
+		}
+		lang = lang[:i]
+	}
+}
+
+// handleHello greets in the language named in the path.
+func handleHello(w http.ResponseWriter, r *http.Request) {
+	g, ok := findGreeting(r.PathValue("lang"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "unknown language: use an ISO 639 code such as fr (see /api/v1/greetings)")
+		return
+	}
+	writeJSON(w, http.StatusOK, HelloResponse{Greeting: g, Instance: instanceName()})
+}
+
+// handleRandomHello greets in a random language.
+func handleRandomHello(w http.ResponseWriter, r *http.Request) {
+	list := greetings()
+	writeJSON(w, http.StatusOK, HelloResponse{Greeting: list[rand.IntN(len(list))], Instance: instanceName()})
+}
+
+// handleListGreetings lists the languages.
+func handleListGreetings(w http.ResponseWriter, r *http.Request) {
+	list := greetings()
+	setPagination(w, Pagination{Total: len(list)})
+	writeJSON(w, http.StatusOK, GreetingListResponse{Greetings: list})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestGreetingsCatalog checks the catalog is complete and has no duplicate
+// languages.
+func TestGreetingsCatalog(t *testing.T) {
+	list := greetings()
+	if len(list) < 50 {
+		t.Fatalf("Expected dozens of languages, got %d", len(list))
+	}
+	seen := make(map[string]bool)
+	for _, g := range list {
+		if g.Lang == "" || g.Language == "" || g.Native == "" || g.Hello == "" {
+			t.Errorf("Incomplete greeting %+v", g)
+		}
+		if seen[g.Lang] {
+			t.Errorf("Duplicate language %q", g.Lang)
+		}
+		seen[g.Lang] = true
+	}
+	if seen["random"] {
+		t.Error(`"random" can't be a language: it's the route for a random one`)
+	}
+}
+
+// TestHello checks lookups by code, case and regional tag, the random
+// route, unknown languages and the listing.
+func TestHello(t *testing.T) {
+	_, c := newTestServer(t)
+
+	for _, lang := range []string{"fr", "FR", "fr-CA", "fr_CA"} {
+		resp := testsupport.Decode[HelloResponse](c.Get("/api/v1/hello/" + lang).Status(http.StatusOK))
+		if resp.Hello != "Bonjour" || resp.Lang != "fr" || resp.Instance == "" {
+			t.Errorf("%s: expected French, got %+v", lang, resp)
+		}
+	}
+
+	random := testsupport.Decode[HelloResponse](c.Get("/api/v1/hello/random").Status(http.StatusOK))
+	if _, ok := findGreeting(random.Lang); !ok {
+		t.Errorf("Expected a listed language, got %+v", random)
+	}
+
+	c.Get("/api/v1/hello/klingon").Status(http.StatusNotFound)
+
+	list := testsupport.Decode[GreetingListResponse](c.Get("/api/v1/greetings").Status(http.StatusOK))
+	if len(list.Greetings) != len(greetings()) {
+		t.Errorf("Expected %d greetings, got %d", len(greetings()), len(list.Greetings))
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file implements the guestbook, a classic first web application:
+// visitors sign it with their name and a message, and everyone can read the
+// entries, newest first, a page at a time.
+//
+// It's small, but it follows a request through every layer: an HTML form
+// (templates/guestbook.html) posts to the server, the input is cleaned and
+// validated, saved in the store, and read back out to render the template.
+// The same entries are available as JSON under /api/v1/guestbook.
+//
+// Input from strangers needs care at two points:
+//   - on the way in, cleanText removes control characters and invalid
+//     UTF-8, which could otherwise mess up terminals, logs and exports.
+//   - on the way out, html/template escapes everything it inserts, so a
+//     message containing <script> is shown as text instead of running.
+//     That's why we store the text as typed rather than HTML-escaping it
+//     on the way in: escaping is the job of whatever displays it.
+
+// GuestbookEntry is one signature in the guestbook.
+type GuestbookEntry struct {
+	ID        string    `json:"id" proto:"1"`
+	Name      string    `json:"name" proto:"2"`
+	Message   string    `json:"message" proto:"3"`
+	CreatedAt time.Time `json:"created_at" proto:"4"`
+}
+
+// GuestbookEntryRequest is the JSON body accepted by POST /api/v1/guestbook.
+type GuestbookEntryRequest struct {
+	Name    string `json:"name" proto:"1"`
+	Message string `json:"message" proto:"2"`
+
+	// CaptchaToken is needed when CAPTCHAs are on (see captcha.go).
+	CaptchaToken string `json:"captcha_token,omitempty" proto:"3"`
+}
+
+// GuestbookListResponse is one page of guestbook entries.
+type GuestbookListResponse struct {
+	Entries    []GuestbookEntry `json:"entries" proto:"1"`
+	Pagination Pagination       `json:"pagination" proto:"2"`
+}
+
+// GuestbookPage is the data for templates/guestbook.html.
+type GuestbookPage struct {
+	GuestbookListResponse
+
+	// PrevPage and NextPage are the neighbouring page numbers, or 0 if
+	// there's no such page.
+	PrevPage, NextPage int
+
+	// Captcha is the CAPTCHA widget, if there is one (see captcha.go).
+	Captcha CaptchaWidget
+
+	// After a failed submission the form is shown again with what the
+	// visitor typed and what was wrong with it.
+	Name, Message string
+	Errors        []FieldError
+}
+
+// Page sizes for listing the guestbook. maxGuestbookPage keeps
+// (page-1)*perPage well within an int: without it, ?page=
+// 9223372036854775807 overflows to a negative offset.
+const (
+	defaultGuestbookPerPage = 10
+	maxGuestbookPerPage     = 50
+	maxGuestbookPage        = 1_000_000
+)
+
+// cleanText tidies user-supplied text: invalid UTF-8 and control characters
+// are dropped (keeping line breaks if multiline is set, normalized to \n)
+// and surrounding whitespace is trimmed.
+func cleanText(s string, multiline bool) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' && multiline {
+			return r
+		}
+		if r == '\n' || r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1 // dropped
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// cleanGuestbookEntry cleans a submission and checks it against the
+// guestbook-entry schema. The check runs after cleaning, so a message made
+// only of control characters counts as empty.
+func cleanGuestbookEntry(name, message string) (GuestbookEntryRequest, []FieldError) {
+	req := GuestbookEntryRequest{Name: cleanText(name, false), Message: cleanText(message, true)}
+	return req, requestSchemas["guestbook-entry"].Validate(map[string]any{"name": req.Name, "message": req.Message})
+}
+
+// guestbookPage reads the page and per_page query parameters.
+func guestbookPage(r *http.Request) (page, perPage int, err error) {
+	page, perPage = 1, defaultGuestbookPerPage
+	q := r.URL.Query()
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 || page > maxGuestbookPage {
+			return 0, 0, fmt.Errorf("page must be between 1 and %d", maxGuestbookPage)
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > maxGuestbookPerPage {
+			return 0, 0, fmt.Errorf("per_page must be between 1 and %d", maxGuestbookPerPage)
+		}
+	}
+	return page, perPage, nil
+}
+
+// listGuestbook loads one page of the tenant's guestbook.
+func (s *Server) listGuestbook(tenant string, page, perPage int) GuestbookListResponse {
+	entries, total := s.store.ListGuestbook(tenant, (page-1)*perPage, perPage)
+	return GuestbookListResponse{
+		Entries:    entries,
+		Pagination: Pagination{Total: total, Page: page, PerPage: perPage},
+	}
+}
+
+// handleListGuestbook returns a page of entries as JSON.
+func (s *Server) handleListGuestbook(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := guestbookPage(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := s.listGuestbook(tenantFromContext(r.Context()), page, perPage)
+	setPagination(w, resp.Pagination)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleSignGuestbook adds an entry from a JSON body, or a form (see
+// forms.go).
+func (s *Server) handleSignGuestbook(w http.ResponseWriter, r *http.Request) {
+	var req GuestbookEntryRequest
+	if !decodeValidForm(w, r, "guestbook-entry", &req) {
+		return
+	}
+	token := req.CaptchaToken
+	req, errs := cleanGuestbookEntry(req.Name, req.Message)
+	if len(errs) > 0 {
+		writeValidationProblem(w, "guestbook-entry", errs)
+		return
+	}
+	if err := s.verifyCaptcha(r, token); err != nil {
+		writeCaptchaProblem(w, "guestbook-entry", err)
+		return
+	}
+
+	entry := s.store.AddGuestbookEntry(tenantFromContext(r.Context()), req.Name, req.Message)
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+// handleGuestbookPage renders the guestbook as HTML.
+func (s *Server) handleGuestbookPage(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := guestbookPage(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.renderGuestbook(w, r, http.StatusOK, page, perPage, GuestbookPage{})
+}
+
+// renderGuestbook fills in the entries and page links and renders the page.
+func (s *Server) renderGuestbook(w http.ResponseWriter, r *http.Request, status, page, perPage int, data GuestbookPage) {
+	data.GuestbookListResponse = s.listGuestbook(tenantFromContext(r.Context()), page, perPage)
+	data.Captcha = s.captchaWidget()
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if page*perPage < data.Pagination.Total {
+		data.NextPage = page + 1
+	}
+	s.renderPage(w, "guestbook.html", status, data)
+}
+
+// handleGuestbookForm handles the HTML form. On success it redirects back to
+// the guestbook with 303 See Other, the "Post/Redirect/Get" pattern: the
+// browser then loads the page with a GET, so refreshing it doesn't submit
+// the form a second time.
+func (s *Server) handleGuestbookForm(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxValidatedBody)
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid form submission")
+		return
+	}
+
+	req, errs := cleanGuestbookEntry(r.PostForm.Get("name"), r.PostForm.Get("message"))
+	if len(errs) > 0 {
+		s.renderGuestbook(w, r, http.StatusUnprocessableEntity, 1, defaultGuestbookPerPage,
+			GuestbookPage{Name: req.Name, Message: req.Message, Errors: errs})
+		return
+	}
+	if err := s.verifyCaptcha(r, s.formCaptchaToken(r)); err != nil {
+		status, fieldErr := captchaProblem(err)
+		s.renderGuestbook(w, r, status, 1, defaultGuestbookPerPage,
+			GuestbookPage{Name: req.Name, Message: req.Message, Errors: []FieldError{fieldErr}})
+		return
+	}
+
+	s.store.AddGuestbookEntry(tenantFromContext(r.Context()), req.Name, req.Message)
+	http.Redirect(w, r, "/guestbook", http.StatusSeeOther)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestCleanText checks control characters are removed and line breaks are
+// only kept where they're allowed.
+func TestCleanText(t *testing.T) {
+	tests := []struct {
+		in        string
+		multiline bool
+		want      string
+	}{
+		{"  Alice  ", false, "Alice"},
+		{"Al\x00ice\x1b[31m", false, "Alice[31m"},
+		{"two\r\nlines", true, "two\nlines"},
+		{"two\nlines", false, "two lines"},
+		{"bad \xff utf-8", false, "bad  utf-8"},
+	}
+	for _, tt := range tests {
+		if got := cleanText(tt.in, tt.multiline); got != tt.want {
+			t.Errorf("cleanText(%q, %v) = %q, want %q", tt.in, tt.multiline, got, tt.want)
+		}
+	}
+}
+
+// TestGuestbookAPI signs the guestbook through the API and pages through
+// the entries.
+func TestGuestbookAPI(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	for _, name := range []string{"one", "two", "three"} {
+		body := `{"name": "` + name + `", "message": "hello"}`
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/guestbook", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/guestbook?page=2&per_page=2", nil))
+
+	var page GuestbookListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Name != "one" {
+		t.Errorf("Expected the oldest entry alone on page 2, got %+v", page.Entries)
+	}
+	if page.Pagination != (Pagination{Total: 3, Page: 2, PerPage: 2}) {
+		t.Errorf("Unexpected pagination %+v", page.Pagination)
+	}
+
+	// Only control characters is as good as empty.
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/guestbook", strings.NewReader(`{"name": "x", "message": "\u0007"}`)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an empty message, got %d", rec.Code)
+	}
+}
+
+// TestGuestbookForm posts the HTML form and checks the entry shows up
+// escaped, and that invalid input re-renders the form.
+func TestGuestbookForm(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	post := func(name, message string) *httptest.ResponseRecorder {
+		form := url.Values{"name": {name}, "message": {message}}
+		req := httptest.NewRequest(http.MethodPost, "/guestbook", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("Mallory", "<script>alert(1)</script>")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/guestbook" {
+		t.Fatalf("Expected a 303 redirect, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/guestbook", nil))
+	body := rec.Body.String()
+	if strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("Expected the message to be escaped, got %s", body)
+	}
+
+	rec = post("Nobody", "   ")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `value="Nobody"`) {
+		t.Errorf("Expected the form again with the name kept, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// FuzzGuestbookForm posts arbitrary form bodies to the guestbook.
+//
+//	go test -fuzz FuzzGuestbookForm -fuzztime 30s
+func FuzzGuestbookForm(f *testing.F) {
+	f.Add("name=Ann&message=Hi")
+	f.Add("name=%zz&message=%00")
+	f.Add("name=\xff\xfe&message=" + strings.Repeat("a", 600))
+	f.Add(";;&&==")
+
+	h := newServer(Config{}).routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, form string) {
+		req := httptest.NewRequest(http.MethodPost, "/guestbook", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		serveFuzz(t, h, req)
+	})
+}
+
+// FuzzGuestbookQuery lists the guestbook with arbitrary query strings,
+// against a guestbook with some entries in it.
+//
+//	go test -fuzz FuzzGuestbookQuery -fuzztime 30s
+func FuzzGuestbookQuery(f *testing.F) {
+	f.Add("page=2&per_page=5")
+	f.Add("page=9223372036854775807&per_page=50")
+	f.Add("page=-1&per_page=0")
+	f.Add("page=%zz")
+
+	srv := newServer(Config{})
+	for range 30 {
+		srv.store.AddGuestbookEntry(defaultTenant, "Ann", "Hi")
+	}
+	h := srv.routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, query string) {
+		for _, path := range []string{"/api/v1/guestbook", "/guestbook"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.URL.RawQuery = query
+			serveFuzz(t, h, req)
+		}
+	})
+}
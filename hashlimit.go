@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// This file limits how much memory password hashing can take at once.
+// Each Argon2id hash fills PASSWORD_HASH_MEMORY (19 MiB by default) while
+// it runs, and registering or logging in, even as nobody, runs one, so a
+// burst of those requests could take as much memory as it liked: a few
+// hundred at once would exhaust a container's limit. Hashes are let
+// through while the memory they use adds up to no more than
+// PASSWORD_HASH_MAX_MEMORY; the rest wait for one to finish, until the
+// request's deadline (HANDLER_TIMEOUT) runs out or the client leaves,
+// when they get a 503. A hash bigger than the whole budget still runs,
+// alone, so raising PASSWORD_HASH_MEMORY can't lock everyone out.
+
+// hashLimiter counts the memory, in KiB, of the password hashes running.
+type hashLimiter struct {
+	mu   sync.Mutex
+	used int64
+
+	// released is closed, and replaced, whenever a hash finishes, to wake
+	// the waiting ones.
+	released chan struct{}
+}
+
+func newHashLimiter() *hashLimiter {
+	return &hashLimiter{released: make(chan struct{})}
+}
+
+// acquire waits until a hash of memory KiB fits within budget, and counts
+// it in. It returns ctx's error if ctx is done first.
+func (l *hashLimiter) acquire(ctx context.Context, memory, budget int64) error {
+	for {
+		l.mu.Lock()
+		if l.used == 0 || l.used+memory <= budget {
+			l.used += memory
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release counts a hash of memory KiB out.
+func (l *hashLimiter) release(memory int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= memory
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// hashingPassword waits for room to hash a password with p, and returns
+// the function to call when it's done. If the request gives up first, it
+// answers 503 and returns false.
+func (s *Server) hashingPassword(w http.ResponseWriter, r *http.Request, p argon2Params) (done func(), ok bool) {
+	memory := int64(p.Memory)
+	if err := s.passwordHashing.acquire(r.Context(), memory, int64(s.config().PasswordHashMaxMemory)); err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, http.StatusServiceUnavailable, "too many passwords are being checked: try again shortly")
+		return nil, false
+	}
+	return func() { s.passwordHashing.release(memory) }, true
+}
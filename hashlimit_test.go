@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHashLimiter checks hashes run while their memory fits the budget,
+// one too big for it still runs alone, and a waiting one starts when
+// another finishes or gives up when its context is done.
+func TestHashLimiter(t *testing.T) {
+	l := newHashLimiter()
+	ctx := context.Background()
+	if err := l.acquire(ctx, 60, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(timeout, 60, 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected to wait until the deadline, got %v", err)
+	}
+
+	started := make(chan error)
+	go func() { started <- l.acquire(ctx, 60, 100) }()
+	select {
+	case err := <-started:
+		t.Fatalf("Expected to wait for memory, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release(60)
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	l.release(60)
+
+	if err := l.acquire(ctx, 500, 100); err != nil {
+		t.Errorf("Expected a hash bigger than the budget to run alone, got %v", err)
+	}
+}
+
+// TestLoginWaitsForHashing checks a login that can't start its hash before
+// the client gives up gets a 503.
+func TestLoginWaitsForHashing(t *testing.T) {
+	s, c := newUserTestServer(t)
+	s.cfg.PasswordHashMaxMemory = 64
+	if err := s.passwordHashing.acquire(context.Background(), 64, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"login": "alice", "password": "correct horse"}`)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	// Straight to the handler, since the timeout middleware would answer
+	// too once the context is done.
+	rec := httptest.NewRecorder()
+	s.handleLogin(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After, got %d: %s", rec.Code, rec.Body)
+	}
+
+	s.passwordHashing.release(64)
+	c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "correct horse"}).Status(http.StatusUnauthorized)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// This file sends heartbeats: a request to HEARTBEAT_URL every
+// HEARTBEAT_INTERVAL, for as long as the server is healthy. It's the other
+// way round from a health check. Instead of a monitor calling the server,
+// which only works if the monitor can reach it, the server calls the
+// monitor, and the monitor raises the alarm when the calls stop. This is a
+// dead man's switch, and it catches what a health check can't: a server
+// that's stopped without anyone noticing, a cron host that's gone, or a
+// network that lets no traffic out.
+//
+// Services like healthchecks.io and Cronitor, or Uptime Kuma's push
+// monitors, give each check a URL to ping and alert when a ping is late:
+//
+//	HEARTBEAT_URL=https://hc-ping.com/<uuid>
+//	HEARTBEAT_INTERVAL=1m
+//
+// Set the monitor's grace period to a few intervals, so a single lost
+// ping doesn't page anyone. HEARTBEAT_METHOD=POST sends a small JSON body
+// (status, instance and version), which some monitors keep with the ping.
+//
+// A heartbeat is only sent while the readiness checks (see readiness.go)
+// pass, or only soft ones fail, and not while shutting down. Heartbeats
+// that are skipped or fail are missed: the server logs each one, with how
+// many have been missed in a row, and logs again once they get through.
+
+// heartbeatTimeout bounds one heartbeat request.
+const heartbeatTimeout = 10 * time.Second
+
+// Heartbeat is the JSON body of a POST heartbeat.
+type Heartbeat struct {
+	Status   string `json:"status"`
+	Instance string `json:"instance"`
+	Version  string `json:"version"`
+}
+
+// sendHeartbeats sends a heartbeat now and then every interval, until ctx
+// is done.
+func (s *Server) sendHeartbeats(ctx context.Context, rawURL, method string, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	misses := 0
+	for {
+		err := s.heartbeat(ctx, rawURL, method)
+		switch {
+		case err != nil:
+			misses++
+			slog.Warn("Heartbeat missed", "misses", misses, "error", err)
+		case misses > 0:
+			slog.Info("Heartbeats resumed", "missed", misses)
+			misses = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// heartbeat sends one heartbeat, if the server is healthy.
+func (s *Server) heartbeat(ctx context.Context, rawURL, method string) error {
+	if s.draining.Load() {
+		return errors.New("not sent: shutting down")
+	}
+	results, _ := s.readiness.Check(ctx, s.clock.Now())
+	status := readinessStatus(results)
+	if status == "unavailable" {
+		return errors.New("not sent: readiness checks are failing")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+	var body io.Reader
+	if method == http.MethodPost {
+		data, err := json.Marshal(Heartbeat{Status: status, Instance: instanceName(), Version: version})
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.outbound.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the monitor answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHeartbeats checks heartbeats are sent on every tick while the server
+// is healthy, and skipped while it isn't.
+func TestHeartbeats(t *testing.T) {
+	var mu sync.Mutex
+	var beats []Heartbeat
+	monitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hb Heartbeat
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&hb) != nil {
+			http.Error(w, "bad heartbeat", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		beats = append(beats, hb)
+		mu.Unlock()
+	}))
+	defer monitor.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(beats)
+	}
+
+	s, _ := newTestServer(t)
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+	var failing atomic.Bool
+	s.readiness.Register("database", SeverityHard, func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sendHeartbeats(ctx, monitor.URL, http.MethodPost, time.Minute)
+	eventually(t, func() bool { return count() == 1 && clock.Waiters() == 1 })
+	if beats[0].Status != "ready" || beats[0].Version != version {
+		t.Errorf("Unexpected heartbeat %+v", beats[0])
+	}
+
+	failing.Store(true)
+	clock.Advance(time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if n := count(); n != 1 {
+		t.Fatalf("Expected no heartbeat while unhealthy, got %d", n)
+	}
+
+	failing.Store(false)
+	clock.Advance(time.Minute)
+	eventually(t, func() bool { return count() == 2 })
+}
+
+// TestHeartbeatErrors checks what counts as a missed heartbeat.
+func TestHeartbeatErrors(t *testing.T) {
+	monitor := httptest.NewServer(http.NotFoundHandler())
+	defer monitor.Close()
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	if err := s.heartbeat(ctx, monitor.URL, http.MethodGet); err == nil {
+		t.Error("Expected a 404 from the monitor to be an error")
+	}
+	s.draining.Store(true)
+	if err := s.heartbeat(ctx, monitor.URL, http.MethodGet); err == nil {
+		t.Error("Expected no heartbeat while shutting down")
+	}
+}
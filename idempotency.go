@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the Idempotency-Key header for POST and PATCH. A
+// client that sends a request and gets no answer, because of a timeout or
+// a dropped connection, can't tell whether it was done. Retrying a GET or
+// a DELETE is harmless, but retrying "create a note" may create two.
+//
+// With an Idempotency-Key, a unique value the client makes up for each
+// operation (a UUID, say) and sends again with every retry of it, the
+// server can tell a retry from a new request:
+//
+//	curl -X POST -H 'Idempotency-Key: 5f2b...' -d '{"title": "Hi"}' .../api/v1/notes
+//
+// The first request with a key is handled as usual, and its response is
+// kept for IDEMPOTENCY_TTL. A retry with the same key gets that response
+// back, marked Idempotent-Replayed: true, without the handler running
+// again. Keys belong to a tenant and a caller, so one client can't replay
+// another's response by guessing its key: the caller is the subject of a
+// valid token, any other credential in the Authorization header (hashed),
+// or for anonymous requests the client's address. A request is turned
+// away if its key is:
+//   - still in use by a request being handled: 409, retry later
+//   - used for a different request (method, URL or body): 422, since
+//     that's a bug in the client
+//
+// Server errors (5xx) aren't kept, so a retry of an operation that failed
+// that way runs again. Requests without the header, and those with bodies
+// over 1 MiB (file uploads, mostly), are handled as usual. The responses
+// are kept in memory, so each instance only knows the keys it has seen; a
+// retry that the load balancer sends to another instance runs again. At
+// most maxIdempotentResponses are kept: when that's reached, the one that
+// would expire first makes way.
+
+// idempotencyHeader is the request header with the key.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the longest key accepted.
+const maxIdempotencyKey = 255
+
+// maxIdempotentResponses is how many keys are kept at once.
+const maxIdempotentResponses = 10_000
+
+// idempotentResponse is a kept response, or a placeholder while the first
+// request with its key is being handled.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore keeps responses by tenant and key.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	swept     time.Time // when responses was last cleared of expired ones
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{responses: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the response kept for key, if there's one that hasn't
+// expired. Otherwise it reserves the key for a request with fingerprint,
+// and returns nil. ok is false if there's no room: every key kept is
+// still in use.
+func (st *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte, now time.Time, ttl time.Duration) (kept *idempotentResponse, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if now.Sub(st.swept) >= time.Minute || len(st.responses) >= maxIdempotentResponses {
+		for k, resp := range st.responses {
+			if resp.done && !now.Before(resp.expires) {
+				delete(st.responses, k)
+			}
+		}
+		st.swept = now
+	}
+	if resp, found := st.responses[key]; found && !(resp.done && !now.Before(resp.expires)) {
+		return resp, true
+	}
+	if len(st.responses) >= maxIdempotentResponses && !st.evict() {
+		return nil, false
+	}
+	st.responses[key] = &idempotentResponse{fingerprint: fingerprint, expires: now.Add(ttl)}
+	return nil, true
+}
+
+// evict removes the kept response that expires first, and reports whether
+// there was one. Keys still in use aren't removed. st.mu must be held.
+func (st *idempotencyStore) evict() bool {
+	var oldest string
+	for k, resp := range st.responses {
+		if resp.done && (oldest == "" || resp.expires.Before(st.responses[oldest].expires)) {
+			oldest = k
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(st.responses, oldest)
+	return true
+}
+
+// finish keeps the response to the request that reserved key.
+func (st *idempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	resp := st.responses[key]
+	resp.done, resp.status, resp.header, resp.body = true, status, header, body
+}
+
+// forget frees key, for the next request with it to be handled.
+func (st *idempotencyStore) forget(key string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.responses, key)
+}
+
+// idempotencyCaller identifies who sent r, for their keys to be theirs
+// alone: the audience and subject of a valid token from the request's
+// tenant, a hash of any other Authorization header (an API key, say), or
+// the client's address.
+func (s *Server) idempotencyCaller(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok && strings.Count(token, ".") == 2 {
+		if claims, err := s.verifyJWT(token); err == nil && claims.Tenant == tenantFromContext(r.Context()) {
+			return "sub:" + claims.Audience + ":" + claims.Subject
+		}
+	}
+	if auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "auth:" + hex.EncodeToString(sum[:])
+	}
+	return "addr:" + rateLimitClient(r)
+}
+
+// recordingWriter copies a response as it's written.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+		rw.header = rw.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotencyMiddleware replays the kept response to a retried POST or
+// PATCH with an Idempotency-Key.
+func (s *Server) idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeProblem(w, http.StatusBadRequest, "the Idempotency-Key header is too long")
+			return
+		}
+
+		// The body is read here, to tell a retry from a different request
+		// with the same key, and put back for the handler.
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "couldn't read the request body")
+			return
+		}
+		if len(body) > maxValidatedBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		h.Sum(fingerprint[:0])
+
+		key = tenantFromContext(r.Context()) + "\x00" + s.idempotencyCaller(r) + "\x00" + key
+		kept, ok := s.idempotency.begin(key, fingerprint, s.clock.Now(), s.config().IdempotencyTTL)
+		switch {
+		case !ok:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusServiceUnavailable, "too many requests with an Idempotency-Key are being handled")
+			return
+		case kept == nil:
+		case kept.fingerprint != fingerprint:
+			writeProblem(w, http.StatusUnprocessableEntity, "this Idempotency-Key was used for a different request")
+			return
+		case !kept.done:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusConflict, "a request with this Idempotency-Key is still being handled")
+			return
+		default:
+			// Headers set by the middleware on the way in, like the request
+			// ID, are this request's; the rest are the kept response's.
+			for k, v := range kept.header {
+				if _, ok := w.Header()[k]; !ok {
+					w.Header()[k] = v
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(kept.status)
+			w.Write(kept.body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		finished := false
+		defer func() {
+			// Free the key if the handler panicked, or failed in a way a
+			// retry might not.
+			if !finished {
+				s.idempotency.forget(key)
+			}
+		}()
+		next(rw, r)
+		if rw.status == 0 {
+			rw.WriteHeader(http.StatusOK)
+		}
+		if rw.status < 500 {
+			s.idempotency.finish(key, rw.status, rw.header, bytes.Clone(rw.body.Bytes()))
+			finished = true
+		}
+	}
+}
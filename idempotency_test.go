@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestIdempotencyKey checks a retried POST gets the first response back
+// without creating a second note, until the key expires.
+func TestIdempotencyKey(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	c.Header.Set(idempotencyHeader, "create-hello")
+
+	first := c.Post("/api/v1/notes", map[string]string{"title": "Hello"}).Status(http.StatusCreated)
+	retry := c.Post("/api/v1/notes", map[string]string{"title": "Hello"}).
+		Status(http.StatusCreated).
+		HasHeader("Idempotent-Replayed", "true").
+		HasHeader("Content-Type", first.Header().Get("Content-Type"))
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the same response, got %s then %s", first.Body, retry.Body)
+	}
+	if retry.Header().Get("X-Request-ID") == first.Header().Get("X-Request-ID") {
+		t.Error("Expected the retry to have its own request ID")
+	}
+	if notes := s.store.ListNotes(defaultTenant); len(notes) != 1 {
+		t.Errorf("Expected 1 note, got %d", len(notes))
+	}
+
+	c.Post("/api/v1/notes", map[string]string{"title": "Bye"}).Status(http.StatusUnprocessableEntity)
+	c.Header.Set(tenantHeader, "acme")
+	c.Post("/api/v1/notes", map[string]string{"title": "Hello"}).Status(http.StatusCreated)
+	c.Header.Del(tenantHeader)
+
+	clock.Advance(24 * time.Hour)
+	if rec := c.Post("/api/v1/notes", map[string]string{"title": "Bye"}).Status(http.StatusCreated); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected the expired key to be reusable")
+	}
+}
+
+// TestIdempotencyKeyErrors checks server errors aren't kept, a key in use
+// is turned away, and requests without a key aren't affected.
+func TestIdempotencyKeyErrors(t *testing.T) {
+	s, c := newTestServer(t)
+	s.faults.Set(Fault{Route: "POST /api/v1/counter", Kind: "error", Status: http.StatusServiceUnavailable, Count: 1})
+	c.Header.Set(idempotencyHeader, "count")
+	c.Post("/api/v1/counter", nil).Status(http.StatusServiceUnavailable)
+	c.Post("/api/v1/counter", nil).Status(http.StatusOK)
+
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+	s.faults.Set(Fault{Route: "POST /api/v1/notes", Kind: "timeout", DelayMs: 1000, Count: 1})
+	c.Header.Set(idempotencyHeader, "slow")
+	done := make(chan int)
+	go func() { done <- c.Post("/api/v1/notes", map[string]string{"title": "Slow"}).Code }()
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	c.Post("/api/v1/notes", map[string]string{"title": "Slow"}).Status(http.StatusConflict)
+	clock.Advance(time.Second)
+	<-done
+
+	c.Header.Del(idempotencyHeader)
+	for range 2 {
+		c.Post("/api/v1/notes", map[string]string{"title": "Plain"}).Status(http.StatusCreated)
+	}
+	c.Header.Set(idempotencyHeader, strings.Repeat("k", maxIdempotencyKey+1))
+	c.Post("/api/v1/notes", map[string]string{"title": "Long"}).Status(http.StatusBadRequest)
+}
+
+// TestIdempotencyKeyPerCaller checks a key belongs to the caller that used
+// it: another credential or address doesn't get the response, while the
+// same user with a fresh token does.
+func TestIdempotencyKeyPerCaller(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	c.Header.Set(idempotencyHeader, "shared")
+	post := func(auth, addr string) *testsupport.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader(`{"title": "Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		req.RemoteAddr = addr
+		return c.DoRequest(req).Status(http.StatusCreated)
+	}
+
+	post("Bearer key-a", "192.0.2.1:1000")
+	if post("Bearer key-b", "192.0.2.1:1000").Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected another API key not to get the response")
+	}
+	post("", "192.0.2.1:1000")
+	if post("", "192.0.2.2:1000").Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected another address not to get the response")
+	}
+
+	first, _ := s.issueJWT(defaultTenant, jwtAudienceUser, "alice", time.Hour)
+	clock.Advance(time.Minute)
+	refreshed, _ := s.issueJWT(defaultTenant, jwtAudienceUser, "alice", time.Hour)
+	post("Bearer "+first, "192.0.2.1:1000")
+	post("Bearer "+refreshed, "192.0.2.3:1000").HasHeader("Idempotent-Replayed", "true")
+	if notes := s.store.ListNotes(defaultTenant); len(notes) != 5 {
+		t.Errorf("Expected 5 notes, got %d", len(notes))
+	}
+}
+
+// TestIdempotencyStoreFull checks the store stays at its limit, making way
+// for new keys with the response that expires first, and turns a request
+// away only when every key is in use.
+func TestIdempotencyStoreFull(t *testing.T) {
+	st := newIdempotencyStore()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range maxIdempotentResponses {
+		key := strconv.Itoa(i)
+		st.begin(key, [sha256.Size]byte{}, now, time.Hour+time.Duration(i)*time.Second)
+		st.finish(key, http.StatusOK, nil, nil)
+	}
+
+	if _, ok := st.begin("new", [sha256.Size]byte{}, now, time.Hour); !ok {
+		t.Fatal("Expected room to be made")
+	}
+	if _, kept := st.responses["0"]; kept || len(st.responses) != maxIdempotentResponses {
+		t.Errorf("Expected the first to expire to make way, got %d kept", len(st.responses))
+	}
+
+	for k := range st.responses {
+		st.responses[k].done = false
+	}
+	if _, ok := st.begin("another", [sha256.Size]byte{}, now, time.Hour); ok {
+		t.Error("Expected no room while every key is in use")
+	}
+}
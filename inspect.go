@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the request inspector: a middleware that remembers
+// the most recent requests, and a page (/inspect) and API
+// (/api/v1/inspect) that show them. It's a teaching aid for seeing what
+// actually arrives at the server: which headers a proxy adds
+// (X-Forwarded-For, Via...), what a browser sends compared to curl, how
+// long each request took.
+//
+// Requests are kept in memory only, in a ring buffer of fixed size, so old
+// ones fall out as new ones arrive. Credentials are redacted before
+// anything is stored, and each tenant only sees its own requests.
+
+// inspectCapacity is how many requests the inspector remembers.
+const inspectCapacity = 100
+
+// sensitiveWords mark header and query parameter names whose values are
+// replaced with [REDACTED], such as Authorization, Cookie, X-Api-Key or
+// ?access_token=.
+var sensitiveWords = []string{"auth", "cookie", "token", "secret", "key", "password", "signature", "session"}
+
+// InspectedRequest is a captured request and how it was answered.
+type InspectedRequest struct {
+	RequestID  string              `json:"request_id"`
+	TraceID    string              `json:"trace_id,omitempty"`
+	Time       time.Time           `json:"time"`
+	Tenant     string              `json:"-"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+
+	Status          int                 `json:"status"`
+	DurationMs      float64             `json:"duration_ms"`
+	ResponseBytes   int64               `json:"response_bytes"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+}
+
+// InspectResponse is the JSON body returned by GET /api/v1/inspect.
+type InspectResponse struct {
+	Requests []InspectedRequest `json:"requests"`
+}
+
+// Inspector keeps the most recent requests. It's safe for concurrent use.
+type Inspector struct {
+	mu       sync.Mutex
+	requests []InspectedRequest // a ring buffer, like Metrics.latencies
+	next     int
+}
+
+// newInspector creates an empty inspector.
+func newInspector() *Inspector {
+	return &Inspector{}
+}
+
+// Add records a request, replacing the oldest one when full.
+func (in *Inspector) Add(req InspectedRequest) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if len(in.requests) < inspectCapacity {
+		in.requests = append(in.requests, req)
+		return
+	}
+	in.requests[in.next] = req
+	in.next = (in.next + 1) % inspectCapacity
+}
+
+// Recent returns a tenant's captured requests, newest first.
+func (in *Inspector) Recent(tenant string) []InspectedRequest {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	recent := []InspectedRequest{}
+	for i := range in.requests {
+		// Walk backwards from the newest, which sits just before next.
+		req := in.requests[(in.next-1-i+2*len(in.requests))%len(in.requests)]
+		if req.Tenant == tenant {
+			recent = append(recent, req)
+		}
+	}
+	return recent
+}
+
+// sensitiveName reports whether a header or parameter name suggests its
+// value is a credential.
+func sensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(sensitiveWords, func(word string) bool {
+		return strings.Contains(name, word)
+	})
+}
+
+// sanitizeHeaders copies headers, redacting sensitive values.
+func sanitizeHeaders(h http.Header) map[string][]string {
+	clean := make(map[string][]string, len(h))
+	for name, values := range h {
+		if sensitiveName(name) {
+			values = []string{redacted}
+		}
+		clean[name] = slices.Clone(values)
+	}
+	return clean
+}
+
+// sanitizeURL returns the request's path and query, with sensitive query
+// parameters redacted.
+func sanitizeURL(u *url.URL) string {
+	query := u.Query()
+	for name := range query {
+		if sensitiveName(name) {
+			query[name] = []string{redacted}
+		}
+	}
+	clean := url.URL{Path: u.Path, RawQuery: query.Encode()}
+	return clean.String()
+}
+
+// inspectRecorder remembers the status code and counts the bytes written.
+type inspectRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code before passing it on.
+func (r *inspectRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written.
+func (r *inspectRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (r *inspectRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// inspectMiddleware captures every request except those for the inspector
+// itself, which would otherwise crowd out everything else.
+func (s *Server) inspectMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/inspect" || r.URL.Path == "/api/v1/inspect" {
+			next(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &inspectRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		tc, _ := traceFromContext(r.Context())
+		s.inspector.Add(InspectedRequest{
+			RequestID:       requestIDFromContext(r.Context()),
+			TraceID:         tc.TraceID,
+			Time:            start,
+			Tenant:          tenantFromContext(r.Context()),
+			Method:          r.Method,
+			URL:             sanitizeURL(r.URL),
+			Proto:           r.Proto,
+			Host:            r.Host,
+			RemoteAddr:      r.RemoteAddr,
+			Headers:         sanitizeHeaders(r.Header),
+			Status:          rec.status,
+			DurationMs:      float64(time.Since(start)) / float64(time.Millisecond),
+			ResponseBytes:   rec.bytes,
+			ResponseHeaders: sanitizeHeaders(rec.Header()),
+		})
+	}
+}
+
+// handleInspect shows the captured requests as a web page.
+func (s *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	s.renderPage(w, "inspect.html", http.StatusOK, InspectResponse{
+		Requests: s.inspector.Recent(tenantFromContext(r.Context())),
+	})
+}
+
+// handleListInspected returns the captured requests as JSON.
+func (s *Server) handleListInspected(w http.ResponseWriter, r *http.Request) {
+	requests := s.inspector.Recent(tenantFromContext(r.Context()))
+	setPagination(w, Pagination{Total: len(requests)})
+	writeJSON(w, http.StatusOK, InspectResponse{Requests: requests})
+}
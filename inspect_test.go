@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestInspectorRingBuffer checks the newest requests are kept and listed
+// first, per tenant.
+func TestInspectorRingBuffer(t *testing.T) {
+	in := newInspector()
+	for i := 0; i < inspectCapacity+5; i++ {
+		in.Add(InspectedRequest{Tenant: "acme", Status: i})
+	}
+	in.Add(InspectedRequest{Tenant: "globex", Status: 999})
+
+	recent := in.Recent("acme")
+	if len(recent) != inspectCapacity-1 {
+		t.Fatalf("Expected %d requests, got %d", inspectCapacity-1, len(recent))
+	}
+	if recent[0].Status != inspectCapacity+4 || recent[len(recent)-1].Status != 6 {
+		t.Errorf("Expected newest first, got %d ... %d", recent[0].Status, recent[len(recent)-1].Status)
+	}
+	if globex := in.Recent("globex"); len(globex) != 1 || globex[0].Status != 999 {
+		t.Errorf("Expected globex's one request, got %+v", globex)
+	}
+}
+
+// TestInspectMiddleware makes a request with credentials and a trace
+// context, then checks what the API shows.
+func TestInspectMiddleware(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/message?access_token=hunter2&verbose=1", nil)
+	req.Header.Set("Authorization", "Bearer hunter2")
+	req.Header.Set("Cookie", "session=hunter2")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(requestIDHeader, "req-1")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/inspect", nil))
+	if strings.Contains(rec.Body.String(), "hunter2") {
+		t.Errorf("Expected credentials to be redacted, got %s", rec.Body.String())
+	}
+
+	var resp InspectResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if len(resp.Requests) != 1 {
+		t.Fatalf("Expected only the /api/message request, got %+v", resp.Requests)
+	}
+	got := resp.Requests[0]
+	if got.URL != "/api/message?access_token=%5BREDACTED%5D&verbose=1" || got.Status != http.StatusOK || got.ResponseBytes == 0 {
+		t.Errorf("Unexpected request %+v", got)
+	}
+	if got.RequestID != "req-1" || got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the request and trace IDs, got %q and %q", got.RequestID, got.TraceID)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/inspect", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "GET /api/message") {
+		t.Errorf("Expected the page to list the request, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements GET /api/v1/instance, which says which copy of the
+// server answered. Scale the deployment up (kubectl scale deployment app
+// --replicas=3, or docker compose up --scale app=3), call it a few times,
+// and watch the answers change as the load balancer spreads requests out.
+//
+// Each instance also gets a colour, worked out from its host name so it
+// stays the same across requests (though not across restarts, since a new
+// container gets a new name). The landing page shows it, which makes it
+// easy to spot at a glance when a refresh lands on a different replica.
+//
+// Kubernetes doesn't tell a container its pod name, namespace or node
+// unless asked to. The Downward API does it by setting environment
+// variables from the pod's own fields:
+//
+//	env:
+//	  - name: POD_NAME
+//	    valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//	  - name: POD_NAMESPACE
+//	    valueFrom: {fieldRef: {fieldPath: metadata.namespace}}
+//	  - name: NODE_NAME
+//	    valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//	  - name: MEMORY_LIMIT
+//	    valueFrom: {resourceFieldRef: {resource: limits.memory}}
+//
+// Labels and annotations can't be environment variables, since there can
+// be any number of them, so they come as files in a downwardAPI volume
+// mounted at PODINFO_DIR (/etc/podinfo by default):
+//
+//	volumes:
+//	  - name: podinfo
+//	    downwardAPI:
+//	      items:
+//	        - path: labels
+//	          fieldRef: {fieldPath: metadata.labels}
+//	        - path: annotations
+//	          fieldRef: {fieldPath: metadata.annotations}
+//
+// Unlike environment variables, which are fixed when the container starts,
+// the kubelet rewrites these files when the pod's labels or annotations
+// change, so they're read again on every request: try kubectl label pod.
+// Resource requests and limits can be files in the same volume too
+// (resourceFieldRef, with paths cpu_limit, cpu_request, mem_limit and
+// mem_request); a file takes precedence over the environment variable.
+//
+// Outside Kubernetes all of this is simply left out.
+
+// startTime is when the process started, or near enough: when the package
+// was initialized.
+var startTime = time.Now()
+
+// InstanceResponse is the JSON body returned by GET /api/v1/instance.
+type InstanceResponse struct {
+	Hostname     string `json:"hostname"`
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+	NodeName     string `json:"node_name,omitempty"`
+
+	// ContainerID is the full ID of the container the process runs in, as
+	// shown by docker ps or crictl ps (which shorten it to 12 or 13
+	// characters).
+	ContainerID string `json:"container_id,omitempty"`
+
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Version       string    `json:"version"`
+
+	// Color is a CSS colour ("#rrggbb") derived from the host name.
+	Color string `json:"color"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Resources   *PodResources     `json:"resources,omitempty"`
+}
+
+// PodResources are the container's resource requests and limits, as the
+// Downward API reports them: CPU in whole cores (rounded up) unless a
+// divisor such as 1m is set, memory in bytes. With no limit set, the limit
+// reported is what the node can allocate.
+type PodResources struct {
+	CPURequest    string `json:"cpu_request,omitempty"`
+	CPULimit      string `json:"cpu_limit,omitempty"`
+	MemoryRequest string `json:"memory_request,omitempty"`
+	MemoryLimit   string `json:"memory_limit,omitempty"`
+}
+
+// lastAppliedAnnotation is added by kubectl apply and holds the whole
+// manifest the pod was created from, environment variables included. It's
+// left out of the response: it's long, and may contain secrets.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// currentInstance describes this process at the given time, reading pod
+// metadata files from podInfoDir.
+func currentInstance(now time.Time, podInfoDir string) InstanceResponse {
+	inst := InstanceResponse{
+		Hostname:      instanceName(),
+		PodName:       os.Getenv("POD_NAME"),
+		PodNamespace:  os.Getenv("POD_NAMESPACE"),
+		NodeName:      os.Getenv("NODE_NAME"),
+		ContainerID:   containerID(),
+		StartedAt:     startTime,
+		UptimeSeconds: int64(now.Sub(startTime).Seconds()),
+		Version:       version,
+		Color:         instanceColor(instanceName()),
+		Labels:        readDownwardAPIFile(filepath.Join(podInfoDir, "labels")),
+		Annotations:   readDownwardAPIFile(filepath.Join(podInfoDir, "annotations")),
+	}
+	delete(inst.Annotations, lastAppliedAnnotation)
+
+	resources := PodResources{
+		CPURequest:    downwardAPIValue(podInfoDir, "cpu_request", "CPU_REQUEST"),
+		CPULimit:      downwardAPIValue(podInfoDir, "cpu_limit", "CPU_LIMIT"),
+		MemoryRequest: downwardAPIValue(podInfoDir, "mem_request", "MEMORY_REQUEST"),
+		MemoryLimit:   downwardAPIValue(podInfoDir, "mem_limit", "MEMORY_LIMIT"),
+	}
+	if resources != (PodResources{}) {
+		inst.Resources = &resources
+	}
+	return inst
+}
+
+// readDownwardAPIFile reads a labels or annotations file, which has one
+// key="value" pair per line with the value quoted like a Go string. A
+// missing file gives nil, and lines that don't parse are skipped.
+func readDownwardAPIFile(path string) map[string]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pairs := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, quoted, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if value, err := strconv.Unquote(quoted); err == nil {
+			pairs[key] = value
+		}
+	}
+	return pairs
+}
+
+// downwardAPIValue returns the contents of the named file in dir if there
+// is one, or else the environment variable.
+func downwardAPIValue(dir, file, env string) string {
+	if data, err := os.ReadFile(filepath.Join(dir, file)); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return os.Getenv(env)
+}
+
+// podLogAttrs returns the attributes that identify this pod in log lines,
+// or nil outside Kubernetes. With many replicas writing to one log
+// collector, they're how you tell which pod said what.
+func podLogAttrs() []any {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		return nil
+	}
+	attrs := []any{"pod", name}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		attrs = append(attrs, "namespace", ns)
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		attrs = append(attrs, "node", node)
+	}
+	return attrs
+}
+
+// logPodMetadata logs the pod's labels and resources once at startup. Only
+// the annotation names are logged, since their values can be long.
+func logPodMetadata(inst InstanceResponse) {
+	if inst.Labels == nil && inst.Annotations == nil && inst.Resources == nil {
+		return
+	}
+	annotations := make([]string, 0, len(inst.Annotations))
+	for key := range inst.Annotations {
+		annotations = append(annotations, key)
+	}
+	slices.Sort(annotations)
+
+	attrs := []any{"labels", inst.Labels, "annotations", annotations}
+	if r := inst.Resources; r != nil {
+		attrs = append(attrs, "cpu_request", r.CPURequest, "cpu_limit", r.CPULimit,
+			"memory_request", r.MemoryRequest, "memory_limit", r.MemoryLimit)
+	}
+	slog.Info("Pod metadata", attrs...)
+}
+
+var (
+	// cgroupIDPattern finds a container ID in /proc/self/cgroup, where
+	// runtimes name each container's cgroup after it: "/docker/<id>",
+	// "/kubepods/.../<id>" or "/.../cri-containerd-<id>.scope".
+	cgroupIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	// mountIDPattern finds a container ID in /proc/self/mountinfo, from the
+	// files Docker and Podman mount into the container (/etc/hostname and
+	// friends), which live in a directory named after it. Other long hex
+	// strings there, such as overlay layer IDs, aren't container IDs.
+	mountIDPattern = regexp.MustCompile(`containers/([0-9a-f]{64})/`)
+)
+
+// containerID returns the ID of the container this process runs in, or ""
+// outside a container. cgroup v1 puts it in /proc/self/cgroup; with cgroup
+// v2 that file usually just says "0::/", so the mounts are checked next.
+var containerID = sync.OnceValue(func() string {
+	if data, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		if id := containerIDFromCgroup(data); id != "" {
+			return id
+		}
+	}
+	if data, err := os.ReadFile("/proc/self/mountinfo"); err == nil {
+		return containerIDFromMountinfo(data)
+	}
+	return ""
+})
+
+// containerIDFromCgroup returns the container ID in the contents of
+// /proc/self/cgroup, taking the last one on a line since nested cgroups
+// come after their parents.
+func containerIDFromCgroup(data []byte) string {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if ids := cgroupIDPattern.FindAll(line, -1); len(ids) > 0 {
+			return string(ids[len(ids)-1])
+		}
+	}
+	return ""
+}
+
+// containerIDFromMountinfo returns the container ID in the contents of
+// /proc/self/mountinfo.
+func containerIDFromMountinfo(data []byte) string {
+	if m := mountIDPattern.FindSubmatch(data); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// instanceColor picks a colour for an instance from a hash of its name.
+// Only the hue varies, with saturation and lightness fixed, so every colour
+// is bright enough to tell apart and dark enough for white text.
+func instanceColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	hue := float64(h.Sum32() % 360)
+	r, g, b := hslToRGB(hue, 0.65, 0.45)
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// hslToRGB converts a colour from HSL (hue in degrees, saturation and
+// lightness from 0 to 1) to 8-bit RGB.
+func hslToRGB(hue, saturation, lightness float64) (r, g, b uint8) {
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := lightness - chroma/2
+
+	var rf, gf, bf float64
+	switch {
+	case hue < 60:
+		rf, gf, bf = chroma, x, 0
+	case hue < 120:
+		rf, gf, bf = x, chroma, 0
+	case hue < 180:
+		rf, gf, bf = 0, chroma, x
+	case hue < 240:
+		rf, gf, bf = 0, x, chroma
+	case hue < 300:
+		rf, gf, bf = x, 0, chroma
+	default:
+		rf, gf, bf = chroma, 0, x
+	}
+	scale := func(v float64) uint8 { return uint8(math.Round((v + m) * 255)) }
+	return scale(rf), scale(gf), scale(bf)
+}
+
+// handleInstance describes the instance that served the request.
+func (s *Server) handleInstance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentInstance(s.clock.Now(), s.config().PodInfoDir))
+}
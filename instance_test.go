@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestContainerIDFromCgroup checks the cgroup formats of the common runtimes.
+func TestContainerIDFromCgroup(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		name   string
+		cgroup string
+		want   string
+	}{
+		{"docker", "12:memory:/docker/" + id + "\n11:cpu:/docker/" + id + "\n", id},
+		{"kubernetes", "5:pids:/kubepods/burstable/pod6c1a5e2e-0f4b-4f0e-9c38-2b8e0d1c7a11/" + id + "\n", id},
+		{"containerd", "0::/system.slice/cri-containerd-" + id + ".scope\n", id},
+		{"cgroup v2", "0::/\n", ""},
+		{"not a container", "0::/user.slice/user-1000.slice/session-2.scope\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerIDFromCgroup([]byte(tt.cgroup)); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestContainerIDFromMountinfo checks the ID is taken from the hostname
+// mount, not from overlay layer IDs.
+func TestContainerIDFromMountinfo(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	layer := strings.Repeat("fedcba9876543210", 4)
+	mountinfo := "1 0 0:50 / / rw - overlay overlay rw,upperdir=/var/lib/docker/overlay2/" + layer + "/diff\n" +
+		"2 1 254:1 /docker/containers/" + id + "/hostname /etc/hostname rw - ext4 /dev/vda1 rw\n"
+
+	if got := containerIDFromMountinfo([]byte(mountinfo)); got != id {
+		t.Errorf("Expected %q, got %q", id, got)
+	}
+	if got := containerIDFromMountinfo([]byte("1 0 0:50 / / rw - ext4 /dev/vda1 rw\n")); got != "" {
+		t.Errorf("Expected no ID outside a container, got %q", got)
+	}
+}
+
+// TestInstanceColor checks colours are valid, stable and vary by name.
+func TestInstanceColor(t *testing.T) {
+	hex := regexp.MustCompile(`^#[0-9a-f]{6}$`)
+	seen := map[string]bool{}
+	for _, name := range []string{"app-1", "app-2", "app-3", "web-7d9f8c-x2k4p"} {
+		color := instanceColor(name)
+		if !hex.MatchString(color) {
+			t.Errorf("Expected a #rrggbb colour for %q, got %q", name, color)
+		}
+		if instanceColor(name) != color {
+			t.Errorf("Expected the same colour every time for %q", name)
+		}
+		seen[color] = true
+	}
+	if len(seen) < 3 {
+		t.Errorf("Expected different names to get different colours, got %v", seen)
+	}
+}
+
+// TestHSLToRGB checks a few well-known colours.
+func TestHSLToRGB(t *testing.T) {
+	tests := []struct {
+		hue, s, l float64
+		r, g, b   uint8
+	}{
+		{0, 1, 0.5, 255, 0, 0},
+		{120, 1, 0.5, 0, 255, 0},
+		{240, 1, 0.5, 0, 0, 255},
+		{0, 0, 1, 255, 255, 255},
+	}
+	for _, tt := range tests {
+		r, g, b := hslToRGB(tt.hue, tt.s, tt.l)
+		if r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("hsl(%v, %v, %v): expected (%d, %d, %d), got (%d, %d, %d)", tt.hue, tt.s, tt.l, tt.r, tt.g, tt.b, r, g, b)
+		}
+	}
+}
+
+// TestHandleInstance checks the pod fields come from the Downward API
+// environment variables.
+func TestHandleInstance(t *testing.T) {
+	t.Setenv("POD_NAME", "app-7d9f8c-x2k4p")
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("NODE_NAME", "worker-1")
+
+	rec := httptest.NewRecorder()
+	newServer(Config{}).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/instance", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var resp InstanceResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if resp.PodName != "app-7d9f8c-x2k4p" || resp.PodNamespace != "default" || resp.NodeName != "worker-1" {
+		t.Errorf("Unexpected pod fields %+v", resp)
+	}
+	if resp.Hostname != instanceName() || resp.Color != instanceColor(instanceName()) {
+		t.Errorf("Unexpected host name or colour %+v", resp)
+	}
+	if !resp.StartedAt.Equal(startTime) || resp.StartedAt.After(time.Now()) {
+		t.Errorf("Unexpected start time %v", resp.StartedAt)
+	}
+}
+
+// TestReadDownwardAPIFile checks quoted values are unquoted and a missing
+// file gives nothing.
+func TestReadDownwardAPIFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "annotations")
+	data := `app.kubernetes.io/name="hello"` + "\n" + `note="say \"hi\"\nthen leave"` + "\n" + "garbage\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"app.kubernetes.io/name": "hello", "note": "say \"hi\"\nthen leave"}
+	if got := readDownwardAPIFile(path); !maps.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := readDownwardAPIFile(filepath.Join(t.TempDir(), "labels")); got != nil {
+		t.Errorf("Expected nil for a missing file, got %v", got)
+	}
+}
+
+// TestCurrentInstancePodInfo checks metadata is read from the volume, with
+// files taking precedence over environment variables.
+func TestCurrentInstancePodInfo(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"labels":      `app="hello"` + "\n" + `tier="web"`,
+		"annotations": lastAppliedAnnotation + `="{\"secret\":\"x\"}"` + "\n" + `team="devops"`,
+		"cpu_limit":   "500\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("CPU_LIMIT", "2")
+	t.Setenv("MEMORY_LIMIT", "134217728")
+
+	inst := currentInstance(time.Now(), dir)
+	if !maps.Equal(inst.Labels, map[string]string{"app": "hello", "tier": "web"}) {
+		t.Errorf("Unexpected labels %v", inst.Labels)
+	}
+	if !maps.Equal(inst.Annotations, map[string]string{"team": "devops"}) {
+		t.Errorf("Expected the last-applied-configuration annotation to be dropped, got %v", inst.Annotations)
+	}
+	if inst.Resources == nil || inst.Resources.CPULimit != "500" || inst.Resources.MemoryLimit != "134217728" {
+		t.Errorf("Unexpected resources %+v", inst.Resources)
+	}
+
+	// Outside Kubernetes there's nothing to report.
+	t.Setenv("CPU_LIMIT", "")
+	t.Setenv("MEMORY_LIMIT", "")
+	inst = currentInstance(time.Now(), t.TempDir())
+	if inst.Labels != nil || inst.Annotations != nil || inst.Resources != nil {
+		t.Errorf("Expected no pod metadata, got %+v", inst)
+	}
+}
+
+// TestPodLogAttrs checks log attributes are only added in a pod.
+func TestPodLogAttrs(t *testing.T) {
+	t.Setenv("POD_NAME", "")
+	if attrs := podLogAttrs(); attrs != nil {
+		t.Errorf("Expected no attributes outside a pod, got %v", attrs)
+	}
+
+	t.Setenv("POD_NAME", "app-1")
+	t.Setenv("POD_NAMESPACE", "default")
+	t.Setenv("NODE_NAME", "")
+	want := []any{"pod", "app-1", "namespace", "default"}
+	if attrs := podLogAttrs(); !slices.Equal(attrs, want) {
+		t.Errorf("Expected %v, got %v", want, attrs)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// This file implements background jobs and the worker that runs them. Some
+// work doesn't belong in a request: it's slow, like sending an email, or it
+// can fail and be retried later without the visitor waiting. The web server
+// puts a job on a queue and answers straight away; a worker takes it off
+// and does the work.
+//
+// The web server and the worker are the same binary. "serve" listens for
+// HTTP, and "worker" doesn't listen at all: it only takes jobs off the
+// queue. They share the code, the configuration and the job handlers, and
+// are deployed and scaled separately, the web+worker split Heroku made
+// popular. Run several workers for more throughput; each job goes to one.
+//
+// The queue is a Redis list (REDIS_URL, see redis.go): jobs are pushed on
+// with LPUSH and taken off the other end with RPOP, oldest first. The
+// worker polls every jobPollInterval, and works through everything queued
+// before waiting again. A job that fails is put back at the end of the
+// queue for another attempt, up to maxJobAttempts, and then moved to the
+// jobsFailedKey list for a person to look at; either way the worker waits
+// for the next poll before going on, rather than retrying at full speed. A worker killed in the middle of a job loses it; a
+// queue that can't lose anything moves jobs to a processing list with
+// LMOVE, at the cost of having to recover them from it.
+//
+// Jobs are queued with POST /admin/jobs, or from code with s.enqueueJob.
+// Each has a type naming its handler. The built-in ones are "email", which
+// sends an Email, and "log", which logs its payload and is handy for
+// trying things out. Forks add their own with RegisterJobHandler, like
+// routes and health checks (see extensions.go):
+//
+//	func init() {
+//		RegisterJobHandler("thumbnail", (*Server).thumbnailJob)
+//	}
+//
+// On SIGTERM the worker finishes the job it's running, then exits.
+
+// Redis keys of the job queue and of the jobs that failed for good.
+const (
+	jobsKey       = "jobs"
+	jobsFailedKey = "jobs:failed"
+)
+
+// jobPollInterval is how often an idle worker checks the queue.
+const jobPollInterval = time.Second
+
+// jobTimeout limits how long one attempt at a job can take.
+const jobTimeout = time.Minute
+
+// maxJobAttempts is how many times a job is tried before it's given up on.
+const maxJobAttempts = 3
+
+// Job is a unit of work for a worker.
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Attempts   int             `json:"attempts"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	LastError  string          `json:"last_error,omitempty"`
+}
+
+// JobRequest is the JSON body accepted by POST /admin/jobs.
+type JobRequest struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// JobQueueResponse is the JSON body returned by GET /admin/jobs.
+type JobQueueResponse struct {
+	Queued int64 `json:"queued"`
+	Failed int64 `json:"failed"`
+}
+
+// EmailJob is the payload of an "email" job.
+type EmailJob struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+// jobHandler does the work of a job with the given payload.
+type jobHandler func(s *Server, ctx context.Context, payload json.RawMessage) error
+
+// jobHandlers holds the handlers, by job type.
+var jobHandlers struct {
+	mu       sync.Mutex
+	handlers map[string]jobHandler
+}
+
+func init() {
+	RegisterJobHandler("email", (*Server).emailJob)
+	RegisterJobHandler("log", (*Server).logJob)
+}
+
+// RegisterJobHandler adds the handler for jobs of a type. Like
+// RegisterRoute, it's meant to be called from init functions and panics on
+// a mistake (an empty or duplicate type, a nil handler).
+func RegisterJobHandler(jobType string, handler func(s *Server, ctx context.Context, payload json.RawMessage) error) {
+	jobHandlers.mu.Lock()
+	defer jobHandlers.mu.Unlock()
+	switch {
+	case jobType == "":
+		panic("RegisterJobHandler: empty job type")
+	case handler == nil:
+		panic(fmt.Sprintf("RegisterJobHandler: nil handler for %q", jobType))
+	case jobHandlers.handlers[jobType] != nil:
+		panic(fmt.Sprintf("RegisterJobHandler: duplicate job type %q", jobType))
+	}
+	if jobHandlers.handlers == nil {
+		jobHandlers.handlers = make(map[string]jobHandler)
+	}
+	jobHandlers.handlers[jobType] = handler
+}
+
+// lookupJobHandler returns the handler for jobs of a type, or nil.
+func lookupJobHandler(jobType string) jobHandler {
+	jobHandlers.mu.Lock()
+	defer jobHandlers.mu.Unlock()
+	return jobHandlers.handlers[jobType]
+}
+
+// errNoQueue means there's no Redis to queue jobs in, and
+// errUnknownJobType that no handler was registered for a job's type.
+var (
+	errNoQueue        = errors.New("jobs need REDIS_URL")
+	errUnknownJobType = errors.New("unknown job type")
+)
+
+// enqueueJob puts a job on the queue and returns it.
+func (s *Server) enqueueJob(ctx context.Context, jobType string, payload json.RawMessage) (Job, error) {
+	if s.redis == nil {
+		return Job{}, errNoQueue
+	}
+	if lookupJobHandler(jobType) == nil {
+		return Job{}, fmt.Errorf("%w %q", errUnknownJobType, jobType)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := Job{ID: hex.EncodeToString(id), Type: jobType, Payload: payload, EnqueuedAt: s.clock.Now()}
+	return job, s.pushJob(ctx, jobsKey, job)
+}
+
+// pushJob adds job to the list at key.
+func (s *Server) pushJob(ctx context.Context, key string, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.Do(ctx, "LPUSH", key, string(data))
+	return err
+}
+
+// runWorker runs jobs from the queue until ctx is cancelled.
+func (s *Server) runWorker(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil && s.workOnce(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// workOnce runs the oldest job on the queue, if there is one, and reports
+// whether it went on to the next one: it stops when the queue is empty, and
+// after a failure.
+func (s *Server) workOnce(ctx context.Context) bool {
+	reply, err := s.redis.Do(ctx, "RPOP", jobsKey)
+	if err != nil {
+		slog.Warn("Can't read the job queue", "error", err)
+		return false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return false
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		slog.Error("Dropped a job that isn't valid JSON", "error", err)
+		return true
+	}
+
+	// A job that has started is finished, even when the worker is asked
+	// to stop.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jobTimeout)
+	defer cancel()
+	start := time.Now()
+	job.Attempts++
+	err = s.runJob(ctx, job)
+	log := slog.With("job_id", job.ID, "type", job.Type, "attempt", job.Attempts)
+	if err == nil {
+		log.Info("Job done", "duration", time.Since(start))
+		return true
+	}
+
+	job.LastError = err.Error()
+	key := jobsKey
+	if job.Attempts >= maxJobAttempts {
+		key = jobsFailedKey
+		log.Error("Job failed for good", "error", err)
+	} else {
+		log.Warn("Job failed, will retry", "error", err)
+	}
+	if err := s.pushJob(ctx, key, job); err != nil {
+		log.Error("Lost a failed job", "error", err)
+	}
+	return false
+}
+
+// runJob runs job's handler, turning a panic into an error.
+func (s *Server) runJob(ctx context.Context, job Job) (err error) {
+	handler := lookupJobHandler(job.Type)
+	if handler == nil {
+		return fmt.Errorf("%w %q", errUnknownJobType, job.Type)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return handler(s, ctx, job.Payload)
+}
+
+// emailJob sends the EmailJob in payload.
+func (s *Server) emailJob(ctx context.Context, payload json.RawMessage) error {
+	var job EmailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	if s.mailer == nil {
+		return errors.New("no mailer: set SMTP_HOST")
+	}
+	email := Email{Subject: job.Subject, Body: job.Body}
+	for _, to := range job.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("to: %q is not an email address", to)
+		}
+		email.To = append(email.To, addr)
+	}
+	if len(email.To) == 0 {
+		return errors.New("to: no addresses")
+	}
+	return s.mailer.Send(ctx, email)
+}
+
+// logJob logs its payload.
+func (s *Server) logJob(ctx context.Context, payload json.RawMessage) error {
+	slog.InfoContext(ctx, "Log job", "payload", string(payload))
+	return nil
+}
+
+// handleEnqueueJob queues the job in the request body.
+func (s *Server) handleEnqueueJob(w http.ResponseWriter, r *http.Request) {
+	var req JobRequest
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBody))
+	if err == nil {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "request body must be a JSON job")
+		return
+	}
+
+	job, err := s.enqueueJob(r.Context(), req.Type, req.Payload)
+	switch {
+	case errors.Is(err, errNoQueue):
+		writeProblem(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, errUnknownJobType):
+		writeProblem(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		writeProblem(w, http.StatusBadGateway, "the job couldn't be queued: "+err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// handleJobQueue reports how many jobs are queued and failed.
+func (s *Server) handleJobQueue(w http.ResponseWriter, r *http.Request) {
+	if s.redis == nil {
+		writeProblem(w, http.StatusServiceUnavailable, errNoQueue.Error())
+		return
+	}
+	replies, err := s.redis.Pipeline(r.Context(), []string{"LLEN", jobsKey}, []string{"LLEN", jobsFailedKey})
+	if err != nil {
+		writeProblem(w, http.StatusBadGateway, "can't read the job queue: "+err.Error())
+		return
+	}
+	queued, _ := replies[0].(int64)
+	failed, _ := replies[1].(int64)
+	writeJSON(w, http.StatusOK, JobQueueResponse{Queued: queued, Failed: failed})
+}
+
+// runWorkerCommand runs jobs until the process is asked to stop.
+func runWorkerCommand(args []string, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := parseFlags(newFlagSet("worker", stderr), args); err != nil {
+		return err
+	}
+	cfg, vault, err := withVaultSecrets(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.RedisURL == "" {
+		return errNoQueue
+	}
+
+	srv := newServer(cfg)
+	srv.vault = vault
+	slog.SetDefault(slog.New(traceLogHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: srv.logLevel})}).With(podLogAttrs()...))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	slog.Info("Worker started", "queue", jobsKey)
+	go srv.renewVault(ctx)
+	srv.runWorker(ctx, jobPollInterval)
+	slog.Info("Worker stopped")
+	return nil
+}
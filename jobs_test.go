@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// failingJobRuns counts the runs of the "test-fail" job, which always
+// fails.
+var failingJobRuns atomic.Int32
+
+func init() {
+	RegisterJobHandler("test-fail", func(s *Server, ctx context.Context, payload json.RawMessage) error {
+		failingJobRuns.Add(1)
+		return errors.New("broken")
+	})
+}
+
+// newJobServer returns a server queueing jobs in a fake Redis, on a fake
+// clock, with a client for its API.
+func newJobServer(t *testing.T) (*Server, *testsupport.Client, *fakeRedis, *fakeClock) {
+	redis := newFakeRedis(t, "")
+	cfg := defaultConfig(t)
+	cfg.RedisURL = redis.URL()
+	cfg.RedisTimeout = time.Second
+	s := newServer(cfg)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	return s, testsupport.New(t, s.handler()), redis, clock
+}
+
+// TestJobs queues an email job through the admin API and has a worker
+// send it.
+func TestJobs(t *testing.T) {
+	openAdmin(t)
+	s, c, _, clock := newJobServer(t)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+
+	job := testsupport.Decode[Job](c.Post("/admin/jobs", map[string]any{
+		"type":    "email",
+		"payload": EmailJob{To: []string{"ops@example.com"}, Subject: "Report", Body: "All good"},
+	}).Status(http.StatusAccepted))
+	if job.ID == "" || job.Type != "email" || !job.EnqueuedAt.Equal(clock.Now()) {
+		t.Errorf("Unexpected job %+v", job)
+	}
+	c.Get("/admin/jobs").Status(http.StatusOK).JSON(`{"queued": 1, "failed": 0}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.runWorker(ctx, time.Second)
+	eventually(t, func() bool { return len(mailer.Sent()) == 1 })
+	if email := mailer.Sent()[0]; email.To[0].Address != "ops@example.com" || email.Subject != "Report" || email.Body != "All good" {
+		t.Errorf("Unexpected email %+v", email)
+	}
+	c.Get("/admin/jobs").Status(http.StatusOK).JSON(`{"queued": 0, "failed": 0}`)
+}
+
+// TestJobRetries checks a failing job is tried maxJobAttempts times, a
+// poll apart, then moved to the failed list.
+func TestJobRetries(t *testing.T) {
+	openAdmin(t)
+	s, c, redis, clock := newJobServer(t)
+	failingJobRuns.Store(0)
+	c.Post("/admin/jobs", map[string]string{"type": "test-fail"}).Status(http.StatusAccepted)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.runWorker(ctx, time.Second)
+	eventually(t, func() bool { return failingJobRuns.Load() == 1 && clock.Waiters() == 1 })
+	for attempt := int32(2); attempt <= maxJobAttempts; attempt++ {
+		clock.Advance(time.Second)
+		eventually(t, func() bool { return failingJobRuns.Load() == attempt })
+	}
+	eventually(t, func() bool {
+		return strings.Contains(strings.Join(redis.Commands(), "\n"), "LPUSH jobs:failed")
+	})
+	c.Get("/admin/jobs").Status(http.StatusOK).JSON(`{"queued": 0, "failed": 1}`)
+
+	redis.mu.Lock()
+	var failed Job
+	json.Unmarshal([]byte(redis.lists[jobsFailedKey][0]), &failed)
+	redis.mu.Unlock()
+	if failed.Attempts != maxJobAttempts || failed.LastError != "broken" {
+		t.Errorf("Expected the failed job's attempts and error kept, got %+v", failed)
+	}
+}
+
+// TestEnqueueJobErrors checks unknown job types and a missing queue are
+// rejected.
+func TestEnqueueJobErrors(t *testing.T) {
+	openAdmin(t)
+	_, c, _, _ := newJobServer(t)
+	c.Post("/admin/jobs", map[string]string{"type": "nope"}).Status(http.StatusUnprocessableEntity)
+	c.Post("/admin/jobs", "not json").Status(http.StatusBadRequest)
+
+	_, plain := newTestServer(t)
+	plain.Post("/admin/jobs", map[string]string{"type": "log"}).Status(http.StatusServiceUnavailable)
+	plain.Get("/admin/jobs").Status(http.StatusServiceUnavailable)
+}
+
+// TestWorkerCommandNeedsRedis checks the worker won't start without a
+// queue.
+func TestWorkerCommandNeedsRedis(t *testing.T) {
+	t.Setenv("REDIS_URL", "")
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"worker"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "REDIS_URL") {
+		t.Errorf("Expected exit code 1 asking for REDIS_URL, got %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file issues and verifies JSON Web Tokens (RFC 7519), and publishes
+// the keys that verify them at /.well-known/jwks.json, so other services
+// can check a token without asking this one. A JWT is three base64url
+// parts joined by dots: a header naming the algorithm and key, the claims
+// (who it's for, and until when), and a signature over the first two:
+//
+//	eyJhbGciOiJFZERTQSIsImtpZCI6Ii4uLiJ9.eyJzdWIiOiJhbGljZSIsImV4cCI6Li4ufQ.<signature>
+//
+// Tokens are signed with Ed25519 ("EdDSA", RFC 8037), whose public keys are
+// small and whose signatures are fast to check.
+//
+// Tokens come from two places, and say which in their audience ("aud"), so
+// one can't be used for the other's purpose:
+//   - An operator issues gateway tokens with POST /admin/tokens. Gateway
+//     routes that need an API key accept one instead (see proxy.go).
+//   - Users get user tokens by signing in (see users.go), which are only
+//     good for their own account, at /api/v1/me. Anyone can register, so
+//     these mustn't open the gateway.
+//
+// A token also names the tenant it was issued in, and is only accepted
+// there.
+//
+// The signing key changes every JWT_KEY_ROTATION. Rather than being made
+// at random and stored somewhere every instance can reach, each period's
+// key is derived from JWT_SECRET and the period's number, so every
+// instance signs with the same key without talking to the others, and
+// restarts don't invalidate tokens. A retired key is still accepted, and
+// published, for JWT_KEY_GRACE, so tokens signed just before a rotation
+// stay valid until they expire. The next period's key is published ahead
+// of time too, so a verifier that caches the key set already has it when
+// tokens signed with it arrive. Keep JWT_SECRET secret: every key can be
+// derived from it. Without it, a random secret is made at startup, which
+// is fine for one instance in development.
+
+// jwtAlgorithm is the only algorithm tokens are signed or accepted with.
+// Accepting whatever the header says is the classic JWT vulnerability:
+// "none", or an HMAC keyed with the public key.
+const jwtAlgorithm = "EdDSA"
+
+// The audiences tokens are issued for.
+const (
+	jwtAudienceGateway = "gateway"
+	jwtAudienceUser    = "user"
+)
+
+// b64url is the encoding of every part of a JWT and of JWK key values.
+var b64url = base64.RawURLEncoding
+
+// jwtKey is one period's signing key.
+type jwtKey struct {
+	id      string // the kid: the key's RFC 7638 thumbprint
+	period  int64
+	private ed25519.PrivateKey
+}
+
+// JWK is a public key in a JWKS (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS is the body of GET /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWTClaims are the claims of the tokens this server issues.
+type JWTClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	Tenant    string `json:"tenant"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// TokenRequest is the JSON body of POST /admin/tokens.
+type TokenRequest struct {
+	Subject   string `json:"subject"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// TokenResponse is an issued token, as OAuth 2.0 returns them (RFC 6749).
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+
+	// RefreshToken gets a new access token when this one expires; see
+	// refresh.go.
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// jwtKeyRing derives the keys from the secret, remembering the ones in use.
+type jwtKeyRing struct {
+	secret []byte
+	mu     sync.Mutex
+	keys   map[int64]*jwtKey
+}
+
+// newJWTKeyRing returns the key ring for secret, or for a random secret if
+// it's empty.
+func newJWTKeyRing(secret string) *jwtKeyRing {
+	kr := &jwtKeyRing{secret: []byte(secret), keys: make(map[int64]*jwtKey)}
+	if secret == "" {
+		kr.secret = make([]byte, 32)
+		rand.Read(kr.secret)
+	}
+	return kr
+}
+
+// key returns period's key.
+func (kr *jwtKeyRing) key(period int64) *jwtKey {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if key, ok := kr.keys[period]; ok {
+		return key
+	}
+	mac := hmac.New(sha256.New, kr.secret)
+	fmt.Fprintf(mac, "jwt-signing-key/%d", period)
+	private := ed25519.NewKeyFromSeed(mac.Sum(nil))
+	key := &jwtKey{id: jwkThumbprint(private.Public().(ed25519.PublicKey)), period: period, private: private}
+	kr.keys[period] = key
+	return key
+}
+
+// keysAt returns the key that signs at now, and every key that verifies:
+// that one, the next one and those retired less than grace ago, newest
+// first.
+func (kr *jwtKeyRing) keysAt(now time.Time, rotation, grace time.Duration) (signing *jwtKey, valid []*jwtKey) {
+	seconds := int64(rotation / time.Second)
+	current := now.Unix() / seconds
+	signing = kr.key(current)
+	valid = []*jwtKey{kr.key(current + 1), signing}
+	// Period p's key retires at the start of period p+1.
+	oldest := current
+	for p := current - 1; time.Unix((p+1)*seconds, 0).Add(grace).After(now); p-- {
+		valid = append(valid, kr.key(p))
+		oldest = p
+	}
+
+	// Forget keys that are too old to be used again.
+	kr.mu.Lock()
+	for p := range kr.keys {
+		if p < oldest {
+			delete(kr.keys, p)
+		}
+	}
+	kr.mu.Unlock()
+	return signing, valid
+}
+
+// jwkThumbprint returns an Ed25519 key's RFC 7638 thumbprint: the SHA-256
+// of its JWK's required members, in order, without spaces.
+func jwkThumbprint(public ed25519.PublicKey) string {
+	sum := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + b64url.EncodeToString(public) + `"}`))
+	return b64url.EncodeToString(sum[:])
+}
+
+// issueJWT signs a token for subject in tenant, for audience, that expires
+// after ttl.
+func (s *Server) issueJWT(tenant, audience, subject string, ttl time.Duration) (string, JWTClaims) {
+	cfg := s.config()
+	now := s.clock.Now()
+	key, _ := s.jwtKeys.keysAt(now, cfg.JWTKeyRotation, cfg.JWTKeyGrace)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	claims := JWTClaims{
+		Issuer:    cfg.JWTIssuer,
+		Subject:   subject,
+		Audience:  audience,
+		Tenant:    tenant,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        b64url.EncodeToString(id),
+	}
+	header, _ := json.Marshal(map[string]string{"alg": jwtAlgorithm, "typ": "JWT", "kid": key.id})
+	payload, _ := json.Marshal(claims)
+	signed := b64url.EncodeToString(header) + "." + b64url.EncodeToString(payload)
+	return signed + "." + b64url.EncodeToString(ed25519.Sign(key.private, []byte(signed))), claims
+}
+
+// verifyJWT checks a token's signature, issuer and expiry, and returns its
+// claims.
+func (s *Server) verifyJWT(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return JWTClaims{}, errors.New("not a JWT")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if data, err := b64url.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		return JWTClaims{}, errors.New("the token's header is malformed")
+	}
+	if header.Algorithm != jwtAlgorithm {
+		return JWTClaims{}, fmt.Errorf("the token is signed with %q, not %s", header.Algorithm, jwtAlgorithm)
+	}
+	signature, err := b64url.DecodeString(parts[2])
+	if err != nil {
+		return JWTClaims{}, errors.New("the token's signature is malformed")
+	}
+
+	cfg := s.config()
+	now := s.clock.Now()
+	_, valid := s.jwtKeys.keysAt(now, cfg.JWTKeyRotation, cfg.JWTKeyGrace)
+	var key *jwtKey
+	for _, k := range valid {
+		if k.id == header.KeyID {
+			key = k
+		}
+	}
+	if key == nil {
+		return JWTClaims{}, errors.New("the token's key is unknown or has been retired")
+	}
+	if !ed25519.Verify(key.private.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), signature) {
+		return JWTClaims{}, errors.New("the token's signature is invalid")
+	}
+
+	// Only now that the signature's known to be good are the claims read.
+	var claims JWTClaims
+	if data, err := b64url.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return JWTClaims{}, errors.New("the token's claims are malformed")
+	}
+	if claims.Issuer != cfg.JWTIssuer {
+		return JWTClaims{}, fmt.Errorf("the token was issued by %q", claims.Issuer)
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return JWTClaims{}, errors.New("the token has expired")
+	}
+	return claims, nil
+}
+
+// bearerJWT returns the claims of the valid JWT in a request's
+// Authorization header, if it has one issued for audience in the request's
+// tenant.
+func (s *Server) bearerJWT(r *http.Request, audience string) (JWTClaims, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.Count(token, ".") != 2 {
+		return JWTClaims{}, false
+	}
+	claims, err := s.verifyJWT(token)
+	if err != nil || claims.Audience != audience || claims.Tenant != tenantFromContext(r.Context()) {
+		return JWTClaims{}, false
+	}
+	return claims, true
+}
+
+// handleJWKS serves the public keys that verify tokens: the signing key,
+// the next one and those still in their grace period.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	_, valid := s.jwtKeys.keysAt(s.clock.Now(), cfg.JWTKeyRotation, cfg.JWTKeyGrace)
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range valid {
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         b64url.EncodeToString(key.private.Public().(ed25519.PublicKey)),
+			KeyID:     key.id,
+			Use:       "sig",
+			Algorithm: jwtAlgorithm,
+		})
+	}
+	// Verifiers may cache the keys for a while; the next key is published
+	// a whole period ahead, so there's no hurry.
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(min(cfg.JWTKeyRotation/2, time.Hour)/time.Second)))
+	writeJSON(w, http.StatusOK, jwks)
+}
+
+// handleIssueToken issues a gateway token, for testing services that
+// accept them:
+//
+//	curl -X POST -d '{"subject": "alice"}' http://localhost:8000/admin/tokens
+func (s *Server) handleIssueToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if !decodeValid(w, r, "token-request", &req) {
+		return
+	}
+	cfg := s.config()
+	ttl := cfg.JWTTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > cfg.JWTKeyGrace {
+		writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("a token can't outlive its key's grace period, JWT_KEY_GRACE (%s)", cfg.JWTKeyGrace))
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.issueTokens(tenantFromContext(r.Context()), jwtAudienceGateway, req.Subject, "", ttl))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestIssueToken issues a token through the admin API and checks it
+// verifies until it expires, and that forgeries don't.
+func TestIssueToken(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+
+	resp := testsupport.Decode[TokenResponse](c.Post("/admin/tokens", map[string]any{"subject": "alice"}).Status(http.StatusCreated))
+	if resp.TokenType != "Bearer" || resp.ExpiresIn != 15*60 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	claims, err := s.verifyJWT(resp.AccessToken)
+	if err != nil || claims.Subject != "alice" || claims.Issuer != "go-hello-devops" || claims.ExpiresAt != clock.Now().Add(15*time.Minute).Unix() {
+		t.Fatalf("Expected the token to verify, got %+v %v", claims, err)
+	}
+	c.Post("/admin/tokens", map[string]any{"subject": "bob", "expires_in": 86400 + 1}).Status(http.StatusUnprocessableEntity)
+	s.cfg.JWTKeyGrace = time.Hour
+	c.Post("/admin/tokens", map[string]any{"subject": "bob", "expires_in": 7200}).
+		Status(http.StatusUnprocessableEntity).
+		JSON(`{"detail": "a token can't outlive its key's grace period, JWT_KEY_GRACE (1h0m0s)", "...": "..."}`)
+
+	parts := strings.Split(resp.AccessToken, ".")
+	header, payload, signature := parts[0], parts[1], parts[2]
+	forged := strings.Replace(string(mustDecodeB64URL(t, payload)), "alice", "admin", 1)
+	for name, token := range map[string]string{
+		"changed claims": header + "." + b64url.EncodeToString([]byte(forged)) + "." + signature,
+		"alg none":       b64url.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + payload + ".",
+		"no signature":   header + "." + payload,
+	} {
+		if _, err := s.verifyJWT(token); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+
+	s.cfg.JWTIssuer = "someone-else"
+	if _, err := s.verifyJWT(resp.AccessToken); err == nil || !strings.Contains(err.Error(), "issued by") {
+		t.Errorf("Expected another issuer's token to be rejected, got %v", err)
+	}
+	s.cfg.JWTIssuer = "go-hello-devops"
+	clock.Advance(15 * time.Minute)
+	if _, err := s.verifyJWT(resp.AccessToken); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the token to expire, got %v", err)
+	}
+}
+
+// mustDecodeB64URL decodes a part of a JWT.
+func mustDecodeB64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := b64url.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestJWTKeyRotation checks the signing key changes every period, the
+// retired one is published and accepted through its grace period, and a
+// verifier can check tokens with the published keys alone.
+func TestJWTKeyRotation(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.cfg.JWTKeyRotation, s.cfg.JWTKeyGrace = time.Hour, 90*time.Minute
+
+	kids := func() []string {
+		jwks := testsupport.Decode[JWKS](c.Get("/.well-known/jwks.json").Status(http.StatusOK).HasHeader("Cache-Control", "public, max-age=1800"))
+		var ids []string
+		for _, key := range jwks.Keys {
+			ids = append(ids, key.KeyID)
+		}
+		return ids
+	}
+	kid := func(token string) string {
+		header, _, _ := strings.Cut(token, ".")
+		return strings.Split(strings.Split(string(mustDecodeB64URL(t, header)), `"kid":"`)[1], `"`)[0]
+	}
+
+	old, _ := s.issueJWT(defaultTenant, jwtAudienceGateway, "alice", time.Hour)
+	if got := kids(); len(got) != 3 || got[1] != kid(old) {
+		t.Fatalf("Expected the next, current and previous keys, got %v", got)
+	}
+	next := kids()[0]
+
+	// At 10:00 the next key takes over; the old one is still good until
+	// 11:30.
+	clock.Advance(30 * time.Minute)
+	current, _ := s.issueJWT(defaultTenant, jwtAudienceGateway, "bob", time.Hour)
+	if kid(current) != next || kid(current) == kid(old) {
+		t.Errorf("Expected the published next key to sign, got %s", kid(current))
+	}
+	if _, err := s.verifyJWT(old); err != nil {
+		t.Errorf("Expected the old key to be accepted in its grace period, got %v", err)
+	}
+
+	// A third party verifies with the published keys.
+	jwks := testsupport.Decode[JWKS](c.Get("/.well-known/jwks.json"))
+	signed, signature := current[:strings.LastIndex(current, ".")], mustDecodeB64URL(t, current[strings.LastIndex(current, ".")+1:])
+	verified := false
+	for _, key := range jwks.Keys {
+		if key.KeyID == kid(current) {
+			verified = ed25519.Verify(mustDecodeB64URL(t, key.X), []byte(signed), signature)
+		}
+	}
+	if !verified {
+		t.Error("Expected the token to verify with its published key")
+	}
+
+	clock.Advance(90 * time.Minute)
+	if _, err := s.verifyJWT(old); err == nil || !strings.Contains(err.Error(), "retired") {
+		t.Errorf("Expected the old key to be retired, got %v", err)
+	}
+	for _, id := range kids() {
+		if id == kid(old) {
+			t.Error("Expected the retired key to be unpublished")
+		}
+	}
+
+	// Instances with the same secret sign with the same keys.
+	s.cfg.JWTSecret = strings.Repeat("s", 32)
+	a, b := newServer(s.cfg), newServer(s.cfg)
+	a.useClock(clock)
+	b.useClock(clock)
+	token, _ := a.issueJWT(defaultTenant, jwtAudienceGateway, "carol", time.Minute)
+	if _, err := b.verifyJWT(token); err != nil {
+		t.Errorf("Expected another instance to accept the token, got %v", err)
+	}
+	if _, err := s.verifyJWT(token); err == nil {
+		t.Error("Expected an instance with another secret to reject it")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLandingPageCache checks the page is rendered once per banner, and
+// answers If-None-Match with 304.
+func TestLandingPageCache(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.BannerText = "Maintenance tonight"
+	s := newServer(cfg)
+	mux := s.routes()
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || !strings.Contains(first.Body.String(), "Maintenance tonight") {
+		t.Fatalf("Expected the page with an ETag, got %d %v", first.Code, first.Header())
+	}
+	cached := s.landing.Load()
+	if get("").Body.String() != first.Body.String() || s.landing.Load() != cached {
+		t.Error("Expected the cached page to be served again")
+	}
+	if rec := get(etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+
+	// A new banner means a new page, and old copies are out of date.
+	cfg.BannerText = "All done"
+	s.cfgMu.Lock()
+	s.cfg = cfg
+	s.cfgMu.Unlock()
+	rec := get(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag || !strings.Contains(rec.Body.String(), "All done") {
+		t.Errorf("Expected the page re-rendered for the new banner, got %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+)
+
+// This file implements /learn, a short series of exercises that get you
+// changing this server's code. Each exercise comes with a check: the
+// verify endpoint builds a fresh server from the code that's running now,
+// sends it requests the way a test would, and reports which steps pass.
+// Make a change, restart the server ("go run ."), verify, repeat.
+//
+// The checks use the server's own router in memory (no network), so they
+// see exactly the routes and handlers compiled into the binary.
+
+// originalMessage is what GET /api/message says before anyone edits it.
+const originalMessage = "This is your first API endpoint! Try modifying this message."
+
+// Exercise is one task in the /learn series.
+type Exercise struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Hint        string `json:"hint"`
+
+	// check runs the exercise's steps against a server built from cfg.
+	check func(cfg Config) []CheckStep
+}
+
+// CheckStep is the outcome of one step of an exercise's check.
+type CheckStep struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// VerifyResponse is the JSON body returned by the verify endpoint.
+type VerifyResponse struct {
+	Exercise string      `json:"exercise"`
+	Passed   bool        `json:"passed"`
+	Steps    []CheckStep `json:"steps"`
+	Next     string      `json:"next,omitempty"` // the following exercise
+}
+
+// ExerciseListResponse is the JSON body returned by
+// GET /api/v1/learn/exercises.
+type ExerciseListResponse struct {
+	Exercises []Exercise `json:"exercises"`
+}
+
+// LearnPage is the data for the learn template: every exercise with the
+// result of checking it, and the learner's badges.
+type LearnPage struct {
+	Exercises []VerifiedExercise
+	Passed    int
+	Badges    []Badge
+}
+
+// VerifiedExercise is an exercise with its check result.
+type VerifiedExercise struct {
+	Exercise
+	Result VerifyResponse
+}
+
+// exercises returns the series, in the order they should be done. It's a
+// function rather than a variable because the checks build servers, whose
+// routes include the /learn handlers that list the exercises: as a
+// variable, it would depend on itself.
+func exercises() []Exercise {
+	return []Exercise{
+		{
+			ID:    "change-message",
+			Title: "Change a message",
+			Description: "GET /api/message returns a JSON message inviting you to change it. " +
+				"Change it to anything you like.",
+			Hint: "Look for handleMessage in main.go.",
+			check: func(cfg Config) []CheckStep {
+				rec := probe(cfg, http.MethodGet, "/api/message")
+				var body struct {
+					Message string `json:"message"`
+				}
+				steps := []CheckStep{expectStatus(rec, http.StatusOK), expectJSON(rec, &body)}
+				return append(steps, CheckStep{
+					Name:   "message has changed",
+					Passed: body.Message != "" && body.Message != originalMessage,
+					Detail: fmt.Sprintf("got %q", body.Message),
+				})
+			},
+		},
+		{
+			ID:    "hello-endpoint",
+			Title: "Add an endpoint",
+			Description: `Add GET /api/v1/hello, returning the JSON {"message": "Hello, DevOps!"} ` +
+				"with status 200.",
+			Hint: "Write a handler like handleMessage, register it in routes() in server.go " +
+				"and send the response with writeJSON.",
+			check: func(cfg Config) []CheckStep {
+				rec := probe(cfg, http.MethodGet, "/api/v1/hello")
+				var body struct {
+					Message string `json:"message"`
+				}
+				steps := []CheckStep{expectStatus(rec, http.StatusOK), expectJSON(rec, &body)}
+				return append(steps, CheckStep{
+					Name:   `message is "Hello, DevOps!"`,
+					Passed: body.Message == "Hello, DevOps!",
+					Detail: fmt.Sprintf("got %q", body.Message),
+				})
+			},
+		},
+		{
+			ID:    "readyz-maintenance",
+			Title: "Make /readyz fail",
+			Description: "Kubernetes asks a readiness probe, GET /readyz, whether a pod should get traffic; " +
+				"a pod that's not ready is taken out of the load balancer without being restarted. " +
+				"Make /readyz return 503 Service Unavailable while the maintenance feature flag is on " +
+				"(FEATURE_FLAGS=maintenance), as well as while shutting down, and 200 otherwise.",
+			Hint: "See handleReadyz in shutdown.go, and check " +
+				`slices.Contains(s.config().FeatureFlags, "maintenance"). Try toggling it with a reload.`,
+			check: func(cfg Config) []CheckStep {
+				cfg.FeatureFlags = slices.DeleteFunc(slices.Clone(cfg.FeatureFlags), func(f string) bool { return f == "maintenance" })
+				normal := expectStatus(probe(cfg, http.MethodGet, "/readyz"), http.StatusOK)
+				normal.Name = "without the flag: " + normal.Name
+
+				cfg.FeatureFlags = append(cfg.FeatureFlags, "maintenance")
+				maintenance := expectStatus(probe(cfg, http.MethodGet, "/readyz"), http.StatusServiceUnavailable)
+				maintenance.Name = "with the flag: " + maintenance.Name
+				return []CheckStep{normal, maintenance}
+			},
+		},
+		{
+			ID:    "version-header",
+			Title: "Write a middleware",
+			Description: "Add an X-App-Version header, holding the app's version, to every response. " +
+				"Doing it once in a middleware beats repeating it in every handler.",
+			Hint: "See loggingMiddleware in main.go for the shape of a middleware, and add yours " +
+				"to middlewareOrder and the routes group in chain.go. The version is in the version variable.",
+			check: func(cfg Config) []CheckStep {
+				var steps []CheckStep
+				for _, path := range []string{"/health", "/api/message", "/no-such-page"} {
+					got := probe(cfg, http.MethodGet, path).Header().Get("X-App-Version")
+					steps = append(steps, CheckStep{
+						Name:   "X-App-Version on " + path,
+						Passed: got == version,
+						Detail: fmt.Sprintf("want %q, got %q", version, got),
+					})
+				}
+				return steps
+			},
+		},
+	}
+}
+
+// probe sends a request to a new server built from cfg, and returns the
+// response. A new server is used so checks can change the configuration
+// without touching the running one. Checks expect plain JSON, so envelope
+// mode is turned off.
+func probe(cfg Config, method, path string) *httptest.ResponseRecorder {
+	cfg.ResponseEnvelope = false
+	rec := httptest.NewRecorder()
+	newServer(cfg).routes().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+// expectStatus checks a response's status code.
+func expectStatus(rec *httptest.ResponseRecorder, want int) CheckStep {
+	return CheckStep{
+		Name:   fmt.Sprintf("status is %d", want),
+		Passed: rec.Code == want,
+		Detail: fmt.Sprintf("got %d", rec.Code),
+	}
+}
+
+// expectJSON checks a response is JSON, decoding it into v.
+func expectJSON(rec *httptest.ResponseRecorder, v any) CheckStep {
+	step := CheckStep{Name: "response is JSON"}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		step.Detail = fmt.Sprintf("Content-Type is %q", ct)
+		return step
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		step.Detail = err.Error()
+		return step
+	}
+	step.Passed = true
+	return step
+}
+
+// verify runs the check for list[i].
+func verify(cfg Config, list []Exercise, i int) VerifyResponse {
+	resp := VerifyResponse{Exercise: list[i].ID, Passed: true, Steps: list[i].check(cfg)}
+	for _, step := range resp.Steps {
+		resp.Passed = resp.Passed && step.Passed
+	}
+	if i+1 < len(list) {
+		resp.Next = list[i+1].ID
+	}
+	return resp
+}
+
+// findExercise returns the index of the exercise with the given ID.
+func findExercise(list []Exercise, id string) (int, bool) {
+	i := slices.IndexFunc(list, func(e Exercise) bool { return e.ID == id })
+	return i, i >= 0
+}
+
+// handleLearn shows every exercise with its current result, recording any
+// newly completed ones (see progress.go).
+func (s *Server) handleLearn(w http.ResponseWriter, r *http.Request) {
+	learner := learnerID(w, r)
+
+	var page LearnPage
+	list := exercises()
+	for i, exercise := range list {
+		result := verify(s.config(), list, i)
+		if result.Passed {
+			page.Passed++
+		}
+		s.recordResult(r, learner, result)
+		page.Exercises = append(page.Exercises, VerifiedExercise{Exercise: exercise, Result: result})
+	}
+	page.Badges = s.progress(tenantFromContext(r.Context()), learner).Badges
+	s.renderPage(w, "learn.html", http.StatusOK, page)
+}
+
+// handleListExercises lists the exercises in order.
+func handleListExercises(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ExerciseListResponse{Exercises: exercises()})
+}
+
+// handleGetExercise returns one exercise.
+func handleGetExercise(w http.ResponseWriter, r *http.Request) {
+	list := exercises()
+	i, ok := findExercise(list, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "no such exercise")
+		return
+	}
+	writeJSON(w, http.StatusOK, list[i])
+}
+
+// handleVerifyExercise checks an exercise against the running code.
+func (s *Server) handleVerifyExercise(w http.ResponseWriter, r *http.Request) {
+	list := exercises()
+	i, ok := findExercise(list, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "no such exercise")
+		return
+	}
+	result := verify(s.config(), list, i)
+	s.recordResult(r, learnerID(w, r), result)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// These tests check the exercise machinery rather than whether any
+// exercise is done, so they keep passing as you work through them.
+
+// TestExercisesWellFormed checks every exercise has a unique ID and a
+// check that returns at least one step.
+func TestExercisesWellFormed(t *testing.T) {
+	seen := map[string]bool{}
+	for _, e := range exercises() {
+		if e.ID == "" || seen[e.ID] || e.Title == "" || e.check == nil {
+			t.Errorf("Bad exercise %+v", e)
+		}
+		seen[e.ID] = true
+		if steps := e.check(Config{}); len(steps) == 0 {
+			t.Errorf("Exercise %s has no check steps", e.ID)
+		}
+	}
+}
+
+// TestVerify checks an exercise passes only when every step does.
+func TestVerify(t *testing.T) {
+	pass := CheckStep{Name: "ok", Passed: true}
+	fail := CheckStep{Name: "not yet"}
+	list := []Exercise{
+		{ID: "first", check: func(Config) []CheckStep { return []CheckStep{pass, pass} }},
+		{ID: "second", check: func(Config) []CheckStep { return []CheckStep{pass, fail} }},
+	}
+
+	if got := verify(Config{}, list, 0); !got.Passed || got.Next != "second" {
+		t.Errorf("Expected the first to pass and point at the second, got %+v", got)
+	}
+	if got := verify(Config{}, list, 1); got.Passed || got.Next != "" {
+		t.Errorf("Expected the second to fail with no next, got %+v", got)
+	}
+}
+
+// TestExpectJSON checks the JSON step rejects other content types.
+func TestExpectJSON(t *testing.T) {
+	var body struct{ Status string }
+
+	rec := probe(Config{}, http.MethodGet, "/health")
+	if step := expectJSON(rec, &body); !step.Passed || body.Status != "healthy" {
+		t.Errorf("Expected /health to be JSON, got %+v", step)
+	}
+
+	rec = probe(Config{}, http.MethodGet, "/")
+	if step := expectJSON(rec, &body); step.Passed || !strings.Contains(step.Detail, "text/html") {
+		t.Errorf("Expected the home page not to be JSON, got %+v", step)
+	}
+}
+
+// TestLearnEndpoints checks the page and API respond.
+func TestLearnEndpoints(t *testing.T) {
+	mux := newServer(Config{}).routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/learn"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Make /readyz fail") {
+		t.Errorf("Expected the learn page, got %d", rec.Code)
+	}
+
+	rec := get("/api/v1/learn/exercises/readyz-maintenance/verify")
+	var resp VerifyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Exercise != "readyz-maintenance" || len(resp.Steps) == 0 {
+		t.Errorf("Expected a verification result, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := get("/api/v1/learn/exercises/nope"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown exercise, got %d", rec.Code)
+	}
+}
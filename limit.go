@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// This file limits how many requests are handled at once. Past some point,
+// taking on more work only makes every request slower, until they all time
+// out: the memory and CPU are shared between more and more of them. It's
+// better to turn the excess away at once, with a 503 and a Retry-After the
+// client (or the load balancer) can act on, and serve the rest at full
+// speed.
+//
+// MAX_IN_FLIGHT caps the requests handled at once by the whole server, and
+// ROUTE_MAX_IN_FLIGHT caps some routes, as a list of pattern=n, so that
+// one expensive route (thumbnails, say) can't take every slot:
+//
+//	ROUTE_MAX_IN_FLIGHT=GET /api/v1/files/{id}/thumbnail=4
+//
+// 0 means no limit, the default. The routes that monitoring depends on, and
+// the long-lived streams, which would hold a slot for as long as a browser
+// tab stays open, don't count against MAX_IN_FLIGHT.
+//
+// A short burst over the limit needn't be turned away: with MAX_QUEUED, up
+// to that many requests wait, for up to QUEUE_TIMEOUT, for a slot to come
+// free. Only when the queue is full, or the wait runs out, does a request
+// get its 503, with a Retry-After of QUEUE_TIMEOUT. A waiting request takes
+// the next free slot it can, so they aren't strictly served in order.
+//
+// The http_requests_in_flight and http_requests_queued metrics show how
+// many requests are being handled and waiting.
+
+// uncappedRoutes don't count against MAX_IN_FLIGHT.
+var uncappedRoutes = map[string]bool{
+	"/health":       true,
+	"GET /livez":    true,
+	"GET /readyz":   true,
+	"GET /startupz": true,
+	"GET /metrics":  true,
+}
+
+// parseRouteLimits parses ROUTE_MAX_IN_FLIGHT.
+func parseRouteLimits(list []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range list {
+		pattern, value, ok := cutRouteSetting(entry)
+		if !ok {
+			return nil, fmt.Errorf("%q is not pattern=n", entry)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q: %q is not a valid limit", entry, value)
+		}
+		limits[pattern] = n
+	}
+	return limits, nil
+}
+
+// inFlight counts the requests being handled, in all and by route.
+type inFlight struct {
+	mu     sync.Mutex
+	total  int // requests counting against MAX_IN_FLIGHT
+	routes map[string]int
+	queued int
+
+	// released is closed, and replaced, whenever a request finishes, to
+	// wake the queued requests.
+	released chan struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{routes: make(map[string]int), released: make(chan struct{})}
+}
+
+// acquire counts a request to route in, unless that would go over a limit.
+// If it would, it returns a channel that's closed when a slot may be free.
+func (f *inFlight) acquire(route string, capped bool, maxTotal, maxRoute int) (bool, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if capped && maxTotal > 0 && f.total >= maxTotal {
+		return false, f.released
+	}
+	if maxRoute > 0 && f.routes[route] >= maxRoute {
+		return false, f.released
+	}
+	if capped {
+		f.total++
+	}
+	f.routes[route]++
+	return true, nil
+}
+
+// release counts a request to route out.
+func (f *inFlight) release(route string, capped bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if capped {
+		f.total--
+	}
+	if f.routes[route]--; f.routes[route] == 0 {
+		delete(f.routes, route)
+	}
+	close(f.released)
+	f.released = make(chan struct{})
+}
+
+// enqueue takes a place in the queue, if fewer than max are waiting.
+func (f *inFlight) enqueue(max int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.queued >= max {
+		return false
+	}
+	f.queued++
+	return true
+}
+
+// dequeue gives up a place in the queue.
+func (f *inFlight) dequeue() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued--
+}
+
+// limitMiddleware turns requests away with a 503 while their route, or the
+// server, is at its limit.
+func (s *Server) limitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		// The configuration has been validated, so parsing can't fail.
+		limits, _ := parseRouteLimits(cfg.RouteMaxInFlight)
+		route := r.Pattern
+		capped := !uncappedRoutes[route] && !longLivedRoutes[route]
+
+		ok, released := s.inFlight.acquire(route, capped, cfg.MaxInFlight, limits[route])
+		if !ok && cfg.MaxQueued > 0 && s.inFlight.enqueue(cfg.MaxQueued) {
+			s.metrics.AddQueued(1)
+			timer := s.clock.NewTimer(cfg.QueueTimeout)
+		wait:
+			for !ok {
+				select {
+				case <-released:
+					ok, released = s.inFlight.acquire(route, capped, cfg.MaxInFlight, limits[route])
+				case <-timer.C():
+					break wait
+				case <-r.Context().Done():
+					break wait
+				}
+			}
+			timer.Stop()
+			s.inFlight.dequeue()
+			s.metrics.AddQueued(-1)
+		}
+		if !ok {
+			retry := max(1, int(math.Ceil(cfg.QueueTimeout.Seconds())))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			writeProblem(w, http.StatusServiceUnavailable, "the server is busy; try again shortly")
+			return
+		}
+		s.metrics.AddInFlight(1)
+		defer func() {
+			s.inFlight.release(route, capped)
+			s.metrics.AddInFlight(-1)
+		}()
+		next(w, r)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// holdRequest starts a request to GET /api/v1/quote that hangs, on a timeout
+// fault, until the returned function is called.
+func holdRequest(t *testing.T, s *Server, c *testsupport.Client) (release func()) {
+	t.Helper()
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+	s.faults.Set(Fault{Route: "GET /api/v1/quote", Kind: "timeout", DelayMs: 60_000, Count: 1})
+
+	done := make(chan int)
+	go func() { done <- c.Get("/api/v1/quote").Code }()
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	return func() {
+		clock.Advance(time.Minute)
+		<-done
+	}
+}
+
+// TestMaxInFlight checks requests over MAX_IN_FLIGHT are turned away, but
+// not health checks, and the in-flight count is in the metrics.
+func TestMaxInFlight(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.MaxInFlight = 1
+	s.cfgMu.Unlock()
+
+	release := holdRequest(t, s, c)
+	c.Get("/api/v1/counter").
+		Status(http.StatusServiceUnavailable).
+		HasHeader("Retry-After", "1")
+	c.Get("/health").Status(http.StatusOK)
+	c.Get("/livez").Status(http.StatusOK)
+
+	// The quote, and the metrics request itself.
+	metrics := c.Get("/metrics").Body.String()
+	if !strings.Contains(metrics, "\nhttp_requests_in_flight 2\n") {
+		t.Errorf("Expected 2 requests in flight, got:\n%s", metrics)
+	}
+
+	release()
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+}
+
+// TestProbesUncapped checks every health probe is in uncappedRoutes, so a
+// busy server still answers the kubelet.
+func TestProbesUncapped(t *testing.T) {
+	for path := range probePaths {
+		if !uncappedRoutes[path] && !uncappedRoutes["GET "+path] {
+			t.Errorf("Expected %s to be uncapped", path)
+		}
+	}
+}
+
+// TestRouteMaxInFlight checks a route's limit only applies to that route.
+func TestRouteMaxInFlight(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.RouteMaxInFlight = []string{"GET /api/v1/quote=1"}
+	s.cfgMu.Unlock()
+
+	release := holdRequest(t, s, c)
+	c.Get("/api/v1/quote").Status(http.StatusServiceUnavailable)
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+
+	release()
+	c.Get("/api/v1/quote").Status(http.StatusOK)
+}
+
+// TestRouteMaxInFlightConfig checks bad limits are rejected.
+func TestRouteMaxInFlightConfig(t *testing.T) {
+	cfg := defaultConfig(t)
+	for _, bad := range []string{"GET /api/v1/quote", "GET /api/v1/quote=many", "GET /api/v1/quote=-1"} {
+		cfg.RouteMaxInFlight = []string{bad}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "ROUTE_MAX_IN_FLIGHT") {
+			t.Errorf("%q: expected ROUTE_MAX_IN_FLIGHT rejected, got %v", bad, err)
+		}
+	}
+}
+
+// TestQueue checks a request over the limit waits for a slot, one over the
+// queue's length is turned away at once, and one that waits too long gets
+// a 503 with the queue timeout as its Retry-After.
+func TestQueue(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.MaxInFlight, s.cfg.MaxQueued, s.cfg.QueueTimeout = 1, 1, 5*time.Second
+	s.cfgMu.Unlock()
+
+	release := holdRequest(t, s, c)
+	clock := s.clock.(*fakeClock)
+	queued := make(chan *testsupport.Response)
+	go func() { queued <- c.Get("/api/v1/counter") }()
+	eventually(t, func() bool { return clock.Waiters() == 2 })
+
+	c.Get("/api/v1/counter").
+		Status(http.StatusServiceUnavailable).
+		HasHeader("Retry-After", "5")
+	if metrics := c.Get("/metrics").Body.String(); !strings.Contains(metrics, "\nhttp_requests_queued 1\n") {
+		t.Errorf("Expected 1 request queued, got:\n%s", metrics)
+	}
+
+	release()
+	(<-queued).Status(http.StatusOK)
+
+	release = holdRequest(t, s, c)
+	clock = s.clock.(*fakeClock)
+	go func() { queued <- c.Get("/api/v1/counter") }()
+	eventually(t, func() bool { return clock.Waiters() == 2 })
+	clock.Advance(5 * time.Second) // the held request is still running
+	(<-queued).Status(http.StatusServiceUnavailable).HasHeader("Retry-After", "5")
+	release()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// This file implements a URL shortener: POST /api/v1/links turns a long URL
+// into a short code, and GET /l/{code} redirects to it, counting the click.
+//
+// Short codes are random rather than sequential, so nobody can walk through
+// every link by counting up. Random codes can collide, though, so the store
+// checks a new code is unused and inserts it under the same lock
+// (Store.CreateLink), trying again with a fresh code if it's taken.
+
+// Link is a shortened URL.
+type Link struct {
+	Code      string     `json:"code"`
+	URL       string     `json:"url"`
+	Clicks    int64      `json:"clicks"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expired reports whether the link has expired at the given time.
+func (l Link) expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// CreateLinkRequest is the JSON body accepted by POST /api/v1/links.
+type CreateLinkRequest struct {
+	URL string `json:"url"`
+
+	// TTLSeconds makes the link expire that long after it's created. Links
+	// without one never expire.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// LinkResponse is a link plus the full short URL to hand out.
+type LinkResponse struct {
+	Link
+	ShortURL string `json:"short_url"`
+}
+
+// LinkListResponse lists a tenant's links.
+type LinkListResponse struct {
+	Links []LinkResponse `json:"links"`
+}
+
+// Errors returned by the link store methods.
+var (
+	errLinkNotFound  = errors.New("link not found")
+	errLinkExpired   = errors.New("link has expired")
+	errCodeCollision = errors.New("could not find an unused short code")
+)
+
+// shortCodeAlphabet leaves out characters that are easily confused when a
+// code is read aloud or typed: 0/O and 1/l/I.
+const shortCodeAlphabet = "23456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// shortCodeLength gives 57^7, about 2 * 10^12, possible codes: collisions
+// stay rare for far more links than this store will ever hold.
+const shortCodeLength = 7
+
+// newShortCode returns a random short code.
+func newShortCode() string {
+	code := make([]byte, shortCodeLength)
+	size := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range code {
+		// rand.Int picks uniformly; taking a random byte modulo 57 would
+		// make some characters more likely than others.
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			panic(err) // the system's random source is broken
+		}
+		code[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// validHTTPURL checks a URL is absolute, and http or https. That's what makes
+// it safe to redirect to: other schemes such as javascript: must never be
+// redirected to. It also checks URLs in the configuration.
+func validHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// linkResponse adds the short URL, built from the host the request was
+// sent to, so it works behind any domain.
+func linkResponse(r *http.Request, link Link) LinkResponse {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return LinkResponse{Link: link, ShortURL: scheme + "://" + r.Host + "/l/" + link.Code}
+}
+
+// handleCreateLink shortens a URL.
+func (s *Server) handleCreateLink(w http.ResponseWriter, r *http.Request) {
+	var req CreateLinkRequest
+	if !decodeValid(w, r, "link-create", &req) {
+		return
+	}
+	if !validHTTPURL(req.URL) {
+		writeValidationProblem(w, "link-create", []FieldError{{Pointer: "/url", Detail: "must be an absolute http or https URL"}})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.TTLSeconds > 0 {
+		t := s.clock.Now().UTC().Add(time.Duration(req.TTLSeconds) * time.Second)
+		expiresAt = &t
+	}
+
+	link, err := s.store.CreateLink(tenantFromContext(r.Context()), req.URL, expiresAt)
+	if err != nil {
+		writeProblem(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/links/"+link.Code)
+	writeJSON(w, http.StatusCreated, linkResponse(r, link))
+}
+
+// handleListLinks lists the tenant's links with their click counts.
+func (s *Server) handleListLinks(w http.ResponseWriter, r *http.Request) {
+	links := s.store.ListLinks(tenantFromContext(r.Context()))
+	resp := LinkListResponse{Links: make([]LinkResponse, 0, len(links))}
+	for _, link := range links {
+		resp.Links = append(resp.Links, linkResponse(r, link))
+	}
+	setPagination(w, Pagination{Total: len(links)})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetLink returns one link and its click count, without counting a
+// click.
+func (s *Server) handleGetLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := s.store.GetLink(tenantFromContext(r.Context()), r.PathValue("code"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "link not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, linkResponse(r, link))
+}
+
+// handleFollowLink redirects to a link's URL and counts the click.
+//
+// It answers 302 Found rather than 301 Moved Permanently: browsers cache
+// permanent redirects and skip the server next time, so those clicks would
+// never be counted, and the link couldn't expire.
+func (s *Server) handleFollowLink(w http.ResponseWriter, r *http.Request) {
+	link, err := s.store.FollowLink(tenantFromContext(r.Context()), r.PathValue("code"), s.clock.Now())
+	switch {
+	case errors.Is(err, errLinkExpired):
+		// 410 Gone says the link existed but won't work again.
+		writeProblem(w, http.StatusGone, "this link has expired")
+		return
+	case err != nil:
+		writeProblem(w, http.StatusNotFound, "link not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
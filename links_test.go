@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNewShortCode checks codes have the right length and alphabet.
+func TestNewShortCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code := newShortCode()
+		if len(code) != shortCodeLength || strings.Trim(code, shortCodeAlphabet) != "" {
+			t.Errorf("Unexpected code %q", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("Expected 100 different codes, got %d", len(seen))
+	}
+}
+
+// TestLinkLifecycle shortens a URL, follows it and checks the click was
+// counted.
+func TestLinkLifecycle(t *testing.T) {
+	srv := newServer(Config{})
+	mux := srv.routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/links", strings.NewReader(`{"url": "https://go.dev/doc/"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created LinkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if created.ShortURL != "http://example.com/l/"+created.Code {
+		t.Errorf("Unexpected short URL %q", created.ShortURL)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/l/"+created.Code, nil))
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://go.dev/doc/" {
+			t.Fatalf("Expected a 302 to the URL, got %d %s", rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	if link, _ := srv.store.GetLink(defaultTenant, created.Code); link.Clicks != 2 {
+		t.Errorf("Expected 2 clicks, got %d", link.Clicks)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/l/nothere", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown code, got %d", rec.Code)
+	}
+}
+
+// TestLinkValidation checks only http and https URLs can be shortened.
+func TestLinkValidation(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	for _, body := range []string{
+		`{"url": "javascript:alert(1)"}`,
+		`{"url": "/relative"}`,
+		`{"url": "https://go.dev", "ttl_seconds": 5}`,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/links", strings.NewReader(body)))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", body, rec.Code)
+		}
+	}
+}
+
+// TestFollowExpiredLink checks an expired link answers 410 and isn't counted.
+func TestFollowExpiredLink(t *testing.T) {
+	store := newStore()
+	expires := time.Now().Add(time.Minute)
+	link, err := store.CreateLink("acme", "https://go.dev", &expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.FollowLink("acme", link.Code, time.Now()); err != nil {
+		t.Errorf("Expected the link to work before it expires, got %v", err)
+	}
+	if _, err := store.FollowLink("acme", link.Code, expires); err != errLinkExpired {
+		t.Errorf("Expected errLinkExpired, got %v", err)
+	}
+	if got, _ := store.GetLink("acme", link.Code); got.Clicks != 1 {
+		t.Errorf("Expected only the first click to count, got %d", got.Clicks)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements live reload for dev mode: when a template or static
+// file changes on disk, every open browser tab refreshes itself.
+//
+// It's built from two pieces:
+//   - a Server-Sent Events (SSE) endpoint, /dev/livereload. SSE is a simple
+//     standard for a server to push messages to the browser over a normal,
+//     long-lived HTTP response. The browser's EventSource API reconnects
+//     automatically if the connection drops.
+//   - a middleware that injects a tiny script into every HTML page. The
+//     script listens on the SSE endpoint and reloads the page when told to.
+
+// liveReloadScript is injected just before </body> in HTML responses.
+const liveReloadScript = `<script>
+// Injected by the dev-mode live reload middleware (see livereload.go).
+new EventSource("/dev/livereload").addEventListener("reload", () => location.reload());
+</script>
+`
+
+// LiveReload broadcasts "something changed" to every connected browser.
+type LiveReload struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+// newLiveReload creates a broadcaster with no clients.
+func newLiveReload() *LiveReload {
+	return &LiveReload{clients: make(map[chan struct{}]struct{})}
+}
+
+// subscribe registers a new client and returns its notification channel.
+func (lr *LiveReload) subscribe() chan struct{} {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	// A buffer of one means a notification is never lost, and several
+	// changes in quick succession collapse into a single reload.
+	ch := make(chan struct{}, 1)
+	lr.clients[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe removes a client when its connection closes.
+func (lr *LiveReload) unsubscribe(ch chan struct{}) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	delete(lr.clients, ch)
+}
+
+// Notify tells every connected client to reload.
+func (lr *LiveReload) Notify() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for ch := range lr.clients {
+		// A non-blocking send: if a reload is already pending for this
+		// client, there's no need to queue another.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleLiveReload is the SSE endpoint browsers listen on.
+func (s *Server) handleLiveReload(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// The server's WriteTimeout would cut this long-lived response off
+	// after a few seconds, so clear the deadline for this one request.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// Subscribe before sending the headers, so a client that has seen the
+	// response start can be sure it won't miss a notification.
+	ch := s.liveReload.subscribe()
+	defer s.liveReload.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	// Proxies often close connections that are silent for too long, so we
+	// send an SSE comment (a line starting with ':') every now and then.
+	keepAlive := s.clock.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// The browser navigated away or the tab was closed.
+			return
+		case <-s.stopping:
+			return
+		case <-keepAlive.C():
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// liveReloadMiddleware injects the live reload script into HTML responses.
+// Other responses (JSON, CSS, the SSE stream itself) pass straight through.
+func liveReloadMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		iw := &injectWriter{ResponseWriter: w, status: http.StatusOK}
+		next(iw, r)
+		iw.finish()
+	}
+}
+
+// injectWriter holds back HTML responses so the script can be added before
+// they're sent. Whether a response is HTML is decided from its Content-Type
+// when the handler writes the status code.
+type injectWriter struct {
+	http.ResponseWriter
+	status  int
+	decided bool
+	html    bool
+	buf     bytes.Buffer
+}
+
+// WriteHeader decides whether to buffer the response.
+func (iw *injectWriter) WriteHeader(status int) {
+	if iw.decided {
+		return
+	}
+	iw.decided = true
+	iw.status = status
+	iw.html = strings.HasPrefix(iw.Header().Get("Content-Type"), "text/html")
+
+	if !iw.html {
+		iw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write buffers HTML and passes everything else through.
+func (iw *injectWriter) Write(b []byte) (int, error) {
+	if !iw.decided {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if iw.html {
+		return iw.buf.Write(b)
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter.
+func (iw *injectWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// finish sends a buffered HTML response with the script inserted.
+func (iw *injectWriter) finish() {
+	if !iw.html {
+		return
+	}
+
+	body := iw.buf.Bytes()
+	if i := bytes.LastIndex(body, []byte("</body>")); i >= 0 {
+		body = append(body[:i:i], append([]byte(liveReloadScript), body[i:]...)...)
+	} else {
+		body = append(body, liveReloadScript...)
+	}
+
+	// The body got longer, so any Content-Length the handler set is wrong.
+	iw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	iw.ResponseWriter.WriteHeader(iw.status)
+	iw.ResponseWriter.Write(body)
+}
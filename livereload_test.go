@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLiveReloadMiddlewareInjectsScript checks that HTML pages get the
+// script and JSON responses are left alone.
+func TestLiveReloadMiddlewareInjectsScript(t *testing.T) {
+	html := liveReloadMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body><h1>Hi</h1></body></html>"))
+	})
+
+	rec := httptest.NewRecorder()
+	html(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "EventSource") || !strings.HasSuffix(body, "</body></html>") {
+		t.Errorf("Expected the script before </body>, got %q", body)
+	}
+
+	rec = httptest.NewRecorder()
+	liveReloadMiddleware(handleHealth)(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if strings.Contains(rec.Body.String(), "EventSource") {
+		t.Error("Expected JSON responses to be left alone")
+	}
+}
+
+// TestLiveReloadEndpoint connects to the SSE endpoint of a real test server
+// and checks that a notification arrives as a reload event.
+func TestLiveReloadEndpoint(t *testing.T) {
+	srv := newServer(Config{DevMode: true})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/dev/livereload", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+
+	// The response headers arrive after the handler has subscribed, so the
+	// notification can't be missed.
+	srv.liveReload.Notify()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if line != "event: reload\n" {
+		t.Errorf("Expected a reload event, got %q", line)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file formats times for people, in their language and time zone, for
+// GET /api/message, which is also served as /api/v1/message. Machines get
+// the RFC 3339 time in UTC as always; people get it as they'd write it:
+//
+//	curl -H "Accept-Language: de-CH, fr;q=0.8" -H "Time-Zone: Europe/Zurich" http://localhost:8000/api/message
+//	  "local": {"time": "Montag, 3. Juni 2024 um 14:05 CEST", "locale": "de", "timezone": "Europe/Zurich"}
+//
+// The language is negotiated from Accept-Language, which browsers send
+// with the user's preferences, or chosen with ?locale=. The time zone is
+// an IANA name (see timezone.go) in the Time-Zone header, as GitHub's API
+// takes it, or ?tz=, and is UTC without either. The query parameters win,
+// since they're the easiest to try in a browser.
+//
+// Go's time package only knows English names for months and days, and
+// real localization libraries carry the whole of Unicode's CLDR to do
+// better. This keeps a small table instead: a layout per language, with
+// the names to swap in for English ones.
+
+// timeLocale is how one language writes a date and time.
+type timeLocale struct {
+	tag string
+
+	// layout is a time.Format layout with the English month and day names
+	// (January and Monday) where the language has names.
+	layout string
+
+	// months and days replace the English names, January and Sunday first.
+	months [12]string
+	days   [7]string
+}
+
+// timeLocales are the supported languages. The first one for a language is
+// the one a tag with an unsupported region falls back to, and the very
+// first is the default.
+var timeLocales = []timeLocale{
+	{
+		tag:    "en-US",
+		layout: "Monday, January 2, 2006 at 3:04 PM MST",
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		days:   [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	},
+	{
+		tag:    "en-GB",
+		layout: "Monday 2 January 2006 at 15:04 MST",
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		days:   [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	},
+	{
+		tag:    "de",
+		layout: "Monday, 2. January 2006 um 15:04 MST",
+		months: [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		days:   [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+	},
+	{
+		tag:    "fr",
+		layout: "Monday 2 January 2006 à 15:04 MST",
+		months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		days:   [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	},
+	{
+		tag:    "es",
+		layout: "Monday, 2 de January de 2006, 15:04 MST",
+		months: [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		days:   [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+	},
+	{
+		tag:    "it",
+		layout: "Monday 2 January 2006 alle ore 15:04 MST",
+		months: [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		days:   [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+	},
+	{
+		tag:    "pt",
+		layout: "Monday, 2 de January de 2006 às 15:04 MST",
+		months: [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		days:   [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+	},
+	{
+		tag:    "nl",
+		layout: "Monday 2 January 2006 om 15:04 MST",
+		months: [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		days:   [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+	},
+	{
+		tag:    "sv",
+		layout: "Monday 2 January 2006 kl. 15:04 MST",
+		months: [12]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		days:   [7]string{"söndag", "måndag", "tisdag", "onsdag", "torsdag", "fredag", "lördag"},
+	},
+	{
+		// Polish and Russian put the month in the genitive after a day.
+		tag:    "pl",
+		layout: "Monday, 2 January 2006 15:04 MST",
+		months: [12]string{"stycznia", "lutego", "marca", "kwietnia", "maja", "czerwca", "lipca", "sierpnia", "września", "października", "listopada", "grudnia"},
+		days:   [7]string{"niedziela", "poniedziałek", "wtorek", "środa", "czwartek", "piątek", "sobota"},
+	},
+	{
+		tag:    "ru",
+		layout: "Monday, 2 January 2006 г., 15:04 MST",
+		months: [12]string{"января", "февраля", "марта", "апреля", "мая", "июня", "июля", "августа", "сентября", "октября", "ноября", "декабря"},
+		days:   [7]string{"воскресенье", "понедельник", "вторник", "среда", "четверг", "пятница", "суббота"},
+	},
+	{
+		// Japanese and Chinese write months as numbers, so only the days
+		// have names.
+		tag:    "ja",
+		layout: "2006年1月2日(Monday) 15:04 MST",
+		days:   [7]string{"日", "月", "火", "水", "木", "金", "土"},
+	},
+	{
+		tag:    "zh",
+		layout: "2006年1月2日Monday 15:04 MST",
+		days:   [7]string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"},
+	},
+}
+
+// LocalizedTime is a time as a person would read it.
+type LocalizedTime struct {
+	Time     string `json:"time"`
+	Locale   string `json:"locale"`
+	Timezone string `json:"timezone"`
+}
+
+// Why a time can't be localized as asked.
+var (
+	errUnknownLocale   = errors.New("unsupported locale: use a language tag such as de or en-GB")
+	errUnknownTimeZone = errors.New("unknown time zone: use an IANA name such as Europe/Paris (see /api/v1/timezones)")
+)
+
+// format formats t in the locale.
+func (l timeLocale) format(t time.Time) string {
+	s := t.Format(l.layout)
+	if l.days[0] != "" {
+		s = strings.Replace(s, t.Weekday().String(), l.days[t.Weekday()], 1)
+	}
+	if l.months[0] != "" {
+		s = strings.Replace(s, t.Month().String(), l.months[t.Month()-1], 1)
+	}
+	return s
+}
+
+// findTimeLocale returns the locale for a language tag: the tag itself, or
+// failing that its language.
+func findTimeLocale(tag string) (timeLocale, bool) {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	lang, _, _ := strings.Cut(tag, "-")
+	if i := slices.IndexFunc(timeLocales, func(l timeLocale) bool { return strings.EqualFold(l.tag, tag) }); i >= 0 {
+		return timeLocales[i], true
+	}
+	if i := slices.IndexFunc(timeLocales, func(l timeLocale) bool {
+		base, _, _ := strings.Cut(l.tag, "-")
+		return strings.EqualFold(base, lang)
+	}); i >= 0 {
+		return timeLocales[i], true
+	}
+	return timeLocale{}, false
+}
+
+// negotiateTimeLocale picks the locale an Accept-Language header prefers
+// most, or the default if it names none of them. "*" and tags with q=0 are
+// skipped.
+func negotiateTimeLocale(header string) timeLocale {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	// A stable sort keeps the header's order among equal weights.
+	slices.SortStableFunc(choices, func(a, b choice) int { return cmp.Compare(b.q, a.q) })
+	for _, c := range choices {
+		if l, ok := findTimeLocale(c.tag); ok {
+			return l
+		}
+	}
+	return timeLocales[0]
+}
+
+// localizeTime formats t for the reader of r, in the locale and time zone
+// it asks for.
+func localizeTime(r *http.Request, t time.Time) (LocalizedTime, error) {
+	locale := negotiateTimeLocale(r.Header.Get("Accept-Language"))
+	if tag := r.URL.Query().Get("locale"); tag != "" {
+		var ok bool
+		if locale, ok = findTimeLocale(tag); !ok {
+			return LocalizedTime{}, errUnknownLocale
+		}
+	}
+
+	zone := cmp.Or(r.URL.Query().Get("tz"), r.Header.Get("Time-Zone"), "UTC")
+	loc, ok := loadZone(zone)
+	if !ok {
+		return LocalizedTime{}, errUnknownTimeZone
+	}
+	return LocalizedTime{Time: locale.format(t.In(loc)), Locale: locale.tag, Timezone: loc.String()}, nil
+}
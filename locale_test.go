@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestTimeLocaleFormat checks names are swapped in for English ones.
+func TestTimeLocaleFormat(t *testing.T) {
+	monday := time.Date(2024, 6, 3, 14, 5, 0, 0, time.UTC)
+	tests := map[string]string{
+		"en-US": "Monday, June 3, 2024 at 2:05 PM UTC",
+		"en-GB": "Monday 3 June 2024 at 14:05 UTC",
+		"de":    "Montag, 3. Juni 2024 um 14:05 UTC",
+		"fr":    "lundi 3 juin 2024 à 14:05 UTC",
+		"pl":    "poniedziałek, 3 czerwca 2024 14:05 UTC",
+		"ja":    "2024年6月3日(月) 14:05 UTC",
+	}
+	for tag, want := range tests {
+		l, ok := findTimeLocale(tag)
+		if !ok {
+			t.Fatalf("Expected %s to be supported", tag)
+		}
+		if got := l.format(monday); got != want {
+			t.Errorf("%s: expected %q, got %q", tag, want, got)
+		}
+	}
+}
+
+// TestNegotiateTimeLocale checks weights, fallbacks to the language and
+// the default.
+func TestNegotiateTimeLocale(t *testing.T) {
+	tests := map[string]string{
+		"":                          "en-US",
+		"en-GB,en;q=0.9":            "en-GB",
+		"en-AU":                     "en-US",
+		"de-CH, fr;q=0.8":           "de",
+		"fr;q=0.5, it;q=0.9":        "it",
+		"tlh, pt-BR;q=0.7, *;q=0.1": "pt",
+		"ja;q=0, *":                 "en-US",
+	}
+	for header, want := range tests {
+		if got := negotiateTimeLocale(header).tag; got != want {
+			t.Errorf("%q: expected %s, got %s", header, want, got)
+		}
+	}
+}
+
+// TestMessageLocalTime checks the query parameters win over the headers,
+// the UTC time is always there, and bad values are refused.
+func TestMessageLocalTime(t *testing.T) {
+	_, c := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/message?locale=sv", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Time-Zone", "Asia/Tokyo")
+	resp := testsupport.Decode[MessageResponse](c.DoRequest(req).
+		Status(http.StatusOK).
+		HasHeader("Content-Language", "sv"))
+	if resp.Local.Locale != "sv" || resp.Local.Timezone != "Asia/Tokyo" {
+		t.Errorf("Expected Swedish in Tokyo, got %+v", resp.Local)
+	}
+	if parsed, err := time.Parse(time.RFC3339, resp.Time); err != nil || parsed.Location() != time.UTC {
+		t.Errorf("Expected an RFC 3339 time in UTC, got %q", resp.Time)
+	}
+
+	resp = testsupport.Decode[MessageResponse](c.Get("/api/message?tz=America/New_York").Status(http.StatusOK))
+	if resp.Local.Locale != "en-US" || resp.Local.Timezone != "America/New_York" {
+		t.Errorf("Expected English in New York, got %+v", resp.Local)
+	}
+
+	c.Get("/api/v1/message?tz=Mars/Olympus_Mons").Status(http.StatusBadRequest)
+	c.Get("/api/v1/message?locale=tlh").Status(http.StatusBadRequest)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file slows down password guessing at POST /api/v1/login (see
+// users.go). Argon2id makes each guess expensive for someone holding a
+// copy of the hashes; this makes guesses through the API expensive too.
+// Failed logins are counted two ways:
+//
+//   - per account, so one account can't be guessed at from many addresses.
+//     After a failure, the account's next attempt has to wait a second,
+//     then two, then four, and so on; after LOGIN_MAX_FAILURES in a row,
+//     it's locked for LOGIN_LOCKOUT.
+//   - per client IP address, so one address can't try a few passwords on
+//     every account. After LOGIN_MAX_FAILURES_PER_IP, it's locked too.
+//     The address is counted across tenants: the tenant comes from the
+//     request, so counting it per tenant would let a client reset its
+//     count, and spray accounts in every tenant, by naming another one.
+//
+// Each lockout of the same account or address lasts twice as long as the
+// one before, up to a day, and a day without failures forgets them all. A
+// successful login resets its account's count but not its address's, or
+// an attacker could reset theirs by logging into an account of their own.
+// While blocked, attempts get a 429 with Retry-After, and the password
+// isn't checked at all: even the right one is refused, so a lockout can't
+// be used to confirm a guess.
+//
+// Accounts are counted by the login given, whether or not anybody has it,
+// so locking out says nothing about who's registered. The flip side is
+// that anyone can lock someone out by failing to log in as them, which is
+// why lockouts are temporary: permanent ones would make that a way to shut
+// accounts for good. Like RATE_LIMIT without Redis, each instance counts
+// on its own.
+//
+// login_failures_total, login_lockouts_total and login_attempts_blocked_total
+// on /metrics show guessing as it happens.
+
+// loginBaseDelay is the wait after a first failure, doubling with each one
+// after it; maxLoginLockout caps lockouts; and loginFailureMemory is how
+// long a record of failures is kept after the last one.
+const (
+	loginBaseDelay     = time.Second
+	maxLoginLockout    = 24 * time.Hour
+	loginFailureMemory = 24 * time.Hour
+)
+
+// The scopes failures are counted in, as metrics labels.
+const (
+	loginScopeAccount = "account"
+	loginScopeIP      = "ip"
+)
+
+// loginRecord is the failures of one account or address.
+type loginRecord struct {
+	failures    int       // since the last lockout or success
+	lockouts    int       // so far, to double each one
+	last        time.Time // of the last failure
+	blockedTill time.Time
+}
+
+// loginGuard counts failed logins.
+type loginGuard struct {
+	mu      sync.Mutex
+	records map[string]*loginRecord // by scope, then account or client
+	swept   time.Time
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{records: make(map[string]*loginRecord)}
+}
+
+// loginAccount identifies the account a login is for, within a tenant.
+func loginAccount(tenant, login string) string {
+	return tenant + " " + strings.ToLower(login)
+}
+
+// blocked returns how long until account and client can try again, and
+// which of the two is blocked, or 0 if neither is.
+func (g *loginGuard) blocked(now time.Time, account, client string) (time.Duration, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var wait time.Duration
+	var scope string
+	for _, k := range []struct{ scope, key string }{{loginScopeAccount, account}, {loginScopeIP, client}} {
+		if r, ok := g.records[k.scope+" "+k.key]; ok && r.blockedTill.After(now) && r.blockedTill.Sub(now) > wait {
+			wait, scope = r.blockedTill.Sub(now), k.scope
+		}
+	}
+	return wait, scope
+}
+
+// fail records a failed login. It returns the scopes that have just been
+// locked out.
+func (g *loginGuard) fail(now time.Time, account, client string, cfg Config) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+
+	var locked []string
+	for _, k := range []struct {
+		scope, key string
+		max        int
+	}{{loginScopeAccount, account, cfg.LoginMaxFailures}, {loginScopeIP, client, cfg.LoginMaxFailuresPerIP}} {
+		if k.max == 0 {
+			continue
+		}
+		r := g.records[k.scope+" "+k.key]
+		if r == nil {
+			r = &loginRecord{}
+			g.records[k.scope+" "+k.key] = r
+		}
+		r.failures++
+		r.last = now
+
+		switch {
+		case r.failures >= k.max:
+			lockout := min(cfg.LoginLockout<<min(r.lockouts, 16), maxLoginLockout)
+			r.blockedTill = now.Add(lockout)
+			r.failures = 0
+			r.lockouts++
+			locked = append(locked, k.scope)
+		case k.scope == loginScopeAccount:
+			// Addresses aren't delayed: one address can be a whole office
+			// behind NAT, and its limit is higher to match.
+			r.blockedTill = now.Add(loginBaseDelay << min(r.failures-1, 16))
+		}
+	}
+	return locked
+}
+
+// succeed forgets an account's failures after a successful login.
+func (g *loginGuard) succeed(account string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.records, loginScopeAccount+" "+account)
+}
+
+// sweep forgets records with no recent failures, at most once a minute.
+// The caller must hold the lock.
+func (g *loginGuard) sweep(now time.Time) {
+	if now.Sub(g.swept) < time.Minute {
+		return
+	}
+	g.swept = now
+	for key, r := range g.records {
+		if now.Sub(r.last) > loginFailureMemory && !r.blockedTill.After(now) {
+			delete(g.records, key)
+		}
+	}
+}
+
+// checkLoginAllowed answers 429 and returns false if a login is blocked.
+func (s *Server) checkLoginAllowed(w http.ResponseWriter, account, client string) bool {
+	wait, scope := s.logins.blocked(s.clock.Now(), account, client)
+	if wait <= 0 {
+		return true
+	}
+	s.metrics.ObserveLoginBlocked(scope)
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	what := "this account"
+	if scope == loginScopeIP {
+		what = "your address"
+	}
+	writeProblem(w, http.StatusTooManyRequests, fmt.Sprintf("too many failed logins for %s; try again in %d seconds", what, seconds))
+	return false
+}
+
+// loginFailed records a failed login, and logs and counts any lockout.
+func (s *Server) loginFailed(r *http.Request, account, client string) {
+	s.metrics.ObserveLoginFailure()
+	for _, scope := range s.logins.fail(s.clock.Now(), account, client, s.config()) {
+		s.metrics.ObserveLoginLockout(scope)
+		slog.WarnContext(r.Context(), "Locked out logins after repeated failures", "scope", scope, "account", account, "client", client)
+	}
+}
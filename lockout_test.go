@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoginLockout fails to log in as alice until her account is locked,
+// checks the delays on the way and that even her password is refused while
+// locked, then that the next lockout lasts twice as long.
+func TestLoginLockout(t *testing.T) {
+	s, c := newUserTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.cfg.LoginMaxFailures, s.cfg.LoginLockout = 3, 10*time.Minute
+	c.Post("/api/v1/register", map[string]any{"username": "alice", "email": "alice@example.com", "password": "correct horse"}).Status(http.StatusCreated)
+
+	login := func(password string) int {
+		return c.Post("/api/v1/login", map[string]any{"login": "alice", "password": password}).Code
+	}
+	if code := login("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401, got %d", code)
+	}
+	c.Post("/api/v1/login", map[string]any{"login": "Alice", "password": "correct horse"}).
+		Status(http.StatusTooManyRequests).
+		HasHeader("Retry-After", "1").
+		JSON(`{"detail": "too many failed logins for this account; try again in 1 seconds", "...": "..."}`)
+	clock.Advance(time.Second)
+	login("wrong")
+	clock.Advance(time.Second)
+	if code := login("wrong"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second delay to be two seconds, got %d", code)
+	}
+	clock.Advance(time.Second)
+	login("wrong")
+
+	c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "correct horse"}).
+		Status(http.StatusTooManyRequests).
+		HasHeader("Retry-After", "600")
+	clock.Advance(10 * time.Minute)
+	for range 3 {
+		login("wrong")
+		clock.Advance(time.Minute)
+	}
+	clock.Advance(18 * time.Minute)
+	if code := login("correct horse"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second lockout to last 20 minutes, got %d", code)
+	}
+	clock.Advance(time.Minute)
+	if code := login("correct horse"); code != http.StatusOK {
+		t.Errorf("Expected alice to log in after the lockout, got %d", code)
+	}
+
+	// Logging in reset the count, and other accounts weren't affected.
+	clock.Advance(time.Hour)
+	if code := login("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a fresh count after logging in, got %d", code)
+	}
+	if code := c.Post("/api/v1/login", map[string]any{"login": "bob", "password": "wrong"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected bob not to be delayed, got %d", code)
+	}
+
+	metrics := c.Get("/metrics").Status(http.StatusOK).Body.String()
+	for _, want := range []string{"login_failures_total 8\n", `login_lockouts_total{scope="account"} 2`, `login_attempts_blocked_total{scope="account"} 4`} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected /metrics to contain %q", want)
+		}
+	}
+}
+
+// TestLoginLockoutPerIP checks an address trying one password on many
+// accounts is locked out, and logging in to its own account doesn't help.
+func TestLoginLockoutPerIP(t *testing.T) {
+	s, c := newUserTestServer(t)
+	s.useClock(newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)))
+	s.cfg.LoginMaxFailuresPerIP = 3
+	c.Post("/api/v1/register", map[string]any{"username": "mallory", "email": "mallory@example.com", "password": "my own password"}).Status(http.StatusCreated)
+
+	for _, victim := range []string{"alice", "bob"} {
+		c.Post("/api/v1/login", map[string]any{"login": victim, "password": "123456"}).Status(http.StatusUnauthorized)
+	}
+	c.Post("/api/v1/login", map[string]any{"login": "mallory", "password": "my own password"}).Status(http.StatusOK)
+	c.Post("/api/v1/login", map[string]any{"login": "carol", "password": "123456"}).Status(http.StatusUnauthorized)
+	c.Post("/api/v1/login", map[string]any{"login": "mallory", "password": "my own password"}).
+		Status(http.StatusTooManyRequests).
+		JSON(`{"detail": "too many failed logins for your address; try again in 900 seconds", "...": "..."}`)
+}
+
+// TestLoginLockoutAcrossTenants checks an address is locked out whichever
+// tenants its failures were in.
+func TestLoginLockoutAcrossTenants(t *testing.T) {
+	s, c := newUserTestServer(t)
+	s.useClock(newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)))
+	s.cfg.LoginMaxFailuresPerIP = 3
+
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		c.Header.Set(tenantHeader, tenant)
+		c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "123456"}).Status(http.StatusUnauthorized)
+	}
+	c.Header.Set(tenantHeader, "umbrella")
+	c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "123456"}).
+		Status(http.StatusTooManyRequests).
+		JSON(`{"detail": "too many failed logins for your address; try again in 900 seconds", "...": "..."}`)
+}
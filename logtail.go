@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements GET /admin/logs/tail, a WebSocket (see websocket.go)
+// that streams the server's log: the most recent entries first, then each
+// new one as it's logged, like kubectl logs --tail=100 -f but without
+// needing access to the cluster. Each message is a JSON LogEntry.
+//
+// Every entry the server logs is also kept in a ring buffer of the last
+// logTailSize, and handed to each connected tail. The query parameters
+// choose what's sent:
+//   - lines: how many recent entries to start with (default 100, 0 for
+//     none)
+//   - follow: "false" to send the recent entries and close, rather than
+//     going on with new ones
+//   - level: the lowest level to send, debug, info, warn or error
+//   - route: only entries logged while serving a route whose pattern
+//     contains this, such as "/api/v1/notes"
+//
+// Only entries the server logs at all are kept, so LOG_LEVEL=debug is
+// needed to see debug ones. It's an admin endpoint: with ADMIN_API_KEYS
+// set, the upgrade request needs the key. Browsers can't set headers on a
+// WebSocket, so it's meant for command-line clients:
+//
+//	websocat -H 'Authorization: Bearer <key>' 'ws://localhost:8000/admin/logs/tail?level=warn'
+//
+// A client too slow to keep up misses entries rather than holding up the
+// logging: each gets a buffer of logTailBuffer, and what doesn't fit is
+// dropped.
+
+// logTailSize is how many recent entries are kept.
+const logTailSize = 1000
+
+// logTailBuffer is how many entries can wait to be sent to one client.
+const logTailBuffer = 256
+
+// defaultTailLines is how many recent entries a tail starts with.
+const defaultTailLines = 100
+
+// LogEntry is one log entry, as sent by the log tail.
+type LogEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Route   string         `json:"route,omitempty"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// LogTail keeps the recent log entries and hands new ones to subscribers.
+type LogTail struct {
+	mu      sync.Mutex
+	entries []LogEntry // a ring: next is where the oldest one is, once full
+	next    int
+	subs    map[chan LogEntry]struct{}
+}
+
+// newLogTail creates an empty log tail.
+func newLogTail() *LogTail {
+	return &LogTail{entries: make([]LogEntry, 0, logTailSize), subs: make(map[chan LogEntry]struct{})}
+}
+
+// add keeps entry and hands it to the subscribers.
+func (t *LogTail) add(entry LogEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) < logTailSize {
+		t.entries = append(t.entries, entry)
+	} else {
+		t.entries[t.next] = entry
+		t.next = (t.next + 1) % logTailSize
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- entry:
+		default: // too slow: it misses this one
+		}
+	}
+}
+
+// Subscribe returns the recent entries, oldest first, and a channel that
+// receives new ones until cancel is called. Taking both under one lock
+// means nothing is missed or sent twice in between.
+func (t *LogTail) Subscribe() (recent []LogEntry, entries <-chan LogEntry, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recent = append(append(recent, t.entries[t.next:]...), t.entries[:t.next]...)
+	ch := make(chan LogEntry, logTailBuffer)
+	t.subs[ch] = struct{}{}
+	return recent, ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subs, ch)
+	}
+}
+
+// Handler returns a slog.Handler that passes records on to next and keeps
+// a copy of them in the tail.
+func (t *LogTail) Handler(next slog.Handler) slog.Handler {
+	return logTailHandler{Handler: next, tail: t}
+}
+
+// logTailHandler copies each record it handles into a LogTail. It keeps the
+// attributes added with Logger.With, and the group they're in, to add them
+// to each entry the way the text handler does.
+type logTailHandler struct {
+	slog.Handler
+	tail   *LogTail
+	attrs  []slog.Attr
+	prefix string // the groups, as "a.b."
+}
+
+// Handle records r and passes it on.
+func (h logTailHandler) Handle(ctx context.Context, r slog.Record) error {
+	entry := LogEntry{Time: r.Time, Level: r.Level.String(), Message: r.Message, Route: logRouteFromContext(ctx)}
+	if len(h.attrs) > 0 || r.NumAttrs() > 0 {
+		entry.Attrs = make(map[string]any)
+		for _, a := range h.attrs {
+			addLogAttr(entry.Attrs, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addLogAttr(entry.Attrs, h.prefix, a)
+			return true
+		})
+	}
+	h.tail.add(entry)
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs keeps the wrapper on loggers made with Logger.With.
+func (h logTailHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	kept := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	kept = append(kept, h.attrs...)
+	for _, a := range attrs {
+		kept = append(kept, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return logTailHandler{Handler: h.Handler.WithAttrs(attrs), tail: h.tail, attrs: kept, prefix: h.prefix}
+}
+
+// WithGroup keeps the wrapper on loggers made with Logger.WithGroup.
+func (h logTailHandler) WithGroup(name string) slog.Handler {
+	return logTailHandler{Handler: h.Handler.WithGroup(name), tail: h.tail, attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// addLogAttr adds a to attrs, with its group's name and a dot before the
+// key, as the text handler writes it.
+func addLogAttr(attrs map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			addLogAttr(attrs, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	if err, ok := v.Any().(error); ok {
+		attrs[prefix+a.Key] = err.Error()
+		return
+	}
+	attrs[prefix+a.Key] = v.Any()
+}
+
+// logRouteKey is the context key for the pattern of the route being
+// served.
+type logRouteKey struct{}
+
+// withLogRoute returns ctx recording that pattern's route is being served,
+// for the log tail's route filter.
+func withLogRoute(ctx context.Context, pattern string) context.Context {
+	return context.WithValue(ctx, logRouteKey{}, pattern)
+}
+
+// logRouteFromContext returns the route being served, or "".
+func logRouteFromContext(ctx context.Context) string {
+	route, _ := ctx.Value(logRouteKey{}).(string)
+	return route
+}
+
+// tailFilter is the choice of entries for one tail.
+type tailFilter struct {
+	level slog.Level
+	route string
+}
+
+// match reports whether the filter lets entry through.
+func (f tailFilter) match(entry LogEntry) bool {
+	var level slog.Level
+	if level.UnmarshalText([]byte(entry.Level)) != nil || level < f.level {
+		return false
+	}
+	return f.route == "" || strings.Contains(entry.Route, f.route)
+}
+
+// tailParams reads the query parameters of a tail.
+func tailParams(r *http.Request) (filter tailFilter, lines int, follow bool, problem string) {
+	q := r.URL.Query()
+	filter = tailFilter{level: slog.LevelDebug, route: q.Get("route")}
+	if v := q.Get("level"); v != "" {
+		if filter.level.UnmarshalText([]byte(v)) != nil {
+			return filter, 0, false, "level must be debug, info, warn or error"
+		}
+	}
+	lines = defaultTailLines
+	if v := q.Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > logTailSize {
+			return filter, 0, false, "lines must be a number between 0 and " + strconv.Itoa(logTailSize)
+		}
+		lines = n
+	}
+	return filter, lines, q.Get("follow") != "false", ""
+}
+
+// handleLogTail streams the log over a WebSocket.
+func (s *Server) handleLogTail(w http.ResponseWriter, r *http.Request) {
+	filter, lines, follow, problem := tailParams(r)
+	if problem != "" {
+		writeProblem(w, http.StatusBadRequest, problem)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	recent, entries, cancel := s.logTail.Subscribe()
+	defer cancel()
+
+	var matched []LogEntry
+	for _, entry := range recent {
+		if filter.match(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	for _, entry := range matched[max(len(matched)-lines, 0):] {
+		if !sendLogEntry(ws, entry) {
+			return
+		}
+	}
+	if !follow {
+		ws.Close(wsCloseNormal)
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		ws.ReadLoop()
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-s.stopping:
+			ws.Close(wsCloseGoingAway)
+			return
+		case entry := <-entries:
+			if filter.match(entry) && !sendLogEntry(ws, entry) {
+				return
+			}
+		}
+	}
+}
+
+// sendLogEntry sends entry as JSON, and reports whether it could.
+func sendLogEntry(ws *wsConn, entry LogEntry) bool {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		// An attribute that can't be encoded; send the rest.
+		entry.Attrs = nil
+		data, _ = json.Marshal(entry)
+	}
+	if err := ws.WriteText(data); err != nil {
+		ws.conn.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestLogTailRing checks the tail keeps the latest logTailSize entries,
+// oldest first, with the logger's attributes and groups.
+func TestLogTailRing(t *testing.T) {
+	tail := newLogTail()
+	logger := slog.New(tail.Handler(slog.NewTextHandler(io.Discard, nil))).With("pod", "web-1")
+	for i := range logTailSize + 5 {
+		logger.Info("line", "n", i)
+	}
+	logger.WithGroup("req").Warn("failed", "error", errors.New("boom"))
+
+	recent, _, cancel := tail.Subscribe()
+	cancel()
+	if len(recent) != logTailSize {
+		t.Fatalf("Expected %d entries, got %d", logTailSize, len(recent))
+	}
+	if first := recent[0]; first.Attrs["n"] != int64(6) || first.Attrs["pod"] != "web-1" {
+		t.Errorf("Expected the oldest kept to be line 6 from web-1, got %+v", first)
+	}
+	if last := recent[len(recent)-1]; last.Level != "WARN" || last.Attrs["req.error"] != "boom" {
+		t.Errorf("Expected the grouped error last, got %+v", last)
+	}
+}
+
+// TestLogTailWebSocket tails the log over a WebSocket: the recent entries
+// that match, then new ones as they're logged.
+func TestLogTailWebSocket(t *testing.T) {
+	openAdmin(t)
+	s, _ := newTestServer(t)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	logger := slog.New(s.logTail.Handler(slog.NewTextHandler(io.Discard, nil)))
+	notes := withLogRoute(context.Background(), "GET /api/v1/notes")
+
+	logger.WarnContext(notes, "old")
+	logger.WarnContext(notes, "recent")
+	logger.InfoContext(notes, "too quiet")
+	logger.Warn("elsewhere")
+
+	c := dialWebSocket(t, srv, "/admin/logs/tail?lines=1&level=warn&route=/api/v1/notes", nil)
+	read := func() LogEntry {
+		t.Helper()
+		_, payload := c.Read()
+		var entry LogEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	if entry := read(); entry.Message != "recent" || entry.Route != "GET /api/v1/notes" {
+		t.Errorf("Expected the most recent match, got %+v", entry)
+	}
+
+	// The tail has subscribed by the time the first entry arrives.
+	logger.Warn("still elsewhere")
+	logger.ErrorContext(notes, "live")
+	if entry := read(); entry.Message != "live" || entry.Level != "ERROR" {
+		t.Errorf("Expected the live entry, got %+v", entry)
+	}
+}
+
+// TestLogTailAuth checks the tail is an admin endpoint, and a plain GET is
+// told to upgrade.
+func TestLogTailAuth(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	c.Get("/admin/logs/tail").Status(http.StatusUpgradeRequired)
+	c.Get("/admin/logs/tail?level=loud").Status(http.StatusBadRequest)
+
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+	c.Get("/admin/logs/tail").Status(http.StatusUnauthorized)
+
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	dialWebSocket(t, srv, "/admin/logs/tail?follow=false", http.Header{"Authorization": {"Bearer k1"}})
+}
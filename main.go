@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -24,79 +28,47 @@ type HealthResponse struct {
 
 // MessageResponse represents a simple message response.
 // This demonstrates how to structure data for API responses.
+//
+// Time is always RFC 3339 in UTC, for programs; Local is the same moment for
+// people, in their language and time zone (see locale.go).
 type MessageResponse struct {
-	Message string `json:"message"`
-	Time    string `json:"time"`
+	Message string        `json:"message"`
+	Time    string        `json:"time"`
+	Local   LocalizedTime `json:"local"`
+}
+
+// IndexData is the data available to the landing page template. It's the
+// same for every visitor, so the page can be rendered once and cached (see
+// landing.go); the visit count and exercise progress are filled in by
+// static/landing.js.
+type IndexData struct {
+	// Banner is an optional announcement shown above the page content,
+	// set with BANNER_TEXT (and reloadable without a restart).
+	Banner string
+
+	// Instance is the host that served the page (see counter.go) and
+	// Color its colour (see instance.go).
+	Instance string
+	Color    string
 }
 
 // handleRoot handles requests to the root path "/"
 // This is our main page that displays the hello world message.
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	// In a real application, you'd probably render an HTML template here.
-	// For this simple example, we're just sending plain HTML.
-	
-	html := `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Hello DevOps!</title>
-    <style>
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
-            max-width: 800px;
-            margin: 50px auto;
-            padding: 20px;
-            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
-            color: white;
-            text-align: center;
-        }
-        .container {
-            background: rgba(255, 255, 255, 0.1);
-            border-radius: 10px;
-            padding: 40px;
-            backdrop-filter: blur(10px);
-        }
-        h1 {
-            font-size: 3em;
-            margin: 0;
-        }
-        p {
-            font-size: 1.2em;
-            margin: 20px 0;
-        }
-        .info {
-            margin-top: 30px;
-            font-size: 0.9em;
-            opacity: 0.8;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>👋 Hello DevOps!</h1>
-        <p>Welcome to your first Go web application running in Coderbox.</p>
-        <p>This is where your journey begins. Start editing and watch the changes happen!</p>
-        <div class="info">
-            <p>Try these endpoints:</p>
-            <p>GET /health - Check if the service is running</p>
-            <p>GET /api/message - Get a JSON response</p>
-        </div>
-    </div>
-</body>
-</html>
-`
-	
-	// Set the content type header to tell the browser we're sending HTML
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	
-	// Write the HTTP status code. 200 means OK.
-	w.WriteHeader(http.StatusOK)
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	// Every path without a route of its own ends up here, but only views
+	// of the page itself (not /favicon.ico and friends) count as visits.
+	if r.URL.Path == "/" {
+		s.store.IncrementCounter(tenantFromContext(r.Context()))
+	}
 	
-	// Write the HTML response
-	fmt.Fprint(w, html)
+	// The HTML lives in templates/index.html and is compiled into the binary
+	// (see templates.go). It's rendered once and then served from memory;
+	// see landing.go.
+	s.serveLanding(w, r)
 	
-	// Log that we served a request. In production, you'd use structured logging.
-	log.Printf("Served request to %s from %s", r.URL.Path, r.RemoteAddr)
+	// Log that we served a request. Passing the request's context lets the
+	// log line carry its trace and span IDs (see tracecontext.go).
+	slog.InfoContext(r.Context(), "Served request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 }
 
 // handleHealth provides a health check endpoint for monitoring and orchestration.
@@ -107,7 +79,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	response := HealthResponse{
 		Status:    "healthy",
 		Timestamp: time.Now(),
-		Version:   "1.0.0",
+		Version:   version,
 	}
 	
 	// Set the content type to JSON
@@ -124,12 +96,23 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // handleMessage provides a simple API endpoint that returns a JSON message.
 // This demonstrates the pattern for building JSON APIs in Go.
-func handleMessage(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	now := s.clock.Now()
+	local, err := localizeTime(r, now)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
 	response := MessageResponse{
 		Message: "This is your first API endpoint! Try modifying this message.",
-		Time:    time.Now().Format(time.RFC3339),
+		Time:    now.UTC().Format(time.RFC3339),
+		Local:   local,
 	}
 	
+	// The answer depends on these headers, so caches must key on them too.
+	w.Header().Set("Vary", "Accept-Language, Time-Zone")
+	w.Header().Set("Content-Language", local.Locale)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	
@@ -146,52 +129,189 @@ func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		
-		// Call the actual handler
+		// Call the actual handler. Lines it logs with the request's context
+		// say which route they came from, for the log tail (see logtail.go).
+		r = r.WithContext(withLogRoute(r.Context(), r.Pattern))
 		next(w, r)
 		
 		// Log information about the request after it's been handled
 		duration := time.Since(start)
-		log.Printf("%s %s completed in %v", r.Method, r.URL.Path, duration)
+		slog.InfoContext(r.Context(), "Request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"tenant", tenantFromContext(r.Context()),
+			"request_id", requestIDFromContext(r.Context()),
+			"duration", duration)
 	}
 }
 
+// version is the application version. It defaults to a development value but
+// can be stamped at build time without editing code:
+//
+//	go build -ldflags "-X main.version=1.2.3" .
+var version = "1.0.0"
+
 func main() {
-	// Get the port from an environment variable, defaulting to 8000 if not set.
-	// This is a common pattern for configuring applications in containers.
-	// Different environments can set different ports without changing the code.
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	// The binary is a small command-line tool with subcommands (serve, version,
+	// healthcheck, ...). Running it with no arguments starts the web server, so
+	// "go run ." and the Docker image behave exactly as they always have.
+	// See cli.go for the list of commands.
+	//
+	// Before anything reads the configuration, load variables from a .env
+	// file if there is one (see dotenv.go).
+	if err := loadDotenv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve starts the HTTP server and blocks until it stops.
+func serve(cfg Config) error {
+	// Replace secret settings with the ones from Vault, if it's configured
+	// (see vault.go), before anything uses them.
+	cfg, vault, err := withVaultSecrets(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create the server, which owns the data store and metrics.
+	srv := newServer(cfg)
+	srv.vault = vault
+	
+	// Send all logging through log/slog, which supports levels. The level
+	// comes from the server so a config reload can change it. Calls to
+	// log.Printf keep working: slog.SetDefault redirects them at INFO level.
+	// In Kubernetes, every line also says which pod wrote it (see
+	// instance.go).
+	// traceLogHandler adds trace_id and span_id to lines logged with a
+	// request's context, and the log tail keeps a copy of each line for
+	// /admin/logs/tail (see logtail.go).
+	logger := slog.New(traceLogHandler{srv.logTail.Handler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: srv.logLevel}))})
+	slog.SetDefault(logger.With(podLogAttrs()...))
+	logPodMetadata(currentInstance(time.Now(), cfg.PodInfoDir))
+	
+	// Wait for the services listed in WAIT_FOR to come up before listening
+	// (see waitfor.go).
+	if err := waitForDependencies(context.Background(), srv.clock, srv.outbound, cfg.WaitFor, cfg.WaitTimeout); err != nil {
+		return err
+	}
+	
+	// Register what has to happen before the server takes traffic:
+	// migrating and loading the data file among other things. The tasks
+	// run once the server is listening (see startup.go).
+	srv.registerStartupTasks(cfg)
+	
+	// Register the dependency checks behind /readyz (see readiness.go).
+	srv.registerReadinessChecks(cfg)
+	
+	// Reload reloadable settings whenever the process receives SIGHUP.
+	go srv.reloadOnSignal()
+	
+	// In dev mode, watch the templates and static files for edits and tell
+	// open browser tabs to reload when they change.
+	if cfg.DevMode {
+		log.Printf("Dev mode: serving templates and static files from disk with live reload")
+		go srv.assets.Watch(context.Background(), 500*time.Millisecond, srv.liveReload.Notify)
+	}
+	
+	// Without ADMIN_API_KEYS the admin endpoints are closed outside dev
+	// mode (see admin.go); say so, rather than leave a 403 to puzzle over.
+	if len(cfg.AdminAPIKeys) == 0 && !cfg.DevMode {
+		log.Printf("Admin endpoints are disabled until ADMIN_API_KEYS is set")
 	}
 	
 	// Set up our HTTP routes using the standard library's http.ServeMux.
 	// ServeMux is a request router that matches incoming requests to handlers.
-	mux := http.NewServeMux()
-	
-	// Register our handlers with the router.
-	// We wrap each handler with our logging middleware to get request logs.
-	mux.HandleFunc("/", loggingMiddleware(handleRoot))
-	mux.HandleFunc("/health", loggingMiddleware(handleHealth))
-	mux.HandleFunc("/api/message", loggingMiddleware(handleMessage))
+	// See routes() in server.go for the full list of endpoints, and
+	// handler() for what goes in front of them.
+	handler := srv.handler()
 	
 	// Configure the HTTP server.
-	// In production, you'd want to set timeouts to prevent resource exhaustion.
+	// Timeouts prevent resource exhaustion from slow or idle clients; their
+	// values come from the configuration (see config.go).
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:         fmt.Sprintf(":%d", cfg.Port),
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 	
 	// Log that we're starting up
-	log.Printf("Starting server on port %s", port)
-	log.Printf("Access the application at http://localhost:%s", port)
-	
-	// Start the server. ListenAndServe blocks until the server shuts down.
-	// If there's an error starting the server (for example, if the port is
-	// already in use), ListenAndServe returns the error and we log it and exit.
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	log.Printf("Starting server on port %d", cfg.Port)
+	log.Printf("Access the application at http://localhost:%d", cfg.Port)
+	
+	// Start the server. ListenAndServe blocks until the server shuts down,
+	// so it runs in its own goroutine while this one waits for a signal to
+	// stop. If there's an error starting the server (for example, if the
+	// port is already in use), ListenAndServe returns the error and we pass
+	// it back to the CLI, which logs it and exits with a failure code.
+	errs := make(chan error, 2)
+	go func() { errs <- server.ListenAndServe() }()
+	
+	// Run the startup tasks. If one fails, so does starting the server.
+	go func() {
+		if err := srv.startup.Run(context.Background()); err != nil {
+			errs <- err
+			return
+		}
+		
+		// Permanently remove notes that were deleted long enough ago.
+		go srv.purgeDeletedNotes(context.Background(), cfg.PurgeInterval)
+		
+		// Save the visit counters now and then (see countersave.go).
+		go srv.saveCounters(context.Background(), cfg.CounterSaveInterval)
+		
+		// Erase the accounts whose users asked to be deleted.
+		go srv.eraseUsers(context.Background(), cfg.AccountEraseInterval)
+		
+		// Keep the upstreams' endpoints up to date (see resolver.go).
+		go srv.watchUpstreams(context.Background(), cfg.UpstreamRefreshInterval)
+		
+		// Watch for saturation, for load shedding (see shed.go).
+		go srv.adjustLoadShedding(context.Background(), shedInterval)
+		
+		// Record the Go runtime's metrics (see runtimemetrics.go).
+		if cfg.RuntimeMetricsInterval > 0 {
+			go srv.collectRuntimeMetrics(context.Background(), cfg.RuntimeMetricsInterval)
+		}
+		
+		// Tell the monitor we're alive (see heartbeat.go).
+		if cfg.HeartbeatURL != "" {
+			go srv.sendHeartbeats(context.Background(), cfg.HeartbeatURL, cfg.HeartbeatMethod, cfg.HeartbeatInterval)
+		}
+		
+		// Say so in chat, and post notifications in batches from now on
+		// (see notify.go).
+		srv.notify(eventStartup, "started and taking traffic")
+		if srv.notifier != nil && cfg.NotifyBatchInterval > 0 {
+			go srv.postNotifications(context.Background(), cfg.NotifyBatchInterval)
+		}
+		
+		// Publish a status summary now and then (see status.go).
+		if cfg.StatusInterval > 0 {
+			go srv.broadcastStatus(context.Background(), cfg.StatusInterval)
+		}
+		
+		// Keep the counter's read model up to date (see projection.go).
+		go srv.projectCounters(context.Background(), cfg.ProjectionInterval)
+		
+		// Keep the Vault token and secret from expiring (see vault.go).
+		go srv.renewVault(context.Background())
+		
+		// Ready for traffic, so tell Consul where to find us (see consul.go).
+		srv.registerWithConsul()
+	}()
+	
+	// SIGTERM is how Docker and Kubernetes ask a container to stop; SIGINT
+	// is Ctrl-C. Either one starts a graceful shutdown (see shutdown.go).
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("server failed to start: %w", err)
+	case sig := <-stop:
+		return srv.terminate(server, sig, cfg.ShutdownDelay, cfg.ShutdownTimeout)
 	}
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -23,8 +25,12 @@ func TestHandleRoot(t *testing.T) {
 	// records what the handler writes so we can check it in our test.
 	rec := httptest.NewRecorder()
 	
+	// handleRoot is a method on Server because it reads the banner from the
+	// configuration, so we create a server with an empty configuration first.
+	srv := newServer(Config{})
+	
 	// Call our handler with the fake request and recorder
-	handleRoot(rec, req)
+	srv.handleRoot(rec, req)
 	
 	// Check that the status code is correct
 	// If it's not 200 OK, the test fails
@@ -105,7 +111,7 @@ func TestHandleMessage(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/api/message", nil)
 	rec := httptest.NewRecorder()
 	
-	handleMessage(rec, req)
+	newServer(Config{}).handleMessage(rec, req)
 	
 	if rec.Code != http.StatusOK {
 		t.Fatalf("Expected status 200, got %d", rec.Code)
@@ -142,6 +148,11 @@ func TestLoggingMiddleware(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 	
+	// Send the log to a buffer, as JSON, to check its fields
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	
 	// Wrap the handler with our middleware
 	wrappedHandler := loggingMiddleware(testHandler)
 	
@@ -159,6 +170,21 @@ func TestLoggingMiddleware(t *testing.T) {
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
 	}
+	
+	// Verify the details are separate fields, not part of the message,
+	// so log tools can filter on them
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("Expected one JSON log line, got %q: %v", logs.String(), err)
+	}
+	if line["msg"] != "Request completed" || line["method"] != "GET" || line["path"] != "/test" || line["tenant"] != defaultTenant {
+		t.Errorf("Expected the request's details as fields, got %v", line)
+	}
+	for _, key := range []string{"request_id", "duration"} {
+		if _, ok := line[key]; !ok {
+			t.Errorf("Expected a %s field, got %v", key, line)
+		}
+	}
 }
 
 // contains is a helper function that checks if a string contains a substring.
@@ -187,12 +213,13 @@ func containsHelper(s, substr string) bool {
 // to develop for when you're working on performance-critical code.
 func BenchmarkHandleRoot(b *testing.B) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	srv := newServer(Config{})
 	
 	// The testing framework sets b.N to an appropriate number of iterations
 	// to get statistically significant results
 	for i := 0; i < b.N; i++ {
 		rec := httptest.NewRecorder()
-		handleRoot(rec, req)
+		srv.handleRoot(rec, req)
 	}
 }
 
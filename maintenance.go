@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This file implements maintenance mode: while it's on, every request but
+// the probes, the metrics and the admin pages gets 503 Service Unavailable
+// with a message, as a page for browsers and a problem for API clients. It's
+// for the times the data must not change underneath someone, like a
+// migration run by hand, and is switched on and off from the admin UI or
+// with PUT /admin/maintenance:
+//
+//	curl -X PUT -d '{"enabled": true, "message": "Back at 10:00 UTC"}' http://localhost:8000/admin/maintenance
+//
+// /readyz is left alone on purpose. A pod in maintenance mode should stay
+// in the load balancer so visitors see the maintenance page, rather than be
+// taken out and leave them with the load balancer's own error. (Making
+// /readyz fail for the "maintenance" feature flag is one of the exercises
+// in learn.go, which is a different trade-off.)
+//
+// The switch is kept in memory, so it applies to this instance only and is
+// off again after a restart.
+
+// defaultMaintenanceMessage is shown if none is given.
+const defaultMaintenanceMessage = "The site is down for maintenance. Please try again shortly."
+
+// maintenanceRetryAfter is the Retry-After sent with the 503, in seconds.
+const maintenanceRetryAfter = "120"
+
+// MaintenanceState is the JSON body of GET and PUT /admin/maintenance.
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// MaintenancePage is the data for the maintenance template.
+type MaintenancePage struct {
+	Message string
+}
+
+// maintenanceGate answers 503 for everything but startupPaths and the admin
+// routes while maintenance mode is on. Like startupGate, it wraps the whole
+// router, proxied routes included.
+func (s *Server) maintenanceGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := s.maintenance.Load()
+		if state == nil || startupPaths[r.URL.Path] || r.URL.Path == "/admin" ||
+			strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			s.renderPage(w, "maintenance.html", http.StatusServiceUnavailable, MaintenancePage{Message: state.Message})
+			return
+		}
+		writeProblem(w, http.StatusServiceUnavailable, state.Message)
+	})
+}
+
+// handleGetMaintenance reports whether maintenance mode is on.
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	state := s.maintenance.Load()
+	if state == nil {
+		state = &MaintenanceState{}
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleSetMaintenance switches maintenance mode on or off.
+func (s *Server) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceState
+	if !decodeValid(w, r, "maintenance", &req) {
+		return
+	}
+	if !req.Enabled {
+		if s.maintenance.Swap(nil) != nil {
+			s.adminEvent(adminEventMaintenance, "maintenance mode is off", nil)
+		}
+		writeJSON(w, http.StatusOK, MaintenanceState{})
+		return
+	}
+
+	now := s.clock.Now()
+	state := &MaintenanceState{Enabled: true, Message: cleanText(req.Message, false), Since: &now}
+	if state.Message == "" {
+		state.Message = defaultMaintenanceMessage
+	}
+	if old := s.maintenance.Swap(state); old != nil {
+		state.Since = old.Since
+	}
+	s.adminEvent(adminEventMaintenance, "maintenance mode is on: "+state.Message, state)
+	writeJSON(w, http.StatusOK, state)
+}
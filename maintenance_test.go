@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMaintenanceMode switches maintenance mode on and off, and checks what
+// is turned away in between.
+func TestMaintenanceMode(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	_, events, cancel := s.adminEvents.Subscribe(0)
+	defer cancel()
+	c.Get("/admin/maintenance").JSON(`{"enabled": false}`)
+
+	c.Put("/admin/maintenance", map[string]any{"enabled": true, "message": "Back at 10:00"}).
+		Status(http.StatusOK).
+		JSON(`{"enabled": true, "message": "Back at 10:00", "...": "..."}`)
+	if event := <-events; event.Type != adminEventMaintenance || event.Message != "maintenance mode is on: Back at 10:00" {
+		t.Errorf("Expected a maintenance event, got %+v", event)
+	}
+
+	c.Get("/api/v1/counter").
+		Status(http.StatusServiceUnavailable).
+		HasHeader("Retry-After", maintenanceRetryAfter).
+		JSON(`{"status": 503, "detail": "Back at 10:00", "...": "..."}`)
+	c.Get("/readyz").Status(http.StatusOK)
+	c.Get("/admin/maintenance").Status(http.StatusOK)
+	c.Get("/static/style.css").Status(http.StatusOK)
+
+	c.Header.Set("Accept", "text/html")
+	if page := c.Get("/").Status(http.StatusServiceUnavailable).Body.String(); !strings.Contains(page, "Back at 10:00") {
+		t.Errorf("Expected the maintenance page with the message, got %s", page)
+	}
+	c.Header.Del("Accept")
+
+	c.Put("/admin/maintenance", map[string]any{"enabled": false}).JSON(`{"enabled": false}`)
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+	if event := <-events; event.Message != "maintenance mode is off" {
+		t.Errorf("Expected maintenance mode off, got %+v", event)
+	}
+}
+
+// TestMaintenanceModeDefaults checks the default message, that switching
+// on again keeps the original time, and that the body is validated.
+func TestMaintenanceModeDefaults(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	s.useClock(clock)
+
+	c.Put("/admin/maintenance", map[string]any{"enabled": true}).
+		JSON(`{"enabled": true, "message": "` + defaultMaintenanceMessage + `", "since": "2024-05-01T09:00:00Z"}`)
+
+	clock.Advance(time.Minute)
+	c.Put("/admin/maintenance", map[string]any{"enabled": true, "message": "Nearly done"}).
+		JSON(`{"enabled": true, "message": "Nearly done", "since": "2024-05-01T09:00:00Z"}`)
+
+	c.Put("/admin/maintenance", map[string]any{"message": "no switch"}).Status(http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements basic request metrics in the Prometheus text format.
+// Logs tell you what happened to a single request; metrics tell you how the
+// service behaves overall (how many requests, how many errors, how slow).
+// Prometheus scrapes the /metrics endpoint periodically and stores the values
+// over time so you can graph and alert on them.
+//
+// The official Prometheus client library does a lot more, but the text format
+// is simple enough that writing it ourselves shows there is no magic involved.
+
+// requestLabels identifies one time series. Every distinct combination of
+// label values becomes its own line in the /metrics output, so labels must
+// only ever hold a small set of values (route patterns, not raw URLs).
+type requestLabels struct {
+	Tenant string
+	Method string
+	Route  string
+	Status int
+}
+
+// requestStats accumulates the values for one combination of labels.
+type requestStats struct {
+	count   uint64
+	seconds float64
+}
+
+// outboundLabels identifies one time series of requests this server sent
+// to other services (see outbound.go). Status is the response's status
+// code, or "error" when no response came back.
+type outboundLabels struct {
+	Host   string
+	Method string
+	Status string
+}
+
+// proxyLabels identifies one time series of requests forwarded by the
+// proxy (see proxy.go). Status is the status code sent back to the client.
+type proxyLabels struct {
+	Upstream string
+	Status   string
+}
+
+// affinityLabels identifies one time series of sticky routes' requests.
+// Result is "hit" (the client's endpoint served it), "new" (the client had
+// none yet) or "moved" (its endpoint wasn't available).
+type affinityLabels struct {
+	Upstream string
+	Result   string
+}
+
+// latencyWindow is how many recent request durations are kept for
+// computing percentiles.
+const latencyWindow = 1000
+
+// Metrics collects request statistics. It is safe for concurrent use.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]*requestStats
+	outbound map[outboundLabels]*requestStats
+	proxy    map[proxyLabels]*requestStats
+
+	// proxyRetries counts the retries of proxied requests, per upstream.
+	proxyRetries map[string]uint64
+
+	// runtime is the Go runtime's measurements, and runtimeCollected
+	// whether there are any yet (see runtimemetrics.go).
+	runtime          RuntimeStats
+	runtimeCollected bool
+
+	// deduplicated counts the requests that shared another's response,
+	// per route (see dedup.go).
+	deduplicated map[string]uint64
+
+	// affinity counts how sticky routes' requests were placed (see
+	// affinity.go).
+	affinity map[affinityLabels]uint64
+
+	// latencies is a ring buffer of the most recent request durations:
+	// once full, each new one overwrites the oldest, at latencyNext.
+	latencies   []time.Duration
+	latencyNext int
+
+	// lastOutbound is the most recent outbound request to each host.
+	lastOutbound map[string]outboundResult
+
+	// inFlight and queued are the numbers of requests being handled and
+	// waiting to be (see limit.go).
+	inFlight int64
+	queued   int64
+
+	// shed counts the requests shed, and shedFraction is the share being
+	// shed (see shed.go).
+	shed         uint64
+	shedFraction float64
+
+	// rateLimited counts the requests over a client's rate limit (see
+	// ratelimit.go).
+	rateLimited uint64
+
+	// loginFailures counts failed logins, and loginLockouts and
+	// loginsBlocked the lockouts and the attempts refused during them,
+	// by scope (see lockout.go).
+	loginFailures uint64
+	loginLockouts map[string]uint64
+	loginsBlocked map[string]uint64
+}
+
+// outboundResult is how an outbound request went, and when.
+type outboundResult struct {
+	Status string
+	At     time.Time
+}
+
+// newMetrics creates an empty metrics collector.
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:     make(map[requestLabels]*requestStats),
+		outbound:     make(map[outboundLabels]*requestStats),
+		lastOutbound: make(map[string]outboundResult),
+		proxy:        make(map[proxyLabels]*requestStats),
+		proxyRetries: make(map[string]uint64),
+		affinity:     make(map[affinityLabels]uint64),
+		deduplicated: make(map[string]uint64),
+
+		loginLockouts: make(map[string]uint64),
+		loginsBlocked: make(map[string]uint64),
+	}
+}
+
+// AddInFlight adds delta to the number of requests being handled.
+func (m *Metrics) AddInFlight(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight += delta
+}
+
+// AddQueued adds delta to the number of requests waiting to be handled.
+func (m *Metrics) AddQueued(delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued += delta
+}
+
+// ObserveShed counts a shed request.
+func (m *Metrics) ObserveShed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shed++
+}
+
+// ObserveRateLimited counts a request over its client's rate limit.
+func (m *Metrics) ObserveRateLimited() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimited++
+}
+
+// ObserveLoginFailure counts a failed login.
+func (m *Metrics) ObserveLoginFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginFailures++
+}
+
+// ObserveLoginLockout counts an account or address locked out.
+func (m *Metrics) ObserveLoginLockout(scope string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginLockouts[scope]++
+}
+
+// ObserveLoginBlocked counts a login refused because of a lockout or delay.
+func (m *Metrics) ObserveLoginBlocked(scope string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginsBlocked[scope]++
+}
+
+// SetShedFraction records the share of requests being shed.
+func (m *Metrics) SetShedFraction(fraction float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shedFraction = fraction
+}
+
+// ObserveRequest records one completed request and how long it took.
+func (m *Metrics) ObserveRequest(labels requestLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.requests[labels]
+	if !ok {
+		stats = &requestStats{}
+		m.requests[labels] = stats
+	}
+	stats.count++
+	stats.seconds += duration.Seconds()
+}
+
+// ObserveOutbound records one request sent to another service.
+func (m *Metrics) ObserveOutbound(labels outboundLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.outbound[labels]
+	if !ok {
+		stats = &requestStats{}
+		m.outbound[labels] = stats
+	}
+	stats.count++
+	stats.seconds += duration.Seconds()
+	m.lastOutbound[labels.Host] = outboundResult{Status: labels.Status, At: time.Now()}
+}
+
+// ObserveProxy records one request forwarded to an upstream.
+func (m *Metrics) ObserveProxy(labels proxyLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.proxy[labels]
+	if !ok {
+		stats = &requestStats{}
+		m.proxy[labels] = stats
+	}
+	stats.count++
+	stats.seconds += duration.Seconds()
+}
+
+// ObserveProxyRetry records that a proxied request was sent again.
+func (m *Metrics) ObserveProxyRetry(upstream string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proxyRetries[upstream]++
+}
+
+// SetRuntime records the Go runtime's latest measurements.
+func (m *Metrics) SetRuntime(stats RuntimeStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runtime, m.runtimeCollected = stats, true
+}
+
+// ObserveDeduplicated counts a request to route that shared another's
+// response.
+func (m *Metrics) ObserveDeduplicated(route string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deduplicated[route]++
+}
+
+// ObserveAffinity records how a sticky route's request was placed.
+func (m *Metrics) ObserveAffinity(labels affinityLabels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.affinity[labels]++
+}
+
+// ObserveLatency adds a request duration to the window used for
+// percentiles. Long-lived streaming responses shouldn't be added: an SSE
+// connection open for an hour says nothing about how fast the server is.
+func (m *Metrics) ObserveLatency(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.latencies) < latencyWindow {
+		m.latencies = append(m.latencies, duration)
+		return
+	}
+	m.latencies[m.latencyNext] = duration
+	m.latencyNext = (m.latencyNext + 1) % latencyWindow
+}
+
+// MetricsSnapshot summarizes the metrics at one moment, for the dashboard.
+type MetricsSnapshot struct {
+	Requests     uint64             `json:"requests"`
+	ClientErrors uint64             `json:"client_errors"` // 4xx responses
+	ServerErrors uint64             `json:"server_errors"` // 5xx responses
+	Latency      LatencyPercentiles `json:"latency"`
+	Outbound     []OutboundSummary  `json:"outbound"`
+	Runtime      RuntimeStats       `json:"runtime"`
+}
+
+// LatencyPercentiles are computed over the most recent requests, in
+// milliseconds. P99 is the time 99% of requests finished within, which
+// shows the slow tail that an average hides.
+type LatencyPercentiles struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+// OutboundSummary totals the outbound requests to one host. Errors counts
+// requests that got no response or a 5xx one.
+type OutboundSummary struct {
+	Host       string    `json:"host"`
+	Requests   uint64    `json:"requests"`
+	Errors     uint64    `json:"errors"`
+	LastStatus string    `json:"last_status"`
+	LastAt     time.Time `json:"last_at"`
+}
+
+// Snapshot returns the current totals and percentiles.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var snap MetricsSnapshot
+	for labels, stats := range m.requests {
+		snap.Requests += stats.count
+		switch {
+		case labels.Status >= 500:
+			snap.ServerErrors += stats.count
+		case labels.Status >= 400:
+			snap.ClientErrors += stats.count
+		}
+	}
+
+	snap.Runtime = m.runtime
+
+	sorted := slices.Clone(m.latencies)
+	slices.Sort(sorted)
+	snap.Latency = LatencyPercentiles{
+		Samples: len(sorted),
+		P50:     percentileMillis(sorted, 0.50),
+		P90:     percentileMillis(sorted, 0.90),
+		P99:     percentileMillis(sorted, 0.99),
+	}
+
+	hosts := make(map[string]*OutboundSummary)
+	for labels, stats := range m.outbound {
+		sum, ok := hosts[labels.Host]
+		if !ok {
+			last := m.lastOutbound[labels.Host]
+			sum = &OutboundSummary{Host: labels.Host, LastStatus: last.Status, LastAt: last.At}
+			hosts[labels.Host] = sum
+		}
+		sum.Requests += stats.count
+		if outboundFailed(labels.Status) {
+			sum.Errors += stats.count
+		}
+	}
+	for _, sum := range hosts {
+		snap.Outbound = append(snap.Outbound, *sum)
+	}
+	slices.SortFunc(snap.Outbound, func(a, b OutboundSummary) int { return strings.Compare(a.Host, b.Host) })
+
+	return snap
+}
+
+// outboundFailed reports whether an outbound status label is a failure.
+func outboundFailed(status string) bool {
+	code, err := strconv.Atoi(status)
+	return err != nil || code >= 500
+}
+
+// percentileMillis returns the p-th percentile of sorted durations using
+// the nearest-rank method: the smallest value that at least p of the
+// values are less than or equal to.
+func percentileMillis(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return float64(sorted[max(rank, 0)]) / float64(time.Millisecond)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Sort the series so the output is stable, which makes it easier to read
+	// and to test.
+	keys := make([]requestLabels, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return formatLabels(keys[i]) < formatLabels(keys[j])
+	})
+
+	var written int64
+	write := func(format string, args ...any) error {
+		n, err := fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+
+	if err := write("# HELP http_requests_total Total number of HTTP requests.\n# TYPE http_requests_total counter\n"); err != nil {
+		return written, err
+	}
+	for _, k := range keys {
+		if err := write("http_requests_total{%s} %d\n", formatLabels(k), m.requests[k].count); err != nil {
+			return written, err
+		}
+	}
+
+	if err := write("# HELP http_request_duration_seconds_sum Total time spent serving HTTP requests.\n# TYPE http_request_duration_seconds_sum counter\n"); err != nil {
+		return written, err
+	}
+	for _, k := range keys {
+		if err := write("http_request_duration_seconds_sum{%s} %g\n", formatLabels(k), m.requests[k].seconds); err != nil {
+			return written, err
+		}
+	}
+
+	if err := write("# HELP http_requests_in_flight Number of HTTP requests being handled.\n# TYPE http_requests_in_flight gauge\nhttp_requests_in_flight %d\n", m.inFlight); err != nil {
+		return written, err
+	}
+	if err := write("# HELP http_requests_queued Number of HTTP requests waiting to be handled.\n# TYPE http_requests_queued gauge\nhttp_requests_queued %d\n", m.queued); err != nil {
+		return written, err
+	}
+	if m.runtimeCollected {
+		rt := m.runtime
+		if err := write("# HELP go_goroutines Number of live goroutines.\n# TYPE go_goroutines gauge\ngo_goroutines %d\n", rt.Goroutines); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_sched_gomaxprocs_threads Number of goroutines that can run at once.\n# TYPE go_sched_gomaxprocs_threads gauge\ngo_sched_gomaxprocs_threads %d\n", rt.GOMAXPROCS); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_memory_heap_objects_bytes Memory occupied by live and unswept heap objects.\n# TYPE go_memory_heap_objects_bytes gauge\ngo_memory_heap_objects_bytes %d\n", rt.HeapBytes); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_memory_total_bytes All memory mapped by the Go runtime.\n# TYPE go_memory_total_bytes gauge\ngo_memory_total_bytes %d\n", rt.TotalBytes); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_gc_cycles_total Number of completed garbage collection cycles.\n# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total %d\n", rt.GCCycles); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_gc_pause_seconds Stop-the-world garbage collection pauses over the last collection interval.\n# TYPE go_gc_pause_seconds gauge\ngo_gc_pause_seconds{quantile=\"0.5\"} %g\ngo_gc_pause_seconds{quantile=\"0.99\"} %g\n", rt.GCPauseP50/1000, rt.GCPauseP99/1000); err != nil {
+			return written, err
+		}
+		if err := write("# HELP go_sched_latency_seconds Time runnable goroutines waited for a CPU over the last collection interval.\n# TYPE go_sched_latency_seconds gauge\ngo_sched_latency_seconds{quantile=\"0.5\"} %g\ngo_sched_latency_seconds{quantile=\"0.99\"} %g\n", rt.SchedLatencyP50/1000, rt.SchedLatencyP99/1000); err != nil {
+			return written, err
+		}
+	}
+	if len(m.deduplicated) > 0 {
+		if err := write("# HELP http_requests_deduplicated_total Total number of requests answered with an identical concurrent request's response.\n# TYPE http_requests_deduplicated_total counter\n"); err != nil {
+			return written, err
+		}
+		for _, route := range slices.Sorted(maps.Keys(m.deduplicated)) {
+			if err := write("http_requests_deduplicated_total{route=%s} %d\n", strconv.Quote(route), m.deduplicated[route]); err != nil {
+				return written, err
+			}
+		}
+	}
+	if err := write("# HELP http_requests_rate_limited_total Total number of requests turned away for going over a client's rate limit.\n# TYPE http_requests_rate_limited_total counter\nhttp_requests_rate_limited_total %d\n", m.rateLimited); err != nil {
+		return written, err
+	}
+	if err := write("# HELP login_failures_total Total number of failed logins.\n# TYPE login_failures_total counter\nlogin_failures_total %d\n", m.loginFailures); err != nil {
+		return written, err
+	}
+	for _, metric := range []struct {
+		name, help string
+		values     map[string]uint64
+	}{
+		{"login_lockouts_total", "Total number of accounts and addresses locked out after failed logins.", m.loginLockouts},
+		{"login_attempts_blocked_total", "Total number of logins refused during a lockout or delay.", m.loginsBlocked},
+	} {
+		if err := write("# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name); err != nil {
+			return written, err
+		}
+		for _, scope := range []string{loginScopeAccount, loginScopeIP} {
+			if err := write("%s{scope=%s} %d\n", metric.name, strconv.Quote(scope), metric.values[scope]); err != nil {
+				return written, err
+			}
+		}
+	}
+	if err := write("# HELP http_requests_shed_total Total number of requests turned away by load shedding.\n# TYPE http_requests_shed_total counter\nhttp_requests_shed_total %d\n", m.shed); err != nil {
+		return written, err
+	}
+	if err := write("# HELP load_shed_fraction Share of requests being shed, from 0 to 1.\n# TYPE load_shed_fraction gauge\nload_shed_fraction %g\n", m.shedFraction); err != nil {
+		return written, err
+	}
+
+	if len(m.proxy) > 0 {
+		proxyKeys := make([]proxyLabels, 0, len(m.proxy))
+		for k := range m.proxy {
+			proxyKeys = append(proxyKeys, k)
+		}
+		sort.Slice(proxyKeys, func(i, j int) bool {
+			return formatProxyLabels(proxyKeys[i]) < formatProxyLabels(proxyKeys[j])
+		})
+
+		if err := write("# HELP proxy_requests_total Total number of requests forwarded to upstreams.\n# TYPE proxy_requests_total counter\n"); err != nil {
+			return written, err
+		}
+		for _, k := range proxyKeys {
+			if err := write("proxy_requests_total{%s} %d\n", formatProxyLabels(k), m.proxy[k].count); err != nil {
+				return written, err
+			}
+		}
+
+		if err := write("# HELP proxy_request_duration_seconds_sum Total time spent forwarding requests to upstreams.\n# TYPE proxy_request_duration_seconds_sum counter\n"); err != nil {
+			return written, err
+		}
+		for _, k := range proxyKeys {
+			if err := write("proxy_request_duration_seconds_sum{%s} %g\n", formatProxyLabels(k), m.proxy[k].seconds); err != nil {
+				return written, err
+			}
+		}
+
+		if err := write("# HELP proxy_retries_total Total number of proxied requests sent again after a failure.\n# TYPE proxy_retries_total counter\n"); err != nil {
+			return written, err
+		}
+		for _, upstream := range slices.Sorted(maps.Keys(m.proxyRetries)) {
+			if err := write("proxy_retries_total{upstream=%s} %d\n", strconv.Quote(upstream), m.proxyRetries[upstream]); err != nil {
+				return written, err
+			}
+		}
+
+		if len(m.affinity) > 0 {
+			affinityKeys := slices.SortedFunc(maps.Keys(m.affinity), func(a, b affinityLabels) int {
+				return cmp.Or(strings.Compare(a.Upstream, b.Upstream), strings.Compare(a.Result, b.Result))
+			})
+			if err := write("# HELP proxy_affinity_total Requests on sticky routes, by whether they reached the client's endpoint.\n# TYPE proxy_affinity_total counter\n"); err != nil {
+				return written, err
+			}
+			for _, k := range affinityKeys {
+				if err := write("proxy_affinity_total{upstream=%s,result=%s} %d\n", strconv.Quote(k.Upstream), strconv.Quote(k.Result), m.affinity[k]); err != nil {
+					return written, err
+				}
+			}
+		}
+	}
+
+	// Then the metrics added with NewCounter and friends (see
+	// custommetrics.go).
+	n, err := writeCustomMetrics(w)
+	written += n
+	if err != nil {
+		return written, err
+	}
+
+	if len(m.outbound) == 0 {
+		return written, nil
+	}
+
+	outKeys := make([]outboundLabels, 0, len(m.outbound))
+	for k := range m.outbound {
+		outKeys = append(outKeys, k)
+	}
+	sort.Slice(outKeys, func(i, j int) bool {
+		return formatOutboundLabels(outKeys[i]) < formatOutboundLabels(outKeys[j])
+	})
+
+	if err := write("# HELP http_client_requests_total Total number of HTTP requests sent to other services.\n# TYPE http_client_requests_total counter\n"); err != nil {
+		return written, err
+	}
+	for _, k := range outKeys {
+		if err := write("http_client_requests_total{%s} %d\n", formatOutboundLabels(k), m.outbound[k].count); err != nil {
+			return written, err
+		}
+	}
+
+	if err := write("# HELP http_client_request_duration_seconds_sum Total time spent waiting for other services.\n# TYPE http_client_request_duration_seconds_sum counter\n"); err != nil {
+		return written, err
+	}
+	for _, k := range outKeys {
+		if err := write("http_client_request_duration_seconds_sum{%s} %g\n", formatOutboundLabels(k), m.outbound[k].seconds); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// formatLabels renders labels as Prometheus expects: name="value",...
+// strconv.Quote takes care of escaping quotes and backslashes.
+func formatLabels(l requestLabels) string {
+	return fmt.Sprintf("tenant=%s,method=%s,route=%s,status=%s",
+		strconv.Quote(l.Tenant), strconv.Quote(l.Method),
+		strconv.Quote(l.Route), strconv.Quote(strconv.Itoa(l.Status)))
+}
+
+// formatOutboundLabels renders outbound request labels.
+func formatOutboundLabels(l outboundLabels) string {
+	return fmt.Sprintf("host=%s,method=%s,status=%s",
+		strconv.Quote(l.Host), strconv.Quote(l.Method), strconv.Quote(l.Status))
+}
+
+// formatProxyLabels renders proxied request labels.
+func formatProxyLabels(l proxyLabels) string {
+	return fmt.Sprintf("upstream=%s,status=%s", strconv.Quote(l.Upstream), strconv.Quote(l.Status))
+}
+
+// statusRecorder wraps an http.ResponseWriter to remember the status code the
+// handler wrote. The standard ResponseWriter doesn't let you read it back, so
+// middleware that wants to know the outcome of a request needs this trick.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before passing it on.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the underlying ResponseWriter so http.ResponseController
+// can still reach optional features such as flushing.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsMiddleware records the count and duration of every request, labeled
+// with the tenant and the route pattern that matched.
+func (s *Server) metricsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Handlers that never call WriteHeader implicitly send 200 OK.
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		duration := time.Since(start)
+		if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" && ct != "application/x-ndjson" {
+			s.metrics.ObserveLatency(duration)
+		}
+		// Unknown tenants are turned away by tenantMiddleware, but one can
+		// get here if TENANTS was reloaded while the request was running.
+		tenant := tenantFromContext(r.Context())
+		if !knownTenant(s.config(), tenant) {
+			tenant = "other"
+		}
+		s.metrics.ObserveRequest(requestLabels{
+			Tenant: tenant,
+			Method: r.Method,
+			Route:  r.Pattern,
+			Status: rec.status,
+		}, duration)
+	}
+}
+
+// handleMetrics serves the collected metrics for Prometheus to scrape.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := s.metrics.WriteTo(w); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
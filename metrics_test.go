@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetricsEndpoint makes a request and then checks that it shows up in the
+// /metrics output with the tenant and route labels.
+func TestMetricsEndpoint(t *testing.T) {
+	mux := newServer(Config{Tenants: []string{"acme"}}).routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/message", nil)
+	req.Header.Set(tenantHeader, "acme")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	// A tenant that isn't in TENANTS doesn't get a series of its own.
+	req = httptest.NewRequest(http.MethodGet, "/api/message", nil)
+	req.Header.Set(tenantHeader, "made-up")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	want := `http_requests_total{tenant="acme",method="GET",route="/api/message",status="200"} 1`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %q, got:\n%s", want, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "made-up") {
+		t.Errorf("Expected no series for an unknown tenant, got:\n%s", rec.Body.String())
+	}
+}
+
+// TestMetricsSnapshot checks the error counts and latency percentiles.
+func TestMetricsSnapshot(t *testing.T) {
+	m := newMetrics()
+	for i := 1; i <= 100; i++ {
+		m.ObserveLatency(time.Duration(i) * time.Millisecond)
+	}
+	m.ObserveRequest(requestLabels{Route: "/", Status: 200}, 0)
+	m.ObserveRequest(requestLabels{Route: "/", Status: 404}, 0)
+	m.ObserveRequest(requestLabels{Route: "/", Status: 503}, 0)
+	m.ObserveOutbound(outboundLabels{Host: "api", Status: "200"}, 0)
+	m.ObserveOutbound(outboundLabels{Host: "api", Status: "error"}, 0)
+
+	snap := m.Snapshot()
+	if snap.Requests != 3 || snap.ClientErrors != 1 || snap.ServerErrors != 1 {
+		t.Errorf("Unexpected totals %+v", snap)
+	}
+	if want := (LatencyPercentiles{Samples: 100, P50: 50, P90: 90, P99: 99}); snap.Latency != want {
+		t.Errorf("Expected %+v, got %+v", want, snap.Latency)
+	}
+	if len(snap.Outbound) != 1 || snap.Outbound[0].Requests != 2 || snap.Outbound[0].Errors != 1 || snap.Outbound[0].LastStatus != "error" {
+		t.Errorf("Unexpected outbound summary %+v", snap.Outbound)
+	}
+
+	// Once the window is full, new samples replace the oldest.
+	for i := 0; i < latencyWindow; i++ {
+		m.ObserveLatency(time.Second)
+	}
+	if snap := m.Snapshot(); snap.Latency.Samples != latencyWindow || snap.Latency.P50 != 1000 {
+		t.Errorf("Expected only the newest samples, got %+v", snap.Latency)
+	}
+}
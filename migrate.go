@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements schema migrations for the data file (DATA_FILE, see
+// store.go). A migration is a numbered, reversible change to the shape of the
+// stored data. Each one is a pair of files in the migrations directory:
+//
+//	0002_add_note_tags.up.json     applies the change
+//	0002_add_note_tags.down.json   reverts it
+//
+// SQL databases use .sql files for this. Our data is a JSON document, so a
+// migration is a list of operations applied to every record of a target:
+//
+//	{"op": "add_field",    "target": "notes", "field": "tags", "value": []}
+//	{"op": "remove_field", "target": "notes", "field": "tags"}
+//	{"op": "rename_field", "target": "notes", "field": "body", "to": "text"}
+//
+// Targets are "tenants" (each tenant's object) and "notes" (each note of
+// every tenant). The data file records its schema_version, the number of the
+// last migration applied, and the server refuses to open a file whose version
+// doesn't match the migrations built into the binary.
+
+//go:embed migrations/*.json
+var migrationFiles embed.FS
+
+// migrations is the ordered list of migrations built into the binary. Like
+// the templates, they were checked when the binary was built, so a broken
+// file is a programming error and panics at startup.
+var migrations = mustLoadMigrations(migrationFiles, "migrations")
+
+// migration is one numbered, reversible schema change.
+type migration struct {
+	Version int
+	Name    string
+	up      []migrationOp
+	down    []migrationOp
+}
+
+// migrationOp is one operation from a migration file.
+type migrationOp struct {
+	Op     string          `json:"op"`
+	Target string          `json:"target"`
+	Field  string          `json:"field"`
+	To     string          `json:"to,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// migrationFileName matches "0001_create_notes.up.json".
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.json$`)
+
+// latestSchemaVersion is the schema version this binary reads and writes.
+func latestSchemaVersion() int {
+	return latestOf(migrations)
+}
+
+// mustLoadMigrations is loadMigrations for the embedded files.
+func mustLoadMigrations(fsys fs.FS, dir string) []migration {
+	list, err := loadMigrations(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return list
+}
+
+// loadMigrations reads and checks every migration in dir. Versions must run
+// 1, 2, 3... without gaps, and each must have both an up and a down file.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("%s: not a migration file name (want NNNN_name.up.json or .down.json)", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+
+		ops, err := readMigrationOps(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if m[3] == "up" {
+			mig.up = ops
+		} else {
+			mig.down = ops
+		}
+	}
+
+	list := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == nil || mig.down == nil {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		list = append(list, *mig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	for i, mig := range list {
+		if mig.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be numbered 1, 2, 3...: expected %d, found %d", i+1, mig.Version)
+		}
+	}
+	return list, nil
+}
+
+// readMigrationOps parses and checks one migration file.
+func readMigrationOps(fsys fs.FS, name string) ([]migrationOp, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []migrationOp{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ops); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	for i, op := range ops {
+		if err := op.check(); err != nil {
+			return nil, fmt.Errorf("%s: operation %d: %w", name, i+1, err)
+		}
+	}
+	return ops, nil
+}
+
+// check reports whether an operation is well formed.
+func (op migrationOp) check() error {
+	if op.Target != "tenants" && op.Target != "notes" {
+		return fmt.Errorf("unknown target %q (want tenants or notes)", op.Target)
+	}
+	if op.Field == "" {
+		return errors.New("missing field")
+	}
+
+	switch op.Op {
+	case "add_field":
+		if len(op.Value) == 0 {
+			return errors.New("add_field needs a value")
+		}
+	case "remove_field":
+	case "rename_field":
+		if op.To == "" {
+			return errors.New("rename_field needs a \"to\" field name")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// apply runs the operation against every matching record in the document.
+func (op migrationOp) apply(doc map[string]any) error {
+	for _, record := range records(doc, op.Target) {
+		switch op.Op {
+		case "add_field":
+			if _, exists := record[op.Field]; exists {
+				continue
+			}
+			// Decode the value afresh for every record, so no two records
+			// share the same slice or map.
+			value, err := decodeJSON(op.Value)
+			if err != nil {
+				return err
+			}
+			record[op.Field] = value
+		case "remove_field":
+			delete(record, op.Field)
+		case "rename_field":
+			if value, exists := record[op.Field]; exists {
+				record[op.To] = value
+				delete(record, op.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// records returns the JSON objects an operation applies to.
+func records(doc map[string]any, target string) []map[string]any {
+	var out []map[string]any
+
+	tenants, _ := doc["tenants"].(map[string]any)
+	for _, t := range tenants {
+		tenant, ok := t.(map[string]any)
+		if !ok {
+			continue
+		}
+		if target == "tenants" {
+			out = append(out, tenant)
+			continue
+		}
+
+		notes, _ := tenant["notes"].([]any)
+		for _, n := range notes {
+			if note, ok := n.(map[string]any); ok {
+				out = append(out, note)
+			}
+		}
+	}
+	return out
+}
+
+// decodeJSON decodes into generic Go values. UseNumber keeps numbers exactly
+// as written, so an int64 counter doesn't lose precision as a float64.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// Migrator applies migrations to a data file. The server must be stopped
+// while it runs, or the server's next write would undo the migration.
+type Migrator struct {
+	path       string
+	migrations []migration
+}
+
+// newMigrator creates a Migrator for a data file using the built-in migrations.
+func newMigrator(path string) *Migrator {
+	return &Migrator{path: path, migrations: migrations}
+}
+
+// load reads the data file as a generic document. A missing file is an
+// empty document at schema version 0, so "up" can create it.
+func (m *Migrator) load() (map[string]any, int, error) {
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]any{"tenants": map[string]any{}}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %s: %w", m.path, err)
+	}
+	doc, ok := v.(map[string]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("reading %s: not a JSON object", m.path)
+	}
+
+	version := 0
+	if n, ok := doc["schema_version"].(json.Number); ok {
+		v, err := n.Int64()
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading %s: invalid schema_version %s", m.path, n)
+		}
+		version = int(v)
+	}
+	if version < 0 || version > len(m.migrations) {
+		return nil, 0, fmt.Errorf("%s is at schema version %d, but this binary only knows migrations up to %d",
+			m.path, version, len(m.migrations))
+	}
+	return doc, version, nil
+}
+
+// save writes the document back with its new schema version.
+func (m *Migrator) save(doc map[string]any, version int) error {
+	doc["schema_version"] = version
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, append(data, '\n'))
+}
+
+// Version returns the data file's current schema version.
+func (m *Migrator) Version() (int, error) {
+	_, version, err := m.load()
+	return version, err
+}
+
+// Up applies every pending migration and returns the ones it applied.
+func (m *Migrator) Up() ([]migration, error) {
+	doc, version, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := m.migrations[version:]
+	for _, mig := range pending {
+		for _, op := range mig.up {
+			if err := op.apply(doc); err != nil {
+				return nil, fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+		}
+	}
+
+	// The whole batch is saved at once, so a failure part-way through
+	// leaves the file exactly as it was.
+	if len(pending) > 0 {
+		if err := m.save(doc, latestOf(m.migrations)); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// Down reverts the last n applied migrations and returns them, most recent
+// first.
+func (m *Migrator) Down(n int) ([]migration, error) {
+	doc, version, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	if n > version {
+		return nil, fmt.Errorf("cannot revert %d migrations: only %d applied", n, version)
+	}
+
+	var reverted []migration
+	for v := version; v > version-n; v-- {
+		mig := m.migrations[v-1]
+		for _, op := range mig.down {
+			if err := op.apply(doc); err != nil {
+				return nil, fmt.Errorf("reverting %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+		}
+		reverted = append(reverted, mig)
+	}
+
+	if len(reverted) > 0 {
+		if err := m.save(doc, version-n); err != nil {
+			return nil, err
+		}
+	}
+	return reverted, nil
+}
+
+// latestOf returns the highest version in a list of migrations.
+func latestOf(list []migration) int {
+	if len(list) == 0 {
+		return 0
+	}
+	return list[len(list)-1].Version
+}
+
+// createMigration writes an empty up/down pair for the next version into dir
+// and returns their paths. The new files are only picked up by the binary
+// after a rebuild, because migrations are embedded.
+func createMigration(dir, name string) ([]string, error) {
+	name = strings.ToLower(strings.ReplaceAll(name, "-", "_"))
+	if !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name %q: use letters, digits and underscores", name)
+	}
+
+	existing, err := loadMigrations(os.DirFS(dir), ".")
+	if err != nil {
+		return nil, err
+	}
+	version := latestOf(existing) + 1
+
+	var paths []string
+	for _, direction := range []string{"up", "down"} {
+		p := filepath.Join(dir, fmt.Sprintf("%04d_%s.%s.json", version, name, direction))
+		if err := os.WriteFile(p, []byte("[]\n"), 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
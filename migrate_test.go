@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestEmbeddedMigrations checks the migrations built into the binary load
+// and that a fresh data file opens at the latest version.
+func TestEmbeddedMigrations(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("Expected at least one embedded migration")
+	}
+
+	path := filepath.Join(t.TempDir(), "data.json")
+	if _, err := newMigrator(path).Up(); err != nil {
+		t.Fatalf("migrate up failed: %v", err)
+	}
+	if _, err := openStore(path); err != nil {
+		t.Errorf("Expected a migrated file to open, got %v", err)
+	}
+}
+
+// TestLoadMigrationsValidation checks that broken migration sets are caught.
+func TestLoadMigrationsValidation(t *testing.T) {
+	ok := &fstest.MapFile{Data: []byte(`[]`)}
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		want  string
+	}{
+		{"missing down", fstest.MapFS{
+			"m/0001_a.up.json": ok,
+		}, "needs both"},
+		{"gap", fstest.MapFS{
+			"m/0001_a.up.json": ok, "m/0001_a.down.json": ok,
+			"m/0003_c.up.json": ok, "m/0003_c.down.json": ok,
+		}, "expected 2"},
+		{"bad name", fstest.MapFS{
+			"m/first.up.json": ok,
+		}, "not a migration file name"},
+		{"unknown op", fstest.MapFS{
+			"m/0001_a.up.json":   {Data: []byte(`[{"op": "drop_table", "target": "notes", "field": "x"}]`)},
+			"m/0001_a.down.json": ok,
+		}, "unknown op"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadMigrations(tt.files, "m")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestMigratorUpDown applies a field rename to existing notes and reverts it.
+func TestMigratorUpDown(t *testing.T) {
+	list, err := loadMigrations(fstest.MapFS{
+		"m/0001_init.up.json":   {Data: []byte(`[{"op": "add_field", "target": "tenants", "field": "notes", "value": []}]`)},
+		"m/0001_init.down.json": {Data: []byte(`[{"op": "remove_field", "target": "tenants", "field": "notes"}]`)},
+		"m/0002_rename.up.json": {Data: []byte(`[
+			{"op": "rename_field", "target": "notes", "field": "body", "to": "text"},
+			{"op": "add_field", "target": "notes", "field": "tags", "value": []}
+		]`)},
+		"m/0002_rename.down.json": {Data: []byte(`[
+			{"op": "rename_field", "target": "notes", "field": "text", "to": "body"},
+			{"op": "remove_field", "target": "notes", "field": "tags"}
+		]`)},
+	}, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.json")
+	existing := `{"schema_version": 1, "tenants": {"acme": {"notes": [{"id": "1", "body": "hi"}]}}}`
+	if err := os.WriteFile(path, []byte(existing), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := &Migrator{path: path, migrations: list}
+
+	applied, err := m.Up()
+	if err != nil || len(applied) != 1 || applied[0].Name != "rename" {
+		t.Fatalf("Expected migration 2 to be applied, got %v, %v", applied, err)
+	}
+	if note := firstNote(t, path); note["text"] != "hi" || note["body"] != nil || note["tags"] == nil {
+		t.Errorf("Expected body renamed to text and tags added, got %v", note)
+	}
+
+	if _, err := m.Down(1); err != nil {
+		t.Fatalf("migrate down failed: %v", err)
+	}
+	if note := firstNote(t, path); note["body"] != "hi" || note["tags"] != nil {
+		t.Errorf("Expected the note to be back to its original shape, got %v", note)
+	}
+	if v, _ := m.Version(); v != 1 {
+		t.Errorf("Expected schema version 1, got %d", v)
+	}
+
+	if _, err := m.Down(5); err == nil {
+		t.Error("Expected an error reverting more migrations than were applied")
+	}
+}
+
+// firstNote reads the first note of tenant acme from a data file.
+func firstNote(t *testing.T, path string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Tenants map[string]struct {
+			Notes []map[string]any `json:"notes"`
+		} `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Tenants["acme"].Notes[0]
+}
+
+// TestMigrateCommand runs the migrate subcommands against a temporary file.
+func TestMigrateCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+
+	run := func(args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if code := runCLI(args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d: %s", args, code, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	if out := run("migrate", "status", "-file", path); !strings.Contains(out, "pending") {
+		t.Errorf("Expected pending migrations before up, got %q", out)
+	}
+	if out := run("migrate", "up", "-file", path); !strings.Contains(out, "Applied 0001_create_notes") {
+		t.Errorf("Expected migration 1 to be applied, got %q", out)
+	}
+	if out := run("migrate", "-file", path); !strings.Contains(out, "up to date") {
+		t.Errorf("Expected a bare migrate to run up, got %q", out)
+	}
+
+	last := migrations[len(migrations)-1]
+	want := fmt.Sprintf("Reverted %04d_%s", last.Version, last.Name)
+	if out := run("migrate", "down", "1", "-file", path); !strings.Contains(out, want) {
+		t.Errorf("Expected the latest migration to be reverted, got %q", out)
+	}
+}
+
+// TestMigrateCreateCommand checks new migrations get the next number.
+func TestMigrateCreateCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	var stdout, stderr bytes.Buffer
+	for _, name := range []string{"first", "add-tags"} {
+		if code := runCLI([]string{"migrate", "create", name, "-dir", dir}, &stdout, &stderr); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+		}
+	}
+
+	for _, want := range []string{"0001_first.up.json", "0002_add_tags.down.json"} {
+		if _, err := os.Stat(filepath.Join(dir, want)); err != nil {
+			t.Errorf("Expected %s to be created: %v", want, err)
+		}
+	}
+}
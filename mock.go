@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// This file implements MOCK_EXTERNAL=true, which answers calls to the
+// outside services the app uses with made-up responses, without leaving
+// the process. The whole app can then be demoed on a laptop with no
+// internet connection, and tested without depending on anyone else's
+// servers.
+//
+// The fakes sit under the outbound client, as its transport, rather than
+// replacing the quote and weather code. Requests are still built, sent
+// through the instrumented client and decoded as usual; only the network
+// call is skipped. That way mock mode exercises nearly the same code as
+// the real thing, and outbound metrics and Server-Timing still show the
+// calls. Mocked services:
+//   - the quote API (QUOTE_API_URL), for QUOTE_SOURCE=http
+//   - the LLM (LLM_URL), for QUOTE_SOURCE=llm
+//   - Open-Meteo geocoding and forecasts (WEATHER_GEOCODING_URL and
+//     WEATHER_FORECAST_URL)
+//   - the CAPTCHA provider's siteverify API, which accepts any token
+//     but "fail" (see captcha.go)
+//
+// The answers are deterministic: quotes come from the embedded list in
+// order, and a city's weather is worked out from a hash of its name, so the
+// same city always gets the same weather. Every city exists except
+// "Nowhere", for trying out a 404. Anything else the outbound client calls,
+// such as Consul or WAIT_FOR targets, is sent for real.
+
+// mockCity is the one city the fake geocoder doesn't know.
+const mockCity = "nowhere"
+
+// mockTransport answers requests to the mocked services in-process and
+// passes the rest to base.
+type mockTransport struct {
+	base http.RoundTripper
+
+	// fakes answers requests by host and path. hosts holds every mocked
+	// host, so other paths on them get a 404 rather than a real request.
+	fakes map[string]func(*http.Request) any
+	hosts map[string]bool
+
+	quotes []Quote
+	next   atomic.Uint64 // index of the next quote
+}
+
+// newMockTransport creates the fakes for the services configured in cfg.
+func newMockTransport(cfg Config, base http.RoundTripper) *mockTransport {
+	m := &mockTransport{
+		base:   base,
+		fakes:  make(map[string]func(*http.Request) any),
+		hosts:  make(map[string]bool),
+		quotes: newEmbeddedQuotes().quotes,
+	}
+	m.add(cfg.QuoteAPIURL, m.quoteAPI)
+	m.add(cfg.LLMURL, m.llm)
+	m.add(cfg.WeatherGeocodingURL, m.geocoding)
+	m.add(cfg.WeatherForecastURL, m.forecast)
+	m.add(captchaVerifyURL(cfg), m.siteverify)
+	return m
+}
+
+// add answers requests to rawURL, ignoring its query, with fake. Invalid
+// URLs are skipped; Config.Validate reports them.
+func (m *mockTransport) add(rawURL string, fake func(*http.Request) any) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	m.fakes[u.Host+u.Path] = fake
+	m.hosts[u.Host] = true
+}
+
+// RoundTrip answers the request with a fake's JSON, if a service is mocked
+// at its URL.
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !m.hosts[req.URL.Host] {
+		return m.base.RoundTrip(req)
+	}
+	if req.Body != nil {
+		// A RoundTripper must close the body but not change the request,
+		// so the fakes get a copy of it to read.
+		body, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	status, v := http.StatusOK, any(nil)
+	if fake, ok := m.fakes[req.URL.Host+req.URL.Path]; ok {
+		v = fake(req)
+	} else {
+		status, v = http.StatusNotFound, map[string]string{"error": "not found"}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+// siteverify answers like a CAPTCHA provider's siteverify API, accepting
+// any token but "fail".
+func (m *mockTransport) siteverify(req *http.Request) any {
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("response") == "fail" {
+		return map[string]any{"success": false, "error-codes": []string{"invalid-input-response"}}
+	}
+	return map[string]any{"success": true}
+}
+
+// nextQuote returns the embedded quotes in turn.
+func (m *mockTransport) nextQuote() Quote {
+	return m.quotes[(m.next.Add(1)-1)%uint64(len(m.quotes))]
+}
+
+// quoteAPI answers like dummyjson.com's random quote.
+func (m *mockTransport) quoteAPI(*http.Request) any {
+	q := m.nextQuote()
+	return map[string]string{"quote": q.Text, "author": q.Author}
+}
+
+// llm answers like an OpenAI-compatible chat completions API, with the
+// quotation and author on separate lines as llmPrompt asks.
+func (m *mockTransport) llm(*http.Request) any {
+	q := m.nextQuote()
+	return map[string]any{
+		"choices": []map[string]any{
+			{"message": map[string]string{"role": "assistant", "content": q.Text + "\n" + q.Author}},
+		},
+	}
+}
+
+// geocoding answers like Open-Meteo's geocoding API, placing every city
+// but mockCity somewhere on Earth based on its name.
+func (m *mockTransport) geocoding(req *http.Request) any {
+	name := strings.TrimSpace(req.URL.Query().Get("name"))
+	if name == "" || strings.EqualFold(name, mockCity) {
+		return map[string]any{}
+	}
+	h := mockHash(strings.ToLower(name))
+	return map[string]any{
+		"results": []map[string]any{{
+			"name":      titleCase(name),
+			"country":   "Mockland",
+			"latitude":  math.Round(float64(h%180_000)/10-9000) / 100,
+			"longitude": math.Round(float64(h/180_000%360_000)/10-18000) / 100,
+		}},
+	}
+}
+
+// forecast answers like Open-Meteo's current conditions, derived from the
+// coordinates and observed at the last quarter hour.
+func (m *mockTransport) forecast(req *http.Request) any {
+	q := req.URL.Query()
+	h := mockHash(q.Get("latitude") + "," + q.Get("longitude"))
+	codes := make([]int, 0, len(weatherDescriptions))
+	for code := range weatherDescriptions {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return map[string]any{
+		"current": map[string]any{
+			"time":           time.Now().Truncate(15 * time.Minute).Unix(),
+			"temperature_2m": float64(h%500)/10 - 15,
+			"wind_speed_10m": float64(h/500%600) / 10,
+			"weather_code":   codes[(h>>40)%uint64(len(codes))],
+		},
+	}
+}
+
+// mockHash turns s into a number for deriving fake values.
+func mockHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// titleCase capitalizes the first letter of each word, so "new york"
+// comes back as "New York", like a real geocoder's canonical name.
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r := []rune(w)
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
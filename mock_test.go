@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestMockQuotes checks the mocked quote API and LLM give the embedded
+// quotes in order.
+func TestMockQuotes(t *testing.T) {
+	want := newEmbeddedQuotes().quotes
+	for _, source := range []string{"http", "llm"} {
+		s, c := newTestServer(t)
+		s.quotes = newQuotes(Config{QuoteSource: source, QuoteAPIURL: s.cfg.QuoteAPIURL, LLMURL: s.cfg.LLMURL, LLMModel: "test"}, s.outbound)
+
+		for i := range 2 {
+			got := testsupport.Decode[QuoteResponse](c.Get("/api/v1/quote").Status(http.StatusOK))
+			if got.Source != source || got.Quote != want[i] {
+				t.Errorf("%s: expected quote %d from the mock, got %+v", source, i, got)
+			}
+		}
+	}
+}
+
+// TestMockWeather checks a city always gets the same weather, and Nowhere
+// isn't found.
+func TestMockWeather(t *testing.T) {
+	_, c1 := newTestServer(t)
+	_, c2 := newTestServer(t)
+	london := testsupport.Decode[Weather](c1.Get("/api/v1/weather?city=london").Status(http.StatusOK))
+	again := testsupport.Decode[Weather](c2.Get("/api/v1/weather?city=London").Status(http.StatusOK))
+	if london.City != "London" || london.Description == "Unknown" {
+		t.Errorf("Unexpected mock weather %+v", london)
+	}
+	if again.TemperatureC != london.TemperatureC || again.WeatherCode != london.WeatherCode || again.Latitude != london.Latitude {
+		t.Errorf("Expected the same weather twice, got %+v and %+v", london, again)
+	}
+	c1.Get("/api/v1/weather?city=Nowhere").Status(http.StatusNotFound)
+}
+
+// TestMockPassesThrough checks only the mocked services are answered by
+// the mock, and the calls are still recorded.
+func TestMockPassesThrough(t *testing.T) {
+	s, c := newTestServer(t)
+	c.Get("/api/v1/weather?city=Paris").Status(http.StatusOK)
+
+	metrics := c.Get("/metrics").Status(http.StatusOK).Body.String()
+	if !strings.Contains(metrics, `http_client_requests_total{host="api.open-meteo.com",method="GET",status="200"} 1`) {
+		t.Errorf("Expected the mocked forecast call in the metrics, got:\n%s", metrics)
+	}
+
+	// Another path on a mocked host gets a 404 without leaving the process.
+	resp, err := s.outbound.Get("https://api.open-meteo.com/elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 from the mock, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// This file contains the notes API, a small CRUD (Create, Read, Update,
+// Delete) resource. Notes are stored per tenant, so two tenants can use the
+// same API without ever seeing each other's data.
+
+// CreateNoteRequest is the JSON body accepted by POST /api/v1/notes.
+type CreateNoteRequest struct {
+	Title string `json:"title" proto:"1"`
+	Body  string `json:"body" proto:"2"`
+}
+
+// NoteListResponse wraps the list of notes in an object. Returning an object
+// instead of a bare array leaves room to add fields (like pagination) later
+// without breaking clients.
+type NoteListResponse struct {
+	Notes []Note `json:"notes" proto:"1"`
+}
+
+// handleListNotes returns every note belonging to the request's tenant.
+// Deleted notes are left out unless the query has include_deleted=true.
+func (s *Server) handleListNotes(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+
+	includeDeleted := false
+	if v := r.URL.Query().Get("include_deleted"); v != "" {
+		var err error
+		if includeDeleted, err = strconv.ParseBool(v); err != nil {
+			writeProblem(w, http.StatusBadRequest, "include_deleted must be true or false")
+			return
+		}
+	}
+
+	notes := s.store.ListNotes(tenant)
+	if includeDeleted {
+		notes = s.store.ListNotesWithDeleted(tenant)
+	}
+	setPagination(w, Pagination{Total: len(notes)})
+	writeJSON(w, http.StatusOK, NoteListResponse{Notes: notes})
+}
+
+// handleCreateNote creates a note from a JSON request body, or a form (see
+// forms.go).
+func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request) {
+	// The schema (schemas/note-create.json) checks the title is present
+	// and not blank, and that nothing else unexpected was sent.
+	var req CreateNoteRequest
+	if !decodeValidForm(w, r, "note-create", &req) {
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+
+	tenant := tenantFromContext(r.Context())
+	note := s.store.CreateNote(tenant, req.Title, req.Body)
+
+	// 201 Created plus a Location header is the conventional response to a
+	// successful POST that creates a new resource.
+	w.Header().Set("Location", "/api/v1/notes/"+note.ID)
+	w.Header().Set("ETag", etagOf(note))
+	writeJSON(w, http.StatusCreated, note)
+}
+
+// handleGetNote returns a single note by ID.
+func (s *Server) handleGetNote(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+
+	// r.PathValue reads the {id} wildcard from the route pattern.
+	note, ok := s.store.GetNote(tenant, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "note not found")
+		return
+	}
+	// The ETag is what the client sends back in If-Match to change the
+	// note (see etag.go).
+	w.Header().Set("ETag", etagOf(note))
+	writeJSON(w, http.StatusOK, note)
+}
+
+// handleDeleteNote deletes a note by ID. The request must carry the note's
+// ETag in If-Match, so a client can't delete a note someone else has just
+// changed without having seen the change.
+//
+// Deletes are "soft": the note is only marked as deleted, and can be
+// restored until the purge job (purge.go) removes it for good.
+func (s *Server) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if _, ok := s.store.GetNote(tenant, id); !ok {
+		writeProblem(w, http.StatusNotFound, "note not found")
+		return
+	}
+	match, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteNote(tenant, id, match); err != nil {
+		writeNoteError(w, err)
+		return
+	}
+
+	// 204 No Content tells the client the delete worked and there's no body.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestoreNote undoes a soft delete.
+func (s *Server) handleRestoreNote(w http.ResponseWriter, r *http.Request) {
+	note, err := s.store.RestoreNote(tenantFromContext(r.Context()), r.PathValue("id"))
+	if err != nil {
+		writeNoteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etagOf(note))
+	writeJSON(w, http.StatusOK, note)
+}
+
+// writeNoteError turns an error from a note store method into the matching
+// problem response.
+func writeNoteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoteChanged):
+		writeProblem(w, http.StatusPreconditionFailed, "the note has changed since it was read: GET it again for the current ETag")
+		return
+	case errors.Is(err, errNoteNotDeleted):
+		writeProblem(w, http.StatusConflict, "the note is not deleted")
+		return
+	}
+	writeProblem(w, http.StatusNotFound, "note not found")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestNotesCRUD exercises the notes API through the real router, so the
+// route patterns and middleware are tested along with the handlers.
+func TestNotesCRUD(t *testing.T) {
+	mux := newServer(Config{Tenants: []string{"acme"}}).routes()
+
+	// Create a note for tenant "acme".
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader(`{"title":"hello","body":"world"}`))
+	req.Header.Set(tenantHeader, "acme")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var created Note
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+
+	// The note is visible to acme...
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/notes/"+created.ID, nil)
+	req.Header.Set(tenantHeader, "acme")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+
+	// ...but not to the default tenant.
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/notes", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var list NoteListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if len(list.Notes) != 0 {
+		t.Errorf("Expected no notes for default tenant, got %d", len(list.Notes))
+	}
+
+	// Delete it and check it's gone.
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/notes/"+created.ID, nil)
+	req.Header.Set(tenantHeader, "acme")
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rec.Code)
+	}
+}
+
+// TestCreateNoteValidation checks that bad input gets a problem+json error.
+func TestCreateNoteValidation(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	for _, body := range []string{`not json`, `{"title":"   "}`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code < 400 {
+			t.Errorf("Expected an error status for body %q, got %d", body, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("Expected problem+json error, got %s", ct)
+		}
+	}
+}
+
+// TestSoftDeleteAndRestore checks a deleted note disappears from the API but
+// can be listed with include_deleted and brought back.
+func TestSoftDeleteAndRestore(t *testing.T) {
+	srv := newServer(Config{})
+	mux := srv.routes()
+	note := srv.store.CreateNote(defaultTenant, "Oops", "")
+	if err := srv.store.DeleteNote(defaultTenant, note.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	restore := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/notes/"+note.ID+"/restore", nil))
+		return rec.Code
+	}
+
+	if rec := get("/api/v1/notes/" + note.ID); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted note, got %d", rec.Code)
+	}
+	if rec := get("/api/v1/notes"); strings.Contains(rec.Body.String(), note.ID) {
+		t.Errorf("Expected the deleted note to be left out, got %s", rec.Body.String())
+	}
+	if rec := get("/api/v1/notes?include_deleted=true"); !strings.Contains(rec.Body.String(), `"deleted_at"`) {
+		t.Errorf("Expected the deleted note with deleted_at, got %s", rec.Body.String())
+	}
+	if rec := get("/api/v1/notes?include_deleted=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad include_deleted, got %d", rec.Code)
+	}
+
+	if code := restore(); code != http.StatusOK {
+		t.Fatalf("Expected 200 from restore, got %d", code)
+	}
+	if rec := get("/api/v1/notes/" + note.ID); rec.Code != http.StatusOK {
+		t.Errorf("Expected the restored note to be back, got %d", rec.Code)
+	}
+	if code := restore(); code != http.StatusConflict {
+		t.Errorf("Expected 409 restoring a live note, got %d", code)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file posts messages about significant events to chat: a Slack or
+// Discord channel, through an incoming webhook (NOTIFY_SLACK_URL,
+// NOTIFY_DISCORD_URL, or both). Logs and metrics record everything, but
+// somebody has to go and look; a message in the team channel is seen.
+//
+// The events, which NOTIFY_EVENTS picks from:
+//   - "startup": the server has started and is taking traffic
+//   - "shutdown": it has been asked to stop
+//   - "panic": a handler panicked, and the recover middleware answered 500
+//   - "health": the readiness status changed, say from ready to degraded
+//     because Redis went away, and back
+//   - "status": the periodic status report (see status.go), which isn't
+//     on by default
+//
+// Something going wrong often means it going wrong many times at once: a
+// bug panicking on every request, or a dependency flapping between up and
+// down. One message each would flood the channel and run into the
+// webhooks' rate limits, so messages are gathered up for
+// NOTIFY_BATCH_INTERVAL and posted together, at most maxPendingNotifications
+// of them with a count of the rest. 0 posts each one straight away. What's
+// still waiting at shutdown is posted before the server exits.
+//
+// Posting is best effort: a webhook that fails is logged, and the messages
+// are dropped rather than retried.
+
+// Notification events.
+const (
+	eventStartup  = "startup"
+	eventShutdown = "shutdown"
+	eventPanic    = "panic"
+	eventHealth   = "health"
+	eventStatus   = "status"
+)
+
+// notifyEvents are the events there are, for NOTIFY_EVENTS.
+var notifyEvents = []string{eventStartup, eventShutdown, eventPanic, eventHealth, eventStatus}
+
+// notifyIcons start each event's line.
+var notifyIcons = map[string]string{
+	eventStartup:  "🟢",
+	eventShutdown: "🔴",
+	eventPanic:    "💥",
+	eventHealth:   "🩺",
+	eventStatus:   "📊",
+}
+
+// maxPendingNotifications limits how many messages a batch holds; later
+// ones are only counted.
+const maxPendingNotifications = 20
+
+// notifyTimeout limits how long posting to one webhook can take.
+const notifyTimeout = 10 * time.Second
+
+// discordMaxLength is the longest message Discord accepts, in characters.
+const discordMaxLength = 2000
+
+// notification is one message waiting to be posted.
+type notification struct {
+	event string
+	text  string
+	at    time.Time
+}
+
+// webhook is a chat webhook: kind is "slack" or "discord".
+type webhook struct {
+	kind, url string
+}
+
+// Notifier posts notifications to chat webhooks.
+type Notifier struct {
+	client   *http.Client
+	webhooks []webhook
+	events   map[string]bool
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []notification
+	dropped int // past maxPendingNotifications
+}
+
+// newNotifier returns the notifier configured by cfg, or nil if no webhook
+// is.
+func newNotifier(cfg Config, client *http.Client) *Notifier {
+	n := &Notifier{client: client, events: make(map[string]bool), interval: cfg.NotifyBatchInterval}
+	if cfg.NotifySlackURL != "" {
+		n.webhooks = append(n.webhooks, webhook{"slack", cfg.NotifySlackURL})
+	}
+	if cfg.NotifyDiscordURL != "" {
+		n.webhooks = append(n.webhooks, webhook{"discord", cfg.NotifyDiscordURL})
+	}
+	if len(n.webhooks) == 0 {
+		return nil
+	}
+	for _, event := range cfg.NotifyEvents {
+		n.events[event] = true
+	}
+	return n
+}
+
+// notify queues a message about event, if notifications are on for it.
+// Without batching, it's posted straight away.
+func (s *Server) notify(event, text string) {
+	n := s.notifier
+	if n == nil || !n.events[event] {
+		return
+	}
+	n.mu.Lock()
+	if len(n.pending) < maxPendingNotifications {
+		n.pending = append(n.pending, notification{event, text, s.clock.Now()})
+	} else {
+		n.dropped++
+	}
+	n.mu.Unlock()
+
+	if n.interval == 0 {
+		go n.Flush(context.Background())
+	}
+}
+
+// readinessChanged notifies a change in the readiness status, naming the
+// checks that are failing, and publishes it to the admin event feed.
+func (s *Server) readinessChanged(from, to string, results []CheckResult) {
+	var failing []string
+	for _, r := range results {
+		if !r.OK {
+			failing = append(failing, r.Name+": "+r.Error)
+		}
+	}
+	text := fmt.Sprintf("readiness went from %s to %s", from, to)
+	if len(failing) > 0 {
+		text += " (" + strings.Join(failing, "; ") + ")"
+	}
+	s.notify(eventHealth, text)
+	s.adminEvent(adminEventHealth, text, HealthEvent{From: from, To: to, Failing: failing})
+}
+
+// postNotifications posts the pending notifications every interval, until
+// ctx is cancelled.
+func (s *Server) postNotifications(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			s.notifier.Flush(ctx)
+		}
+	}
+}
+
+// Flush posts the pending notifications to every webhook.
+func (n *Notifier) Flush(ctx context.Context) {
+	n.mu.Lock()
+	batch, dropped := n.pending, n.dropped
+	n.pending, n.dropped = nil, 0
+	n.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	for _, hook := range n.webhooks {
+		if err := n.post(ctx, hook, formatNotifications(hook.kind, batch, dropped)); err != nil {
+			slog.Warn("Notification not posted", "webhook", hook.kind, "messages", len(batch)+dropped, "error", err)
+		}
+	}
+}
+
+// post sends text to hook.
+func (n *Notifier) post(ctx context.Context, hook webhook, text string) error {
+	// Slack takes the message as "text", Discord as "content".
+	payload := map[string]string{"text": text}
+	if hook.kind == "discord" {
+		payload = map[string]string{"content": text}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// formatNotifications writes a batch as one message for kind of webhook:
+// a heading naming the instance, then a line per notification. Slack marks
+// bold with single asterisks and Discord with double ones.
+func formatNotifications(kind string, batch []notification, dropped int) string {
+	bold := "*"
+	if kind == "discord" {
+		bold = "**"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%shello-devops%s %s on %s\n", bold, bold, version, instanceName())
+	for _, n := range batch {
+		fmt.Fprintf(&b, "%s %s %s%s%s: %s\n", notifyIcons[n.event], n.at.UTC().Format("15:04:05"), bold, n.event, bold, n.text)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&b, "…and %d more\n", dropped)
+	}
+
+	text := strings.TrimSuffix(b.String(), "\n")
+	if kind == "discord" {
+		if runes := []rune(text); len(runes) > discordMaxLength {
+			text = string(runes[:discordMaxLength-1]) + "…"
+		}
+	}
+	return text
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWebhook records the messages posted to it, as Slack's "text" or
+// Discord's "content".
+type fakeWebhook struct {
+	*httptest.Server
+	mu       sync.Mutex
+	messages []string
+}
+
+// newFakeWebhook starts a webhook, stopped when the test ends.
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	f := &fakeWebhook{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.messages = append(f.messages, payload["text"]+payload["content"])
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Messages returns the messages posted so far.
+func (f *fakeWebhook) Messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+// newNotifyServer returns a server that posts cfg's notifications to a
+// fake Slack webhook, on a fake clock.
+func newNotifyServer(t *testing.T, cfg Config) (*Server, *fakeWebhook, *fakeClock) {
+	hook := newFakeWebhook(t)
+	cfg.NotifySlackURL = hook.URL
+	s := newServer(cfg)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	return s, hook, clock
+}
+
+// TestNotifyBatches checks notifications are posted together every
+// NOTIFY_BATCH_INTERVAL, and only for NOTIFY_EVENTS.
+func TestNotifyBatches(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.NotifyEvents = []string{eventStartup, eventPanic}
+	s, hook, clock := newNotifyServer(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.postNotifications(ctx, 10*time.Second)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+
+	s.notify(eventStartup, "started and taking traffic")
+	s.notify(eventHealth, "readiness went from ready to degraded")
+	s.notify(eventPanic, "GET /boom panicked: boom")
+	clock.Advance(10 * time.Second)
+	eventually(t, func() bool { return len(hook.Messages()) == 1 })
+
+	msg := hook.Messages()[0]
+	for _, want := range []string{"*hello-devops*", "🟢 12:00:00 *startup*: started and taking traffic", "💥 12:00:00 *panic*: GET /boom panicked: boom"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected %q in the message, got:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "readiness") {
+		t.Errorf("Expected health events left out, got:\n%s", msg)
+	}
+
+	clock.Advance(10 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if n := len(hook.Messages()); n != 1 {
+		t.Errorf("Expected nothing posted without notifications, got %d messages", n)
+	}
+}
+
+// TestNotifyPanic checks a panicking handler is notified, and shutting
+// down posts the shutdown and whatever else is waiting.
+func TestNotifyPanic(t *testing.T) {
+	s, hook, _ := newNotifyServer(t, defaultConfig(t))
+	h := s.handler()
+	if err := s.faults.Set(Fault{Route: "GET /api/v1/counter", Kind: "panic", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/counter", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %d", rec.Code)
+	}
+
+	if err := s.terminate(&http.Server{}, os.Interrupt, 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	messages := hook.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "*panic*: GET /api/v1/counter panicked: injected panic") ||
+		!strings.Contains(messages[0], "*shutdown*: shutting down (interrupt)") {
+		t.Errorf("Expected the panic and shutdown posted, got %q", messages)
+	}
+}
+
+// TestNotifyReadiness checks changes in the readiness status are notified,
+// naming the failing checks.
+func TestNotifyReadiness(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.NotifyBatchInterval = 0
+	s, hook, clock := newNotifyServer(t, cfg)
+	var failing atomic.Bool
+	s.readiness.Register("redis", SeverityHard, func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	check := func() {
+		clock.Advance(time.Minute)
+		s.readiness.Check(context.Background(), clock.Now())
+	}
+	check()
+	failing.Store(true)
+	check()
+	eventually(t, func() bool { return len(hook.Messages()) == 1 })
+	failing.Store(false)
+	check()
+	check()
+	eventually(t, func() bool { return len(hook.Messages()) == 2 })
+
+	messages := hook.Messages()
+	if !strings.Contains(messages[0], "readiness went from ready to unavailable (redis: connection refused)") ||
+		!strings.Contains(messages[1], "readiness went from unavailable to ready") {
+		t.Errorf("Expected the changes posted, got %q", messages)
+	}
+}
+
+// TestFormatNotifications checks Discord's formatting, the count of
+// dropped notifications and the length limit.
+func TestFormatNotifications(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg := formatNotifications("discord", []notification{{eventShutdown, "shutting down", at}}, 3)
+	if !strings.Contains(msg, "🔴 12:00:00 **shutdown**: shutting down\n…and 3 more") {
+		t.Errorf("Unexpected message:\n%s", msg)
+	}
+
+	long := formatNotifications("discord", []notification{{eventPanic, strings.Repeat("é", 3000), at}}, 0)
+	if n := len([]rune(long)); n != discordMaxLength || !strings.HasSuffix(long, "…") {
+		t.Errorf("Expected the message cut to %d characters, got %d", discordMaxLength, n)
+	}
+}
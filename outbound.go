@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// This file provides the HTTP client the server uses to call other services
+// (the quote and weather APIs). Outbound calls are often where latency and
+// errors really come from, so the client is instrumented the same way as
+// incoming requests: every call is counted and timed in /metrics, labeled
+// with the host it went to, and logged at debug level.
+//
+// The instrumentation lives in an http.RoundTripper, the interface the
+// client uses to actually send a request. Wrapping the default one lets us
+// observe every request without changing the code that makes them.
+
+// outboundTimeout bounds every outbound request. Callers that need a
+// shorter limit set one on the request's context.
+const outboundTimeout = 30 * time.Second
+
+// instrumentedTransport records metrics for each request it sends, and
+// passes on the request ID and trace context (tracecontext.go) of the
+// incoming request that caused it, so logs and traces on both sides can be
+// matched up.
+type instrumentedTransport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+}
+
+// newOutboundClient creates an HTTP client that records into metrics.
+func newOutboundClient(metrics *Metrics) *http.Client {
+	return &http.Client{
+		Transport: &instrumentedTransport{base: http.DefaultTransport, metrics: metrics},
+		Timeout:   outboundTimeout,
+	}
+}
+
+// RoundTrip sends the request and records how it went. A RoundTripper must
+// not modify the request it's given, so headers are added to a clone.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestIDFromContext(req.Context())
+	if _, traced := traceFromContext(req.Context()); traced || id != "" {
+		req = req.Clone(req.Context())
+		if id != "" && req.Header.Get(requestIDHeader) == "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		injectTrace(req.Context(), req.Header)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	duration := time.Since(start)
+	addServerTiming(req.Context(), "upstream", duration)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.ObserveOutbound(outboundLabels{Host: req.URL.Host, Method: req.Method, Status: status}, duration)
+	slog.DebugContext(req.Context(), "outbound request", "method", req.Method, "url", req.URL.Redacted(), "status", status, "duration", duration)
+
+	return resp, err
+}
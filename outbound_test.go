@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOutboundClient checks outbound requests are counted in the metrics
+// and carry the request ID.
+func TestOutboundClient(t *testing.T) {
+	var gotID string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = r.Header.Get(requestIDHeader)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer api.Close()
+
+	metrics := newMetrics()
+	client := newOutboundClient(metrics)
+
+	ctx := context.WithValue(context.Background(), requestIDContextKey, "abc123")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, api.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if gotID != "abc123" {
+		t.Errorf("Expected the request ID to be passed on, got %q", gotID)
+	}
+	if req.Header.Get(requestIDHeader) != "" {
+		t.Error("Expected the caller's request to be left unchanged")
+	}
+
+	// A request that gets no response at all is counted as an error.
+	api.Close()
+	if _, err := client.Get(api.URL); err == nil {
+		t.Fatal("Expected a request to a closed server to fail")
+	}
+
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	host := strings.TrimPrefix(api.URL, "http://")
+	for _, want := range []string{
+		`http_client_requests_total{host="` + host + `",method="GET",status="418"} 1`,
+		`http_client_requests_total{host="` + host + `",method="GET",status="error"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// This file implements partial updates with PATCH. A PUT replaces the whole
+// resource, so the client has to send every field; a PATCH sends only the
+// changes. There are two standard formats for describing them, and the
+// request's Content-Type says which one is used:
+//
+// JSON Merge Patch (RFC 7396), application/merge-patch+json, looks like the
+// resource itself. Fields present are set, fields set to null are removed:
+//
+//	{"title": "New title"}
+//
+// JSON Patch (RFC 6902), application/json-patch+json, is a list of
+// operations addressed by JSON Pointer paths. It's more verbose but can do
+// things a merge patch can't, like conditional updates with "test":
+//
+//	[{"op": "test", "path": "/title", "value": "Old title"},
+//	 {"op": "replace", "path": "/title", "value": "New title"}]
+//
+// Both are applied to the note's JSON form, and the result is decoded and
+// validated exactly like a new note would be before anything is saved.
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// handlePatchNote applies a merge patch or JSON patch to a note.
+func (s *Server) handlePatchNote(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		// The Accept-Patch header tells the client which formats we take.
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		writeProblem(w, http.StatusUnsupportedMediaType, "Content-Type must be "+mergePatchType+" or "+jsonPatchType)
+		return
+	}
+
+	tenant := tenantFromContext(r.Context())
+	note, ok := s.store.GetNote(tenant, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "note not found")
+		return
+	}
+
+	// Patches are relative to the version the client read, so applying one
+	// to a newer version could give nonsense. Reject stale ones up front;
+	// UpdateNote checks again in case the note changes while we work.
+	match, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	if !match(note) {
+		writeNoteError(w, errNoteChanged)
+		return
+	}
+
+	// Read the whole body, up to a limit, so a patch followed by anything
+	// else is rejected rather than half applied.
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBody))
+	if err != nil {
+		writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxValidatedBody))
+		return
+	}
+	var patch any
+	if err := json.Unmarshal(data, &patch); err != nil {
+		writeProblem(w, http.StatusBadRequest, "request body must be valid JSON")
+		return
+	}
+
+	// Turn the note into generic JSON values, which both formats work on.
+	var doc any
+	raw, _ := json.Marshal(note)
+	json.Unmarshal(raw, &doc)
+
+	if mediaType == mergePatchType {
+		doc = mergePatch(doc, patch)
+	} else {
+		doc, err = applyJSONPatch(doc, patch)
+		if errors.Is(err, errPatchTestFailed) {
+			// A failed "test" means the note isn't in the state the
+			// client expected, so nothing is changed.
+			writeProblem(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeProblem(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	patched, err := validatePatchedNote(note, doc)
+	if err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	updated, err := s.store.UpdateNote(tenant, patched, match)
+	if err != nil {
+		// Changed or deleted by someone else between our read and write.
+		writeNoteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etagOf(updated))
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// validatePatchedNote decodes the patched document back into a Note and
+// checks it. Unknown fields and wrong types are rejected rather than
+// silently ignored, and read-only fields must be unchanged.
+func validatePatchedNote(original Note, doc any) (Note, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return Note{}, err
+	}
+
+	var note Note
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&note); err != nil {
+		return Note{}, fmt.Errorf("patched note is invalid: %v", err)
+	}
+
+	if note.ID != original.ID {
+		return Note{}, errors.New("id is read-only")
+	}
+	if !note.CreatedAt.Equal(original.CreatedAt) {
+		return Note{}, errors.New("created_at is read-only")
+	}
+	note.Title = strings.TrimSpace(note.Title)
+	if note.Title == "" {
+		return Note{}, errors.New("title is required")
+	}
+	return note, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch. The whole algorithm fits in a
+// few lines: objects are merged recursively, null deletes, and anything else
+// replaces the target outright.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// errPatchTestFailed is returned when a JSON Patch "test" operation fails.
+var errPatchTestFailed = errors.New("test operation failed")
+
+// jsonPatchOp is one RFC 6902 operation.
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from"`
+	Value any    `json:"value"`
+}
+
+// applyJSONPatch applies an RFC 6902 patch. Operations run in order, and if
+// any fails the whole patch fails, so the caller keeps the original.
+func applyJSONPatch(doc, patch any) (any, error) {
+	raw, _ := json.Marshal(patch)
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return nil, errors.New("a JSON patch must be an array of operations")
+	}
+
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, op.Value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, op.Path); err == nil {
+				doc, err = pointerAdd(doc, op.Path, op.Value)
+			}
+		case "move", "copy":
+			var value any
+			if value, err = pointerGet(doc, op.From); err == nil {
+				if op.Op == "move" {
+					doc, _, err = pointerRemove(doc, op.From)
+				} else {
+					value = deepCopy(value)
+				}
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "test":
+			var value any
+			if value, err = pointerGet(doc, op.Path); err == nil && !jsonEqual(value, op.Value) {
+				err = fmt.Errorf("%w: %s does not have the expected value", errPatchTestFailed, op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer such as "/tags/0" into its
+// reference tokens, undoing the ~1 (for "/") and ~0 (for "~") escapes.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// pointerGet returns the value a pointer refers to.
+func pointerGet(doc any, ptr string) (any, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[t]; !ok {
+				return nil, fmt.Errorf("%s does not exist", ptr)
+			}
+		case []any:
+			i, err := arrayIndex(t, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("%s does not exist", ptr)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd sets the value at a pointer, inserting into arrays ("-" means
+// the end) and creating or replacing object members. The parent must exist.
+func pointerAdd(doc any, ptr string, value any) (any, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, tokens, func(parent any, last string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[last] = value
+			return p, nil
+		case []any:
+			i := len(p)
+			if last != "-" {
+				if i, err = arrayIndex(last, len(p)); err != nil {
+					return nil, err
+				}
+			}
+			return append(p[:i], append([]any{value}, p[i:]...)...), nil
+		}
+		return nil, fmt.Errorf("parent of %s is not an object or array", ptr)
+	})
+}
+
+// pointerRemove deletes the value at a pointer and returns it.
+func pointerRemove(doc any, ptr string) (any, any, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	var removed any
+	doc, err = updateParent(doc, tokens, func(parent any, last string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			v, ok := p[last]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", ptr)
+			}
+			removed = v
+			delete(p, last)
+			return p, nil
+		case []any:
+			i, err := arrayIndex(last, len(p)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%s does not exist", ptr)
+	})
+	return doc, removed, err
+}
+
+// updateParent walks to the container holding the last token, lets fn
+// change it, and stores the result back (arrays may have been reallocated).
+func updateParent(doc any, tokens []string, fn func(parent any, last string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+
+	switch v := doc.(type) {
+	case map[string]any:
+		child, ok := v[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("/%s does not exist", tokens[0])
+		}
+		updated, err := updateParent(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[tokens[0]] = updated
+		return v, nil
+	case []any:
+		i, err := arrayIndex(tokens[0], len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateParent(v[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = updated
+		return v, nil
+	}
+	return nil, fmt.Errorf("/%s does not exist", tokens[0])
+}
+
+// arrayIndex parses an array index token and checks it is at most maxIndex.
+func arrayIndex(token string, maxIndex int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > maxIndex || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// deepCopy copies a generic JSON value, so a "copy" doesn't alias.
+func deepCopy(v any) any {
+	raw, _ := json.Marshal(v)
+	var out any
+	json.Unmarshal(raw, &out)
+	return out
+}
+
+// jsonEqual compares two generic JSON values. Encoding both is the simplest
+// correct way: encoding/json writes object keys in sorted order.
+func jsonEqual(a, b any) bool {
+	ra, _ := json.Marshal(a)
+	rb, _ := json.Marshal(b)
+	return bytes.Equal(ra, rb)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// parseJSON parses a JSON literal for table-driven tests.
+func parseJSON(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("bad test JSON %q: %v", s, err)
+	}
+	return v
+}
+
+// TestMergePatch runs the examples from RFC 7396, Appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		got := mergePatch(parseJSON(t, tt.target), parseJSON(t, tt.patch))
+		if !jsonEqual(got, parseJSON(t, tt.want)) {
+			raw, _ := json.Marshal(got)
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tt.target, tt.patch, raw, tt.want)
+		}
+	}
+}
+
+// TestApplyJSONPatch checks each RFC 6902 operation.
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+		wantErr                bool
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, false},
+		{"add to array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, false},
+		{"append", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, false},
+		{"remove", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, false},
+		{"replace", `{"a":[1,2]}`, `[{"op":"replace","path":"/a/0","value":9}]`, `{"a":[9,2]}`, false},
+		{"move", `{"a":1}`, `[{"op":"move","from":"/a","path":"/b"}]`, `{"b":1}`, false},
+		{"copy", `{"a":{"x":1}}`, `[{"op":"copy","from":"/a","path":"/b"}]`, `{"a":{"x":1},"b":{"x":1}}`, false},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/m~0n"}]`, `{}`, false},
+		{"test passes", `{"a":"x"}`, `[{"op":"test","path":"/a","value":"x"}]`, `{"a":"x"}`, false},
+		{"test fails", `{"a":"x"}`, `[{"op":"test","path":"/a","value":"y"}]`, ``, true},
+		{"remove missing", `{}`, `[{"op":"remove","path":"/a"}]`, ``, true},
+		{"replace missing", `{}`, `[{"op":"replace","path":"/a","value":1}]`, ``, true},
+		{"bad index", `{"a":[1]}`, `[{"op":"add","path":"/a/5","value":1}]`, ``, true},
+		{"unknown op", `{}`, `[{"op":"frobnicate","path":"/a"}]`, ``, true},
+		{"not an array", `{}`, `{"op":"add"}`, ``, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyJSONPatch(parseJSON(t, tt.doc), parseJSON(t, tt.patch))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !jsonEqual(got, parseJSON(t, tt.want)) {
+				raw, _ := json.Marshal(got)
+				t.Errorf("Got %s, want %s", raw, tt.want)
+			}
+		})
+	}
+}
+
+// patchNote sends a PATCH request for a note, with the If-Match header
+// set to its current ETag.
+func patchNote(srv *Server, id, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/notes/"+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if note, ok := srv.store.GetNote(defaultTenant, id); ok {
+		req.Header.Set("If-Match", etagOf(note))
+	}
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// TestHandlePatchNote checks both patch formats end to end, and that
+// invalid results are rejected without changing the note.
+func TestHandlePatchNote(t *testing.T) {
+	srv := newServer(Config{})
+	note := srv.store.CreateNote(defaultTenant, "Original", "Body")
+
+	rec := patchNote(srv, note.ID, mergePatchType, `{"title": "Merged"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("merge patch: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := srv.store.GetNote(defaultTenant, note.ID); got.Title != "Merged" || got.Body != "Body" {
+		t.Errorf("Expected only the title to change, got %+v", got)
+	}
+
+	rec = patchNote(srv, note.ID, jsonPatchType, `[{"op": "test", "path": "/title", "value": "Merged"}, {"op": "replace", "path": "/body", "value": "Patched"}]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("JSON patch: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rejections := []struct {
+		name, contentType, body string
+		status                  int
+	}{
+		{"wrong content type", "application/json", `{"title": "x"}`, http.StatusUnsupportedMediaType},
+		{"remove title", mergePatchType, `{"title": null}`, http.StatusUnprocessableEntity},
+		{"change id", mergePatchType, `{"id": "other"}`, http.StatusUnprocessableEntity},
+		{"unknown field", mergePatchType, `{"color": "red"}`, http.StatusUnprocessableEntity},
+		{"wrong type", mergePatchType, `{"title": 42}`, http.StatusUnprocessableEntity},
+		{"failed test", jsonPatchType, `[{"op": "test", "path": "/title", "value": "Stale"}]`, http.StatusConflict},
+	}
+	for _, tt := range rejections {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := patchNote(srv, note.ID, tt.contentType, tt.body); rec.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	if got, _ := srv.store.GetNote(defaultTenant, note.ID); got.Title != "Merged" || got.Body != "Patched" {
+		t.Errorf("Expected rejected patches to change nothing, got %+v", got)
+	}
+	if rec := patchNote(srv, "missing", mergePatchType, `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing note, got %d", rec.Code)
+	}
+}
+
+// FuzzPatchNote sends arbitrary merge patches and JSON patches.
+//
+//	go test -fuzz FuzzPatchNote -fuzztime 30s
+func FuzzPatchNote(f *testing.F) {
+	f.Add(false, `{"title": "New", "body": null}`)
+	f.Add(false, `{"id": "other", "extra": {"a": [1, 2]}}`)
+	f.Add(true, `[{"op": "replace", "path": "/title", "value": "New"}]`)
+	f.Add(true, `[{"op": "move", "from": "/title", "path": "/body"}, {"op": "test", "path": "/x/-", "value": 1}]`)
+	f.Add(true, `[{"op": "add", "path": "/body/99999999999999999999", "value": 1}]`)
+	f.Add(true, `[] trailing`)
+
+	srv := newServer(Config{})
+	h := srv.routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, jsonPatch bool, body string) {
+		note := srv.store.CreateNote(defaultTenant, "Title", "Body")
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/notes/"+note.ID, strings.NewReader(body))
+		req.Header.Set("If-Match", etagOf(note))
+		req.Header.Set("Content-Type", mergePatchType)
+		if jsonPatch {
+			req.Header.Set("Content-Type", jsonPatchType)
+		}
+		rec := serveFuzz(t, h, req)
+		if rec.Code == http.StatusOK && !json.Valid([]byte(body)) {
+			t.Errorf("Expected invalid JSON to be rejected, got 200 for %q", body)
+		}
+	})
+}
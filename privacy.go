@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// This file gives users the two data rights the GDPR is best known for:
+// to get a copy of their data (article 15, and 20's portability), and to
+// have it erased (article 17). Both need the user's access token (see
+// users.go):
+//
+//	curl -H "Authorization: Bearer <access_token>" http://localhost:8000/api/v1/me/export
+//	curl -X DELETE -H "Authorization: Bearer <access_token>" http://localhost:8000/api/v1/me
+//
+// The export is a JSON download of everything stored about the account:
+// the profile, the sign-ins (refresh tokens, by their hashes) and the
+// account's audit entries. Nothing else the app stores is linked to an
+// account: guestbook entries and notes belong to the tenant, and /learn
+// progress to a cookie.
+//
+// Erasure happens in two steps. The request marks the account, signs it
+// out everywhere by revoking its refresh tokens, and answers 202 Accepted
+// straight away; from then on it can't log in. A background job in the
+// server, like the purge of deleted notes (see purge.go), then removes it
+// and its tokens every ACCOUNT_ERASE_INTERVAL. Access tokens already
+// issued stay valid until they expire, a few minutes at most, but there's
+// no account left for them to reach.
+//
+// Both are audited: an entry is stored for every export, request and
+// erasure, and logged. Entries hold the account's ID but nothing personal,
+// so they outlive the account as the record that it was erased, and an
+// operator can list them with GET /admin/audit. Backups taken before an
+// erasure still hold the account (see backup.go); restoring one brings it
+// back, so expire them accordingly.
+
+// The actions audited.
+const (
+	auditExport          = "export"
+	auditDeletionRequest = "deletion_requested"
+	auditErased          = "erased"
+)
+
+// AuditEntry records something done to an account's data.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	UserID string    `json:"user_id"`
+
+	// RequestID ties the entry to the request's logs; the background
+	// erasure has none.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AuditResponse is the JSON body of GET /admin/audit.
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// UserDataExport is everything stored about a user.
+type UserDataExport struct {
+	ExportedAt time.Time      `json:"exported_at"`
+	User       UserProfile    `json:"user"`
+	Sessions   []RefreshToken `json:"sessions"`
+	Audit      []AuditEntry   `json:"audit"`
+}
+
+// DeletionResponse is the JSON body of DELETE /api/v1/me.
+type DeletionResponse struct {
+	Status      string    `json:"status"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// currentUser returns the registered user a request's access token is
+// for, or answers 401 or 404 and returns false. Only user tokens count: a
+// gateway token names whatever subject the operator chose.
+func (s *Server) currentUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	claims, ok := s.bearerJWT(r, jwtAudienceUser)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-hello-devops"`)
+		writeProblem(w, http.StatusUnauthorized, "this route needs a token, sent as Authorization: Bearer <token>")
+		return User{}, false
+	}
+	user, ok := s.store.GetUser(tenantFromContext(r.Context()), claims.Subject)
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "the token is not for a registered user")
+		return User{}, false
+	}
+	return user, true
+}
+
+// audit stores and logs an audit entry.
+func (s *Server) audit(ctx context.Context, tenant string, entry AuditEntry) {
+	s.store.AddAuditEntry(tenant, entry)
+	slog.InfoContext(ctx, "Audit", "action", entry.Action, "user_id", entry.UserID)
+}
+
+// handleExportUserData sends the user all their data, as a download.
+func (s *Server) handleExportUserData(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	now := s.clock.Now().UTC()
+	s.audit(r.Context(), tenant, AuditEntry{Time: now, Action: auditExport, UserID: user.ID, RequestID: requestIDFromContext(r.Context())})
+
+	export := UserDataExport{
+		ExportedAt: now,
+		User:       user.Profile(),
+		Sessions:   s.store.UserRefreshTokens(tenant, user.ID),
+		Audit:      s.store.ListAudit(tenant, user.ID),
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+user.Username+`-data.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// handleDeleteUser accepts a request to erase the user's account.
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	user, first := s.store.RequestUserDeletion(tenant, user.ID, s.clock.Now())
+	if first {
+		s.audit(r.Context(), tenant, AuditEntry{Time: *user.DeletionRequestedAt, Action: auditDeletionRequest, UserID: user.ID, RequestID: requestIDFromContext(r.Context())})
+	}
+	writeJSON(w, http.StatusAccepted, DeletionResponse{Status: "pending", RequestedAt: *user.DeletionRequestedAt})
+}
+
+// handleListAudit lists the tenant's audit entries, oldest first, or one
+// user's with ?user_id=.
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	entries := s.store.ListAudit(tenantFromContext(r.Context()), r.URL.Query().Get("user_id"))
+	writeJSON(w, http.StatusOK, AuditResponse{Entries: entries})
+}
+
+// eraseUsers runs eraseOnce every interval until ctx is cancelled.
+func (s *Server) eraseUsers(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.eraseOnce(s.clock.Now())
+	}
+}
+
+// eraseOnce erases the accounts whose deletion has been requested, and
+// audits each. With several replicas each would run it, which is harmless:
+// an account can only be erased once.
+func (s *Server) eraseOnce(now time.Time) int {
+	erased := s.store.EraseRequestedUsers(now)
+	for _, e := range erased {
+		slog.Info("Audit", "action", auditErased, "user_id", e.UserID, "tenant", e.Tenant)
+	}
+	return len(erased)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// registerAndLogin registers alice and returns her profile and tokens.
+func registerAndLogin(t *testing.T, c *testsupport.Client) (UserProfile, TokenResponse) {
+	t.Helper()
+	user := testsupport.Decode[UserProfile](c.Post("/api/v1/register", map[string]any{"username": "alice", "email": "alice@example.com", "password": "correct horse"}).Status(http.StatusCreated))
+	tokens := testsupport.Decode[TokenResponse](c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "correct horse"}).Status(http.StatusOK))
+	return user, tokens
+}
+
+// withBearer returns a request sent with an access token.
+func withBearer(method, path, token string) *http.Request {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// TestExportUserData checks the export holds the user's profile, sessions
+// and audit entries, and is itself audited.
+func TestExportUserData(t *testing.T) {
+	_, c := newUserTestServer(t)
+	user, tokens := registerAndLogin(t, c)
+
+	export := testsupport.Decode[UserDataExport](c.DoRequest(withBearer(http.MethodGet, "/api/v1/me/export", tokens.AccessToken)).
+		Status(http.StatusOK).
+		HasHeader("Content-Disposition", `attachment; filename="alice-data.json"`))
+	if export.User != user {
+		t.Errorf("Expected %+v, got %+v", user, export.User)
+	}
+	if len(export.Sessions) != 1 || export.Sessions[0].Subject != user.ID {
+		t.Errorf("Expected the login's refresh token, got %+v", export.Sessions)
+	}
+	if len(export.Audit) != 1 || export.Audit[0].Action != auditExport || export.Audit[0].UserID != user.ID {
+		t.Errorf("Expected the export to be audited, got %+v", export.Audit)
+	}
+
+	c.Get("/api/v1/me/export").Status(http.StatusUnauthorized)
+}
+
+// TestDeleteUser checks a deletion request signs the user out and stops
+// them logging in, and the background job then erases them.
+func TestDeleteUser(t *testing.T) {
+	openAdmin(t)
+	s, c := newUserTestServer(t)
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	user, tokens := registerAndLogin(t, c)
+
+	c.DoRequest(withBearer(http.MethodDelete, "/api/v1/me", tokens.AccessToken)).
+		Status(http.StatusAccepted).
+		JSON(`{"status": "pending", "requested_at": "2024-01-01T00:00:00Z"}`)
+	// Asking twice is the same as asking once.
+	clock.Advance(time.Minute)
+	c.DoRequest(withBearer(http.MethodDelete, "/api/v1/me", tokens.AccessToken)).
+		Status(http.StatusAccepted).
+		JSON(`{"status": "pending", "requested_at": "2024-01-01T00:00:00Z"}`)
+
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": tokens.RefreshToken}).Status(http.StatusUnauthorized)
+	c.Post("/api/v1/login", map[string]any{"login": "alice", "password": "correct horse"}).Status(http.StatusUnauthorized)
+	c.DoRequest(withBearer(http.MethodGet, "/api/v1/me", tokens.AccessToken)).
+		Status(http.StatusOK).
+		JSON(`{"deletion_requested_at": "2024-01-01T00:00:00Z", "...": "..."}`)
+
+	if n := s.eraseOnce(clock.Now()); n != 1 {
+		t.Fatalf("Expected 1 user erased, got %d", n)
+	}
+	if n := s.eraseOnce(clock.Now()); n != 0 {
+		t.Errorf("Expected nothing left to erase, got %d", n)
+	}
+	snap := s.store.Snapshot().Tenants[defaultTenant]
+	if len(snap.Users) != 0 || len(snap.RefreshTokens) != 0 {
+		t.Errorf("Expected the user and their tokens to be gone, got %+v and %+v", snap.Users, snap.RefreshTokens)
+	}
+	c.DoRequest(withBearer(http.MethodGet, "/api/v1/me", tokens.AccessToken)).Status(http.StatusNotFound)
+
+	audit := testsupport.Decode[AuditResponse](c.Get("/admin/audit?user_id=" + user.ID).Status(http.StatusOK))
+	if len(audit.Entries) != 2 || audit.Entries[0].Action != auditDeletionRequest || audit.Entries[1].Action != auditErased {
+		t.Errorf("Expected the request and the erasure to be audited, got %+v", audit.Entries)
+	}
+
+	// The name is free again once the account is gone.
+	c.Post("/api/v1/register", map[string]any{"username": "alice", "email": "alice@example.com", "password": "correct horse"}).Status(http.StatusCreated)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "net/http"
+
+// This file serves the health probes ahead of everything else. Kubernetes
+// restarts a pod that fails its liveness probe and stops sending it traffic
+// while it fails its readiness probe, so a probe that fails only because
+// the server is busy does real harm: a restart under load throws away the
+// work in progress and moves the load onto the other pods.
+//
+// So the probes (/health and /livez for liveness, /readyz and /startupz)
+// take a short path:
+//   - handler() sends them straight to their handlers, before the startup
+//     gate and the proxy, so no gateway route can shadow them
+//   - their middleware is the probe group's (see chain.go): recover,
+//     request ID and metrics, without the tenant, logging, load shedding,
+//     in-flight limits, auth or deadline the other routes go through
+//
+// None of their handlers waits on anything slow: /readyz answers from the
+// readiness checks' cache, refreshing it with a timeout (see readiness.go).
+
+// probePaths are the paths of the health probes.
+var probePaths = map[string]bool{"/health": true, "/livez": true, "/readyz": true, "/startupz": true}
+
+// handleProbe registers a health probe with the probe group's middleware.
+func (s *Server) handleProbe(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	s.register(mux, pattern, h, s.chain(probeGroup))
+}
+
+// handler returns the server's whole HTTP handler: the probes, then the
+// startup gate, the maintenance gate, the proxy and the routes.
+func (s *Server) handler() http.Handler {
+	mux := s.routes()
+	next := s.startupGate(s.maintenanceGate(s.proxyRouter(mux)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
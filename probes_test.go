@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestProbesBypassProtections checks the probes answer while everything
+// that turns requests away is at its strictest.
+func TestProbesBypassProtections(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.MaxInFlight = 1
+	s.cfg.AdminAPIKeys = []string{"secret"}
+	s.cfgMu.Unlock()
+
+	release := holdRequest(t, s, c)
+	defer release()
+	c.Get("/api/v1/counter").Status(http.StatusServiceUnavailable)
+	for _, path := range []string{"/health", "/livez", "/readyz", "/startupz"} {
+		c.Get(path).Status(http.StatusOK)
+	}
+}
+
+// TestProbesFirst checks a gateway route can't shadow the probes, and the
+// registry shows their short middleware chain.
+func TestProbesFirst(t *testing.T) {
+	openAdmin(t)
+	s, _ := newProxyServer(t, "/livez=http://127.0.0.1:1", "/api=http://127.0.0.1:1")
+	c := testsupport.New(t, s.handler())
+	c.Get("/livez").Status(http.StatusOK)
+	c.Get("/api/v1/counter").Status(http.StatusBadGateway)
+
+	routes := testsupport.Decode[RouteListResponse](c.Get("/admin/routes").Status(http.StatusOK))
+	found := 0
+	for _, route := range routes.Routes {
+		if !probePaths[route.Path] {
+			continue
+		}
+		found++
+		if want := []string{"recover", "requestid", "metrics"}; !slices.Equal(route.Middleware, want) {
+			t.Errorf("%s: expected middleware %v, got %v", route.Path, want, route.Middleware)
+		}
+	}
+	if found != len(probePaths) {
+		t.Errorf("Expected %d probes in the registry, got %d", len(probePaths), found)
+	}
+}
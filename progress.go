@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// This file remembers which /learn exercises each learner has completed,
+// so progress survives closing the browser (and, with DATA_FILE set,
+// restarting the server). There are no user accounts: a learner is
+// identified by a random ID kept in a long-lived cookie. Scripts and curl
+// users can send the ID in an X-Learner-ID header instead.
+//
+// An exercise counts as completed the first time its check passes, whether
+// on the /learn page or through the verify endpoint, and stays completed.
+// Badges are worked out from the completions each time, so adding a badge
+// needs no migration.
+
+const (
+	learnerCookie = "learner"
+	learnerHeader = "X-Learner-ID"
+
+	// learnerCookieMaxAge keeps the cookie for a year.
+	learnerCookieMaxAge = 365 * 24 * 60 * 60
+)
+
+// ExerciseCompletion is one completed exercise in a ProgressResponse.
+type ExerciseCompletion struct {
+	Exercise    string    `json:"exercise"`
+	Title       string    `json:"title"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// Badge is awarded for reaching a milestone.
+type Badge struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Emoji string `json:"emoji"`
+}
+
+// ProgressResponse is the JSON body returned by GET /api/v1/progress.
+type ProgressResponse struct {
+	Learner   string               `json:"learner"`
+	Completed []ExerciseCompletion `json:"completed"`
+	Total     int                  `json:"total"`
+	Badges    []Badge              `json:"badges"`
+}
+
+// badges lists every badge with the number of completed exercises it
+// needs; zero means all of them.
+var badges = []struct {
+	Badge
+	needs int
+}{
+	{Badge{ID: "first-steps", Name: "First steps", Emoji: "🌱"}, 1},
+	{Badge{ID: "halfway", Name: "Halfway there", Emoji: "🚀"}, 3},
+	{Badge{ID: "graduate", Name: "Graduate", Emoji: "🎓"}, 0},
+}
+
+// learnerID returns the ID of the learner making the request, from the
+// header or cookie. A visitor without one is given a new ID in a cookie.
+func learnerID(w http.ResponseWriter, r *http.Request) string {
+	if id := r.Header.Get(learnerHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+	if c, err := r.Cookie(learnerCookie); err == nil && requestIDPattern.MatchString(c.Value) {
+		return c.Value
+	}
+
+	id := newID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     learnerCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   learnerCookieMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// progress returns a learner's completed exercises, in the order of the
+// series, and the badges they've earned.
+func (s *Server) progress(tenant, learner string) ProgressResponse {
+	list := exercises()
+	done := s.store.Completions(tenant, learner)
+
+	resp := ProgressResponse{Learner: learner, Completed: []ExerciseCompletion{}, Total: len(list), Badges: []Badge{}}
+	for _, e := range list {
+		if at, ok := done[e.ID]; ok {
+			resp.Completed = append(resp.Completed, ExerciseCompletion{Exercise: e.ID, Title: e.Title, CompletedAt: at})
+		}
+	}
+	for _, b := range badges {
+		needs := b.needs
+		if needs == 0 {
+			needs = len(list)
+		}
+		if len(resp.Completed) >= needs {
+			resp.Badges = append(resp.Badges, b.Badge)
+		}
+	}
+	return resp
+}
+
+// recordResult saves a passed check as a completion.
+func (s *Server) recordResult(r *http.Request, learner string, result VerifyResponse) {
+	if result.Passed {
+		s.store.CompleteExercise(tenantFromContext(r.Context()), learner, result.Exercise, s.clock.Now())
+	}
+}
+
+// handleGetProgress returns the learner's progress.
+func (s *Server) handleGetProgress(w http.ResponseWriter, r *http.Request) {
+	learner := learnerID(w, r)
+	writeJSON(w, http.StatusOK, s.progress(tenantFromContext(r.Context()), learner))
+}
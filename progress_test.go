@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLearnerID checks a new visitor gets a cookie, and returning ones are
+// recognized by cookie or header.
+func TestLearnerID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	id := learnerID(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != learnerCookie || cookies[0].Value != id {
+		t.Fatalf("Expected a learner cookie with %q, got %+v", id, cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	if got := learnerID(rec, req); got != id || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected the cookie's ID %q without a new cookie, got %q", id, got)
+	}
+
+	req.Header.Set(learnerHeader, "script-1")
+	if got := learnerID(httptest.NewRecorder(), req); got != "script-1" {
+		t.Errorf("Expected the header's ID, got %q", got)
+	}
+}
+
+// TestProgressAndBadges records completions and checks the badges earned.
+func TestProgressAndBadges(t *testing.T) {
+	srv := newServer(Config{})
+	list := exercises()
+
+	if p := srv.progress("acme", "ada"); len(p.Completed) != 0 || len(p.Badges) != 0 || p.Total != len(list) {
+		t.Errorf("Expected no progress yet, got %+v", p)
+	}
+
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	if !srv.store.CompleteExercise("acme", "ada", list[2].ID, at) {
+		t.Error("Expected the first completion to be news")
+	}
+	if srv.store.CompleteExercise("acme", "ada", list[2].ID, at.Add(time.Hour)) {
+		t.Error("Expected a repeat completion not to be news")
+	}
+	srv.store.CompleteExercise("acme", "ada", list[0].ID, at)
+
+	p := srv.progress("acme", "ada")
+	if len(p.Completed) != 2 || p.Completed[0].Exercise != list[0].ID || !p.Completed[1].CompletedAt.Equal(at) {
+		t.Errorf("Expected two completions in series order, got %+v", p.Completed)
+	}
+	if len(p.Badges) != 1 || p.Badges[0].ID != "first-steps" {
+		t.Errorf("Expected the first-steps badge, got %+v", p.Badges)
+	}
+
+	for _, e := range list {
+		srv.store.CompleteExercise("acme", "ada", e.ID, at)
+	}
+	if p := srv.progress("acme", "ada"); len(p.Badges) != len(badges) {
+		t.Errorf("Expected every badge, got %+v", p.Badges)
+	}
+	if p := srv.progress("acme", "grace"); len(p.Completed) != 0 {
+		t.Errorf("Expected other learners to have no progress, got %+v", p)
+	}
+}
+
+// TestProgressPersists checks completions survive a restart.
+func TestProgressPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CompleteExercise("acme", "ada", "readyz", time.Now())
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Completions("acme", "ada")["readyz"]; !ok {
+		t.Error("Expected the completion to survive a restart")
+	}
+}
+
+// TestHandleGetProgress checks the endpoint uses the learner header.
+func TestHandleGetProgress(t *testing.T) {
+	srv := newServer(Config{})
+	srv.store.CompleteExercise(defaultTenant, "ada", exercises()[0].ID, time.Now())
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/progress", nil)
+	req.Header.Set(learnerHeader, "ada")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	var resp ProgressResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if resp.Learner != "ada" || len(resp.Completed) != 1 {
+		t.Errorf("Expected ada's one completion, got %+v", resp)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This file builds a read model of the event-sourced counter (see
+// eventcounter.go), which completes the CQRS story: Command Query
+// Responsibility Segregation. Writes and reads go to different models.
+// Commands are checked against the event-sourced state and append events,
+// the write side. Queries read a projection, the read side: a table kept
+// in the shape the readers want, denormalized, with whatever has been
+// worked out of the events already there. Here that's a CounterView per
+// tenant: not just the value, but how many increments, decrements and
+// resets there were, how much was added and removed, and the highest value
+// it reached, which the write side never needed to know.
+//
+// The projection is updated asynchronously. Every PROJECTION_INTERVAL the
+// projector reads the events after the last one it projected (its
+// position) and folds them into the views; appending an event doesn't wait
+// for it. That's what lets the two sides scale and fail separately, and
+// what costs consistency: the read model is eventually consistent, a
+// little behind the events. GET /api/v1/eventcounter/projection shows how
+// far behind, as the lag in events and in seconds since the oldest event
+// it hasn't seen. Post a few commands and read it straight away to watch
+// it catch up.
+//
+// A read model can always be thrown away and rebuilt from the events, so
+// this one isn't saved at all: it starts empty, at position 0, and
+// replays everything when the server starts.
+
+// CounterView is a tenant's row in the counter read model.
+type CounterView struct {
+	Value      int64 `json:"value"`
+	Increments int64 `json:"increments"`
+	Decrements int64 `json:"decrements"`
+	Resets     int64 `json:"resets"`
+	Added      int64 `json:"added"`
+	Removed    int64 `json:"removed"`
+	Peak       int64 `json:"peak"`
+
+	// Position is the version of the last event projected.
+	Position    int64      `json:"position"`
+	LastEventAt *time.Time `json:"last_event_at,omitempty"`
+}
+
+// CounterProjectionResponse is the JSON body returned by GET
+// /api/v1/eventcounter/projection: the view, and how far it's behind the
+// events.
+type CounterProjectionResponse struct {
+	CounterView
+	Head       int64   `json:"head"`
+	LagEvents  int64   `json:"lag_events"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// CounterProjection is the counter read model, by tenant.
+type CounterProjection struct {
+	mu    sync.RWMutex
+	views map[string]CounterView
+}
+
+// newCounterProjection creates an empty read model.
+func newCounterProjection() *CounterProjection {
+	return &CounterProjection{views: make(map[string]CounterView)}
+}
+
+// View returns a tenant's row.
+func (p *CounterProjection) View(tenant string) CounterView {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.views[tenant]
+}
+
+// project folds events into a tenant's row, skipping any it has already
+// seen, so projecting the same events twice is harmless.
+func (p *CounterProjection) project(tenant string, events []CounterEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v := p.views[tenant]
+	for _, event := range events {
+		if event.Version <= v.Position {
+			continue
+		}
+		switch event.Type {
+		case counterIncremented:
+			v.Increments++
+			v.Added += event.Amount
+			v.Value += event.Amount
+		case counterDecremented:
+			v.Decrements++
+			v.Removed += event.Amount
+			v.Value -= event.Amount
+		case counterReset:
+			v.Resets++
+			v.Removed += v.Value
+			v.Value = 0
+		}
+		v.Peak = max(v.Peak, v.Value)
+		v.Position = event.Version
+		at := event.At
+		v.LastEventAt = &at
+	}
+	p.views[tenant] = v
+}
+
+// projectCounters brings the read model up to date every interval, until
+// ctx is cancelled.
+func (s *Server) projectCounters(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.projectOnce()
+	}
+}
+
+// projectOnce projects every tenant's events after its position.
+func (s *Server) projectOnce() {
+	for _, tenant := range s.store.CounterTenants() {
+		s.projection.project(tenant, s.store.CounterEvents(tenant, s.projection.View(tenant).Position))
+	}
+}
+
+// handleCounterProjection returns the tenant's row of the read model and
+// its lag.
+func (s *Server) handleCounterProjection(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	resp := CounterProjectionResponse{CounterView: s.projection.View(tenant)}
+	behind := s.store.CounterEvents(tenant, resp.Position)
+	resp.Head = resp.Position + int64(len(behind))
+	resp.LagEvents = int64(len(behind))
+	if len(behind) > 0 {
+		resp.LagSeconds = s.clock.Now().Sub(behind[0].At).Seconds()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestCounterProjection checks the read model lags behind the events until
+// the projector runs, then catches up with the totals worked out.
+func TestCounterProjection(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+
+	for _, cmd := range []map[string]any{
+		{"action": "increment", "amount": 5},
+		{"action": "decrement", "amount": 2},
+		{"action": "reset"},
+		{"action": "increment"},
+	} {
+		c.Post("/api/v1/eventcounter", cmd).Status(http.StatusCreated)
+	}
+	clock.Advance(3 * time.Second)
+	c.Get("/api/v1/eventcounter/projection").Status(http.StatusOK).JSON(`{"value": 0, "increments": 0, "decrements": 0, "resets": 0,
+		"added": 0, "removed": 0, "peak": 0, "position": 0, "head": 4, "lag_events": 4, "lag_seconds": 3}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.projectCounters(ctx, time.Second)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(time.Second)
+	eventually(t, func() bool { return s.projection.View(defaultTenant).Position == 4 })
+
+	resp := testsupport.Decode[CounterProjectionResponse](c.Get("/api/v1/eventcounter/projection").Status(http.StatusOK))
+	want := CounterView{Value: 1, Increments: 2, Decrements: 1, Resets: 1, Added: 6, Removed: 5, Peak: 5, Position: 4}
+	if resp.LastEventAt == nil || resp.LagEvents != 0 || resp.LagSeconds != 0 || resp.Head != 4 {
+		t.Errorf("Expected the projection to have caught up, got %+v", resp)
+	}
+	resp.LastEventAt = nil
+	if resp.CounterView != want {
+		t.Errorf("Expected %+v, got %+v", want, resp.CounterView)
+	}
+
+	// Projecting again changes nothing.
+	s.projectOnce()
+	if v := s.projection.View(defaultTenant); v.Value != 1 || v.Increments != 2 {
+		t.Errorf("Expected projecting twice to be harmless, got %+v", v)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProtoRoundTrip encodes messages and decodes them again, including
+// the nested, repeated, time and embedded fields.
+func TestProtoRoundTrip(t *testing.T) {
+	deleted := time.Date(2024, 6, 3, 12, 0, 0, 500, time.UTC)
+	notes := NoteListResponse{Notes: []Note{
+		{ID: "1", Title: "Shopping", Body: "Milk", CreatedAt: time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC)},
+		{ID: "2", Title: "Ünïcode ✓", CreatedAt: deleted, DeletedAt: &deleted},
+	}}
+	var gotNotes NoteListResponse
+	if err := protoUnmarshal(protoMarshal(notes), &gotNotes); err != nil || !reflect.DeepEqual(gotNotes, notes) {
+		t.Errorf("Expected %+v, got %+v (%v)", notes, gotNotes, err)
+	}
+
+	hello := HelloResponse{Greeting: Greeting{Lang: "ja", Hello: "こんにちは"}, Instance: "web-1"}
+	var gotHello HelloResponse
+	if err := protoUnmarshal(protoMarshal(hello), &gotHello); err != nil || gotHello != hello {
+		t.Errorf("Expected %+v, got %+v (%v)", hello, gotHello, err)
+	}
+
+	problem := ProblemResponse{Title: "Bad", Status: 422, Errors: []FieldError{{Pointer: "/title", Detail: "is required"}}}
+	var gotProblem ProblemResponse
+	if err := protoUnmarshal(protoMarshal(problem), &gotProblem); err != nil || !reflect.DeepEqual(gotProblem, problem) {
+		t.Errorf("Expected %+v, got %+v (%v)", problem, gotProblem, err)
+	}
+}
+
+// TestProtoWireFormat checks the bytes against what protoc produces for
+// the same message, and that unknown fields are skipped.
+func TestProtoWireFormat(t *testing.T) {
+	// Field 1 "hi"; field 3, 150 as a varint (protobuf's own example).
+	got := protoMarshal(ProblemResponse{Type: "hi", Status: 150})
+	if want := []byte{0x0a, 2, 'h', 'i', 0x18, 0x96, 0x01}; !bytes.Equal(got, want) {
+		t.Errorf("Expected % x, got % x", want, got)
+	}
+
+	// Field 9 (unknown) as a varint, then field 2, then field 15 (unknown)
+	// as bytes.
+	var req CreateNoteRequest
+	data := []byte{0x48, 7, 0x12, 1, 'x', 0x7a, 1, 'y'}
+	if err := protoUnmarshal(data, &req); err != nil || req != (CreateNoteRequest{Body: "x"}) {
+		t.Errorf("Expected body x, got %+v (%v)", req, err)
+	}
+
+	for _, bad := range [][]byte{{0x0a, 5, 'a'}, {0x0a}, {0x08, 1}, {0x0b}} {
+		if err := protoUnmarshal(bad, &req); err == nil {
+			t.Errorf("Expected % x to be rejected", bad)
+		}
+	}
+}
+
+// TestPrefersProtobuf checks Accept negotiation.
+func TestPrefersProtobuf(t *testing.T) {
+	cases := map[string]bool{
+		"":                       false,
+		"application/json":       false,
+		"*/*":                    false,
+		"application/x-protobuf": true,
+		"application/protobuf":   true,
+		"application/x-protobuf, application/json":       true,
+		"application/x-protobuf;q=0.5, application/json": false,
+		"application/json;q=0.5, application/x-protobuf": true,
+	}
+	for accept, want := range cases {
+		if got := prefersProtobuf(accept); got != want {
+			t.Errorf("prefersProtobuf(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+// TestProtobufAPI creates a note from protobuf and reads notes back as
+// protobuf, with errors as protobuf too and other responses still JSON.
+func TestProtobufAPI(t *testing.T) {
+	_, c := newTestServer(t)
+
+	protoRequest := func(method, path string, body any) *http.Request {
+		var data []byte
+		if body != nil {
+			data = protoMarshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Accept", "application/x-protobuf")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-protobuf")
+		}
+		return req
+	}
+
+	resp := c.DoRequest(protoRequest(http.MethodPost, "/api/v1/notes", CreateNoteRequest{Title: "Proto", Body: "Buffers"})).
+		Status(http.StatusCreated).
+		HasHeader("Content-Type", `application/x-protobuf; messageType="hellodevops.v1.Note"`)
+	var note Note
+	if err := protoUnmarshal(resp.Body.Bytes(), &note); err != nil || note.Title != "Proto" || note.Body != "Buffers" || note.CreatedAt.IsZero() {
+		t.Errorf("Unexpected note %+v (%v)", note, err)
+	}
+
+	resp = c.DoRequest(protoRequest(http.MethodGet, "/api/v1/notes", nil)).Status(http.StatusOK)
+	var list NoteListResponse
+	if err := protoUnmarshal(resp.Body.Bytes(), &list); err != nil || len(list.Notes) != 1 || list.Notes[0].ID != note.ID {
+		t.Errorf("Unexpected notes %+v (%v)", list, err)
+	}
+
+	// A protobuf body is checked against the schema like a JSON one.
+	resp = c.DoRequest(protoRequest(http.MethodPost, "/api/v1/notes", CreateNoteRequest{Body: "no title"})).
+		Status(http.StatusUnprocessableEntity).
+		HasHeader("Content-Type", `application/x-protobuf; messageType="hellodevops.v1.ProblemResponse"`)
+	var problem ProblemResponse
+	if err := protoUnmarshal(resp.Body.Bytes(), &problem); err != nil || len(problem.Errors) == 0 || problem.Errors[0].Pointer != "/title" {
+		t.Errorf("Unexpected problem %+v (%v)", problem, err)
+	}
+
+	// A truncated string.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader("\x0a\x05ab"))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	c.DoRequest(req).Status(http.StatusBadRequest).JSON(`{"detail": "request body must be a valid protobuf message", "...": "..."}`)
+
+	// Responses without a message stay JSON.
+	resp = c.DoRequest(protoRequest(http.MethodGet, "/api/v1/timezones", nil)).Status(http.StatusOK)
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected JSON, got %s", ct)
+	}
+
+	// And JSON is still the default.
+	resp = c.Get("/api/v1/notes").Status(http.StatusOK).HasHeader("Content-Type", "application/json").
+		JSON(`{"notes": [{"title": "Proto", "...": "..."}]}`)
+
+	// Only responses that could have been protobuf vary by Accept.
+	if !slices.Contains(resp.Header().Values("Vary"), "Accept") {
+		t.Errorf("Expected Vary: Accept on a message, got %v", resp.Header().Values("Vary"))
+	}
+	for _, path := range []string{"/", "/api/v1/timezones"} {
+		if vary := c.Get(path).Status(http.StatusOK).Header().Values("Vary"); slices.Contains(vary, "Accept") {
+			t.Errorf("%s: expected no Vary: Accept, got %v", path, vary)
+		}
+	}
+}
+
+// TestProtoSchema checks api.proto describes every message and is served.
+func TestProtoSchema(t *testing.T) {
+	schema := protoSchema()
+	for _, want := range []string{
+		"syntax = \"proto3\";",
+		"message Note {\n  string id = 1;\n  string title = 2;\n  string body = 3;\n  google.protobuf.Timestamp created_at = 4;\n  google.protobuf.Timestamp deleted_at = 5;\n}",
+		"message HelloResponse {\n  string lang = 1;",
+		"  repeated FieldError errors = 5;",
+	} {
+		if !strings.Contains(schema, want) {
+			t.Errorf("Expected api.proto to contain %q, got\n%s", want, schema)
+		}
+	}
+
+	_, c := newTestServer(t)
+	if body := c.Get("/proto/api.proto").Status(http.StatusOK).Body.String(); body != schema {
+		t.Errorf("Expected /proto/api.proto to serve the schema, got %s", body)
+	}
+}
+
+// FuzzProtobufBody sends arbitrary protobuf bodies to the endpoints that
+// accept them, and decodes them straight into messages with repeated and
+// nested fields: the decoder reads untrusted input, so it must never
+// panic, and what it accepts must encode back to the same message.
+//
+//	go test -fuzz FuzzProtobufBody -fuzztime 30s
+func FuzzProtobufBody(f *testing.F) {
+	targets := []string{"/api/v1/notes", "/api/v1/guestbook"}
+	for i, body := range [][]byte{
+		protoMarshal(CreateNoteRequest{Title: "Hello", Body: "World"}),
+		protoMarshal(GuestbookEntryRequest{Name: "Ada", Message: "Hi"}),
+		protoMarshal(ProblemResponse{Status: 422, Errors: []FieldError{{Pointer: "/title", Detail: "required"}}}),
+		[]byte("\x0a\x05ab"),
+		[]byte("\x0a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"),
+		[]byte("\x08\x80"),
+		{},
+	} {
+		f.Add(uint8(i), body)
+	}
+
+	s := newServer(Config{})
+	h := s.routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, target uint8, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, targets[int(target)%len(targets)], bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		serveFuzz(t, h, req)
+
+		var problem ProblemResponse
+		protoUnmarshal(body, &problem)
+		var list NoteListResponse
+		protoUnmarshal(body, &list)
+
+		var note CreateNoteRequest
+		if protoUnmarshal(body, &note) != nil {
+			return
+		}
+		var again CreateNoteRequest
+		if err := protoUnmarshal(protoMarshal(note), &again); err != nil || again != note {
+			t.Errorf("Expected %+v to survive encoding, got %+v (%v)", note, again, err)
+		}
+	})
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file turns the server into a small API gateway: requests whose path
+// starts with a configured prefix are forwarded to an upstream service
+// instead of being handled here, and the upstream's response is passed
+// back. For example, with
+//
+//	UPSTREAMS=users=dns+http://users-headless:8080
+//	PROXY_ROUTES=/users=users,/status=http://status:9000
+//
+// GET /users/42 is sent to one of the users pods as GET /users/42, and
+// /status/... to status:9000. A route's upstream is either a name from
+// UPSTREAMS or a target written in place (see resolver.go).
+//
+// Routes that need more than that go in a JSON file named by
+// GATEWAY_ROUTES_FILE, which can also strip the prefix, add headers,
+// require an API key and keep clients on one endpoint (see affinity.go):
+//
+//	{"routes": [
+//	  {"path": "/users", "upstream": "users", "strip_prefix": true,
+//	   "headers": {"X-Gateway": "go-hello-devops"}, "auth": true}
+//	]}
+//
+// Here GET /users/42 becomes GET /42 upstream, and is only forwarded with
+// "Authorization: Bearer <key>" for one of the GATEWAY_API_KEYS. The key is
+// the gateway's business, so it isn't passed on. One binary can this way
+// front several services, each seeing the paths it expects.
+//
+// Both sets of routes are reloaded with the rest of the configuration
+// (SIGHUP or POST /admin/reload, see reload.go), so routes can be added or
+// changed without a restart. A file with a mistake is rejected and the
+// current routes are kept.
+//
+// The standard library's httputil.ReverseProxy does the forwarding. Around
+// it, this file adds what a gateway is for:
+//   - headers: X-Forwarded-For, -Host, -Proto and -Prefix tell the upstream
+//     where the request really came from, X-Request-ID lets its logs be
+//     matched with ours, and Via marks the hop in both directions.
+//   - timeouts: an upstream that accepts the connection but never answers
+//     gets PROXY_TIMEOUT, then the client gets 504 Gateway Timeout.
+//   - retries: a request that failed to get an answer, or got 502, 503 or
+//     504, is tried again on the next endpoint, up to PROXY_RETRIES times.
+//     Only idempotent requests without a body are retried: doing them twice
+//     has the same effect as once, so a retry can't, say, create a note
+//     twice.
+//   - metrics: proxy_requests_total and proxy_retries_total in /metrics,
+//     labeled by upstream.
+//
+// Proxied requests go through the middleware in proxyGroup (see chain.go):
+// the request ID, trace, tenant, metrics and logging, the rate limit, load
+// shedding and in-flight limits, the gateway's API keys (auth) and request
+// signatures, and Server-Timing. They skip the others, which would change
+// the upstream's response (protobuf, the envelope, live reload), replay it
+// (idempotency) or keep copies of it (inspect).
+
+// proxyVia identifies this server in Via headers.
+const proxyVia = "1.1 go-hello-devops"
+
+// proxyDialTimeout bounds connecting to an upstream.
+const proxyDialTimeout = 5 * time.Second
+
+// proxyEndpointContextKey carries the endpoint picked for a request to the
+// ReverseProxy's Rewrite function.
+const proxyEndpointContextKey contextKey = "proxy-endpoint"
+
+// ProxyRoute forwards requests under Prefix to Upstream.
+type ProxyRoute struct {
+	Prefix      string // without a trailing slash
+	Upstream    *Upstream
+	StripPrefix bool              // remove Prefix from the path sent upstream
+	Headers     map[string]string // set on the request sent upstream
+	Auth        bool              // require one of GATEWAY_API_KEYS
+	Sticky      bool              // keep each client on one endpoint
+
+	proxy   *httputil.ReverseProxy
+	metrics *Metrics
+}
+
+// proxyRouteSpec is how a route is written in GATEWAY_ROUTES_FILE.
+type proxyRouteSpec struct {
+	Path        string            `json:"path"`
+	Upstream    string            `json:"upstream"`
+	StripPrefix bool              `json:"strip_prefix"`
+	Headers     map[string]string `json:"headers"`
+	Auth        bool              `json:"auth"`
+	Sticky      bool              `json:"sticky"`
+}
+
+// gatewayFile is the format of GATEWAY_ROUTES_FILE.
+type gatewayFile struct {
+	Routes []proxyRouteSpec `json:"routes"`
+}
+
+// Proxy holds the routes and forwards requests that match one.
+type Proxy struct {
+	routes  []*ProxyRoute // longest prefix first
+	inline  []*Upstream   // upstreams written in place in a route
+	metrics *Metrics
+}
+
+// parseProxyRoutes parses the PROXY_ROUTES setting, a list of
+// prefix=upstream.
+func parseProxyRoutes(entries []string) ([]proxyRouteSpec, error) {
+	var specs []proxyRouteSpec
+	for _, entry := range entries {
+		prefix, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not prefix=upstream", entry)
+		}
+		specs = append(specs, proxyRouteSpec{Path: prefix, Upstream: target})
+	}
+	return specs, nil
+}
+
+// readGatewayFile reads the routes in a GATEWAY_ROUTES_FILE. Unknown
+// fields are an error, so a misspelt "strip_prefx" doesn't go unnoticed.
+func readGatewayFile(path string) ([]proxyRouteSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var file gatewayFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Routes, nil
+}
+
+// loadProxyRoutes builds the routes from PROXY_ROUTES and
+// GATEWAY_ROUTES_FILE. A route's upstream is a name from ups or a target;
+// upstreams written in place are returned too, so they can be refreshed
+// like the others, and one in previous with the same name and target is
+// reused, keeping its endpoints across a reload.
+func loadProxyRoutes(cfg Config, ups, previous []*Upstream) ([]*ProxyRoute, []*Upstream, error) {
+	specs, err := parseProxyRoutes(cfg.ProxyRoutes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.GatewayRoutesFile != "" {
+		fromFile, err := readGatewayFile(cfg.GatewayRoutesFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		specs = append(specs, fromFile...)
+	}
+
+	var routes []*ProxyRoute
+	var inline []*Upstream
+	for _, spec := range specs {
+		prefix := strings.TrimSuffix(spec.Path, "/")
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, nil, fmt.Errorf("route %q: the path must start with / and can't be / alone", spec.Path)
+		}
+		if slices.ContainsFunc(routes, func(r *ProxyRoute) bool { return r.Prefix == prefix }) {
+			return nil, nil, fmt.Errorf("path %q is routed twice", prefix)
+		}
+		for name := range spec.Headers {
+			if name == "" || strings.ContainsAny(name, " :\r\n") {
+				return nil, nil, fmt.Errorf("route %q: %q is not a valid header name", prefix, name)
+			}
+		}
+		if spec.Auth && len(cfg.GatewayAPIKeys) == 0 {
+			return nil, nil, fmt.Errorf("route %q needs an API key, but GATEWAY_API_KEYS is empty", prefix)
+		}
+
+		var up *Upstream
+		if i := slices.IndexFunc(ups, func(u *Upstream) bool { return u.Name == spec.Upstream }); i >= 0 {
+			up = ups[i]
+		} else if i := slices.IndexFunc(previous, func(u *Upstream) bool { return u.Name == prefix && u.Target == spec.Upstream }); i >= 0 {
+			up = previous[i]
+			inline = append(inline, up)
+		} else {
+			if up, err = parseUpstream(prefix, spec.Upstream); err != nil {
+				return nil, nil, fmt.Errorf("route %q: not a name from UPSTREAMS, and %w", prefix, err)
+			}
+			inline = append(inline, up)
+		}
+		routes = append(routes, &ProxyRoute{
+			Prefix:      prefix,
+			Upstream:    up,
+			StripPrefix: spec.StripPrefix,
+			Headers:     spec.Headers,
+			Auth:        spec.Auth,
+			Sticky:      spec.Sticky,
+		})
+	}
+	return routes, inline, nil
+}
+
+// newProxy creates a proxy for the routes, or returns nil if there are
+// none.
+func newProxy(routes []*ProxyRoute, inline []*Upstream, timeout time.Duration, retries int, metrics *Metrics) *Proxy {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	// The default transport, but with bounded connecting and waiting.
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = (&net.Dialer{Timeout: proxyDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	base.ResponseHeaderTimeout = timeout
+
+	p := &Proxy{routes: slices.Clone(routes), inline: inline, metrics: metrics}
+	slices.SortFunc(p.routes, func(a, b *ProxyRoute) int { return cmp.Compare(len(b.Prefix), len(a.Prefix)) })
+	for _, route := range p.routes {
+		route.metrics = metrics
+		route.proxy = &httputil.ReverseProxy{
+			Rewrite:        route.rewrite,
+			Transport:      &retryTransport{base: base, upstream: route.Upstream, retries: retries, metrics: metrics},
+			ModifyResponse: route.modifyResponse,
+			ErrorHandler:   route.handleError,
+		}
+	}
+	return p
+}
+
+// match returns the route for a path, if any.
+func (p *Proxy) match(path string) (*ProxyRoute, bool) {
+	for _, route := range p.routes {
+		if path == route.Prefix || strings.HasPrefix(path, route.Prefix+"/") {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// rewrite turns the incoming request into the one sent upstream.
+func (route *ProxyRoute) rewrite(pr *httputil.ProxyRequest) {
+	if route.StripPrefix {
+		out := pr.Out.URL
+		out.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(out.Path, route.Prefix), "/")
+		out.RawPath = ""
+	}
+	endpoint, _ := pr.In.Context().Value(proxyEndpointContextKey).(*url.URL)
+	pr.SetURL(endpoint)
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Forwarded-Prefix", route.Prefix)
+	pr.Out.Header.Add("Via", proxyVia)
+	if id := requestIDFromContext(pr.In.Context()); id != "" {
+		pr.Out.Header.Set(requestIDHeader, id)
+	}
+	injectTrace(pr.In.Context(), pr.Out.Header)
+	if route.Auth {
+		pr.Out.Header.Del("Authorization")
+	}
+	if route.Sticky {
+		removeCookie(pr.Out.Header, affinityCookie)
+	}
+	for name, value := range route.Headers {
+		pr.Out.Header.Set(name, value)
+	}
+}
+
+// modifyResponse adjusts the upstream's response headers. The request ID
+// was already set by our middleware, and would otherwise be repeated.
+func (route *ProxyRoute) modifyResponse(resp *http.Response) error {
+	resp.Header.Add("Via", proxyVia)
+	resp.Header.Del(requestIDHeader)
+	if route.Sticky {
+		route.pinClient(resp)
+	}
+	return nil
+}
+
+// handleError answers when no response came back from the upstream: 504
+// if it timed out, 502 otherwise.
+func (route *ProxyRoute) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+	slog.WarnContext(r.Context(), "Proxy request failed", "upstream", route.Upstream.Name, "path", r.URL.Path, "error", err)
+	writeProblem(w, status, fmt.Sprintf("upstream %s did not answer", route.Upstream.Name))
+}
+
+// serve forwards a request to one of the route's endpoints and records the
+// outcome.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, route *ProxyRoute) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		p.metrics.ObserveProxy(proxyLabels{Upstream: route.Upstream.Name, Status: strconv.Itoa(rec.status)}, time.Since(start))
+	}()
+
+	var affinity string
+	if route.Sticky {
+		if c, err := r.Cookie(affinityCookie); err == nil {
+			affinity = c.Value
+		}
+		r = r.WithContext(context.WithValue(r.Context(), proxyAffinityContextKey, affinity))
+	}
+	endpoint, err := route.Upstream.PickPreferring(affinity)
+	if err != nil {
+		if errors.Is(err, errCircuitOpen) {
+			rec.Header().Set("Retry-After", "5")
+		}
+		writeProblem(rec, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	ctx := context.WithValue(r.Context(), proxyEndpointContextKey, endpoint)
+	route.proxy.ServeHTTP(rec, r.WithContext(ctx))
+}
+
+// retryTransport sends a request, trying other endpoints of the upstream
+// when that's safe and worth it.
+type retryTransport struct {
+	base     http.RoundTripper
+	upstream *Upstream
+	retries  int
+	metrics  *Metrics
+}
+
+// RoundTrip sends the request, retrying up to t.retries times. Each
+// attempt is reported to the upstream's balancer (see balancer.go).
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		endpoint := req.URL
+		start := time.Now()
+		resp, err := t.base.RoundTrip(req)
+		addServerTiming(req.Context(), "upstream", time.Since(start))
+		// A client that gave up says nothing about the endpoint.
+		failed := req.Context().Err() == nil && (err != nil || upstreamFailed(resp.StatusCode))
+
+		if attempt == t.retries || !shouldRetry(req, resp, err) {
+			if err != nil {
+				t.upstream.Done(endpoint, failed)
+				return nil, err
+			}
+			resp.Body = &doneBody{ReadCloser: resp.Body, done: func() { t.upstream.Done(endpoint, failed) }}
+			return resp, nil
+		}
+
+		t.upstream.Done(endpoint, failed)
+		next, pickErr := t.upstream.Pick()
+		if pickErr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		slog.WarnContext(req.Context(), "Retrying proxy request", "upstream", t.upstream.Name, "failed", req.URL.Host, "next", next.Host, "attempt", attempt+1)
+		t.metrics.ObserveProxyRetry(t.upstream.Name)
+
+		// A RoundTripper must not modify the request it's given.
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = next.Scheme, next.Host
+	}
+}
+
+// shouldRetry reports whether a request that got resp or err is worth
+// sending again.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// The client gave up, so nobody would get the answer.
+	if req.Context().Err() != nil {
+		return false
+	}
+	// A body has been read by the first attempt, so can't be sent again.
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return err != nil || upstreamFailed(resp.StatusCode)
+}
+
+// upstreamFailed reports whether a status code means the upstream, rather
+// than the request, is the problem.
+func upstreamFailed(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// proxyRouteContextKey holds the proxy route a request matched.
+const proxyRouteContextKey contextKey = "proxy-route"
+
+// authMiddleware turns away requests to proxy routes that need an API key
+// and don't have one, or a gateway token this server issued (see jwt.go).
+func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, _ := r.Context().Value(proxyRouteContextKey).(*ProxyRoute)
+		if route != nil && route.Auth && !authorized(r, s.config().GatewayAPIKeys) && !s.hasGatewayJWT(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-hello-devops"`)
+			writeProblem(w, http.StatusUnauthorized, "this route needs an API key or a token, sent as Authorization: Bearer <key>")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasGatewayJWT reports whether a request carries a gateway token. Users'
+// tokens aren't enough: anyone can register.
+func (s *Server) hasGatewayJWT(r *http.Request) bool {
+	_, ok := s.bearerJWT(r, jwtAudienceGateway)
+	return ok
+}
+
+// authorized reports whether a request carries one of the gateway's API
+// keys. The comparison takes the same time however much of a key matches,
+// so the time taken doesn't give away how close a guess was.
+func authorized(r *http.Request, keys []string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadProxy rebuilds the routes from cfg and swaps them in. Upstreams
+// new to the routes are looked up first, so they have endpoints as soon as
+// they're used.
+func (s *Server) reloadProxy(ctx context.Context, cfg Config) error {
+	var previous []*Upstream
+	if old := s.proxy.Load(); old != nil {
+		previous = old.inline
+	}
+	routes, inline, err := loadProxyRoutes(cfg, s.upstreams, previous)
+	if err != nil {
+		return err
+	}
+	for _, u := range inline {
+		if !slices.Contains(previous, u) {
+			u.setBalancing(s.balancing(cfg))
+		}
+		if len(u.Endpoints()) == 0 {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := u.Refresh(ctx, s.dns); err != nil {
+				slog.Warn("Upstream lookup failed", "upstream", u.Name, "target", u.Target, "error", err)
+			}
+			cancel()
+		}
+	}
+	s.proxy.Store(newProxy(routes, inline, cfg.ProxyTimeout, cfg.ProxyRetries, s.metrics))
+	slog.Info("Proxy routes loaded", "routes", len(routes))
+	return nil
+}
+
+// balancing returns the balancing settings in cfg, with circuit breaker
+// changes reported to the admin event feed (see adminevents.go) and
+// timing taken from the server's clock.
+func (s *Server) balancing(cfg Config) balancing {
+	b := balancingFromConfig(cfg)
+	b.onCircuit = s.circuitChanged
+	b.clock = func() time.Time { return s.clock.Now() }
+	return b
+}
+
+// proxyRouter sends requests that match a proxy route upstream, and
+// everything else to next. It wraps the router, like startupGate, because
+// the prefixes can change when the configuration is reloaded.
+func (s *Server) proxyRouter(next http.Handler) http.Handler {
+	chain := s.chain(proxyGroup)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy := s.proxy.Load()
+		var route *ProxyRoute
+		ok := false
+		if proxy != nil {
+			route, ok = proxy.match(r.URL.Path)
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := func(w http.ResponseWriter, r *http.Request) {
+			proxy.serve(w, r, route)
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			h = chain[i].wrap(h)
+		}
+		// The route, for metrics and logs, and for auth.
+		r.Pattern = route.Prefix + "/"
+		h(w, r.WithContext(context.WithValue(r.Context(), proxyRouteContextKey, route)))
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newProxyServer returns a server with the given PROXY_ROUTES, and its
+// handler built the way serve() builds it.
+func newProxyServer(t *testing.T, routes ...string) (*Server, http.Handler) {
+	cfg := defaultConfig(t)
+	cfg.ProxyRoutes = routes
+	cfg.ProxyTimeout, cfg.ProxyRetries = time.Second, 2
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	return s, s.proxyRouter(s.routes())
+}
+
+// writeGatewayFile writes a GATEWAY_ROUTES_FILE and returns its path.
+func writeGatewayFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "routes.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadProxyRoutes checks route parsing and validation.
+func TestLoadProxyRoutes(t *testing.T) {
+	ups, _ := parseUpstreams([]string{"users=http://users:8080"})
+	cfg := Config{ProxyRoutes: []string{"/users/=users", "/status=http://status:9000"}}
+	routes, inline, err := loadProxyRoutes(cfg, ups, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].Prefix != "/users" || routes[0].Upstream != ups[0] {
+		t.Errorf("Unexpected routes %+v", routes)
+	}
+	if len(inline) != 1 || inline[0].Name != "/status" {
+		t.Errorf("Expected the inline target to become an upstream, got %+v", inline)
+	}
+
+	// Reloading keeps inline upstreams that haven't changed.
+	_, again, err := loadProxyRoutes(cfg, ups, inline)
+	if err != nil || again[0] != inline[0] {
+		t.Errorf("Expected the inline upstream to be reused, got %v, %v", again, err)
+	}
+
+	for _, bad := range [][]string{
+		{"/users"},
+		{"users=users"},
+		{"/=users"},
+		{"/users=nobody"},
+		{"/users=users", "/users/=users"},
+	} {
+		if _, _, err := loadProxyRoutes(Config{ProxyRoutes: bad}, ups, nil); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, bad := range []string{
+		`{"routes": [{"path": "/a", "upstream": "users", "strip_prefx": true}]}`,
+		`{"routes": [{"path": "/a", "upstream": "users", "auth": true}]}`,
+		`{"routes": [{"path": "/a", "upstream": "users", "headers": {"Bad Name": "x"}}]}`,
+		`{"routes": [`,
+	} {
+		cfg := Config{GatewayRoutesFile: writeGatewayFile(t, dir, bad)}
+		if _, _, err := loadProxyRoutes(cfg, ups, nil); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+	if _, _, err := loadProxyRoutes(Config{GatewayRoutesFile: filepath.Join(dir, "missing.json")}, ups, nil); err == nil {
+		t.Error("Expected a missing routes file to be an error")
+	}
+}
+
+// TestGatewayRoutes checks the options of routes from the routes file, and
+// that editing the file and reloading changes them.
+func TestGatewayRoutes(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	cfg := defaultConfig(t)
+	cfg.GatewayAPIKeys = []string{"k3y"}
+	cfg.GatewayRoutesFile = writeGatewayFile(t, dir, `{"routes": [
+		{"path": "/users", "upstream": "`+upstream.URL+`", "strip_prefix": true,
+		 "headers": {"X-Gateway": "yes"}, "auth": true}
+	]}`)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	h := s.proxyRouter(s.routes())
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, key := range []string{"", "wrong"} {
+		if rec := get("/users/42", key); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Key %q: expected 401 with WWW-Authenticate, got %d", key, rec.Code)
+		}
+	}
+
+	rec := get("/users/42", "k3y")
+	if rec.Code != http.StatusOK || rec.Body.String() != "/42" {
+		t.Fatalf("Expected the prefix to be stripped, got %d %q", rec.Code, rec.Body)
+	}
+	if got.Header.Get("X-Gateway") != "yes" || got.Header.Get("Authorization") != "" {
+		t.Errorf("Expected the added header and no API key upstream, got %v", got.Header)
+	}
+	token, _ := s.issueJWT(defaultTenant, jwtAudienceGateway, "alice", time.Minute)
+	if rec := get("/users/42", token); rec.Code != http.StatusOK {
+		t.Errorf("Expected a token to be accepted instead of a key, got %d", rec.Code)
+	}
+	// Anyone can register and sign in, so users' tokens don't count, nor
+	// do another tenant's.
+	userToken, _ := s.issueJWT(defaultTenant, jwtAudienceUser, "alice", time.Minute)
+	otherToken, _ := s.issueJWT("other", jwtAudienceGateway, "alice", time.Minute)
+	for _, token := range []string{userToken, otherToken} {
+		if rec := get("/users/42", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a user's or another tenant's token to be refused, got %d", rec.Code)
+		}
+	}
+	if rec := get("/users", "k3y"); rec.Body.String() != "/" {
+		t.Errorf("Expected the bare prefix to become /, got %q", rec.Body)
+	}
+
+	// Move the route and drop the key requirement, then reload.
+	cfg.GatewayRoutesFile = writeGatewayFile(t, dir, `{"routes": [{"path": "/people", "upstream": "`+upstream.URL+`"}]}`)
+	if err := s.reloadProxy(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/people/42", ""); rec.Code != http.StatusOK || rec.Body.String() != "/people/42" {
+		t.Errorf("Expected the new route to be used, got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get("/users/42", "k3y"); rec.Body.String() == "/42" {
+		t.Error("Expected the old route to be gone")
+	}
+}
+
+// TestProxyForwards checks requests under the prefix reach the upstream
+// with the forwarding headers, and others don't.
+func TestProxyForwards(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set(requestIDHeader, "from-upstream")
+		io.WriteString(w, "hello from upstream")
+	}))
+	defer upstream.Close()
+
+	s, h := newProxyServer(t, "/svc="+upstream.URL)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/svc/items?page=2", nil)
+	req.Header.Set(requestIDHeader, "abc123")
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello from upstream" {
+		t.Fatalf("Expected the upstream's response, got %d %q", rec.Code, rec.Body)
+	}
+	if got.URL.Path != "/svc/items" || got.URL.RawQuery != "page=2" {
+		t.Errorf("Expected the path and query to be kept, got %s", got.URL)
+	}
+	if got.Header.Get("X-Forwarded-Prefix") != "/svc" || got.Header.Get("X-Forwarded-Host") != "example.com" || got.Header.Get("Via") != proxyVia {
+		t.Errorf("Missing forwarding headers: %v", got.Header)
+	}
+	if got.Header.Get(requestIDHeader) != "abc123" {
+		t.Errorf("Expected the request ID to be passed on, got %q", got.Header.Get(requestIDHeader))
+	}
+	if ids := rec.Header().Values(requestIDHeader); len(ids) != 1 || ids[0] != "abc123" {
+		t.Errorf("Expected one request ID in the response, got %v", ids)
+	}
+	if rec.Header().Get("Via") != proxyVia {
+		t.Errorf("Expected a Via header in the response, got %v", rec.Header())
+	}
+
+	var metrics strings.Builder
+	s.metrics.WriteTo(&metrics)
+	if !strings.Contains(metrics.String(), `proxy_requests_total{upstream="/svc",status="200"} 1`) {
+		t.Errorf("Expected the request in the metrics, got:\n%s", metrics.String())
+	}
+
+	// Paths that only share the prefix's letters aren't proxied.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/svcs", nil))
+	if rec.Body.String() == "hello from upstream" {
+		t.Error("Expected /svcs not to be proxied")
+	}
+}
+
+// TestProxyRetries checks an idempotent request moves on to a working
+// endpoint, and that a POST isn't repeated.
+func TestProxyRetries(t *testing.T) {
+	var bad atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bad.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer working.Close()
+
+	s, h := newProxyServer(t, "/svc=http://placeholder")
+	route, _ := s.proxy.Load().match("/svc")
+	failingURL, _ := url.Parse(failing.URL)
+	workingURL, _ := url.Parse(working.URL)
+	route.Upstream.endpoints = []*url.URL{failingURL, workingURL}
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/svc/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected the retry to reach the working endpoint, got %d", rec.Code)
+		}
+	}
+
+	bad.Store(0)
+	failures := 0
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/svc/", strings.NewReader("{}")))
+		if rec.Code == http.StatusServiceUnavailable {
+			failures++
+		}
+	}
+	if failures != 1 || bad.Load() != 1 {
+		t.Errorf("Expected the POST to the failing endpoint not to be retried, got %d failures, %d attempts", failures, bad.Load())
+	}
+
+	var metrics strings.Builder
+	s.metrics.WriteTo(&metrics)
+	if !strings.Contains(metrics.String(), `proxy_retries_total{upstream="/svc"}`) {
+		t.Errorf("Expected retries in the metrics, got:\n%s", metrics.String())
+	}
+}
+
+// TestProxyErrors checks the answers when the upstream can't be reached
+// or is too slow.
+func TestProxyErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	_, h := newProxyServer(t, "/slow="+slow.URL, "/down="+closed.URL)
+	for path, want := range map[string]int{"/slow/": http.StatusGatewayTimeout, "/down/": http.StatusBadGateway} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// This file implements the background job that purges deleted notes.
+//
+// Deleting a note only marks it as deleted (a "soft delete"), so a mistake
+// can be undone with POST /api/v1/notes/{id}/restore. Keeping tombstones
+// forever would let the store grow without bound, though, so once they're
+// older than DELETED_NOTE_RETENTION they're removed for good.
+
+// purgeDeletedNotes runs purgeOnce every interval until ctx is cancelled.
+// Running it in the server process is the simplest kind of scheduled job.
+// With several replicas each would run it, which is harmless here: purging
+// twice removes nothing the second time.
+func (s *Server) purgeDeletedNotes(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.purgeOnce(s.clock.Now())
+	}
+}
+
+// purgeOnce removes the notes deleted more than the retention period before
+// now. The retention is read on every run, so a reload takes effect at the
+// next one.
+func (s *Server) purgeOnce(now time.Time) int {
+	retention := s.config().DeletedNoteRetention
+	purged := s.store.PurgeDeleted(now.Add(-retention))
+	if purged > 0 {
+		slog.Info("purged deleted notes", "count", purged, "retention", retention)
+	}
+	return purged
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPurgeOnce checks only tombstones older than the retention period are
+// removed.
+func TestPurgeOnce(t *testing.T) {
+	srv := newServer(Config{DeletedNoteRetention: time.Hour})
+	kept := srv.store.CreateNote("acme", "Kept", "")
+	deleted := srv.store.CreateNote("acme", "Deleted", "")
+	if err := srv.store.DeleteNote("acme", deleted.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.purgeOnce(time.Now()); got != 0 {
+		t.Errorf("Expected a fresh tombstone to be kept, purged %d", got)
+	}
+	if got := srv.purgeOnce(time.Now().Add(2 * time.Hour)); got != 1 {
+		t.Errorf("Expected 1 note purged, got %d", got)
+	}
+
+	notes := srv.store.ListNotesWithDeleted("acme")
+	if len(notes) != 1 || notes[0].ID != kept.ID {
+		t.Errorf("Expected only the live note to remain, got %+v", notes)
+	}
+}
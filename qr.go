@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// This file implements GET /api/v1/qr, which returns a QR code as a PNG
+// image. Most endpoints answer with JSON or HTML, which are text; this one
+// shows how a handler sends binary data instead: build the bytes, then set
+// Content-Type (and Content-Length) to say exactly what they are.
+//
+// The QR encoder below is written from scratch following the ISO/IEC 18004
+// standard, since the standard library doesn't have one. It supports byte
+// mode (any UTF-8 text) and versions 1 to 10 (21x21 to 57x57 modules),
+// which is enough for a URL or a short message: up to 271 bytes at level L.
+// The steps are:
+//  1. encode the text as a bit stream and pad it to the version's capacity.
+//  2. add Reed-Solomon error correction codewords, which let a scanner
+//     rebuild up to 7-30% of the code (depending on the level) if it's
+//     damaged or dirty.
+//  3. draw the fixed patterns (the three big squares, timing lines...) and
+//     the data onto the grid, then apply the "mask" that gives the most
+//     scanner-friendly result.
+
+// qrLevel is an error correction level.
+type qrLevel int
+
+const (
+	qrLevelL qrLevel = iota // recovers ~7% of the code
+	qrLevelM                // ~15%
+	qrLevelQ                // ~25%
+	qrLevelH                // ~30%
+)
+
+// parseQRLevel reads a level name.
+func parseQRLevel(s string) (qrLevel, bool) {
+	i := strings.Index("LMQH", strings.ToUpper(s))
+	if len(s) != 1 || i < 0 {
+		return 0, false
+	}
+	return qrLevel(i), true
+}
+
+// formatBits are the level's two bits in the format information.
+func (l qrLevel) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+// qrBlocks describes how a version's codewords are split into blocks at one
+// level: ecLen error correction codewords per block, and blocks of dataLen
+// data codewords followed by blocks2 of dataLen+1.
+type qrBlocks struct {
+	ecLen, blocks1, dataLen, blocks2 int
+}
+
+// qrBlockTable is indexed by version-1 and level (table 9 of the standard).
+var qrBlockTable = [10][4]qrBlocks{
+	{{7, 1, 19, 0}, {10, 1, 16, 0}, {13, 1, 13, 0}, {17, 1, 9, 0}},
+	{{10, 1, 34, 0}, {16, 1, 28, 0}, {22, 1, 22, 0}, {28, 1, 16, 0}},
+	{{15, 1, 55, 0}, {26, 1, 44, 0}, {18, 2, 17, 0}, {22, 2, 13, 0}},
+	{{20, 1, 80, 0}, {18, 2, 32, 0}, {26, 2, 24, 0}, {16, 4, 9, 0}},
+	{{26, 1, 108, 0}, {24, 2, 43, 0}, {18, 2, 15, 2}, {22, 2, 11, 2}},
+	{{18, 2, 68, 0}, {16, 4, 27, 0}, {24, 4, 19, 0}, {28, 4, 15, 0}},
+	{{20, 2, 78, 0}, {18, 4, 31, 0}, {18, 2, 14, 4}, {26, 4, 13, 1}},
+	{{24, 2, 97, 0}, {22, 2, 38, 2}, {22, 4, 18, 2}, {26, 4, 14, 2}},
+	{{30, 2, 116, 0}, {22, 3, 36, 2}, {20, 4, 16, 4}, {24, 4, 12, 4}},
+	{{18, 2, 68, 2}, {26, 4, 43, 1}, {24, 6, 19, 2}, {28, 6, 15, 2}},
+}
+
+// qrMaxVersion is the largest version in qrBlockTable.
+const qrMaxVersion = len(qrBlockTable)
+
+// dataCodewords is the number of data codewords the blocks hold.
+func (b qrBlocks) dataCodewords() int {
+	return b.blocks1*b.dataLen + b.blocks2*(b.dataLen+1)
+}
+
+// qrCapacity is the most bytes of text a version holds at a level: the
+// data codewords less the 4-bit mode and the 8- or 16-bit length.
+func qrCapacity(version int, level qrLevel) int {
+	return (qrBlockTable[version-1][level].dataCodewords()*8 - 4 - qrCountBits(version)) / 8
+}
+
+// qrCountBits is the size of the byte-mode length field.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// errQRTooLong is returned for text that doesn't fit the largest version.
+var errQRTooLong = errors.New("text is too long for a QR code")
+
+// QRCode is an encoded QR symbol: a square grid of dark and light modules.
+type QRCode struct {
+	size     int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // marks modules that aren't data: patterns and format
+}
+
+// Size is the number of modules along each side.
+func (q *QRCode) Size() int { return q.size }
+
+// Dark reports whether the module at column x, row y is dark.
+func (q *QRCode) Dark(x, y int) bool { return q.modules[y][x] }
+
+// encodeQR encodes text in the smallest version that fits at the level.
+func encodeQR(text []byte, level qrLevel) (*QRCode, error) {
+	version := 1
+	for version <= qrMaxVersion && len(text) > qrCapacity(version, level) {
+		version++
+	}
+	if version > qrMaxVersion {
+		return nil, fmt.Errorf("%w: at most %d bytes at this level", errQRTooLong, qrCapacity(qrMaxVersion, level))
+	}
+
+	blocks := qrBlockTable[version-1][level]
+	data := qrDataCodewords(text, version, blocks.dataCodewords())
+	codewords := qrInterleave(data, blocks)
+
+	size := version*4 + 17
+	q := &QRCode{size: size, modules: qrGrid(size), function: qrGrid(size)}
+	q.drawFunctionPatterns(version, level)
+	q.drawCodewords(codewords)
+
+	// Try all eight masks and keep the one with the lowest penalty.
+	// Masking is its own inverse, so applying a mask twice undoes it.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+	return q, nil
+}
+
+// qrGrid allocates a size x size grid.
+func qrGrid(size int) [][]bool {
+	grid := make([][]bool, size)
+	for i := range grid {
+		grid[i] = make([]bool, size)
+	}
+	return grid
+}
+
+// qrBits accumulates a bit stream.
+type qrBits []bool
+
+// append adds the low n bits of v, most significant first.
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 == 1)
+	}
+}
+
+// qrDataCodewords builds the data codewords: the mode, the length, the text,
+// then a terminator and padding up to the capacity.
+func qrDataCodewords(text []byte, version, capacity int) []byte {
+	var bits qrBits
+	bits.append(0b0100, 4) // byte mode
+	bits.append(len(text), qrCountBits(version))
+	for _, c := range text {
+		bits.append(int(c), 8)
+	}
+
+	bits.append(0, min(4, capacity*8-len(bits))) // terminator
+	bits.append(0, (8-len(bits)%8)%8)            // up to a whole byte
+	for pad := 0; len(bits) < capacity*8; pad ^= 1 {
+		bits.append([]int{0xEC, 0x11}[pad], 8) // alternate pad bytes
+	}
+
+	data := make([]byte, capacity)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return data
+}
+
+// qrInterleave splits the data into blocks, adds each block's error
+// correction, and interleaves the blocks: the first codeword of every
+// block, then the second, and so on. Spreading each block across the
+// symbol means a smudge in one spot damages several blocks a little rather
+// than one block beyond repair.
+func qrInterleave(data []byte, b qrBlocks) []byte {
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < b.blocks1+b.blocks2; i++ {
+		n := b.dataLen
+		if i >= b.blocks1 {
+			n++
+		}
+		dataBlocks = append(dataBlocks, data[:n])
+		ecBlocks = append(ecBlocks, reedSolomon(data[:n], b.ecLen))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i <= b.dataLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ecLen; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies two elements of GF(256), the field QR codes compute
+// error correction in, with the reducing polynomial x^8+x^4+x^3+x^2+1.
+func gfMul(a, b byte) byte {
+	var p byte
+	for ; b > 0; b >>= 1 {
+		if b&1 == 1 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1D
+		}
+	}
+	return p
+}
+
+// reedSolomon returns n error correction codewords for data: the remainder
+// of dividing the data polynomial by the generator (x-1)(x-2)(x-4)...
+func reedSolomon(data []byte, n int) []byte {
+	// Build the generator's coefficients (leading 1 left out).
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+
+	// Polynomial long division, keeping only the remainder.
+	rem := make([]byte, n)
+	for _, d := range data {
+		factor := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := range rem {
+			rem[j] ^= gfMul(gen[j], factor)
+		}
+	}
+	return rem
+}
+
+// set sets a function module.
+func (q *QRCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws everything that isn't data.
+func (q *QRCode) drawFunctionPatterns(version int, level qrLevel) {
+	// Timing patterns: alternating modules along row and column 6.
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns: the big squares in three corners, with a light
+	// border separating them from the data.
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns: small squares that help scanners with curved or
+	// tilted codes. None overlap the finder patterns.
+	pos := qrAlignmentPositions(version)
+	for i, y := range pos {
+		for j, x := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas now; the real bits are drawn once the mask
+	// is chosen.
+	q.drawFormatBits(level, 0)
+
+	// Version 7 and up also record the version number, twice.
+	if version >= 7 {
+		bits := qrVersionBits(version)
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// qrVersionBits is the version number followed by its 12-bit BCH code.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	return version<<12 | rem
+}
+
+// qrAlignmentPositions returns the rows (and columns) of the alignment
+// pattern centres.
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*4 + 4 + n*2 - 3) / (n*2 - 2) * 2 // rounded up to an even number
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, version*4+10; i > 0; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// qrFormatBits is the level and mask followed by their 10-bit BCH code,
+// XORed with a fixed pattern so the result is never all light.
+func qrFormatBits(level qrLevel, mask int) int {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// drawFormatBits draws both copies of the format information.
+func (q *QRCode) drawFormatBits(level qrLevel, mask int) {
+	bits := qrFormatBits(level, mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	// Around the top-left finder.
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	// Split between the other two finders.
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // the "dark module", always dark
+}
+
+// drawCodewords fills the data modules in the standard zigzag: two columns
+// at a time from the right, alternately upwards and downwards.
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] || i >= len(codewords)*8 {
+					continue // any leftover modules stay light
+				}
+				q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by one of the eight mask
+// patterns. Masks break up large blank areas and shapes that look like the
+// finder patterns, which could confuse a scanner.
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol would be to scan, using the four
+// rules of the standard. Lower is better.
+func (q *QRCode) penalty() int {
+	p := 0
+	n := q.size
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			// Rule 1: runs of five or more modules of one colour.
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// Rule 3: patterns that look like a finder (1:1:3:1:1) with
+			// four light modules on one side.
+			for x := 0; x+11 <= n; x++ {
+				var line [11]bool
+				for k := range line {
+					line[k] = at(x+k, y, vertical)
+				}
+				if line == qrFinderLike || line == qrFinderLikeReversed {
+					p += 40
+				}
+			}
+		}
+	}
+
+	// Rule 2: 2x2 blocks of one colour.
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: 10 points for every 5% the dark share is away from half.
+	total := n * n
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+// The finder-like patterns penalized by rule 3.
+var (
+	qrFinderLike         = [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+	qrFinderLikeReversed = [11]bool{false, false, false, false, true, false, true, true, true, false, true}
+)
+
+// abs returns the absolute value of an int.
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Limits for the QR endpoint's size parameter, in pixels.
+const (
+	defaultQRSize = 256
+	maxQRSize     = 2048
+)
+
+// qrQuietZone is the light border scanners need around a code, in modules.
+const qrQuietZone = 4
+
+// renderQRPNG draws the code as a black and white PNG about size pixels
+// wide. Every module becomes a square of whole pixels (scaling by a
+// fraction would blur the edges), so the image may be a little smaller.
+func renderQRPNG(q *QRCode, size int) ([]byte, error) {
+	modules := q.Size() + 2*qrQuietZone
+	scale := max(1, size/modules)
+
+	// A two-colour palette keeps the file tiny.
+	img := image.NewPaletted(image.Rect(0, 0, modules*scale, modules*scale), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size(); y++ {
+		for x := 0; x < q.Size(); x++ {
+			if !q.Dark(x, y) {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				row := (y+qrQuietZone)*scale + py
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+px, row, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleQRCode returns a QR code for the text parameter. Optional
+// parameters are size (the image width in pixels) and ecc (the error
+// correction level: L, M, Q or H).
+func handleQRCode(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	text := query.Get("text")
+	if text == "" {
+		writeProblem(w, http.StatusBadRequest, "the text parameter is required")
+		return
+	}
+
+	size := defaultQRSize
+	if v := query.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxQRSize {
+			writeProblem(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d", maxQRSize))
+			return
+		}
+		size = n
+	}
+
+	level := qrLevelM
+	if v := query.Get("ecc"); v != "" {
+		var ok bool
+		if level, ok = parseQRLevel(v); !ok {
+			writeProblem(w, http.StatusBadRequest, "ecc must be L, M, Q or H")
+			return
+		}
+	}
+
+	code, err := encodeQR([]byte(text), level)
+	if err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	img, err := renderQRPNG(code, size)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, "failed to encode image")
+		return
+	}
+
+	// Binary responses need an exact Content-Type, since there's nothing
+	// for a client to guess from. The same URL always gives the same
+	// image, so it can be cached for a long time.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(img)
+}
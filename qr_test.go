@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestReedSolomon checks the error correction against the worked example
+// for "HELLO WORLD" at version 1-M.
+func TestReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomon(data, 10); !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// TestQRFormatAndVersionBits compares against values from the standard's
+// tables.
+func TestQRFormatAndVersionBits(t *testing.T) {
+	formats := map[qrLevel]int{
+		qrLevelL: 0b111011111000100,
+		qrLevelM: 0b101010000010010,
+		qrLevelQ: 0b011010101011111,
+		qrLevelH: 0b001011010001001,
+	}
+	for level, want := range formats {
+		if got := qrFormatBits(level, 0); got != want {
+			t.Errorf("Format bits for level %d mask 0: expected %015b, got %015b", level, want, got)
+		}
+	}
+	if got := qrVersionBits(7); got != 0x07C94 {
+		t.Errorf("Version 7 bits: expected %x, got %x", 0x07C94, got)
+	}
+}
+
+// TestQRBlockTable checks every version's blocks add up to the number of
+// codewords its grid has room for.
+func TestQRBlockTable(t *testing.T) {
+	for version := 1; version <= qrMaxVersion; version++ {
+		// The number of data modules, from the size of the grid less
+		// the function patterns.
+		modules := (16*version+128)*version + 64
+		if version >= 2 {
+			n := version/7 + 2
+			modules -= (25*n-10)*n - 55
+			if version >= 7 {
+				modules -= 36
+			}
+		}
+		for level, b := range qrBlockTable[version-1] {
+			total := b.dataCodewords() + (b.blocks1+b.blocks2)*b.ecLen
+			if total != modules/8 {
+				t.Errorf("Version %d level %d: blocks hold %d codewords, grid has %d", version, level, total, modules/8)
+			}
+		}
+	}
+}
+
+// readQRCodewords reads the codewords back out of a finished symbol by
+// undoing the mask named in its format bits, the way a scanner would.
+func readQRCodewords(t *testing.T, q *QRCode) []byte {
+	t.Helper()
+	var format int
+	for i := 0; i < 8; i++ {
+		if q.Dark(q.size-1-i, 8) {
+			format |= 1 << i
+		}
+	}
+	for i := 8; i < 15; i++ {
+		if q.Dark(8, q.size-15+i) {
+			format |= 1 << i
+		}
+	}
+	mask := (format ^ 0x5412) >> 10 & 7
+
+	q.applyMask(mask)
+	defer q.applyMask(mask)
+
+	var bits qrBits
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if !q.function[y][right-j] {
+					bits = append(bits, q.Dark(right-j, y))
+				}
+			}
+		}
+	}
+
+	out := make([]byte, len(bits)/8)
+	for i := range out {
+		for _, bit := range bits[i*8 : i*8+8] {
+			out[i] <<= 1
+			if bit {
+				out[i] |= 1
+			}
+		}
+	}
+	return out
+}
+
+// TestEncodeQRRoundTrip encodes texts of various lengths and reads the
+// codewords back out of the grid.
+func TestEncodeQRRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		text    string
+		level   qrLevel
+		version int
+	}{
+		{"hi", qrLevelM, 1},
+		{"https://example.com/l/abc1234", qrLevelM, 3},
+		{strings.Repeat("x", 84), qrLevelH, 8},
+		{strings.Repeat("y", 271), qrLevelL, 10},
+	} {
+		q, err := encodeQR([]byte(tt.text), tt.level)
+		if err != nil {
+			t.Fatalf("encodeQR(%d bytes): %v", len(tt.text), err)
+		}
+		if q.Size() != tt.version*4+17 {
+			t.Errorf("%d bytes at level %d: expected version %d, got size %d", len(tt.text), tt.level, tt.version, q.Size())
+		}
+
+		blocks := qrBlockTable[tt.version-1][tt.level]
+		want := qrInterleave(qrDataCodewords([]byte(tt.text), tt.version, blocks.dataCodewords()), blocks)
+		if got := readQRCodewords(t, q); !bytes.Equal(got[:len(want)], want) {
+			t.Errorf("%d bytes: codewords read back don't match", len(tt.text))
+		}
+	}
+
+	if _, err := encodeQR(bytes.Repeat([]byte("z"), 272), qrLevelL); err == nil {
+		t.Error("Expected an error for text that doesn't fit")
+	}
+}
+
+// TestHandleQRCode checks the endpoint returns a PNG of about the asked size.
+func TestHandleQRCode(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/qr?text=hello&size=300&ecc=H", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to decode PNG: %v", err)
+	}
+	// Version 1 plus the quiet zone is 29 modules: 10 pixels each.
+	if w := img.Bounds().Dx(); w != 290 {
+		t.Errorf("Expected a 290 pixel image, got %d", w)
+	}
+
+	for _, query := range []string{"", "?text=x&ecc=Z", "?text=x&size=0", "?text=" + strings.Repeat("a", 300)} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/qr"+query, nil))
+		if rec.Code < 400 {
+			t.Errorf("Expected an error for %q, got %d", query, rec.Code)
+		}
+	}
+}
+
+// FuzzQRCode requests codes with arbitrary parameters.
+//
+//	go test -fuzz FuzzQRCode -fuzztime 30s
+func FuzzQRCode(f *testing.F) {
+	f.Add("https://example.com", "200", "M")
+	f.Add(strings.Repeat("A", 5000), "1", "h")
+	f.Add("\xff\x00", "-1", "")
+
+	f.Fuzz(func(t *testing.T, text, size, ecc string) {
+		query := url.Values{"text": {text}, "size": {size}, "ecc": {ecc}}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/qr?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		handleQRCode(rec, req)
+		if rec.Code >= 500 {
+			t.Fatalf("%q, %q, %q: got %d %s", text, size, ecc, rec.Code, rec.Body.String())
+		}
+	})
+}
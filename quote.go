@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements GET /api/v1/quote, which returns a quote from one of
+// several sources, chosen by QUOTE_SOURCE:
+//   - "embedded": a small list compiled into the binary (quotes/quotes.json)
+//   - "http": an external quote API
+//   - "llm": a language model, asked for a quotation
+//
+// The external sources are slow and can fail, so each source has its own
+// cache, and when a fetch fails we fall back to the last quote it gave us or,
+// failing that, to the embedded list. The endpoint always has something to
+// show, which is what you want from a feature nobody would page you about.
+
+//go:embed quotes/quotes.json
+var embeddedQuotesJSON []byte
+
+// Quote is a quotation and who said it.
+type Quote struct {
+	Text   string `json:"text"`
+	Author string `json:"author"`
+}
+
+// QuoteResponse is the JSON body returned by GET /api/v1/quote. Source is
+// the source that actually provided the quote, which differs from
+// QUOTE_SOURCE after a fallback.
+type QuoteResponse struct {
+	Quote
+	Source string `json:"source"`
+	Cached bool   `json:"cached"`
+}
+
+// QuoteSource provides quotes. Each call may return a different one.
+type QuoteSource interface {
+	Name() string
+	Quote(ctx context.Context) (Quote, error)
+}
+
+// newQuoteSource creates the source selected by the configuration.
+func newQuoteSource(cfg Config, client *http.Client) QuoteSource {
+	switch cfg.QuoteSource {
+	case "http":
+		return &httpQuotes{url: cfg.QuoteAPIURL, client: client}
+	case "llm":
+		return &llmQuotes{url: cfg.LLMURL, model: cfg.LLMModel, apiKey: cfg.LLMAPIKey, client: client}
+	}
+	return newEmbeddedQuotes()
+}
+
+// embeddedQuotes picks a random quote from the built-in list.
+type embeddedQuotes struct {
+	quotes []Quote
+}
+
+// newEmbeddedQuotes parses the built-in list. It's part of the binary, so
+// a parse error is a bug and panics.
+func newEmbeddedQuotes() *embeddedQuotes {
+	var quotes []Quote
+	if err := json.Unmarshal(embeddedQuotesJSON, &quotes); err != nil || len(quotes) == 0 {
+		panic(fmt.Sprintf("quotes/quotes.json: %d quotes, %v", len(quotes), err))
+	}
+	return &embeddedQuotes{quotes: quotes}
+}
+
+func (e *embeddedQuotes) Name() string { return "embedded" }
+
+// Quote never fails.
+func (e *embeddedQuotes) Quote(ctx context.Context) (Quote, error) {
+	return e.quotes[rand.IntN(len(e.quotes))], nil
+}
+
+// httpQuotes fetches a quote from a JSON API such as dummyjson.com, which
+// answers with {"quote": "...", "author": "..."}. APIs that call the text
+// "text" instead work too.
+type httpQuotes struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpQuotes) Name() string { return "http" }
+
+func (h *httpQuotes) Quote(ctx context.Context) (Quote, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return Quote{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	var body struct {
+		Quote  string `json:"quote"`
+		Text   string `json:"text"`
+		Author string `json:"author"`
+	}
+	if err := doJSON(h.client, req, &body); err != nil {
+		return Quote{}, err
+	}
+
+	q := Quote{Text: cmp.Or(body.Quote, body.Text), Author: body.Author}
+	if q.Text == "" {
+		return Quote{}, errors.New("quote API response has no quote")
+	}
+	return q, nil
+}
+
+// llmPrompt asks for a real quotation in a format that's easy to split.
+const llmPrompt = "Give me one short, well-known quotation about software, " +
+	"engineering or teamwork, said by a real person. Reply with only the " +
+	"quotation on the first line and the person's name on the second line."
+
+// llmQuotes asks a language model for a quote through an OpenAI-compatible
+// chat completions API. Ollama, vLLM, LM Studio and most hosted model
+// providers speak it, so one client covers them all.
+type llmQuotes struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+func (l *llmQuotes) Name() string { return "llm" }
+
+func (l *llmQuotes) Quote(ctx context.Context) (Quote, error) {
+	payload, err := json.Marshal(map[string]any{
+		"model":      l.model,
+		"messages":   []map[string]string{{"role": "user", "content": llmPrompt}},
+		"max_tokens": 200,
+	})
+	if err != nil {
+		return Quote{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(payload))
+	if err != nil {
+		return Quote{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+
+	var body struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := doJSON(l.client, req, &body); err != nil {
+		return Quote{}, err
+	}
+	if len(body.Choices) == 0 {
+		return Quote{}, errors.New("model returned no choices")
+	}
+	return parseLLMQuote(body.Choices[0].Message.Content)
+}
+
+// parseLLMQuote splits a model's reply into the quotation and its author.
+// Models don't always follow instructions exactly, so quotation marks and
+// a leading dash before the name are tolerated.
+func parseLLMQuote(reply string) (Quote, error) {
+	var lines []string
+	for _, line := range strings.Split(reply, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 2 {
+		return Quote{}, fmt.Errorf("model reply is not a quote and an author: %q", reply)
+	}
+
+	text := strings.Join(lines[:len(lines)-1], " ")
+	author := strings.TrimLeft(lines[len(lines)-1], "-–— ")
+	return Quote{Text: strings.Trim(text, "\"“” "), Author: author}, nil
+}
+
+// doJSON sends req and decodes a successful JSON response into v.
+func doJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, 64<<10)
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+// cachedQuotes remembers a source's last quote for ttl. The lock is held
+// while fetching, so a burst of requests after the quote expires causes a
+// single fetch rather than one each.
+type cachedQuotes struct {
+	src QuoteSource
+	ttl time.Duration
+
+	mu      sync.Mutex
+	quote   Quote
+	fetched time.Time // zero until the first successful fetch
+}
+
+// get returns the cached quote if it's fresh, and otherwise fetches a new
+// one. If the fetch fails but an older quote is cached, that's returned
+// along with the error, with stale set.
+func (c *cachedQuotes) get(ctx context.Context, now time.Time) (q Quote, cached, stale bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && now.Sub(c.fetched) < c.ttl {
+		return c.quote, true, false, nil
+	}
+
+	q, err = c.src.Quote(ctx)
+	if err == nil {
+		c.quote, c.fetched = q, now
+		return q, false, false, nil
+	}
+	if !c.fetched.IsZero() {
+		return c.quote, true, true, err
+	}
+	return Quote{}, false, false, err
+}
+
+// Quotes serves quotes from the configured source, falling back to the
+// embedded list when it fails.
+type Quotes struct {
+	primary  *cachedQuotes
+	fallback *cachedQuotes // nil when the primary is the embedded list
+	timeout  time.Duration
+}
+
+// newQuotes creates the quote service for the configuration. External
+// sources are called with client.
+func newQuotes(cfg Config, client *http.Client) *Quotes {
+	q := &Quotes{
+		primary: &cachedQuotes{src: newQuoteSource(cfg, client), ttl: cfg.QuoteCacheTTL},
+		timeout: cfg.QuoteTimeout,
+	}
+	if q.primary.src.Name() != "embedded" {
+		q.fallback = &cachedQuotes{src: newEmbeddedQuotes(), ttl: cfg.QuoteCacheTTL}
+	}
+	return q
+}
+
+// Get returns a quote, trying in turn the primary source's cache, the
+// primary source, its stale cache and finally the embedded list.
+func (q *Quotes) Get(ctx context.Context, now time.Time) QuoteResponse {
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+
+	quote, cached, stale, err := q.primary.get(ctx, now)
+	name := q.primary.src.Name()
+	if err != nil {
+		slog.WarnContext(ctx, "fetching quote failed", "source", name, "stale", stale, "error", err)
+	}
+	if err == nil || stale || q.fallback == nil {
+		return QuoteResponse{Quote: quote, Source: name, Cached: cached}
+	}
+
+	// The embedded list can't fail, so the error is ignored.
+	quote, cached, _, _ = q.fallback.get(ctx, now)
+	return QuoteResponse{Quote: quote, Source: q.fallback.src.Name(), Cached: cached}
+}
+
+// handleQuote returns a quote.
+func (s *Server) handleQuote(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.quotes.Get(r.Context(), s.clock.Now()))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeQuotes is a QuoteSource that returns numbered quotes, or an error
+// while fail is set.
+type fakeQuotes struct {
+	calls int
+	fail  bool
+}
+
+func (f *fakeQuotes) Name() string { return "fake" }
+
+func (f *fakeQuotes) Quote(ctx context.Context) (Quote, error) {
+	f.calls++
+	if f.fail {
+		return Quote{}, errors.New("source is down")
+	}
+	return Quote{Text: "Quote " + string(rune('0'+f.calls)), Author: "Fake"}, nil
+}
+
+// TestQuotesCacheAndFallback walks through caching, a stale cache after a
+// failure, and falling back to the embedded list when nothing is cached.
+func TestQuotesCacheAndFallback(t *testing.T) {
+	src := &fakeQuotes{}
+	q := &Quotes{
+		primary:  &cachedQuotes{src: src, ttl: time.Hour},
+		fallback: &cachedQuotes{src: newEmbeddedQuotes()},
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	first := q.Get(context.Background(), now)
+	if first.Text != "Quote 1" || first.Source != "fake" || first.Cached {
+		t.Errorf("Expected a fresh quote, got %+v", first)
+	}
+	if again := q.Get(context.Background(), now.Add(time.Minute)); again.Text != "Quote 1" || !again.Cached || src.calls != 1 {
+		t.Errorf("Expected the cached quote without a fetch, got %+v after %d calls", again, src.calls)
+	}
+
+	src.fail = true
+	if stale := q.Get(context.Background(), now.Add(2*time.Hour)); stale.Text != "Quote 1" || !stale.Cached {
+		t.Errorf("Expected the stale quote after a failure, got %+v", stale)
+	}
+
+	q.primary = &cachedQuotes{src: src, ttl: time.Hour}
+	if fallback := q.Get(context.Background(), now); fallback.Source != "embedded" || fallback.Text == "" {
+		t.Errorf("Expected an embedded quote, got %+v", fallback)
+	}
+}
+
+// TestHTTPQuotes fetches from a fake quote API, and checks errors are
+// reported.
+func TestHTTPQuotes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id": 1, "quote": "Hello", "author": "World"}`))
+	}))
+	defer api.Close()
+
+	src := &httpQuotes{url: api.URL, client: api.Client()}
+	if q, err := src.Quote(context.Background()); err != nil || q != (Quote{Text: "Hello", Author: "World"}) {
+		t.Errorf("Unexpected quote %+v, error %v", q, err)
+	}
+
+	src.url = api.URL + "/broken"
+	if _, err := src.Quote(context.Background()); err == nil {
+		t.Error("Expected an error from a failing API")
+	}
+}
+
+// TestLLMQuotes checks the chat completions request and reply.
+func TestLLMQuotes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "tiny" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "\"Ship it.\"\n- Somebody"}}]}`))
+	}))
+	defer api.Close()
+
+	src := &llmQuotes{url: api.URL, model: "tiny", apiKey: "secret", client: api.Client()}
+	q, err := src.Quote(context.Background())
+	if err != nil || q != (Quote{Text: "Ship it.", Author: "Somebody"}) {
+		t.Errorf("Unexpected quote %+v, error %v", q, err)
+	}
+}
+
+// TestParseLLMQuote checks the formats models tend to reply with.
+func TestParseLLMQuote(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  Quote
+	}{
+		{"Stay hungry.\nSteve Jobs", Quote{"Stay hungry.", "Steve Jobs"}},
+		{"“Stay hungry.”\n\n— Steve Jobs\n", Quote{"Stay hungry.", "Steve Jobs"}},
+		{"Two lines\nof quote\n-Someone", Quote{"Two lines of quote", "Someone"}},
+	}
+	for _, tt := range tests {
+		if got, err := parseLLMQuote(tt.reply); err != nil || got != tt.want {
+			t.Errorf("parseLLMQuote(%q) = %+v, %v; want %+v", tt.reply, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseLLMQuote("Sorry, I can't help with that."); err == nil {
+		t.Error("Expected an error for a reply without an author")
+	}
+}
+
+// TestHandleQuote checks the default configuration serves embedded quotes.
+func TestHandleQuote(t *testing.T) {
+	srv := newServer(defaultConfig(t))
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/quote", nil))
+
+	var resp QuoteResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if rec.Code != http.StatusOK || resp.Source != "embedded" || !slices.Contains(newEmbeddedQuotes().quotes, resp.Quote) {
+		t.Errorf("Expected an embedded quote, got %d %+v", rec.Code, resp)
+	}
+}
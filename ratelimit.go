@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file limits how many requests each client can make in a window of
+// time. The in-flight limits (limit.go) protect the server from the total
+// load; a rate limit stops one client, a script stuck in a loop say, from
+// using up the capacity everyone else shares.
+//
+// With RATE_LIMIT set, each client can make that many requests every
+// RATE_LIMIT_WINDOW. A client is an IP address, whatever tenant it asks
+// for: the tenant comes from the request, so a client could otherwise get
+// a fresh allowance by naming a new one each time. The window
+// starts at the client's first request, and past the limit requests get a
+// 429 until it ends. 0, the default, means no limit. Like the in-flight
+// limits, it doesn't apply to health probes, metrics, or admin requests
+// that carry an admin key (see shed.go).
+//
+// Every limited response says where the client stands, so a polite client
+// can slow down before it's turned away rather than after:
+//
+//	RateLimit-Limit: 100       requests allowed in the window
+//	RateLimit-Remaining: 42    requests left in it
+//	RateLimit-Reset: 17        seconds until it ends
+//
+// These are the headers of the IETF RateLimit draft. Many clients still
+// look for the older X-RateLimit-Limit, -Remaining and -Reset instead, so
+// they're sent too, with X-RateLimit-Reset as a Unix time, the way GitHub's
+// API sends it.
+//
+// Each instance counts on its own, so with three replicas behind a load
+// balancer a client really gets three times the limit. With REDIS_URL set,
+// the counts are kept in Redis instead (see redis.go), where every replica
+// sees them. Redis uses a sliding window: windows are fixed slots of time,
+// shared by the replicas, and the estimate of a client's recent requests is
+// its count in this slot plus the previous slot's, weighted by how much of
+// it is still within one window of now. That smooths out the burst a fixed
+// window allows at its edge, for two small commands per request.
+//
+// If Redis can't be reached, limiting carries on locally rather than
+// failing requests or letting everything through, and Redis is tried again
+// after redisRetryAfter. The switch each way is logged.
+
+// redisRetryAfter is how long rate limiting counts locally after Redis
+// fails, before trying it again.
+const redisRetryAfter = 5 * time.Second
+
+// rateWindow is one client's current window.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// rateLimiter counts each client's requests in its current window.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	swept   time.Time // when windows was last cleared of ended ones
+
+	// sharedDown is set while Redis is failing, and retryAt is when to
+	// try it again.
+	sharedDown bool
+	retryAt    time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{windows: make(map[string]*rateWindow)}
+}
+
+// allow counts a request from client at now, unless it's over limit. It
+// returns the requests the client has left and when its window ends.
+func (l *rateLimiter) allow(client string, now time.Time, limit int, window time.Duration) (ok bool, remaining int, reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= window {
+		for key, w := range l.windows {
+			if !now.Before(w.start.Add(window)) {
+				delete(l.windows, key)
+			}
+		}
+		l.swept = now
+	}
+
+	w, found := l.windows[client]
+	if !found || !now.Before(w.start.Add(window)) {
+		w = &rateWindow{start: now}
+		l.windows[client] = w
+	}
+	reset = w.start.Add(window)
+	if w.count >= limit {
+		return false, 0, reset
+	}
+	w.count++
+	return true, limit - w.count, reset
+}
+
+// useShared reports whether to count in Redis at now, rather than locally.
+func (l *rateLimiter) useShared(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !now.Before(l.retryAt)
+}
+
+// sharedFailed switches to counting locally after err from Redis.
+func (l *rateLimiter) sharedFailed(now time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.sharedDown {
+		slog.Warn("Redis failed, rate limiting locally", "error", err, "retry_in", redisRetryAfter)
+	}
+	l.sharedDown, l.retryAt = true, now.Add(redisRetryAfter)
+}
+
+// sharedWorked switches back to Redis, if it had failed.
+func (l *rateLimiter) sharedWorked() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sharedDown {
+		slog.Info("Redis is back, rate limiting across instances")
+	}
+	l.sharedDown = false
+}
+
+// clients returns the clients with a window that hasn't ended at now, the
+// busiest first. Clients counted in Redis aren't included.
+func (l *rateLimiter) clients(now time.Time, limit int, window time.Duration) []RateLimitClient {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clients := []RateLimitClient{}
+	for key, w := range l.windows {
+		reset := w.start.Add(window)
+		if !now.Before(reset) {
+			continue
+		}
+		clients = append(clients, RateLimitClient{
+			Client:    key,
+			Requests:  w.count,
+			Remaining: max(0, limit-w.count),
+			ResetsIn:  reset.Sub(now).Round(time.Second).String(),
+		})
+	}
+	slices.SortFunc(clients, func(a, b RateLimitClient) int {
+		return cmp.Or(b.Requests-a.Requests, strings.Compare(a.Client, b.Client))
+	})
+	return clients
+}
+
+// RateLimitClient is one client's window, as listed by GET /admin/ratelimit.
+// Client is the IP address.
+type RateLimitClient struct {
+	Client    string `json:"client"`
+	Requests  int    `json:"requests"`
+	Remaining int    `json:"remaining"`
+	ResetsIn  string `json:"resets_in"`
+}
+
+// RateLimitState is the JSON body returned by GET /admin/ratelimit. Backend
+// is "off" without RATE_LIMIT, "redis" while counting in Redis, and "local"
+// otherwise, when Clients lists this instance's counts.
+type RateLimitState struct {
+	Limit     int               `json:"limit"`
+	Window    string            `json:"window"`
+	Backend   string            `json:"backend"`
+	RedisDown bool              `json:"redis_down,omitempty"`
+	Clients   []RateLimitClient `json:"clients"`
+}
+
+// handleRateLimitState shows the rate limit and where each client stands.
+func (s *Server) handleRateLimitState(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	now := s.clock.Now()
+	state := RateLimitState{Limit: cfg.RateLimit, Window: cfg.RateLimitWindow.String(), Backend: "off"}
+	if cfg.RateLimit > 0 {
+		state.Backend = "local"
+		if s.redis != nil {
+			if s.rateLimiter.useShared(now) {
+				state.Backend = "redis"
+			} else {
+				state.RedisDown = true
+			}
+		}
+	}
+	state.Clients = s.rateLimiter.clients(now, cfg.RateLimit, cfg.RateLimitWindow)
+	setPagination(w, Pagination{Total: len(state.Clients)})
+	writeJSON(w, http.StatusOK, state)
+}
+
+// allowShared counts a request from client at now in Redis, unless it's
+// over limit, using a sliding window. Like allow, it returns the requests
+// the client has left and when the current slot ends.
+func allowShared(ctx context.Context, redis *Redis, client string, now time.Time, limit int, window time.Duration) (ok bool, remaining int, reset time.Time, err error) {
+	slot := now.UnixMilli() / window.Milliseconds()
+	current := "ratelimit:" + client + ":" + strconv.FormatInt(slot, 10)
+	previous := "ratelimit:" + client + ":" + strconv.FormatInt(slot-1, 10)
+	// The slot is still needed as the previous one, until the next ends.
+	ttl := strconv.FormatInt(2*window.Milliseconds(), 10)
+
+	replies, err := redis.Pipeline(ctx, []string{"INCR", current}, []string{"PEXPIRE", current, ttl}, []string{"GET", previous})
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return false, 0, time.Time{}, err
+		}
+	}
+	count, _ := replies[0].(int64)
+	before := 0
+	if s, ok := replies[2].(string); ok {
+		before, _ = strconv.Atoi(s)
+	}
+
+	start := time.UnixMilli(slot * window.Milliseconds())
+	reset = start.Add(window)
+	weight := 1 - float64(now.Sub(start))/float64(window)
+	estimate := float64(before)*weight + float64(count)
+	if estimate > float64(limit) {
+		// Turned away, so it doesn't count. If this fails, the client
+		// only loses one request from its limit.
+		redis.Do(ctx, "DECR", current)
+		return false, 0, reset, nil
+	}
+	return true, max(0, limit-int(math.Ceil(estimate))), reset, nil
+}
+
+// allowRequest counts a request from client, in Redis if it's configured
+// and working, otherwise in limiter. Limits other than RATE_LIMIT have a
+// scope, which keeps their counts in Redis apart.
+func (s *Server) allowRequest(r *http.Request, now time.Time, limiter *rateLimiter, scope string, limit int, window time.Duration) (ok bool, remaining int, reset time.Time) {
+	client := rateLimitClient(r)
+	if scope != "" {
+		client = scope + " " + client
+	}
+	if s.redis != nil && limiter.useShared(now) {
+		// A client hanging up isn't Redis failing.
+		ctx := context.WithoutCancel(r.Context())
+		ok, remaining, reset, err := allowShared(ctx, s.redis, client, now, limit, window)
+		if err == nil {
+			limiter.sharedWorked()
+			return ok, remaining, reset
+		}
+		limiter.sharedFailed(now, err)
+	}
+	return limiter.allow(client, now, limit, window)
+}
+
+// rateLimitClient identifies the client that sent r, by its address alone.
+func rateLimitClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// setRateLimitHeaders tells the client where it stands.
+func setRateLimitHeaders(h http.Header, limit, remaining int, reset, now time.Time) {
+	seconds := strconv.Itoa(max(0, int(reset.Sub(now).Round(time.Second).Seconds())))
+	h.Set("RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", seconds)
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+// rateLimitMiddleware turns a client away with a 429 once it's made
+// RATE_LIMIT requests in the window.
+func (s *Server) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		if cfg.RateLimit == 0 || s.critical(r) {
+			next(w, r)
+			return
+		}
+
+		if s.limitRequest(w, r, s.rateLimiter, "", cfg.RateLimit, cfg.RateLimitWindow) {
+			next(w, r)
+		}
+	}
+}
+
+// limitRequest counts r against limit requests every window, in limiter
+// and under scope in Redis, and sets the RateLimit headers. If the client
+// is over the limit, it answers 429 and returns false.
+func (s *Server) limitRequest(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, scope string, limit int, window time.Duration) bool {
+	now := s.clock.Now()
+	ok, remaining, reset := s.allowRequest(r, now, limiter, scope, limit, window)
+	setRateLimitHeaders(w.Header(), limit, remaining, reset, now)
+	if !ok {
+		s.metrics.ObserveRateLimited()
+		w.Header().Set("Retry-After", w.Header().Get("RateLimit-Reset"))
+		writeProblem(w, http.StatusTooManyRequests, "too many requests; see the RateLimit headers")
+		return false
+	}
+	return true
+}
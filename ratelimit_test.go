@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestRateLimit checks a client is turned away past RATE_LIMIT until its
+// window ends, with headers saying where it stands, however many tenants
+// it names, while the health probes aren't affected.
+func TestRateLimit(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.cfgMu.Lock()
+	s.cfg.RateLimit = 2
+	s.cfg.RateLimitWindow = time.Minute
+	s.cfgMu.Unlock()
+
+	c.Get("/api/v1/counter").
+		Status(http.StatusOK).
+		HasHeader("RateLimit-Limit", "2").
+		HasHeader("RateLimit-Remaining", "1").
+		HasHeader("RateLimit-Reset", "60").
+		HasHeader("X-RateLimit-Limit", "2").
+		HasHeader("X-RateLimit-Remaining", "1").
+		HasHeader("X-RateLimit-Reset", strconv.FormatInt(clock.Now().Add(time.Minute).Unix(), 10))
+	clock.Advance(20 * time.Second)
+	c.Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "0")
+	c.Get("/api/v1/counter").
+		Status(http.StatusTooManyRequests).
+		HasHeader("RateLimit-Remaining", "0").
+		HasHeader("RateLimit-Reset", "40").
+		HasHeader("Retry-After", "40")
+	c.Get("/health").Status(http.StatusOK)
+	if metrics := c.Get("/metrics").Body.String(); !strings.Contains(metrics, "\nhttp_requests_rate_limited_total 1\n") {
+		t.Errorf("Expected 1 request rate limited, got:\n%s", metrics)
+	}
+
+	c.Header.Set(tenantHeader, "acme")
+	c.Get("/api/v1/counter").Status(http.StatusTooManyRequests)
+	c.Header.Del(tenantHeader)
+
+	clock.Advance(40 * time.Second)
+	c.Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "1")
+
+	s.cfgMu.Lock()
+	s.cfg.RateLimit = 0
+	s.cfgMu.Unlock()
+	if rec := c.Get("/api/v1/counter").Status(http.StatusOK); rec.Header().Get("RateLimit-Limit") != "" {
+		t.Error("Expected no RateLimit headers with no limit")
+	}
+}
+
+// TestRateLimitShared checks instances sharing a Redis server share their
+// clients' limits, and fall back to counting locally while it's down.
+func TestRateLimitShared(t *testing.T) {
+	f := newFakeRedis(t, "")
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	var clients [2]*testsupport.Client
+	var servers [2]*Server
+	for i := range servers {
+		cfg := defaultConfig(t)
+		cfg.RateLimit = 3
+		cfg.RateLimitWindow = time.Minute
+		cfg.RedisURL = f.URL()
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = newServer(cfg)
+		servers[i].useClock(clock)
+		clients[i] = testsupport.New(t, servers[i].handler())
+	}
+
+	clients[0].Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "2")
+	clients[1].Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "1")
+	clients[0].Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "0")
+	clients[1].Get("/api/v1/counter").Status(http.StatusTooManyRequests).HasHeader("RateLimit-Reset", "60")
+
+	// Halfway through the next window, half the last one's 3 requests
+	// still count, leaving room for 1.
+	clock.Advance(90 * time.Second)
+	clients[1].Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "0")
+	clients[0].Get("/api/v1/counter").Status(http.StatusTooManyRequests).HasHeader("RateLimit-Reset", "30")
+	if cmds := f.Commands(); cmds[len(cmds)-1] != "DECR ratelimit:192.0.2.1:28401841" {
+		t.Errorf("Expected the rejected request uncounted, got %q", cmds[len(cmds)-1])
+	}
+
+	f.Stop()
+	clients[0].Get("/api/v1/counter").Status(http.StatusOK).HasHeader("RateLimit-Remaining", "2")
+	if servers[0].rateLimiter.useShared(clock.Now()) {
+		t.Error("Expected Redis left alone after failing")
+	}
+	clock.Advance(redisRetryAfter)
+	if !servers[0].rateLimiter.useShared(clock.Now()) {
+		t.Error("Expected Redis tried again after redisRetryAfter")
+	}
+}
+
+// TestRateLimiterSweep checks ended windows are forgotten.
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.allow("a", start, 1, time.Minute)
+	l.allow("b", start.Add(30*time.Second), 1, time.Minute)
+	l.allow("c", start.Add(time.Minute), 1, time.Minute)
+	if _, ok := l.windows["a"]; ok || len(l.windows) != 2 {
+		t.Errorf("Expected only a's window forgotten, got %v", l.windows)
+	}
+}
+
+// TestRateLimitState checks GET /admin/ratelimit shows the limit and each
+// client's window, and that looking, with an admin key, doesn't count.
+func TestRateLimitState(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	c.Get("/admin/ratelimit").JSON(`{"limit": 0, "window": "1m0s", "backend": "off", "clients": []}`)
+
+	s.useClock(newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)))
+	s.cfgMu.Lock()
+	s.cfg.RateLimit = 5
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+	c.Get("/api/v1/counter")
+	c.Get("/api/v1/counter")
+	c.Header.Set("Authorization", "Bearer k1")
+	c.Get("/admin/ratelimit").JSON(`{"limit": 5, "window": "1m0s", "backend": "local", "clients": [
+		{"client": "192.0.2.1", "requests": 2, "remaining": 3, "resets_in": "1m0s"}
+	]}`)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// This file implements the dependency checks behind GET /readyz. A pod is
+// only worth sending traffic to if what it depends on works, so readiness
+// asks each dependency in turn: can the data file be saved, is there disk
+// space left, can the quote source be reached?
+//
+// The checks run concurrently, each with its own timeout, so one slow
+// dependency can't hold up the probe (Kubernetes gives up on a probe after
+// timeoutSeconds, 1 by default). Results are cached for READINESS_CACHE_TTL,
+// so frequent probes, or many clients calling /readyz, don't hammer the
+// dependencies.
+//
+// Not every failure should take the pod out of service. A hard check is
+// one the server can't do its job without; if only soft checks fail,
+// /readyz still answers 200 but says "degraded". The quote source is soft,
+// for example, since quotes fall back to the embedded list.
+//
+// To add a check of your own, for a database or cache your fork uses, call
+// RegisterHealthCheck from an init function in a new file:
+//
+//	func init() {
+//		RegisterHealthCheck("redis", SeverityHard, func(ctx context.Context) error {
+//			return redisClient.Ping(ctx).Err()
+//		})
+//	}
+//
+// GET /admin/healthchecks lists every check with its latest result.
+
+// Severity says what a failing check means for readiness.
+type Severity string
+
+const (
+	SeverityHard Severity = "hard" // failing makes the server unavailable
+	SeveritySoft Severity = "soft" // failing only degrades it
+)
+
+// HealthCheck is a named dependency check.
+type HealthCheck struct {
+	Name     string
+	Severity Severity
+	Check    func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of one HealthCheck.
+type CheckResult struct {
+	Name       string   `json:"name"`
+	OK         bool     `json:"ok"`
+	Severity   Severity `json:"severity"`
+	Error      string   `json:"error,omitempty"`
+	DurationMs float64  `json:"duration_ms"`
+}
+
+// HealthCheckInfo describes a registered check, as listed by
+// GET /admin/healthchecks.
+type HealthCheckInfo struct {
+	Name       string       `json:"name"`
+	Severity   Severity     `json:"severity"`
+	LastResult *CheckResult `json:"last_result,omitempty"` // nil until it has run
+}
+
+// HealthCheckListResponse is the JSON body returned by
+// GET /admin/healthchecks.
+type HealthCheckListResponse struct {
+	Checks    []HealthCheckInfo `json:"checks"`
+	CheckedAt *time.Time        `json:"checked_at,omitempty"`
+}
+
+// extraHealthChecks holds the checks added with RegisterHealthCheck, which
+// registerReadinessChecks adds to the server's own.
+var extraHealthChecks struct {
+	mu     sync.Mutex
+	checks []HealthCheck
+}
+
+// RegisterHealthCheck adds a check to /readyz. It's meant to be called from
+// init functions, and like http.HandleFunc it panics on a mistake (an
+// empty or duplicate name, an unknown severity, a nil check), since that's
+// a bug to fix rather than an error to handle.
+func RegisterHealthCheck(name string, severity Severity, check func(ctx context.Context) error) {
+	extraHealthChecks.mu.Lock()
+	defer extraHealthChecks.mu.Unlock()
+	extraHealthChecks.checks = appendHealthCheck(extraHealthChecks.checks, HealthCheck{Name: name, Severity: severity, Check: check})
+}
+
+// appendHealthCheck validates a check and adds it to checks.
+func appendHealthCheck(checks []HealthCheck, hc HealthCheck) []HealthCheck {
+	switch {
+	case hc.Name == "":
+		panic("health check: empty name")
+	case hc.Severity != SeverityHard && hc.Severity != SeveritySoft:
+		panic(fmt.Sprintf("health check %q: unknown severity %q", hc.Name, hc.Severity))
+	case hc.Check == nil:
+		panic(fmt.Sprintf("health check %q: nil check", hc.Name))
+	case slices.ContainsFunc(checks, func(c HealthCheck) bool { return c.Name == hc.Name }):
+		panic(fmt.Sprintf("health check %q: registered twice", hc.Name))
+	}
+	return append(checks, hc)
+}
+
+// Readiness is the registry of dependency checks. It's safe for concurrent
+// use.
+type Readiness struct {
+	timeout time.Duration // for each check
+	ttl     time.Duration // how long results are reused
+
+	// onChange, if set, is called with the old and new readiness status
+	// when a run of the checks changes it.
+	onChange func(from, to string, results []CheckResult)
+
+	mu        sync.Mutex
+	checks    []HealthCheck
+	results   []CheckResult
+	checkedAt time.Time
+}
+
+// newReadiness creates a registry without checks.
+func newReadiness(timeout, ttl time.Duration) *Readiness {
+	return &Readiness{timeout: timeout, ttl: ttl}
+}
+
+// Register adds a check. It panics on the same mistakes as
+// RegisterHealthCheck.
+func (rd *Readiness) Register(name string, severity Severity, check func(ctx context.Context) error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.checks = appendHealthCheck(rd.checks, HealthCheck{Name: name, Severity: severity, Check: check})
+	rd.checkedAt = time.Time{}
+}
+
+// List describes the registered checks, with the most recent results if
+// the checks have run since the last one was registered.
+func (rd *Readiness) List() HealthCheckListResponse {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	resp := HealthCheckListResponse{Checks: make([]HealthCheckInfo, len(rd.checks))}
+	for i, hc := range rd.checks {
+		resp.Checks[i] = HealthCheckInfo{Name: hc.Name, Severity: hc.Severity}
+	}
+	if !rd.checkedAt.IsZero() {
+		at := rd.checkedAt
+		resp.CheckedAt = &at
+		for i := range rd.results {
+			resp.Checks[i].LastResult = &rd.results[i]
+		}
+	}
+	return resp
+}
+
+// Check returns the result of every check, reusing recent results, and
+// whether they came from the cache. The lock is held while checks run, so
+// concurrent callers wait for one set of results rather than each running
+// their own.
+func (rd *Readiness) Check(ctx context.Context, now time.Time) ([]CheckResult, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if !rd.checkedAt.IsZero() && now.Sub(rd.checkedAt) < rd.ttl {
+		return rd.results, true
+	}
+
+	// The results are shared with every caller, so the checks mustn't be
+	// cancelled just because the first one gave up.
+	ctx = context.WithoutCancel(ctx)
+	results := make([]CheckResult, len(rd.checks))
+	var wg sync.WaitGroup
+	for i, hc := range rd.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := hc.Check(ctx)
+			results[i] = CheckResult{
+				Name:       hc.Name,
+				OK:         err == nil,
+				Severity:   hc.Severity,
+				DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rd.onChange != nil && rd.results != nil {
+		if from, to := readinessStatus(rd.results), readinessStatus(results); from != to {
+			rd.onChange(from, to, results)
+		}
+	}
+	rd.results, rd.checkedAt = results, now
+	return results, false
+}
+
+// readinessStatus sums up check results: "ready" if they all passed,
+// "degraded" if only soft ones failed, and "unavailable" if a hard one did.
+func readinessStatus(results []CheckResult) string {
+	status := "ready"
+	for _, r := range results {
+		switch {
+		case !r.OK && r.Severity == SeverityHard:
+			return "unavailable"
+		case !r.OK:
+			status = "degraded"
+		}
+	}
+	return status
+}
+
+// registerReadinessChecks registers the server's own checks for the
+// configuration, then those added with RegisterHealthCheck.
+func (s *Server) registerReadinessChecks(cfg Config) {
+	if cfg.DataFile != "" {
+		s.readiness.Register("data file", SeverityHard, func(ctx context.Context) error {
+			if _, err := os.Stat(cfg.DataFile); err != nil {
+				return err
+			}
+			return s.store.SaveError()
+		})
+		s.readiness.Register("disk space (data file)", SeverityHard, func(ctx context.Context) error {
+			return checkDiskFree(filepath.Dir(cfg.DataFile), cfg.ReadinessMinDiskFree)
+		})
+	}
+	if cfg.BlobBackend == "local" {
+		s.readiness.Register("disk space (uploads)", SeverityHard, func(ctx context.Context) error {
+			return checkDiskFree(cfg.UploadDir, cfg.ReadinessMinDiskFree)
+		})
+	}
+
+	switch cfg.QuoteSource {
+	case "http":
+		s.readiness.Register("quote API", SeveritySoft, func(ctx context.Context) error {
+			return checkReachable(ctx, s.outbound, cfg.QuoteAPIURL)
+		})
+	case "llm":
+		s.readiness.Register("LLM API", SeveritySoft, func(ctx context.Context) error {
+			return checkReachable(ctx, s.outbound, cfg.LLMURL)
+		})
+	}
+
+	if s.redis != nil {
+		// Rate limiting falls back to counting locally without Redis.
+		s.readiness.Register("redis", SeveritySoft, s.redis.Ping)
+	}
+
+	extraHealthChecks.mu.Lock()
+	defer extraHealthChecks.mu.Unlock()
+	for _, hc := range extraHealthChecks.checks {
+		s.readiness.Register(hc.Name, hc.Severity, hc.Check)
+	}
+}
+
+// checkDiskFree fails if the file system holding dir has less than min
+// bytes available.
+func checkDiskFree(dir string, min int64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return err
+	}
+	if free < uint64(min) {
+		return fmt.Errorf("%d MiB free, want at least %d MiB", free>>20, min>>20)
+	}
+	return nil
+}
+
+// checkReachable checks a service answers HTTP at all, by asking for the
+// root of rawURL's host. Any response short of a server error will do:
+// the point is whether the service is up, not what it thinks of the
+// request.
+func checkReachable(ctx context.Context, client *http.Client, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	root := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	return checkHTTP(ctx, client, root.String())
+}
+
+// checkHTTP fails if a GET request for rawURL fails or gets a server error.
+func checkHTTP(ctx context.Context, client *http.Client, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// handleListHealthChecks lists the readiness checks and their latest
+// results. It doesn't run them: that's /readyz's job.
+func (s *Server) handleListHealthChecks(w http.ResponseWriter, r *http.Request) {
+	resp := s.readiness.List()
+	setPagination(w, Pagination{Total: len(resp.Checks)})
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReadinessCheck checks the checks run concurrently with a timeout
+// each, and that results are cached.
+func TestReadinessCheck(t *testing.T) {
+	rd := newReadiness(50*time.Millisecond, time.Minute)
+	var runs atomic.Int32
+	for _, name := range []string{"a", "b", "c"} {
+		rd.Register(name, SeverityHard, func(ctx context.Context) error {
+			runs.Add(1)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+
+	now := time.Now()
+	start := time.Now()
+	results, cached := rd.Check(context.Background(), now)
+	if elapsed := time.Since(start); elapsed > 140*time.Millisecond {
+		t.Errorf("Expected the checks to time out together, took %v", elapsed)
+	}
+	if cached || len(results) != 3 {
+		t.Fatalf("Expected 3 fresh results, got %+v", results)
+	}
+	for _, r := range results {
+		if r.OK || !strings.Contains(r.Error, "deadline") {
+			t.Errorf("Expected %s to time out, got %+v", r.Name, r)
+		}
+	}
+
+	if _, cached := rd.Check(context.Background(), now.Add(30*time.Second)); !cached || runs.Load() != 3 {
+		t.Errorf("Expected cached results without running the checks again, ran %d", runs.Load())
+	}
+	if _, cached := rd.Check(context.Background(), now.Add(2*time.Minute)); cached || runs.Load() != 6 {
+		t.Errorf("Expected the checks to run again once the cache expired, ran %d", runs.Load())
+	}
+}
+
+// TestReadinessStatus checks only hard failures make the server
+// unavailable.
+func TestReadinessStatus(t *testing.T) {
+	tests := []struct {
+		results []CheckResult
+		want    string
+	}{
+		{nil, "ready"},
+		{[]CheckResult{{OK: true, Severity: SeverityHard}, {OK: true, Severity: SeveritySoft}}, "ready"},
+		{[]CheckResult{{OK: true, Severity: SeverityHard}, {OK: false, Severity: SeveritySoft}}, "degraded"},
+		{[]CheckResult{{OK: false, Severity: SeveritySoft}, {OK: false, Severity: SeverityHard}}, "unavailable"},
+	}
+	for _, tt := range tests {
+		if got := readinessStatus(tt.results); got != tt.want {
+			t.Errorf("%+v: expected %q, got %q", tt.results, tt.want, got)
+		}
+	}
+}
+
+// TestReadyzChecks checks /readyz reports each check and answers 503 only
+// for hard failures.
+func TestReadyzChecks(t *testing.T) {
+	for _, severity := range []Severity{SeveritySoft, SeverityHard} {
+		s := newServer(Config{ReadinessCheckTimeout: time.Second})
+		s.readiness.Register("ok", SeverityHard, func(ctx context.Context) error { return nil })
+		s.readiness.Register("broken", severity, func(ctx context.Context) error { return errors.New("no route to host") })
+
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp ReadyResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse JSON response: %v", err)
+		}
+
+		wantCode, wantStatus := http.StatusOK, "degraded"
+		if severity == SeverityHard {
+			wantCode, wantStatus = http.StatusServiceUnavailable, "unavailable"
+		}
+		if rec.Code != wantCode || resp.Status != wantStatus {
+			t.Errorf("%s: expected %d %s, got %d %s", severity, wantCode, wantStatus, rec.Code, resp.Status)
+		}
+		if len(resp.Checks) != 2 || resp.Checks[1].Error != "no route to host" {
+			t.Errorf("Expected both checks in the response, got %+v", resp.Checks)
+		}
+	}
+}
+
+// TestCheckReachable checks any non-5xx answer counts as reachable.
+func TestCheckReachable(t *testing.T) {
+	status := http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			t.Errorf("Expected a request for the root, got %s", r.URL.Path)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	if err := checkReachable(context.Background(), srv.Client(), srv.URL+"/v1/chat/completions"); err != nil {
+		t.Errorf("Expected a 404 to count as reachable, got %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := checkReachable(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("Expected a 502 to fail")
+	}
+	srv.Close()
+	if err := checkReachable(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("Expected a closed server to fail")
+	}
+}
+
+// TestCheckDiskFree checks the threshold against the real disk.
+func TestCheckDiskFree(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := diskFree(dir); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("disk space isn't supported on this system")
+	}
+	if err := checkDiskFree(dir, 0); err != nil {
+		t.Errorf("Expected no minimum to pass, got %v", err)
+	}
+	if err := checkDiskFree(dir, math.MaxInt64); err == nil {
+		t.Error("Expected an impossible minimum to fail")
+	}
+}
+
+// TestRegisterHealthCheck checks registered checks reach /readyz, are listed
+// by the admin endpoint, and that mistakes panic.
+func TestRegisterHealthCheck(t *testing.T) {
+	openAdmin(t)
+	saved := extraHealthChecks.checks
+	defer func() { extraHealthChecks.checks = saved }()
+	extraHealthChecks.checks = nil
+
+	RegisterHealthCheck("cache", SeveritySoft, func(ctx context.Context) error { return errors.New("cache miss") })
+	for _, bad := range []func(){
+		func() { RegisterHealthCheck("cache", SeverityHard, func(ctx context.Context) error { return nil }) },
+		func() { RegisterHealthCheck("db", "fatal", func(ctx context.Context) error { return nil }) },
+		func() { RegisterHealthCheck("", SeverityHard, func(ctx context.Context) error { return nil }) },
+		func() { RegisterHealthCheck("db", SeverityHard, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a bad registration to panic")
+				}
+			}()
+			bad()
+		}()
+	}
+
+	cfg := defaultConfig(t)
+	cfg.UploadDir = t.TempDir()
+	s := newServer(cfg)
+	s.registerReadinessChecks(cfg)
+	mux := s.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	var list HealthCheckListResponse
+	if err := json.Unmarshal(get("/admin/healthchecks").Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	last := list.Checks[len(list.Checks)-1]
+	if last.Name != "cache" || last.Severity != SeveritySoft || last.LastResult != nil || list.CheckedAt != nil {
+		t.Errorf("Expected the registered check, not yet run, got %+v", list)
+	}
+
+	if rec := get("/readyz"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "cache miss") {
+		t.Errorf("Expected the soft check to degrade /readyz, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(get("/admin/healthchecks").Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	last = list.Checks[len(list.Checks)-1]
+	if last.LastResult == nil || last.LastResult.OK || list.CheckedAt == nil {
+		t.Errorf("Expected the latest result to be listed, got %+v", last)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file is a small Redis client, used when REDIS_URL is set to share
+// state between instances of the server (the rate limit counters, see
+// ratelimit.go). Redis keeps its data in memory and answers in well under a
+// millisecond, which makes it the usual place for counters that every
+// replica has to agree on.
+//
+// Redis's protocol, RESP, is simple enough to speak directly, so the client
+// doesn't need a library. A command is sent as an array of strings:
+//
+//	*2\r\n$4\r\nINCR\r\n$3\r\nkey\r\n
+//
+// and each reply starts with a character giving its type: + for a status
+// like OK, - for an error, : for an integer, $ for a string ($-1 for none)
+// and * for an array of replies. Several commands can be written at once
+// and their replies read back in order, a pipeline, which costs one round
+// trip instead of one each.
+//
+// The client keeps a single connection, and sends one command (or
+// pipeline) at a time over it. That's plenty for a few small commands per
+// request; a busier service would want a pool. After any network error the
+// connection is closed, and the next command dials a new one.
+//
+// REDIS_URL looks like redis://:password@host:6379/0, with rediss:// for
+// TLS. Try it with the Redis service in docker-compose.yml:
+//
+//	docker compose --profile redis up
+//
+// with REDIS_URL=redis://redis:6379 in the app's environment.
+
+// Redis is a connection to a Redis server.
+type Redis struct {
+	addr     string
+	password string
+	db       int
+	tls      *tls.Config // nil for a plain connection
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from Redis, like "ERR unknown command".
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// parseRedisURL checks a REDIS_URL and returns a client for it, without
+// connecting.
+func parseRedisURL(rawURL string, timeout time.Duration) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// url.Parse's error repeats the URL, password and all.
+		return nil, errors.New("not a valid URL")
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("the scheme must be redis or rediss, not %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("the URL has no host")
+	}
+	r := &Redis{addr: u.Host, timeout: timeout}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		r.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	r.password, _ = u.User.Password()
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil || r.db < 0 {
+			return nil, fmt.Errorf("%q is not a database number", db)
+		}
+	}
+	return r, nil
+}
+
+// newRedis returns a client for cfg.RedisURL, or nil if it isn't set.
+func newRedis(cfg Config) *Redis {
+	if cfg.RedisURL == "" {
+		return nil
+	}
+	// The configuration has been validated, so parsing can't fail.
+	r, _ := parseRedisURL(cfg.RedisURL, cfg.RedisTimeout)
+	return r
+}
+
+// Do sends one command and returns its reply: a string, an int64, nil, or
+// a []any of those. An error reply is returned as a redisError.
+func (r *Redis) Do(ctx context.Context, args ...string) (any, error) {
+	replies, err := r.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(redisError); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands at once and returns their replies, in
+// order. Error replies are returned in the slice, as redisErrors, since
+// one command failing doesn't stop the others running.
+func (r *Redis) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	replies, err := r.roundTrip(ctx, cmds)
+	if err != nil && r.conn != nil {
+		// The connection may have half a reply left on it, so it can't be
+		// used again.
+		r.conn.Close()
+		r.conn = nil
+	}
+	return replies, err
+}
+
+// roundTrip writes the commands and reads their replies, connecting
+// first if need be. The caller holds r.mu.
+func (r *Redis) roundTrip(ctx context.Context, cmds [][]string) ([]any, error) {
+	deadline, ok := ctx.Deadline()
+	if limit := time.Now().Add(r.timeout); !ok || limit.Before(deadline) {
+		deadline = limit
+	}
+	if r.conn == nil {
+		if err := r.connect(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+	r.conn.SetDeadline(deadline)
+	return r.send(cmds)
+}
+
+// connect dials the server and logs in. The caller holds r.mu.
+func (r *Redis) connect(ctx context.Context, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		conn, err = (&tls.Dialer{Config: r.tls}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.r = conn, bufio.NewReader(conn)
+	r.conn.SetDeadline(deadline)
+
+	var setup [][]string
+	if r.password != "" {
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	replies, err := r.send(setup)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes the commands and reads their replies. The caller holds r.mu.
+func (r *Redis) send(cmds [][]string) ([]any, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		reply, err := readRedisReply(r.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readRedisReply reads one reply.
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err // $-1 is no value, nil
+		}
+		data := make([]byte, n+2) // and the \r\n
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Ping checks the server answers.
+func (r *Redis) Ping(ctx context.Context) error {
+	_, err := r.Do(ctx, "PING")
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory Redis server that knows the few commands the
+// app uses. Keys never expire.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	data  map[string]string
+	lists map[string][]string
+	cmds  []string // every command received, like "INCR key"
+	conns []net.Conn
+}
+
+// newFakeRedis starts a fake Redis server, stopped at the end of the test.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, data: make(map[string]string), lists: make(map[string][]string)}
+	go f.serve()
+	t.Cleanup(f.Stop)
+	return f
+}
+
+// URL returns the REDIS_URL of the server.
+func (f *fakeRedis) URL() string {
+	if f.password != "" {
+		return "redis://:" + f.password + "@" + f.ln.Addr().String()
+	}
+	return "redis://" + f.ln.Addr().String()
+}
+
+// Stop stops the server, closing its connections.
+func (f *fakeRedis) Stop() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+// handle answers the commands on one connection.
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		f.mu.Lock()
+		f.cmds = append(f.cmds, strings.Join(args, " "))
+		var out string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			out = "+PONG\r\n"
+		case cmd == "SELECT", cmd == "PEXPIRE":
+			out = "+OK\r\n"
+		case cmd == "GET":
+			if v, ok := f.data[args[1]]; ok {
+				out = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+			} else {
+				out = "$-1\r\n"
+			}
+		case cmd == "INCR", cmd == "DECR":
+			n, _ := strconv.Atoi(f.data[args[1]])
+			if cmd == "INCR" {
+				n++
+			} else {
+				n--
+			}
+			f.data[args[1]] = strconv.Itoa(n)
+			out = ":" + strconv.Itoa(n) + "\r\n"
+		case cmd == "LPUSH":
+			f.lists[args[1]] = append([]string{args[2]}, f.lists[args[1]]...)
+			out = ":" + strconv.Itoa(len(f.lists[args[1]])) + "\r\n"
+		case cmd == "RPOP":
+			out = "$-1\r\n"
+			if list := f.lists[args[1]]; len(list) > 0 {
+				v := list[len(list)-1]
+				f.lists[args[1]] = list[:len(list)-1]
+				out = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+			}
+		case cmd == "LLEN":
+			out = ":" + strconv.Itoa(len(f.lists[args[1]])) + "\r\n"
+		default:
+			out = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		f.mu.Unlock()
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+// Commands returns the commands received so far.
+func (f *fakeRedis) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+// TestRedis sends commands to the fake server: logging in, selecting the
+// database, pipelining, and error replies.
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t, "hunter2")
+	r, err := parseRedisURL(f.URL()+"/2", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := r.Ping(ctx); err != nil {
+		t.Fatalf("Expected PONG, got %v", err)
+	}
+	replies, err := r.Pipeline(ctx, []string{"INCR", "n"}, []string{"INCR", "n"}, []string{"GET", "n"}, []string{"GET", "missing"}, []string{"NOPE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{int64(1), int64(2), "2", nil, redisError("ERR unknown command 'NOPE'")}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Errorf("Reply %d: expected %#v, got %#v", i, want[i], replies[i])
+		}
+	}
+	if _, err := r.Do(ctx, "NOPE"); !errors.As(err, new(redisError)) {
+		t.Errorf("Expected an error reply, got %v", err)
+	}
+	if got := f.Commands(); got[0] != "AUTH hunter2" || got[1] != "SELECT 2" {
+		t.Errorf("Expected AUTH then SELECT, got %q", got)
+	}
+
+	wrong, _ := parseRedisURL("redis://:wrong@"+f.ln.Addr().String(), time.Second)
+	if err := wrong.Ping(ctx); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected a wrong password error, got %v", err)
+	}
+}
+
+// TestParseRedisURL checks REDIS_URL parsing, and that errors don't show
+// the password.
+func TestParseRedisURL(t *testing.T) {
+	r, err := parseRedisURL("rediss://:secret@cache.example.com/3", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.addr != "cache.example.com:6379" || r.password != "secret" || r.db != 3 || r.tls == nil {
+		t.Errorf("Unexpected client %+v", r)
+	}
+
+	for _, bad := range []string{"http://cache:6379", "redis://", "redis://cache/db", "redis://:secret@cache:6379/%zz"} {
+		_, err := parseRedisURL(bad, time.Second)
+		if err == nil {
+			t.Errorf("%s: expected an error", bad)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%s: the error shows the password: %v", bad, err)
+		}
+	}
+}
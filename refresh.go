@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// This file adds refresh tokens to the JWTs of jwt.go. An access token is
+// short-lived (JWT_TTL, 15 minutes by default) because it can't be taken
+// back: anything holding one is let in until it expires. A refresh token
+// lives much longer (JWT_REFRESH_TTL, 30 days), but it's only good for
+// getting a new access token, from this server, which can say no:
+//
+//	curl -X POST -d '{"refresh_token": "..."}' http://localhost:8000/api/v1/token/refresh
+//
+// Refresh tokens are random strings rather than JWTs, and the store keeps a
+// record of each, so they can be revoked: by the client signing out
+// (POST /api/v1/token/revoke) or by an operator (DELETE
+// /admin/tokens/{subject}). Only a hash of the token is stored, so a copy
+// of the data file or a backup doesn't hand them out.
+//
+// Each refresh token can be used once: refreshing returns a new one too,
+// and the old one is spent. That's rotation, and it makes a stolen refresh
+// token detectable: if both the thief and the client use it, whoever comes
+// second presents a spent token, and since the server can't tell which one
+// is the client, every token descended from the same sign-in (its
+// "family") is revoked, and the client signs in again.
+
+// RefreshToken is the store's record of a refresh token.
+type RefreshToken struct {
+	// ID is the hex SHA-256 of the token.
+	ID string `json:"id"`
+
+	// Family is shared by every token descended from the same sign-in.
+	Family  string `json:"family"`
+	Subject string `json:"subject"`
+
+	// Audience is the access tokens' audience (see jwt.go). Tokens stored
+	// before there were audiences have none, and refresh as user tokens,
+	// which can do the least.
+	Audience  string     `json:"audience,omitempty"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Why a refresh token isn't accepted.
+var (
+	errRefreshTokenInvalid = errors.New("the refresh token is unknown, expired or revoked")
+	errRefreshTokenReused  = errors.New("the refresh token has already been used, so every token from the same sign-in has been revoked; sign in again")
+)
+
+// RefreshRequest is the JSON body of POST /api/v1/token/refresh and
+// /api/v1/token/revoke.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RevokedResponse is the JSON body of DELETE /admin/tokens/{subject}.
+type RevokedResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// refreshTokenID returns the ID a token is stored under.
+func refreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens returns an access token and a refresh token for subject, for
+// audience. The refresh token starts a new family, or continues family if
+// it's set.
+func (s *Server) issueTokens(tenant, audience, subject, family string, ttl time.Duration) TokenResponse {
+	access, claims := s.issueJWT(tenant, audience, subject, ttl)
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	refresh := b64url.EncodeToString(b)
+	if family == "" {
+		family = newID()
+	}
+	now := s.clock.Now().UTC()
+	s.store.AddRefreshToken(tenant, RefreshToken{
+		ID:        refreshTokenID(refresh),
+		Family:    family,
+		Subject:   subject,
+		Audience:  audience,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.config().JWTRefreshTTL),
+	})
+	return TokenResponse{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(claims.ExpiresAt - claims.IssuedAt), RefreshToken: refresh}
+}
+
+// handleRefreshToken swaps a refresh token for a new access token and
+// refresh token.
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if !decodeValid(w, r, "token-refresh", &req) {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	token, err := s.store.UseRefreshToken(tenant, refreshTokenID(req.RefreshToken), s.clock.Now())
+	if err != nil {
+		writeProblem(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.issueTokens(tenant, cmp.Or(token.Audience, jwtAudienceUser), token.Subject, token.Family, s.config().JWTTTL))
+}
+
+// handleRevokeToken revokes a refresh token and the rest of its family,
+// which is how a client signs out. Like RFC 7009, it succeeds whether or
+// not the token was valid: there's nothing a client could do differently.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if !decodeValid(w, r, "token-refresh", &req) {
+		return
+	}
+	s.store.RevokeRefreshTokens(tenantFromContext(r.Context()), s.clock.Now(), func(t RefreshToken) bool {
+		return t.ID == refreshTokenID(req.RefreshToken)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeSubject revokes every refresh token of a subject, signing
+// them out everywhere once their access tokens expire.
+func (s *Server) handleRevokeSubject(w http.ResponseWriter, r *http.Request) {
+	subject := r.PathValue("subject")
+	n := s.store.RevokeRefreshTokens(tenantFromContext(r.Context()), s.clock.Now(), func(t RefreshToken) bool {
+		return t.Subject == subject
+	})
+	writeJSON(w, http.StatusOK, RevokedResponse{Revoked: n})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// TestRefreshToken refreshes a token pair twice, then replays a spent
+// refresh token and checks the whole family is revoked.
+func TestRefreshToken(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+
+	first := testsupport.Decode[TokenResponse](c.Post("/admin/tokens", map[string]any{"subject": "alice"}).Status(http.StatusCreated))
+	if first.RefreshToken == "" {
+		t.Fatalf("Expected a refresh token, got %+v", first)
+	}
+	for _, token := range s.store.Snapshot().Tenants[defaultTenant].RefreshTokens {
+		if strings.Contains(token.ID, first.RefreshToken) || token.ID != refreshTokenID(first.RefreshToken) {
+			t.Errorf("Expected only the token's hash to be stored, got %+v", token)
+		}
+	}
+
+	clock.Advance(20 * time.Minute)
+	second := testsupport.Decode[TokenResponse](c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": first.RefreshToken}).Status(http.StatusOK))
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("Expected the refresh token to be rotated")
+	}
+	if claims, err := s.verifyJWT(second.AccessToken); err != nil || claims.Subject != "alice" || claims.Audience != jwtAudienceGateway {
+		t.Fatalf("Expected a fresh gateway token for alice, got %+v %v", claims, err)
+	}
+	third := testsupport.Decode[TokenResponse](c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": second.RefreshToken}).Status(http.StatusOK))
+
+	// Replaying the first token gives it away as stolen, so the latest
+	// token stops working too.
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": first.RefreshToken}).
+		Status(http.StatusUnauthorized).
+		JSON(`{"detail": "the refresh token has already been used, so every token from the same sign-in has been revoked; sign in again", "...": "..."}`)
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": third.RefreshToken}).Status(http.StatusUnauthorized)
+
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": "made-up"}).
+		Status(http.StatusUnauthorized).
+		JSON(`{"detail": "the refresh token is unknown, expired or revoked", "...": "..."}`)
+	c.Post("/api/v1/token/refresh", map[string]any{}).Status(http.StatusUnprocessableEntity)
+}
+
+// TestRefreshTokenExpires checks a refresh token stops working after
+// JWT_REFRESH_TTL, and expired ones are swept from the store.
+func TestRefreshTokenExpires(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.cfg.JWTRefreshTTL = time.Hour
+
+	old := testsupport.Decode[TokenResponse](c.Post("/admin/tokens", map[string]any{"subject": "alice"}).Status(http.StatusCreated))
+	clock.Advance(time.Hour)
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": old.RefreshToken}).Status(http.StatusUnauthorized)
+
+	c.Post("/admin/tokens", map[string]any{"subject": "bob"}).Status(http.StatusCreated)
+	if tokens := s.store.Snapshot().Tenants[defaultTenant].RefreshTokens; len(tokens) != 1 || tokens[0].Subject != "bob" {
+		t.Errorf("Expected only bob's token to be kept, got %+v", tokens)
+	}
+}
+
+// TestRevokeRefreshTokens signs out one session, then every session of a
+// subject, and checks the counts and that the tokens stop working.
+func TestRevokeRefreshTokens(t *testing.T) {
+	openAdmin(t)
+	s, c := newTestServer(t)
+	s.useClock(newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)))
+
+	issue := func(subject string) string {
+		return testsupport.Decode[TokenResponse](c.Post("/admin/tokens", map[string]any{"subject": subject}).Status(http.StatusCreated)).RefreshToken
+	}
+	laptop, phone, tablet, bob := issue("alice"), issue("alice"), issue("alice"), issue("bob")
+	refreshed := testsupport.Decode[TokenResponse](c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": laptop}).Status(http.StatusOK))
+
+	// Signing out with the spent token still ends its session, and a token
+	// that doesn't exist gets the same answer.
+	c.Post("/api/v1/token/revoke", map[string]any{"refresh_token": laptop}).Status(http.StatusNoContent)
+	c.Post("/api/v1/token/revoke", map[string]any{"refresh_token": "made-up"}).Status(http.StatusNoContent)
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": refreshed.RefreshToken}).Status(http.StatusUnauthorized)
+
+	c.Delete("/admin/tokens/alice").Status(http.StatusOK).JSON(`{"revoked": 2}`)
+	for _, token := range []string{phone, tablet} {
+		c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": token}).Status(http.StatusUnauthorized)
+	}
+	c.Post("/api/v1/token/refresh", map[string]any{"refresh_token": bob}).Status(http.StatusOK)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// This file implements configuration hot reload. Restarting a process to
+// change its log level throws away in-flight requests and warm caches, so
+// settings that are safe to change on the fly (tagged reload:"true" in
+// config.go) can be reloaded while the server keeps running.
+//
+// A reload is triggered either by sending the process the SIGHUP signal,
+// the traditional Unix way of saying "re-read your configuration":
+//
+//	kill -HUP $(pidof server)
+//	docker compose kill -s HUP app
+//
+// or by calling POST /admin/reload. Either way, the .env file is read again
+// and the new configuration validated before anything changes. If it's
+// invalid the old configuration stays in place.
+
+// ConfigChange describes one setting that differs between two configurations.
+type ConfigChange struct {
+	Setting string `json:"setting"`
+	Old     any    `json:"old"`
+	New     any    `json:"new"`
+}
+
+// ReloadResponse reports the outcome of a configuration reload.
+type ReloadResponse struct {
+	// Applied lists the reloadable settings that changed.
+	Applied []ConfigChange `json:"applied"`
+
+	// RestartRequired lists settings that changed but can only take effect
+	// after a restart, such as the port.
+	RestartRequired []ConfigChange `json:"restart_required"`
+}
+
+// diffConfig compares two configurations setting by setting. Values come
+// from Settings(), so secrets stay redacted in the diff and in the logs.
+func diffConfig(old, new Config) ReloadResponse {
+	diff := ReloadResponse{Applied: []ConfigChange{}, RestartRequired: []ConfigChange{}}
+
+	newSettings := new.Settings()
+	for i, o := range old.Settings() {
+		n := newSettings[i]
+		if reflect.DeepEqual(o.Value, n.Value) {
+			continue
+		}
+
+		change := ConfigChange{Setting: o.Name, Old: o.Value, New: n.Value}
+		if o.Reloadable {
+			diff.Applied = append(diff.Applied, change)
+		} else {
+			diff.RestartRequired = append(diff.RestartRequired, change)
+		}
+	}
+	return diff
+}
+
+// mergeReloadable returns current with every reloadable field replaced by
+// its value, and source, from next. Other fields keep their current values,
+// because the running server can't apply them.
+func mergeReloadable(current, next Config) Config {
+	cv := reflect.ValueOf(&current).Elem()
+	nv := reflect.ValueOf(next)
+
+	for i := 0; i < cv.NumField(); i++ {
+		if field := cv.Type().Field(i); field.Tag.Get("reload") == "true" {
+			cv.Field(i).Set(nv.Field(i))
+			if source, ok := next.sources[field.Tag.Get("json")]; ok {
+				current.setSource(field.Tag.Get("json"), source)
+			}
+		}
+	}
+	return current
+}
+
+// reloadConfig re-reads the configuration and applies reloadable changes.
+// Either way, it publishes the outcome to the admin event feed.
+func (s *Server) reloadConfig() (diff ReloadResponse, err error) {
+	defer func() {
+		if err != nil {
+			s.adminEvent(adminEventReload, "config reload failed: "+err.Error(), nil)
+		} else {
+			s.adminEvent(adminEventReload, fmt.Sprintf("config reloaded: %d applied, %d need a restart", len(diff.Applied), len(diff.RestartRequired)), diff)
+		}
+	}()
+	if err := reloadDotenv(); err != nil {
+		return ReloadResponse{}, err
+	}
+
+	next, err := loadConfig()
+	if err != nil {
+		return ReloadResponse{}, err
+	}
+	// Secrets from Vault still win over the environment, with their latest
+	// values (see vault.go).
+	if s.vault != nil {
+		if next, err = s.vault.Apply(next); err != nil {
+			return ReloadResponse{}, err
+		}
+	}
+
+	// Hold the lock across read-modify-write so two reloads at once can't
+	// interleave.
+	s.cfgMu.Lock()
+	diff = diffConfig(s.cfg, next)
+	s.cfg = mergeReloadable(s.cfg, next)
+	s.logLevel.Set(s.cfg.slogLevel())
+	cfg := s.cfg
+	s.cfgMu.Unlock()
+
+	// The proxy routes are rebuilt every time, since the routes file may
+	// have changed even if its name hasn't.
+	if err := s.reloadProxy(context.Background(), cfg); err != nil {
+		return ReloadResponse{}, err
+	}
+
+	for _, c := range diff.Applied {
+		slog.Info("config setting reloaded", "setting", c.Setting, "old", c.Old, "new", c.New)
+	}
+	for _, c := range diff.RestartRequired {
+		slog.Warn("config setting changed but requires a restart", "setting", c.Setting, "old", c.Old, "new", c.New)
+	}
+	if len(diff.Applied) == 0 && len(diff.RestartRequired) == 0 {
+		slog.Info("config reloaded with no changes")
+	}
+	return diff, nil
+}
+
+// reloadOnSignal reloads the configuration every time the process receives
+// SIGHUP. It runs in its own goroutine for the lifetime of the server.
+func (s *Server) reloadOnSignal() {
+	// signal.Notify delivers signals to a channel instead of letting them
+	// terminate the process (SIGHUP's default behavior).
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		slog.Info("received SIGHUP, reloading configuration")
+		if _, err := s.reloadConfig(); err != nil {
+			slog.Error("config reload failed, keeping current configuration", "error", err)
+		}
+	}
+}
+
+// handleReload reloads the configuration on demand and reports what changed.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	diff, err := s.reloadConfig()
+	if err != nil {
+		slog.Error("config reload failed, keeping current configuration", "error", err)
+		writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("reload failed: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// FeatureListResponse is the JSON body returned by GET /api/v1/features.
+type FeatureListResponse struct {
+	Features []string `json:"features"`
+}
+
+// handleListFeatures returns the enabled feature flags, so clients (and
+// learners) can see the effect of a reload immediately.
+func (s *Server) handleListFeatures(w http.ResponseWriter, r *http.Request) {
+	features := s.config().FeatureFlags
+	if features == nil {
+		features = []string{}
+	}
+	writeJSON(w, http.StatusOK, FeatureListResponse{Features: features})
+}
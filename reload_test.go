@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDiffConfig checks that changes are split into those applied at
+// runtime and those that need a restart.
+func TestDiffConfig(t *testing.T) {
+	old := Config{Port: 8000, LogLevel: "info"}
+	new := Config{Port: 9000, LogLevel: "debug"}
+
+	diff := diffConfig(old, new)
+
+	if len(diff.Applied) != 1 || diff.Applied[0].Setting != "log_level" {
+		t.Errorf("Expected log_level to be applied, got %+v", diff.Applied)
+	}
+	if len(diff.RestartRequired) != 1 || diff.RestartRequired[0].Setting != "port" {
+		t.Errorf("Expected port to require a restart, got %+v", diff.RestartRequired)
+	}
+}
+
+// TestMergeReloadable checks that only reloadable settings, and their
+// sources, are copied.
+func TestMergeReloadable(t *testing.T) {
+	current := Config{Port: 8000, BannerText: "old", sources: map[string]string{"port": sourceFlag, "banner_text": sourceDefault}}
+	next := Config{Port: 9000, BannerText: "new", sources: map[string]string{"port": sourceEnv, "banner_text": sourceFile}}
+
+	merged := mergeReloadable(current, next)
+	if merged.Port != 8000 || merged.BannerText != "new" {
+		t.Errorf("Expected port 8000 and banner new, got %+v", merged)
+	}
+	if merged.sources["port"] != sourceFlag || merged.sources["banner_text"] != sourceFile {
+		t.Errorf("Expected port from the flag and banner from the file, got %v", merged.sources)
+	}
+	if current.sources["banner_text"] != sourceDefault {
+		t.Errorf("Expected the current sources unchanged, got %v", current.sources)
+	}
+}
+
+// TestHandleReload edits a .env file and reloads through the admin endpoint,
+// checking that the new banner and log level take effect.
+func TestHandleReload(t *testing.T) {
+	openAdmin(t)
+	path := filepath.Join(t.TempDir(), "reload.env")
+	t.Setenv(dotenvPathVar, path)
+	t.Setenv("BANNER_TEXT", "")
+	t.Setenv("LOG_LEVEL", "")
+	os.Unsetenv("BANNER_TEXT")
+	os.Unsetenv("LOG_LEVEL")
+
+	if err := os.WriteFile(path, []byte("BANNER_TEXT=Maintenance at noon\nLOG_LEVEL=debug\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start from the defaults, so the reload only sees the two edits.
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg)
+	mux := srv.routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var diff ReloadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if len(diff.Applied) != 2 {
+		t.Errorf("Expected 2 applied changes, got %+v", diff.Applied)
+	}
+
+	if srv.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Expected log level debug, got %v", srv.logLevel.Level())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(rec.Body.String(), "Maintenance at noon") {
+		t.Error("Expected the landing page to show the reloaded banner")
+	}
+}
+
+// TestHandleReloadInvalid checks that a bad configuration is rejected and the
+// current one kept.
+func TestHandleReloadInvalid(t *testing.T) {
+	openAdmin(t)
+	path := filepath.Join(t.TempDir(), "reload.env")
+	t.Setenv(dotenvPathVar, path)
+	t.Setenv("LOG_LEVEL", "")
+	os.Unsetenv("LOG_LEVEL")
+
+	if err := os.WriteFile(path, []byte("LOG_LEVEL=loud\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(Config{Port: 8000, LogLevel: "info"})
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got %d", rec.Code)
+	}
+	if srv.config().LogLevel != "info" {
+		t.Errorf("Expected the old log level to be kept, got %q", srv.config().LogLevel)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// This file contains small helpers for writing HTTP responses. Once an
+// application has more than a handful of endpoints, repeating the same
+// "set header, write status, encode JSON, log the error" dance in every
+// handler gets tedious and error-prone, so we collect it in one place.
+
+// ProblemResponse is an error body following RFC 7807 ("Problem Details for
+// HTTP APIs"). Using a standard error format means clients can handle errors
+// from every endpoint the same way instead of special-casing each one.
+//
+// The RFC allows problem types to add their own members. Validation errors
+// add "errors", listing every invalid field (see schema.go).
+type ProblemResponse struct {
+	Type   string       `json:"type" proto:"1"`
+	Title  string       `json:"title" proto:"2"`
+	Status int          `json:"status" proto:"3"`
+	Detail string       `json:"detail,omitempty" proto:"4"`
+	Errors []FieldError `json:"errors,omitempty" proto:"5"`
+}
+
+// writeJSON encodes v as JSON and writes it with the given status code.
+// Like the original handlers, encoding errors are only logged because the
+// status code has already been sent by the time they can happen.
+//
+// In envelope mode (see envelope.go) v becomes the envelope's data. A client
+// that asked for protobuf gets that instead, if v has a protobuf message
+// (see protobuf.go).
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	if writeProtobuf(w, status, v) {
+		return
+	}
+	if ew := envelopeOf(w); ew != nil {
+		v = Envelope{Data: v, Meta: ew.meta}
+	}
+	encodeJSON(w, status, "application/json", v)
+}
+
+// writeProblem sends an RFC 7807 problem+json error response. The title is
+// derived from the status code so callers only need to explain what went wrong.
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	sendProblem(w, ProblemResponse{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// writeValidationProblem sends a 422 listing every field that failed schema
+// validation. The type points at the schema the body was checked against.
+func writeValidationProblem(w http.ResponseWriter, schema string, errs []FieldError) {
+	sendProblem(w, ProblemResponse{
+		Type:   "/schemas/" + schema + ".json",
+		Title:  "Request body failed validation",
+		Status: http.StatusUnprocessableEntity,
+		Detail: fmt.Sprintf("%d field(s) are invalid, see errors", len(errs)),
+		Errors: errs,
+	})
+}
+
+// sendProblem writes a problem response. In envelope mode the problem
+// becomes the envelope's error, and the body is plain JSON.
+func sendProblem(w http.ResponseWriter, problem ProblemResponse) {
+	if writeProtobuf(w, problem.Status, problem) {
+		return
+	}
+	if ew := envelopeOf(w); ew != nil {
+		encodeJSON(w, problem.Status, "application/json", Envelope{Error: &problem, Meta: ew.meta})
+		return
+	}
+	encodeJSON(w, problem.Status, "application/problem+json", problem)
+}
+
+// jsonBuffer is a buffer with an encoder that writes into it. JSON
+// responses are encoded into one before being sent, and a sync.Pool lets
+// each request reuse one an earlier request is done with instead of
+// growing a new buffer every time.
+//
+// The benchmarks in render_test.go show the pool buys nothing measurable
+// over the json.NewEncoder(w) it replaced: BenchmarkWriteJSONNotes (a page
+// of 50 notes) stays at 2416 B and 51 allocations per response, and the
+// time is within noise. encoding/json already pools its own buffers, and
+// the allocations left are inside it: time.Time.MarshalJSON allocates once
+// per note, and maps are copied to sort their keys. What the pool does do
+// is make buffering the whole response, which lets encodeJSON send a
+// proper error, cost nothing extra.
+type jsonBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// maxPooledJSONBuffer is the largest buffer put back in the pool. A rare
+// huge response (a full export, say) shouldn't leave a huge buffer behind
+// for every small one to carry around.
+const maxPooledJSONBuffer = 64 << 10
+
+var jsonBufferPool = sync.Pool{
+	New: func() any {
+		jb := &jsonBuffer{}
+		jb.enc = json.NewEncoder(&jb.buf)
+		return jb
+	},
+}
+
+// encodeJSON writes v as the response body. It's encoded before anything
+// is sent, so a value that can't be encoded gets a 500 rather than half a
+// body under a success status.
+func encodeJSON(w http.ResponseWriter, status int, contentType string, v any) {
+	jb := jsonBufferPool.Get().(*jsonBuffer)
+	defer func() {
+		if jb.buf.Cap() <= maxPooledJSONBuffer {
+			jb.buf.Reset()
+			jsonBufferPool.Put(jb)
+		}
+	}()
+
+	if err := jb.enc.Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+		jb.buf.Reset()
+		status, contentType = http.StatusInternalServerError, "application/problem+json"
+		jb.enc.Encode(ProblemResponse{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: "the response could not be encoded",
+		})
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(jb.buf.Bytes())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWriteJSON checks the status, content type and body, including when
+// buffers are reused.
+func TestWriteJSON(t *testing.T) {
+	for i := range 3 {
+		rec := httptest.NewRecorder()
+		writeJSON(rec, http.StatusCreated, map[string]int{"n": i})
+		if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Unexpected response %d %v", rec.Code, rec.Header())
+		}
+		if want := fmt.Sprintf("{\"n\":%d}\n", i); rec.Body.String() != want {
+			t.Errorf("Expected %q, got %q", want, rec.Body.String())
+		}
+	}
+}
+
+// TestWriteJSONError checks a value that can't be encoded gives a 500
+// rather than half a body under the wrong status.
+func TestWriteJSONError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, map[string]float64{"n": math.NaN()})
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected a 500 problem, got %d %v", rec.Code, rec.Header())
+	}
+	var problem ProblemResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Errorf("Expected a problem body, got %q", rec.Body.String())
+	}
+}
+
+// benchmarkWriteJSON measures writing v, reporting allocations.
+func benchmarkWriteJSON(b *testing.B, v any) {
+	w := &discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// BenchmarkWriteJSONSmall writes a response like GET /health's.
+func BenchmarkWriteJSONSmall(b *testing.B) {
+	benchmarkWriteJSON(b, map[string]string{"status": "healthy", "version": version})
+}
+
+// BenchmarkWriteJSONNotes writes a page of 50 notes, like GET /api/v1/notes.
+func BenchmarkWriteJSONNotes(b *testing.B) {
+	benchmarkWriteJSON(b, benchNotes(50))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+// This file gives every request an ID. The ID is sent back in the
+// X-Request-ID header, written to the request log and (in envelope mode)
+// included in the response body, so a user reporting "it failed" can quote
+// an ID that leads straight to the matching log line.
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits the IDs we accept from clients. A proxy or caller
+// may already have assigned one, and reusing it lets a request be followed
+// across services, but it's untrusted input that ends up in logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+const requestIDContextKey contextKey = "request-id"
+
+// requestIDFromContext returns the request's ID, or "" outside a request.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestIDMiddleware assigns the request its ID: the client's X-Request-ID
+// if it sent a valid one, otherwise a new random one.
+func requestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	}
+}
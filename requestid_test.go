@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequestIDMiddleware checks a valid client ID is kept and anything
+// else is replaced.
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	h := requestIDMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	})
+
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"has spaces", false},
+		{strings.Repeat("x", 65), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestIDHeader, tt.header)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		if got := rec.Header().Get(requestIDHeader); got != seen || got == "" {
+			t.Errorf("Expected the header and context to share a non-empty ID, got %q and %q", got, seen)
+		}
+		if (seen == tt.header) != tt.keep {
+			t.Errorf("X-Request-ID %q: expected keep=%v, got ID %q", tt.header, tt.keep, seen)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file discovers upstreams: the other services the server forwards
+// requests to (see the proxy). An upstream is given a name and a target in
+// UPSTREAMS, and the target says how to find its instances:
+//
+//	http://users:8080                          a fixed address
+//	http://users-1:8080|http://users-2:8080    several fixed addresses
+//	dns+http://users-headless:8080             every address the name resolves to
+//	srv+http://_http._tcp.users.default.svc.cluster.local
+//	                                           the hosts and ports in its SRV records
+//
+// for example UPSTREAMS=users=dns+http://users-headless:8080.
+//
+// The DNS forms are how service discovery works in Kubernetes. A normal
+// Service has one virtual IP and the cluster balances connections to it,
+// but a headless Service (clusterIP: None) resolves to the IP of every
+// ready pod, so the client can pick one itself. SRV records add the port,
+// so nothing has to be configured but a name.
+//
+// Pods come and go, so targets are resolved again every
+// UPSTREAM_REFRESH_INTERVAL. If a lookup fails, the previous endpoints are
+// kept: slightly out of date is better than none at all.
+
+// dnsResolver is the part of *net.Resolver used here, so tests can fake it.
+type dnsResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// errNoEndpoints is returned by Upstream.Pick when nothing is known to be
+// running.
+var errNoEndpoints = errors.New("no endpoints")
+
+// Upstream is a named set of service instances. It's safe for concurrent
+// use.
+type Upstream struct {
+	Name   string
+	Target string
+
+	kind   string // "static", "dns" or "srv"
+	scheme string // of the endpoints: http or https
+	host   string // to look up (the SRV name for srv)
+	port   string
+
+	mu         sync.RWMutex
+	endpoints  []*url.URL
+	resolvedAt time.Time
+	err        error // from the latest lookup
+
+	// For choosing endpoints, see balancer.go.
+	balancing balancing
+	states    map[string]*endpointState // by endpoint host
+	circuit   circuit
+	next      uint64
+}
+
+// UpstreamStatus describes an upstream in GET /admin/upstreams.
+type UpstreamStatus struct {
+	Name       string     `json:"name"`
+	Target     string     `json:"target"`
+	Endpoints  []string   `json:"endpoints"`
+	Ejected    []string   `json:"ejected,omitempty"`
+	Strategy   string     `json:"strategy"`
+	Circuit    string     `json:"circuit"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// UpstreamListResponse is the JSON body returned by GET /admin/upstreams.
+type UpstreamListResponse struct {
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// parseUpstream parses a target. Static targets have their one endpoint
+// straight away.
+func parseUpstream(name, target string) (*Upstream, error) {
+	if strings.Contains(target, "|") {
+		up := &Upstream{Name: name, Target: target, kind: "static", resolvedAt: time.Now()}
+		for _, part := range strings.Split(target, "|") {
+			one, err := parseUpstream(name, part)
+			if err != nil {
+				return nil, err
+			}
+			if one.kind != "static" {
+				return nil, fmt.Errorf("%q: only fixed addresses can be listed with |", target)
+			}
+			up.endpoints = append(up.endpoints, one.endpoints...)
+		}
+		return up, nil
+	}
+
+	kind, rest := "static", target
+	if scheme, after, ok := strings.Cut(target, "+"); ok && (scheme == "dns" || scheme == "srv") {
+		kind, rest = scheme, after
+	}
+	u, err := url.Parse(rest)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("%q is not a valid target", target)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("%q: targets can't have a path", target)
+	}
+
+	up := &Upstream{Name: name, Target: target, kind: kind, scheme: u.Scheme, host: u.Hostname(), port: u.Port()}
+	switch kind {
+	case "srv":
+		if up.port != "" {
+			return nil, fmt.Errorf("%q: SRV records give the port, so the target can't", target)
+		}
+	default:
+		if up.port == "" {
+			up.port = "80"
+			if up.scheme == "https" {
+				up.port = "443"
+			}
+		}
+	}
+	if kind == "static" {
+		up.endpoints = []*url.URL{{Scheme: up.scheme, Host: net.JoinHostPort(up.host, up.port)}}
+		up.resolvedAt = time.Now()
+	}
+	return up, nil
+}
+
+// parseUpstreams parses the UPSTREAMS setting, a list of name=target.
+func parseUpstreams(entries []string) ([]*Upstream, error) {
+	var ups []*Upstream
+	for _, entry := range entries {
+		name, target, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not name=target", entry)
+		}
+		if slices.ContainsFunc(ups, func(u *Upstream) bool { return u.Name == name }) {
+			return nil, fmt.Errorf("upstream %q is defined twice", name)
+		}
+		up, err := parseUpstream(name, target)
+		if err != nil {
+			return nil, err
+		}
+		ups = append(ups, up)
+	}
+	return ups, nil
+}
+
+// Refresh looks the target up again. On failure the previous endpoints are
+// kept and the error is remembered for GET /admin/upstreams.
+func (u *Upstream) Refresh(ctx context.Context, dns dnsResolver) error {
+	if u.kind == "static" {
+		return nil
+	}
+	endpoints, err := u.lookup(ctx, dns)
+	if err == nil && len(endpoints) == 0 {
+		err = errNoEndpoints
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.err = err
+	if err != nil {
+		return err
+	}
+	u.endpoints, u.resolvedAt = endpoints, time.Now()
+
+	// Forget endpoints that have gone, unless requests are still in flight.
+	for host, st := range u.states {
+		if st.active == 0 && !slices.ContainsFunc(endpoints, func(e *url.URL) bool { return e.Host == host }) {
+			delete(u.states, host)
+		}
+	}
+	return nil
+}
+
+// lookup resolves the target to endpoints, sorted so that the order only
+// changes when the set does.
+func (u *Upstream) lookup(ctx context.Context, dns dnsResolver) ([]*url.URL, error) {
+	var hostPorts []string
+	switch u.kind {
+	case "dns":
+		addrs, err := dns.LookupHost(ctx, u.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			hostPorts = append(hostPorts, net.JoinHostPort(addr, u.port))
+		}
+	case "srv":
+		// An empty service and proto look the name up as it is.
+		_, records, err := dns.LookupSRV(ctx, "", "", u.host)
+		if err != nil {
+			return nil, err
+		}
+		// Only the records with the best (lowest) priority are used; the
+		// others are backups. Weights are ignored: the proxy balances
+		// evenly.
+		if len(records) > 0 {
+			best := slices.MinFunc(records, func(a, b *net.SRV) int { return cmp.Compare(a.Priority, b.Priority) }).Priority
+			for _, r := range records {
+				if r.Priority == best {
+					hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+				}
+			}
+		}
+	}
+
+	slices.Sort(hostPorts)
+	hostPorts = slices.Compact(hostPorts)
+	endpoints := make([]*url.URL, len(hostPorts))
+	for i, hp := range hostPorts {
+		endpoints[i] = &url.URL{Scheme: u.scheme, Host: hp}
+	}
+	return endpoints, nil
+}
+
+// Endpoints returns the endpoints found by the latest successful lookup.
+func (u *Upstream) Endpoints() []*url.URL {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.endpoints
+}
+
+// Status describes the upstream for GET /admin/upstreams.
+func (u *Upstream) Status() UpstreamStatus {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	now := u.balancing.now()
+	st := UpstreamStatus{
+		Name:      u.Name,
+		Target:    u.Target,
+		Endpoints: []string{},
+		Strategy:  cmp.Or(u.balancing.strategy, strategyRoundRobin),
+		Circuit:   u.circuit.state(u.balancing, now),
+	}
+	for _, e := range u.endpoints {
+		st.Endpoints = append(st.Endpoints, e.String())
+		if es, ok := u.states[e.Host]; ok && now.Before(es.ejectedUntil) {
+			st.Ejected = append(st.Ejected, e.String())
+		}
+	}
+	if !u.resolvedAt.IsZero() {
+		at := u.resolvedAt
+		st.ResolvedAt = &at
+	}
+	if u.err != nil {
+		st.Error = u.err.Error()
+	}
+	return st
+}
+
+// upstream returns the upstream with the given name.
+func (s *Server) upstream(name string) (*Upstream, bool) {
+	i := slices.IndexFunc(s.upstreams, func(u *Upstream) bool { return u.Name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return s.upstreams[i], true
+}
+
+// allUpstreams returns the upstreams from UPSTREAMS and those written in
+// place in proxy routes.
+func (s *Server) allUpstreams() []*Upstream {
+	ups := s.upstreams
+	if p := s.proxy.Load(); p != nil {
+		ups = append(slices.Clip(ups), p.inline...)
+	}
+	return ups
+}
+
+// refreshUpstreams looks every upstream up once, logging failures.
+func (s *Server) refreshUpstreams(ctx context.Context) {
+	for _, u := range s.allUpstreams() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := u.Refresh(ctx, s.dns); err != nil {
+			slog.Warn("Upstream lookup failed, keeping previous endpoints", "upstream", u.Name, "target", u.Target, "error", err)
+		}
+		cancel()
+	}
+}
+
+// watchUpstreams refreshes the upstreams every interval until ctx is done.
+func (s *Server) watchUpstreams(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			s.refreshUpstreams(ctx)
+		}
+	}
+}
+
+// handleListUpstreams lists the upstreams and their current endpoints.
+func (s *Server) handleListUpstreams(w http.ResponseWriter, r *http.Request) {
+	resp := UpstreamListResponse{Upstreams: []UpstreamStatus{}}
+	for _, u := range s.allUpstreams() {
+		resp.Upstreams = append(resp.Upstreams, u.Status())
+	}
+	setPagination(w, Pagination{Total: len(resp.Upstreams)})
+	writeJSON(w, http.StatusOK, resp)
+}
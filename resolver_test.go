@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// fakeDNS answers lookups from fixed tables.
+type fakeDNS struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+	err   error
+}
+
+func (f *fakeDNS) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.hosts[host], nil
+}
+
+func (f *fakeDNS) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if f.err != nil {
+		return "", nil, f.err
+	}
+	return name, f.srv[name], nil
+}
+
+// endpointStrings returns an upstream's endpoints as strings.
+func endpointStrings(u *Upstream) []string {
+	var s []string
+	for _, e := range u.Endpoints() {
+		s = append(s, e.String())
+	}
+	return s
+}
+
+// TestParseUpstreams checks the accepted target forms.
+func TestParseUpstreams(t *testing.T) {
+	ups, err := parseUpstreams([]string{
+		"users=http://users:8080",
+		"secure=https://api.example.com",
+		"pods=dns+http://users-headless:8080",
+		"named=srv+http://_http._tcp.users.default.svc.cluster.local",
+		"pair=http://users-1:8080|http://users-2:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups) != 5 {
+		t.Fatalf("Expected 5 upstreams, got %d", len(ups))
+	}
+	if got := endpointStrings(ups[0]); !slices.Equal(got, []string{"http://users:8080"}) {
+		t.Errorf("Expected a static endpoint, got %v", got)
+	}
+	if got := endpointStrings(ups[1]); !slices.Equal(got, []string{"https://api.example.com:443"}) {
+		t.Errorf("Expected the default https port, got %v", got)
+	}
+	if len(ups[2].Endpoints()) != 0 {
+		t.Error("Expected DNS targets to have no endpoints until resolved")
+	}
+	if got := endpointStrings(ups[4]); !slices.Equal(got, []string{"http://users-1:8080", "http://users-2:8080"}) {
+		t.Errorf("Expected both fixed endpoints, got %v", got)
+	}
+
+	for _, bad := range [][]string{
+		{"users"},
+		{"=http://users"},
+		{"users=ftp://users"},
+		{"users=http://users/api"},
+		{"users=srv+http://_http._tcp.users:8080"},
+		{"users=http://a", "users=http://b"},
+		{"users=http://a|dns+http://b:80"},
+	} {
+		if _, err := parseUpstreams(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
+
+// TestUpstreamRefreshDNS checks a headless-service lookup, and that a
+// failed lookup keeps the previous endpoints.
+func TestUpstreamRefreshDNS(t *testing.T) {
+	dns := &fakeDNS{hosts: map[string][]string{"users-headless": {"10.0.0.2", "10.0.0.1", "10.0.0.2"}}}
+	u, err := parseUpstream("users", "dns+http://users-headless:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.Refresh(context.Background(), dns); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}
+	if got := endpointStrings(u); !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	dns.err = errors.New("no such host")
+	if err := u.Refresh(context.Background(), dns); err == nil {
+		t.Error("Expected the failed lookup to be reported")
+	}
+	if got := endpointStrings(u); !slices.Equal(got, want) {
+		t.Errorf("Expected the previous endpoints to be kept, got %v", got)
+	}
+	if st := u.Status(); st.Error != "no such host" || st.ResolvedAt == nil {
+		t.Errorf("Unexpected status %+v", st)
+	}
+}
+
+// TestUpstreamRefreshSRV checks only the best-priority records are used.
+func TestUpstreamRefreshSRV(t *testing.T) {
+	const name = "_http._tcp.users.default.svc.cluster.local"
+	dns := &fakeDNS{srv: map[string][]*net.SRV{name: {
+		{Target: "pod-b.users.", Port: 9000, Priority: 10},
+		{Target: "backup.users.", Port: 9000, Priority: 20},
+		{Target: "pod-a.users.", Port: 9001, Priority: 10},
+	}}}
+	u, err := parseUpstream("users", "srv+http://"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Refresh(context.Background(), dns); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://pod-a.users:9001", "http://pod-b.users:9000"}
+	if got := endpointStrings(u); !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// TestUpstreamPick checks endpoints are taken in turn.
+func TestUpstreamPick(t *testing.T) {
+	dns := &fakeDNS{hosts: map[string][]string{"app": {"10.0.0.1", "10.0.0.2"}}}
+	u, _ := parseUpstream("app", "dns+http://app:80")
+	if _, err := u.Pick(); !errors.Is(err, errNoEndpoints) {
+		t.Errorf("Expected errNoEndpoints before resolving, got %v", err)
+	}
+	if err := u.Refresh(context.Background(), dns); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for range 4 {
+		e, err := u.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e.Host)
+	}
+	want := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// TestListUpstreams checks GET /admin/upstreams.
+func TestListUpstreams(t *testing.T) {
+	openAdmin(t)
+	cfg := defaultConfig(t)
+	cfg.Upstreams = []string{"users=dns+http://users-headless:8080", "orders=http://orders:8080"}
+	s := newServer(cfg)
+	s.dns = &fakeDNS{hosts: map[string][]string{"users-headless": {"10.0.0.1"}}}
+	s.refreshUpstreams(context.Background())
+
+	if u, ok := s.upstream("orders"); !ok || u.Target != "http://orders:8080" {
+		t.Errorf("Expected to find the orders upstream, got %v", u)
+	}
+
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/upstreams", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var resp UpstreamListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Upstreams) != 2 || resp.Upstreams[0].Name != "users" || !slices.Equal(resp.Upstreams[0].Endpoints, []string{"http://10.0.0.1:8080"}) {
+		t.Errorf("Unexpected upstreams %+v", resp.Upstreams)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// This file implements a route registry: a list describing every endpoint the
+// server exposes. Because routes are recorded at the moment they're registered
+// with the router, the list can never drift out of date the way hand-written
+// documentation does. Both GET /admin/routes and the "routes" CLI command are
+// generated from it.
+
+// Route describes one registered endpoint.
+type Route struct {
+	// Methods lists the HTTP methods the route accepts. "ANY" means the
+	// pattern has no method and matches every request method.
+	Methods []string `json:"methods"`
+
+	// Path is the path part of the pattern, including {wildcards}.
+	Path string `json:"path"`
+
+	// Handler is the name of the Go function that handles the request.
+	Handler string `json:"handler"`
+
+	// Middleware lists the middleware wrapped around the handler, outermost
+	// first, which is the order they see the request in.
+	Middleware []string `json:"middleware"`
+}
+
+// RouteListResponse is the JSON body returned by GET /admin/routes.
+type RouteListResponse struct {
+	Routes []Route `json:"routes"`
+}
+
+// middleware is a named middleware function. Giving middleware names lets the
+// registry report exactly which chain each handler is wrapped in.
+type middleware struct {
+	name string
+	wrap func(http.HandlerFunc) http.HandlerFunc
+}
+
+// newRoute builds the registry entry for a pattern such as "GET /notes/{id}".
+func newRoute(pattern string, h http.HandlerFunc, chain []middleware) Route {
+	route := Route{Methods: []string{"ANY"}, Path: pattern, Handler: handlerName(h)}
+
+	// A pattern may start with a method followed by a space.
+	if method, path, ok := strings.Cut(pattern, " "); ok {
+		route.Methods = []string{method}
+		// Go's router also sends HEAD requests to GET handlers.
+		if method == http.MethodGet {
+			route.Methods = append(route.Methods, http.MethodHead)
+		}
+		route.Path = path
+	}
+
+	for _, m := range chain {
+		route.Middleware = append(route.Middleware, m.name)
+	}
+	return route
+}
+
+// handlerName returns a readable name for a handler function, such as
+// "handleHealth" or "(*Server).handleListNotes". The runtime package can look
+// up the name of any function from its address in memory, so h can be any
+// function, such as an extension handler taking the Server.
+func handlerName(h any) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+
+	// Strip the package ("main." in the binary, the full import path in
+	// tests) and the "-fm" suffix Go adds to method values.
+	name = strings.TrimSuffix(name, "-fm")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		name = rest
+	}
+	return name
+}
+
+// handleListRoutes returns the route registry as JSON.
+func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, RouteListResponse{Routes: s.registry})
+}
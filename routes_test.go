@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestNewRoute checks how patterns are split into methods and paths.
+func TestNewRoute(t *testing.T) {
+	chain := []middleware{{name: "logging", wrap: loggingMiddleware}}
+
+	route := newRoute("GET /health", handleHealth, chain)
+	want := Route{
+		Methods:    []string{"GET", "HEAD"},
+		Path:       "/health",
+		Handler:    "handleHealth",
+		Middleware: []string{"logging"},
+	}
+	if !reflect.DeepEqual(route, want) {
+		t.Errorf("Expected %+v, got %+v", want, route)
+	}
+
+	if route := newRoute("/", handleHealth, nil); route.Methods[0] != "ANY" || route.Path != "/" {
+		t.Errorf("Expected a method-less pattern to match ANY method, got %+v", route)
+	}
+}
+
+// TestHandleListRoutes checks that the admin endpoint reports every route,
+// including method handler names.
+func TestHandleListRoutes(t *testing.T) {
+	openAdmin(t)
+	mux := newServer(Config{}).routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var response RouteListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+
+	found := false
+	for _, r := range response.Routes {
+		if r.Path == "/api/v1/notes/{id}" && r.Handler == "(*Server).handleGetNote" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected GET /api/v1/notes/{id} in %+v", response.Routes)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"slices"
+	"time"
+)
+
+// This file exports the Go runtime's own measurements to /metrics. When
+// requests get slow, the cause is often in the runtime rather than the
+// code: the garbage collector stopping the world, the heap growing until
+// it's collected constantly, goroutines piling up, or more runnable
+// goroutines than CPUs, so they queue for one. Graphed next to request
+// latency, these show which it is.
+//
+// The runtime/metrics package reads them cheaply, without stopping the
+// world as runtime.ReadMemStats does. They're collected every
+// RUNTIME_METRICS_INTERVAL (0 turns collection off) rather than on every
+// scrape, so scraping stays cheap too:
+//
+//	go_goroutines                        live goroutines
+//	go_sched_gomaxprocs_threads          how many can run at once
+//	go_memory_heap_objects_bytes         memory in live and unswept objects
+//	go_memory_total_bytes                everything the runtime has mapped
+//	go_gc_cycles_total                   garbage collections so far
+//	go_gc_pause_seconds{quantile}        stop-the-world pauses for GC, and
+//	go_sched_latency_seconds{quantile}   time runnable goroutines waited for
+//	                                     a CPU, over the last interval
+//
+// The dashboard shows the same numbers, next to request latency.
+
+// RuntimeStats are the runtime's measurements at the last collection.
+// The quantiles are of the pauses and scheduling delays since the one
+// before.
+type RuntimeStats struct {
+	Goroutines      uint64  `json:"goroutines"`
+	GOMAXPROCS      uint64  `json:"gomaxprocs"`
+	HeapBytes       uint64  `json:"heap_bytes"`
+	TotalBytes      uint64  `json:"total_bytes"`
+	GCCycles        uint64  `json:"gc_cycles"`
+	GCPauseP50      float64 `json:"gc_pause_p50_ms"`
+	GCPauseP99      float64 `json:"gc_pause_p99_ms"`
+	SchedLatencyP50 float64 `json:"sched_latency_p50_ms"`
+	SchedLatencyP99 float64 `json:"sched_latency_p99_ms"`
+}
+
+// runtimeSamples are the runtime metrics read at each collection.
+var runtimeSamples = []string{
+	"/sched/goroutines:goroutines",
+	"/sched/gomaxprocs:threads",
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/total:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/sched/pauses/total/gc:seconds",
+	"/sched/latencies:seconds",
+}
+
+// runtimeCollector reads the runtime metrics, keeping the histograms from
+// the last read to work out what changed since.
+type runtimeCollector struct {
+	samples []metrics.Sample
+	prev    map[string]*metrics.Float64Histogram
+}
+
+func newRuntimeCollector() *runtimeCollector {
+	c := &runtimeCollector{prev: make(map[string]*metrics.Float64Histogram)}
+	for _, name := range runtimeSamples {
+		c.samples = append(c.samples, metrics.Sample{Name: name})
+	}
+	return c
+}
+
+// collect reads the runtime metrics. Any this Go version doesn't have are
+// left at zero.
+func (c *runtimeCollector) collect() RuntimeStats {
+	metrics.Read(c.samples)
+	var stats RuntimeStats
+	for _, sample := range c.samples {
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			n := sample.Value.Uint64()
+			switch sample.Name {
+			case "/sched/goroutines:goroutines":
+				stats.Goroutines = n
+			case "/sched/gomaxprocs:threads":
+				stats.GOMAXPROCS = n
+			case "/memory/classes/heap/objects:bytes":
+				stats.HeapBytes = n
+			case "/memory/classes/total:bytes":
+				stats.TotalBytes = n
+			case "/gc/cycles/total:gc-cycles":
+				stats.GCCycles = n
+			}
+		case metrics.KindFloat64Histogram:
+			cur := sample.Value.Float64Histogram()
+			prev := c.prev[sample.Name]
+			c.prev[sample.Name] = cur
+			p50 := histogramQuantile(cur, prev, 0.5).Seconds() * 1000
+			p99 := histogramQuantile(cur, prev, 0.99).Seconds() * 1000
+			switch sample.Name {
+			case "/sched/pauses/total/gc:seconds":
+				stats.GCPauseP50, stats.GCPauseP99 = p50, p99
+			case "/sched/latencies:seconds":
+				stats.SchedLatencyP50, stats.SchedLatencyP99 = p50, p99
+			}
+		}
+	}
+	return stats
+}
+
+// histogramQuantile returns the q quantile of the values a runtime
+// histogram has counted since prev (since the process started if prev is
+// nil), as the upper bound of the bucket it falls in. The runtime only
+// keeps totals, so what happened recently has to be worked out from the
+// difference.
+func histogramQuantile(cur, prev *metrics.Float64Histogram, q float64) time.Duration {
+	counts := slices.Clone(cur.Counts)
+	if prev != nil && len(prev.Counts) == len(counts) {
+		for i := range counts {
+			counts[i] -= prev.Counts[i]
+		}
+	}
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; float64(seen) >= q*float64(total) {
+			// The bucket's upper bound, unless that's infinity.
+			bound := cur.Buckets[i+1]
+			if math.IsInf(bound, 1) {
+				bound = cur.Buckets[i]
+			}
+			return time.Duration(bound * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// collectRuntimeMetrics records the runtime metrics now and then every
+// interval, until ctx is done.
+func (s *Server) collectRuntimeMetrics(ctx context.Context, interval time.Duration) {
+	c := newRuntimeCollector()
+	s.metrics.SetRuntime(c.collect())
+
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.metrics.SetRuntime(c.collect())
+	}
+}
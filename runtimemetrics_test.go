@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRuntimeMetrics checks the runtime's measurements are collected on
+// every tick and exported.
+func TestRuntimeMetrics(t *testing.T) {
+	s, c := newTestServer(t)
+	if strings.Contains(c.Get("/metrics").Body.String(), "go_goroutines") {
+		t.Error("Expected no runtime metrics before collection")
+	}
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.collectRuntimeMetrics(ctx, 15*time.Second)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+
+	runtime.GC()
+	cycles := s.metrics.Snapshot().Runtime.GCCycles
+	clock.Advance(15 * time.Second)
+	eventually(t, func() bool { return s.metrics.Snapshot().Runtime.GCCycles > cycles })
+
+	rt := s.metrics.Snapshot().Runtime
+	if rt.Goroutines == 0 || rt.GOMAXPROCS == 0 || rt.HeapBytes == 0 || rt.TotalBytes < rt.HeapBytes {
+		t.Errorf("Expected plausible runtime stats, got %+v", rt)
+	}
+	metricsText := c.Get("/metrics").Body.String()
+	for _, name := range []string{"go_goroutines ", "go_memory_heap_objects_bytes ", "go_gc_cycles_total ", `go_gc_pause_seconds{quantile="0.99"} `, `go_sched_latency_seconds{quantile="0.5"} `} {
+		if !strings.Contains(metricsText, "\n"+name) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", name, metricsText)
+		}
+	}
+}
+
+// TestHistogramQuantile checks quantiles are of what was counted since
+// the previous histogram.
+func TestHistogramQuantile(t *testing.T) {
+	prev := &metrics.Float64Histogram{Counts: []uint64{5, 0, 0}, Buckets: []float64{0, 0.001, 0.01, 0.1}}
+	cur := &metrics.Float64Histogram{Counts: []uint64{5, 9, 1}, Buckets: prev.Buckets}
+
+	if got := histogramQuantile(cur, nil, 0.25); got != time.Millisecond {
+		t.Errorf("Expected 1ms since the start, got %v", got)
+	}
+	if got := histogramQuantile(cur, prev, 0.5); got != 10*time.Millisecond {
+		t.Errorf("Expected 10ms since prev, got %v", got)
+	}
+	if got := histogramQuantile(cur, prev, 1); got != 100*time.Millisecond {
+		t.Errorf("Expected 100ms at the top, got %v", got)
+	}
+	if got := histogramQuantile(prev, prev, 0.5); got != 0 {
+		t.Errorf("Expected 0 with nothing new, got %v", got)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file validates JSON request bodies against JSON Schemas. A schema is
+// a JSON document describing what valid JSON looks like ("an object with a
+// string title of at most 200 characters..."). Keeping the rules in schemas
+// rather than scattered if-statements has two benefits: every problem in a
+// request is reported at once, each pointing at the offending field, and
+// clients can download the same schemas from /schemas/ to validate before
+// they even send a request.
+//
+// The schemas live in the schemas directory and are embedded into the
+// binary. The validator below implements the commonly used subset of JSON
+// Schema (draft 2020-12): type, properties, required, additionalProperties,
+// items, enum, minLength, maxLength, pattern, minimum, maximum, minItems and
+// maxItems. A schema using any other keyword fails to load, rather than
+// having that keyword silently ignored.
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// requestSchemas holds the parsed schemas by name ("note-create"). They're
+// embedded, so a broken one is a programming error and panics at startup.
+var requestSchemas = mustLoadSchemas(schemaFiles, "schemas")
+
+// maxValidatedBody limits how much of a request body is read for validation.
+const maxValidatedBody = 1 << 20 // 1 MiB
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	// Annotations: accepted, but don't affect validation.
+	SchemaURI   string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// mustLoadSchemas parses every schema in dir.
+func mustLoadSchemas(fsys fs.FS, dir string) map[string]*Schema {
+	schemas, err := loadSchemas(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return schemas
+}
+
+// loadSchemas parses every .json file in dir into a Schema.
+func loadSchemas(fsys fs.FS, dir string) (map[string]*Schema, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]*Schema)
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseSchema(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		schemas[strings.TrimSuffix(path.Base(name), ".json")] = s
+	}
+	return schemas, nil
+}
+
+// parseSchema decodes a schema, rejecting unsupported keywords.
+func parseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// compile prepares regular expressions throughout the schema.
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// FieldError describes one validation failure. Pointer is a JSON Pointer
+// (RFC 6901) to the offending value, such as "/operations/2/title"; an empty
+// pointer means the whole body.
+type FieldError struct {
+	Pointer string `json:"pointer" proto:"1"`
+	Detail  string `json:"detail" proto:"2"`
+}
+
+// Validate checks a decoded JSON value against the schema and returns every
+// problem found, ordered by pointer.
+func (s *Schema) Validate(v any) []FieldError {
+	errs := s.validate(v, "")
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Pointer < errs[j].Pointer })
+	return errs
+}
+
+// validate checks one value. ptr is the value's location in the document.
+func (s *Schema) validate(v any, ptr string) []FieldError {
+	fail := func(format string, args ...any) []FieldError {
+		return []FieldError{{Pointer: ptr, Detail: fmt.Sprintf(format, args...)}}
+	}
+
+	// A value of the wrong type can't be checked any further.
+	if s.Type != "" && jsonType(v, s.Type) != s.Type {
+		return fail("must be of type %s, got %s", s.Type, jsonType(v, ""))
+	}
+
+	var errs []FieldError
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || jsonEqual(v, e)
+		}
+		if !found {
+			errs = append(errs, fail("must be one of %s", mustMarshal(s.Enum))...)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v) // lengths count characters, not bytes
+		if s.MinLength != nil && n < *s.MinLength {
+			errs = append(errs, fail("must be at least %d characters", *s.MinLength)...)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			errs = append(errs, fail("must be at most %d characters", *s.MaxLength)...)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			errs = append(errs, fail("must match the pattern %s", s.Pattern)...)
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs = append(errs, fail("must be at least %v", *s.Minimum)...)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errs = append(errs, fail("must be at most %v", *s.Maximum)...)
+		}
+
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errs = append(errs, fail("must have at least %d items", *s.MinItems)...)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errs = append(errs, fail("must have at most %d items", *s.MaxItems)...)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s/%d", ptr, i))...)
+			}
+		}
+
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, FieldError{Pointer: ptr + "/" + escapePointer(name), Detail: "is required"})
+			}
+		}
+		for name, value := range v {
+			child := ptr + "/" + escapePointer(name)
+			if prop, ok := s.Properties[name]; ok {
+				errs = append(errs, prop.validate(value, child)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, FieldError{Pointer: child, Detail: "is not an allowed field"})
+			}
+		}
+	}
+	return errs
+}
+
+// jsonType names the JSON type of a decoded value. A whole number counts as
+// an "integer" when that's the type being checked for, and as a "number"
+// otherwise.
+func jsonType(v any, want string) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if want == "integer" && v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer.
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// mustMarshal encodes a value that is known to be encodable.
+func mustMarshal(v any) string {
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// decodeValid reads a JSON request body, validates it against the named
+// schema and decodes it into dst. If anything is wrong it writes the problem
+// response itself and returns false, so handlers can simply return.
+//
+// A protobuf body (see protobuf.go) is decoded into dst's message and
+// validated as the JSON it stands for.
+func decodeValid(w http.ResponseWriter, r *http.Request, schema string, dst any) bool {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBody))
+	if err != nil {
+		writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxValidatedBody))
+		return false
+	}
+
+	if isProtobuf(r.Header.Get("Content-Type")) {
+		doc, err := protobufDocument(data, dst)
+		switch {
+		case errors.Is(err, errNotProtoMessage):
+			writeProblem(w, http.StatusUnsupportedMediaType, err.Error())
+			return false
+		case err != nil:
+			writeProblem(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		return decodeValidDocument(w, schema, doc, dst)
+	}
+
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		writeProblem(w, http.StatusBadRequest, "request body must be valid JSON")
+		return false
+	}
+	return decodeValidDocument(w, schema, doc, dst)
+}
+
+// decodeValidDocument validates a decoded JSON document against the named
+// schema and decodes it into dst, as decodeValid does.
+func decodeValidDocument(w http.ResponseWriter, schema string, doc any, dst any) bool {
+	if errs := requestSchemas[schema].Validate(doc); len(errs) > 0 {
+		writeValidationProblem(w, schema, errs)
+		return false
+	}
+
+	// The document matched the schema, so this can only fail if the schema
+	// and the Go type disagree: a bug, not a client error. It's decoded
+	// from the validated document re-encoded, not the body as sent: JSON
+	// Schema counts 1e2 and 100.0 as integers, but encoding/json only
+	// decodes 100 into an int. Unknown fields are rejected here too, in
+	// case a schema forgets additionalProperties.
+	normalized, _ := json.Marshal(doc)
+	dec := json.NewDecoder(bytes.NewReader(normalized))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "request passed validation but could not be decoded")
+		return false
+	}
+	return true
+}
+
+// handleListSchemas lists the available schemas.
+func handleListSchemas(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(requestSchemas))
+	for name := range requestSchemas {
+		names = append(names, "/schemas/"+name+".json")
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, map[string][]string{"schemas": names})
+}
+
+// handleGetSchema serves one schema exactly as it's written in the file.
+func handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	data, err := fs.ReadFile(schemaFiles, "schemas/"+path.Base(r.PathValue("name")))
+	if err != nil {
+		writeProblem(w, http.StatusNotFound, "schema not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(data)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestSchemaValidate checks each supported keyword and that errors point at
+// the offending field.
+func TestSchemaValidate(t *testing.T) {
+	schema, err := parseSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"tags": {"type": "array", "maxItems": 2, "items": {"enum": ["a", "b"]}}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+
+	tests := []struct {
+		doc  string
+		want []string // pointers of the expected errors, in order
+	}{
+		{`{"name": "abc", "age": 30, "tags": ["a"]}`, nil},
+		{`[]`, []string{""}},
+		{`{}`, []string{"/name"}},
+		{`{"name": "a"}`, []string{"/name"}},
+		{`{"name": "abcdef"}`, []string{"/name"}},
+		{`{"name": "ABC"}`, []string{"/name"}},
+		{`{"name": "ab", "age": 1.5}`, []string{"/age"}},
+		{`{"name": "ab", "age": -1}`, []string{"/age"}},
+		{`{"name": "ab", "tags": ["a", "c"]}`, []string{"/tags/1"}},
+		{`{"name": "ab", "tags": ["a", "b", "a"]}`, []string{"/tags"}},
+		{`{"name": 5, "x/y": true}`, []string{"/name", "/x~1y"}},
+	}
+
+	for _, tt := range tests {
+		var doc any
+		if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range schema.Validate(doc) {
+			got = append(got, e.Pointer)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Validate(%s): expected errors at %q, got %q", tt.doc, tt.want, got)
+		}
+	}
+}
+
+// TestLoadSchemasRejectsUnknownKeywords makes sure an unsupported keyword
+// is an error rather than a rule that is quietly not enforced.
+func TestLoadSchemasRejectsUnknownKeywords(t *testing.T) {
+	fsys := fstest.MapFS{
+		"schemas/bad.json": {Data: []byte(`{"type": "string", "format": "email"}`)},
+	}
+	if _, err := loadSchemas(fsys, "schemas"); err == nil {
+		t.Error("Expected an error for the unsupported format keyword")
+	}
+}
+
+// TestCreateNoteFieldErrors checks the problem response lists every invalid
+// field, not just the first.
+func TestCreateNoteFieldErrors(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	body := `{"title": "", "body": 7, "colour": "red"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422, got %d", rec.Code)
+	}
+
+	var problem ProblemResponse
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatalf("Failed to decode problem: %v", err)
+	}
+	if problem.Type != "/schemas/note-create.json" {
+		t.Errorf("Expected the type to link to the schema, got %q", problem.Type)
+	}
+
+	pointers := map[string]bool{}
+	for _, e := range problem.Errors {
+		pointers[e.Pointer] = true
+	}
+	for _, want := range []string{"/title", "/body", "/colour"} {
+		if !pointers[want] {
+			t.Errorf("Expected an error for %s, got %+v", want, problem.Errors)
+		}
+	}
+}
+
+// TestSchemaEndpoints checks clients can list and download the schemas.
+func TestSchemaEndpoints(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schemas/", nil))
+	if !strings.Contains(rec.Body.String(), "/schemas/note-create.json") {
+		t.Errorf("Expected note-create.json in the index, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schemas/note-create.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/schema+json" {
+		t.Errorf("Expected the schema, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if _, err := parseSchema(rec.Body.Bytes()); err != nil {
+		t.Errorf("Expected the served schema to parse: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schemas/missing.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown schema, got %d", rec.Code)
+	}
+}
+
+// serveFuzz serves a fuzzed request and fails on a server error: whatever
+// a client sends should get a 4xx at worst. A panic fails the fuzz test by
+// itself.
+func serveFuzz(t *testing.T, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code >= 500 {
+		t.Fatalf("%s %s: got %d %s", req.Method, req.URL, rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+// quietLogs discards log output while f runs: fuzzing makes a lot of
+// requests, and the access log would bury any failure.
+func quietLogs(f *testing.F) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(out) })
+}
+
+// FuzzRequestBodies sends arbitrary bodies to every endpoint that decodes
+// JSON against a schema.
+//
+//	go test -fuzz FuzzRequestBodies -fuzztime 30s
+func FuzzRequestBodies(f *testing.F) {
+	targets := []string{"/api/v1/notes", "/api/v1/notes:batch", "/api/v1/links", "/api/v1/guestbook"}
+	for i, body := range []string{
+		`{"title": "Hello", "body": "World"}`,
+		`{"operations": [{"op": "create", "title": "a"}, {"op": "delete", "id": "x"}], "atomic": true}`,
+		`{"url": "https://example.com", "ttl_seconds": 1e2}`,
+		`{"name": "Ada", "message": "Hi", "extra": 1}`,
+		`{"title": "\u0000", "body": null}`,
+		`[{}]`,
+	} {
+		f.Add(uint8(i), []byte(body))
+	}
+
+	h := newServer(Config{}).routes()
+	quietLogs(f)
+	f.Fuzz(func(t *testing.T, target uint8, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, targets[int(target)%len(targets)], bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := serveFuzz(t, h, req)
+		// A failed atomic batch answers 422 with its usual results.
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("Expected a JSON response, got %d %q", rec.Code, rec.Body.String())
+		}
+	})
+}
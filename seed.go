@@ -0,0 +1,92 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// This file implements demo data seeding. A freshly started environment is
+// empty, which makes for a dull first look; seeding fills it with a few
+// example records so there's something to explore straight away.
+//
+// Seeding is idempotent: every seed record has a fixed ID and is "upserted"
+// (inserted if missing, updated if different), so running it twice doesn't
+// create duplicates. That makes it safe to run on every deploy.
+
+//go:embed seed/seed.json
+var seedFS embed.FS
+
+// SeedData is the structure of seed/seed.json. Each collection has its own
+// key, so adding demo data for a new module means adding a key here and a
+// matching section to the file.
+type SeedData struct {
+	Notes     []Note           `json:"notes"`
+	Guestbook []GuestbookEntry `json:"guestbook"`
+}
+
+// SeedResult counts what happened to the records of one collection.
+type SeedResult struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// SeedResponse is the JSON body returned by POST /admin/seed.
+type SeedResponse struct {
+	Tenant    string     `json:"tenant"`
+	Notes     SeedResult `json:"notes"`
+	Guestbook SeedResult `json:"guestbook"`
+}
+
+// count records the outcome of one upsert.
+func (r *SeedResult) count(result upsertResult) {
+	switch result {
+	case upsertCreated:
+		r.Created++
+	case upsertUpdated:
+		r.Updated++
+	default:
+		r.Unchanged++
+	}
+}
+
+// loadSeedData reads the embedded seed file.
+func loadSeedData() (SeedData, error) {
+	var data SeedData
+
+	raw, err := seedFS.ReadFile("seed/seed.json")
+	if err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return data, fmt.Errorf("parsing seed data: %w", err)
+	}
+	return data, nil
+}
+
+// seed upserts the seed data into the tenant's part of the store.
+func (s *Server) seed(tenant string, data SeedData) SeedResponse {
+	resp := SeedResponse{Tenant: tenant}
+
+	for _, note := range data.Notes {
+		resp.Notes.count(s.store.UpsertNote(tenant, note))
+	}
+	for _, entry := range data.Guestbook {
+		resp.Guestbook.count(s.store.UpsertGuestbookEntry(tenant, entry))
+	}
+	return resp
+}
+
+// handleSeed seeds demo data for the request's tenant.
+func (s *Server) handleSeed(w http.ResponseWriter, r *http.Request) {
+	data, err := loadSeedData()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := s.seed(tenantFromContext(r.Context()), data)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestSeedIsIdempotent seeds twice and checks the second run changes nothing.
+func TestSeedIsIdempotent(t *testing.T) {
+	srv := newServer(Config{})
+
+	data, err := loadSeedData()
+	if err != nil {
+		t.Fatalf("Failed to load seed data: %v", err)
+	}
+	if len(data.Notes) == 0 {
+		t.Fatal("Expected seed data to contain notes")
+	}
+
+	first := srv.seed("demo", data)
+	if first.Notes.Created != len(data.Notes) {
+		t.Errorf("Expected %d notes created, got %+v", len(data.Notes), first.Notes)
+	}
+
+	second := srv.seed("demo", data)
+	if second.Notes.Created != 0 || second.Notes.Unchanged != len(data.Notes) {
+		t.Errorf("Expected the second run to change nothing, got %+v", second.Notes)
+	}
+
+	if got := len(srv.store.ListNotes("demo")); got != len(data.Notes) {
+		t.Errorf("Expected %d notes, got %d", len(data.Notes), got)
+	}
+	if _, total := srv.store.ListGuestbook("demo", 0, 1); total != len(data.Guestbook) || second.Guestbook.Created != 0 {
+		t.Errorf("Expected %d guestbook entries seeded once, got %d and %+v", len(data.Guestbook), total, second.Guestbook)
+	}
+}
+
+// TestSeedCommand runs the seed command against a real test server.
+func TestSeedCommand(t *testing.T) {
+	openAdmin(t)
+	srv := newServer(Config{Tenants: []string{"acme"}})
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"seed", "-url", ts.URL + "/admin/seed", "-tenant", "acme"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	if !strings.Contains(stdout.String(), `"acme"`) {
+		t.Errorf("Expected output to mention the tenant, got %q", stdout.String())
+	}
+	if len(srv.store.ListNotes("acme")) == 0 {
+		t.Error("Expected acme to have seeded notes")
+	}
+}
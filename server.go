@@ -0,0 +1,380 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Server holds the state that handlers share: the data store, the metrics
+// collector and configuration. Handlers that need this state are methods on
+// *Server, while stateless handlers like handleHealth stay plain functions.
+//
+// Passing state around in a struct (instead of using global variables) makes
+// it obvious what each handler depends on and lets tests build a fresh,
+// isolated server for every test case.
+type Server struct {
+	store   *Store
+	blobs   BlobStore
+	clock   Clock
+	metrics *Metrics
+	assets  *Assets
+	quotes  *Quotes
+	weather *WeatherService
+
+	// faults makes handlers fail on purpose, in tests and dev mode (see
+	// faults.go).
+	faults *faultInjector
+
+	// inFlight counts the requests being handled, for the limits in
+	// limit.go.
+	inFlight *inFlight
+
+	// flights are the requests being handled on behalf of identical ones
+	// (see dedup.go).
+	flights *flightGroup
+
+	// idempotency keeps responses to requests with an Idempotency-Key, to
+	// replay to retries (see idempotency.go).
+	idempotency *idempotencyStore
+
+	// jwtKeys are the keys that sign and verify JWTs (see jwt.go).
+	jwtKeys *jwtKeyRing
+
+	// signatures are the request signatures seen recently, to turn away
+	// replays (see signature.go).
+	signatures *seenSignatures
+
+	// redis is the Redis server shared with the other instances, if
+	// REDIS_URL is set (see redis.go); nil otherwise.
+	redis *Redis
+
+	// rateLimiter counts each client's requests, for RATE_LIMIT (see
+	// ratelimit.go).
+	rateLimiter *rateLimiter
+
+	// mailer sends email, or is nil if it can't (see email.go), and
+	// contactLimiter counts the contact form's messages, for
+	// CONTACT_RATE_LIMIT (see contact.go).
+	mailer         Mailer
+	contactLimiter *rateLimiter
+
+	// logins counts failed logins, for LOGIN_MAX_FAILURES (see
+	// lockout.go).
+	logins *loginGuard
+
+	// passwordHashing limits the memory of the password hashes running at
+	// once (see hashlimit.go).
+	passwordHashing *hashLimiter
+
+	// notifier posts significant events to chat, or is nil if no webhook
+	// is configured (see notify.go).
+	notifier *Notifier
+
+	// statusCounts are the request totals at the last status summary (see
+	// status.go).
+	statusCounts statusCounts
+
+	// projection is the read model of the event-sourced counter (see
+	// projection.go).
+	projection *CounterProjection
+
+	// logTail keeps the recent log entries for /admin/logs/tail (see
+	// logtail.go).
+	logTail *LogTail
+
+	// adminEvents is the feed of events for operators at /admin/events
+	// (see adminevents.go).
+	adminEvents *AdminEvents
+
+	// maintenance is set while maintenance mode is on, and nil otherwise
+	// (see maintenance.go).
+	maintenance atomic.Pointer[MaintenanceState]
+
+	// shedder turns requests away while the instance is saturated (see
+	// shed.go).
+	shedder *loadShedder
+
+	// inspector remembers recent requests for the /inspect page.
+	inspector *Inspector
+
+	// outbound is the HTTP client for calling other services. It records
+	// its requests in metrics (see outbound.go).
+	outbound *http.Client
+
+	// liveReload notifies browsers when assets change (dev mode only).
+	liveReload *LiveReload
+
+	// cfg can be replaced at runtime by a configuration reload, so it's
+	// guarded by a mutex. Always read it through config().
+	cfgMu sync.RWMutex
+	cfg   Config
+
+	// logLevel controls which log messages are printed. A slog.LevelVar can
+	// be changed while the program runs, which is how LOG_LEVEL is reloaded.
+	logLevel *slog.LevelVar
+
+	// startup holds the tasks that must finish before the server takes
+	// traffic (see startup.go).
+	startup *Startup
+
+	// readiness holds the dependency checks behind /readyz (see
+	// readiness.go).
+	readiness *Readiness
+
+	// upstreams are the services requests can be forwarded to, and dns
+	// looks them up (see resolver.go).
+	upstreams []*Upstream
+	dns       dnsResolver
+
+	// proxy forwards requests under configured prefixes to upstreams (see
+	// proxy.go). It's replaced when the configuration is reloaded, and nil
+	// if there are no routes.
+	proxy atomic.Pointer[Proxy]
+
+	// landing is the rendered landing page (see landing.go), nil until the
+	// first request for it.
+	landing atomic.Pointer[landingPage]
+
+	// consul registers the server with Consul, if configured (see
+	// consul.go); nil otherwise.
+	consul *Consul
+
+	// vault supplied the secret settings, if configured (see vault.go);
+	// nil otherwise.
+	vault *Vault
+
+	// draining is set once shutdown has begun, which fails /readyz, and
+	// stopping is closed when connections are being drained, which ends
+	// long-lived streams (see shutdown.go).
+	draining atomic.Bool
+	stopping chan struct{}
+
+	// registry describes every route registered by routes(), in order.
+	// GET /admin/routes and the "routes" CLI command are generated from it.
+	registry []Route
+}
+
+// newServer creates a Server with an empty store and fresh metrics.
+func newServer(cfg Config) *Server {
+	metrics := newMetrics()
+	outbound := newOutboundClient(metrics)
+	if cfg.MockExternal {
+		// Answer calls to the quote, LLM and weather APIs in-process (see
+		// mock.go), still recording them like real ones.
+		outbound.Transport = &instrumentedTransport{base: newMockTransport(cfg, http.DefaultTransport), metrics: metrics}
+	}
+	s := &Server{
+		cfg:             cfg,
+		consul:          newConsul(cfg, outbound),
+		dns:             net.DefaultResolver,
+		store:           newStore(),
+		clock:           realClock{},
+		blobs:           timedBlobStore{newBlobStore(cfg)},
+		metrics:         metrics,
+		assets:          newAssets(cfg.DevMode),
+		quotes:          newQuotes(cfg, outbound),
+		weather:         newWeatherService(cfg, outbound),
+		outbound:        outbound,
+		inspector:       newInspector(),
+		faults:          newFaultInjector(),
+		inFlight:        newInFlight(),
+		shedder:         newLoadShedder(),
+		rateLimiter:     newRateLimiter(),
+		mailer:          newMailer(cfg),
+		notifier:        newNotifier(cfg, outbound),
+		contactLimiter:  newRateLimiter(),
+		logins:          newLoginGuard(),
+		passwordHashing: newHashLimiter(),
+		projection:      newCounterProjection(),
+		logTail:         newLogTail(),
+		adminEvents:     newAdminEvents(),
+		redis:           newRedis(cfg),
+		idempotency:     newIdempotencyStore(),
+		signatures:      newSeenSignatures(),
+		jwtKeys:         newJWTKeyRing(cfg.JWTSecret),
+		flights:         newFlightGroup(),
+		liveReload:      newLiveReload(),
+		logLevel:        new(slog.LevelVar),
+		startup:         newStartup(),
+		readiness:       newReadiness(cfg.ReadinessCheckTimeout, cfg.ReadinessCacheTTL),
+		stopping:        make(chan struct{}),
+	}
+	s.logLevel.Set(cfg.slogLevel())
+	s.readiness.onChange = s.readinessChanged
+
+	// The configuration has been validated, so parsing can't fail.
+	s.upstreams, _ = parseUpstreams(cfg.Upstreams)
+	proxyRoutes, inline, _ := loadProxyRoutes(cfg, s.upstreams, nil)
+	s.proxy.Store(newProxy(proxyRoutes, inline, cfg.ProxyTimeout, cfg.ProxyRetries, metrics))
+	for _, u := range s.allUpstreams() {
+		u.setBalancing(s.balancing(cfg))
+	}
+	return s
+}
+
+// config returns a copy of the current configuration. Because it's a copy,
+// callers can use it freely without holding the lock.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+// middleware returns the standard middleware stack, outermost first: the
+// routes group's chain (see chain.go), then any middleware added with
+// RegisterMiddleware, innermost.
+func (s *Server) middleware() []middleware {
+	return append(s.chain(routeGroup), registeredMiddleware()...)
+}
+
+// wrap applies a middleware chain to a handler. We wrap from the innermost
+// middleware outwards so the first one in the list runs first.
+func wrap(h http.HandlerFunc, chain []middleware) http.HandlerFunc {
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i].wrap(h)
+	}
+	return h
+}
+
+// handle registers a handler wrapped in the standard middleware stack and
+// records it in the route registry. Middleware that only some routes need,
+// like the admin endpoints' API key check, is passed as extra; it runs
+// after the standard stack and the route's deadline (see timeout.go), in
+// the order given. In tests and dev mode, the handler can also be made to
+// fail on purpose (see faults.go).
+func (s *Server) handle(mux *http.ServeMux, pattern string, h http.HandlerFunc, extra ...middleware) {
+	s.register(mux, pattern, h, slices.Concat(s.middleware(), []middleware{s.timeoutMiddleware(pattern)}, extra))
+}
+
+// register records a handler in the route registry and adds it to the
+// router, wrapped in chain.
+func (s *Server) register(mux *http.ServeMux, pattern string, h http.HandlerFunc, chain []middleware) {
+	s.registry = append(s.registry, newRoute(pattern, h, chain))
+	if faultsEnabled(s.config()) {
+		h = s.injectFaults(pattern, h)
+	}
+	mux.HandleFunc(pattern, wrap(h, chain))
+}
+
+// routes registers every endpoint and returns the finished router.
+// Since Go 1.22, patterns can include an HTTP method and {wildcards}, so
+// "GET /api/v1/notes/{id}" only matches GET requests and captures the ID.
+func (s *Server) routes() *http.ServeMux {
+	s.registry = nil
+	mux := http.NewServeMux()
+	admin := middleware{"adminauth", s.adminAuthMiddleware}
+	dedup := middleware{"dedup", s.dedupMiddleware}
+	contactLimit := middleware{"contactlimit", s.contactRateLimitMiddleware}
+
+	// The probes come first; see probes.go.
+	s.handleProbe(mux, "/health", handleHealth)
+	s.handleProbe(mux, "GET /livez", handleHealth)
+	s.handleProbe(mux, "GET /readyz", s.handleReadyz)
+	s.handleProbe(mux, "GET /startupz", s.handleStartupz)
+
+	s.handle(mux, "/", s.handleRoot)
+	s.handle(mux, "/api/message", s.handleMessage)
+	s.handle(mux, "GET /api/v1/message", s.handleMessage)
+	s.handle(mux, "GET /static/", s.assets.StaticHandler().ServeHTTP)
+	if s.config().DevMode {
+		s.handle(mux, "GET /dev/livereload", s.handleLiveReload)
+	}
+	s.handle(mux, "GET /metrics", s.handleMetrics)
+	s.handle(mux, "GET /dashboard", s.handleDashboard)
+	s.handle(mux, "GET /dashboard/events", s.handleDashboardEvents)
+	s.handle(mux, "GET /inspect", s.handleInspect)
+	s.handle(mux, "GET /api/v1/inspect", s.handleListInspected)
+	s.handle(mux, "GET /learn", s.handleLearn)
+	s.handle(mux, "GET /api/v1/learn/exercises", handleListExercises)
+	s.handle(mux, "GET /api/v1/learn/exercises/{id}", handleGetExercise)
+	s.handle(mux, "GET /api/v1/learn/exercises/{id}/verify", s.handleVerifyExercise)
+	s.handle(mux, "GET /api/v1/progress", s.handleGetProgress)
+	s.handle(mux, "GET /admin", s.handleAdminUI, admin)
+	s.handle(mux, "GET /admin/routes", s.handleListRoutes, admin)
+	s.handle(mux, "GET /admin/config", s.handleAdminConfig, admin)
+	s.handle(mux, "GET /admin/healthchecks", s.handleListHealthChecks, admin)
+	s.handle(mux, "GET /admin/upstreams", s.handleListUpstreams, admin)
+	s.handle(mux, "GET /admin/ratelimit", s.handleRateLimitState, admin)
+	s.handle(mux, "PUT /admin/flags/{name}", s.handleEnableFlag, admin)
+	s.handle(mux, "DELETE /admin/flags/{name}", s.handleDisableFlag, admin)
+	s.handle(mux, "GET /admin/maintenance", s.handleGetMaintenance, admin)
+	s.handle(mux, "PUT /admin/maintenance", s.handleSetMaintenance, admin)
+	s.handle(mux, "POST /admin/tokens", s.handleIssueToken, admin)
+	s.handle(mux, "DELETE /admin/tokens/{subject}", s.handleRevokeSubject, admin)
+	s.handle(mux, "GET /admin/audit", s.handleListAudit, admin)
+	s.handle(mux, "POST /admin/reload", s.handleReload, admin)
+	s.handle(mux, "POST /admin/seed", s.handleSeed, admin)
+	s.handle(mux, "GET /admin/jobs", s.handleJobQueue, admin)
+	s.handle(mux, "POST /admin/jobs", s.handleEnqueueJob, admin)
+	s.handle(mux, "GET /admin/logs/tail", s.handleLogTail, admin)
+	s.handle(mux, "GET /admin/events", s.handleAdminEvents, admin)
+	s.handle(mux, "GET /admin/backup", s.handleBackup, admin)
+	s.handle(mux, "POST /admin/restore", s.handleRestore, admin)
+	if faultsEnabled(s.config()) {
+		s.handle(mux, "GET /admin/faults", s.handleListFaults, admin)
+		s.handle(mux, "POST /admin/faults", s.handleSetFault, admin)
+		s.handle(mux, "DELETE /admin/faults", s.handleClearFaults, admin)
+	}
+	s.handle(mux, "GET /api/v1/features", s.handleListFeatures)
+	s.handle(mux, "GET /.well-known/jwks.json", s.handleJWKS)
+	s.handle(mux, "POST /api/v1/token/refresh", s.handleRefreshToken)
+	s.handle(mux, "POST /api/v1/token/revoke", s.handleRevokeToken)
+	s.handle(mux, "POST /api/v1/register", s.handleRegister)
+	s.handle(mux, "POST /api/v1/login", s.handleLogin)
+	s.handle(mux, "GET /api/v1/me", s.handleCurrentUser)
+	s.handle(mux, "GET /api/v1/me/export", s.handleExportUserData)
+	s.handle(mux, "DELETE /api/v1/me", s.handleDeleteUser)
+	s.handle(mux, "GET /schemas/", handleListSchemas)
+	s.handle(mux, "GET /schemas/{name}", handleGetSchema)
+	s.handle(mux, "GET /proto/api.proto", handleProtoSchema)
+
+	s.handle(mux, "GET /guestbook", s.handleGuestbookPage)
+	s.handle(mux, "POST /guestbook", s.handleGuestbookForm)
+	s.handle(mux, "GET /api/v1/guestbook", s.handleListGuestbook)
+	s.handle(mux, "POST /api/v1/guestbook", s.handleSignGuestbook)
+	s.handle(mux, "GET /contact", s.handleContactPage)
+	s.handle(mux, "POST /contact", s.handleContactForm, contactLimit)
+	s.handle(mux, "POST /api/v1/contact", s.handleContact, contactLimit)
+	s.handle(mux, "GET /api/v1/counter", s.handleGetCounter)
+	s.handle(mux, "POST /api/v1/counter", s.handleIncrementCounter)
+	s.handle(mux, "GET /api/v1/eventcounter", s.handleGetEventCounter)
+	s.handle(mux, "POST /api/v1/eventcounter", s.handleCounterCommand)
+	s.handle(mux, "GET /api/v1/eventcounter/events", s.handleListCounterEvents)
+	s.handle(mux, "GET /api/v1/eventcounter/projection", s.handleCounterProjection)
+	s.handle(mux, "GET /api/v1/notes", s.handleListNotes)
+	s.handle(mux, "POST /api/v1/notes", s.handleCreateNote)
+	s.handle(mux, "POST /api/v1/notes:batch", s.handleBatchNotes)
+	s.handle(mux, "GET /api/v1/notes/export", s.handleExportNotes)
+	s.handle(mux, "GET /api/v1/notes/{id}", s.handleGetNote)
+	s.handle(mux, "PATCH /api/v1/notes/{id}", s.handlePatchNote)
+	s.handle(mux, "DELETE /api/v1/notes/{id}", s.handleDeleteNote)
+	s.handle(mux, "POST /api/v1/notes/{id}/restore", s.handleRestoreNote)
+	s.handle(mux, "GET /api/v1/qr", handleQRCode)
+	s.handle(mux, "GET /api/v1/time/{tz...}", s.handleTime)
+	s.handle(mux, "GET /api/v1/timezones", handleListTimezones)
+	s.handle(mux, "GET /api/v1/hello/random", handleRandomHello)
+	s.handle(mux, "GET /api/v1/hello/{lang}", handleHello)
+	s.handle(mux, "GET /api/v1/greetings", handleListGreetings)
+	s.handle(mux, "GET /api/v1/instance", s.handleInstance)
+	s.handle(mux, "GET /api/v1/stream", s.handleStream)
+	s.handle(mux, "GET /api/v1/quote", s.handleQuote, dedup)
+	s.handle(mux, "GET /api/v1/weather", s.handleWeather, dedup)
+	s.handle(mux, "GET /api/v1/links", s.handleListLinks)
+	s.handle(mux, "POST /api/v1/links", s.handleCreateLink)
+	s.handle(mux, "GET /api/v1/links/{code}", s.handleGetLink)
+	s.handle(mux, "GET /l/{code}", s.handleFollowLink)
+	s.handle(mux, "GET /api/v1/files", s.handleListFiles)
+	s.handle(mux, "POST /api/v1/files", s.handleUploadFile)
+	s.handle(mux, "GET /api/v1/files/{id}", s.handleGetFile)
+	s.handle(mux, "GET /api/v1/files/{id}/content", s.handleDownloadFile)
+	s.handle(mux, "GET /api/v1/files/{id}/thumbnail", s.handleThumbnail)
+
+	// Endpoints added with RegisterRoute (see extensions.go).
+	s.handleExtensions(mux)
+
+	return mux
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// newTestServer returns a server with the default configuration and
+// in-memory dependencies, and a client for its full handler, built the way
+// serve() builds it. Use it to test new endpoints end to end:
+//
+//	_, c := newTestServer(t)
+//	c.Get("/api/v1/counter").Status(http.StatusOK).JSON(`{"count": 0, "...": "..."}`)
+//
+// Data lives only in memory, uploads go to a temporary directory that's
+// removed after the test, and the quote, weather and LLM APIs are mocked
+// (see mock.go), so nothing reaches the internet. Adjust the Server before
+// sending requests if a test needs something else.
+func newTestServer(t testing.TB) (*Server, *testsupport.Client) {
+	t.Helper()
+	cfg := defaultConfig(t)
+	cfg.UploadDir = t.TempDir()
+	cfg.MockExternal = true
+	cfg.Tenants = []string{"acme", "globex", "initech", "umbrella"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg)
+	return s, testsupport.New(t, s.handler())
+}
+
+// TestNewTestServer creates, reads and deletes a note through the test
+// client.
+func TestNewTestServer(t *testing.T) {
+	_, c := newTestServer(t)
+	c.Header.Set(tenantHeader, "acme")
+
+	resp := c.Post("/api/v1/notes", map[string]string{"title": "Hello", "body": "World"}).
+		Status(http.StatusCreated)
+	note := testsupport.Decode[Note](resp)
+
+	resp = c.Get("/api/v1/notes/"+note.ID).
+		Status(http.StatusOK).
+		HasHeader("Content-Type", "application/json").
+		JSON(`{"id": "` + note.ID + `", "title": "Hello", "body": "World", "...": "..."}`)
+
+	// Changes need the note's ETag; DoRequest sends a request built by hand.
+	c.Delete("/api/v1/notes/" + note.ID).Status(http.StatusPreconditionRequired)
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/notes/"+note.ID, nil)
+	req.Header.Set("If-Match", resp.Header().Get("ETag"))
+	c.DoRequest(req).Status(http.StatusNoContent)
+	c.Get("/api/v1/notes/" + note.ID).Status(http.StatusNotFound)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file adds a Server-Timing header to responses, which tells the
+// client where the server spent its time. Browser devtools show it in the
+// Timing tab of a request in the Network panel, next to the browser's own
+// numbers, so "the page is slow" can be narrowed down without looking at
+// server logs:
+//
+//	Server-Timing: app;dur=48.2;desc="Handler", upstream;dur=41.7;desc="1 call", blob;dur=3.1;desc="2 calls"
+//
+//   - app is the time from the request arriving to the response headers
+//     being sent: everything the server did before it could answer.
+//   - upstream is time spent waiting for other services: outbound calls
+//     (outbound.go) and proxied requests (proxy.go).
+//   - blob is time spent in the blob store (blobstore.go), which is disk or
+//     S3 depending on BLOB_BACKEND.
+//
+// Code that does something slow records it with addServerTiming, which
+// finds the request's timings through its context. There's no database
+// here; saving the data file happens inside Store calls that don't take a
+// context, so that time shows up as part of app.
+//
+// Timings tell anyone who can see the response something about the
+// system's insides, so SERVER_TIMING=false turns the header off.
+
+// serverTimingContextKey holds a request's *serverTiming.
+const serverTimingContextKey contextKey = "server-timing"
+
+// timingMetric is one entry of a Server-Timing header.
+type timingMetric struct {
+	name  string
+	total time.Duration
+	count int
+}
+
+// serverTiming collects a request's timings. Outbound calls may run
+// concurrently, so it's safe for concurrent use.
+type serverTiming struct {
+	mu      sync.Mutex
+	metrics []*timingMetric
+}
+
+// add records d against the named metric.
+func (t *serverTiming) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.metrics {
+		if m.name == name {
+			m.total += d
+			m.count++
+			return
+		}
+	}
+	t.metrics = append(t.metrics, &timingMetric{name: name, total: d, count: 1})
+}
+
+// header formats the timings, with app taking elapsed.
+func (t *serverTiming) header(elapsed time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := []string{formatTiming("app", elapsed, "Handler")}
+	for _, m := range t.metrics {
+		desc := "1 call"
+		if m.count != 1 {
+			desc = fmt.Sprintf("%d calls", m.count)
+		}
+		entries = append(entries, formatTiming(m.name, m.total, desc))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// formatTiming formats one entry, in milliseconds as the header expects.
+func formatTiming(name string, d time.Duration, desc string) string {
+	return fmt.Sprintf("%s;dur=%.1f;desc=%q", name, float64(d)/float64(time.Millisecond), desc)
+}
+
+// addServerTiming records time spent on something during a request. It
+// does nothing outside a request, or with SERVER_TIMING off.
+func addServerTiming(ctx context.Context, name string, d time.Duration) {
+	if t, ok := ctx.Value(serverTimingContextKey).(*serverTiming); ok {
+		t.add(name, d)
+	}
+}
+
+// timingWriter adds the Server-Timing header just before the response
+// headers are sent, the last moment it can.
+type timingWriter struct {
+	http.ResponseWriter
+	timing *serverTiming
+	start  time.Time
+	sent   bool
+}
+
+// WriteHeader adds the header, then sends the headers.
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.sent {
+		tw.sent = true
+		tw.Header().Add("Server-Timing", tw.timing.header(time.Since(tw.start)))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// Write sends the headers first if the handler didn't.
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.sent {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter.
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// serverTimingMiddleware gives each request somewhere to record timings,
+// and sends them in a Server-Timing header.
+func serverTimingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timing := &serverTiming{}
+		tw := &timingWriter{ResponseWriter: w, timing: timing, start: time.Now()}
+		next(tw, r.WithContext(context.WithValue(r.Context(), serverTimingContextKey, timing)))
+	}
+}
+
+// timedBlobStore records the time spent in a blob store.
+type timedBlobStore struct {
+	BlobStore
+}
+
+// Put stores a blob.
+func (b timedBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	defer observeBlob(ctx, time.Now())
+	return b.BlobStore.Put(ctx, key, r, size, contentType)
+}
+
+// Open opens a blob. Only opening it is timed: reading it happens as the
+// response is sent.
+func (b timedBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	defer observeBlob(ctx, time.Now())
+	return b.BlobStore.Open(ctx, key)
+}
+
+// Delete removes a blob.
+func (b timedBlobStore) Delete(ctx context.Context, key string) error {
+	defer observeBlob(ctx, time.Now())
+	return b.BlobStore.Delete(ctx, key)
+}
+
+// observeBlob records a blob store call that started at start.
+func observeBlob(ctx context.Context, start time.Time) {
+	addServerTiming(ctx, "blob", time.Since(start))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerTimingMiddleware checks recorded timings appear in the header,
+// summed per name.
+func TestServerTimingMiddleware(t *testing.T) {
+	h := serverTimingMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		addServerTiming(r.Context(), "upstream", 10*time.Millisecond)
+		addServerTiming(r.Context(), "upstream", 5*time.Millisecond)
+		addServerTiming(r.Context(), "blob", 2*time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	got := rec.Header().Get("Server-Timing")
+	for _, want := range []string{`app;dur=`, `upstream;dur=15.0;desc="2 calls"`, `blob;dur=2.0;desc="1 call"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %s in the header, got %q", want, got)
+		}
+	}
+}
+
+// TestAddServerTimingOutsideRequest checks recording without a request is
+// harmless.
+func TestAddServerTimingOutsideRequest(t *testing.T) {
+	addServerTiming(context.Background(), "upstream", time.Millisecond)
+}
+
+// TestServerTimingConfig checks the header is sent by default, and not with
+// SERVER_TIMING off.
+func TestServerTimingConfig(t *testing.T) {
+	for _, on := range []bool{true, false} {
+		cfg := defaultConfig(t)
+		cfg.ServerTiming = on
+		s := newServer(cfg)
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/message", nil))
+		if got := rec.Header().Get("Server-Timing") != ""; got != on {
+			t.Errorf("With SERVER_TIMING=%v, expected a header %v, got %v", on, on, got)
+		}
+	}
+}
+
+// TestServerTimingProxy checks proxied requests report upstream time.
+func TestServerTimingProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	_, h := newProxyServer(t, "/app="+backend.URL)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app/", nil))
+	if got := rec.Header().Get("Server-Timing"); !strings.Contains(got, `upstream;dur=`) {
+		t.Errorf("Expected upstream time in the header, got %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements load shedding: turning away a share of requests
+// when the instance is saturated, so that it can still serve the rest.
+// MAX_IN_FLIGHT (limit.go) caps load at a number you pick in advance;
+// shedding reacts to how the instance is actually coping, which depends on
+// what the requests are and what else is running on the machine.
+//
+// With LOAD_SHEDDING=true, once a second the server checks two signs of
+// saturation:
+//   - request latency: the 90th percentile over the last second, against
+//     SHED_LATENCY
+//   - CPU: how long goroutines waited for a CPU to run on (the Go
+//     runtime's scheduling latency, 99th percentile), against
+//     SHED_SCHED_LATENCY. It climbs as soon as there's more work than
+//     CPUs, whatever the cause.
+//
+// While either is over its threshold, the share of requests shed goes up
+// by 10 points a second, to at most SHED_MAX_FRACTION; once both are back
+// under, it comes down by 5 points a second, more slowly so that it
+// doesn't flap. Shed requests get a 503 with Retry-After. Health probes and
+// metrics are never shed: a pod that fails its probes because it's busy
+// would be restarted, making things worse. Nor are admin requests that
+// carry an admin key, so an operator can still reach a struggling
+// instance; without a key they're shed like any other, or anyone could get
+// past shedding, and rate limits, by asking for an admin endpoint.
+//
+// http_requests_shed_total counts shed requests, and load_shed_fraction is
+// the share being shed.
+
+// shedInterval is how often the shed fraction is adjusted.
+const shedInterval = time.Second
+
+// maxShedSamples bounds the latencies kept between adjustments.
+const maxShedSamples = 4096
+
+// loadShedder decides which requests to shed.
+type loadShedder struct {
+	mu       sync.Mutex
+	fraction float64         // the share of requests to shed, 0 to 1
+	samples  []time.Duration // latencies of requests served since the last adjustment
+
+	sched *metrics.Float64Histogram // scheduling latencies at the last adjustment
+}
+
+func newLoadShedder() *loadShedder {
+	return &loadShedder{}
+}
+
+// shed reports whether to shed a request.
+func (l *loadShedder) shed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fraction > 0 && rand.Float64() < l.fraction
+}
+
+// observe records how long a request that wasn't shed took.
+func (l *loadShedder) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < maxShedSamples {
+		l.samples = append(l.samples, d)
+	}
+}
+
+// adjust moves the shed fraction up if the instance is saturated, and down
+// if not, and returns it.
+func (l *loadShedder) adjust(cfg Config) float64 {
+	schedP99 := l.schedLatency(0.99)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slices.Sort(l.samples)
+	var p90 time.Duration
+	if len(l.samples) > 0 {
+		p90 = l.samples[int(math.Ceil(0.9*float64(len(l.samples))))-1]
+	}
+	l.samples = l.samples[:0]
+
+	switch {
+	case !cfg.LoadShedding:
+		l.fraction = 0
+	case p90 > cfg.ShedLatency || schedP99 > cfg.ShedSchedLatency:
+		l.fraction = min(cfg.ShedMaxFraction, l.fraction+0.1)
+	default:
+		l.fraction = max(0, l.fraction-0.05)
+	}
+	return l.fraction
+}
+
+// schedLatency returns the q quantile of the Go runtime's scheduling
+// latencies since it was last called.
+func (l *loadShedder) schedLatency(q float64) time.Duration {
+	sample := []metrics.Sample{{Name: "/sched/latencies:seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return 0
+	}
+	cur := sample[0].Value.Float64Histogram()
+	prev := l.sched
+	l.sched = cur
+	return histogramQuantile(cur, prev, q)
+}
+
+// adjustLoadShedding adjusts the shed fraction every interval until ctx is
+// done. It runs whether or not shedding is on, since LOAD_SHEDDING can be
+// turned on by a reload.
+func (s *Server) adjustLoadShedding(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.metrics.SetShedFraction(s.shedder.adjust(s.config()))
+	}
+}
+
+// critical reports whether a request must never be shed or rate limited:
+// it's for a probe or metrics, or it's an admin request with an admin key.
+// The key is checked here as well as by adminAuthMiddleware because that
+// runs later, after the limits.
+func (s *Server) critical(r *http.Request) bool {
+	if uncappedRoutes[r.Pattern] {
+		return true
+	}
+	_, path, _ := strings.Cut(r.Pattern, " ")
+	if path != "/admin" && !strings.HasPrefix(path, "/admin/") {
+		return false
+	}
+	keys := s.config().AdminAPIKeys
+	return len(keys) > 0 && (authorized(r, keys) || basicAuthorized(r, keys))
+}
+
+// shedMiddleware sheds requests while the instance is saturated.
+func (s *Server) shedMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.config().LoadShedding || s.critical(r) {
+			next(w, r)
+			return
+		}
+		if s.shedder.shed() {
+			s.metrics.ObserveShed()
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusServiceUnavailable, "the server is overloaded; try again shortly")
+			return
+		}
+
+		start := time.Now()
+		next(w, r)
+		if !longLivedRoutes[r.Pattern] {
+			s.shedder.observe(time.Since(start))
+		}
+	}
+}
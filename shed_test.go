@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShedMiddleware checks that while shedding everything it can, the
+// server still answers health probes, metrics and admin requests with a
+// key, but not admin requests without one.
+func TestShedMiddleware(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.LoadShedding = true
+	s.cfgMu.Unlock()
+	s.shedder.fraction = 1
+
+	c.Get("/api/v1/counter").
+		Status(http.StatusServiceUnavailable).
+		HasHeader("Retry-After", "1")
+	c.Get("/health").Status(http.StatusOK)
+	c.Get("/readyz").Status(http.StatusOK)
+	s.cfgMu.Lock()
+	s.cfg.AdminAPIKeys = []string{"k1"}
+	s.cfgMu.Unlock()
+	c.Get("/admin/routes").Status(http.StatusServiceUnavailable)
+	req := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+	req.Header.Set("Authorization", "Bearer k1")
+	c.DoRequest(req).Status(http.StatusOK)
+	if metrics := c.Get("/metrics").Body.String(); !strings.Contains(metrics, "\nhttp_requests_shed_total 2\n") {
+		t.Errorf("Expected 1 request shed, got:\n%s", metrics)
+	}
+
+	s.cfgMu.Lock()
+	s.cfg.LoadShedding = false
+	s.cfgMu.Unlock()
+	c.Get("/api/v1/counter").Status(http.StatusOK)
+}
+
+// TestShedAdjust checks the shed fraction climbs while requests are slow,
+// up to the maximum, and comes back down once they're not.
+func TestShedAdjust(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.LoadShedding = true
+	cfg.ShedLatency = 100 * time.Millisecond
+	cfg.ShedSchedLatency = time.Hour // only latency counts here
+	cfg.ShedMaxFraction = 0.25
+	l := newLoadShedder()
+
+	want := []float64{0.1, 0.2, 0.25, 0.25}
+	for i, w := range want {
+		for range 10 {
+			l.observe(time.Second)
+		}
+		if got := l.adjust(cfg); !near(got, w) {
+			t.Errorf("Slow second %d: expected %g shed, got %g", i+1, w, got)
+		}
+	}
+
+	// Mostly fast requests, with the slow ones under the 90th percentile.
+	for range 95 {
+		l.observe(time.Millisecond)
+	}
+	for range 5 {
+		l.observe(time.Second)
+	}
+	if got := l.adjust(cfg); !near(got, 0.2) {
+		t.Errorf("Expected the fraction to come down, got %g", got)
+	}
+
+	cfg.LoadShedding = false
+	if got := l.adjust(cfg); got != 0 {
+		t.Errorf("Expected nothing shed when turned off, got %g", got)
+	}
+}
+
+// near reports whether two fractions are equal, give or take rounding.
+func near(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
+
+// TestAdjustLoadShedding checks the background job publishes the fraction
+// on every tick.
+func TestAdjustLoadShedding(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Now())
+	s.useClock(clock)
+	s.cfgMu.Lock()
+	s.cfg.LoadShedding, s.cfg.ShedLatency = true, time.Millisecond
+	s.cfgMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.adjustLoadShedding(ctx, shedInterval)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+
+	s.shedder.observe(time.Second)
+	clock.Advance(shedInterval)
+	eventually(t, func() bool {
+		return strings.Contains(c.Get("/metrics").Body.String(), "\nload_shed_fraction 0.1\n")
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// This file implements the readiness probe (GET /readyz) and what happens
+// when the server is asked to stop.
+//
+// Stopping a pod without dropping requests is a race. When Kubernetes
+// deletes a pod it does two things at once: it sends the container SIGTERM,
+// and it tells every node to stop routing traffic to the pod. The second
+// takes a few seconds to reach everywhere, so a server that exits as soon
+// as SIGTERM arrives turns away requests that were already on their way to
+// it. The fix is to keep serving for a while after SIGTERM:
+//
+//  1. Fail /readyz straight away, so anything still routing by readiness
+//     stops sending new requests here.
+//  2. Wait SHUTDOWN_DELAY for the endpoint removal to reach every node,
+//     still serving whatever arrives in the meantime.
+//  3. Drain: stop accepting connections and wait up to SHUTDOWN_TIMEOUT
+//     for requests in progress to finish.
+//
+// A preStop hook does the waiting in step 2 in Kubernetes instead, before
+// SIGTERM is even sent:
+//
+//	lifecycle:
+//	  preStop:
+//	    sleep: {seconds: 5}
+//
+// With a preStop hook, SHUTDOWN_DELAY can be 0. Either way, the pod's
+// terminationGracePeriodSeconds (30 by default) must cover the preStop
+// sleep, SHUTDOWN_DELAY and SHUTDOWN_TIMEOUT together, or the container is
+// killed before it's done.
+//
+// /health, the liveness probe, keeps answering 200 throughout: the server
+// isn't broken, and failing liveness would get it restarted.
+
+// ReadyResponse is the JSON body returned by GET /readyz.
+type ReadyResponse struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks,omitempty"`
+	Cached bool          `json:"cached,omitempty"` // whether the checks' results were reused
+}
+
+// handleReadyz reports whether the server wants traffic: 503 until startup
+// is done (see startup.go), once it has started shutting down, and when a
+// critical dependency check fails (see readiness.go); 200 otherwise.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !s.startup.Done() {
+		writeJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "starting"})
+		return
+	}
+	if s.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, ReadyResponse{Status: "draining"})
+		return
+	}
+
+	results, cached := s.readiness.Check(r.Context(), s.clock.Now())
+	resp := ReadyResponse{Status: readinessStatus(results), Checks: results, Cached: cached}
+	code := http.StatusOK
+	if resp.Status == "unavailable" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, resp)
+}
+
+// terminate runs the shutdown sequence for server after sig was received.
+// Ctrl-C (SIGINT) skips the delay: nothing routes traffic to a server
+// running in a terminal, so there's nothing to wait for.
+func (s *Server) terminate(server *http.Server, sig os.Signal, delay, timeout time.Duration) error {
+	s.draining.Store(true)
+	s.deregisterFromConsul()
+	if sig != syscall.SIGTERM {
+		delay = 0
+	}
+	slog.Info("Shutting down: readiness is failing", "signal", sig, "delay", delay)
+	s.notify(eventShutdown, fmt.Sprintf("shutting down (%s)", sig))
+	s.adminEvent(adminEventDrain, fmt.Sprintf("shutting down (%s): readiness is failing, draining connections in %s", sig, delay), nil)
+	<-s.clock.NewTimer(delay).C()
+
+	// Long-lived streams (the dashboard, live reload) would otherwise keep
+	// Shutdown waiting until the timeout. Browsers reconnect to another
+	// replica.
+	server.RegisterOnShutdown(func() { close(s.stopping) })
+
+	slog.Info("Draining connections", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Once the last requests are done, save the visits they counted (see
+	// countersave.go).
+	defer s.store.Flush()
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+		return fmt.Errorf("draining connections: %w", err)
+	}
+	// Post what's waiting, the shutdown included, before the process exits.
+	if s.notifier != nil {
+		s.notifier.Flush(context.Background())
+	}
+	slog.Info("Shutdown complete")
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHandleReadyz checks readiness fails once draining has started, while
+// liveness doesn't.
+func TestHandleReadyz(t *testing.T) {
+	s := newServer(Config{})
+	mux := s.routes()
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected 200 before shutdown, got %d", code)
+	}
+	s.draining.Store(true)
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", code)
+	}
+	if code := get("/health"); code != http.StatusOK {
+		t.Errorf("Expected /health to stay 200 while draining, got %d", code)
+	}
+}
+
+// TestTerminate checks the delay is respected for SIGTERM, and that an open
+// event stream doesn't hold up the drain.
+func TestTerminate(t *testing.T) {
+	for _, tt := range []struct {
+		sig     os.Signal
+		minTime time.Duration
+	}{
+		{syscall.SIGTERM, 100 * time.Millisecond},
+		{os.Interrupt, 0},
+	} {
+		t.Run(tt.sig.String(), func(t *testing.T) {
+			s := newServer(Config{})
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: s.routes()}
+			go server.Serve(ln)
+
+			resp, err := http.Get("http://" + ln.Addr().String() + "/dashboard/events")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			start := time.Now()
+			if err := s.terminate(server, tt.sig, 100*time.Millisecond, 5*time.Second); err != nil {
+				t.Fatalf("Expected a clean shutdown, got %v", err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.minTime || elapsed > 3*time.Second {
+				t.Errorf("Expected shutdown to take at least %v and not wait for the stream, took %v", tt.minTime, elapsed)
+			}
+			if !s.draining.Load() {
+				t.Error("Expected the server to be draining")
+			}
+		})
+	}
+}
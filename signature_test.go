@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignedRoutes checks requests to signed routes need a valid, fresh
+// signature from one of the keys, once, and other routes don't.
+func TestSignedRoutes(t *testing.T) {
+	s, c := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.cfg.SigningKeys = []string{"k1", "k2"}
+	s.cfg.SignedRoutes = []string{"/api/v1/notes"}
+
+	signed := func(method, target, body, key string, at time.Time) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := signRequest(req, key, at); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	c.Post("/api/v1/notes", map[string]string{"title": "Hi"}).Status(http.StatusUnauthorized)
+	c.Get("/api/v1/notes?limit=1").Status(http.StatusUnauthorized)
+	c.Get("/api/v1/notesy").Status(http.StatusOK) // not under /api/v1/notes
+	c.Post("/api/v1/counter", nil).Status(http.StatusOK)
+
+	req := signed(http.MethodPost, "/api/v1/notes", `{"title": "Hi"}`, "k2", clock.Now())
+	c.DoRequest(req).Status(http.StatusCreated).JSON(`{"title": "Hi", "...": "..."}`)
+	// The same request again is a replay.
+	replay := signed(http.MethodPost, "/api/v1/notes", `{"title": "Hi"}`, "k2", clock.Now())
+	c.DoRequest(replay).Status(http.StatusUnauthorized).JSON(`{"detail": "this signed request has already been received; sign it again to retry", "...": "..."}`)
+
+	// Changing the body, the path or the key breaks the signature.
+	req = signed(http.MethodPost, "/api/v1/notes", `{"title": "Hi"}`, "k1", clock.Now().Add(-time.Second))
+	req.Body, req.ContentLength = http.NoBody, 0
+	c.DoRequest(req).Status(http.StatusUnauthorized)
+	req = signed(http.MethodGet, "/api/v1/notes?limit=1", "", "k1", clock.Now())
+	req.URL.RawQuery = "limit=2"
+	c.DoRequest(req).Status(http.StatusUnauthorized)
+	c.DoRequest(signed(http.MethodGet, "/api/v1/notes", "", "k3", clock.Now())).Status(http.StatusUnauthorized).JSON(`{"detail": "the signature doesn't match the request", "...": "..."}`)
+
+	// A signature is good for 5 minutes either way.
+	c.DoRequest(signed(http.MethodGet, "/api/v1/notes?limit=1", "", "k1", clock.Now().Add(4*time.Minute))).Status(http.StatusOK)
+	c.DoRequest(signed(http.MethodGet, "/api/v1/notes?limit=2", "", "k1", clock.Now().Add(-6*time.Minute))).
+		Status(http.StatusUnauthorized).
+		JSON(`{"detail": "the signature's timestamp is 6m0s from the server's time, more than the 5m0s allowed", "...": "..."}`)
+}
+
+// TestSeenSignatures checks signatures are forgotten once they'd be too
+// old to accept anyway.
+func TestSeenSignatures(t *testing.T) {
+	ss := newSeenSignatures()
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	if !ss.first("a", now, time.Minute) || ss.first("a", now.Add(time.Minute), time.Minute) {
+		t.Error("Expected a repeated signature to be caught")
+	}
+	if !ss.first("a", now.Add(2*time.Minute), time.Minute) || len(ss.seen) != 1 {
+		t.Errorf("Expected the old signature to be forgotten, got %v", ss.seen)
+	}
+}
+
+// TestSignCommand checks the printed headers sign the request.
+func TestSignCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"sign", "-key", "k1", "-method", "POST", "-path", "/api/v1/notes", "-body", `{"title": "Hi"}`}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	header := make(http.Header)
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		name, value, _ := strings.Cut(line, ": ")
+		header.Set(name, value)
+	}
+
+	s, c := newTestServer(t)
+	s.cfg.SigningKeys, s.cfg.SignedRoutes = []string{"k1"}, []string{"/api/v1/notes"}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/notes", strings.NewReader(`{"title": "Hi"}`))
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	c.DoRequest(req).Status(http.StatusCreated)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This file implements the startup probe (GET /startupz) and the
+// initialization tasks it waits for.
+//
+// Kubernetes has three kinds of probe, each asking a different question:
+//   - startup (/startupz): has the app finished starting? Until it has, the
+//     other two probes aren't run, so a slow start isn't mistaken for a
+//     hang and the container isn't restarted in the middle of it.
+//   - liveness (/health): is the app still working? If not, restart it.
+//   - readiness (/readyz): should the app get traffic right now?
+//
+// Work that has to happen before the server can do its job (migrating and
+// loading the data file, warming caches, checking the services it depends
+// on) is registered as a task with the server's Startup. serve() starts
+// listening first, so the probes can be answered, then runs the tasks in
+// the order they were registered. Until they've all finished, every other
+// request gets 503 Service Unavailable and /readyz fails too. If a task
+// fails the server exits, and the orchestrator starts it again.
+//
+// To add a task, register it in registerStartupTasks.
+
+// StartupTask is one initialization step, as reported by /startupz.
+type StartupTask struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"` // pending, running, done or failed
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms,omitempty"`
+
+	run func(ctx context.Context) error
+}
+
+// StartupResponse is the JSON body returned by GET /startupz.
+type StartupResponse struct {
+	Started bool          `json:"started"`
+	Tasks   []StartupTask `json:"tasks"`
+}
+
+// Startup is the registry of initialization tasks. It's safe for
+// concurrent use.
+type Startup struct {
+	mu    sync.Mutex
+	tasks []StartupTask
+}
+
+// newStartup creates a registry with no tasks, which counts as started.
+func newStartup() *Startup {
+	return &Startup{}
+}
+
+// Register adds a task, to run after those already registered.
+func (st *Startup) Register(name string, run func(ctx context.Context) error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.tasks = append(st.tasks, StartupTask{Name: name, Status: "pending", run: run})
+}
+
+// Run runs the tasks in order, stopping at the first that fails.
+func (st *Startup) Run(ctx context.Context) error {
+	st.mu.Lock()
+	n := len(st.tasks)
+	st.mu.Unlock()
+
+	for i := range n {
+		// The lock isn't held while a task runs, so /startupz can report
+		// progress meanwhile.
+		st.mu.Lock()
+		task := &st.tasks[i]
+		task.Status = "running"
+		name, run := task.Name, task.run
+		st.mu.Unlock()
+
+		start := time.Now()
+		err := run(ctx)
+		duration := time.Since(start)
+
+		st.mu.Lock()
+		task = &st.tasks[i]
+		task.DurationMs = float64(duration) / float64(time.Millisecond)
+		task.Status = "done"
+		if err != nil {
+			task.Status, task.Error = "failed", err.Error()
+		}
+		st.mu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("startup task %q: %w", name, err)
+		}
+		slog.Info("Startup task done", "task", name, "duration", duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Done reports whether every task has finished successfully.
+func (st *Startup) Done() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, task := range st.tasks {
+		if task.Status != "done" {
+			return false
+		}
+	}
+	return true
+}
+
+// Status reports every task's progress.
+func (st *Startup) Status() StartupResponse {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	resp := StartupResponse{Started: true, Tasks: make([]StartupTask, len(st.tasks))}
+	copy(resp.Tasks, st.tasks)
+	for _, task := range st.tasks {
+		resp.Started = resp.Started && task.Status == "done"
+	}
+	return resp
+}
+
+// registerStartupTasks registers everything serve() needs done before the
+// server takes traffic.
+func (s *Server) registerStartupTasks(cfg Config) {
+	// Bring the data file's schema up to date if asked to, then open it.
+	// This happens before any request can touch the store.
+	if cfg.MigrateOnStart && cfg.DataFile != "" {
+		s.startup.Register("migrations", func(ctx context.Context) error {
+			applied, err := newMigrator(cfg.DataFile).Up()
+			if err != nil {
+				return fmt.Errorf("migrating %s: %w", cfg.DataFile, err)
+			}
+			for _, m := range applied {
+				log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+			}
+			return nil
+		})
+	}
+	s.startup.Register("data file", func(ctx context.Context) error {
+		cipher, err := newFieldCipher(cfg.DataEncryptionKeys)
+		if err != nil {
+			return err
+		}
+		store, err := openEncryptedStore(cfg.DataFile, cipher)
+		if err != nil {
+			return err
+		}
+		if store.staleFields > 0 {
+			log.Printf("%d sensitive values in %s aren't encrypted with the first DATA_ENCRYPTION_KEYS key yet; they will be at the next write, or run \"server reencrypt\"", store.staleFields, cfg.DataFile)
+		}
+		store.clock = s.clock
+		s.store = store
+		return nil
+	})
+
+	// Fetch the first quote now, so the first visitor doesn't wait for a
+	// slow source. Quotes.Get falls back to the embedded list, so this
+	// can't fail.
+	s.startup.Register("quote cache", func(ctx context.Context) error {
+		s.quotes.Get(ctx, s.clock.Now())
+		return nil
+	})
+
+	// Find the upstreams' endpoints. A failed lookup isn't fatal: a headless
+	// service with no ready pods has no addresses yet, and the periodic
+	// refresh will find them when it does.
+	if len(s.allUpstreams()) > 0 {
+		s.startup.Register("upstreams", func(ctx context.Context) error {
+			s.refreshUpstreams(ctx)
+			return nil
+		})
+	}
+
+	// Make sure uploads can be stored, by writing and deleting a small blob.
+	s.startup.Register("blob store", func(ctx context.Context) error {
+		const key = "startup/check"
+		data := []byte("ok")
+		if err := s.blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+			return err
+		}
+		return s.blobs.Delete(ctx, key)
+	})
+}
+
+// startupPaths are the paths answered while the server is starting: the
+// probes, and the metrics so a slow start can be watched.
+var startupPaths = map[string]bool{"/health": true, "/livez": true, "/readyz": true, "/startupz": true, "/metrics": true}
+
+// startupGate answers 503 for everything but startupPaths until startup is
+// done. It wraps the whole router in serve(), rather than being part of
+// the middleware stack, because until startup is done the store the
+// middleware and handlers use may not be loaded yet.
+func (s *Server) startupGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if startupPaths[r.URL.Path] || s.startup.Done() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, http.StatusServiceUnavailable, "the server is starting up, try again shortly")
+	})
+}
+
+// handleStartupz reports whether startup is done: 200 if so, 503 if not,
+// with each task's progress either way.
+func (s *Server) handleStartupz(w http.ResponseWriter, r *http.Request) {
+	status := s.startup.Status()
+	code := http.StatusOK
+	if !status.Started {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestStartupRun checks tasks run in order and a failure stops the rest.
+func TestStartupRun(t *testing.T) {
+	st := newStartup()
+	if !st.Done() {
+		t.Error("Expected a registry without tasks to count as started")
+	}
+
+	var order []string
+	st.Register("first", func(ctx context.Context) error { order = append(order, "first"); return nil })
+	st.Register("second", func(ctx context.Context) error { return errors.New("boom") })
+	st.Register("third", func(ctx context.Context) error { order = append(order, "third"); return nil })
+	if st.Done() {
+		t.Error("Expected pending tasks to mean not started")
+	}
+
+	if err := st.Run(context.Background()); err == nil {
+		t.Fatal("Expected the failing task to fail Run")
+	}
+	if len(order) != 1 || order[0] != "first" {
+		t.Errorf("Expected only the first task to run, got %v", order)
+	}
+
+	status := st.Status()
+	want := []string{"done", "failed", "pending"}
+	for i, task := range status.Tasks {
+		if task.Status != want[i] {
+			t.Errorf("Expected task %q to be %s, got %s", task.Name, want[i], task.Status)
+		}
+	}
+	if status.Started || status.Tasks[1].Error != "boom" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+// TestStartupGate checks requests wait for startup, except the probes.
+func TestStartupGate(t *testing.T) {
+	s := newServer(Config{})
+	running, release := make(chan struct{}), make(chan struct{})
+	s.startup.Register("slow", func(ctx context.Context) error {
+		close(running)
+		<-release
+		return nil
+	})
+	handler := s.startupGate(s.routes())
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	done := make(chan error)
+	go func() { done <- s.startup.Run(context.Background()) }()
+	<-running
+
+	if rec := get("/api/v1/notes"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After while starting, got %d", rec.Code)
+	}
+	if rec := get("/health"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /health to answer while starting, got %d", rec.Code)
+	}
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail while starting, got %d", rec.Code)
+	}
+	rec := get("/startupz")
+	var status StartupResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || status.Started || status.Tasks[0].Status != "running" {
+		t.Errorf("Expected startup in progress, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/v1/notes", "/readyz", "/startupz"} {
+		if rec := get(path); rec.Code != http.StatusOK {
+			t.Errorf("Expected %s to answer 200 after startup, got %d", path, rec.Code)
+		}
+	}
+}
+
+// TestRegisterStartupTasks runs the real tasks against a temporary data
+// file and upload directory.
+func TestRegisterStartupTasks(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig(t)
+	cfg.DataFile = filepath.Join(dir, "data.json")
+	cfg.UploadDir = filepath.Join(dir, "uploads")
+	cfg.MigrateOnStart = true
+
+	s := newServer(cfg)
+	before := s.store
+	s.registerStartupTasks(cfg)
+	if err := s.startup.Run(context.Background()); err != nil {
+		t.Fatalf("Expected startup to succeed, got %v", err)
+	}
+	if s.store == before {
+		t.Error("Expected the data file to replace the in-memory store")
+	}
+
+	var names []string
+	for _, task := range s.startup.Status().Tasks {
+		names = append(names, task.Name)
+	}
+	if len(names) != 4 || names[0] != "migrations" || names[1] != "data file" {
+		t.Errorf("Unexpected tasks %v", names)
+	}
+}
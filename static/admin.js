@@ -0,0 +1,128 @@
+// Runs the admin page (templates/admin.html). Everything on it comes from,
+// and goes back to, the admin JSON API, so the page can do nothing curl
+// can't. See adminui.go.
+
+function set(id, value) {
+    document.getElementById(id).textContent = value;
+}
+
+// api calls an admin endpoint and returns its JSON body. The browser sends
+// the credentials it was given for the page.
+async function api(method, path, body) {
+    const options = {method, headers: {Accept: "application/json"}};
+    if (body !== undefined) {
+        options.headers["Content-Type"] = "application/json";
+        options.body = JSON.stringify(body);
+    }
+    const resp = await fetch(path, options);
+    const data = await resp.json();
+    if (!resp.ok) {
+        throw new Error(data.detail || resp.statusText);
+    }
+    return data;
+}
+
+// row appends a table row of cells to table.
+function row(table, ...cells) {
+    const tr = table.insertRow();
+    for (const cell of cells) {
+        tr.insertCell().textContent = cell;
+    }
+}
+
+// item appends a list item with text, and a button if label is given.
+function item(list, text, label, onclick) {
+    const li = document.createElement("li");
+    li.textContent = text + " ";
+    if (label) {
+        const button = document.createElement("button");
+        button.textContent = label;
+        button.onclick = onclick;
+        li.append(button);
+    }
+    list.append(li);
+}
+
+let maintenance = {enabled: false};
+
+async function loadMaintenance() {
+    maintenance = await api("GET", "/admin/maintenance");
+    set("maintenance-state", maintenance.enabled
+        ? `🚧 On since ${new Date(maintenance.since).toLocaleString()}: ${maintenance.message}`
+        : "✅ Off");
+    set("maintenance-toggle", maintenance.enabled ? "Switch off" : "Switch on");
+}
+
+async function loadFlags() {
+    const {features} = await api("GET", "/api/v1/features");
+    const list = document.getElementById("flags");
+    list.replaceChildren();
+    for (const name of features) {
+        item(list, `🚩 ${name}`, "Switch off", () => run(api("DELETE", `/admin/flags/${encodeURIComponent(name)}`).then(loadFlags)));
+    }
+    if (features.length === 0) {
+        item(list, "No flags are on.");
+    }
+}
+
+async function loadHealthChecks() {
+    const {checks} = await api("GET", "/admin/healthchecks");
+    const list = document.getElementById("healthchecks");
+    list.replaceChildren();
+    for (const check of checks) {
+        const result = check.last_result;
+        const icon = !result ? "⏳" : result.ok ? "✅" : check.severity === "hard" ? "❌" : "⚠️";
+        item(list, `${icon} ${check.name} (${check.severity})${result && result.error ? ": " + result.error : ""}`);
+    }
+}
+
+async function loadRateLimit() {
+    const state = await api("GET", "/admin/ratelimit");
+    set("ratelimit-state", state.backend === "off"
+        ? "Off: RATE_LIMIT isn't set."
+        : `${state.limit} requests every ${state.window}, counted ${state.backend === "redis" ? "in Redis" : "locally"}${state.redis_down ? " while Redis is down" : ""}.`);
+    const table = document.getElementById("ratelimit-clients");
+    table.replaceChildren();
+    for (const c of state.clients) {
+        row(table, c.client, `${c.requests} made`, `${c.remaining} left`, `resets in ${c.resets_in}`);
+    }
+}
+
+async function loadConfig() {
+    const settings = await api("GET", "/admin/config");
+    const table = document.getElementById("config");
+    table.replaceChildren();
+    for (const s of settings) {
+        row(table, s.name, JSON.stringify(s.value), s.source, s.reloadable ? "🔄" : "");
+    }
+}
+
+// run shows the outcome of a change.
+function run(promise) {
+    promise.then(() => set("status", ""), err => set("status", `❌ ${err.message}`));
+}
+
+document.getElementById("maintenance-form").onsubmit = event => {
+    event.preventDefault();
+    const message = document.getElementById("maintenance-message").value;
+    run(api("PUT", "/admin/maintenance", {enabled: !maintenance.enabled, message}).then(loadMaintenance));
+};
+
+document.getElementById("flag-form").onsubmit = event => {
+    event.preventDefault();
+    const input = document.getElementById("flag-name");
+    run(api("PUT", `/admin/flags/${encodeURIComponent(input.value)}`).then(() => {
+        input.value = "";
+        return loadFlags();
+    }));
+};
+
+// The health checks and rate limits change by themselves, so they're
+// refreshed every few seconds.
+function refresh() {
+    run(Promise.all([loadHealthChecks(), loadRateLimit()]));
+}
+
+run(Promise.all([loadMaintenance(), loadFlags(), loadConfig()]));
+refresh();
+setInterval(refresh, 5000);
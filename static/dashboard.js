@@ -0,0 +1,78 @@
+// Updates the dashboard (templates/dashboard.html) from the server's
+// /dashboard/events stream. See dashboard.go for the data sent.
+
+const bars = "▁▂▃▄▅▆▇█";
+const history = [];
+
+function set(id, value) {
+    document.getElementById(id).textContent = value;
+}
+
+// sparkline draws the recent request rates as a row of bars.
+function sparkline(values) {
+    const top = Math.max(...values, 1);
+    return values.map(v => bars[Math.round((v / top) * (bars.length - 1))]).join("");
+}
+
+const events = new EventSource("/dashboard/events");
+
+events.addEventListener("metrics", event => {
+    const m = JSON.parse(event.data);
+
+    history.push(m.request_rate);
+    if (history.length > 30) {
+        history.shift();
+    }
+
+    set("rate", m.request_rate.toFixed(1));
+    set("rate-history", sparkline(history));
+    set("requests", m.requests);
+    set("client-errors", m.client_errors);
+    set("server-errors", m.server_errors);
+    set("p50", m.latency.p50_ms.toFixed(1));
+    set("p90", m.latency.p90_ms.toFixed(1));
+    set("p99", m.latency.p99_ms.toFixed(1));
+    set("goroutines", m.runtime.goroutines);
+    set("heap", (m.runtime.heap_bytes / (1 << 20)).toFixed(1));
+    set("gc-pause", m.runtime.gc_pause_p99_ms.toFixed(2));
+    set("sched-latency", m.runtime.sched_latency_p99_ms.toFixed(2));
+
+    const list = document.getElementById("dependencies");
+    list.replaceChildren(...m.dependencies.map(dep => {
+        const item = document.createElement("li");
+        item.textContent = `${dep.up ? "✅" : "❌"} ${dep.name}: ${dep.detail}`;
+        return item;
+    }));
+
+    set("status", "Live, updated " + new Date(m.time).toLocaleTimeString());
+});
+
+// EventSource reconnects by itself; just say so in the meantime.
+events.onerror = () => set("status", "Disconnected, retrying...");
+
+// Config reloads, circuit breakers, health changes and draining, newest
+// first, from /admin/events (see adminevents.go).
+const adminIcons = {reload: "🔄", breaker: "⚡", health: "🩺", drain: "🚪", maintenance: "🚧", flag: "🚩"};
+const admin = new EventSource("/admin/events");
+
+admin.onopen = () => set("admin-status", "Live, nothing yet");
+
+for (const type of Object.keys(adminIcons)) {
+    admin.addEventListener(type, event => {
+        const e = JSON.parse(event.data);
+        const item = document.createElement("li");
+        item.textContent = `${adminIcons[e.type]} ${new Date(e.time).toLocaleTimeString()} ${e.message}`;
+        const list = document.getElementById("admin-events");
+        list.prepend(item);
+        while (list.children.length > 50) {
+            list.lastChild.remove();
+        }
+        set("admin-status", "Live");
+    });
+}
+
+// A 401 (ADMIN_API_KEYS is set, and EventSource can't send a key) closes the
+// connection for good rather than retrying.
+admin.onerror = () => set("admin-status", admin.readyState === EventSource.CLOSED
+    ? "Unavailable: the feed needs an admin API key"
+    : "Disconnected, retrying...");
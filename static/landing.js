@@ -0,0 +1,26 @@
+// Fills in the visitor's own details on the landing page
+// (templates/index.html). The page itself is the same for everyone, so the
+// server renders it once and caches it (see landing.go); the parts that
+// differ per visitor come from the API instead.
+
+function set(id, value) {
+    document.getElementById(id).textContent = value;
+}
+
+fetch("/api/v1/counter")
+    .then(resp => resp.json())
+    .then(counter => set("visits", counter.count));
+
+fetch("/api/v1/progress")
+    .then(resp => resp.json())
+    .then(progress => {
+        set("completed", progress.completed.length);
+        set("total", progress.total);
+        const badges = document.getElementById("badges");
+        for (const badge of progress.badges) {
+            const span = document.createElement("span");
+            span.className = "badge";
+            span.textContent = badge.emoji + " " + badge.name;
+            badges.append(" ", span);
+        }
+    });
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This file publishes a summary of how the server is doing every
+// STATUS_INTERVAL: how long it's been up, how many requests it served since
+// the last summary, and what share of them failed. It's the pull model of
+// /metrics turned around: rather than waiting to be scraped, the server
+// pushes a status report to wherever people will see it, like a daily
+// stand-up for one instance. Off (0) by default.
+//
+// It runs like the other background jobs (purge.go, heartbeat.go): a loop
+// on the server's clock, so tests drive it with a fake one. Each summary
+// goes to:
+//   - the log, at INFO
+//   - STATUS_WEBHOOK_URL, if set, as a JSON StatusSummary
+//   - the chat webhooks (see notify.go), if NOTIFY_EVENTS includes
+//     "status". It doesn't by default: an hourly report is worth having in
+//     a channel of its own, but not among the alerts.
+//
+// A failed post is logged and not retried: the next summary only covers
+// its own period, so the report for that one is lost.
+
+// statusTimeout limits how long posting a summary can take.
+const statusTimeout = 10 * time.Second
+
+// StatusSummary is the status published every STATUS_INTERVAL. Requests
+// and Errors count since the previous summary; Errors are 5xx responses.
+type StatusSummary struct {
+	Instance      string    `json:"instance"`
+	Version       string    `json:"version"`
+	Time          time.Time `json:"time"`
+	Status        string    `json:"status"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Requests      uint64    `json:"requests"`
+	Errors        uint64    `json:"errors"`
+	ErrorRate     float64   `json:"error_rate"`
+	TotalRequests uint64    `json:"total_requests"`
+}
+
+// statusCounts remembers the totals at the previous summary.
+type statusCounts struct {
+	mu       sync.Mutex
+	requests uint64
+	errors   uint64
+}
+
+// broadcastStatus publishes a status summary every interval, until ctx is
+// cancelled.
+func (s *Server) broadcastStatus(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.publishStatus(ctx, s.statusSummary(ctx, s.clock.Now()))
+	}
+}
+
+// statusSummary sums up the server's status at now, since the previous
+// summary.
+func (s *Server) statusSummary(ctx context.Context, now time.Time) StatusSummary {
+	snap := s.metrics.Snapshot()
+	results, _ := s.readiness.Check(ctx, now)
+
+	s.statusCounts.mu.Lock()
+	requests := snap.Requests - s.statusCounts.requests
+	errors := snap.ServerErrors - s.statusCounts.errors
+	s.statusCounts.requests, s.statusCounts.errors = snap.Requests, snap.ServerErrors
+	s.statusCounts.mu.Unlock()
+
+	summary := StatusSummary{
+		Instance:      instanceName(),
+		Version:       version,
+		Time:          now,
+		Status:        readinessStatus(results),
+		UptimeSeconds: int64(now.Sub(startTime).Seconds()),
+		Requests:      requests,
+		Errors:        errors,
+		TotalRequests: snap.Requests,
+	}
+	if requests > 0 {
+		summary.ErrorRate = float64(errors) / float64(requests)
+	}
+	return summary
+}
+
+// publishStatus sends summary to the log, the status webhook and chat.
+func (s *Server) publishStatus(ctx context.Context, summary StatusSummary) {
+	slog.Info("Status", "status", summary.Status, "uptime_seconds", summary.UptimeSeconds,
+		"requests", summary.Requests, "errors", summary.Errors, "error_rate", summary.ErrorRate)
+
+	s.notify(eventStatus, fmt.Sprintf("%s, up %s, %d requests (%.1f%% errors) since the last report",
+		summary.Status, (time.Duration(summary.UptimeSeconds)*time.Second).String(), summary.Requests, summary.ErrorRate*100))
+
+	if url := s.config().StatusWebhookURL; url != "" {
+		if err := s.postStatus(ctx, url, summary); err != nil {
+			slog.Warn("Status not posted", "error", err)
+		}
+	}
+}
+
+// postStatus posts summary as JSON to rawURL.
+func (s *Server) postStatus(ctx context.Context, rawURL string, summary StatusSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.outbound.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBroadcastStatus checks a summary is posted every interval, counting
+// the requests since the previous one, and sent to chat when asked.
+func TestBroadcastStatus(t *testing.T) {
+	var mu sync.Mutex
+	var summaries []StatusSummary
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary StatusSummary
+		if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+			http.Error(w, "bad summary", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		summaries = append(summaries, summary)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(summaries)
+	}
+
+	cfg := defaultConfig(t)
+	cfg.StatusWebhookURL = webhook.URL
+	cfg.NotifyEvents = []string{eventStatus}
+	cfg.NotifyBatchInterval = 0
+	s, chat, clock := newNotifyServer(t, cfg)
+	h := s.handler()
+	if err := s.faults.Set(Fault{Route: "GET /api/v1/counter", Kind: "error", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/counter", nil))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.broadcastStatus(ctx, time.Hour)
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(time.Hour)
+	eventually(t, func() bool { return count() == 1 })
+	clock.Advance(time.Hour)
+	eventually(t, func() bool { return count() == 2 })
+
+	mu.Lock()
+	first, second := summaries[0], summaries[1]
+	mu.Unlock()
+	if first.Requests != 4 || first.Errors != 1 || first.ErrorRate != 0.25 || first.Status != "ready" || first.Version != version {
+		t.Errorf("Unexpected first summary %+v", first)
+	}
+	if second.Requests != 0 || second.TotalRequests != 4 || second.ErrorRate != 0 {
+		t.Errorf("Expected no requests since the first summary, got %+v", second)
+	}
+
+	eventually(t, func() bool { return len(chat.Messages()) == 2 })
+	if msg := chat.Messages()[0]; !strings.Contains(msg, "*status*: ready, up ") || !strings.Contains(msg, "4 requests (25.0% errors)") {
+		t.Errorf("Unexpected chat message:\n%s", msg)
+	}
+}
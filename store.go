@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements a small in-memory data store. Real applications keep
+// their data in a database, but an in-memory store lets us teach the same
+// ideas (isolation between tenants, concurrency safety, CRUD operations)
+// without having to run one.
+//
+// Every piece of data belongs to a tenant. A tenant is one customer of a SaaS
+// application: each tenant sees only its own notes and its own counter, even
+// though they are all served by the same process.
+//
+// By default everything is lost when the process exits. Setting DATA_FILE
+// makes the store save itself to a JSON file after every change and load it
+// again at startup; the file's layout is versioned by migrations (migrate.go).
+
+// Note is a short piece of text saved by a user.
+type Note struct {
+	ID        string    `json:"id" proto:"1"`
+	Title     string    `json:"title" proto:"2"`
+	Body      string    `json:"body" proto:"3"`
+	CreatedAt time.Time `json:"created_at" proto:"4"`
+
+	// DeletedAt is set when the note is deleted. Deleted notes are kept as
+	// "tombstones" for a while (see purge.go), so a delete can be undone
+	// with POST /api/v1/notes/{id}/restore.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" proto:"5"`
+}
+
+// deleted reports whether the note is a tombstone.
+func (n Note) deleted() bool {
+	return n.DeletedAt != nil
+}
+
+// tenantData holds everything the store knows about a single tenant.
+type tenantData struct {
+	notes     map[string]Note
+	files     map[string]FileInfo
+	guestbook map[string]GuestbookEntry
+	links     map[string]Link
+	counter   int64
+
+	// refreshTokens are the refresh tokens issued (see refresh.go), by ID.
+	refreshTokens map[string]RefreshToken
+
+	// users are the registered users (see users.go), by ID.
+	users map[string]User
+
+	// audit is the log of what's been done to users' data (see
+	// privacy.go), oldest first.
+	audit []AuditEntry
+
+	// progress records when each learner completed each exercise (see
+	// progress.go), by learner ID and then exercise ID.
+	progress map[string]map[string]time.Time
+
+	// counterEvents, counterSnapshot and eventCounter are the event-sourced
+	// counter (see eventcounter.go): its events, its latest snapshot, and
+	// the state they replay to, kept up to date as events are appended.
+	counterEvents   []CounterEvent
+	counterSnapshot *CounterSnapshot
+	eventCounter    EventCounter
+}
+
+// newTenantData creates the empty data for a new tenant.
+func newTenantData() *tenantData {
+	return &tenantData{
+		notes:     make(map[string]Note),
+		files:     make(map[string]FileInfo),
+		guestbook: make(map[string]GuestbookEntry),
+		links:     make(map[string]Link),
+		progress:  make(map[string]map[string]time.Time),
+
+		refreshTokens: make(map[string]RefreshToken),
+		users:         make(map[string]User),
+	}
+}
+
+// Store is a concurrency-safe, tenant-scoped data store.
+// HTTP handlers run concurrently (each request gets its own goroutine), so
+// every access to the shared maps must be protected by the mutex. A
+// sync.RWMutex lets many readers in at once but gives writers exclusive access.
+type Store struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenantData
+
+	// path is the data file, or empty for a purely in-memory store.
+	path string
+
+	// saveErr is the result of the last save, shown on the dashboard.
+	saveErr error
+
+	// unsaved is set when a change hasn't been written to the data file
+	// yet: counter increments are saved in batches (see Flush).
+	unsaved bool
+
+	// cipher encrypts the data file's sensitive fields, if it's set, and
+	// staleFields counts those that were read in plaintext or under an old
+	// key (see fieldcrypt.go).
+	cipher      *fieldCipher
+	staleFields int
+
+	// clock timestamps new and deleted records (see clock.go).
+	clock Clock
+}
+
+// newStore creates an empty in-memory store.
+func newStore() *Store {
+	return &Store{tenants: make(map[string]*tenantData), clock: realClock{}}
+}
+
+// now is the time to record in new and deleted records, in UTC.
+func (s *Store) now() time.Time {
+	return s.clock.Now().UTC()
+}
+
+// dataFile is the layout of the DATA_FILE on disk.
+type dataFile struct {
+	SchemaVersion int `json:"schema_version"`
+	StoreSnapshot
+}
+
+// openStore opens the store saved in path, or returns an in-memory store if
+// path is empty. A missing file is created. A file written for a different
+// schema version is refused: run "migrate up" (or set MIGRATE_ON_START)
+// first, rather than risk misreading the data.
+func openStore(path string) (*Store, error) {
+	return openEncryptedStore(path, nil)
+}
+
+// openEncryptedStore is openStore for a data file whose sensitive fields
+// are encrypted with c (see fieldcrypt.go).
+func openEncryptedStore(path string, c *fieldCipher) (*Store, error) {
+	s := newStore()
+	if path == "" {
+		return s, nil
+	}
+	s.path, s.cipher = path, c
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file dataFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if file.SchemaVersion != latestSchemaVersion() {
+		return nil, fmt.Errorf("%s is at schema version %d but this binary expects %d: run \"migrate up\" first",
+			path, file.SchemaVersion, latestSchemaVersion())
+	}
+
+	if s.staleFields, err = c.openSnapshot(file.StoreSnapshot); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	s.tenants = tenantsFromSnapshot(file.StoreSnapshot)
+	return s, nil
+}
+
+// persist saves the store after a change. The caller must hold the write
+// lock, which also stops two saves from interleaving.
+//
+// Writing the whole file on every change is simple and fine for a demo
+// with a few hundred records; a real database writes only what changed.
+// Store methods don't return errors, so a failed save is logged rather than
+// reported to the client: the change is kept in memory and saved with the
+// next successful write.
+func (s *Store) persist() {
+	if s.path == "" {
+		return
+	}
+	s.saveErr = s.save()
+	if s.saveErr != nil {
+		slog.Error("saving data file failed", "path", s.path, "error", s.saveErr)
+	}
+	s.unsaved = s.saveErr != nil
+}
+
+// Flush saves the changes that haven't been yet. Every page view counts a
+// visit, so saving the whole file each time would cost a write and an
+// fsync per request; instead IncrementCounter only marks the store
+// unsaved, and the server calls Flush every COUNTER_SAVE_INTERVAL and when
+// it shuts down. A crash loses the visits since the last flush, which is
+// fine for a counter. Any other change saves everything, counters
+// included.
+func (s *Store) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unsaved {
+		s.persist()
+	}
+}
+
+// SaveError returns the error from the last attempt to save the data file,
+// or nil if it succeeded (or there's no data file).
+func (s *Store) SaveError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.saveErr
+}
+
+// save writes the data file. The caller must hold the lock.
+func (s *Store) save() error {
+	snap := s.snapshot()
+	if err := s.cipher.sealSnapshot(snap); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dataFile{
+		SchemaVersion: latestSchemaVersion(),
+		StoreSnapshot: snap,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(data, '\n'))
+}
+
+// writeFileAtomic replaces a file's contents in a way that can't leave it
+// half-written: the data goes to a temporary file in the same directory,
+// which is then renamed over the original. A rename within one file system
+// is atomic, so a crash leaves either the old file or the new one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once the rename has happened
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Sync makes sure the data is on disk before the rename makes it visible.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// tenant returns the data for a tenant, creating it on first use.
+// The caller must hold the write lock.
+func (s *Store) tenant(id string) *tenantData {
+	t, ok := s.tenants[id]
+	if !ok {
+		t = newTenantData()
+		s.tenants[id] = t
+	}
+	return t
+}
+
+// CreateNote saves a new note for the tenant and returns it with its ID set.
+func (s *Store) CreateNote(tenant, title, body string) Note {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	note := Note{
+		ID:        newID(),
+		Title:     title,
+		Body:      body,
+		CreatedAt: s.now(),
+	}
+	s.tenant(tenant).notes[note.ID] = note
+	s.persist()
+	return note
+}
+
+// ListNotes returns a tenant's notes, oldest first, leaving out deleted ones.
+func (s *Store) ListNotes(tenant string) []Note {
+	return s.listNotes(tenant, false)
+}
+
+// ListNotesWithDeleted is like ListNotes but includes deleted notes.
+func (s *Store) ListNotesWithDeleted(tenant string) []Note {
+	return s.listNotes(tenant, true)
+}
+
+func (s *Store) listNotes(tenant string, includeDeleted bool) []Note {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notes := []Note{}
+	if t, ok := s.tenants[tenant]; ok {
+		for _, n := range t.notes {
+			if includeDeleted || !n.deleted() {
+				notes = append(notes, n)
+			}
+		}
+	}
+
+	sortNotes(notes)
+	return notes
+}
+
+// sortNotes orders notes oldest first. Maps have no defined order in Go, so
+// we sort to give clients (and the data file) a stable order.
+func sortNotes(notes []Note) {
+	sort.Slice(notes, func(i, j int) bool {
+		if notes[i].CreatedAt.Equal(notes[j].CreatedAt) {
+			return notes[i].ID < notes[j].ID
+		}
+		return notes[i].CreatedAt.Before(notes[j].CreatedAt)
+	})
+}
+
+// GetNote looks up a single note. The boolean reports whether it was found;
+// a deleted note counts as not found.
+func (s *Store) GetNote(tenant, id string) (Note, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return Note{}, false
+	}
+	note, ok := t.notes[id]
+	if !ok || note.deleted() {
+		return Note{}, false
+	}
+	return note, true
+}
+
+// Errors returned by the conditional note methods.
+var (
+	errNoteNotFound   = errors.New("note not found")
+	errNoteChanged    = errors.New("note has changed since it was read")
+	errNoteNotDeleted = errors.New("note is not deleted")
+)
+
+// UpdateNote replaces a note's title and body, keeping its ID and creation
+// time, and returns the updated note. If match is not nil, the update only
+// happens when match approves the note's current state; otherwise it
+// returns errNoteChanged. The check and the write happen under one lock, so
+// no other request can slip in between them.
+func (s *Store) UpdateNote(tenant string, note Note, match func(Note) bool) (Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return Note{}, errNoteNotFound
+	}
+	existing, ok := t.notes[note.ID]
+	if !ok || existing.deleted() {
+		return Note{}, errNoteNotFound
+	}
+	if match != nil && !match(existing) {
+		return Note{}, errNoteChanged
+	}
+	existing.Title = note.Title
+	existing.Body = note.Body
+	t.notes[note.ID] = existing
+	s.persist()
+	return existing, nil
+}
+
+// DeleteNote marks a note as deleted. Like UpdateNote, a non-nil match must
+// approve the note's current state. The note stays in the store as a
+// tombstone until RestoreNote brings it back or PurgeDeleted removes it.
+func (s *Store) DeleteNote(tenant, id string, match func(Note) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return errNoteNotFound
+	}
+	existing, ok := t.notes[id]
+	if !ok || existing.deleted() {
+		return errNoteNotFound
+	}
+	if match != nil && !match(existing) {
+		return errNoteChanged
+	}
+	now := s.now()
+	existing.DeletedAt = &now
+	t.notes[id] = existing
+	s.persist()
+	return nil
+}
+
+// RestoreNote undoes the deletion of a note and returns it.
+func (s *Store) RestoreNote(tenant, id string) (Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return Note{}, errNoteNotFound
+	}
+	note, ok := t.notes[id]
+	if !ok {
+		return Note{}, errNoteNotFound
+	}
+	if !note.deleted() {
+		return Note{}, errNoteNotDeleted
+	}
+	note.DeletedAt = nil
+	t.notes[id] = note
+	s.persist()
+	return note, nil
+}
+
+// PurgeDeleted permanently removes every note, in every tenant, that was
+// deleted before the given time, and returns how many it removed.
+func (s *Store) PurgeDeleted(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for _, t := range s.tenants {
+		for id, note := range t.notes {
+			if note.deleted() && note.DeletedAt.Before(before) {
+				delete(t.notes, id)
+				purged++
+			}
+		}
+	}
+	if purged > 0 {
+		s.persist()
+	}
+	return purged
+}
+
+// NoteTx is a transaction over one tenant's notes, used by batch
+// operations. Changes are staged and only reach the store if the
+// transaction commits, so a batch can be all-or-nothing.
+type NoteTx struct {
+	t       *tenantData
+	now     time.Time // when the transaction started, its changes' timestamp
+	created map[string]Note
+	deleted map[string]bool
+}
+
+// Create stages a new note.
+func (tx *NoteTx) Create(title, body string) Note {
+	note := Note{ID: newID(), Title: title, Body: body, CreatedAt: tx.now}
+	tx.created[note.ID] = note
+	return note
+}
+
+// Delete stages a note's removal and reports whether it existed, counting
+// changes already staged in this transaction.
+func (tx *NoteTx) Delete(id string) bool {
+	if _, ok := tx.created[id]; ok {
+		delete(tx.created, id)
+		return true
+	}
+	if n, ok := tx.t.notes[id]; ok && !n.deleted() && !tx.deleted[id] {
+		tx.deleted[id] = true
+		return true
+	}
+	return false
+}
+
+// Batch runs fn as a transaction on a tenant's notes. The store is locked
+// for the whole call, so no other request sees a half-applied batch. The
+// staged changes are applied only if fn returns true, and saved with a
+// single write.
+func (s *Store) Batch(tenant string, fn func(tx *NoteTx) (commit bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	tx := &NoteTx{t: t, now: s.now(), created: make(map[string]Note), deleted: make(map[string]bool)}
+	if !fn(tx) {
+		return
+	}
+
+	for id := range tx.deleted {
+		note := t.notes[id]
+		note.DeletedAt = &tx.now
+		t.notes[id] = note
+	}
+	for id, note := range tx.created {
+		t.notes[id] = note
+	}
+	s.persist()
+}
+
+// upsertResult reports what an upsert did.
+type upsertResult int
+
+const (
+	upsertUnchanged upsertResult = iota
+	upsertCreated
+	upsertUpdated
+)
+
+// UpsertNote stores a note under the ID it already has, creating it if it
+// doesn't exist and updating its title and body if it does.
+func (s *Store) UpsertNote(tenant string, note Note) upsertResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	existing, ok := t.notes[note.ID]
+	if !ok || existing.deleted() {
+		// A deleted fixture is brought back as if it were new.
+		note.CreatedAt = s.now()
+		t.notes[note.ID] = note
+		s.persist()
+		return upsertCreated
+	}
+
+	if existing.Title == note.Title && existing.Body == note.Body {
+		return upsertUnchanged
+	}
+	existing.Title = note.Title
+	existing.Body = note.Body
+	t.notes[note.ID] = existing
+	s.persist()
+	return upsertUpdated
+}
+
+// AddFile records the metadata of an uploaded file.
+func (s *Store) AddFile(tenant string, info FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tenant(tenant).files[info.ID] = info
+	s.persist()
+}
+
+// ListFiles returns a tenant's files, oldest first.
+func (s *Store) ListFiles(tenant string) []FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []FileInfo{}
+	if t, ok := s.tenants[tenant]; ok {
+		files = sortedFiles(t.files)
+	}
+	return files
+}
+
+// sortedFiles returns the files in a map, oldest first.
+func sortedFiles(m map[string]FileInfo) []FileInfo {
+	files := []FileInfo{}
+	for _, f := range m {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt.Equal(files[j].CreatedAt) {
+			return files[i].ID < files[j].ID
+		}
+		return files[i].CreatedAt.Before(files[j].CreatedAt)
+	})
+	return files
+}
+
+// GetFile looks up a file's metadata.
+func (s *Store) GetFile(tenant, id string) (FileInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return FileInfo{}, false
+	}
+	info, ok := t.files[id]
+	return info, ok
+}
+
+// AddGuestbookEntry signs the tenant's guestbook.
+func (s *Store) AddGuestbookEntry(tenant, name, message string) GuestbookEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := GuestbookEntry{ID: newID(), Name: name, Message: message, CreatedAt: s.now()}
+	s.tenant(tenant).guestbook[entry.ID] = entry
+	s.persist()
+	return entry
+}
+
+// UpsertGuestbookEntry stores an entry under the ID it already has, like
+// UpsertNote.
+func (s *Store) UpsertGuestbookEntry(tenant string, entry GuestbookEntry) upsertResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	existing, ok := t.guestbook[entry.ID]
+	if ok && existing.Name == entry.Name && existing.Message == entry.Message {
+		return upsertUnchanged
+	}
+	if ok {
+		entry.CreatedAt = existing.CreatedAt
+	} else {
+		entry.CreatedAt = s.now()
+	}
+	t.guestbook[entry.ID] = entry
+	s.persist()
+	if ok {
+		return upsertUpdated
+	}
+	return upsertCreated
+}
+
+// ListGuestbook returns up to limit of the tenant's guestbook entries,
+// newest first, skipping the first offset, along with the total number of
+// entries.
+func (s *Store) ListGuestbook(tenant string, offset, limit int) ([]GuestbookEntry, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return []GuestbookEntry{}, 0
+	}
+	entries := sortedGuestbook(t.guestbook)
+	slices.Reverse(entries)
+
+	total := len(entries)
+	offset = min(offset, total)
+	return entries[offset:min(offset+limit, total)], total
+}
+
+// sortedGuestbook returns the entries of a guestbook map oldest first.
+func sortedGuestbook(m map[string]GuestbookEntry) []GuestbookEntry {
+	entries := make([]GuestbookEntry, 0, len(m))
+	for _, e := range m {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries
+}
+
+// CreateLink saves a new short link under a random, unused code.
+func (s *Store) CreateLink(tenant, target string, expiresAt *time.Time) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Holding the lock while choosing the code means no other request can
+	// take it between our check and our insert. A handful of attempts is
+	// plenty: with trillions of codes, even one collision is unlikely.
+	t := s.tenant(tenant)
+	for attempt := 0; attempt < 5; attempt++ {
+		code := newShortCode()
+		if _, taken := t.links[code]; taken {
+			continue
+		}
+		link := Link{Code: code, URL: target, CreatedAt: s.now(), ExpiresAt: expiresAt}
+		t.links[code] = link
+		s.persist()
+		return link, nil
+	}
+	return Link{}, errCodeCollision
+}
+
+// ListLinks returns a tenant's links, oldest first.
+func (s *Store) ListLinks(tenant string) []Link {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.tenants[tenant]; ok {
+		return sortedLinks(t.links)
+	}
+	return []Link{}
+}
+
+// sortedLinks returns the links of a map oldest first.
+func sortedLinks(m map[string]Link) []Link {
+	links := make([]Link, 0, len(m))
+	for _, l := range m {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].Code < links[j].Code
+		}
+		return links[i].CreatedAt.Before(links[j].CreatedAt)
+	})
+	return links
+}
+
+// GetLink looks up a link by its code.
+func (s *Store) GetLink(tenant, code string) (Link, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return Link{}, false
+	}
+	link, ok := t.links[code]
+	return link, ok
+}
+
+// FollowLink counts a click on a link and returns it, unless the link has
+// expired by now. Saving the store on every click is the price of keeping
+// the file as the only storage; a database would just increment a column.
+func (s *Store) FollowLink(tenant, code string, now time.Time) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return Link{}, errLinkNotFound
+	}
+	link, ok := t.links[code]
+	if !ok {
+		return Link{}, errLinkNotFound
+	}
+	if link.expired(now) {
+		return Link{}, errLinkExpired
+	}
+	link.Clicks++
+	t.links[code] = link
+	s.persist()
+	return link, nil
+}
+
+// AddRefreshToken saves a newly issued refresh token. Expired tokens are
+// dropped at the same time, so the store only grows with tokens in use.
+func (s *Store) AddRefreshToken(tenant string, token RefreshToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	now := s.now()
+	for id, old := range t.refreshTokens {
+		if !now.Before(old.ExpiresAt) {
+			delete(t.refreshTokens, id)
+		}
+	}
+	t.refreshTokens[token.ID] = token
+	s.persist()
+}
+
+// UseRefreshToken spends a refresh token and returns it. A token that's
+// been spent already revokes its whole family, and returns
+// errRefreshTokenReused.
+func (s *Store) UseRefreshToken(tenant, id string, now time.Time) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return RefreshToken{}, errRefreshTokenInvalid
+	}
+	token, ok := t.refreshTokens[id]
+	if !ok || token.RevokedAt != nil || !now.Before(token.ExpiresAt) {
+		return RefreshToken{}, errRefreshTokenInvalid
+	}
+	if token.UsedAt != nil {
+		revokeFamily(t, token.Family, now.UTC())
+		s.persist()
+		return RefreshToken{}, errRefreshTokenReused
+	}
+	used := now.UTC()
+	token.UsedAt = &used
+	t.refreshTokens[id] = token
+	s.persist()
+	return token, nil
+}
+
+// RevokeRefreshTokens revokes the family of every refresh token match
+// accepts, and returns how many of them could still have been used: the
+// number of sign-ins ended, since a family has one such token at a time.
+func (s *Store) RevokeRefreshTokens(tenant string, now time.Time, match func(RefreshToken) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return 0
+	}
+	families := make(map[string]bool)
+	for _, token := range t.refreshTokens {
+		if match(token) {
+			families[token.Family] = true
+		}
+	}
+	revoked := 0
+	for family := range families {
+		revoked += revokeFamily(t, family, now.UTC())
+	}
+	if len(families) > 0 {
+		s.persist()
+	}
+	return revoked
+}
+
+// revokeFamily revokes a family of refresh tokens and returns how many of
+// them were live: unspent, unrevoked and unexpired. The caller must hold
+// the lock.
+func revokeFamily(t *tenantData, family string, now time.Time) int {
+	live := 0
+	for id, token := range t.refreshTokens {
+		if token.Family != family || token.RevokedAt != nil {
+			continue
+		}
+		if token.UsedAt == nil && now.Before(token.ExpiresAt) {
+			live++
+		}
+		token.RevokedAt = &now
+		t.refreshTokens[id] = token
+	}
+	return live
+}
+
+// sortedRefreshTokens returns the refresh tokens of a map oldest first.
+func sortedRefreshTokens(m map[string]RefreshToken) []RefreshToken {
+	tokens := make([]RefreshToken, 0, len(m))
+	for _, token := range m {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].IssuedAt.Equal(tokens[j].IssuedAt) {
+			return tokens[i].ID < tokens[j].ID
+		}
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	return tokens
+}
+
+// CreateUser saves a new user, unless their username or email address is
+// taken.
+func (s *Store) CreateUser(tenant string, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	for _, u := range t.users {
+		if u.Username == user.Username {
+			return User{}, errUsernameTaken
+		}
+		if strings.EqualFold(u.Email, user.Email) {
+			return User{}, errEmailTaken
+		}
+	}
+	user.CreatedAt = s.now()
+	t.users[user.ID] = user
+	s.persist()
+	return user, nil
+}
+
+// GetUser looks up a user by ID.
+func (s *Store) GetUser(tenant, id string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		return User{}, false
+	}
+	user, ok := t.users[id]
+	return user, ok
+}
+
+// FindUser looks up a user by username or email address, ignoring case.
+// Usernames can't contain "@", so the two can't be confused. Users waiting
+// to be erased aren't found, so they can't log in.
+func (s *Store) FindUser(tenant, login string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.tenants[tenant]; ok {
+		for _, u := range t.users {
+			if u.DeletionRequestedAt != nil {
+				continue
+			}
+			if strings.EqualFold(u.Username, login) || strings.EqualFold(u.Email, login) {
+				return u, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// RequestUserDeletion marks a user to be erased, and revokes all their
+// refresh tokens. It returns the user, and whether this is the first
+// request: asking again changes nothing.
+func (s *Store) RequestUserDeletion(tenant, id string, now time.Time) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	user, ok := t.users[id]
+	if !ok || user.DeletionRequestedAt != nil {
+		return user, false
+	}
+	requested := now.UTC()
+	user.DeletionRequestedAt = &requested
+	t.users[id] = user
+	for _, token := range t.refreshTokens {
+		if token.Subject == id {
+			revokeFamily(t, token.Family, requested)
+		}
+	}
+	s.persist()
+	return user, true
+}
+
+// ErasedUser identifies a user EraseRequestedUsers erased.
+type ErasedUser struct {
+	Tenant, UserID string
+}
+
+// EraseRequestedUsers removes, in every tenant, the users whose deletion
+// has been requested, with their refresh tokens, and audits each erasure.
+func (s *Store) EraseRequestedUsers(now time.Time) []ErasedUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var erased []ErasedUser
+	for tenant, t := range s.tenants {
+		for _, user := range sortedUsers(t.users) {
+			if user.DeletionRequestedAt == nil {
+				continue
+			}
+			delete(t.users, user.ID)
+			for id, token := range t.refreshTokens {
+				if token.Subject == user.ID {
+					delete(t.refreshTokens, id)
+				}
+			}
+			t.audit = append(t.audit, AuditEntry{Time: now.UTC(), Action: auditErased, UserID: user.ID})
+			erased = append(erased, ErasedUser{Tenant: tenant, UserID: user.ID})
+		}
+	}
+	if len(erased) > 0 {
+		s.persist()
+	}
+	return erased
+}
+
+// UserRefreshTokens returns a user's refresh tokens, oldest first.
+func (s *Store) UserRefreshTokens(tenant, id string) []RefreshToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := []RefreshToken{}
+	if t, ok := s.tenants[tenant]; ok {
+		for _, token := range sortedRefreshTokens(t.refreshTokens) {
+			if token.Subject == id {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// AddAuditEntry appends an entry to a tenant's audit log.
+func (s *Store) AddAuditEntry(tenant string, entry AuditEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	t.audit = append(t.audit, entry)
+	s.persist()
+}
+
+// ListAudit returns a tenant's audit entries, oldest first: all of them,
+// or only a user's if userID isn't empty.
+func (s *Store) ListAudit(tenant, userID string) []AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []AuditEntry{}
+	if t, ok := s.tenants[tenant]; ok {
+		for _, e := range t.audit {
+			if userID == "" || e.UserID == userID {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// sortedUsers returns the users of a map oldest first.
+func sortedUsers(m map[string]User) []User {
+	users := make([]User, 0, len(m))
+	for _, u := range m {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	return users
+}
+
+// CompleteExercise records that a learner completed an exercise at the
+// given time, and reports whether that's news. The first completion is
+// the one kept.
+func (s *Store) CompleteExercise(tenant, learner, exercise string, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	if _, done := t.progress[learner][exercise]; done {
+		return false
+	}
+	if t.progress[learner] == nil {
+		t.progress[learner] = make(map[string]time.Time)
+	}
+	t.progress[learner][exercise] = at.UTC()
+	s.persist()
+	return true
+}
+
+// Completions returns when a learner completed each exercise, by exercise
+// ID.
+func (s *Store) Completions(tenant, learner string) map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	done := make(map[string]time.Time)
+	if t, ok := s.tenants[tenant]; ok {
+		for exercise, at := range t.progress[learner] {
+			done[exercise] = at
+		}
+	}
+	return done
+}
+
+// sortedCompletions flattens a progress map into a list, ordered by learner
+// and then by time.
+func sortedCompletions(m map[string]map[string]time.Time) []Completion {
+	completions := []Completion{}
+	for learner, exercises := range m {
+		for exercise, at := range exercises {
+			completions = append(completions, Completion{Learner: learner, Exercise: exercise, CompletedAt: at})
+		}
+	}
+	sort.Slice(completions, func(i, j int) bool {
+		a, b := completions[i], completions[j]
+		if a.Learner != b.Learner {
+			return a.Learner < b.Learner
+		}
+		if !a.CompletedAt.Equal(b.CompletedAt) {
+			return a.CompletedAt.Before(b.CompletedAt)
+		}
+		return a.Exercise < b.Exercise
+	})
+	return completions
+}
+
+// IncrementCounter adds one to the tenant's counter and returns the new
+// value. It's saved to the data file by the next Flush.
+func (s *Store) IncrementCounter(tenant string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	t.counter++
+	s.unsaved = s.path != ""
+	return t.counter
+}
+
+// Counter returns the tenant's current counter value.
+func (s *Store) Counter(tenant string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.tenants[tenant]; ok {
+		return t.counter
+	}
+	return 0
+}
+
+// AppendCounterEvent decides what a command does to the tenant's
+// event-sourced counter and appends the event, taking a snapshot every
+// counterSnapshotEvery events. A refused command appends nothing.
+func (s *Store) AppendCounterEvent(tenant string, cmd CounterCommand) (EventCounterResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenant)
+	event, err := t.eventCounter.decide(cmd, s.now())
+	if err != nil {
+		return EventCounterResponse{}, err
+	}
+	t.counterEvents = append(t.counterEvents, event)
+	t.eventCounter = t.eventCounter.apply(event)
+	if t.eventCounter.Version%counterSnapshotEvery == 0 {
+		t.counterSnapshot = &CounterSnapshot{EventCounter: t.eventCounter, TakenAt: event.At}
+	}
+	s.persist()
+
+	resp := t.eventCounterResponse()
+	resp.Event = &event
+	return resp, nil
+}
+
+// EventCounterAt returns the tenant's event-sourced counter as it was after
+// version events, replaying them, or as it is now if version is 0. It
+// reports false for a version that hasn't happened yet.
+func (s *Store) EventCounterAt(tenant string, version int64) (EventCounterResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		t = newTenantData()
+	}
+	if version == 0 || version == t.eventCounter.Version {
+		return t.eventCounterResponse(), true
+	}
+	if version > t.eventCounter.Version {
+		return EventCounterResponse{}, false
+	}
+	state, replayed := replayCounter(t.counterSnapshot, t.counterEvents, version)
+	resp := EventCounterResponse{EventCounter: state, Replayed: replayed}
+	if replayed < int(version) {
+		resp.SnapshotVersion = t.counterSnapshot.Version
+	}
+	return resp, true
+}
+
+// eventCounterResponse describes the current state of the counter.
+func (t *tenantData) eventCounterResponse() EventCounterResponse {
+	resp := EventCounterResponse{EventCounter: t.eventCounter, Replayed: int(t.eventCounter.Version)}
+	if t.counterSnapshot != nil {
+		resp.SnapshotVersion = t.counterSnapshot.Version
+		resp.Replayed -= int(t.counterSnapshot.Version)
+	}
+	return resp
+}
+
+// CounterEvents returns the tenant's counter events after version after, in
+// order.
+func (s *Store) CounterEvents(tenant string, after int64) []CounterEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []CounterEvent{}
+	if t, ok := s.tenants[tenant]; ok {
+		// Versions count from 1 with no gaps, so event n is at index n-1.
+		if after < int64(len(t.counterEvents)) {
+			events = append(events, t.counterEvents[after:]...)
+		}
+	}
+	return events
+}
+
+// CounterTenants returns the tenants whose event-sourced counter has
+// events.
+func (s *Store) CounterTenants() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tenants []string
+	for id, t := range s.tenants {
+		if len(t.counterEvents) > 0 {
+			tenants = append(tenants, id)
+		}
+	}
+	return tenants
+}
+
+// StoreSnapshot is a copy of everything in the store, used for backups.
+type StoreSnapshot struct {
+	Tenants map[string]TenantSnapshot `json:"tenants"`
+}
+
+// TenantSnapshot is a copy of one tenant's data. Files holds only the
+// metadata of uploaded files; their contents stay in UPLOAD_DIR.
+type TenantSnapshot struct {
+	Notes     []Note           `json:"notes"`
+	Files     []FileInfo       `json:"files"`
+	Guestbook []GuestbookEntry `json:"guestbook"`
+	Links     []Link           `json:"links"`
+	Progress  []Completion     `json:"progress"`
+	Counter   int64            `json:"counter"`
+
+	// CounterEvents and CounterSnapshot are the event-sourced counter. Its
+	// state isn't saved: it's replayed from them when the store is loaded.
+	CounterEvents   []CounterEvent   `json:"counter_events"`
+	CounterSnapshot *CounterSnapshot `json:"counter_snapshot,omitempty"`
+
+	// RefreshTokens holds hashes of the refresh tokens, never the tokens.
+	RefreshTokens []RefreshToken `json:"refresh_tokens"`
+
+	// Users holds password hashes, never passwords.
+	Users []User `json:"users"`
+
+	// Audit is the log of what's been done to users' data.
+	Audit []AuditEntry `json:"audit"`
+}
+
+// Completion records that a learner completed an exercise.
+type Completion struct {
+	Learner     string    `json:"learner"`
+	Exercise    string    `json:"exercise"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// Snapshot returns a consistent copy of the whole store. Taking it under a
+// single read lock guarantees no write can land halfway through.
+func (s *Store) Snapshot() StoreSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot()
+}
+
+// snapshot copies the store. The caller must hold the lock.
+func (s *Store) snapshot() StoreSnapshot {
+	snap := StoreSnapshot{Tenants: make(map[string]TenantSnapshot)}
+	for id, t := range s.tenants {
+		ts := TenantSnapshot{Notes: []Note{}, Files: sortedFiles(t.files), Guestbook: sortedGuestbook(t.guestbook), Links: sortedLinks(t.links), Progress: sortedCompletions(t.progress), Counter: t.counter,
+			CounterEvents: append([]CounterEvent{}, t.counterEvents...), CounterSnapshot: t.counterSnapshot, RefreshTokens: sortedRefreshTokens(t.refreshTokens),
+			Users: sortedUsers(t.users), Audit: append([]AuditEntry{}, t.audit...)}
+		for _, n := range t.notes {
+			ts.Notes = append(ts.Notes, n)
+		}
+		sortNotes(ts.Notes)
+		snap.Tenants[id] = ts
+	}
+	return snap
+}
+
+// Restore replaces the entire contents of the store with a snapshot.
+func (s *Store) Restore(snap StoreSnapshot) {
+	// Build the new data first and swap it in at the end, so readers see
+	// either the old contents or the new ones, never a mixture.
+	tenants := tenantsFromSnapshot(snap)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants = tenants
+	s.persist()
+}
+
+// tenantsFromSnapshot rebuilds the store's maps from a snapshot.
+func tenantsFromSnapshot(snap StoreSnapshot) map[string]*tenantData {
+	tenants := make(map[string]*tenantData)
+	for id, ts := range snap.Tenants {
+		t := newTenantData()
+		t.counter = ts.Counter
+		for _, n := range ts.Notes {
+			t.notes[n.ID] = n
+		}
+		for _, f := range ts.Files {
+			t.files[f.ID] = f
+		}
+		for _, e := range ts.Guestbook {
+			t.guestbook[e.ID] = e
+		}
+		for _, l := range ts.Links {
+			t.links[l.Code] = l
+		}
+		for _, u := range ts.Users {
+			t.users[u.ID] = u
+		}
+		for _, token := range ts.RefreshTokens {
+			t.refreshTokens[token.ID] = token
+		}
+		t.audit = ts.Audit
+		for _, c := range ts.Progress {
+			if t.progress[c.Learner] == nil {
+				t.progress[c.Learner] = make(map[string]time.Time)
+			}
+			t.progress[c.Learner][c.Exercise] = c.CompletedAt
+		}
+		t.counterEvents, t.counterSnapshot = ts.CounterEvents, ts.CounterSnapshot
+		t.eventCounter, _ = replayCounter(t.counterSnapshot, t.counterEvents, 0)
+		tenants[id] = t
+	}
+	return tenants
+}
+
+// newID generates a random identifier. Random IDs (rather than 1, 2, 3...)
+// don't leak how many records exist and never collide between tenants.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the operating system's random source is
+		// broken, in which case there's nothing sensible left to do.
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
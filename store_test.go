@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestStoreTenantIsolation verifies that tenants never see each other's data,
+// which is the most important property of a multi-tenant store.
+func TestStoreTenantIsolation(t *testing.T) {
+	store := newStore()
+
+	note := store.CreateNote("acme", "Acme note", "")
+	store.CreateNote("globex", "Globex note", "")
+
+	if notes := store.ListNotes("acme"); len(notes) != 1 || notes[0].Title != "Acme note" {
+		t.Errorf("Expected only acme's note, got %+v", notes)
+	}
+
+	if _, ok := store.GetNote("globex", note.ID); ok {
+		t.Error("Expected globex not to see acme's note")
+	}
+
+	if err := store.DeleteNote("globex", note.ID, nil); err == nil {
+		t.Error("Expected globex not to be able to delete acme's note")
+	}
+
+	store.IncrementCounter("acme")
+	if got := store.Counter("globex"); got != 0 {
+		t.Errorf("Expected globex counter 0, got %d", got)
+	}
+}
+
+// TestStoreCounterConcurrency increments the counter from many goroutines at
+// once. Run with -race (as "make test" does) to catch missing locking.
+func TestStoreCounterConcurrency(t *testing.T) {
+	store := newStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.IncrementCounter("acme")
+		}()
+	}
+	wg.Wait()
+
+	if got := store.Counter("acme"); got != 50 {
+		t.Errorf("Expected counter 50, got %d", got)
+	}
+}
+
+// TestStorePersistence saves to a data file and opens it again, as a
+// restarted server would.
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	note := store.CreateNote("acme", "Saved", "to disk")
+	store.IncrementCounter("acme")
+	store.Flush()
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if got, ok := reopened.GetNote("acme", note.ID); !ok || got.Body != "to disk" {
+		t.Errorf("Expected the note to survive a restart, got %+v", got)
+	}
+	if got := reopened.Counter("acme"); got != 1 {
+		t.Errorf("Expected counter 1, got %d", got)
+	}
+}
+
+// TestOpenStoreRejectsOldSchema checks that a data file needing migrations
+// is refused instead of being misread.
+func TestOpenStoreRejectsOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := os.WriteFile(path, []byte(`{"schema_version": 0, "tenants": {}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := openStore(path)
+	if err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Errorf("Expected an error suggesting migrate up, got %v", err)
+	}
+}
+
+// TestStoreConditionalUpdate checks a rejected precondition leaves the note
+// untouched.
+func TestStoreConditionalUpdate(t *testing.T) {
+	store := newStore()
+	note := store.CreateNote("acme", "Original", "")
+
+	reject := func(Note) bool { return false }
+	if _, err := store.UpdateNote("acme", Note{ID: note.ID, Title: "Changed"}, reject); err != errNoteChanged {
+		t.Errorf("Expected errNoteChanged, got %v", err)
+	}
+	if err := store.DeleteNote("acme", note.ID, reject); err != errNoteChanged {
+		t.Errorf("Expected errNoteChanged, got %v", err)
+	}
+	if got, ok := store.GetNote("acme", note.ID); !ok || got.Title != "Original" {
+		t.Errorf("Expected the note to be unchanged, got %+v", got)
+	}
+
+	if err := store.DeleteNote("acme", "missing", nil); err != errNoteNotFound {
+		t.Errorf("Expected errNoteNotFound, got %v", err)
+	}
+}
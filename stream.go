@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// This file implements GET /api/v1/stream, an example of a streaming
+// response. Most handlers build a whole response and send it at once; this
+// one sends a line of JSON every interval_ms milliseconds (500 by default)
+// for as long as the client keeps the connection open, or until count
+// lines have been sent:
+//
+//	curl -N 'http://localhost:8000/api/v1/stream?interval_ms=200&count=10'
+//
+// (-N stops curl buffering the output.) Three things make it work:
+//   - Flushing. The ResponseWriter buffers what's written and sends it in
+//     chunks (Transfer-Encoding: chunked, since the length isn't known up
+//     front). Flush sends what's buffered now rather than when the buffer
+//     fills or the handler returns.
+//   - Cancellation. When the client disconnects, the request's context is
+//     cancelled, which is how the handler knows to stop. Without checking
+//     it, the loop would run forever writing to nobody.
+//   - Deadlines. The server's WRITE_TIMEOUT would cut the stream off after
+//     a few seconds, so the handler clears it for its own response, the
+//     way the dashboard's event stream does.
+//
+// Each line is a JSON document, a format called NDJSON (newline-delimited
+// JSON), so a client can parse lines as they arrive.
+
+// Bounds and default of the interval_ms query parameter.
+const (
+	defaultStreamInterval = 500
+	minStreamInterval     = 10
+	maxStreamInterval     = 10000
+)
+
+// StreamLine is one line of GET /api/v1/stream.
+type StreamLine struct {
+	Seq       int       `json:"seq"`
+	Time      time.Time `json:"time"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+}
+
+// streamParams reads interval_ms and count from the query. A count of 0
+// means no limit.
+func streamParams(r *http.Request) (time.Duration, int, error) {
+	q := r.URL.Query()
+	interval := defaultStreamInterval
+	if raw := q.Get("interval_ms"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < minStreamInterval || n > maxStreamInterval {
+			return 0, 0, fmt.Errorf("interval_ms must be a number between %d and %d", minStreamInterval, maxStreamInterval)
+		}
+		interval = n
+	}
+	count := 0
+	if raw := q.Get("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("count must be a number, 0 or more")
+		}
+		count = n
+	}
+	return time.Duration(interval) * time.Millisecond, count, nil
+}
+
+// handleStream writes a line of JSON every interval until the client goes
+// away, count lines have been sent, or the server shuts down.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	interval, count, err := streamParams(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Without this, browsers may hold the text back to guess its type.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := s.clock.Now()
+	enc := json.NewEncoder(w)
+	for seq := 1; count == 0 || seq <= count; seq++ {
+		now := s.clock.Now()
+		if err := enc.Encode(StreamLine{Seq: seq, Time: now, ElapsedMs: now.Sub(start).Milliseconds()}); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if seq == count {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-ticker.C():
+		}
+	}
+}
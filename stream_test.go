@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestStreamCount checks the lines of a stream with a count.
+func TestStreamCount(t *testing.T) {
+	srv := httptest.NewServer(newServer(defaultConfig(t)).routes())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/stream?interval_ms=10&count=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected NDJSON, got %q", ct)
+	}
+
+	var lines []StreamLine
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line StreamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Line %q isn't JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 || lines[0].Seq != 1 || lines[2].Seq != 3 {
+		t.Errorf("Expected lines 1 to 3, got %+v", lines)
+	}
+}
+
+// TestStreamDisconnect checks lines arrive as they're written, and the
+// handler stops when the client goes away.
+func TestStreamDisconnect(t *testing.T) {
+	done := make(chan struct{})
+	s := newServer(defaultConfig(t))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleStream(w, r)
+		close(done)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/stream?interval_ms=20", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Two lines arrive without the response having ended.
+	scanner := bufio.NewScanner(resp.Body)
+	for range 2 {
+		if !scanner.Scan() {
+			t.Fatalf("Expected a line, got %v", scanner.Err())
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the handler to stop after the client disconnected")
+	}
+}
+
+// TestStreamParams checks invalid query parameters are rejected.
+func TestStreamParams(t *testing.T) {
+	s := newServer(defaultConfig(t))
+	for _, query := range []string{"interval_ms=5", "interval_ms=soon", "count=-1"} {
+		rec := httptest.NewRecorder()
+		s.handleStream(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+// FuzzStreamParams checks streamParams accepts only what it should. The
+// handler isn't fuzzed itself, since a count of 0 streams forever.
+//
+//	go test -fuzz FuzzStreamParams -fuzztime 30s
+func FuzzStreamParams(f *testing.F) {
+	f.Add("interval_ms=100&count=3")
+	f.Add("interval_ms=9223372036854775807&count=-0")
+	f.Add("count=%zz")
+
+	f.Fuzz(func(t *testing.T, query string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil)
+		req.URL.RawQuery = query
+		interval, count, err := streamParams(req)
+		if err != nil {
+			return
+		}
+		if interval < minStreamInterval*time.Millisecond || interval > maxStreamInterval*time.Millisecond || count < 0 {
+			t.Errorf("streamParams(%q) = %v, %d", query, interval, count)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The landing page HTML lives in the templates directory and its CSS in the
+// static directory, rather than in Go strings, so they can be edited with
+// proper syntax highlighting.
+//
+// The //go:embed directive below tells the compiler to copy both directories
+// into the binary at build time. The finished binary is still a single file
+// with nothing else to deploy, which is why our Docker image only needs to
+// copy the server executable.
+//
+// The downside of embedding is that every HTML or CSS tweak needs a rebuild.
+// With DEV_MODE=true the files are read from disk instead and reloaded as soon
+// as they change, so frontend edits show up on a browser refresh.
+
+//go:embed templates static
+var embeddedFS embed.FS
+
+// Assets provides the templates and static files, either from the copy
+// embedded in the binary or, in dev mode, from disk.
+type Assets struct {
+	fsys fs.FS
+	dev  bool
+
+	// The parsed templates are replaced when files change, so they're
+	// guarded by a mutex like any other state shared between goroutines.
+	// Each page is parsed on its own, so a mistake in one page doesn't
+	// break the others.
+	mu        sync.RWMutex
+	pages     map[string]*template.Template
+	parseErrs map[string]error
+}
+
+// pageTemplates are the pages in the templates directory.
+var pageTemplates = []string{"index.html", "guestbook.html", "contact.html", "dashboard.html", "inspect.html", "learn.html", "admin.html", "maintenance.html"}
+
+// newAssets loads the assets. In dev mode they're read from the working
+// directory, so run the server from the repository root ("go run .").
+func newAssets(dev bool) *Assets {
+	if dev {
+		return newAssetsFrom(os.DirFS("."), true)
+	}
+	return newAssetsFrom(embeddedFS, false)
+}
+
+// newAssetsFrom loads the assets from any file system, which lets tests point
+// dev mode at a temporary directory.
+func newAssetsFrom(fsys fs.FS, dev bool) *Assets {
+	a := &Assets{fsys: fsys, dev: dev}
+
+	// The embedded templates were checked when the binary was built and
+	// tested, so a parse error there is a programming mistake: panic right
+	// away. Files on disk are being edited by a person, so in dev mode the
+	// error is kept and shown on the page until they fix it.
+	if err := a.Reload(); err != nil && !dev {
+		panic(err)
+	}
+	return a
+}
+
+// Reload parses the templates again, returning every page's error.
+func (a *Assets) Reload() error {
+	pages := make(map[string]*template.Template)
+	parseErrs := make(map[string]error)
+	var errs []error
+	for _, name := range pageTemplates {
+		tmpl, err := template.ParseFS(a.fsys, "templates/"+name)
+		if err != nil {
+			parseErrs[name] = err
+			errs = append(errs, err)
+			continue
+		}
+		pages[name] = tmpl
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.parseErrs = parseErrs
+	for name, tmpl := range pages {
+		if a.pages == nil {
+			a.pages = make(map[string]*template.Template)
+		}
+		a.pages[name] = tmpl
+	}
+	return errors.Join(errs...)
+}
+
+// Page returns a page's template, or the error that stopped it from
+// parsing.
+func (a *Assets) Page(name string) (*template.Template, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if err := a.parseErrs[name]; err != nil {
+		return nil, err
+	}
+	return a.pages[name], nil
+}
+
+// Index returns the landing page template.
+func (a *Assets) Index() (*template.Template, error) {
+	return a.Page("index.html")
+}
+
+// renderPage renders a page template and sends it with the given status.
+func (s *Server) renderPage(w http.ResponseWriter, name string, status int, data any) {
+	// In dev mode the template is read from disk, so it may currently have
+	// a syntax error. Showing it in the browser is the quickest way to fix it.
+	tmpl, err := s.assets.Page(name)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, fmt.Sprintf("template error: %v", err))
+		return
+	}
+
+	// Render into a buffer first. If the template fails halfway through we
+	// can still send a proper error instead of half a page.
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		slog.Error("rendering template failed", "template", name, "error", err)
+		writeProblem(w, http.StatusInternalServerError, "failed to render page")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// StaticHandler serves files from the static directory under /static/.
+func (a *Assets) StaticHandler() http.Handler {
+	static, err := fs.Sub(a.fsys, "static")
+	if err != nil {
+		// fs.Sub only fails for malformed directory names.
+		panic(err)
+	}
+
+	files := http.StripPrefix("/static/", http.FileServerFS(static))
+	if !a.dev {
+		return files
+	}
+
+	// In dev mode, tell the browser not to cache, so a refresh always
+	// picks up the latest version of the file.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Watch polls the asset directories for changes until ctx is cancelled,
+// reloading the templates and calling onChange whenever something changes.
+// Polling is less efficient than operating-system file notifications, but it
+// works everywhere (including bind mounts in containers) without extra
+// dependencies, and a few dozen stat calls per second cost next to nothing.
+func (a *Assets) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	last := a.snapshot()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := a.snapshot()
+		if current == last {
+			continue
+		}
+		last = current
+
+		if err := a.Reload(); err != nil {
+			slog.Error("template reload failed", "error", err)
+		} else {
+			slog.Info("assets changed, templates reloaded")
+		}
+		if onChange != nil {
+			onChange()
+		}
+	}
+}
+
+// snapshot summarizes the name, size and modification time of every asset
+// file. Comparing two snapshots tells us whether anything changed.
+func (a *Assets) snapshot() string {
+	var sig strings.Builder
+	for _, dir := range []string{"templates", "static"} {
+		fs.WalkDir(a.fsys, dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				fmt.Fprintf(&sig, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return sig.String()
+}
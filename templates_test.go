@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStaticFiles checks that the embedded stylesheet is served.
+func TestStaticFiles(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/static/style.css", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Expected a CSS content type, got %s", ct)
+	}
+}
+
+// writeAsset is a small helper that creates a file, including its directory.
+func writeAsset(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAssetsWatchReloadsTemplates simulates dev mode: edit a template on disk
+// and check that the watcher picks up the new version.
+func TestAssetsWatchReloadsTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "templates/index.html", "version one")
+	writeAsset(t, dir, "static/style.css", "body {}")
+
+	assets := newAssetsFrom(os.DirFS(dir), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go assets.Watch(ctx, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	// Let the watcher take its first snapshot before editing.
+	time.Sleep(30 * time.Millisecond)
+	writeAsset(t, dir, "templates/index.html", "version two, which is longer")
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the watcher to notice the change")
+	}
+
+	tmpl, err := assets.Index()
+	if err != nil {
+		t.Fatalf("Expected the template to parse, got %v", err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "version two, which is longer" {
+		t.Errorf("Expected the reloaded template, got %q", out.String())
+	}
+}
+
+// TestAssetsDevModeKeepsParseErrors checks that a broken template on disk is
+// reported rather than crashing the server.
+func TestAssetsDevModeKeepsParseErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeAsset(t, dir, "templates/index.html", "{{ .Broken ")
+
+	assets := newAssetsFrom(os.DirFS(dir), true)
+	if _, err := assets.Index(); err == nil {
+		t.Error("Expected a template parse error")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// This file implements multi-tenant request scoping. In a SaaS application a
+// single deployment serves many customers ("tenants"), and every request has
+// to be attributed to exactly one of them before any data is touched.
+//
+// We support the two most common ways of identifying a tenant:
+//   - an explicit X-Tenant-ID header, handy for APIs and curl experiments
+//   - a subdomain, such as acme.hello.example.com, which is what browsers use
+//
+// Either way the tenant is chosen by the client, so only the tenants listed
+// in TENANTS, and the default one, are served; any other gets a 404. Taking
+// whatever a client sent would let anyone add tenants at will, each one
+// kept in the data file from its first write and given its own series of
+// metrics, which are meant to have a small, fixed set of labels.
+
+// tenantHeader is the HTTP header clients can use to select a tenant.
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenant is used when a request doesn't identify a tenant at all.
+const defaultTenant = "default"
+
+// tenantIDPattern restricts tenant IDs to the characters allowed in a DNS
+// label. Validating untrusted input early keeps odd values out of logs,
+// metrics labels and storage keys.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// contextKey is a private type for context keys. Using our own type instead
+// of a plain string means no other package can accidentally read or
+// overwrite our values.
+type contextKey string
+
+const tenantContextKey contextKey = "tenant"
+
+// tenantFromContext returns the tenant stored in the context by
+// tenantMiddleware, or the default tenant if there isn't one.
+func tenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey).(string); ok {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// resolveTenant works out which tenant a request belongs to. The header wins
+// over the subdomain so that API clients can always be explicit. The boolean
+// is false when the client supplied a tenant ID that isn't valid.
+func resolveTenant(r *http.Request, baseDomain string) (string, bool) {
+	if id := r.Header.Get(tenantHeader); id != "" {
+		id = strings.ToLower(id)
+		return id, tenantIDPattern.MatchString(id)
+	}
+
+	if id := tenantFromHost(r.Host, baseDomain); id != "" {
+		return id, tenantIDPattern.MatchString(id)
+	}
+
+	return defaultTenant, true
+}
+
+// knownTenant reports whether id is the default tenant or one of TENANTS.
+func knownTenant(cfg Config, id string) bool {
+	return id == defaultTenant || slices.Contains(cfg.Tenants, id)
+}
+
+// tenantFromHost extracts the tenant from a host like "acme.example.com" when
+// the base domain is "example.com". Only a single label directly below the
+// base domain counts, so "example.com" itself and unrelated hosts such as
+// "localhost" map to no tenant.
+func tenantFromHost(host, baseDomain string) string {
+	if baseDomain == "" {
+		return ""
+	}
+
+	// The Host header may include a port (localhost:8000), which we strip.
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	baseDomain = strings.ToLower(strings.TrimPrefix(baseDomain, "."))
+
+	sub, ok := strings.CutSuffix(host, "."+baseDomain)
+	if !ok || sub == "" || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// tenantMiddleware identifies the tenant for every request and stores it in
+// the request context, where handlers, logging and metrics can find it.
+// Requests with a malformed or unknown tenant ID are rejected before
+// reaching the handler.
+func (s *Server) tenantMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		tenant, ok := resolveTenant(r, cfg.TenantDomain)
+		if !ok {
+			writeProblem(w, http.StatusBadRequest, "invalid tenant ID")
+			return
+		}
+		if !knownTenant(cfg, tenant) {
+			writeProblem(w, http.StatusNotFound, "unknown tenant")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestResolveTenant covers the different ways a request can identify its
+// tenant. This is a "table-driven test": each entry in the slice is one case,
+// and the loop runs them all. Adding a new case is just adding a line.
+func TestResolveTenant(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		header     string
+		baseDomain string
+		want       string
+		wantOK     bool
+	}{
+		{"no tenant", "localhost:8000", "", "", defaultTenant, true},
+		{"header", "localhost:8000", "acme", "", "acme", true},
+		{"header is lowercased", "localhost", "ACME", "", "acme", true},
+		{"invalid header", "localhost", "acme corp", "", "acme corp", false},
+		{"subdomain", "acme.example.com:8000", "", "example.com", "acme", true},
+		{"header beats subdomain", "acme.example.com", "globex", "example.com", "globex", true},
+		{"base domain itself", "example.com", "", "example.com", defaultTenant, true},
+		{"nested subdomain", "a.b.example.com", "", "example.com", defaultTenant, true},
+		{"subdomain ignored without base domain", "acme.example.com", "", "", defaultTenant, true},
+	}
+
+	for _, tt := range tests {
+		// t.Run creates a subtest so failures report which case broke.
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			if tt.header != "" {
+				req.Header.Set(tenantHeader, tt.header)
+			}
+
+			got, ok := resolveTenant(req, tt.baseDomain)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("resolveTenant() = %q, %v; want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestTenantMiddleware verifies the tenant reaches the handler through the
+// request context and that invalid and unknown tenant IDs are rejected.
+func TestTenantMiddleware(t *testing.T) {
+	srv := newServer(Config{Tenants: []string{"acme"}})
+
+	var seen string
+	handler := srv.tenantMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		seen = tenantFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tenantHeader, "acme")
+	handler(httptest.NewRecorder(), req)
+
+	if seen != "acme" {
+		t.Errorf("Expected tenant acme in context, got %q", seen)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tenantHeader, "not/valid")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid tenant, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(tenantHeader, "globex")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown tenant, got %d", rec.Code)
+	}
+}
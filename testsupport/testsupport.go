@@ -0,0 +1,224 @@
+// Package testsupport has helpers for testing HTTP handlers: a client that
+// sends requests straight to an http.Handler, and assertions on the
+// responses.
+//
+// The server itself lives in package main, which no other package can
+// import, so this package works with any http.Handler. Tests in package main
+// get a client for the full server from newTestServer (see server_test.go):
+//
+//	_, c := newTestServer(t)
+//	resp := c.Post("/api/v1/notes", map[string]string{"title": "Hello"}).
+//		Status(http.StatusCreated)
+//	note := testsupport.Decode[Note](resp)
+//	c.Get("/api/v1/notes/" + note.ID).Status(http.StatusOK).
+//		JSON(`{"title": "Hello", "body": "", "...": "..."}`)
+//
+// Requests don't go over the network: the client calls the handler's
+// ServeHTTP with an httptest.ResponseRecorder, which is fast and needs no
+// free port.
+package testsupport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Client sends requests to a handler. Failures are reported on the test it
+// was created with.
+type Client struct {
+	t testing.TB
+	h http.Handler
+
+	// Header is added to every request, for example a tenant or an
+	// Authorization header.
+	Header http.Header
+}
+
+// New returns a client for h.
+func New(t testing.TB, h http.Handler) *Client {
+	return &Client{t: t, h: h, Header: http.Header{}}
+}
+
+// Get sends a GET request.
+func (c *Client) Get(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodGet, path, nil)
+}
+
+// Post sends a POST request with body, encoded as described for Do.
+func (c *Client) Post(path string, body any) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPost, path, body)
+}
+
+// Put sends a PUT request with body.
+func (c *Client) Put(path string, body any) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPut, path, body)
+}
+
+// Delete sends a DELETE request.
+func (c *Client) Delete(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodDelete, path, nil)
+}
+
+// Do sends a request. A string or []byte body is sent as it is; anything
+// else is encoded as JSON, with Content-Type: application/json. Use
+// DoRequest for full control.
+func (c *Client) Do(method, path string, body any) *Response {
+	c.t.Helper()
+
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	case []byte:
+		r = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			c.t.Fatalf("encoding %s %s body: %v", method, path, err)
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req := httptest.NewRequest(method, path, r)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.DoRequest(req)
+}
+
+// DoRequest sends req, after adding the client's Header to it.
+func (c *Client) DoRequest(req *http.Request) *Response {
+	c.t.Helper()
+	for key, values := range c.Header {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	rec := httptest.NewRecorder()
+	c.h.ServeHTTP(rec, req)
+	return &Response{ResponseRecorder: rec, t: c.t, req: req}
+}
+
+// Response is a recorded response. Its assertion methods return it, so
+// they can be chained.
+type Response struct {
+	*httptest.ResponseRecorder
+	t   testing.TB
+	req *http.Request
+}
+
+// String describes the request and response, for failure messages.
+func (r *Response) String() string {
+	return fmt.Sprintf("%s %s: %d %s", r.req.Method, r.req.URL, r.Code, strings.TrimSpace(r.Body.String()))
+}
+
+// Status fails the test now unless the status code is want. Later checks
+// would only add confusing failures.
+func (r *Response) Status(want int) *Response {
+	r.t.Helper()
+	if r.Code != want {
+		r.t.Fatalf("Expected status %d, got %s", want, r)
+	}
+	return r
+}
+
+// HasHeader checks the response header key is want.
+func (r *Response) HasHeader(key, want string) *Response {
+	r.t.Helper()
+	if got := r.Header().Get(key); got != want {
+		r.t.Errorf("Expected %s %q, got %q from %s", key, want, got, r)
+	}
+	return r
+}
+
+// JSON checks the body is the same JSON value as want. Spacing and the
+// order of object keys don't matter. In want, a "..." member of an object
+// stands for any other members, so a test only has to spell out the fields
+// it cares about:
+//
+//	{"title": "Hello", "...": "..."}
+func (r *Response) JSON(want string) *Response {
+	r.t.Helper()
+	AssertJSON(r.t, r.Body.Bytes(), want)
+	return r
+}
+
+// Decode decodes the body of r as JSON into a T, failing the test if it
+// can't.
+func Decode[T any](r *Response) T {
+	r.t.Helper()
+	var v T
+	if err := json.Unmarshal(r.Body.Bytes(), &v); err != nil {
+		r.t.Fatalf("Decoding %T from %s: %v", v, r, err)
+	}
+	return v
+}
+
+// AssertJSON checks got is the same JSON value as want, as described for
+// Response.JSON.
+func AssertJSON(t testing.TB, got []byte, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Errorf("Expected JSON, got %q: %v", got, err)
+		return
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("Invalid expected JSON %q: %v", want, err)
+	}
+	if !matchJSON(g, w) {
+		t.Errorf("JSON mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+// matchJSON compares decoded JSON values. An object in want with a "..."
+// key matches objects with extra members.
+func matchJSON(got, want any) bool {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		_, partial := w["..."]
+		if !partial && len(g) != len(w) {
+			return false
+		}
+		for key, wv := range w {
+			if key == "..." {
+				continue
+			}
+			if gv, ok := g[key]; !ok || !matchJSON(gv, wv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !matchJSON(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// echo responds with the request's method, Content-Type, X-Tenant-ID and
+// body as JSON.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"method":       r.Method,
+		"content_type": r.Header.Get("Content-Type"),
+		"tenant":       r.Header.Get("X-Tenant-ID"),
+		"body":         string(body),
+	})
+})
+
+// TestClient checks bodies are encoded, headers added and responses
+// checked and decoded.
+func TestClient(t *testing.T) {
+	c := New(t, echo)
+	c.Header.Set("X-Tenant-ID", "acme")
+
+	c.Post("/", map[string]int{"n": 1}).
+		Status(http.StatusAccepted).
+		HasHeader("Content-Type", "application/json").
+		JSON(`{"method": "POST", "content_type": "application/json", "tenant": "acme", "body": "{\"n\":1}"}`)
+
+	got := Decode[map[string]string](c.Put("/", "raw"))
+	if got["body"] != "raw" || got["content_type"] != "" {
+		t.Errorf("Expected a raw body, got %v", got)
+	}
+
+	c.Delete("/").JSON(`{"method": "DELETE", "...": "..."}`)
+}
+
+// TestMatchJSON checks key order and spacing are ignored, and "..." only
+// allows extra object members.
+func TestMatchJSON(t *testing.T) {
+	tests := []struct {
+		got, want string
+		match     bool
+	}{
+		{`{"a": 1, "b": [1, 2]}`, `{"b":[1,2],"a":1}`, true},
+		{`{"a": 1, "b": 2}`, `{"a": 1}`, false},
+		{`{"a": 1, "b": 2}`, `{"a": 1, "...": "..."}`, true},
+		{`{"a": {"b": 1, "c": 2}}`, `{"a": {"b": 1, "...": "..."}}`, true},
+		{`{"a": 1}`, `{"a": 1, "b": 2, "...": "..."}`, false},
+		{`[1, 2]`, `[2, 1]`, false},
+		{`1`, `1.0`, true},
+		{`null`, `{}`, false},
+	}
+	for _, tt := range tests {
+		var got, want any
+		json.Unmarshal([]byte(tt.got), &got)
+		json.Unmarshal([]byte(tt.want), &want)
+		if matchJSON(got, want) != tt.match {
+			t.Errorf("matchJSON(%s, %s): expected %v", tt.got, tt.want, tt.match)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	// Registering the GIF decoder lets image.Decode read GIFs. Thumbnails of
+	// GIFs are written as PNG, so the package isn't otherwise used.
+	_ "image/gif"
+)
+
+// This file generates thumbnails of uploaded images on demand:
+//
+//	GET /api/v1/files/{id}/thumbnail?w=200
+//
+// Resizing an image is CPU-bound work: every pixel of the original is read
+// and averaged, so a large photo takes noticeable milliseconds. Doing that on
+// every request would waste CPU, so each generated size is cached in the blob
+// store next to the original. The X-Cache response header shows whether a
+// request was served from the cache (HIT) or had to do the work (MISS); try
+// the same URL twice and compare the timings in the logs.
+
+const (
+	// Requested widths are rounded up to a multiple of thumbnailStep, so
+	// one image has at most maxThumbnailWidth/thumbnailStep cached sizes,
+	// however many different ?w= values clients ask for.
+	thumbnailStep     = 32
+	maxThumbnailWidth = 1024
+
+	defaultThumbnailWidth = 200
+
+	// maxSourcePixels refuses to decode huge images. A small, highly
+	// compressed file can claim to be 100000x100000 pixels (a "decompression
+	// bomb"); decoding it would need tens of gigabytes of memory.
+	maxSourcePixels = 40_000_000
+)
+
+// thumbnailWidth validates the ?w= parameter and rounds it to a cache step.
+func thumbnailWidth(raw string) (int, error) {
+	if raw == "" {
+		raw = strconv.Itoa(defaultThumbnailWidth)
+	}
+	w, err := strconv.Atoi(raw)
+	if err != nil || w < 1 || w > maxThumbnailWidth {
+		return 0, fmt.Errorf("w must be a width between 1 and %d", maxThumbnailWidth)
+	}
+	return (w + thumbnailStep - 1) / thumbnailStep * thumbnailStep, nil
+}
+
+// handleThumbnail serves a resized copy of an uploaded image.
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	info, ok := s.store.GetFile(tenant, r.PathValue("id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	// JPEG thumbnails stay JPEG (photos compress far better that way);
+	// PNG and GIF become PNG. Other types have no decoder in the standard
+	// library.
+	var outType string
+	switch info.ContentType {
+	case "image/jpeg":
+		outType = "image/jpeg"
+	case "image/png", "image/gif":
+		outType = "image/png"
+	default:
+		writeProblem(w, http.StatusUnsupportedMediaType, "thumbnails are only available for JPEG, PNG and GIF images")
+		return
+	}
+
+	width, err := thumbnailWidth(r.URL.Query().Get("w"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key := fmt.Sprintf("%s/thumbnails/%s-%d", tenant, info.ID, width)
+	cache := "HIT"
+	data, err := s.cachedThumbnail(r, key)
+	if err != nil {
+		cache = "MISS"
+		data, err = s.makeThumbnail(r, blobKey(tenant, info.ID), width, outType)
+		if errors.Is(err, errBlobNotFound) {
+			writeProblem(w, http.StatusNotFound, "file contents not found")
+			return
+		}
+		if err != nil {
+			writeProblem(w, http.StatusUnprocessableEntity, fmt.Sprintf("cannot make a thumbnail: %v", err))
+			return
+		}
+
+		// A failure to cache only costs time on the next request, so it's
+		// logged rather than failing this one.
+		if err := s.blobs.Put(r.Context(), key, bytes.NewReader(data), int64(len(data)), outType); err != nil {
+			slog.WarnContext(r.Context(), "caching thumbnail failed", "key", key, "error", err)
+		}
+	}
+
+	// A file's contents never change under the same ID, so neither do its
+	// thumbnails: browsers may keep them for a long time.
+	w.Header().Set("Content-Type", outType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Cache", cache)
+	w.Write(data)
+}
+
+// cachedThumbnail reads a previously generated thumbnail.
+func (s *Server) cachedThumbnail(r *http.Request, key string) ([]byte, error) {
+	blob, err := s.blobs.Open(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(blob)
+}
+
+// makeThumbnail decodes the original image, resizes it and encodes the result.
+func (s *Server) makeThumbnail(r *http.Request, key string, width int, outType string) ([]byte, error) {
+	blob, err := s.blobs.Open(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	original, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// DecodeConfig reads only the header, so the dimensions can be checked
+	// before any pixel memory is allocated.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxSourcePixels {
+		return nil, fmt.Errorf("image is %dx%d pixels, more than the %d allowed", cfg.Width, cfg.Height, maxSourcePixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	thumb := resize(img, width)
+
+	var buf bytes.Buffer
+	if outType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales an image down to the given width, keeping its aspect ratio.
+// Images are never scaled up: a thumbnail wider than the original would just
+// be a blurrier copy.
+//
+// Each output pixel is the average of the block of input pixels it covers
+// (a "box filter"). It's the simplest resampling method that doesn't drop
+// detail on the floor; libraries like golang.org/x/image/draw offer
+// smoother ones.
+func resize(src image.Image, width int) *image.RGBA {
+	b := src.Bounds()
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/height, y0+1)
+
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(b.Min.X+(x+1)*b.Dx()/width, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
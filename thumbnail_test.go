@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestThumbnailWidth checks validation and rounding of the ?w= parameter.
+func TestThumbnailWidth(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{"", 224, false},
+		{"1", 32, false},
+		{"64", 64, false},
+		{"65", 96, false},
+		{"1024", 1024, false},
+		{"0", 0, true},
+		{"5000", 0, true},
+		{"wide", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := thumbnailWidth(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("thumbnailWidth(%q) = %d, %v; want %d (error %v)", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestResize checks dimensions and that averaging blends colors.
+func TestResize(t *testing.T) {
+	// Left half black, right half white.
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 2; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			src.Set(x, y, color.White)
+		}
+	}
+	for x := 0; x < 2; x++ {
+		for y := 0; y < 2; y++ {
+			src.Set(x, y, color.Black)
+		}
+	}
+
+	one := resize(src, 1)
+	if b := one.Bounds(); b.Dx() != 1 || b.Dy() != 1 {
+		t.Fatalf("Expected a 1x1 image, got %v", b)
+	}
+	if r, _, _, _ := one.At(0, 0).RGBA(); r < 0x7000 || r > 0x9000 {
+		t.Errorf("Expected mid grey, got red channel %#x", r)
+	}
+
+	if b := resize(src, 100).Bounds(); b.Dx() != 4 {
+		t.Errorf("Expected no upscaling, got width %d", b.Dx())
+	}
+}
+
+// TestHandleThumbnail uploads a PNG and fetches a thumbnail twice, checking
+// that the second request is served from the cache.
+func TestHandleThumbnail(t *testing.T) {
+	srv := newUploadServer(t)
+	cfg := srv.config()
+	cfg.UploadMaxBytes = 1 << 20
+	srv.cfg = cfg
+	mux := srv.routes()
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 300, 150)))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, uploadRequest(t, "file", "wide.png", img.Bytes()))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var info FileInfo
+	json.Unmarshal(rec.Body.Bytes(), &info)
+
+	for _, wantCache := range []string{"MISS", "HIT"} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+info.ID+"/thumbnail?w=100", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != wantCache {
+			t.Errorf("Expected X-Cache %s, got %s", wantCache, got)
+		}
+
+		thumb, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("Expected a PNG thumbnail: %v", err)
+		}
+		if b := thumb.Bounds(); b.Dx() != 128 || b.Dy() != 64 {
+			t.Errorf("Expected 128x64 (100 rounded up), got %dx%d", b.Dx(), b.Dy())
+		}
+	}
+}
+
+// FuzzThumbnailWidth checks any accepted width is a cache step within the
+// limit.
+//
+//	go test -fuzz FuzzThumbnailWidth -fuzztime 30s
+func FuzzThumbnailWidth(f *testing.F) {
+	f.Add("224")
+	f.Add("9223372036854775807")
+	f.Add("+1")
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		w, err := thumbnailWidth(raw)
+		if err == nil && (w < thumbnailStep || w > maxThumbnailWidth || w%thumbnailStep != 0) {
+			t.Errorf("thumbnailWidth(%q) = %d", raw, w)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file gives each route a deadline. A handler stuck waiting on a slow
+// LLM or object store would otherwise hold its connection until the
+// server's WRITE_TIMEOUT cuts it off, and the client gets no response at
+// all. With a deadline, the client gets a 503 problem in good time, and
+// the handler's context is cancelled, so the outbound calls it's making
+// (which all take the request's context) give up too.
+//
+// HANDLER_TIMEOUT is the deadline for every route, and ROUTE_TIMEOUTS
+// overrides it for some, as a list of pattern=duration:
+//
+//	ROUTE_TIMEOUTS=GET /api/v1/quote=3s,POST /api/v1/files=2m
+//
+// A duration of 0 means no deadline. Long-lived routes, like the event
+// streams, and file uploads and downloads, which take as long as the
+// transfer does, have none unless ROUTE_TIMEOUTS gives them one. Both
+// settings are reloadable.
+//
+// The handler runs in its own goroutine, writing to a buffer, so that the
+// 503 can be sent even if the handler ignores its context and carries on;
+// whatever it writes after the deadline is thrown away. This is the same
+// approach as http.TimeoutHandler, which can't be used directly because it
+// answers with plain text rather than problem+json. A streamed route given
+// a deadline with ROUTE_TIMEOUTS is buffered too, so a file download is
+// held in memory and sent at the end.
+
+// longLivedRoutes hold their response open on purpose, or for as long as a
+// file takes to transfer, so they have no deadline by default. Their
+// responses are streamed, which a buffered response would break.
+var longLivedRoutes = map[string]bool{
+	"GET /api/v1/stream":             true,
+	"GET /api/v1/notes/export":       true,
+	"POST /api/v1/files":             true,
+	"GET /api/v1/files/{id}/content": true,
+	"GET /dashboard/events":          true,
+	"GET /dev/livereload":            true,
+	"GET /admin/logs/tail":           true,
+	"GET /admin/events":              true,
+}
+
+// parseRouteTimeouts parses ROUTE_TIMEOUTS.
+func parseRouteTimeouts(list []string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, entry := range list {
+		pattern, value, ok := cutRouteSetting(entry)
+		if !ok {
+			return nil, fmt.Errorf("%q is not pattern=duration", entry)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%q: %q is not a valid duration", entry, value)
+		}
+		timeouts[pattern] = d
+	}
+	return timeouts, nil
+}
+
+// cutRouteSetting splits a per-route setting, pattern=value, at its last
+// "=", since a pattern could contain one.
+func cutRouteSetting(entry string) (pattern, value string, ok bool) {
+	i := strings.LastIndex(entry, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	pattern, value = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+	return pattern, value, pattern != ""
+}
+
+// routeTimeout returns the deadline for the route registered as pattern,
+// or 0 for none.
+func routeTimeout(cfg Config, pattern string) time.Duration {
+	// The configuration has been validated, so parsing can't fail.
+	timeouts, _ := parseRouteTimeouts(cfg.RouteTimeouts)
+	if d, ok := timeouts[pattern]; ok {
+		return d
+	}
+	if longLivedRoutes[pattern] {
+		return 0
+	}
+	return cfg.HandlerTimeout
+}
+
+// timeoutMiddleware answers 503 if the route's handler hasn't finished by
+// its deadline.
+func (s *Server) timeoutMiddleware(pattern string) middleware {
+	return middleware{"timeout", func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			d := routeTimeout(s.config(), pattern)
+			if d <= 0 {
+				next(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			tw := &timeoutWriter{w: w, header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if v := recover(); v != nil {
+						panicked <- v
+					}
+				}()
+				next(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case v := <-panicked:
+				// Panic again here, where the recover middleware can see it.
+				panic(v)
+			case <-done:
+				tw.flush()
+			case <-ctx.Done():
+				tw.mu.Lock()
+				tw.timedOut = true
+				tw.mu.Unlock()
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					writeProblem(w, http.StatusServiceUnavailable, fmt.Sprintf("the request took longer than %s", d))
+				}
+			}
+		}
+	}}
+}
+
+// timeoutWriter collects a handler's response, to be sent once it's done.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu       sync.Mutex
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 && !tw.timedOut {
+		tw.status = status
+	}
+}
+
+// Write buffers the response body, or fails once the deadline has passed.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(b)
+}
+
+// Unwrap lets the render helpers find the envelope and protobuf writers
+// further out. Once the deadline has passed it returns nil: the 503 has
+// been sent, and nothing the handler does may reach the real writer.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil
+	}
+	return tw.w
+}
+
+// FlushError and Hijack stop http.ResponseController from reaching the
+// real writer through Unwrap: the response is buffered, so a flush would
+// send the headers before the handler's own.
+func (tw *timeoutWriter) FlushError() error {
+	return http.ErrNotSupported
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+// flush sends the finished response.
+func (tw *timeoutWriter) flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	tw.w.WriteHeader(tw.status)
+	tw.w.Write(tw.body.Bytes())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRouteTimeout checks which deadline each route gets.
+func TestRouteTimeout(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.RouteTimeouts = []string{"GET /api/v1/quote=3s", "GET /api/v1/stream = 1m", "GET /api/v1/files=0"}
+	for pattern, want := range map[string]time.Duration{
+		"GET /api/v1/counter":            cfg.HandlerTimeout,
+		"GET /api/v1/quote":              3 * time.Second,
+		"GET /api/v1/stream":             time.Minute,
+		"GET /api/v1/files":              0,
+		"GET /dashboard/events":          0,
+		"POST /api/v1/files":             0,
+		"GET /api/v1/files/{id}/content": 0,
+	} {
+		if got := routeTimeout(cfg, pattern); got != want {
+			t.Errorf("%s: expected %v, got %v", pattern, want, got)
+		}
+	}
+
+	for _, bad := range []string{"GET /api/v1/quote", "=3s", "GET /api/v1/quote=soon", "GET /api/v1/quote=-1s"} {
+		cfg.RouteTimeouts = []string{bad}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "ROUTE_TIMEOUTS") {
+			t.Errorf("%q: expected ROUTE_TIMEOUTS rejected, got %v", bad, err)
+		}
+	}
+}
+
+// TestTimeoutMiddleware checks a handler still running at its deadline gets
+// a 503 problem, and what it writes afterwards is thrown away.
+func TestTimeoutMiddleware(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.RouteTimeouts = []string{"GET /slow=20ms"}
+	s.cfgMu.Unlock()
+
+	wrote := make(chan error, 1)
+	h := s.timeoutMiddleware("GET /slow").wrap(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).Flush(); err == nil {
+			t.Error("Expected flushing a buffered response to fail")
+		}
+		time.Sleep(50 * time.Millisecond) // ignoring the context
+		if inner := w.(interface{ Unwrap() http.ResponseWriter }).Unwrap(); inner != nil {
+			t.Error("Expected the real writer to be out of reach after the deadline")
+		}
+		_, err := w.Write([]byte("too late"))
+		wrote <- err
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "took longer than 20ms") {
+		t.Errorf("Expected a 503 problem, got %d %s", rec.Code, rec.Body.String())
+	}
+	if err := <-wrote; err != http.ErrHandlerTimeout {
+		t.Errorf("Expected the late write to fail, got %v", err)
+	}
+	if strings.Contains(rec.Body.String(), "too late") {
+		t.Error("Expected the late write thrown away")
+	}
+}
+
+// TestTimeoutCancelsHandler checks the handler's context is cancelled at
+// the deadline, so a handler waiting on it stops.
+func TestTimeoutCancelsHandler(t *testing.T) {
+	s, c := newTestServer(t)
+	s.cfgMu.Lock()
+	s.cfg.RouteTimeouts = []string{"GET /api/v1/quote=20ms"}
+	s.cfgMu.Unlock()
+
+	c.Get("/api/v1/quote").Status(http.StatusOK)
+
+	// A timeout fault hangs until the request's context is done.
+	s.faults.Set(Fault{Route: "GET /api/v1/quote", Kind: "timeout", Count: 1})
+	c.Get("/api/v1/quote").
+		Status(http.StatusServiceUnavailable).
+		HasHeader("Content-Type", "application/problem+json")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// Compile the IANA time zone database into the binary. Our runtime
+	// image (alpine) doesn't ship /usr/share/zoneinfo, and without it
+	// time.LoadLocation only knows UTC. It adds about 450 KB.
+	_ "time/tzdata"
+)
+
+// This file implements a small time zone API:
+//   - GET /api/v1/time/{tz} returns the current time in an IANA time zone
+//     such as Europe/Paris, with its UTC offset and daylight saving state.
+//   - GET /api/v1/timezones lists the supported zone names.
+//
+// It's stateless, so every replica gives the same answer (apart from the
+// clock), which makes it handy for load balancer demos: the instance field
+// shows which replica served each request.
+
+//go:embed timezones/zones.txt
+var zonesFS embed.FS
+
+// TimeResponse is the JSON body returned by GET /api/v1/time/{tz}.
+type TimeResponse struct {
+	Timezone string `json:"timezone" proto:"1"`
+	Time     string `json:"time" proto:"2"` // RFC 3339, with the zone's offset
+	Unix     int64  `json:"unix" proto:"3"`
+
+	// Abbreviation is the zone's short name at this moment, such as CET
+	// or CEST. Some zones only have a numeric one, like "+03".
+	Abbreviation     string `json:"abbreviation" proto:"4"`
+	UTCOffset        string `json:"utc_offset" proto:"5"` // such as "+02:00"
+	UTCOffsetSeconds int    `json:"utc_offset_seconds" proto:"6"`
+	DST              bool   `json:"dst" proto:"7"`
+
+	// NextTransition is when the offset next changes (daylight saving
+	// starting or ending), if it's known to.
+	NextTransition *time.Time `json:"next_transition,omitempty" proto:"8"`
+
+	Instance string `json:"instance" proto:"9"`
+}
+
+// TimezoneListResponse is the JSON body returned by GET /api/v1/timezones.
+type TimezoneListResponse struct {
+	Timezones []string `json:"timezones"`
+}
+
+// supportedZones reads the embedded zone list once.
+var supportedZones = sync.OnceValue(func() []string {
+	f, err := zonesFS.Open("timezones/zones.txt")
+	if err != nil {
+		panic(err) // embedded, so it's always there
+	}
+	defer f.Close()
+
+	var zones []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			zones = append(zones, line)
+		}
+	}
+	return zones
+})
+
+// loadZone looks up a time zone by its IANA name. "Local" is refused: it
+// would be whatever zone the server happens to run in, which is an
+// implementation detail rather than a place.
+func loadZone(name string) (*time.Location, bool) {
+	if name == "" || name == "Local" {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(name)
+	return loc, err == nil
+}
+
+// timeIn describes the moment now in loc.
+func timeIn(now time.Time, loc *time.Location) TimeResponse {
+	t := now.In(loc)
+	abbr, offset := t.Zone()
+
+	resp := TimeResponse{
+		Timezone:         loc.String(),
+		Time:             t.Format(time.RFC3339),
+		Unix:             t.Unix(),
+		Abbreviation:     abbr,
+		UTCOffset:        t.Format("-07:00"),
+		UTCOffsetSeconds: offset,
+		DST:              t.IsDST(),
+		Instance:         instanceName(),
+	}
+	if _, end := t.ZoneBounds(); !end.IsZero() {
+		resp.NextTransition = &end
+	}
+	return resp
+}
+
+// handleTime returns the current time in the zone named in the path. The
+// {tz...} wildcard matches the rest of the path, slashes included, since
+// most zone names have one (America/New_York).
+func (s *Server) handleTime(w http.ResponseWriter, r *http.Request) {
+	loc, ok := loadZone(r.PathValue("tz"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "unknown time zone: use an IANA name such as Europe/Paris (see /api/v1/timezones)")
+		return
+	}
+	writeJSON(w, http.StatusOK, timeIn(s.clock.Now(), loc))
+}
+
+// handleListTimezones lists the supported time zones.
+func handleListTimezones(w http.ResponseWriter, r *http.Request) {
+	zones := supportedZones()
+	setPagination(w, Pagination{Total: len(zones)})
+	writeJSON(w, http.StatusOK, TimezoneListResponse{Timezones: zones})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestTimeIn checks offsets and DST on either side of a known transition:
+// Europe/Paris moved to summer time at 01:00 UTC on 31 March 2024.
+func TestTimeIn(t *testing.T) {
+	loc, ok := loadZone("Europe/Paris")
+	if !ok {
+		t.Fatal("Expected Europe/Paris to load")
+	}
+
+	winter := timeIn(time.Date(2024, 3, 31, 0, 59, 0, 0, time.UTC), loc)
+	if winter.UTCOffset != "+01:00" || winter.DST || winter.Abbreviation != "CET" {
+		t.Errorf("Unexpected winter time %+v", winter)
+	}
+	if winter.NextTransition == nil || !winter.NextTransition.Equal(time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the next transition at 01:00 UTC, got %v", winter.NextTransition)
+	}
+
+	summer := timeIn(time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC), loc)
+	if summer.UTCOffset != "+02:00" || summer.UTCOffsetSeconds != 7200 || !summer.DST {
+		t.Errorf("Unexpected summer time %+v", summer)
+	}
+	if summer.Time != "2024-03-31T03:00:00+02:00" {
+		t.Errorf("Unexpected time %q", summer.Time)
+	}
+}
+
+// TestSupportedZonesLoad makes sure every listed zone really exists.
+func TestSupportedZonesLoad(t *testing.T) {
+	zones := supportedZones()
+	if len(zones) < 100 {
+		t.Fatalf("Expected hundreds of zones, got %d", len(zones))
+	}
+	for _, name := range zones {
+		if _, ok := loadZone(name); !ok {
+			t.Errorf("Listed zone %q doesn't load", name)
+		}
+	}
+}
+
+// TestHandleTime checks zone names with slashes route correctly and bad
+// names are rejected.
+func TestHandleTime(t *testing.T) {
+	mux := newServer(Config{}).routes()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/time/America/New_York", nil))
+	var resp TimeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if rec.Code != http.StatusOK || resp.Timezone != "America/New_York" {
+		t.Errorf("Expected New York's time, got %d %+v", rec.Code, resp)
+	}
+
+	for _, name := range []string{"Mars/Olympus_Mons", "Local", "..%2Fetc%2Fpasswd"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/time/"+name, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %q, got %d", name, rec.Code)
+		}
+	}
+}
+
+// FuzzTime looks up arbitrary zone names.
+//
+//	go test -fuzz FuzzTime -fuzztime 30s
+func FuzzTime(f *testing.F) {
+	f.Add("Europe/London")
+	f.Add("../../../../etc/passwd")
+	f.Add("/etc/localtime")
+	f.Add("UTC\x00")
+
+	now := time.Now()
+	f.Fuzz(func(t *testing.T, name string) {
+		if loc, ok := loadZone(name); ok {
+			timeIn(now, loc)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// This file implements W3C Trace Context (https://www.w3.org/TR/trace-context/),
+// the standard headers tracing systems like OpenTelemetry, Jaeger and
+// Datadog use to follow one request through every service it touches.
+//
+//	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//	             │  └ trace ID: the whole request    └ parent ID    └ flags (01 = sampled)
+//	             └ version
+//	tracestate:  vendor=opaque,other=value
+//
+// Each service that handles the request is a span: it keeps the trace ID,
+// remembers the caller's span as its parent, gets a span ID of its own, and
+// sends that on as the parent of any calls it makes. tracestate carries
+// vendor-specific data and is passed on untouched.
+//
+// The server does this for every request, whether or not anything records
+// the spans: a service that drops the headers breaks the trace for
+// everything behind it. Requests without a valid traceparent start a new
+// trace. Outbound calls (outbound.go) and proxied requests (proxy.go) get
+// the headers, and the trace ID is shown in the request inspector.
+
+// traceparentHeader and tracestateHeader are the Trace Context headers.
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+// maxTracestate is the longest tracestate passed on. The spec asks for at
+// least 512 characters to be kept, and allows dropping longer ones.
+const maxTracestate = 512
+
+// traceContextKey holds a request's traceContext.
+const traceContextKey contextKey = "trace"
+
+// traceContext is this server's span of a trace.
+type traceContext struct {
+	TraceID  string // 32 hex digits
+	SpanID   string // 16 hex digits, this server's span
+	ParentID string // the caller's span, "" if the trace started here
+	Flags    string // 2 hex digits
+	State    string // tracestate, passed on as it came
+}
+
+// traceparent returns the traceparent header for calls made within the
+// span: they're its children.
+func (tc traceContext) traceparent() string {
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + tc.Flags
+}
+
+// traceFromContext returns the request's trace context. ok is false
+// outside a request.
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey).(traceContext)
+	return tc, ok
+}
+
+// parseTraceparent validates a traceparent header and returns its trace ID,
+// parent ID and flags. Later versions of the format may add fields after
+// the flags, which are ignored, as the spec asks.
+func parseTraceparent(h string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	traceID, parentID, flags = parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(flags, 2) ||
+		strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+// isHex reports whether s is n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes as hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // see newID
+	}
+	return hex.EncodeToString(b)
+}
+
+// newTraceContext continues the trace in a request's headers, or starts a
+// new one if there's none. New traces are marked sampled, so services
+// further on that do record traces keep them.
+func newTraceContext(h http.Header) traceContext {
+	tc := traceContext{SpanID: randomHex(8)}
+	traceID, parentID, flags, ok := parseTraceparent(h.Get(traceparentHeader))
+	if !ok {
+		tc.TraceID, tc.Flags = randomHex(16), "01"
+		return tc
+	}
+	tc.TraceID, tc.ParentID, tc.Flags = traceID, parentID, flags
+	// tracestate may be split across several headers; without a valid
+	// traceparent it means nothing.
+	if state := strings.Join(h.Values(tracestateHeader), ","); len(state) <= maxTracestate {
+		tc.State = state
+	}
+	return tc
+}
+
+// injectTrace sets the trace headers for a call made within ctx's span.
+func injectTrace(ctx context.Context, h http.Header) {
+	tc, ok := traceFromContext(ctx)
+	if !ok {
+		return
+	}
+	h.Set(traceparentHeader, tc.traceparent())
+	h.Del(tracestateHeader)
+	if tc.State != "" {
+		h.Set(tracestateHeader, tc.State)
+	}
+}
+
+// traceMiddleware gives each request its span of the trace.
+func traceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tc := newTraceContext(r.Header)
+		next(w, r.WithContext(context.WithValue(r.Context(), traceContextKey, tc)))
+	}
+}
+
+// traceLogHandler adds the trace and span IDs to log lines written with a
+// request's context (slog.InfoContext and friends), so a log search can
+// jump to the trace, and a trace to its logs. Lines logged without one are
+// unchanged.
+type traceLogHandler struct {
+	slog.Handler
+}
+
+// Handle adds the IDs and passes the record on.
+func (h traceLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if tc, ok := traceFromContext(ctx); ok {
+		r.AddAttrs(slog.String("trace_id", tc.TraceID), slog.String("span_id", tc.SpanID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs keeps the wrapper on loggers made with Logger.With.
+func (h traceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the wrapper on loggers made with Logger.WithGroup.
+func (h traceLogHandler) WithGroup(name string) slog.Handler {
+	return traceLogHandler{h.Handler.WithGroup(name)}
+}
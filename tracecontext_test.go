@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+// TestParseTraceparent checks valid headers are accepted and invalid ones
+// rejected.
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-" + testTraceID + "-" + testParentID + "-01", true},
+		{" 00-" + testTraceID + "-" + testParentID + "-00 ", true},
+		{"01-" + testTraceID + "-" + testParentID + "-01-future", true},
+		{"00-" + testTraceID + "-" + testParentID + "-01-extra", false},
+		{"ff-" + testTraceID + "-" + testParentID + "-01", false},
+		{"00-" + strings.ToUpper(testTraceID) + "-" + testParentID + "-01", false},
+		{"00-00000000000000000000000000000000-" + testParentID + "-01", false},
+		{"00-" + testTraceID + "-0000000000000000-01", false},
+		{"00-" + testTraceID + "-" + testParentID, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		traceID, parentID, _, ok := parseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("parseTraceparent(%q): expected ok=%v, got %v", tt.header, tt.ok, ok)
+		}
+		if ok && (traceID != testTraceID || parentID != testParentID) {
+			t.Errorf("parseTraceparent(%q) = %s, %s", tt.header, traceID, parentID)
+		}
+	}
+}
+
+// TestNewTraceContext checks an incoming trace is continued with a new
+// span, and a new trace started without one.
+func TestNewTraceContext(t *testing.T) {
+	h := http.Header{}
+	h.Set(traceparentHeader, "00-"+testTraceID+"-"+testParentID+"-00")
+	h.Add(tracestateHeader, "a=1")
+	h.Add(tracestateHeader, "b=2")
+	tc := newTraceContext(h)
+	if tc.TraceID != testTraceID || tc.ParentID != testParentID || tc.Flags != "00" || tc.State != "a=1,b=2" {
+		t.Errorf("Expected the trace continued, got %+v", tc)
+	}
+	if !isHex(tc.SpanID, 16) || tc.SpanID == testParentID {
+		t.Errorf("Expected a new span ID, got %q", tc.SpanID)
+	}
+
+	h.Set(traceparentHeader, "garbage")
+	tc = newTraceContext(h)
+	if !isHex(tc.TraceID, 32) || tc.TraceID == testTraceID || tc.ParentID != "" || tc.Flags != "01" || tc.State != "" {
+		t.Errorf("Expected a new trace, got %+v", tc)
+	}
+}
+
+// TestOutboundTrace checks outbound calls carry the trace, with this
+// server's span as their parent.
+func TestOutboundTrace(t *testing.T) {
+	var got http.Header
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer api.Close()
+
+	tc := traceContext{TraceID: testTraceID, SpanID: "1111111111111111", Flags: "01", State: "vendor=x"}
+	ctx := context.WithValue(context.Background(), traceContextKey, tc)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, api.URL, nil)
+	req.Header.Set(tracestateHeader, "stale=1")
+	resp, err := newOutboundClient(newMetrics()).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want := "00-" + testTraceID + "-1111111111111111-01"; got.Get(traceparentHeader) != want {
+		t.Errorf("Expected traceparent %s, got %q", want, got.Get(traceparentHeader))
+	}
+	if got.Get(tracestateHeader) != "vendor=x" {
+		t.Errorf("Expected tracestate vendor=x, got %q", got.Values(tracestateHeader))
+	}
+}
+
+// TestProxyTrace checks proxied requests continue the client's trace.
+func TestProxyTrace(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(traceparentHeader)
+	}))
+	defer backend.Close()
+
+	_, h := newProxyServer(t, "/app="+backend.URL)
+	req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+	req.Header.Set(traceparentHeader, "00-"+testTraceID+"-"+testParentID+"-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	traceID, parentID, _, ok := parseTraceparent(got)
+	if !ok || traceID != testTraceID || parentID == testParentID {
+		t.Errorf("Expected the trace continued with a new parent, got %q", got)
+	}
+}
+
+// TestTraceLogHandler checks log lines written with a request's context
+// carry its trace and span IDs, and others don't.
+func TestTraceLogHandler(t *testing.T) {
+	var out strings.Builder
+	logger := slog.New(traceLogHandler{slog.NewTextHandler(&out, nil)}).With("pod", "web-1")
+
+	tc := traceContext{TraceID: testTraceID, SpanID: "1111111111111111"}
+	logger.InfoContext(context.WithValue(context.Background(), traceContextKey, tc), "traced")
+	logger.Info("untraced")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if want := "pod=web-1 trace_id=" + testTraceID + " span_id=1111111111111111"; !strings.HasSuffix(lines[0], want) {
+		t.Errorf("Expected %q at the end of %q", want, lines[0])
+	}
+	if strings.Contains(lines[1], "trace_id") {
+		t.Errorf("Expected no trace ID in %q", lines[1])
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// This file adds user accounts: registering with a username, email
+// address and password, and logging in with either of the first two and
+// the password, which returns access and refresh tokens like those of
+// POST /admin/tokens (see jwt.go and refresh.go), for the user's ID, but
+// only good for the user's own account:
+//
+//	curl -X POST -d '{"username": "alice", "email": "alice@example.com", "password": "correct horse"}' http://localhost:8000/api/v1/register
+//	curl -X POST -d '{"login": "alice", "password": "correct horse"}' http://localhost:8000/api/v1/login
+//	curl -H "Authorization: Bearer <access_token>" http://localhost:8000/api/v1/me
+//
+// Passwords are never stored, only their Argon2id hashes (see argon2.go),
+// which cost PASSWORD_HASH_MEMORY and PASSWORD_HASH_ITERATIONS to compute.
+// A wrong password and an unknown user get the same answer, in about the
+// same time, so login can't be used to find out who has an account.
+// Registration can, since it has to say a username is taken; that's the
+// usual trade-off, and rate limiting (see ratelimit.go) is the defence.
+
+// User is a registered user.
+type User struct {
+	ID string `json:"id"`
+
+	// Username is stored in lowercase, and is unique, like Email, which
+	// is compared ignoring case.
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// DeletionRequestedAt is set when the user asks to be erased (see
+	// privacy.go), until they are.
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+}
+
+// UserProfile is a user as the API returns them: without the hash.
+type UserProfile struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+}
+
+// Profile returns what the API shows of u.
+func (u User) Profile() UserProfile {
+	return UserProfile{ID: u.ID, Username: u.Username, Email: u.Email, CreatedAt: u.CreatedAt, DeletionRequestedAt: u.DeletionRequestedAt}
+}
+
+// RegisterRequest is the JSON body of POST /api/v1/register.
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// LoginRequest is the JSON body of POST /api/v1/login. Login is the
+// username or the email address.
+type LoginRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// Why a user can't be registered.
+var (
+	errUsernameTaken = errors.New("the username is taken")
+	errEmailTaken    = errors.New("an account with this email address already exists")
+)
+
+// errLoginFailed doesn't say which of the login and password was wrong.
+var errLoginFailed = errors.New("wrong username, email address or password")
+
+// passwordParams returns the Argon2id costs new hashes are made with.
+func (s *Server) passwordParams() argon2Params {
+	cfg := s.config()
+	return argon2Params{Memory: uint32(cfg.PasswordHashMemory), Time: uint32(cfg.PasswordHashIterations), Threads: 1}
+}
+
+// cleanRegistration normalizes a registration and checks the email address
+// properly, which the schema can only do roughly, as cleanContact does.
+func cleanRegistration(req RegisterRequest) (RegisterRequest, []FieldError) {
+	req.Username = strings.ToLower(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+		return req, []FieldError{{Pointer: "/email", Detail: "must be an email address"}}
+	}
+	return req, nil
+}
+
+// handleRegister creates a user.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if !decodeValid(w, r, "user-register", &req) {
+		return
+	}
+	req, errs := cleanRegistration(req)
+	if len(errs) > 0 {
+		writeValidationProblem(w, "user-register", errs)
+		return
+	}
+
+	params := s.passwordParams()
+	done, ok := s.hashingPassword(w, r, params)
+	if !ok {
+		return
+	}
+	defer done()
+	user := User{ID: newID(), Username: req.Username, Email: req.Email, PasswordHash: hashPassword(req.Password, params)}
+	user, err := s.store.CreateUser(tenantFromContext(r.Context()), user)
+	if err != nil {
+		writeProblem(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/me")
+	writeJSON(w, http.StatusCreated, user.Profile())
+}
+
+// handleLogin checks a user's password and issues them tokens.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if !decodeValid(w, r, "user-login", &req) {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	account, client := loginAccount(tenant, req.Login), rateLimitClient(r)
+	if !s.checkLoginAllowed(w, account, client) {
+		return
+	}
+	user, found := s.store.FindUser(tenant, req.Login)
+	params := s.passwordParams()
+	if found {
+		// Checking a stored hash takes the memory it was made with.
+		params, _, _, _ = parsePasswordHash(user.PasswordHash)
+	}
+	done, ok := s.hashingPassword(w, r, params)
+	if !ok {
+		return
+	}
+	defer done()
+	if !found {
+		// Hashing the password anyway makes an unknown user take as long
+		// to turn away as a wrong password.
+		hashPassword(req.Password, params)
+		s.loginFailed(r, account, client)
+		writeProblem(w, http.StatusUnauthorized, errLoginFailed.Error())
+		return
+	}
+	if ok, _ := checkPassword(user.PasswordHash, req.Password); !ok {
+		s.loginFailed(r, account, client)
+		writeProblem(w, http.StatusUnauthorized, errLoginFailed.Error())
+		return
+	}
+	s.logins.succeed(account)
+	writeJSON(w, http.StatusOK, s.issueTokens(tenant, jwtAudienceUser, user.ID, "", s.config().JWTTTL))
+}
+
+// handleCurrentUser returns the user a request's access token is for.
+func (s *Server) handleCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.currentUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, user.Profile())
+}
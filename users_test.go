@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cpmorton/go-hello-devops/testsupport"
+)
+
+// newUserTestServer returns a test server that hashes passwords cheaply.
+func newUserTestServer(t *testing.T) (*Server, *testsupport.Client) {
+	t.Helper()
+	s, c := newTestServer(t)
+	s.cfg.PasswordHashMemory, s.cfg.PasswordHashIterations = 64, 1
+	return s, c
+}
+
+// TestRegisterAndLogin registers a user, logs in with their username and
+// their email address, and reads the current user with the access token.
+func TestRegisterAndLogin(t *testing.T) {
+	openAdmin(t)
+	s, c := newUserTestServer(t)
+
+	user := testsupport.Decode[UserProfile](c.Post("/api/v1/register", map[string]any{"username": "Alice", "email": "alice@example.com", "password": "correct horse"}).
+		Status(http.StatusCreated).
+		HasHeader("Location", "/api/v1/me"))
+	if user.ID == "" || user.Username != "alice" || user.Email != "alice@example.com" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+	stored := s.store.Snapshot().Tenants[defaultTenant].Users
+	if len(stored) != 1 || !strings.HasPrefix(stored[0].PasswordHash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Expected only the password's hash to be stored, got %+v", stored)
+	}
+
+	for _, login := range []string{"alice", "ALICE", "Alice@Example.com"} {
+		tokens := testsupport.Decode[TokenResponse](c.Post("/api/v1/login", map[string]any{"login": login, "password": "correct horse"}).Status(http.StatusOK))
+		if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+			t.Fatalf("%s: expected tokens, got %+v", login, tokens)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		if me := testsupport.Decode[UserProfile](c.DoRequest(req).Status(http.StatusOK)); me != user {
+			t.Errorf("%s: expected %+v, got %+v", login, user, me)
+		}
+	}
+
+	// A wrong password and an unknown user are told apart by nothing.
+	for _, login := range []string{"alice", "bob"} {
+		c.Post("/api/v1/login", map[string]any{"login": login, "password": "battery staple"}).
+			Status(http.StatusUnauthorized).
+			JSON(`{"detail": "wrong username, email address or password", "...": "..."}`)
+	}
+	c.Get("/api/v1/me").Status(http.StatusUnauthorized).HasHeader("WWW-Authenticate", `Bearer realm="go-hello-devops"`)
+
+	// A token from POST /admin/tokens is a gateway token, not a user's.
+	admin := testsupport.Decode[TokenResponse](c.Post("/admin/tokens", map[string]any{"subject": "alice"}).Status(http.StatusCreated))
+	req, _ := http.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+admin.AccessToken)
+	c.DoRequest(req).Status(http.StatusUnauthorized)
+}
+
+// TestRegisterValidation checks bad registrations get field errors and
+// taken usernames and email addresses are refused.
+func TestRegisterValidation(t *testing.T) {
+	_, c := newUserTestServer(t)
+
+	c.Post("/api/v1/register", map[string]any{"username": "a", "email": "alice@example.com", "password": "short"}).
+		Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/password", "...": "..."}, {"pointer": "/username", "...": "..."}], "...": "..."}`)
+	c.Post("/api/v1/register", map[string]any{"username": "alice", "email": "alice(home)@example.com", "password": "correct horse"}).
+		Status(http.StatusUnprocessableEntity).
+		JSON(`{"errors": [{"pointer": "/email", "detail": "must be an email address"}], "...": "..."}`)
+
+	c.Post("/api/v1/register", map[string]any{"username": "alice", "email": "alice@example.com", "password": "correct horse"}).Status(http.StatusCreated)
+	c.Post("/api/v1/register", map[string]any{"username": "ALICE", "email": "other@example.com", "password": "correct horse"}).
+		Status(http.StatusConflict).
+		JSON(`{"detail": "the username is taken", "...": "..."}`)
+	c.Post("/api/v1/register", map[string]any{"username": "alice2", "email": "ALICE@example.com", "password": "correct horse"}).
+		Status(http.StatusConflict).
+		JSON(`{"detail": "an account with this email address already exists", "...": "..."}`)
+}
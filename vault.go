@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file fetches secrets from HashiCorp Vault when VAULT_ADDR is set.
+// Environment variables are the twelve-factor way to configure an app, but
+// a secret in an environment variable is visible to anyone who can read the
+// deployment, and changing it means changing every deployment that has it.
+// Vault keeps secrets in one place, hands them only to clients that prove
+// who they are, and records who read what.
+//
+// At startup the server logs in to Vault, reads one secret, and uses its
+// keys as settings: a key named after the environment variable of a secret
+// setting (LLM_API_KEY, SMTP_PASSWORD, REDIS_URL, ADMIN_API_KEYS and so on)
+// replaces the value from the environment. Only settings tagged
+// secret:"true" can be set this way, so the secret can't quietly change,
+// say, the port. GET /admin/config lists them with the source "vault".
+// Without VAULT_ADDR, secrets come from the environment as before.
+//
+// It logs in one of two ways (VAULT_AUTH):
+//   - approle: with VAULT_ROLE_ID and VAULT_SECRET_ID, for servers and CI
+//   - kubernetes: as VAULT_ROLE, proving it with the pod's service account
+//     token, so there's no secret to hand out at all
+//
+// VAULT_SECRET_PATH is the secret's API path. For the KV version 2 engine
+// that has "data" after the mount: secret/data/go-hello-devops for a secret
+// written with
+//
+//	vault kv put secret/go-hello-devops LLM_API_KEY=sk-... ADMIN_API_KEYS=k1
+//
+// The login token, and the secret if it has a lease, expire after a time.
+// renewVault renews them when half of it is up, logging in again if the
+// token can't be renewed any more, and reads the secret again so a rotated
+// secret is picked up: reloadable settings take it at the next reload
+// (see reload.go), the others at the next restart.
+
+// Vault authentication methods.
+const (
+	vaultAuthAppRole    = "approle"
+	vaultAuthKubernetes = "kubernetes"
+)
+
+// vaultServiceAccountToken is where Kubernetes mounts the pod's service
+// account token.
+const vaultServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultRefreshInterval is how often the secret is read again when neither
+// the token nor the secret expires.
+const vaultRefreshInterval = 5 * time.Minute
+
+// vaultRetryAfter is how long to wait before trying again after Vault
+// fails.
+const vaultRetryAfter = 30 * time.Second
+
+// sourceVault is the source of settings from Vault, as reported by
+// GET /admin/config.
+const sourceVault = "vault"
+
+// Vault reads secrets from a Vault server.
+type Vault struct {
+	addr       string
+	auth       string
+	authMount  string
+	roleID     string
+	secretID   string
+	role       string
+	secretPath string
+	tokenFile  string // the service account token, for Kubernetes
+	client     *http.Client
+
+	mu       sync.Mutex
+	token    string
+	tokenTTL time.Duration
+	canRenew bool
+	lease    vaultLease
+	secrets  map[string]string
+}
+
+// vaultLease is the lease on the secret, if it has one.
+type vaultLease struct {
+	id       string
+	ttl      time.Duration
+	canRenew bool
+}
+
+// vaultResponse is the part of Vault's API responses that's used here.
+type vaultResponse struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int             `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// newVault returns a Vault client for the configuration, or nil if
+// VAULT_ADDR isn't set.
+func newVault(cfg Config, client *http.Client) *Vault {
+	if cfg.VaultAddr == "" {
+		return nil
+	}
+	return &Vault{
+		addr:       strings.TrimSuffix(cfg.VaultAddr, "/"),
+		auth:       cfg.VaultAuth,
+		authMount:  cmp.Or(cfg.VaultAuthMount, cfg.VaultAuth),
+		roleID:     cfg.VaultRoleID,
+		secretID:   cfg.VaultSecretID,
+		role:       cfg.VaultRole,
+		secretPath: strings.Trim(cfg.VaultSecretPath, "/"),
+		tokenFile:  vaultServiceAccountToken,
+		client:     client,
+	}
+}
+
+// withVaultSecrets logs in to Vault, if it's configured, and returns cfg
+// with the secret settings from it, along with the client for renewing.
+func withVaultSecrets(ctx context.Context, cfg Config) (Config, *Vault, error) {
+	vault := newVault(cfg, &http.Client{Timeout: 10 * time.Second})
+	if vault == nil {
+		return cfg, nil, nil
+	}
+	if err := vault.Login(ctx); err != nil {
+		return cfg, nil, err
+	}
+	if err := vault.Read(ctx); err != nil {
+		return cfg, nil, err
+	}
+	cfg, err := vault.Apply(cfg)
+	if err != nil {
+		return cfg, nil, err
+	}
+	slog.Info("Read secrets from Vault", "path", vault.secretPath, "settings", len(vault.Secrets()))
+	return cfg, vault, nil
+}
+
+// Login logs in to Vault with the configured method.
+func (v *Vault) Login(ctx context.Context) error {
+	body := map[string]string{}
+	switch v.auth {
+	case vaultAuthAppRole:
+		body["role_id"], body["secret_id"] = v.roleID, v.secretID
+	case vaultAuthKubernetes:
+		jwt, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading the service account token for Vault: %w", err)
+		}
+		body["role"], body["jwt"] = v.role, strings.TrimSpace(string(jwt))
+	}
+
+	resp, err := v.call(ctx, http.MethodPost, "/v1/auth/"+v.authMount+"/login", "", body)
+	if err != nil {
+		return fmt.Errorf("logging in to Vault: %w", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("logging in to Vault: no token in the response")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = resp.Auth.ClientToken
+	v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+	v.canRenew = resp.Auth.Renewable
+	return nil
+}
+
+// Read reads the secret. Its values must be strings.
+func (v *Vault) Read(ctx context.Context) error {
+	resp, err := v.call(ctx, http.MethodGet, "/v1/"+v.secretPath, v.currentToken(), nil)
+	if err != nil {
+		return fmt.Errorf("reading %s from Vault: %w", v.secretPath, err)
+	}
+
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return fmt.Errorf("reading %s from Vault: %w", v.secretPath, err)
+	}
+	// The KV version 2 engine wraps the secret in its own "data", next to
+	// the version's "metadata".
+	if inner, ok := data["data"]; ok && data["metadata"] != nil {
+		data = nil
+		if err := json.Unmarshal(inner, &data); err != nil {
+			return fmt.Errorf("reading %s from Vault: %w", v.secretPath, err)
+		}
+	}
+	secrets := make(map[string]string, len(data))
+	for key, raw := range data {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("reading %s from Vault: %s is not a string", v.secretPath, key)
+		}
+		secrets[key] = value
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.secrets = secrets
+	v.lease = vaultLease{id: resp.LeaseID, ttl: time.Duration(resp.LeaseDuration) * time.Second, canRenew: resp.Renewable}
+	return nil
+}
+
+// Renew renews the token, or logs in again if it can't be renewed, then
+// renews the secret's lease, or reads the secret again if it has no lease
+// that can be renewed.
+func (v *Vault) Renew(ctx context.Context) error {
+	v.mu.Lock()
+	token, canRenew, lease := v.token, v.canRenew, v.lease
+	v.mu.Unlock()
+
+	renewed := false
+	if canRenew {
+		resp, err := v.call(ctx, http.MethodPost, "/v1/auth/token/renew-self", token, map[string]string{})
+		if err == nil && resp.Auth != nil {
+			v.mu.Lock()
+			v.tokenTTL = time.Duration(resp.Auth.LeaseDuration) * time.Second
+			v.canRenew = resp.Auth.Renewable
+			v.mu.Unlock()
+			renewed = true
+		} else if err != nil {
+			slog.Warn("Vault token renewal failed, logging in again", "error", err)
+		}
+	}
+	if !renewed {
+		if err := v.Login(ctx); err != nil {
+			return err
+		}
+	}
+
+	if lease.id != "" && lease.canRenew {
+		resp, err := v.call(ctx, http.MethodPut, "/v1/sys/leases/renew", v.currentToken(), map[string]string{"lease_id": lease.id})
+		if err == nil {
+			v.mu.Lock()
+			v.lease.ttl = time.Duration(resp.LeaseDuration) * time.Second
+			v.lease.canRenew = resp.Renewable
+			v.mu.Unlock()
+			return nil
+		}
+		slog.Warn("Vault lease renewal failed, reading the secret again", "error", err)
+	}
+	return v.Read(ctx)
+}
+
+// renewIn is how long to wait before renewing: half the shorter of the
+// token's and the secret's time to live.
+func (v *Vault) renewIn() time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ttl := vaultRefreshInterval
+	for _, d := range []time.Duration{v.tokenTTL, v.lease.ttl} {
+		if d > 0 && d < ttl {
+			ttl = d
+		}
+	}
+	return max(ttl/2, time.Second)
+}
+
+// Secrets returns a copy of the secret's values.
+func (v *Vault) Secrets() map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return maps.Clone(v.secrets)
+}
+
+// Apply returns cfg with every secret setting named in the secret set to
+// its value from Vault, and checks the result. Keys that aren't the
+// environment variable of a secret setting are logged and ignored.
+func (v *Vault) Apply(cfg Config) (Config, error) {
+	secrets := v.Secrets()
+	cv := reflect.ValueOf(&cfg).Elem()
+	var problems []string
+	for i := 0; i < cv.NumField(); i++ {
+		field := cv.Type().Field(i)
+		env := field.Tag.Get("env")
+		value, ok := secrets[env]
+		if env == "" || !ok {
+			continue
+		}
+		delete(secrets, env)
+		if field.Tag.Get("secret") != "true" {
+			slog.Warn("Ignoring a setting from Vault that isn't a secret", "setting", env)
+			continue
+		}
+		if err := setField(cv.Field(i), value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (from Vault): %v", env, err))
+			continue
+		}
+		cfg.setSource(field.Tag.Get("json"), sourceVault)
+	}
+	for key := range secrets {
+		slog.Warn("Ignoring an unknown setting from Vault", "setting", key)
+	}
+
+	problems = append(problems, cfg.problems()...)
+	if len(problems) > 0 {
+		return cfg, &ConfigError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// currentToken returns the token to call Vault with.
+func (v *Vault) currentToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.token
+}
+
+// call calls the Vault API with token, if there is one, and body as JSON,
+// if there's a body.
+func (v *Vault) call(ctx context.Context, method, path, token string, body any) (vaultResponse, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return vaultResponse{}, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+path, bytes.NewReader(data))
+	if err != nil {
+		return vaultResponse{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return vaultResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result vaultResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		if len(result.Errors) > 0 {
+			return vaultResponse{}, fmt.Errorf("vault answered %s: %s", resp.Status, strings.Join(result.Errors, "; "))
+		}
+		return vaultResponse{}, fmt.Errorf("vault answered %s", resp.Status)
+	}
+	if decodeErr != nil {
+		return vaultResponse{}, fmt.Errorf("decoding Vault's response: %w", decodeErr)
+	}
+	return result, nil
+}
+
+// renewVault keeps the Vault token and secret fresh until ctx is done.
+func (s *Server) renewVault(ctx context.Context) {
+	if s.vault == nil {
+		return
+	}
+	timer := s.clock.NewTimer(s.vault.renewIn())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+		if err := s.vault.Renew(ctx); err != nil {
+			slog.Error("Vault renewal failed", "error", err, "retry_in", vaultRetryAfter)
+			timer.Reset(vaultRetryAfter)
+			continue
+		}
+		timer.Reset(s.vault.renewIn())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault is a Vault server for tests, with AppRole and Kubernetes
+// logins, one KV version 2 secret, and token renewal.
+type fakeVault struct {
+	*httptest.Server
+	mu        sync.Mutex
+	secret    map[string]any
+	tokens    int  // logins so far; each gets a new token
+	renewable bool // whether tokens can be renewed
+	calls     []string
+}
+
+func newFakeVault(t *testing.T, secret map[string]any) *fakeVault {
+	f := &fakeVault{secret: secret, renewable: true}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	token := func() string { return "token-" + string(rune('0'+f.tokens)) }
+
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/v1/auth/approle/login", "/v1/auth/kubernetes/login":
+		if body["secret_id"] != "s3cret" && body["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"invalid credentials"}})
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": token(), "lease_duration": 3600, "renewable": f.renewable}})
+	case "/v1/auth/token/renew-self":
+		if !f.renewable || r.Header.Get("X-Vault-Token") != token() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": token(), "lease_duration": 3600, "renewable": true}})
+	case "/v1/secret/data/go-hello-devops":
+		if r.Header.Get("X-Vault-Token") != token() {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": f.secret, "metadata": map[string]any{"version": 1}}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// vaultConfig returns a valid configuration that uses f with AppRole.
+func vaultConfig(t *testing.T, f *fakeVault) Config {
+	cfg := defaultConfig(t)
+	cfg.VaultAddr, cfg.VaultRoleID, cfg.VaultSecretID = f.URL, "role", "s3cret"
+	return cfg
+}
+
+// TestVaultSecrets logs in with AppRole and checks the secret settings
+// replace the environment's, and other keys are ignored.
+func TestVaultSecrets(t *testing.T) {
+	f := newFakeVault(t, map[string]any{"LLM_API_KEY": "sk-vault", "ADMIN_API_KEYS": "k1,k2", "PORT": "1", "UNKNOWN": "x"})
+	cfg := vaultConfig(t, f)
+	cfg.LLMAPIKey = "sk-env"
+
+	cfg, vault, err := withVaultSecrets(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vault == nil || cfg.LLMAPIKey != "sk-vault" || !slices.Equal(cfg.AdminAPIKeys, []string{"k1", "k2"}) || cfg.Port != 8000 {
+		t.Errorf("Expected the secrets from Vault and the port unchanged, got %q %v %d", cfg.LLMAPIKey, cfg.AdminAPIKeys, cfg.Port)
+	}
+	for _, setting := range cfg.Settings() {
+		if setting.Name == "llm_api_key" && (setting.Source != sourceVault || setting.Value != redacted) {
+			t.Errorf("Expected the key redacted and from Vault, got %+v", setting)
+		}
+	}
+}
+
+// TestVaultNotConfigured checks the environment is used as it is without
+// VAULT_ADDR.
+func TestVaultNotConfigured(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.LLMAPIKey = "sk-env"
+	cfg, vault, err := withVaultSecrets(context.Background(), cfg)
+	if err != nil || vault != nil || cfg.LLMAPIKey != "sk-env" {
+		t.Errorf("Expected the environment's key and no Vault, got %q %v %v", cfg.LLMAPIKey, vault, err)
+	}
+}
+
+// TestVaultKubernetesLogin logs in with the pod's service account token.
+func TestVaultKubernetesLogin(t *testing.T) {
+	f := newFakeVault(t, map[string]any{"SMTP_PASSWORD": "mail"})
+	cfg := defaultConfig(t)
+	cfg.VaultAddr, cfg.VaultAuth, cfg.VaultRole = f.URL, vaultAuthKubernetes, "web"
+	vault := newVault(cfg, f.Client())
+	vault.tokenFile = filepath.Join(t.TempDir(), "token")
+	os.WriteFile(vault.tokenFile, []byte("service-account-jwt\n"), 0o600)
+
+	if err := vault.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vault.Read(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := vault.Secrets()["SMTP_PASSWORD"]; got != "mail" {
+		t.Errorf("Expected the SMTP password, got %q", got)
+	}
+}
+
+// TestVaultErrors checks bad credentials and a secret that isn't all
+// strings are reported.
+func TestVaultErrors(t *testing.T) {
+	f := newFakeVault(t, map[string]any{"LLM_API_KEY": 42})
+	cfg := vaultConfig(t, f)
+	cfg.VaultSecretID = "wrong"
+	if _, _, err := withVaultSecrets(context.Background(), cfg); err == nil || err.Error() != "logging in to Vault: vault answered 400 Bad Request: invalid credentials" {
+		t.Errorf("Expected the login to fail, got %v", err)
+	}
+	if _, _, err := withVaultSecrets(context.Background(), vaultConfig(t, f)); err == nil || err.Error() != "reading secret/data/go-hello-devops from Vault: LLM_API_KEY is not a string" {
+		t.Errorf("Expected the number to be rejected, got %v", err)
+	}
+}
+
+// TestVaultRenew renews the token, then logs in again once it can't be
+// renewed, reading the secret again each time.
+func TestVaultRenew(t *testing.T) {
+	f := newFakeVault(t, map[string]any{"LLM_API_KEY": "sk-1"})
+	vault := newVault(vaultConfig(t, f), f.Client())
+	ctx := context.Background()
+	if err := vault.Login(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := vault.renewIn(); got != vaultRefreshInterval/2 {
+		t.Errorf("Expected to renew in %s, got %s", vaultRefreshInterval/2, got)
+	}
+
+	f.mu.Lock()
+	f.secret["LLM_API_KEY"] = "sk-2"
+	f.mu.Unlock()
+	if err := vault.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if vault.Secrets()["LLM_API_KEY"] != "sk-2" || vault.currentToken() != "token-1" {
+		t.Errorf("Expected the rotated key with the same token, got %v %s", vault.Secrets(), vault.currentToken())
+	}
+
+	f.mu.Lock()
+	f.renewable = false
+	f.mu.Unlock()
+	if err := vault.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if vault.currentToken() != "token-2" {
+		t.Errorf("Expected a new login, got %s", vault.currentToken())
+	}
+}
+
+// TestVaultReload checks a reload keeps the secrets from Vault rather than
+// going back to the environment's.
+func TestVaultReload(t *testing.T) {
+	f := newFakeVault(t, map[string]any{"ADMIN_API_KEYS": "from-vault"})
+	s, c := newTestServer(t)
+	s.vault = newVault(vaultConfig(t, f), f.Client())
+	if err := s.vault.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.vault.Read(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("/admin/upstreams").Status(http.StatusUnauthorized)
+	c.Header.Set("Authorization", "Bearer from-vault")
+	c.Get("/admin/upstreams").Status(http.StatusOK)
+}
+
+// TestRenewVault checks the loop renews when half the token's time to live
+// is up, and tries again sooner after a failure.
+func TestRenewVault(t *testing.T) {
+	f := newFakeVault(t, map[string]any{})
+	s, _ := newTestServer(t)
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.useClock(clock)
+	s.vault = newVault(vaultConfig(t, f), f.Client())
+	if err := s.vault.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.vault.tokenTTL = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.renewVault(ctx)
+	renewals := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := 0
+		for _, call := range f.calls {
+			if call == "POST /v1/auth/token/renew-self" {
+				n++
+			}
+		}
+		return n
+	}
+
+	eventually(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(29 * time.Second)
+	if renewals() != 0 {
+		t.Fatal("Expected no renewal before half the TTL")
+	}
+	clock.Advance(time.Second)
+	eventually(t, func() bool { return renewals() == 1 })
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file makes the server wait for the services it depends on before it
+// starts listening. Containers started together (docker compose up) come
+// up in no particular order, so an app can easily start before its
+// database is accepting connections. The classic fix is a wrapper script
+// such as wait-for-it.sh in the container's entrypoint; doing it in the
+// app itself needs no shell in the image and works the same everywhere.
+//
+// Set WAIT_FOR to a comma-separated list of dependencies, each either
+// host:port (wait until a TCP connection succeeds) or an http(s) URL (wait
+// until it answers with anything but a server error):
+//
+//	WAIT_FOR=minio:9000,http://ollama:11434/
+//
+// Each is retried with exponential backoff until it's up, for at most
+// WAIT_TIMEOUT in all. If that runs out the server exits with an error, and
+// a restart policy or Kubernetes tries again later.
+
+const (
+	// waitInitialBackoff and waitMaxBackoff bound the pause between
+	// attempts, which doubles after each failure.
+	waitInitialBackoff = 250 * time.Millisecond
+	waitMaxBackoff     = 5 * time.Second
+
+	// waitAttemptTimeout bounds a single attempt.
+	waitAttemptTimeout = 2 * time.Second
+)
+
+// waitForDependencies waits until every target is reachable, or returns an
+// error naming those that never became so within timeout. The pauses
+// between attempts are timed by clock.
+func waitForDependencies(ctx context.Context, clock Clock, client *http.Client, targets []string, timeout time.Duration) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = waitFor(ctx, clock, client, target)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("dependencies not reachable after %v: %w", timeout, err)
+	}
+	return nil
+}
+
+// waitFor retries a target until it's reachable or ctx is done.
+func waitFor(ctx context.Context, clock Clock, client *http.Client, target string) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, waitAttemptTimeout)
+		err := checkTarget(attemptCtx, client, target)
+		cancel()
+		if err == nil {
+			slog.Info("Dependency is up", "target", target, "attempts", attempt+1, "waited", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+
+		pause := waitBackoff(attempt)
+		slog.Info("Waiting for dependency", "target", target, "attempt", attempt+1, "retry_in", pause.Round(time.Millisecond), "error", err)
+		timer := clock.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: %w", target, err)
+		case <-timer.C():
+		}
+	}
+}
+
+// waitBackoff returns the pause after a failed attempt (counting from 0):
+// waitInitialBackoff doubled for each earlier failure, up to
+// waitMaxBackoff. A random half of it is left out ("jitter"), so that
+// many instances restarting together don't retry in lockstep.
+func waitBackoff(attempt int) time.Duration {
+	d := waitMaxBackoff
+	if attempt < 10 {
+		d = min(waitInitialBackoff<<attempt, waitMaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// isHTTPTarget reports whether a WAIT_FOR entry is a URL rather than
+// host:port.
+func isHTTPTarget(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// validWaitTarget reports whether a WAIT_FOR entry is an http(s) URL or a
+// host:port pair.
+func validWaitTarget(target string) bool {
+	if isHTTPTarget(target) {
+		return validHTTPURL(target)
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// checkTarget makes one attempt to reach a target.
+func checkTarget(ctx context.Context, client *http.Client, target string) error {
+	if isHTTPTarget(target) {
+		return checkHTTP(ctx, client, target)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWaitForDependencies checks both kinds of target, including one that
+// only comes up after a few attempts.
+func TestWaitForDependencies(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer web.Close()
+
+	// Find a free port, then start listening on it a little later.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		late, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { late.Close() })
+	}()
+
+	err = waitForDependencies(context.Background(), realClock{}, web.Client(), []string{web.URL, addr}, 10*time.Second)
+	if err != nil {
+		t.Errorf("Expected both dependencies to become reachable, got %v", err)
+	}
+}
+
+// TestWaitForDependenciesTimeout checks the deadline is respected and the
+// error names what was unreachable.
+func TestWaitForDependenciesTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	start := time.Now()
+	err = waitForDependencies(context.Background(), realClock{}, http.DefaultClient, []string{addr}, 500*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), addr) {
+		t.Errorf("Expected an error naming %s, got %v", addr, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected to give up after the timeout, took %v", elapsed)
+	}
+}
+
+// TestWaitBackoff checks the pause grows and stays within bounds.
+func TestWaitBackoff(t *testing.T) {
+	for attempt := range 100 {
+		want := min(waitInitialBackoff<<min(attempt, 10), waitMaxBackoff)
+		if d := waitBackoff(attempt); d < want/2 || d > want {
+			t.Errorf("Attempt %d: expected between %v and %v, got %v", attempt, want/2, want, d)
+		}
+	}
+}
+
+// TestValidWaitTarget checks the accepted forms of WAIT_FOR entries.
+func TestValidWaitTarget(t *testing.T) {
+	for target, want := range map[string]bool{
+		"db:5432":                  true,
+		"[::1]:6379":               true,
+		"http://ollama:11434/":     true,
+		"https://example.com/ping": true,
+		"db":                       false,
+		":5432":                    false,
+		"ftp://files":              false,
+		"http://":                  false,
+	} {
+		if got := validWaitTarget(target); got != want {
+			t.Errorf("%q: expected %v, got %v", target, want, got)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements GET /api/v1/weather?city=..., which looks up the
+// current weather from a public API (Open-Meteo by default) and caches it.
+// It's a small example of what a caching reverse proxy does:
+//
+//   - Results are cached for WEATHER_CACHE_TTL, so repeated requests for a
+//     city don't hit the upstream API. The X-Cache header says whether a
+//     response came from the cache (HIT) or not (MISS).
+//   - Concurrent requests for the same city share a single upstream call
+//     rather than each making their own (known as request coalescing).
+//   - When the upstream API is down, an expired result is served instead of
+//     an error, marked with X-Cache: STALE and a Warning header. Slightly
+//     old weather is more useful than none.
+//
+// Upstream calls go through the server's instrumented client, so they show
+// up in /metrics as http_client_requests_total.
+
+// maxWeatherCities bounds the cache, so clients asking for endless made-up
+// cities can't make it grow forever.
+const maxWeatherCities = 1000
+
+// maxCityLength is the longest city name accepted.
+const maxCityLength = 100
+
+// weatherTimeout bounds one lookup (geocoding plus forecast).
+const weatherTimeout = 10 * time.Second
+
+// errCityNotFound is returned when the geocoding API doesn't know a city.
+var errCityNotFound = errors.New("city not found")
+
+// Weather is the JSON body returned by GET /api/v1/weather.
+type Weather struct {
+	City      string  `json:"city"`
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	TemperatureC float64 `json:"temperature_c"`
+	WindSpeedKmh float64 `json:"wind_speed_kmh"`
+
+	// WeatherCode is a WMO weather interpretation code, and Description
+	// its meaning in words.
+	WeatherCode int    `json:"weather_code"`
+	Description string `json:"description"`
+
+	ObservedAt time.Time `json:"observed_at"` // when the upstream measured it
+	FetchedAt  time.Time `json:"fetched_at"`  // when we asked the upstream
+}
+
+// weatherCall is an upstream lookup in progress. Requests for a city that's
+// already being looked up wait for done and share the result.
+type weatherCall struct {
+	done    chan struct{}
+	weather Weather
+	err     error
+}
+
+// WeatherService looks up and caches the weather. It's safe for concurrent
+// use.
+type WeatherService struct {
+	geocodingURL string
+	forecastURL  string
+	client       *http.Client
+	ttl          time.Duration
+	maxStale     time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]Weather // by normalized city name
+	inflight map[string]*weatherCall
+}
+
+// newWeatherService creates a weather service for the configuration, making
+// upstream calls with client.
+func newWeatherService(cfg Config, client *http.Client) *WeatherService {
+	return &WeatherService{
+		geocodingURL: cfg.WeatherGeocodingURL,
+		forecastURL:  cfg.WeatherForecastURL,
+		client:       client,
+		ttl:          cfg.WeatherCacheTTL,
+		maxStale:     cfg.WeatherMaxStale,
+		cache:        make(map[string]Weather),
+		inflight:     make(map[string]*weatherCall),
+	}
+}
+
+// cacheStatus says where a Lookup result came from, as sent in X-Cache.
+type cacheStatus string
+
+const (
+	cacheHit   cacheStatus = "HIT"
+	cacheMiss  cacheStatus = "MISS"
+	cacheStale cacheStatus = "STALE"
+)
+
+// Lookup returns the weather in city, from the cache if it's fresh enough.
+// Otherwise it asks the upstream API, and if that fails falls back to a
+// stale cached result when there's one.
+func (ws *WeatherService) Lookup(ctx context.Context, city string, now time.Time) (Weather, cacheStatus, error) {
+	key := strings.ToLower(strings.TrimSpace(city))
+
+	ws.mu.Lock()
+	cached, ok := ws.cache[key]
+	if ok && now.Sub(cached.FetchedAt) < ws.ttl {
+		ws.mu.Unlock()
+		return cached, cacheHit, nil
+	}
+
+	call, shared := ws.inflight[key]
+	if !shared {
+		call = &weatherCall{done: make(chan struct{})}
+		ws.inflight[key] = call
+	}
+	ws.mu.Unlock()
+
+	if !shared {
+		// The lookup runs on behalf of every waiting request, so it must
+		// not be cancelled just because the first one gives up.
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), weatherTimeout)
+		call.weather, call.err = ws.fetch(fetchCtx, city, now)
+		cancel()
+
+		ws.mu.Lock()
+		if call.err == nil {
+			ws.store(key, call.weather, now)
+		}
+		delete(ws.inflight, key)
+		ws.mu.Unlock()
+		close(call.done)
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return Weather{}, "", ctx.Err()
+	}
+
+	if call.err == nil {
+		return call.weather, cacheMiss, nil
+	}
+	if ok && !errors.Is(call.err, errCityNotFound) && now.Sub(cached.FetchedAt) < ws.ttl+ws.maxStale {
+		slog.WarnContext(ctx, "weather API failed, serving stale result", "city", key, "error", call.err)
+		return cached, cacheStale, nil
+	}
+	return Weather{}, "", call.err
+}
+
+// store adds a result to the cache, first making room if it's full by
+// dropping entries too old to serve, then the oldest ones. The caller holds
+// ws.mu.
+func (ws *WeatherService) store(key string, w Weather, now time.Time) {
+	if _, ok := ws.cache[key]; !ok && len(ws.cache) >= maxWeatherCities {
+		for k, cached := range ws.cache {
+			if now.Sub(cached.FetchedAt) >= ws.ttl+ws.maxStale {
+				delete(ws.cache, k)
+			}
+		}
+		for len(ws.cache) >= maxWeatherCities {
+			var oldest string
+			for k, cached := range ws.cache {
+				if oldest == "" || cached.FetchedAt.Before(ws.cache[oldest].FetchedAt) {
+					oldest = k
+				}
+			}
+			delete(ws.cache, oldest)
+		}
+	}
+	ws.cache[key] = w
+}
+
+// fetch asks the upstream API for the weather in city. That takes two
+// calls: geocoding turns the name into coordinates, then the forecast API
+// reports the current conditions there.
+func (ws *WeatherService) fetch(ctx context.Context, city string, now time.Time) (Weather, error) {
+	var places struct {
+		Results []struct {
+			Name      string  `json:"name"`
+			Country   string  `json:"country"`
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"results"`
+	}
+	query := url.Values{"name": {city}, "count": {"1"}, "language": {"en"}, "format": {"json"}}
+	if err := ws.get(ctx, ws.geocodingURL, query, &places); err != nil {
+		return Weather{}, fmt.Errorf("geocoding: %w", err)
+	}
+	if len(places.Results) == 0 {
+		return Weather{}, errCityNotFound
+	}
+	place := places.Results[0]
+
+	var forecast struct {
+		Current struct {
+			Time        int64   `json:"time"`
+			Temperature float64 `json:"temperature_2m"`
+			WindSpeed   float64 `json:"wind_speed_10m"`
+			WeatherCode int     `json:"weather_code"`
+		} `json:"current"`
+	}
+	query = url.Values{
+		"latitude":   {strconv.FormatFloat(place.Latitude, 'f', -1, 64)},
+		"longitude":  {strconv.FormatFloat(place.Longitude, 'f', -1, 64)},
+		"current":    {"temperature_2m,wind_speed_10m,weather_code"},
+		"timeformat": {"unixtime"},
+	}
+	if err := ws.get(ctx, ws.forecastURL, query, &forecast); err != nil {
+		return Weather{}, fmt.Errorf("forecast: %w", err)
+	}
+
+	return Weather{
+		City:         place.Name,
+		Country:      place.Country,
+		Latitude:     place.Latitude,
+		Longitude:    place.Longitude,
+		TemperatureC: forecast.Current.Temperature,
+		WindSpeedKmh: forecast.Current.WindSpeed,
+		WeatherCode:  forecast.Current.WeatherCode,
+		Description:  weatherDescription(forecast.Current.WeatherCode),
+		ObservedAt:   time.Unix(forecast.Current.Time, 0).UTC(),
+		FetchedAt:    now,
+	}, nil
+}
+
+// get calls an upstream endpoint and decodes its JSON response into v.
+func (ws *WeatherService) get(ctx context.Context, endpoint string, query url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return doJSON(ws.client, req, v)
+}
+
+// weatherDescriptions describes the WMO weather interpretation codes that
+// Open-Meteo reports.
+var weatherDescriptions = map[int]string{
+	0: "Clear sky", 1: "Mainly clear", 2: "Partly cloudy", 3: "Overcast",
+	45: "Fog", 48: "Depositing rime fog",
+	51: "Light drizzle", 53: "Moderate drizzle", 55: "Dense drizzle",
+	56: "Light freezing drizzle", 57: "Dense freezing drizzle",
+	61: "Slight rain", 63: "Moderate rain", 65: "Heavy rain",
+	66: "Light freezing rain", 67: "Heavy freezing rain",
+	71: "Slight snowfall", 73: "Moderate snowfall", 75: "Heavy snowfall",
+	77: "Snow grains",
+	80: "Slight rain showers", 81: "Moderate rain showers", 82: "Violent rain showers",
+	85: "Slight snow showers", 86: "Heavy snow showers",
+	95: "Thunderstorm", 96: "Thunderstorm with slight hail", 99: "Thunderstorm with heavy hail",
+}
+
+// weatherDescription describes a WMO weather code.
+func weatherDescription(code int) string {
+	if d, ok := weatherDescriptions[code]; ok {
+		return d
+	}
+	return "Unknown"
+}
+
+// handleWeather returns the current weather in the city given by the city
+// query parameter. Besides X-Cache, responses carry the standard caching
+// headers a proxy or browser in front of us would use: Age (how old the
+// result is) and Cache-Control (how much longer it may be reused).
+func (s *Server) handleWeather(w http.ResponseWriter, r *http.Request) {
+	city := strings.TrimSpace(r.URL.Query().Get("city"))
+	if city == "" {
+		writeProblem(w, http.StatusBadRequest, "the city parameter is required")
+		return
+	}
+	if len(city) > maxCityLength {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("city must be at most %d bytes", maxCityLength))
+		return
+	}
+
+	now := s.clock.Now()
+	weather, status, err := s.weather.Lookup(r.Context(), city, now)
+	switch {
+	case errors.Is(err, errCityNotFound):
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("no city called %q", city))
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "weather lookup failed", "city", city, "error", err)
+		writeProblem(w, http.StatusBadGateway, "the weather service is unavailable, try again later")
+		return
+	}
+
+	age := now.Sub(weather.FetchedAt)
+	maxAge := max(s.weather.ttl-age, 0)
+	w.Header().Set("X-Cache", string(status))
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	if status == cacheStale {
+		// Warning codes from RFC 7234: the response is stale, because
+		// fetching a fresh one failed.
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+		w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	}
+	writeJSON(w, http.StatusOK, weather)
+}
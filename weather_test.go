@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWeatherAPI imitates Open-Meteo's geocoding and forecast endpoints.
+// It knows one city, counts forecast calls, and fails while down is set.
+type fakeWeatherAPI struct {
+	*httptest.Server
+	forecasts atomic.Int32
+	down      atomic.Bool
+	gate      chan struct{} // if set, forecasts wait for it to close
+}
+
+func newFakeWeatherAPI(t *testing.T) *fakeWeatherAPI {
+	api := &fakeWeatherAPI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		if api.down.Load() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Query().Get("name") != "Paris" && r.URL.Query().Get("name") != "paris" {
+			w.Write([]byte(`{"generationtime_ms": 0.1}`))
+			return
+		}
+		w.Write([]byte(`{"results": [{"name": "Paris", "country": "France", "latitude": 48.85341, "longitude": 2.3488}]}`))
+	})
+	mux.HandleFunc("GET /forecast", func(w http.ResponseWriter, r *http.Request) {
+		if api.gate != nil {
+			<-api.gate
+		}
+		api.forecasts.Add(1)
+		if r.URL.Query().Get("latitude") != "48.85341" {
+			http.Error(w, "bad coordinates", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"current": {"time": 1704110400, "temperature_2m": 5.5, "wind_speed_10m": 12, "weather_code": 3}}`))
+	})
+	api.Server = httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+	return api
+}
+
+// newTestWeatherService returns a weather service using api.
+func newTestWeatherService(t *testing.T, api *fakeWeatherAPI) *WeatherService {
+	cfg := defaultConfig(t)
+	cfg.WeatherGeocodingURL = api.URL + "/search"
+	cfg.WeatherForecastURL = api.URL + "/forecast"
+	return newWeatherService(cfg, api.Client())
+}
+
+// TestWeatherCaching walks a city through a miss, a hit, a stale result
+// while the API is down, and an error once it's too old to serve.
+func TestWeatherCaching(t *testing.T) {
+	api := newFakeWeatherAPI(t)
+	ws := newTestWeatherService(t, api)
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	weather, status, err := ws.Lookup(ctx, "Paris", now)
+	if err != nil || status != cacheMiss {
+		t.Fatalf("Expected a miss, got %s, %v", status, err)
+	}
+	if weather.City != "Paris" || weather.TemperatureC != 5.5 || weather.Description != "Overcast" || !weather.ObservedAt.Equal(time.Unix(1704110400, 0)) {
+		t.Errorf("Unexpected weather %+v", weather)
+	}
+
+	if _, status, _ := ws.Lookup(ctx, " paris ", now.Add(time.Minute)); status != cacheHit || api.forecasts.Load() != 1 {
+		t.Errorf("Expected a hit without calling the API, got %s after %d calls", status, api.forecasts.Load())
+	}
+
+	api.down.Store(true)
+	if _, status, err := ws.Lookup(ctx, "Paris", now.Add(time.Hour)); err != nil || status != cacheStale {
+		t.Errorf("Expected a stale result, got %s, %v", status, err)
+	}
+	if _, _, err := ws.Lookup(ctx, "Paris", now.Add(7*time.Hour)); err == nil {
+		t.Error("Expected an error once the result is too old to serve")
+	}
+
+	api.down.Store(false)
+	if _, _, err := ws.Lookup(ctx, "Atlantis", now); err != errCityNotFound {
+		t.Errorf("Expected errCityNotFound, got %v", err)
+	}
+}
+
+// TestWeatherCoalescing checks concurrent requests for a city share one
+// upstream call.
+func TestWeatherCoalescing(t *testing.T) {
+	api := newFakeWeatherAPI(t)
+	api.gate = make(chan struct{})
+	ws := newTestWeatherService(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := ws.Lookup(context.Background(), "Paris", time.Now()); err != nil {
+				t.Errorf("Lookup failed: %v", err)
+			}
+		}()
+	}
+
+	// Give the goroutines time to queue up behind the first call.
+	time.Sleep(50 * time.Millisecond)
+	close(api.gate)
+	wg.Wait()
+
+	if got := api.forecasts.Load(); got != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", got)
+	}
+}
+
+// TestHandleWeather checks the status codes and caching headers.
+func TestHandleWeather(t *testing.T) {
+	api := newFakeWeatherAPI(t)
+	srv := newServer(defaultConfig(t))
+	srv.weather = newTestWeatherService(t, api)
+	mux := srv.routes()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/weather"+query, nil))
+		return rec
+	}
+
+	rec := get("?city=Paris")
+	var weather Weather
+	if err := json.Unmarshal(rec.Body.Bytes(), &weather); err != nil || rec.Code != http.StatusOK || weather.City != "Paris" {
+		t.Fatalf("Expected Paris's weather, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Header().Get("Cache-Control") != "public, max-age=600" {
+		t.Errorf("Unexpected caching headers %v", rec.Header())
+	}
+	if rec := get("?city=Paris"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected a cache hit, got %q", rec.Header().Get("X-Cache"))
+	}
+
+	for query, status := range map[string]int{"": http.StatusBadRequest, "?city=Atlantis": http.StatusNotFound} {
+		if rec := get(query); rec.Code != status {
+			t.Errorf("%q: expected %d, got %d", query, status, rec.Code)
+		}
+	}
+
+	api.down.Store(true)
+	if rec := get("?city=Lyon"); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 with the API down and nothing cached, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of the WebSocket protocol (RFC 6455)
+// for the server to push messages to a client, as the log tail does (see
+// logtail.go). The standard library doesn't include WebSockets, and the
+// server side of the parts used here is short enough to write out.
+//
+// A WebSocket starts as an ordinary HTTP request, asking to upgrade:
+//
+//	GET /admin/logs/tail HTTP/1.1
+//	Connection: Upgrade
+//	Upgrade: websocket
+//	Sec-WebSocket-Version: 13
+//	Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==
+//
+// The server agrees with 101 Switching Protocols, proving it understood by
+// hashing the key, and from then on the TCP connection carries frames in
+// both directions rather than HTTP. The handler takes the connection over
+// from net/http with Hijack, so it's no longer an HTTP response: the
+// server's timeouts and the middleware that buffer or rewrite responses
+// don't apply to it any more.
+//
+// Each frame has an opcode (text, binary, close, ping, pong) and a length.
+// Frames from the client are masked, XORed with a key sent along with
+// them, so that a proxy that doesn't understand WebSockets can't be
+// tricked into caching them; frames from the server aren't. What isn't
+// implemented: fragmented messages from the client, extensions such as
+// compression, and subprotocols. The client's messages are read only to
+// answer pings and to notice it closing.
+
+// websocketGUID is mixed into the key to make the accept header.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage limits the frames read from a client.
+const maxWebSocketMessage = 4096
+
+// WebSocket opcodes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal    = 1000
+	wsCloseGoingAway = 1001
+	wsCloseProtocol  = 1002
+	wsCloseTooBig    = 1009
+)
+
+// errNotWebSocket means the request didn't ask to upgrade to a WebSocket.
+var errNotWebSocket = errors.New("not a WebSocket upgrade request")
+
+// wsConn is the server's end of a WebSocket.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	mu sync.Mutex // held while writing a frame
+}
+
+// upgradeWebSocket answers a request to upgrade to a WebSocket and takes
+// the connection over. If the request isn't one, or the connection can't be
+// taken over, it writes the problem response itself and returns an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		writeProblem(w, http.StatusUpgradeRequired, "this endpoint is a WebSocket")
+		return nil, errNotWebSocket
+	}
+	// Browsers let any page open a WebSocket to any server, sending its
+	// cookies and credentials along, so one from another site is refused.
+	if crossSite(r) {
+		writeProblem(w, http.StatusForbidden, "WebSockets from other sites are refused")
+		return nil, errNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeProblem(w, http.StatusBadRequest, "only WebSocket version 13 is supported")
+		return nil, errNotWebSocket
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, "the connection can't be upgraded")
+		return nil, err
+	}
+	// The server's deadlines were for the HTTP request; the WebSocket lives
+	// as long as both ends want it to.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// websocketAccept is the Sec-WebSocket-Accept answer to a key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma-separated header has token in it,
+// ignoring case: browsers send "Connection: keep-alive, Upgrade".
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteText sends a text message.
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(wsText, data)
+}
+
+// Close sends a close frame with code and closes the connection.
+func (c *wsConn) Close(code int) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(wsClose, payload)
+	return c.conn.Close()
+}
+
+// writeFrame sends one unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | opcode} // FIN: this frame is the whole message
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// ReadLoop reads the client's frames, answering pings, until the client
+// closes the connection or breaks the protocol. Other messages are
+// discarded. It returns when the connection is done with.
+func (c *wsConn) ReadLoop() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			code := wsCloseProtocol
+			if errors.Is(err, errWebSocketTooBig) {
+				code = wsCloseTooBig
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.Close(code)
+			}
+			return
+		}
+		switch opcode {
+		case wsClose:
+			c.Close(wsCloseNormal)
+			return
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		}
+	}
+}
+
+// errWebSocketTooBig means a client's frame was over maxWebSocketMessage.
+var errWebSocketTooBig = errors.New("WebSocket frame too big")
+
+// readFrame reads one frame from the client and unmasks it.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("client frames must be masked")
+	}
+
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxWebSocketMessage {
+		return 0, nil, errWebSocketTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0F, payload, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client's end of a WebSocket, for tests.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWebSocket opens a WebSocket to path on srv, sending header with the
+// upgrade request, and fails the test unless the server agrees.
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string, header http.Header) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %s", resp.Status)
+	}
+	// The example from RFC 6455, section 1.3.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Wrong Sec-WebSocket-Accept %q", got)
+	}
+	return &wsClient{t: t, conn: conn, br: br}
+}
+
+// Read returns the next frame from the server.
+func (c *wsClient) Read() (opcode byte, payload []byte) {
+	c.t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		c.t.Fatal("Server frames mustn't be masked")
+	}
+	n := int(head[1])
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+// Write sends a masked frame to the server.
+func (c *wsClient) Write(opcode byte, payload []byte) {
+	c.t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// TestWebSocketFrames checks the server answers pings, sends frames of each
+// length encoding, and answers a close.
+func TestWebSocketFrames(t *testing.T) {
+	sizes := []int{5, 300, 70000}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		for _, n := range sizes {
+			ws.WriteText([]byte(strings.Repeat("x", n)))
+		}
+		ws.ReadLoop()
+	}))
+	defer srv.Close()
+
+	c := dialWebSocket(t, srv, "/", nil)
+	for _, n := range sizes {
+		if opcode, payload := c.Read(); opcode != wsText || len(payload) != n {
+			t.Errorf("Expected a text frame of %d bytes, got opcode %d with %d", n, opcode, len(payload))
+		}
+	}
+
+	c.Write(wsPing, []byte("hi"))
+	if opcode, payload := c.Read(); opcode != wsPong || string(payload) != "hi" {
+		t.Errorf("Expected a pong with the ping's payload, got %d %q", opcode, payload)
+	}
+	c.Write(wsClose, []byte{0x03, 0xE8})
+	if opcode, payload := c.Read(); opcode != wsClose || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Errorf("Expected a normal close, got %d %v", opcode, payload)
+	}
+}
+
+// TestWebSocketNotUpgrade checks a plain request is told to upgrade.
+func TestWebSocketNotUpgrade(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if _, err := upgradeWebSocket(rec, httptest.NewRequest(http.MethodGet, "/", nil)); err != errNotWebSocket {
+		t.Errorf("Expected errNotWebSocket, got %v", err)
+	}
+	if rec.Code != http.StatusUpgradeRequired || rec.Header().Get("Upgrade") != "websocket" {
+		t.Errorf("Expected 426 asking for a WebSocket, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+// TestWebSocketCrossSite checks an upgrade from another site's page is
+// refused.
+func TestWebSocketCrossSite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "https://evil.example")
+	rec := httptest.NewRecorder()
+	if _, err := upgradeWebSocket(rec, req); err != errNotWebSocket || rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d (%v)", rec.Code, err)
+	}
+}